@@ -0,0 +1,173 @@
+// Package automation waits for conditions on the remote screen, for
+// login automation and monitoring scripts:
+//
+//	client := grdp.New(host, grdp.WithFramebuffer())
+//	client.Login(domain, user, password)
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+//	defer cancel()
+//	if _, err := automation.WaitForImage(ctx, client, startButton, 8); err != nil {
+//		log.Fatal("desktop not shown: ", err)
+//	}
+//
+// The helpers wake up on every screen update instead of polling, and
+// return ctx.Err() when ctx ends first.
+package automation
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"time"
+)
+
+// Screen is the remote screen the helpers watch.  An RdpClient created
+// with WithFramebuffer implements it.
+type Screen interface {
+	// Snapshot returns a copy of the screen, nil when there is none.
+	Snapshot() *image.RGBA
+	// SnapshotRect returns a copy of area r of the screen.
+	SnapshotRect(r image.Rectangle) *image.RGBA
+	// Updated returns a channel closed by the next screen update.
+	Updated() <-chan struct{}
+}
+
+// ErrNoScreen is returned when the Screen keeps no image, such as an
+// RdpClient without WithFramebuffer.
+var ErrNoScreen = errors.New("automation: no screen image; use grdp.WithFramebuffer")
+
+// WaitForRegionStable waits until area r of the screen has not changed
+// for quiet, for instance until an animation or a progressive repaint
+// ends, and returns its image.
+func WaitForRegionStable(ctx context.Context, s Screen, r image.Rectangle, quiet time.Duration) (*image.RGBA, error) {
+	updated := s.Updated()
+	if updated == nil {
+		return nil, ErrNoScreen
+	}
+	last := s.SnapshotRect(r)
+	timer := time.NewTimer(quiet)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return last, nil
+		case <-updated:
+			updated = s.Updated()
+			img := s.SnapshotRect(r)
+			if img.Rect != last.Rect || !equalPix(img, last) {
+				last = img
+				timer.Reset(quiet)
+			}
+		}
+	}
+}
+
+// WaitForPixel waits until the pixel at x, y has color c, each of its
+// red, green and blue within tolerance, which absorbs the error of lossy
+// codecs.
+func WaitForPixel(ctx context.Context, s Screen, x, y int, c color.Color, tolerance int) error {
+	want := color.RGBAModel.Convert(c).(color.RGBA)
+	return waitFor(ctx, s, func() bool {
+		img := s.SnapshotRect(image.Rect(x, y, x+1, y+1))
+		if img.Rect.Empty() {
+			return false
+		}
+		p := img.RGBAAt(x, y)
+		return near(p.R, want.R, tolerance) && near(p.G, want.G, tolerance) && near(p.B, want.B, tolerance)
+	})
+}
+
+// WaitForImage waits until template appears anywhere on the screen, each
+// pixel within tolerance per color component, and returns the position of
+// its top left corner.  The search is exhaustive, so templates should be
+// small, such as an icon or a button.
+func WaitForImage(ctx context.Context, s Screen, template image.Image, tolerance int) (image.Point, error) {
+	tmpl := toRGBA(template)
+	var at image.Point
+	err := waitFor(ctx, s, func() bool {
+		var ok bool
+		at, ok = find(s.Snapshot(), tmpl, tolerance)
+		return ok
+	})
+	return at, err
+}
+
+// waitFor calls cond after every screen update until it is true.
+func waitFor(ctx context.Context, s Screen, cond func() bool) error {
+	for {
+		updated := s.Updated()
+		if updated == nil {
+			return ErrNoScreen
+		}
+		if cond() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// find returns the first position, in reading order, where tmpl matches
+// img.
+func find(img, tmpl *image.RGBA, tolerance int) (image.Point, bool) {
+	if img == nil {
+		return image.Point{}, false
+	}
+	tw, th := tmpl.Rect.Dx(), tmpl.Rect.Dy()
+	for y := img.Rect.Min.Y; y+th <= img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x+tw <= img.Rect.Max.X; x++ {
+			if matchAt(img, tmpl, x, y, tolerance) {
+				return image.Pt(x, y), true
+			}
+		}
+	}
+	return image.Point{}, false
+}
+
+func matchAt(img, tmpl *image.RGBA, x, y, tolerance int) bool {
+	tw := tmpl.Rect.Dx() * 4
+	for ty := 0; ty < tmpl.Rect.Dy(); ty++ {
+		row := img.Pix[img.PixOffset(x, y+ty):]
+		trow := tmpl.Pix[ty*tmpl.Stride:]
+		for i := 0; i < tw; i += 4 {
+			if !near(row[i], trow[i], tolerance) || !near(row[i+1], trow[i+1], tolerance) || !near(row[i+2], trow[i+2], tolerance) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func near(a, b uint8, tolerance int) bool {
+	d := int(a) - int(b)
+	return d <= tolerance && -d <= tolerance
+}
+
+func equalPix(a, b *image.RGBA) bool {
+	for y := 0; y < a.Rect.Dy(); y++ {
+		ra := a.Pix[y*a.Stride : y*a.Stride+a.Rect.Dx()*4]
+		rb := b.Pix[y*b.Stride : y*b.Stride+b.Rect.Dx()*4]
+		if !bytes.Equal(ra, rb) {
+			return false
+		}
+	}
+	return true
+}
+
+// toRGBA returns img as an *image.RGBA with its origin at 0, 0.
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			out.Set(x, y, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
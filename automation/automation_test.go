@@ -0,0 +1,117 @@
+package automation
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp"
+)
+
+var _ Screen = (*grdp.RdpClient)(nil)
+
+// screen is a Screen painted by the test.
+type screen struct {
+	mu      sync.Mutex
+	img     *image.RGBA
+	updated chan struct{}
+}
+
+func newScreen(w, h int) *screen {
+	return &screen{img: image.NewRGBA(image.Rect(0, 0, w, h)), updated: make(chan struct{})}
+}
+
+func (s *screen) fill(r image.Rectangle, c color.RGBA) {
+	s.mu.Lock()
+	draw.Draw(s.img, r, image.NewUniform(c), image.Point{}, draw.Src)
+	close(s.updated)
+	s.updated = make(chan struct{})
+	s.mu.Unlock()
+}
+
+func (s *screen) Snapshot() *image.RGBA { return s.SnapshotRect(s.img.Rect) }
+
+func (s *screen) SnapshotRect(r image.Rectangle) *image.RGBA {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r = r.Intersect(s.img.Rect)
+	img := image.NewRGBA(r)
+	draw.Draw(img, r, s.img, r.Min, draw.Src)
+	return img
+}
+
+func (s *screen) Updated() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updated
+}
+
+var red = color.RGBA{0xFF, 0, 0, 0xFF}
+
+func TestWaitForPixel(t *testing.T) {
+	s := newScreen(16, 16)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.fill(image.Rect(4, 4, 8, 8), color.RGBA{0xF8, 4, 0, 0xFF})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := WaitForPixel(ctx, s, 5, 5, red, 8); err != nil {
+		t.Error(err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := WaitForPixel(ctx, s, 0, 0, red, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("pixel never painted: %v", err)
+	}
+}
+
+func TestWaitForImage(t *testing.T) {
+	s := newScreen(32, 32)
+	tmpl := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	draw.Draw(tmpl, tmpl.Rect, image.NewUniform(red), image.Point{}, draw.Src)
+	tmpl.SetRGBA(2, 1, color.RGBA{0, 0, 0xFF, 0xFF})
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.fill(image.Rect(10, 20, 13, 22), red)
+		s.fill(image.Rect(12, 21, 13, 22), color.RGBA{0, 0, 0xFF, 0xFF})
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if at, err := WaitForImage(ctx, s, tmpl, 0); err != nil || at != image.Pt(10, 20) {
+		t.Errorf("found at %v, %v", at, err)
+	}
+}
+
+func TestWaitForRegionStable(t *testing.T) {
+	s := newScreen(16, 16)
+	go func() {
+		for i := range 5 {
+			s.fill(image.Rect(0, 0, 4, 4), color.RGBA{uint8(i * 40), 0, 0, 0xFF})
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	img, err := WaitForRegionStable(ctx, s, image.Rect(0, 0, 4, 4), 50*time.Millisecond)
+	if err != nil || img.RGBAAt(0, 0).R != 160 {
+		t.Errorf("stable region %v, %v", img.RGBAAt(0, 0), err)
+	}
+
+	if _, err := WaitForRegionStable(ctx, noScreen{}, image.Rect(0, 0, 4, 4), time.Millisecond); err != ErrNoScreen {
+		t.Errorf("no screen: %v", err)
+	}
+}
+
+type noScreen struct{}
+
+func (noScreen) Snapshot() *image.RGBA                    { return nil }
+func (noScreen) SnapshotRect(image.Rectangle) *image.RGBA { return nil }
+func (noScreen) Updated() <-chan struct{}                 { return nil }
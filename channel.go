@@ -0,0 +1,183 @@
+package grdp
+
+import (
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/nakagami/grdp/plugin"
+	"github.com/nakagami/grdp/plugin/drdynvc"
+	"github.com/nakagami/grdp/plugin/rail"
+	"github.com/nakagami/grdp/plugin/rdpdr/scard"
+	"github.com/nakagami/grdp/plugin/rdpeai"
+	"github.com/nakagami/grdp/plugin/rdpsnd"
+)
+
+// maxStaticChannels is the number of static virtual channels a client
+// may request, including the five grdp implements (MS-RDPBCGR
+// 2.2.1.3.4).
+const maxStaticChannels = 31
+
+// builtinStaticChannels are the static channels grdp implements.  doLogin
+// always requests them, except rail, which only RemoteApp sessions use.
+var builtinStaticChannels = []string{
+	plugin.RDPDR_SVC_CHANNEL_NAME,
+	rdpsnd.ChannelName,
+	plugin.CLIPRDR_SVC_CHANNEL_NAME,
+	rail.ChannelName,
+	drdynvc.ChannelName,
+}
+
+// channelPlugin is a ChannelPlugin registered with the client.
+// Dynamic channels have no options.
+type channelPlugin struct {
+	name    string
+	options uint32
+	dynamic bool
+	p       plugin.ChannelPlugin
+}
+
+// pluginChannel is the StaticChannel or DynamicChannel serving a
+// ChannelPlugin on the current connection.
+type pluginChannel interface {
+	Close()
+}
+
+// RegisterStaticChannel adds the static virtual channel name, at most 7
+// characters, served by p.  options are the CHANNEL_OPTION_* flags; 0
+// requests CHANNEL_OPTION_INITIALIZED | CHANNEL_OPTION_ENCRYPT_RDP.
+// Call it before Login.  p opens once the session is active, or earlier
+// if the server sends on the channel first, and closes when the
+// connection does; it is opened again on each reconnection.
+func (g *RdpClient) RegisterStaticChannel(name string, options uint32, p plugin.ChannelPlugin) error {
+	if name == "" || len(name) > plugin.CHANNEL_NAME_LEN {
+		return fmt.Errorf("static channel name %q: must be 1 to %d characters", name, plugin.CHANNEL_NAME_LEN)
+	}
+	n := len(builtinStaticChannels)
+	for _, b := range builtinStaticChannels {
+		if name == b {
+			return fmt.Errorf("static channel %s is implemented by grdp", name)
+		}
+	}
+	for _, c := range g.channelPlugins {
+		if !c.dynamic {
+			if c.name == name {
+				return fmt.Errorf("static channel %s already registered", name)
+			}
+			n++
+		}
+	}
+	if n >= maxStaticChannels {
+		return fmt.Errorf("static channel %s: at most %d static channels", name, maxStaticChannels)
+	}
+	if options == 0 {
+		options = plugin.CHANNEL_OPTION_INITIALIZED | plugin.CHANNEL_OPTION_ENCRYPT_RDP
+	}
+	g.channelPlugins = append(g.channelPlugins, channelPlugin{name: name, options: options, p: p})
+	return nil
+}
+
+// RegisterDynamicChannel serves the dynamic virtual channel name with p.
+// Call it before Login.  p opens each time the server creates the
+// channel and closes when the server closes it or the connection ends.
+// Registering a channel grdp implements, such as
+// "Microsoft::Windows::RDS::Input", replaces the built-in handler.
+func (g *RdpClient) RegisterDynamicChannel(name string, p plugin.ChannelPlugin) error {
+	if name == "" {
+		return fmt.Errorf("dynamic channel name is empty")
+	}
+	for _, c := range g.channelPlugins {
+		if c.dynamic && c.name == name {
+			return fmt.Errorf("dynamic channel %s already registered", name)
+		}
+	}
+	g.channelPlugins = append(g.channelPlugins, channelPlugin{name: name, dynamic: true, p: p})
+	return nil
+}
+
+// setupStaticChannels registers and requests the static channels of the
+// application.
+func (g *RdpClient) setupStaticChannels() {
+	for _, c := range g.channelPlugins {
+		if c.dynamic {
+			continue
+		}
+		// The name was checked by RegisterStaticChannel.
+		sc, _ := plugin.NewStaticChannel(c.name, c.options, c.p)
+		sc.SetLogger(g.logger)
+		g.channels.Register(sc)
+		g.mcs.SetClientVirtualChannel(c.name, c.options)
+		g.openChannels = append(g.openChannels, sc)
+	}
+}
+
+// setupDynamicChannels registers the dynamic channels of the application
+// with dvc.
+func (g *RdpClient) setupDynamicChannels(dvc *drdynvc.DvcClient) {
+	for _, c := range g.channelPlugins {
+		if !c.dynamic {
+			continue
+		}
+		dc := plugin.NewDynamicChannel(c.name, c.p)
+		dc.SetLogger(g.logger)
+		dvc.RegisterHandler(c.name, dc)
+		g.openChannels = append(g.openChannels, dc)
+	}
+}
+
+// openStaticChannels opens the static channels of the application once
+// the session is active.
+func (g *RdpClient) openStaticChannels() {
+	for _, c := range g.openChannels {
+		if sc, ok := c.(*plugin.StaticChannel); ok {
+			sc.Open()
+		}
+	}
+}
+
+// closeChannels closes the channels of the application and stops their
+// goroutines.
+func (g *RdpClient) closeChannels() {
+	for _, c := range g.openChannels {
+		c.Close()
+	}
+	g.openChannels = nil
+}
+
+// redirectedDrive is a drive added by RedirectDrive.
+type redirectedDrive struct {
+	name string
+	fsys fs.FS
+}
+
+// RedirectDrive shares fsys with the session as the drive name, which
+// programs on the server reach as \\tsclient\name.  The drive is
+// read-only unless fsys is an rdpdr.WritableFS, such as the one
+// rdpdr.OpenDir returns.  Call it before Login.
+func (g *RdpClient) RedirectDrive(name string, fsys fs.FS) error {
+	if name == "" || strings.ContainsAny(name, `\/:*?"<>|`) {
+		return fmt.Errorf("drive name %q is not a valid file name", name)
+	}
+	for _, d := range g.drives {
+		if strings.EqualFold(d.name, name) {
+			return fmt.Errorf("drive %s already redirected", name)
+		}
+	}
+	g.drives = append(g.drives, redirectedDrive{name: name, fsys: fsys})
+	return nil
+}
+
+// RedirectAudioInput lets the session record from src, for conferencing
+// and dictation applications.  Call it before Login.
+func (g *RdpClient) RedirectAudioInput(src rdpeai.AudioSource) *RdpClient {
+	g.audioSource = src
+	return g
+}
+
+// RedirectSmartCards makes the readers of p available to the session,
+// so that the user can log on and sign with a smart card attached to
+// the client.  Call it before Login.
+func (g *RdpClient) RedirectSmartCards(p scard.Provider) *RdpClient {
+	g.smartCards = p
+	return g
+}
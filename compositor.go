@@ -0,0 +1,270 @@
+package grdp
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+)
+
+// ScaleQuality selects how a Compositor scales the desktop.
+type ScaleQuality int
+
+const (
+	// ScaleNearest samples the nearest desktop pixel: fast, but text
+	// gets jagged when shrunk.
+	ScaleNearest ScaleQuality = iota
+	// ScaleSmooth averages the desktop pixels each viewport pixel covers,
+	// which keeps shrunk text legible.
+	ScaleSmooth
+)
+
+// Compositor implements "smart sizing": it composites bitmap updates into
+// a copy of the remote desktop and scales it to the viewport of the
+// caller, reporting the damaged viewport area after each update so a UI
+// only repaints what changed.  Pass Paint to RdpClient.OnBitmap and
+// ResizeDesktop to RdpClient.OnResize:
+//
+//	c := grdp.NewCompositor(1920, 1080, 1280, 720)
+//	c.OnDamage(func(r image.Rectangle) { window.Invalidate(r) })
+//	client.OnBitmap(c.Paint).OnResize(c.ResizeDesktop)
+//
+// and ToDesktop to map pointer positions back for input.
+type Compositor struct {
+	mu         sync.Mutex
+	desktop    *image.RGBA
+	view       *image.RGBA
+	content    image.Rectangle // area of view the desktop is scaled to
+	quality    ScaleQuality
+	keepAspect bool
+	dirty      image.Rectangle // viewport damage since the last Take
+	onDamage   func(image.Rectangle)
+}
+
+// NewCompositor returns a Compositor scaling a desktopWidth x
+// desktopHeight desktop to a viewWidth x viewHeight viewport with
+// ScaleSmooth.
+func NewCompositor(desktopWidth, desktopHeight, viewWidth, viewHeight int) *Compositor {
+	c := &Compositor{
+		desktop: image.NewRGBA(image.Rect(0, 0, desktopWidth, desktopHeight)),
+		view:    image.NewRGBA(image.Rect(0, 0, viewWidth, viewHeight)),
+		quality: ScaleSmooth,
+	}
+	c.layout()
+	c.redraw()
+	return c
+}
+
+// SetQuality selects the scaling of the following updates and redraws
+// the viewport.
+func (c *Compositor) SetQuality(q ScaleQuality) *Compositor {
+	c.mu.Lock()
+	c.quality = q
+	r := c.redraw()
+	c.mu.Unlock()
+	c.damaged(r)
+	return c
+}
+
+// SetKeepAspect letterboxes the desktop in the viewport, centred with
+// black bars, instead of stretching it to fill the viewport.
+func (c *Compositor) SetKeepAspect(keep bool) *Compositor {
+	c.mu.Lock()
+	c.keepAspect = keep
+	c.layout()
+	r := c.redraw()
+	c.mu.Unlock()
+	c.damaged(r)
+	return c
+}
+
+// OnDamage registers a callback with the viewport rectangle each update
+// changed.  It is called on the goroutine that calls Paint, after the
+// viewport image is up to date.
+func (c *Compositor) OnDamage(f func(r image.Rectangle)) *Compositor {
+	c.mu.Lock()
+	c.onDamage = f
+	c.mu.Unlock()
+	return c
+}
+
+// Paint composites bitmaps into the desktop and rescales the area they
+// cover.  It copies the pixels, so it can be used directly as an OnBitmap
+// callback.
+func (c *Compositor) Paint(bitmaps []Bitmap) {
+	c.mu.Lock()
+	var d image.Rectangle
+	for i := range bitmaps {
+		bm := &bitmaps[i]
+		dest := image.Rect(bm.DestLeft, bm.DestTop, bm.DestRight+1, bm.DestBottom+1)
+		d = d.Union(bm.BitmapToRGBAInto(c.desktop.SubImage(dest).(*image.RGBA), dest.Min))
+	}
+	r := c.scale(c.toView(d))
+	c.mu.Unlock()
+	c.damaged(r)
+}
+
+// ResizeDesktop follows a change of the size of the remote desktop,
+// which the server repaints afterwards.
+func (c *Compositor) ResizeDesktop(width, height int) {
+	c.mu.Lock()
+	c.desktop = image.NewRGBA(image.Rect(0, 0, width, height))
+	c.layout()
+	r := c.redraw()
+	c.mu.Unlock()
+	c.damaged(r)
+}
+
+// SetViewport follows a change of the size of the viewport, which is
+// redrawn whole.
+func (c *Compositor) SetViewport(width, height int) {
+	c.mu.Lock()
+	c.view = image.NewRGBA(image.Rect(0, 0, width, height))
+	c.layout()
+	r := c.redraw()
+	c.mu.Unlock()
+	c.damaged(r)
+}
+
+// Take returns a copy of the viewport area damaged since the previous
+// call, at its viewport coordinates, and clears the damage.  It returns
+// nil when nothing changed.
+func (c *Compositor) Take() *image.RGBA {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dirty.Empty() {
+		return nil
+	}
+	img := image.NewRGBA(c.dirty)
+	draw.Draw(img, c.dirty, c.view, c.dirty.Min, draw.Src)
+	c.dirty = image.Rectangle{}
+	return img
+}
+
+// Image returns a copy of the whole viewport.
+func (c *Compositor) Image() *image.RGBA {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	img := image.NewRGBA(c.view.Rect)
+	copy(img.Pix, c.view.Pix)
+	return img
+}
+
+// ToDesktop maps a viewport position, such as that of the pointer, to
+// the desktop.  It reports false for positions outside the scaled
+// desktop, on the letterbox bars.
+func (c *Compositor) ToDesktop(p image.Point) (image.Point, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !p.In(c.content) {
+		return image.Point{}, false
+	}
+	dw, dh := c.desktop.Rect.Dx(), c.desktop.Rect.Dy()
+	cw, ch := c.content.Dx(), c.content.Dy()
+	u, v := p.X-c.content.Min.X, p.Y-c.content.Min.Y
+	return image.Pt((2*u+1)*dw/(2*cw), (2*v+1)*dh/(2*ch)), true
+}
+
+// ToViewport maps a desktop rectangle to the viewport pixels it affects.
+func (c *Compositor) ToViewport(r image.Rectangle) image.Rectangle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.toView(r)
+}
+
+// layout places the scaled desktop in the viewport.
+func (c *Compositor) layout() {
+	vw, vh := c.view.Rect.Dx(), c.view.Rect.Dy()
+	dw, dh := c.desktop.Rect.Dx(), c.desktop.Rect.Dy()
+	c.content = c.view.Rect
+	if !c.keepAspect || dw == 0 || dh == 0 {
+		return
+	}
+	cw, ch := vw, vh
+	if vw*dh > vh*dw {
+		cw = vh * dw / dh
+	} else {
+		ch = vw * dh / dw
+	}
+	x, y := (vw-cw)/2, (vh-ch)/2
+	c.content = image.Rect(x, y, x+cw, y+ch)
+}
+
+// redraw clears the viewport and scales the whole desktop into it.
+func (c *Compositor) redraw() image.Rectangle {
+	clear(c.view.Pix)
+	for i := 3; i < len(c.view.Pix); i += 4 {
+		c.view.Pix[i] = 0xFF
+	}
+	c.scale(c.content)
+	return c.view.Rect
+}
+
+// toView maps desktop rectangle d to the viewport pixels whose desktop
+// area overlaps it.
+func (c *Compositor) toView(d image.Rectangle) image.Rectangle {
+	dw, dh := c.desktop.Rect.Dx(), c.desktop.Rect.Dy()
+	cw, ch := c.content.Dx(), c.content.Dy()
+	if d.Empty() || dw == 0 || dh == 0 {
+		return image.Rectangle{}
+	}
+	r := image.Rect(
+		d.Min.X*cw/dw, d.Min.Y*ch/dh,
+		(d.Max.X*cw+dw-1)/dw, (d.Max.Y*ch+dh-1)/dh,
+	).Add(c.content.Min)
+	return r.Intersect(c.content)
+}
+
+// scale renders the viewport pixels of r, within the content area, from
+// the desktop and returns r.
+func (c *Compositor) scale(r image.Rectangle) image.Rectangle {
+	r = r.Intersect(c.content)
+	dw, dh := c.desktop.Rect.Dx(), c.desktop.Rect.Dy()
+	cw, ch := c.content.Dx(), c.content.Dy()
+	if r.Empty() || dw == 0 || dh == 0 {
+		return image.Rectangle{}
+	}
+	src, dst := c.desktop, c.view
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		v := y - c.content.Min.Y
+		y0 := v * dh / ch
+		y1 := max(y0+1, ((v+1)*dh+ch-1)/ch)
+		row := dst.Pix[dst.PixOffset(r.Min.X, y):]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			u := x - c.content.Min.X
+			out := row[(x-r.Min.X)*4:]
+			if c.quality == ScaleNearest {
+				p := src.Pix[src.PixOffset((2*u+1)*dw/(2*cw), (2*v+1)*dh/(2*ch)):]
+				out[0], out[1], out[2], out[3] = p[0], p[1], p[2], 0xFF
+				continue
+			}
+			x0 := u * dw / cw
+			x1 := max(x0+1, ((u+1)*dw+cw-1)/cw)
+			var sr, sg, sb, n uint32
+			for sy := y0; sy < y1; sy++ {
+				p := src.Pix[src.PixOffset(x0, sy):]
+				for i := 0; i < (x1-x0)*4; i += 4 {
+					sr += uint32(p[i])
+					sg += uint32(p[i+1])
+					sb += uint32(p[i+2])
+				}
+				n += uint32(x1 - x0)
+			}
+			out[0], out[1], out[2], out[3] = uint8(sr/n), uint8(sg/n), uint8(sb/n), 0xFF
+		}
+	}
+	return r
+}
+
+// damaged records r and reports it to the OnDamage callback.
+func (c *Compositor) damaged(r image.Rectangle) {
+	if r.Empty() {
+		return
+	}
+	c.mu.Lock()
+	c.dirty = c.dirty.Union(r)
+	f := c.onDamage
+	c.mu.Unlock()
+	if f != nil {
+		f(r)
+	}
+}
@@ -0,0 +1,53 @@
+package grdp
+
+import (
+	"image"
+	"testing"
+)
+
+// solid returns a w x h 32 bpp bitmap of one colour at x, y.
+func solid(x, y, w, h int, r, g, b byte) Bitmap {
+	data := make([]byte, w*h*4)
+	for i := 0; i < len(data); i += 4 {
+		data[i], data[i+1], data[i+2], data[i+3] = b, g, r, 0xFF
+	}
+	return Bitmap{DestLeft: x, DestTop: y, DestRight: x + w - 1, DestBottom: y + h - 1, Width: w, Height: h, BitsPerPixel: 4, Data: data}
+}
+
+func TestCompositor(t *testing.T) {
+	c := NewCompositor(400, 200, 200, 100)
+	var damage []image.Rectangle
+	c.OnDamage(func(r image.Rectangle) { damage = append(damage, r) })
+
+	// A white 2x2 block at the odd position 41,21 covers parts of four
+	// viewport pixels, which ScaleSmooth averages.
+	c.Paint([]Bitmap{solid(41, 21, 2, 2, 0xFF, 0xFF, 0xFF)})
+	if len(damage) != 1 || damage[0] != image.Rect(20, 10, 22, 12) {
+		t.Fatalf("damage %v", damage)
+	}
+	img := c.Take()
+	if img.Rect != damage[0] || img.RGBAAt(20, 10).R != 0x3F || img.RGBAAt(21, 11).A != 0xFF {
+		t.Errorf("scaled pixels %v %v", img.RGBAAt(20, 10), img.RGBAAt(21, 11))
+	}
+	if c.Take() != nil {
+		t.Error("damage not cleared")
+	}
+
+	c.SetQuality(ScaleNearest)
+	if v := c.Image().RGBAAt(20, 10).R; v != 0xFF {
+		t.Errorf("nearest sample %x", v)
+	}
+
+	// Letterboxed into a square viewport: 200x100 in the middle.
+	c.SetViewport(200, 200)
+	c.SetKeepAspect(true)
+	if p, ok := c.ToDesktop(image.Pt(100, 100)); !ok || p != image.Pt(201, 101) {
+		t.Errorf("centre maps to %v %v", p, ok)
+	}
+	if _, ok := c.ToDesktop(image.Pt(100, 10)); ok {
+		t.Error("letterbox bar mapped to the desktop")
+	}
+	if r := c.ToViewport(image.Rect(0, 0, 400, 200)); r != image.Rect(0, 50, 200, 150) {
+		t.Errorf("desktop maps to %v", r)
+	}
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// MaxBitmapDimension bounds the width and the height of the bitmaps and
+// surfaces a server sends, checked before their pixels are allocated: it
+// is the largest desktop a client may request.
+const MaxBitmapDimension = 32766
+
+// DefaultBudget is the memory budget of a connection, 1 GiB.
+const DefaultBudget = 1 << 30
+
+// ErrBudgetExceeded is returned by Budget.Reserve for a buffer that does
+// not fit in what is left of the budget.
+var ErrBudgetExceeded = errors.New("memory budget exceeded")
+
+// CheckBitmapSize reports dimensions of a bitmap that are negative or
+// beyond MaxBitmapDimension.
+func CheckBitmapSize(width, height int) error {
+	if width < 0 || height < 0 || width > MaxBitmapDimension || height > MaxBitmapDimension {
+		return fmt.Errorf("bitmap of %dx%d pixels exceeds %d a side", width, height, MaxBitmapDimension)
+	}
+	return nil
+}
+
+// Budget caps the memory a connection holds in the buffers whose size
+// the server chooses and which outlive the PDU asking for them: the
+// surfaces and the bitmap cache of the graphics pipeline and the virtual
+// channel messages being reassembled.  A layer reserves the size of such
+// a buffer before allocating it and releases it once it drops the
+// buffer; a buffer that does not fit is refused and the PDU asking for it
+// dropped, instead of letting a server exhaust the memory of the client.
+//
+// A nil *Budget is unlimited.  A Budget is safe for concurrent use.
+type Budget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewBudget returns a budget of limit bytes, unlimited when limit is not
+// positive.
+func NewBudget(limit int64) *Budget {
+	if limit <= 0 {
+		return nil
+	}
+	return &Budget{limit: limit}
+}
+
+// Reserve takes n bytes from the budget, or returns an error wrapping
+// ErrBudgetExceeded when fewer are left.
+func (b *Budget) Reserve(n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+	for {
+		used := b.used.Load()
+		if int64(n) > b.limit-used {
+			return fmt.Errorf("%w: %d bytes requested with %d of %d in use", ErrBudgetExceeded, n, used, b.limit)
+		}
+		if b.used.CompareAndSwap(used, used+int64(n)) {
+			return nil
+		}
+	}
+}
+
+// Release gives back n bytes taken by Reserve.
+func (b *Budget) Release(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.used.Add(-int64(n))
+}
+
+// Used returns the bytes reserved and not released.
+func (b *Budget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.used.Load()
+}
@@ -0,0 +1,48 @@
+package core
+
+import "sync"
+
+// BufferPool reuses the byte slices of the frames a layer reads or writes
+// and drops once the call handling them returns, so a steady stream of
+// PDUs does not allocate a buffer for each.  It hands out *Buffer rather
+// than []byte: a slice put in a sync.Pool is boxed, an allocation of its
+// own on every Put.
+type BufferPool struct {
+	pool sync.Pool
+	max  int
+}
+
+// Buffer is a byte slice borrowed from a BufferPool.
+type Buffer struct {
+	B    []byte
+	pool *BufferPool
+}
+
+// NewBufferPool returns a pool of buffers of size bytes which keeps the
+// buffers grown up to max bytes; larger ones are left to the garbage
+// collector, so a burst of large frames does not stay pinned in the pool.
+func NewBufferPool(size, max int) *BufferPool {
+	p := &BufferPool{max: max}
+	p.pool.New = func() any { return &Buffer{B: make([]byte, 0, size), pool: p} }
+	return p
+}
+
+// Get returns a buffer whose B holds n bytes, not zeroed.
+func (p *BufferPool) Get(n int) *Buffer {
+	b := p.pool.Get().(*Buffer)
+	if cap(b.B) < n {
+		b.B = make([]byte, n)
+	}
+	b.B = b.B[:n]
+	return b
+}
+
+// Release returns the buffer to its pool.  Neither the buffer nor any
+// slice of B may be used after.
+func (b *Buffer) Release() {
+	if cap(b.B) > b.pool.max {
+		return
+	}
+	b.B = b.B[:0]
+	b.pool.pool.Put(b)
+}
@@ -0,0 +1,214 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+/**
+ * Bulk compression types and flags of the CompressedType field and the
+ * fast-path compressionFlags (MS-RDPBCGR 2.2.8.1.1.1.2)
+ */
+const (
+	PACKET_COMPR_TYPE_8K    = 0x0
+	PACKET_COMPR_TYPE_64K   = 0x1
+	PACKET_COMPR_TYPE_RDP6  = 0x2
+	PACKET_COMPR_TYPE_RDP61 = 0x3
+	PACKET_COMPR_TYPE_MASK  = 0x0F
+	PACKET_COMPRESSED       = 0x20
+	PACKET_AT_FRONT         = 0x40
+	PACKET_FLUSHED          = 0x80
+)
+
+/**
+ * RDP 6.1 Level-1 compression flags (MS-RDPEGDI)
+ */
+const (
+	L1_COMPRESSED        = 0x01
+	L1_NO_COMPRESSION    = 0x02
+	L1_PACKET_AT_FRONT   = 0x04
+	L1_INNER_COMPRESSION = 0x10
+)
+
+// ErrUnsupportedCompression is returned for packets compressed with a
+// bulk compressor the client does not implement.
+var ErrUnsupportedCompression = errors.New("unsupported bulk compression")
+
+// CompressionTypeName returns the name of the bulk compressor of a
+// PACKET_COMPR_TYPE_* value.
+func CompressionTypeName(t int) string {
+	switch t {
+	case PACKET_COMPR_TYPE_8K:
+		return "MPPC-8K"
+	case PACKET_COMPR_TYPE_64K:
+		return "MPPC-64K"
+	case PACKET_COMPR_TYPE_RDP6:
+		return "NCRUSH"
+	case PACKET_COMPR_TYPE_RDP61:
+		return "XCRUSH"
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
+
+// BulkDecompressor decompresses the server-to-client PDUs of one RDP
+// connection, picking the compressor from the type in the flags of each
+// packet.  A single instance is shared between the fast-path and
+// slow-path receivers.
+//
+// MPPC and XCRUSH are implemented.  RDP 6.0 (NCRUSH) is not: its
+// Huffman-coded literals and copy offsets need their own decoder, which
+// is left for a separate change, so NCRUSH packets fail with
+// ErrUnsupportedCompression and clients never request that level.
+type BulkDecompressor struct {
+	mppc   *MppcDecompressor
+	xcrush *xcrushDecompressor
+	// ctype is the type of the last compressed packet, -1 before one.
+	ctype atomic.Int32
+	// in and out total the sizes of the compressed packets and of their
+	// decompressed payloads.
+	in, out atomic.Uint64
+}
+
+func NewBulkDecompressor() *BulkDecompressor {
+	d := &BulkDecompressor{mppc: NewMppcDecompressor()}
+	d.ctype.Store(-1)
+	return d
+}
+
+// Type returns the PACKET_COMPR_TYPE_* of the compressor in effect, or
+// -1 while the server has not sent a compressed packet.  It is safe to
+// call from any goroutine.
+func (d *BulkDecompressor) Type() int {
+	return int(d.ctype.Load())
+}
+
+// Totals returns the sizes of the compressed packets processed so far and
+// of their decompressed payloads.  It is safe to call from any goroutine.
+func (d *BulkDecompressor) Totals() (compressed, decompressed uint64) {
+	return d.in.Load(), d.out.Load()
+}
+
+// Decompress processes one packet.  flags is the CompressedType byte
+// (slow-path) or compressionFlags byte (fast-path).
+func (d *BulkDecompressor) Decompress(flags byte, data []byte) ([]byte, error) {
+	out, err := d.decompress(flags, data)
+	if err == nil && flags&PACKET_COMPRESSED != 0 {
+		d.in.Add(uint64(len(data)))
+		d.out.Add(uint64(len(out)))
+	}
+	return out, err
+}
+
+func (d *BulkDecompressor) decompress(flags byte, data []byte) ([]byte, error) {
+	t := int(flags & PACKET_COMPR_TYPE_MASK)
+	if flags&PACKET_COMPRESSED != 0 {
+		d.ctype.Store(int32(t))
+	}
+	switch t {
+	case PACKET_COMPR_TYPE_8K, PACKET_COMPR_TYPE_64K:
+		return d.mppc.Decompress(flags, data)
+	case PACKET_COMPR_TYPE_RDP61:
+		if d.xcrush == nil {
+			d.xcrush = newXcrushDecompressor()
+		}
+		return d.xcrush.decompress(flags, data)
+	}
+	if flags&PACKET_COMPRESSED == 0 {
+		return data, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, CompressionTypeName(t))
+}
+
+const xcrushHistorySize = 2000000
+
+// xcrushDecompressor is the RDP 6.1 bulk decompressor (MS-RDPEGDI): a
+// Level-2 MPPC-64K stage wrapping a Level-1 stage that copies matches
+// from a 2,000,000 byte history.
+type xcrushDecompressor struct {
+	mppc    *MppcDecompressor
+	history []byte
+	offset  int
+}
+
+func newXcrushDecompressor() *xcrushDecompressor {
+	return &xcrushDecompressor{
+		mppc:    NewMppcDecompressor(),
+		history: make([]byte, xcrushHistorySize),
+	}
+}
+
+// decompress decodes an RDP61_COMPRESSED_DATA structure.
+func (x *xcrushDecompressor) decompress(flags byte, data []byte) ([]byte, error) {
+	if flags&PACKET_FLUSHED != 0 {
+		clear(x.history)
+		x.offset = 0
+	}
+	if flags&PACKET_COMPRESSED == 0 {
+		return data, nil
+	}
+	if len(data) < 2 {
+		return nil, fmt.Errorf("xcrush: packet too short")
+	}
+	l1, l2 := data[0], data[1]
+	data = data[2:]
+	if l2&PACKET_COMPRESSED != 0 {
+		var err error
+		data, err = x.mppc.Decompress(l2&^PACKET_COMPR_TYPE_MASK|PACKET_COMPR_TYPE_64K, data)
+		if err != nil {
+			return nil, fmt.Errorf("xcrush: level 2: %w", err)
+		}
+	}
+	if l1&L1_PACKET_AT_FRONT != 0 {
+		x.offset = 0
+	}
+	if l1&L1_COMPRESSED == 0 {
+		if x.offset+len(data) > len(x.history) {
+			return nil, fmt.Errorf("xcrush: history buffer overflow")
+		}
+		x.offset += copy(x.history[x.offset:], data)
+		return data, nil
+	}
+	return x.decompressL1(data)
+}
+
+// decompressL1 rebuilds the output from the match details and literals
+// of a Level-1 compressed packet.
+func (x *xcrushDecompressor) decompressL1(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("xcrush: level 1: no match count")
+	}
+	count := int(binary.LittleEndian.Uint16(data))
+	if len(data) < 2+count*8 {
+		return nil, fmt.Errorf("xcrush: level 1: %d matches truncated", count)
+	}
+	matches, literals := data[2:2+count*8], data[2+count*8:]
+	start, out := x.offset, 0
+	for i := range count {
+		m := matches[i*8:]
+		length := int(binary.LittleEndian.Uint16(m))
+		outputOffset := int(binary.LittleEndian.Uint16(m[2:]))
+		historyOffset := int(binary.LittleEndian.Uint32(m[4:]))
+		if outputOffset < out {
+			return nil, fmt.Errorf("xcrush: level 1: match %d out of order", i)
+		}
+		n := outputOffset - out
+		if n > len(literals) || x.offset+n+length > len(x.history) || historyOffset+length > len(x.history) {
+			return nil, fmt.Errorf("xcrush: level 1: match %d out of bounds", i)
+		}
+		x.offset += copy(x.history[x.offset:], literals[:n])
+		literals = literals[n:]
+		// Matches may overlap the bytes being written.
+		for j := range length {
+			x.history[x.offset+j] = x.history[historyOffset+j]
+		}
+		x.offset += length
+		out = outputOffset + length
+	}
+	if x.offset+len(literals) > len(x.history) {
+		return nil, fmt.Errorf("xcrush: history buffer overflow")
+	}
+	x.offset += copy(x.history[x.offset:], literals)
+	return append([]byte(nil), x.history[start:x.offset]...), nil
+}
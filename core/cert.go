@@ -0,0 +1,100 @@
+package core
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// CertificatePolicy selects how the TLS server certificate is verified.
+// Every configured check must pass; the zero value accepts any
+// certificate, which matches what most RDP servers with self-signed
+// certificates need.
+type CertificatePolicy struct {
+	// VerifyChain checks the chain and host name against Roots, or the
+	// system roots when Roots is nil.
+	VerifyChain bool
+	Roots       *x509.CertPool
+
+	// Pins lists accepted SHA-256 fingerprints of the leaf certificate
+	// in hex; colons and case are ignored.  A matching pin is accepted
+	// even when the certificate is self-signed.
+	Pins []string
+
+	// Verify, when set, is called with the chain presented by the
+	// server, leaf first.  A non-nil error rejects the certificate.
+	Verify func(chain []*x509.Certificate) error
+}
+
+// CertificateError reports a server certificate rejected by a
+// CertificatePolicy.  Chain holds the certificates the server presented
+// so callers can log or display them.
+type CertificateError struct {
+	Reason string // "no certificate", "untrusted", "pin mismatch" or "rejected"
+	Chain  []*x509.Certificate
+	Err    error
+}
+
+func (e *CertificateError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("tls: server certificate %s: %v", e.Reason, e.Err)
+	}
+	return "tls: server certificate " + e.Reason
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of cert as lowercase
+// hex.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Check verifies chain, as presented by serverName, against the policy.
+func (p *CertificatePolicy) Check(chain []*x509.Certificate, serverName string) error {
+	if len(chain) == 0 {
+		return &CertificateError{Reason: "no certificate"}
+	}
+	leaf := chain[0]
+
+	if len(p.Pins) > 0 {
+		fp := CertFingerprint(leaf)
+		pinned := false
+		for _, pin := range p.Pins {
+			if strings.ToLower(strings.ReplaceAll(pin, ":", "")) == fp {
+				pinned = true
+				break
+			}
+		}
+		if !pinned {
+			return &CertificateError{Reason: "pin mismatch", Chain: chain,
+				Err: fmt.Errorf("fingerprint %s is not pinned", fp)}
+		}
+	}
+
+	if p.VerifyChain {
+		opts := x509.VerifyOptions{
+			Roots:         p.Roots,
+			DNSName:       serverName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, c := range chain[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		if _, err := leaf.Verify(opts); err != nil {
+			return &CertificateError{Reason: "untrusted", Chain: chain, Err: err}
+		}
+	}
+
+	if p.Verify != nil {
+		if err := p.Verify(chain); err != nil {
+			return &CertificateError{Reason: "rejected", Chain: chain, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package core
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCertificatePolicy(t *testing.T) {
+	cert := selfSigned(t, "rdp.example")
+	leaf := mustParse(t, cert.Certificate[0])
+	chain := []*x509.Certificate{leaf}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	fp := CertFingerprint(leaf)
+	colons := strings.ToUpper(fp[:2]) + ":" + fp[2:]
+	rejected := errors.New("rejected by test")
+
+	tests := []struct {
+		name   string
+		policy CertificatePolicy
+		host   string
+		reason string
+	}{
+		{"accept any", CertificatePolicy{}, "rdp.example", ""},
+		{"pin", CertificatePolicy{Pins: []string{"00", colons}}, "rdp.example", ""},
+		{"pin mismatch", CertificatePolicy{Pins: []string{"00"}}, "rdp.example", "pin mismatch"},
+		{"custom roots", CertificatePolicy{VerifyChain: true, Roots: roots}, "rdp.example", ""},
+		{"wrong host", CertificatePolicy{VerifyChain: true, Roots: roots}, "other.example", "untrusted"},
+		{"empty roots", CertificatePolicy{VerifyChain: true, Roots: x509.NewCertPool()}, "rdp.example", "untrusted"},
+		{"callback", CertificatePolicy{Verify: func([]*x509.Certificate) error { return rejected }}, "rdp.example", "rejected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.Check(chain, tt.host)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var ce *CertificateError
+			if !errors.As(err, &ce) {
+				t.Fatalf("got %v, want CertificateError", err)
+			}
+			if ce.Reason != tt.reason || len(ce.Chain) != 1 {
+				t.Errorf("got reason %q chain %d, want %q", ce.Reason, len(ce.Chain), tt.reason)
+			}
+		})
+	}
+	if err := (&CertificatePolicy{Verify: func([]*x509.Certificate) error { return rejected }}).Check(chain, ""); !errors.Is(err, rejected) {
+		t.Errorf("callback error not wrapped: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package core
+
+import "fmt"
+
+// maxProtocolErrorData bounds the bytes of the offending PDU that a
+// ProtocolError keeps.
+const maxProtocolErrorData = 4096
+
+// ProtocolError reports a PDU that a layer could not parse, such as one
+// cut short or with a length that runs past its end.  A layer emits it as
+// its "error" event, and closes the connection, when it cannot go on
+// without the PDU, and drops the PDU otherwise.
+type ProtocolError struct {
+	Layer string // the layer that parsed the PDU, such as "pdu" or "mcs"
+	PDU   string // the type of the PDU, such as "Demand Active"
+	Data  []byte // the start of the PDU, as the layer received it
+	Err   error
+}
+
+// NewProtocolError returns the ProtocolError of the PDU data, of which it
+// keeps a copy of the first 4096 bytes.
+func NewProtocolError(layer, pdu string, data []byte, err error) *ProtocolError {
+	return &ProtocolError{
+		Layer: layer,
+		PDU:   pdu,
+		Data:  append([]byte(nil), data[:min(len(data), maxProtocolErrorData)]...),
+		Err:   err,
+	}
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s: malformed %s PDU: %v", e.Layer, e.PDU, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
@@ -2,42 +2,106 @@ package core
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
+	"math"
 )
 
-type ReadBytesComplete func(result []byte, err error)
+// ErrReader is a reader on which the read helpers of this package keep
+// their first error: once a read has failed every read fails with the
+// same error, so a parser can read the fields of a PDU without checking
+// each of them and check Err once at the end.  Reaching the end of the
+// reader counts as an error, so parsers that read until io.EOF, such as
+// io.ReadAll, must not check Err.
+type ErrReader struct {
+	r   io.Reader
+	err error
+}
+
+// NewErrReader returns r when it is an ErrReader already, and an
+// ErrReader reading from r otherwise.
+func NewErrReader(r io.Reader) *ErrReader {
+	if er, ok := r.(*ErrReader); ok {
+		return er
+	}
+	return &ErrReader{r: r}
+}
 
-func StartReadBytes(len int, r io.Reader, cb ReadBytesComplete) {
-	b := make([]byte, len)
-	go func() {
-		_, err := io.ReadFull(r, b)
-		cb(b, err)
-	}()
+func (r *ErrReader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.r.Read(b)
 }
 
+// Len returns the bytes left in the underlying reader when it knows
+// them, as a bytes.Reader does, and math.MaxInt otherwise.
+func (r *ErrReader) Len() int {
+	if l, ok := r.r.(interface{ Len() int }); ok {
+		return l.Len()
+	}
+	return math.MaxInt
+}
+
+// Err returns the first error of the reads, io.ErrUnexpectedEOF when a
+// field was cut short.
+func (r *ErrReader) Err() error {
+	return r.err
+}
+
+// fail records err in r when r is an ErrReader and returns it.
+func fail(r io.Reader, err error) error {
+	if err == nil {
+		return nil
+	}
+	if er, ok := r.(*ErrReader); ok && er.err == nil {
+		if err == io.EOF {
+			er.err = io.ErrUnexpectedEOF
+		} else {
+			er.err = err
+		}
+	}
+	return err
+}
+
+// ReadBytes reads len bytes.  When r knows how many bytes it holds, as a
+// bytes.Reader does, a len running past them fails without allocating the
+// buffer, so a corrupt length field cannot exhaust memory.
 func ReadBytes(len int, r io.Reader) ([]byte, error) {
+	if len < 0 {
+		return nil, fail(r, errors.New("negative length"))
+	}
+	if l, ok := r.(interface{ Len() int }); ok && len > l.Len() {
+		len = l.Len()
+		b := make([]byte, len)
+		n, _ := io.ReadFull(r, b)
+		if n == 0 {
+			return b[:0], fail(r, io.EOF)
+		}
+		return b[:n], fail(r, io.ErrUnexpectedEOF)
+	}
 	b := make([]byte, len)
 	length, err := io.ReadFull(r, b)
-	return b[:length], err
+	return b[:length], fail(r, err)
 }
 
 func ReadByte(r io.Reader) (byte, error) {
 	var buf [1]byte
 	_, err := io.ReadFull(r, buf[:])
-	return buf[0], err
+	return buf[0], fail(r, err)
 }
 
 func ReadUInt8(r io.Reader) (uint8, error) {
 	var buf [1]byte
 	_, err := io.ReadFull(r, buf[:])
-	return buf[0], err
+	return buf[0], fail(r, err)
 }
 
 func ReadUint16LE(r io.Reader) (uint16, error) {
 	var buf [2]byte
 	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
-		return 0, err
+		return 0, fail(r, err)
 	}
 	return binary.LittleEndian.Uint16(buf[:]), nil
 }
@@ -46,7 +110,7 @@ func ReadUint16BE(r io.Reader) (uint16, error) {
 	var buf [2]byte
 	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
-		return 0, err
+		return 0, fail(r, err)
 	}
 	return binary.BigEndian.Uint16(buf[:]), nil
 }
@@ -55,7 +119,7 @@ func ReadUInt32LE(r io.Reader) (uint32, error) {
 	var buf [4]byte
 	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
-		return 0, err
+		return 0, fail(r, err)
 	}
 	return binary.LittleEndian.Uint32(buf[:]), nil
 }
@@ -64,7 +128,7 @@ func ReadUInt32BE(r io.Reader) (uint32, error) {
 	var buf [4]byte
 	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
-		return 0, err
+		return 0, fail(r, err)
 	}
 	return binary.BigEndian.Uint32(buf[:]), nil
 }
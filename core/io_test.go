@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"encoding/hex"
+	"io"
 	"testing"
 )
 
@@ -15,3 +16,23 @@ func TestWriteUInt16LE(t *testing.T) {
 		t.Error(result, "not equals to", expected)
 	}
 }
+
+func TestErrReader(t *testing.T) {
+	r := NewErrReader(bytes.NewReader([]byte{1, 2, 3}))
+	if v, err := ReadUint16LE(r); err != nil || v != 0x0201 {
+		t.Fatal(v, err)
+	}
+	if _, err := ReadUInt32LE(r); err == nil {
+		t.Fatal("truncated read succeeded")
+	}
+	if r.Err() != io.ErrUnexpectedEOF {
+		t.Fatal("Err:", r.Err())
+	}
+	// The error is sticky, even for reads the data would satisfy.
+	if _, err := ReadUInt8(r); err == nil || r.Err() != io.ErrUnexpectedEOF {
+		t.Fatal("read after error:", err, r.Err())
+	}
+	if NewErrReader(r) != r {
+		t.Error("NewErrReader wrapped an ErrReader")
+	}
+}
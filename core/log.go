@@ -1,20 +1,149 @@
 package core
 
 import (
+	"context"
 	"encoding/hex"
+	"fmt"
 	"log/slog"
 )
 
+// Attribute keys shared by the log records of all layers.
+const (
+	// LogLayer names the protocol layer or channel plugin that logged.
+	LogLayer = "layer"
+	// LogChannel is the name of the virtual channel a record is about.
+	LogChannel = "channel"
+	// LogPDU is the type of the PDU a record is about.
+	LogPDU = "pdu"
+)
+
+// DefaultLogger writes to slog.Default() as it is when each record is
+// logged, so a layer created before the application sets its default
+// logger still follows it.
+var DefaultLogger = slog.New(defaultHandler{})
+
+// Logger returns the logger of a layer: l, or DefaultLogger when nil,
+// with the attribute LogLayer set to layer.
+func Logger(l *slog.Logger, layer string) *slog.Logger {
+	if l == nil {
+		l = DefaultLogger
+	}
+	return l.With(LogLayer, layer)
+}
+
+// defaultHandler passes records to the handler of slog.Default(), after
+// applying the attributes and groups added with With and WithGroup.
+type defaultHandler struct {
+	wrap func(slog.Handler) slog.Handler
+}
+
+func (h defaultHandler) handler() slog.Handler {
+	d := slog.Default().Handler()
+	if h.wrap != nil {
+		d = h.wrap(d)
+	}
+	return d
+}
+
+func (h defaultHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h defaultHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler().Handle(ctx, r)
+}
+
+func (h defaultHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.then(func(d slog.Handler) slog.Handler { return d.WithAttrs(attrs) })
+}
+
+func (h defaultHandler) WithGroup(name string) slog.Handler {
+	return h.then(func(d slog.Handler) slog.Handler { return d.WithGroup(name) })
+}
+
+func (h defaultHandler) then(f func(slog.Handler) slog.Handler) defaultHandler {
+	prev := h.wrap
+	if prev == nil {
+		return defaultHandler{f}
+	}
+	return defaultHandler{func(d slog.Handler) slog.Handler { return f(prev(d)) }}
+}
+
 // Hex wraps a byte slice as a slog.LogValuer that lazily encodes the bytes
 // as a hexadecimal string only when the slog handler actually formats it.
 //
 // Use Hex(buf) instead of hex.EncodeToString(buf) inside slog.Debug calls on
 // hot paths: when the logger's level filter discards the record (the common
 // case in production), the encode and the per-call string allocation are
-// skipped entirely.
+// skipped entirely.  A redacting handler drops the bytes, so payloads
+// should always be logged as Hex.
 type Hex []byte
 
 // LogValue implements slog.LogValuer.
 func (h Hex) LogValue() slog.Value {
 	return slog.StringValue(hex.EncodeToString(h))
 }
+
+// Secret marks a logged value as a credential, such as a user name or a
+// session key, which a redacting handler leaves out.
+type Secret string
+
+// LogValue implements slog.LogValuer.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(string(s))
+}
+
+// NewRedactingHandler returns a handler that passes the records to h
+// without the values that may carry credentials or session data: Secret
+// values are replaced by "[redacted]", and Hex values and byte slices by
+// their length.
+func NewRedactingHandler(h slog.Handler) slog.Handler {
+	return redactingHandler{h}
+}
+
+type redactingHandler struct {
+	slog.Handler
+}
+
+func (h redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redact(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, out)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redact(a)
+	}
+	return redactingHandler{h.Handler.WithAttrs(redacted)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{h.Handler.WithGroup(name)}
+}
+
+func redact(a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, g := range group {
+			redacted[i] = redact(g)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	case slog.KindAny, slog.KindLogValuer:
+		switch v := a.Value.Any().(type) {
+		case Secret:
+			return slog.String(a.Key, "[redacted]")
+		case Hex:
+			return slog.String(a.Key, fmt.Sprintf("[%d bytes]", len(v)))
+		case []byte:
+			return slog.String(a.Key, fmt.Sprintf("[%d bytes]", len(v)))
+		}
+	}
+	return a
+}
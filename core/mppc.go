@@ -1,8 +1,11 @@
 package core
 
-// MppcDecompressor maintains per-connection state for RDP MPPC-64K bulk
-// decompression (MS-RDPBCGR §3.1.8.4.1).  A single instance is shared
-// between the fast-path and slow-path receivers of one RDP connection.
+import "fmt"
+
+// MppcDecompressor maintains per-connection state for RDP 4.0 (8K) and
+// RDP 5.0 (64K) MPPC bulk decompression (MS-RDPBCGR §3.1.8.4).  The
+// history size follows the compression type carried in the flags of
+// each packet.
 type MppcDecompressor struct {
 	history [mppcHistorySize]byte
 	offset  int
@@ -13,10 +16,10 @@ const mppcHistorySize = 65536
 // mppc flag bits (mirror the constants in protocol/pdu/data.go so the core
 // package has no import dependency on pdu).
 const (
-	mppcBig        = 0x01 // RDP_MPPC_BIG  – 64 K dictionary
-	mppcCompressed = 0x20 // RDP_MPPC_COMPRESSED
-	mppcReset      = 0x40 // RDP_MPPC_RESET  – compressor is at front of buffer
-	mppcFlushed    = 0x80 // RDP_MPPC_FLUSH  – compressor history flushed
+	mppcBig        = 0x01 // PACKET_COMPR_TYPE_64K – 64 K dictionary
+	mppcCompressed = 0x20 // PACKET_COMPRESSED
+	mppcReset      = 0x40 // PACKET_AT_FRONT – history offset back to 0
+	mppcFlushed    = 0x80 // PACKET_FLUSHED  – compressor history flushed
 )
 
 func NewMppcDecompressor() *MppcDecompressor {
@@ -26,90 +29,129 @@ func NewMppcDecompressor() *MppcDecompressor {
 // Decompress processes one MPPC block.
 //
 // flags is the CompressedType byte (slow-path) or compressionFlags byte
-// (fast-path); it carries the RDP_MPPC_* bit flags.
+// (fast-path); it carries the compression type and the PACKET_* bit flags.
 //
-// When RDP_MPPC_COMPRESSED is not set the payload is uncompressed; the data
-// is returned as-is but the history buffer is still updated so future
-// compressed blocks can reference it.
+// When PACKET_COMPRESSED is not set the payload is returned as-is; the
+// server did not add it to its history, so neither does the decompressor.
 func (d *MppcDecompressor) Decompress(flags byte, data []byte) ([]byte, error) {
 	if flags&mppcFlushed != 0 {
 		d.history = [mppcHistorySize]byte{}
 		d.offset = 0
-	} else if flags&mppcReset != 0 {
+	}
+	if flags&mppcReset != 0 {
 		d.offset = 0
 	}
-
 	if flags&mppcCompressed == 0 {
-		// Uncompressed: update history, return data unchanged.
-		for _, b := range data {
-			d.history[d.offset] = b
-			d.offset = (d.offset + 1) & (mppcHistorySize - 1)
-		}
 		return data, nil
 	}
 
-	output := make([]byte, 0, len(data)*3)
+	size := 8192
+	if flags&PACKET_COMPR_TYPE_MASK == PACKET_COMPR_TYPE_64K {
+		size = mppcHistorySize
+	}
+	start := d.offset
 	br := newMppcBitReader(data)
+	// The shortest token, a literal below 0x80, is 8 bits; anything less
+	// is end-of-stream padding.
+	for br.bitsLeft >= 8 {
+		if d.offset >= size {
+			return nil, fmt.Errorf("mppc: history buffer overflow")
+		}
+		// Literals: 0 + 7 bits for 0x00-0x7F, 10 + 7 bits for 0x80-0xFF.
+		if br.peekBits(1) == 0 {
+			d.history[d.offset] = byte(br.readBits(8))
+			d.offset++
+			continue
+		}
+		if br.peekBits(2) == 0b10 {
+			br.readBits(2)
+			d.history[d.offset] = byte(br.readBits(7) | 0x80)
+			d.offset++
+			continue
+		}
 
-	// A literal token is 9 bits (1 disc + 8 data).  Refuse to start a new
-	// token if fewer than 9 bits remain – those bits are end-of-stream padding.
-outer:
-	for br.bitsLeft >= 9 {
-		if br.readBit() == 0 {
-			// Literal byte
-			b := byte(br.readBits(8))
-			output = append(output, b)
-			d.history[d.offset] = b
-			d.offset = (d.offset + 1) & (mppcHistorySize - 1)
-		} else {
-			// Copy tuple: 2-bit offset discriminator
-			sel := (br.readBit() << 1) | br.readBit()
-			var copyOffset int
-			switch sel {
-			case 0: // 00 + 6 bits → offset 0..63
-				if br.bitsLeft < 6 {
-					break outer
-				}
-				copyOffset = br.readBits(6)
-			case 1: // 01 + 8 bits → offset 64..319
-				if br.bitsLeft < 8 {
-					break outer
-				}
-				copyOffset = 64 + br.readBits(8)
-			case 2: // 10 + 13 bits → offset 320..8511
-				if br.bitsLeft < 13 {
-					break outer
-				}
-				copyOffset = 320 + br.readBits(13)
-			case 3: // 11 + 16 bits → offset 8192..73727
-				if br.bitsLeft < 16 {
-					break outer
-				}
-				copyOffset = 8192 + br.readBits(16)
-			}
-
-			// Copy length: unary code – count leading 1-bits then add 3.
-			// A 0-bit terminates the count; minimum length is 3 (code "0").
-			copyLength := 3
-			for br.bitsLeft > 0 {
-				if br.readBit() == 0 {
-					break
-				}
-				copyLength++
-			}
-
-			// Resolve copy source in the circular history buffer.
-			src := (d.offset - copyOffset - 1 + mppcHistorySize) & (mppcHistorySize - 1)
-			for i := 0; i < copyLength; i++ {
-				b := d.history[(src+i)&(mppcHistorySize-1)]
-				output = append(output, b)
-				d.history[d.offset] = b
-				d.offset = (d.offset + 1) & (mppcHistorySize - 1)
-			}
+		copyOffset, ok := readMppcCopyOffset(br, size == mppcHistorySize)
+		if !ok {
+			break
+		}
+		length, ok := readMppcLength(br, size == mppcHistorySize)
+		if !ok {
+			return nil, fmt.Errorf("mppc: bad length-of-match code")
+		}
+		if copyOffset == 0 || copyOffset > d.offset || d.offset+length > size {
+			return nil, fmt.Errorf("mppc: copy offset %d length %d out of history", copyOffset, length)
+		}
+		// The source may overlap the bytes being written, so copy one
+		// byte at a time.
+		src := d.offset - copyOffset
+		for i := 0; i < length; i++ {
+			d.history[d.offset+i] = d.history[src+i]
 		}
+		d.offset += length
 	}
+	return append([]byte(nil), d.history[start:d.offset]...), nil
+}
 
-	return output, nil
+// readMppcCopyOffset reads the copy-offset of a copy tuple.  It returns
+// false when the remaining bits are padding.
+func readMppcCopyOffset(br *mppcBitReader, big bool) (int, bool) {
+	if big {
+		switch {
+		case br.peekBits(5) == 0b11111:
+			return readMppcField(br, 5, 6, 0)
+		case br.peekBits(5) == 0b11110:
+			return readMppcField(br, 5, 8, 64)
+		case br.peekBits(4) == 0b1110:
+			return readMppcField(br, 4, 11, 320)
+		default: // 110
+			return readMppcField(br, 3, 16, 2368)
+		}
+	}
+	switch {
+	case br.peekBits(4) == 0b1111:
+		return readMppcField(br, 4, 6, 0)
+	case br.peekBits(4) == 0b1110:
+		return readMppcField(br, 4, 8, 64)
+	default: // 110
+		return readMppcField(br, 3, 13, 320)
+	}
+}
+
+func readMppcField(br *mppcBitReader, prefix, bits, base int) (int, bool) {
+	if br.bitsLeft < prefix+bits {
+		return 0, false
+	}
+	br.readBits(prefix)
+	return base + br.readBits(bits), true
+}
+
+// readMppcLength reads the length-of-match of a copy tuple: 0 for 3,
+// otherwise k 1-bits and a 0-bit followed by k+1 bits added to 2^(k+1).
+func readMppcLength(br *mppcBitReader, big bool) (int, bool) {
+	maxOnes := 11
+	if big {
+		maxOnes = 15
+	}
+	k := 0
+	for {
+		if br.bitsLeft == 0 {
+			return 0, false
+		}
+		if br.readBit() == 0 {
+			break
+		}
+		k++
+		if k > maxOnes {
+			return 0, false
+		}
+	}
+	if k == 0 {
+		return 3, true
+	}
+	if br.bitsLeft < k+1 {
+		return 0, false
+	}
+	return 1<<(k+1) + br.readBits(k+1), true
 }
 
 // mppcBitReader reads bits MSB-first from a byte slice.
@@ -152,3 +194,12 @@ func (r *mppcBitReader) readBits(n int) int {
 	}
 	return result
 }
+
+// peekBits returns the next n bits without consuming them; bits past the
+// end read as 0.
+func (r *mppcBitReader) peekBits(n int) int {
+	saved := *r
+	v := r.readBits(n)
+	*r = saved
+	return v
+}
@@ -2,32 +2,25 @@ package core
 
 import (
 	"bytes"
+	"errors"
 	"testing"
 )
 
 // compressedABC is the MPPC-64K encoding of "abc" (three literals).
 //
-// Bit layout (MSB-first within each byte):
-//   literal 'a' (0x61): 0 0110_0001  → bits  0‥8
-//   literal 'b' (0x62): 0 0110_0010  → bits  9‥17
-//   literal 'c' (0x63): 0 0110_0011  → bits 18‥26
-//   padding zeros                    → bits 27‥31
-//
-// Grouped into bytes: 0x30 0x98 0x8C 0x60
-var compressedABC = []byte{0x30, 0x98, 0x8C, 0x60}
+// Literals below 0x80 are the byte itself, 8 bits each:
+//   'a' 0110_0001, 'b' 0110_0010, 'c' 0110_0011
+var compressedABC = []byte{0x61, 0x62, 0x63}
 
 // compressedABCABC is "abc" followed by a copy-tuple that repeats it.
 //
-// After the three literals above (bits 0‥26):
-//   copy disc (1):            bit 27
-//   selector 00:              bits 28‥29
-//   offset bits 000010 (=2):  bits 30‥35
-//   length terminator 0:      bit 36
-//   padding zeros:            bits 37‥39
+// After the three literals above (bits 0‥23):
+//   copy-offset 11111 + 000011 (=3):  bits 24‥34
+//   length-of-match 0 (=3):           bit 35
+//   padding zeros:                    bits 36‥39
 //
-// Bytes: 0x30 0x98 0x8C 0x70 0x20
-// Decoded: "abcabc" (offset 2 → src = histOffset-3 = 0; length 3)
-var compressedABCABC = []byte{0x30, 0x98, 0x8C, 0x70, 0x20}
+// Bytes: 0x61 0x62 0x63 0xF8 0x60
+var compressedABCABC = []byte{0x61, 0x62, 0x63, 0xF8, 0x60}
 
 func TestMppcDecompressLiterals(t *testing.T) {
 	d := NewMppcDecompressor()
@@ -95,11 +88,59 @@ func TestMppcDecompressUncompressed(t *testing.T) {
 	if !bytes.Equal(got, plain) {
 		t.Errorf("got %q, want %q", got, plain)
 	}
-	// History should be updated.
-	if d.history[0] != 'h' || d.history[4] != 'o' {
-		t.Errorf("history not updated: [0]=%q [4]=%q", d.history[0], d.history[4])
+	// The server does not add uncompressed packets to its history, so
+	// the history must stay untouched.
+	if d.history[0] != 0 || d.offset != 0 {
+		t.Errorf("history updated: [0]=%q offset=%d", d.history[0], d.offset)
+	}
+}
+
+// TestBulkDecompressXcrush decodes an RDP 6.1 packet whose Level-2 MPPC
+// stage yields "abc" plus a Level-1 match repeating it from the history.
+func TestBulkDecompressXcrush(t *testing.T) {
+	d := NewBulkDecompressor()
+	l1 := []byte{
+		0x01, 0x00, // MatchCount
+		0x03, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, // length 3, output 3, history 0
+		'a', 'b', 'c', 'd',
+	}
+	got, err := d.Decompress(PACKET_COMPRESSED|PACKET_COMPR_TYPE_RDP61,
+		append([]byte{L1_COMPRESSED, 0}, l1...))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if d.offset != 5 {
-		t.Errorf("offset: got %d, want 5", d.offset)
+	if !bytes.Equal(got, []byte("abcabcd")) {
+		t.Errorf("got %q, want %q", got, "abcabcd")
 	}
+
+	// Level 2 compressed: the literals of the Level-1 packet are MPPC.
+	inner := []byte{0x00, 0x00, 0x61, 0x62, 0x63}
+	got, err = d.Decompress(PACKET_COMPRESSED|PACKET_COMPR_TYPE_RDP61,
+		append([]byte{L1_COMPRESSED, PACKET_COMPRESSED}, inner...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("abc")) {
+		t.Errorf("got %q, want %q", got, "abc")
+	}
+	if d.Type() != PACKET_COMPR_TYPE_RDP61 {
+		t.Errorf("Type() = %d, want %d", d.Type(), PACKET_COMPR_TYPE_RDP61)
+	}
+
+	if _, err := d.Decompress(PACKET_COMPRESSED|PACKET_COMPR_TYPE_RDP6, []byte{0}); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Errorf("NCRUSH: got %v, want ErrUnsupportedCompression", err)
+	}
+}
+
+func FuzzBulkDecompress(f *testing.F) {
+	f.Add(byte(PACKET_COMPRESSED|PACKET_COMPR_TYPE_64K), []byte{0x00, 0x00, 0x61, 0x62, 0x63})
+	f.Add(byte(PACKET_COMPRESSED|PACKET_COMPR_TYPE_8K|PACKET_AT_FRONT), []byte{0x30, 0x9c, 0xe8, 0x00})
+	f.Add(byte(PACKET_COMPRESSED|PACKET_COMPR_TYPE_RDP61), []byte{L1_COMPRESSED, 0,
+		0x01, 0x00, 0x03, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 'a', 'b', 'c', 'd'})
+	f.Fuzz(func(t *testing.T, flags byte, data []byte) {
+		d := NewBulkDecompressor()
+		// a second packet runs against the history of the first
+		d.Decompress(flags, data)
+		d.Decompress(flags, data)
+	})
 }
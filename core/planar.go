@@ -0,0 +1,226 @@
+package core
+
+import (
+	"fmt"
+	"image"
+)
+
+/**
+ * RDP 6.0 bitmap codec (planar) format header
+ * (MS-RDPEGDI 2.2.2.5.1)
+ */
+const (
+	PLANAR_FORMAT_HEADER_CLL_MASK = 0x07
+	PLANAR_FORMAT_HEADER_CS       = 0x08
+	PLANAR_FORMAT_HEADER_RLE      = 0x10
+	PLANAR_FORMAT_HEADER_NA       = 0x20
+)
+
+// DecompressPlanar decodes an RDP 6.0 planar bitmap into dst as top-down
+// BGRA pixels, reusing dst if it has room for width*height*4 bytes.
+// bottomUp is set for bitmap updates, whose planes are stored bottom-up;
+// the planar codec of RDPGFX stores them top-down.
+//
+// The planes are RLE and scanline-delta encoded when the RLE flag is set
+// (MS-RDPEGDI 3.1.9.2), and carry YCoCg, possibly with subsampled
+// chroma, when the colour loss level is not zero (3.1.9.1).
+func DecompressPlanar(input, dst []uint8, width, height int, bottomUp bool) ([]uint8, error) {
+	if err := CheckBitmapSize(width, height); err != nil {
+		return dst, fmt.Errorf("%w: planar: %v", ErrBitmapDecompress, err)
+	}
+	size := width * height * 4
+	if cap(dst) >= size {
+		dst = dst[:size]
+	} else {
+		dst = make([]uint8, size)
+	}
+	planes, cll, err := decodePlanes(input, width, height)
+	if err != nil {
+		return dst, err
+	}
+	for y := range height {
+		row := y
+		if bottomUp {
+			row = height - 1 - y
+		}
+		o := y * width * 4
+		for i := row * width; i < (row+1)*width; i++ {
+			r, g, b := planarRGB(&planes, i, cll)
+			dst[o], dst[o+1], dst[o+2], dst[o+3] = b, g, r, planes[0][i]
+			o += 4
+		}
+	}
+	return dst, nil
+}
+
+// DecompressPlanarInto decodes a planar bitmap of width x height straight
+// into dst as opaque RGBA pixels, with its top left corner at at, clipped
+// to the bounds of dst, and returns the rectangle of dst written.
+// bottomUp is as for DecompressPlanar.
+func DecompressPlanarInto(input []uint8, dst *image.RGBA, at image.Point, width, height int, bottomUp bool) (image.Rectangle, error) {
+	if err := CheckBitmapSize(width, height); err != nil {
+		return image.Rectangle{}, fmt.Errorf("%w: planar: %v", ErrBitmapDecompress, err)
+	}
+	planes, cll, err := decodePlanes(input, width, height)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	r := image.Rectangle{at, at.Add(image.Pt(width, height))}.Intersect(dst.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := y - at.Y
+		if bottomUp {
+			row = height - 1 - row
+		}
+		o := dst.PixOffset(r.Min.X, y)
+		for i := row*width + r.Min.X - at.X; i < row*width+r.Max.X-at.X; i++ {
+			red, g, b := planarRGB(&planes, i, cll)
+			dst.Pix[o], dst.Pix[o+1], dst.Pix[o+2], dst.Pix[o+3] = red, g, b, 0xFF
+			o += 4
+		}
+	}
+	return r, nil
+}
+
+// planarRGB returns the colour of pixel i of the decoded planes.
+func planarRGB(planes *[4][]uint8, i, cll int) (r, g, b uint8) {
+	if cll == 0 {
+		return planes[1][i], planes[2][i], planes[3][i]
+	}
+	return ycocgToRGB(planes[1][i], planes[2][i], planes[3][i], cll)
+}
+
+// decodePlanes decodes the alpha, red or luma, green or orange chroma
+// and blue or green chroma planes of a planar bitmap, each width*height
+// bytes in stream (bottom-up or top-down) order, and returns them with
+// the colour loss level.
+func decodePlanes(input []uint8, width, height int) (planes [4][]uint8, cll int, err error) {
+	if len(input) < 1 {
+		return planes, 0, fmt.Errorf("%w: planar: no format header", ErrBitmapDecompress)
+	}
+	header := input[0]
+	in := input[1:]
+	cll = int(header & PLANAR_FORMAT_HEADER_CLL_MASK)
+	cs := header&PLANAR_FORMAT_HEADER_CS != 0 && cll != 0
+	rle := header&PLANAR_FORMAT_HEADER_RLE != 0
+	noAlpha := header&PLANAR_FORMAT_HEADER_NA != 0
+
+	// Planes in stream order: alpha, red or luma, green or orange
+	// chroma, blue or green chroma.
+	for i := range planes {
+		w, h := width, height
+		if cs && i >= 2 {
+			w, h = (width+1)/2, (height+1)/2
+		}
+		planes[i] = make([]uint8, w*h)
+		if i == 0 && noAlpha {
+			for j := range planes[i] {
+				planes[i][j] = 0xFF
+			}
+			continue
+		}
+		if rle {
+			n, err := decodePlanarPlane(in, planes[i], w, h)
+			if err != nil {
+				return planes, 0, err
+			}
+			in = in[n:]
+		} else {
+			if len(in) < w*h {
+				return planes, 0, fmt.Errorf("%w: planar: raw plane %d truncated", ErrBitmapDecompress, i)
+			}
+			in = in[copy(planes[i], in):]
+		}
+	}
+	if cs {
+		planes[2] = expandChroma(planes[2], width, height)
+		planes[3] = expandChroma(planes[3], width, height)
+	}
+	return planes, cll, nil
+}
+
+// decodePlanarPlane decodes one RLE plane of width*height bytes into out
+// and returns the number of input bytes it used.  The first scanline
+// holds the values, every later one the signed deltas from the scanline
+// above (MS-RDPEGDI 3.1.9.2.3).
+func decodePlanarPlane(in, out []uint8, width, height int) (int, error) {
+	pos := 0
+	for y := range height {
+		row := out[y*width : (y+1)*width]
+		var prev []uint8
+		if y > 0 {
+			prev = out[(y-1)*width : y*width]
+		}
+		var pixel uint8
+		for x := 0; x < width; {
+			if pos >= len(in) {
+				return pos, fmt.Errorf("%w: planar: plane truncated", ErrBitmapDecompress)
+			}
+			control := in[pos]
+			pos++
+			run, raw := int(control&0x0F), int(control>>4)
+			switch run {
+			case 1:
+				run, raw = 16+raw, 0
+			case 2:
+				run, raw = 32+raw, 0
+			}
+			if x+raw+run > width || pos+raw > len(in) {
+				return pos, fmt.Errorf("%w: planar: segment overruns scanline", ErrBitmapDecompress)
+			}
+			for _, v := range in[pos : pos+raw] {
+				if prev != nil {
+					// Deltas are sign-magnitude with the sign in bit 0.
+					if v&1 != 0 {
+						v = -(v>>1 + 1)
+					} else {
+						v >>= 1
+					}
+				}
+				pixel = v
+				row[x] = v
+				if prev != nil {
+					row[x] += prev[x]
+				}
+				x++
+			}
+			pos += raw
+			for ; run > 0; run-- {
+				row[x] = pixel
+				if prev != nil {
+					row[x] += prev[x]
+				}
+				x++
+			}
+		}
+	}
+	return pos, nil
+}
+
+// expandChroma scales a chroma plane subsampled by two in both
+// directions back to width*height.
+func expandChroma(plane []uint8, width, height int) []uint8 {
+	sw := (width + 1) / 2
+	out := make([]uint8, width*height)
+	for y := range height {
+		for x := range width {
+			out[y*width+x] = plane[y/2*sw+x/2]
+		}
+	}
+	return out
+}
+
+// ycocgToRGB converts a luma and the colour loss reduced orange and
+// green chroma (MS-RDPEGDI 3.1.9.1.2) to RGB.
+func ycocgToRGB(y, co, cg uint8, cll int) (r, g, b uint8) {
+	// The chroma values are stored halved as well as shifted.
+	shift := cll - 1
+	Co := int(int8(co << shift))
+	Cg := int(int8(cg << shift))
+	Y := int(y)
+	t := Y - Cg
+	return clampByte(t - Co), clampByte(Y + Cg), clampByte(t + Co)
+}
+
+func clampByte(v int) uint8 {
+	return uint8(min(max(v, 0), 255))
+}
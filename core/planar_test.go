@@ -0,0 +1,71 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestDecompressPlanar(t *testing.T) {
+	// 2x2, no alpha, RLE: red is 10 10 over deltas +2 -1, green and blue zero.
+	red := []byte{0x20, 10, 10, 0x20, 4, 1}
+	zero := []byte{0x20, 0, 0, 0x20, 0, 0}
+	input := append(append(append([]byte{PLANAR_FORMAT_HEADER_RLE | PLANAR_FORMAT_HEADER_NA}, red...), zero...), zero...)
+	out, err := DecompressPlanar(input, nil, 2, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0, 0, 12, 0xFF, 0, 0, 9, 0xFF, 0, 0, 10, 0xFF, 0, 0, 10, 0xFF}
+	if !bytes.Equal(out, want) {
+		t.Errorf("RLE planes = % x, want % x", out, want)
+	}
+
+	// 1x1 raw YCoCg with colour loss level 1.
+	out, err = DecompressPlanar([]byte{1 | PLANAR_FORMAT_HEADER_NA, 100, 10, 5, 0}, nil, 1, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{105, 105, 85, 0xFF}; !bytes.Equal(out, want) {
+		t.Errorf("YCoCg = % x, want % x", out, want)
+	}
+
+	if _, err := DecompressPlanar(input[:8], nil, 2, 2, true); !errors.Is(err, ErrBitmapDecompress) {
+		t.Errorf("truncated: got %v", err)
+	}
+}
+
+func TestDecompressPlanarInto(t *testing.T) {
+	// The 2x2 bitmap of TestDecompressPlanar at 3,1 of a 4x2 image: its
+	// bottom row falls outside.
+	red := []byte{0x20, 10, 10, 0x20, 4, 1}
+	zero := []byte{0x20, 0, 0, 0x20, 0, 0}
+	input := append(append(append([]byte{PLANAR_FORMAT_HEADER_RLE | PLANAR_FORMAT_HEADER_NA}, red...), zero...), zero...)
+	dst := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	r, err := DecompressPlanarInto(input, dst, image.Pt(3, 1), 2, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != image.Rect(3, 1, 4, 2) {
+		t.Errorf("wrote %v", r)
+	}
+	if want := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 12, 0, 0, 0xFF}; !bytes.Equal(dst.Pix[16:], want) {
+		t.Errorf("row 1 = % x, want % x", dst.Pix[16:], want)
+	}
+	if !bytes.Equal(dst.Pix[:16], make([]byte, 16)) {
+		t.Errorf("row 0 written: % x", dst.Pix[:16])
+	}
+
+	if _, err := DecompressPlanarInto(input[:8], dst, image.Point{}, 2, 2, true); !errors.Is(err, ErrBitmapDecompress) {
+		t.Errorf("truncated: got %v", err)
+	}
+}
+
+func FuzzDecompressPlanar(f *testing.F) {
+	zero := []byte{0x20, 0, 0, 0x20, 0, 0}
+	f.Add(append(append(append([]byte{PLANAR_FORMAT_HEADER_RLE | PLANAR_FORMAT_HEADER_NA}, 0x20, 10, 10, 0x20, 4, 1), zero...), zero...), uint8(2), uint8(2))
+	f.Add([]byte{1 | PLANAR_FORMAT_HEADER_NA, 100, 10, 5, 0}, uint8(1), uint8(1))
+	f.Fuzz(func(t *testing.T, input []byte, width, height uint8) {
+		DecompressPlanar(input, nil, int(width), int(height), width&1 == 0)
+	})
+}
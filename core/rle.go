@@ -1,6 +1,7 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"unsafe"
@@ -817,140 +818,10 @@ func decompress3(output *[]uint8, width, height int, input []uint8, size int) bo
 	return true
 }
 
-/* decompress a colour plane */
-func processPlane(in *[]uint8, width, height int, output *[]uint8, j int) int {
-	var (
-		indexw   int
-		indexh   int
-		code     int
-		collen   int
-		replen   int
-		color    uint8
-		x        uint8
-		revcode  int
-		lastline int
-		thisline int
-	)
-	ln := len(*in)
-	out := *output // hoist pointer dereference; writes to out[i] affect the underlying array
-
-	lastline = 0
-	indexh = 0
-	i := 0
-	for indexh < height {
-		thisline = j + (width * height * 4) - ((indexh + 1) * width * 4)
-		color = 0
-		indexw = 0
-		i = thisline
-
-		if lastline == 0 {
-			for indexw < width {
-				code = CVAL(in)
-				replen = int(code & 0xf)
-				collen = int((code >> 4) & 0xf)
-				revcode = (replen << 4) | collen
-				if (revcode <= 47) && (revcode >= 16) {
-					replen = revcode
-					collen = 0
-				}
-				for collen > 0 {
-					color = uint8(CVAL(in))
-					out[i] = color
-					i += 4
-
-					indexw++
-					collen--
-				}
-				for replen > 0 {
-					out[i] = color
-					i += 4
-					indexw++
-					replen--
-				}
-			}
-		} else {
-			// prevOffset is constant per row: indexw*4+lastline == i+(lastline-thisline)
-			// because i == thisline+indexw*4. Pre-computing it eliminates a multiply
-			// per pixel in both inner loops.
-			prevOffset := lastline - thisline
-			for indexw < width {
-				code = CVAL(in)
-				replen = int(code & 0xf)
-				collen = int((code >> 4) & 0xf)
-				revcode = (replen << 4) | collen
-				if (revcode <= 47) && (revcode >= 16) {
-					replen = revcode
-					collen = 0
-				}
-				for collen > 0 {
-					x = uint8(CVAL(in))
-					if x&1 != 0 {
-						x = x >> 1
-						x = x + 1
-						color = -x
-					} else {
-						x = x >> 1
-						color = x
-					}
-					x = out[i+prevOffset] + color
-					out[i] = x
-					i += 4
-					indexw++
-					collen--
-				}
-				for replen > 0 {
-					x = out[i+prevOffset] + color
-					out[i] = x
-					i += 4
-					indexw++
-					replen--
-				}
-			}
-		}
-		indexh++
-		lastline = thisline
-	}
-	return ln - len(*in)
-}
-
-/* 4 byte bitmap decompress */
+/* 4 byte bitmap decompress: RDP 6.0 planar, stored bottom-up */
 func decompress4(output *[]uint8, width, height int, input []uint8, size int) bool {
-	var (
-		code             int
-		onceBytes, total int
-	)
-
-	code = CVAL(&input)
-	rle := code&0x10 != 0
-	noAlpha := code&0x20 != 0
-
-	if !rle {
-		return false
-	}
-
-	total = 1
-	out := *output
-
-	if noAlpha {
-		// No alpha plane in the stream; fill alpha channel with 0xFF.
-		for i := 3; i < len(out); i += 4 {
-			out[i] = 0xFF
-		}
-	} else {
-		onceBytes = processPlane(&input, width, height, output, 3)
-		total += onceBytes
-	}
-
-	onceBytes = processPlane(&input, width, height, output, 2)
-	total += onceBytes
-
-	onceBytes = processPlane(&input, width, height, output, 1)
-	total += onceBytes
-
-	onceBytes = processPlane(&input, width, height, output, 0)
-	total += onceBytes
-
-	return true
+	_, err := DecompressPlanar(input, *output, width, height, true)
+	return err == nil
 }
 
 // DecompressInto decompresses bitmap data into dst, reusing dst if it has
@@ -978,6 +849,46 @@ func DecompressInto(input []uint8, dst []uint8, width, height int, bpp int) []ui
 	return dst
 }
 
+// ErrBitmapDecompress is returned by DecompressIntoChecked for malformed
+// interleaved RLE or planar bitmap data.
+var ErrBitmapDecompress = errors.New("bitmap decompression failed")
+
+// DecompressIntoChecked is DecompressInto for untrusted input: truncated
+// or otherwise malformed streams yield ErrBitmapDecompress instead of a
+// panic or a silently corrupted bitmap.
+func DecompressIntoChecked(input []uint8, dst []uint8, width, height int, bpp int) (out []uint8, err error) {
+	if err := CheckBitmapSize(width, height); err != nil {
+		return dst, fmt.Errorf("%w: %v", ErrBitmapDecompress, err)
+	}
+	size := width * height * bpp
+	if cap(dst) >= size {
+		dst = dst[:size]
+	} else {
+		dst = make([]uint8, size)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = dst, fmt.Errorf("%w: %v", ErrBitmapDecompress, r)
+		}
+	}()
+	// The interleaved decoders also report false for trailing data past
+	// the last scanline, which some servers send; only malformed planar
+	// data is treated as a failure here.
+	switch bpp {
+	case 1:
+		decompress1(&dst, width, height, input, size)
+	case 2:
+		decompress2(&dst, width, height, input, size)
+	case 3:
+		decompress3(&dst, width, height, input, size)
+	case 4:
+		return DecompressPlanar(input, dst, width, height, true)
+	default:
+		return dst, fmt.Errorf("%w: unsupported bpp %d", ErrBitmapDecompress, bpp)
+	}
+	return dst, nil
+}
+
 /* main decompress function */
 func Decompress(input []uint8, width, height int, bpp int) []uint8 {
 	return DecompressInto(input, nil, width, height, bpp)
@@ -2,6 +2,7 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 )
@@ -24,3 +25,33 @@ func TestSum(t *testing.T) {
 	out := Decompress(input, 64, 64, 3)
 	fmt.Println(out)
 }
+
+func TestDecompressIntoChecked(t *testing.T) {
+	// SPECIAL_FGBG white pixel followed by a black pixel.
+	out, err := DecompressIntoChecked([]byte{0xfd, 0xfe}, nil, 2, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out[0] != 0xff || out[3] != 0 {
+		t.Errorf("unexpected pixels % x", out)
+	}
+	// A colour run cut off before its length byte must be reported, not panic.
+	if _, err := DecompressIntoChecked([]byte{0x60}, nil, 2, 1, 3); !errors.Is(err, ErrBitmapDecompress) {
+		t.Errorf("truncated colour: got %v", err)
+	}
+	// 32-bpp planar data with truncated raw planes is rejected.
+	if _, err := DecompressIntoChecked([]byte{0x00}, nil, 4, 4, 4); !errors.Is(err, ErrBitmapDecompress) {
+		t.Errorf("non-RLE planar: got %v", err)
+	}
+}
+
+func FuzzDecompressIntoChecked(f *testing.F) {
+	f.Add([]byte{0xfd, 0xfe}, uint8(2), uint8(1), uint8(3))
+	f.Add([]byte{0x60, 0x04, 0x11, 0x22}, uint8(4), uint8(1), uint8(2))
+	f.Add([]byte{0xfe, 0xfd, 0x81, 0x33}, uint8(8), uint8(2), uint8(1))
+	f.Fuzz(func(t *testing.T, input []byte, width, height, bpp uint8) {
+		// widths are multiples of 4 on the wire
+		w := int(width&0x3F) * 4
+		DecompressIntoChecked(input, nil, w, int(height&0x3F), int(bpp%5))
+	})
+}
@@ -4,10 +4,14 @@ import (
 	"bufio"
 	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/asn1"
 	"errors"
+	"fmt"
 	"math/big"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,11 +28,18 @@ const readBufSize = 65536
 // briefly busy decoding a previous frame.
 const tcpRecvBufSize = 512 * 1024
 
+// SocketLayer is the TCP connection, optionally upgraded to TLS.  Write
+// and Close are safe to call from any goroutine: each Write reaches the
+// connection whole, never interleaved with another, whatever net.Conn the
+// layer was built on.
 type SocketLayer struct {
-	conn       net.Conn
-	tlsConn    *tls.Conn
+	conn       *countedConn
+	tlsConn    atomic.Pointer[tls.Conn]
+	writeMu    sync.Mutex    // serializes Write
 	reader     *bufio.Reader // buffers reads regardless of TLS state
 	serverName string
+	tlsConfig  *tls.Config
+	certPolicy *CertificatePolicy
 }
 
 func NewSocketLayer(conn net.Conn, serverName string) *SocketLayer {
@@ -42,36 +53,82 @@ func NewSocketLayer(conn net.Conn, serverName string) *SocketLayer {
 		_ = tc.SetReadBuffer(tcpRecvBufSize)
 	}
 	l := &SocketLayer{
-		conn:       conn,
-		tlsConn:    nil,
+		conn:       &countedConn{Conn: conn},
 		serverName: serverName,
 	}
-	l.reader = bufio.NewReaderSize(conn, readBufSize)
+	l.reader = bufio.NewReaderSize(l.conn, readBufSize)
 	return l
 }
 
+// countedConn counts the bytes read from and written to a connection.
+type countedConn struct {
+	net.Conn
+	read, written atomic.Uint64
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(uint64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+// Counts returns the bytes received and sent on the connection so far,
+// TLS records included.  It is safe to call from any goroutine.
+func (s *SocketLayer) Counts() (read, written uint64) {
+	return s.conn.read.Load(), s.conn.written.Load()
+}
+
 func (s *SocketLayer) SetDeadline(t time.Time) error {
 	return s.conn.SetDeadline(t)
 }
 
+// SetReadDeadline sets the deadline of the reads only.
+func (s *SocketLayer) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+// Reader returns the buffered reader Read reads from.  StartTLS resets it
+// onto the TLS connection, so it stays valid for the whole connection.
+func (s *SocketLayer) Reader() *bufio.Reader {
+	return s.reader
+}
+
 func (s *SocketLayer) Read(b []byte) (n int, err error) {
 	return s.reader.Read(b)
 }
 
 func (s *SocketLayer) Write(b []byte) (n int, err error) {
-	if s.tlsConn != nil {
-		return s.tlsConn.Write(b)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if tc := s.tlsConn.Load(); tc != nil {
+		return tc.Write(b)
 	}
 	return s.conn.Write(b)
 }
 
+// Close closes the connection.  It does not wait for a Write in progress,
+// which fails instead.
 func (s *SocketLayer) Close() error {
-	if s.tlsConn != nil {
-		s.tlsConn.Close() // best-effort; always close the underlying TCP socket
+	if tc := s.tlsConn.Load(); tc != nil {
+		tc.Close() // best-effort; always close the underlying TCP socket
 	}
 	return s.conn.Close()
 }
 
+// SetTLSConfig replaces the configuration used by StartTLS.  The config
+// is cloned at handshake time; an empty ServerName is filled in with the
+// host being connected to.  nil restores the default, which accepts any
+// server certificate and only negotiates TLS 1.2.
+func (s *SocketLayer) SetTLSConfig(config *tls.Config) {
+	s.tlsConfig = config
+}
+
 func (s *SocketLayer) StartTLS() error {
 	config := &tls.Config{
 		InsecureSkipVerify: true,
@@ -80,11 +137,24 @@ func (s *SocketLayer) StartTLS() error {
 		MaxVersion:         tls.VersionTLS12,
 		//		MaxVersion:               tls.VersionTLS13,
 	}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = s.serverName
+		}
+	}
 	tlsConn := tls.Client(s.conn, config)
 	if err := tlsConn.Handshake(); err != nil {
 		return err
 	}
-	s.tlsConn = tlsConn
+	if s.certPolicy != nil {
+		chain := tlsConn.ConnectionState().PeerCertificates
+		if err := s.certPolicy.Check(chain, config.ServerName); err != nil {
+			tlsConn.Close()
+			return err
+		}
+	}
+	s.tlsConn.Store(tlsConn)
 	// Reset the buffered reader to read from the TLS connection.
 	// Reset discards any unconsumed buffered bytes from the plain-text phase,
 	// which is correct because the TLS handshake has already consumed them.
@@ -97,10 +167,48 @@ type PublicKey struct {
 	E int      `asn1:"explicit,tag:1"` // public exponent
 }
 
+// SetCertificatePolicy makes StartTLS verify the server certificate
+// chain with p after the handshake.  nil accepts any certificate.
+func (s *SocketLayer) SetCertificatePolicy(p *CertificatePolicy) {
+	s.certPolicy = p
+}
+
+// PeerCertificates returns the certificate chain presented by the server
+// during StartTLS, leaf first.
+func (s *SocketLayer) PeerCertificates() []*x509.Certificate {
+	tc := s.tlsConn.Load()
+	if tc == nil {
+		return nil
+	}
+	return tc.ConnectionState().PeerCertificates
+}
+
+// PeerCertificate returns the leaf certificate presented by the server
+// during StartTLS.
+func (s *SocketLayer) PeerCertificate() (*x509.Certificate, error) {
+	tc := s.tlsConn.Load()
+	if tc == nil {
+		return nil, errors.New("TLS conn does not exist")
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("TLS peer sent no certificate")
+	}
+	return certs[0], nil
+}
+
 func (s *SocketLayer) TlsPubKey() ([]byte, error) {
-	if s.tlsConn == nil {
+	tc := s.tlsConn.Load()
+	if tc == nil {
 		return nil, errors.New("TLS conn does not exist")
 	}
-	pub := s.tlsConn.ConnectionState().PeerCertificates[0].PublicKey.(*rsa.PublicKey)
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.New("TLS peer sent no certificate")
+	}
+	pub, ok := certs[0].PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("TLS peer key is %T, not RSA", certs[0].PublicKey)
+	}
 	return asn1.Marshal(*pub)
 }
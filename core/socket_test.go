@@ -0,0 +1,78 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a throwaway server certificate for host.
+func selfSigned(t *testing.T, host string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestStartTLSConfig(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	cert := selfSigned(t, "rdp.example")
+	gotSNI := make(chan string, 1)
+	srv := tls.Server(server, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			gotSNI <- hello.ServerName
+			return nil, nil
+		},
+	})
+	go srv.Handshake()
+
+	s := NewSocketLayer(client, "rdp.example")
+	s.SetTLSConfig(&tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS13,
+	})
+	if err := s.StartTLS(); err != nil {
+		t.Fatal(err)
+	}
+	if sni := <-gotSNI; sni != "rdp.example" {
+		t.Errorf("SNI = %q, want the connection host", sni)
+	}
+	if v := srv.ConnectionState().Version; v != tls.VersionTLS13 {
+		t.Errorf("negotiated version %x, want TLS 1.3", v)
+	}
+	peer, err := s.PeerCertificate()
+	if err != nil || !peer.Equal(mustParse(t, cert.Certificate[0])) {
+		t.Errorf("PeerCertificate = %v, %v", peer, err)
+	}
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
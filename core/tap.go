@@ -0,0 +1,26 @@
+package core
+
+import "time"
+
+// TapPDU is a PDU of a connection as a Tap sees it: after TLS decryption
+// and before TLS encryption, framing included.
+type TapPDU struct {
+	Time     time.Time
+	Outbound bool // sent by the client
+	// Layer is the layer the PDU belongs to: "x224" for the X.224
+	// connection TPDUs, "mcs" for the X.224 data TPDUs, which carry the
+	// MCS and upper layers, and "fastpath" for fast-path PDUs.
+	Layer string
+	// Data is the whole TPKT frame or fast-path PDU.  It is only valid
+	// during the call.
+	Data []byte
+}
+
+// Tap receives a copy of the PDUs a connection sends and receives, for
+// packet captures.  Capture is called on the goroutines sending and
+// receiving, so it must be safe for concurrent use, and it holds them up
+// while it runs.  The CredSSP messages of NLA, which carry the
+// credentials, are not tapped.
+type Tap interface {
+	Capture(p TapPDU)
+}
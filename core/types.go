@@ -12,6 +12,22 @@ type Transport interface {
 	Emit(event any, arguments ...any) *emission.Emitter
 }
 
+// DataSource is a Transport that also publishes its "data" event as a
+// typed emission.Event.
+type DataSource interface {
+	OnData(f func([]byte)) *emission.Subscription
+}
+
+// OnData subscribes f to the "data" event of t, through the typed event
+// when t is a DataSource, which spares boxing every PDU.
+func OnData(t Transport, f func([]byte)) {
+	if s, ok := t.(DataSource); ok {
+		s.OnData(f)
+		return
+	}
+	t.On("data", f)
+}
+
 type FastPathListener interface {
 	RecvFastPath(secFlag byte, s []byte)
 }
@@ -0,0 +1,114 @@
+package grdp
+
+import (
+	"fmt"
+
+	"github.com/nakagami/grdp/protocol/nla"
+)
+
+// MaxCredentialAttempts bounds how many times Login asks a
+// CredentialProvider for a password after NLA rejected the previous one.
+const MaxCredentialAttempts = 3
+
+// CredentialRequest describes the connection a CredentialProvider is
+// asked about.
+type CredentialRequest struct {
+	Host    string
+	Domain  string // resolved so far; empty when GetDomain is being asked
+	User    string
+	Attempt int   // 1 for the first prompt
+	Err     error // why the previous attempt was rejected, nil on the first
+	Card    *nla.SmartCard
+}
+
+// CredentialProvider supplies secrets when the security layer needs them
+// rather than when the client is built, for interactive prompts or vault
+// lookups.  Values passed to Login act as defaults: GetDomain is only
+// called when the domain is empty, and GetPassword when the password is
+// empty or the server rejected the previous attempt.  Errors abort the
+// connection.
+type CredentialProvider interface {
+	GetDomain(req CredentialRequest) (string, error)
+	GetPassword(req CredentialRequest) (string, error)
+	// GetPIN is called for a smart card from SetSmartCardProvider that
+	// has no PIN; req.Card describes it.
+	GetPIN(req CredentialRequest) (string, error)
+}
+
+// SetCredentials sets the account used by CheckCredentials.  Login sets
+// it as well.
+func (g *RdpClient) SetCredentials(domain, user, password string) *RdpClient {
+	g.domain = domain
+	g.user = user
+	g.password = password
+	return g
+}
+
+// SetCredentialProvider makes Login resolve missing credentials through
+// p and prompt again, up to MaxCredentialAttempts times, when NLA fails
+// with nla.ErrBadCredentials.  nil restores the values passed to Login.
+func (g *RdpClient) SetCredentialProvider(p CredentialProvider) *RdpClient {
+	g.credentials = p
+	return g
+}
+
+func (g *RdpClient) credentialRequest() CredentialRequest {
+	return CredentialRequest{
+		Host:    g.hostPort,
+		Domain:  g.domain,
+		User:    g.user,
+		Attempt: g.credAttempt,
+		Err:     g.credErr,
+	}
+}
+
+// credentialsFunc returns the account callback for one connection
+// attempt.  NLA and the Client Info PDU share it, so the provider is
+// asked once per attempt; resolved values are kept for Reconnect.
+func (g *RdpClient) credentialsFunc() func() (domain, user, password string, err error) {
+	resolved := false
+	return func() (string, string, string, error) {
+		if resolved {
+			return g.domain, g.user, g.password, nil
+		}
+		if g.domain == "" {
+			d, err := g.credentials.GetDomain(g.credentialRequest())
+			if err != nil {
+				return "", "", "", fmt.Errorf("get domain: %w", err)
+			}
+			g.domain = d
+		}
+		if g.password == "" || g.credAttempt > 1 {
+			p, err := g.credentials.GetPassword(g.credentialRequest())
+			if err != nil {
+				return "", "", "", fmt.Errorf("get password: %w", err)
+			}
+			g.password = p
+		}
+		resolved = true
+		return g.domain, g.user, g.password, nil
+	}
+}
+
+// smartCardProvider wraps the configured smart card so a missing PIN is
+// asked from the CredentialProvider.
+func (g *RdpClient) smartCardProvider() nla.SmartCardProvider {
+	if g.smartCard == nil || g.credentials == nil {
+		return g.smartCard
+	}
+	return nla.SmartCardProviderFunc(func() (*nla.SmartCard, error) {
+		sc, err := g.smartCard.SmartCard()
+		if err != nil || sc.PIN != "" {
+			return sc, err
+		}
+		req := g.credentialRequest()
+		req.Card = sc
+		pin, err := g.credentials.GetPIN(req)
+		if err != nil {
+			return nil, fmt.Errorf("get PIN: %w", err)
+		}
+		card := *sc
+		card.PIN = pin
+		return &card, nil
+	})
+}
@@ -0,0 +1,60 @@
+package grdp
+
+import (
+	"testing"
+
+	"github.com/nakagami/grdp/protocol/nla"
+)
+
+type fakeCredentials struct {
+	reqs []CredentialRequest
+}
+
+func (f *fakeCredentials) GetDomain(req CredentialRequest) (string, error) {
+	f.reqs = append(f.reqs, req)
+	return "CORP", nil
+}
+
+func (f *fakeCredentials) GetPassword(req CredentialRequest) (string, error) {
+	f.reqs = append(f.reqs, req)
+	return "secret", nil
+}
+
+func (f *fakeCredentials) GetPIN(req CredentialRequest) (string, error) {
+	f.reqs = append(f.reqs, req)
+	return "1234", nil
+}
+
+func TestCredentialsFunc(t *testing.T) {
+	p := &fakeCredentials{}
+	g := NewRdpClient("host:3389", 800, 600, nil).SetCredentialProvider(p)
+	g.user, g.credAttempt = "alice", 1
+
+	resolve := g.credentialsFunc()
+	for range 2 {
+		domain, user, password, err := resolve()
+		if err != nil || domain != "CORP" || user != "alice" || password != "secret" {
+			t.Fatalf("got %q %q %q %v", domain, user, password, err)
+		}
+	}
+	if len(p.reqs) != 2 {
+		t.Fatalf("provider called %d times, want 2", len(p.reqs))
+	}
+
+	// A rejected attempt prompts for the password again but keeps the domain.
+	g.credAttempt, g.credErr = 2, nla.ErrBadCredentials
+	if _, _, _, err := g.credentialsFunc()(); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.reqs) != 3 || p.reqs[2].Attempt != 2 || p.reqs[2].Err != nla.ErrBadCredentials {
+		t.Errorf("unexpected requests %+v", p.reqs)
+	}
+
+	g.SetSmartCardProvider(nla.SmartCardProviderFunc(func() (*nla.SmartCard, error) {
+		return &nla.SmartCard{CardName: "card"}, nil
+	}))
+	sc, err := g.smartCardProvider().SmartCard()
+	if err != nil || sc.PIN != "1234" || sc.CardName != "card" {
+		t.Errorf("got %+v %v", sc, err)
+	}
+}
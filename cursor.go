@@ -0,0 +1,289 @@
+package grdp
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+// Cursor is a decoded remote pointer shape.
+type Cursor struct {
+	Image *image.RGBA // premultiplied RGBA, Width x Height
+	HotX  int         // hotspot relative to the top-left corner
+	HotY  int
+}
+
+// cursorState tracks the remote pointer shape cache, the current shape
+// and the pointer position so the cursor can be drawn into an image
+// (soft cursor) instead of being handed to the GUI.
+type cursorState struct {
+	mu      sync.Mutex
+	cache   map[uint16]*Cursor
+	current *Cursor
+	visible bool
+	x, y    int
+}
+
+func (c *cursorState) update(idx uint16, cur *Cursor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[uint16]*Cursor)
+	}
+	c.cache[idx] = cur
+	c.current = cur
+	c.visible = true
+}
+
+func (c *cursorState) cached(idx uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.cache[idx]; ok {
+		c.current = cur
+		c.visible = true
+	}
+}
+
+func (c *cursorState) hide() {
+	c.mu.Lock()
+	c.visible = false
+	c.mu.Unlock()
+}
+
+func (c *cursorState) move(x, y int) {
+	c.mu.Lock()
+	c.x, c.y = x, y
+	c.mu.Unlock()
+}
+
+// reset drops the shape cache; the server rebuilds it after reactivation.
+func (c *cursorState) reset() {
+	c.mu.Lock()
+	c.cache = nil
+	c.current = nil
+	c.visible = false
+	c.mu.Unlock()
+}
+
+// bounds returns the screen area the cursor covers, empty while hidden.
+func (c *cursorState) bounds() image.Rectangle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.visible || c.current == nil || c.current.Image == nil {
+		return image.Rectangle{}
+	}
+	return c.current.Image.Bounds().Add(image.Pt(c.x-c.current.HotX, c.y-c.current.HotY))
+}
+
+// draw composites the current cursor onto dst at the pointer position.
+func (c *cursorState) draw(dst draw.Image) {
+	c.mu.Lock()
+	cur, visible, x, y := c.current, c.visible, c.x, c.y
+	c.mu.Unlock()
+	if !visible || cur == nil || cur.Image == nil {
+		return
+	}
+	r := cur.Image.Bounds().Add(image.Pt(x-cur.HotX, y-cur.HotY))
+	draw.Draw(dst, r, cur.Image, image.Point{}, draw.Over)
+}
+
+// flipPointerMasks returns top-down copies of the pointer XOR and AND masks.
+// Both are stored bottom-up per MS-RDPBCGR 2.2.9.1.1.4.4, with rows padded
+// to a 2-byte boundary.
+func flipPointerMasks(p *pdu.FastPathUpdatePointerPDU) (andMask, xorData []byte) {
+	w := int(p.Width)
+	h := int(p.Height)
+	if w == 0 || h == 0 {
+		return p.Mask, p.Data
+	}
+	xorBpp := int(p.XorBpp)
+	if xorBpp == 0 {
+		xorBpp = 1
+	}
+	return flipRows(p.Mask, ((w+15)/16)*2, h), flipRows(p.Data, ((w*xorBpp+15)/16)*2, h)
+}
+
+func flipRows(src []byte, stride, h int) []byte {
+	if len(src) == 0 {
+		return src
+	}
+	dst := make([]byte, len(src))
+	copy(dst, src)
+	tmp := make([]byte, stride)
+	for y := 0; y < h/2; y++ {
+		top := y * stride
+		bot := (h - 1 - y) * stride
+		if top+stride <= len(dst) && bot+stride <= len(dst) {
+			copy(tmp, dst[top:top+stride])
+			copy(dst[top:top+stride], dst[bot:bot+stride])
+			copy(dst[bot:bot+stride], tmp)
+		}
+	}
+	return dst
+}
+
+// DecodeCursor converts top-down AND/XOR pointer masks (as passed to the
+// OnPointerUpdate callback) into a Cursor.  Pixels whose AND bit is set
+// are transparent when the XOR colour is black; screen-inverting pixels
+// (AND set, XOR non-black) are rendered opaque black.  32-bpp shapes with
+// a non-zero alpha channel use that alpha instead of the AND mask.
+func DecodeCursor(xorBpp, hotX, hotY, width, height int, andMask, xorData []byte) *Cursor {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if xorBpp == 0 {
+		xorBpp = 1
+	}
+	andStride := ((width + 15) / 16) * 2
+	xorStride := ((width*xorBpp + 15) / 16) * 2
+
+	hasAlpha := false
+	if xorBpp == 32 {
+		for i := 3; i < len(xorData); i += 4 {
+			if xorData[i] != 0 {
+				hasAlpha = true
+				break
+			}
+		}
+	}
+
+	for y := range height {
+		for x := range width {
+			var r, g, b, a uint8 = 0, 0, 0, 0xFF
+			row := y * xorStride
+			switch xorBpp {
+			case 1:
+				i := row + x/8
+				if i < len(xorData) && xorData[i]&(0x80>>(x%8)) != 0 {
+					r, g, b = 0xFF, 0xFF, 0xFF
+				}
+			case 16:
+				i := row + x*2
+				if i+1 < len(xorData) {
+					v := uint16(xorData[i]) | uint16(xorData[i+1])<<8
+					r = uint8(v>>11) << 3
+					g = uint8(v>>5) << 2
+					b = uint8(v) << 3
+				}
+			case 24:
+				i := row + x*3
+				if i+2 < len(xorData) {
+					b, g, r = xorData[i], xorData[i+1], xorData[i+2]
+				}
+			case 32:
+				i := row + x*4
+				if i+3 < len(xorData) {
+					b, g, r = xorData[i], xorData[i+1], xorData[i+2]
+					if hasAlpha {
+						a = xorData[i+3]
+					}
+				}
+			}
+
+			if !hasAlpha {
+				i := y*andStride + x/8
+				if i < len(andMask) && andMask[i]&(0x80>>(x%8)) != 0 {
+					if r|g|b == 0 {
+						a = 0
+					} else {
+						r, g, b = 0, 0, 0
+					}
+				}
+			}
+
+			o := img.PixOffset(x, y)
+			img.Pix[o+0] = uint8(uint16(r) * uint16(a) / 0xFF)
+			img.Pix[o+1] = uint8(uint16(g) * uint16(a) / 0xFF)
+			img.Pix[o+2] = uint8(uint16(b) * uint16(a) / 0xFF)
+			img.Pix[o+3] = a
+		}
+	}
+	return &Cursor{Image: img, HotX: hotX, HotY: hotY}
+}
+
+// SetSoftCursor selects how the remote cursor is presented.  When enabled
+// the OnPointer* callbacks are no longer invoked and the cursor is instead
+// drawn on the screen of Snapshot, SnapshotRect, Screenshot and the key
+// frames of WithRecorder, and by DrawCursor on other copies; moving or
+// changing it signals Updated and reports the areas to OnDamage.  When
+// disabled (the default) the cursor is delivered separately through the
+// OnPointer* callbacks for interactive GUIs.
+func (g *RdpClient) SetSoftCursor(enabled bool) *RdpClient {
+	g.softCursor.Store(enabled)
+	return g
+}
+
+// DrawCursor composites the current remote cursor onto dst at the last
+// known pointer position.  It does nothing while the server has hidden
+// the pointer.
+func (g *RdpClient) DrawCursor(dst draw.Image) {
+	g.cursor.draw(dst)
+}
+
+// softCursorState returns the cursor to draw on copies of the screen,
+// nil unless SetSoftCursor is enabled.
+func (g *RdpClient) softCursorState() *cursorState {
+	if !g.softCursor.Load() {
+		return nil
+	}
+	return &g.cursor
+}
+
+// cursorChanged applies change to the cursor and, with the soft cursor,
+// tells the framebuffer and OnDamage about the areas it left and covers.
+func (g *RdpClient) cursorChanged(change func()) {
+	before := g.cursor.bounds()
+	change()
+	if !g.softCursor.Load() {
+		return
+	}
+	screen := image.Rect(0, 0, g.width, g.height)
+	if g.fb != nil {
+		g.fb.mu.Lock()
+		screen = g.fb.img.Rect
+		g.fb.mu.Unlock()
+	}
+	var rects []image.Rectangle
+	for _, r := range []image.Rectangle{before, g.cursor.bounds()} {
+		if r = r.Intersect(screen); !r.Empty() {
+			rects = append(rects, r)
+		}
+	}
+	if len(rects) == 0 {
+		return
+	}
+	if g.fb != nil {
+		g.fb.notify()
+	}
+	if g.onDamageFn != nil {
+		g.onDamageFn(rects)
+	}
+}
+
+// trackCursor follows pointer PDUs on the current connection.
+func (g *RdpClient) trackCursor() {
+	g.pdu.On("pointer_update", func(p *pdu.FastPathUpdatePointerPDU) {
+		andMask, xorData := flipPointerMasks(p)
+		cur := DecodeCursor(int(p.XorBpp), int(p.X), int(p.Y), int(p.Width), int(p.Height), andMask, xorData)
+		g.cursorChanged(func() { g.cursor.update(p.CacheIdx, cur) })
+	})
+	g.pdu.On("color", func(p *pdu.FastPathColorPdu) {
+		cp := &pdu.FastPathUpdatePointerPDU{XorBpp: 24, CacheIdx: p.CacheIdx,
+			X: p.X, Y: p.Y, Width: p.Width, Height: p.Height, Data: p.Data, Mask: p.Mask}
+		andMask, xorData := flipPointerMasks(cp)
+		cur := DecodeCursor(24, int(p.X), int(p.Y), int(p.Width), int(p.Height), andMask, xorData)
+		g.cursorChanged(func() { g.cursor.update(p.CacheIdx, cur) })
+	})
+	g.pdu.On("pointer_cached", func(idx uint16) {
+		g.cursorChanged(func() { g.cursor.cached(idx) })
+	})
+	g.pdu.On("pointer_hide", func() {
+		g.cursorChanged(g.cursor.hide)
+	})
+	g.pdu.On("pointer_position", func(x, y uint16) {
+		g.cursorChanged(func() { g.cursor.move(int(x), int(y)) })
+	})
+	g.pdu.On("deactivateAll", func() {
+		g.cursorChanged(g.cursor.reset)
+	})
+}
@@ -0,0 +1,96 @@
+package grdp
+
+import (
+	"image"
+	"testing"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+func TestDecodeCursorMasks(t *testing.T) {
+	// 2x1 1-bpp pointer: pixel 0 is white and opaque, pixel 1 is
+	// transparent (AND set, XOR black).
+	c := DecodeCursor(1, 0, 0, 2, 1, []byte{0x40, 0x00}, []byte{0x80, 0x00})
+	if got := c.Image.RGBAAt(0, 0); got.R != 0xFF || got.A != 0xFF {
+		t.Errorf("pixel 0 = %v", got)
+	}
+	if got := c.Image.RGBAAt(1, 0); got.A != 0 {
+		t.Errorf("pixel 1 = %v", got)
+	}
+}
+
+func TestDecodeCursorAlpha(t *testing.T) {
+	// 1x1 32-bpp pointer with half alpha is premultiplied.
+	c := DecodeCursor(32, 0, 0, 1, 1, []byte{0xFF, 0xFF}, []byte{0x00, 0x00, 0xFF, 0x80})
+	if got := c.Image.RGBAAt(0, 0); got.R != 0x80 || got.A != 0x80 {
+		t.Errorf("pixel = %v", got)
+	}
+}
+
+func TestCursorStateDraw(t *testing.T) {
+	var cs cursorState
+	cur := DecodeCursor(24, 1, 1, 2, 2, nil, []byte{
+		0, 0, 0xFF, 0, 0, 0xFF,
+		0, 0, 0xFF, 0, 0, 0xFF,
+	})
+	cs.update(7, cur)
+	cs.move(5, 5)
+
+	dst := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	cs.draw(dst)
+	if got := dst.RGBAAt(4, 4); got.R != 0xFF {
+		t.Errorf("cursor not drawn at hotspot offset: %v", got)
+	}
+
+	cs.hide()
+	dst = image.NewRGBA(image.Rect(0, 0, 8, 8))
+	cs.draw(dst)
+	if got := dst.RGBAAt(4, 4); got.A != 0 {
+		t.Errorf("hidden cursor drawn: %v", got)
+	}
+	cs.cached(7)
+	cs.draw(dst)
+	if got := dst.RGBAAt(5, 5); got.R != 0xFF {
+		t.Errorf("cached cursor not restored: %v", got)
+	}
+}
+
+func TestSoftCursorSnapshot(t *testing.T) {
+	var damage []image.Rectangle
+	g, _ := newSession(8, 8, WithFramebuffer())
+	g.OnDamage(func(rects []image.Rectangle) { damage = append(damage, rects...) })
+	// A red 2x2 pointer with its hotspot at 1,1.
+	g.pdu.Emit("pointer_update", &pdu.FastPathUpdatePointerPDU{XorBpp: 24, X: 1, Y: 1, Width: 2, Height: 2,
+		Data: []byte{0, 0, 0xFF, 0, 0, 0xFF, 0, 0, 0xFF, 0, 0, 0xFF}, Mask: []byte{0, 0, 0, 0}})
+	g.pdu.Emit("pointer_position", uint16(5), uint16(5))
+	if c := g.Snapshot().RGBAAt(4, 4); c.R != 0 {
+		t.Errorf("cursor drawn without the soft cursor: %v", c)
+	}
+	if len(damage) != 0 {
+		t.Errorf("damage without the soft cursor: %v", damage)
+	}
+
+	g.SetSoftCursor(true)
+	updated := g.Updated()
+	g.pdu.Emit("pointer_position", uint16(3), uint16(3))
+	img := g.Snapshot()
+	if c := img.RGBAAt(2, 2); c.R != 0xFF || img.RGBAAt(4, 4).R != 0 {
+		t.Errorf("cursor at 2,2: %v, at 4,4: %v", c, img.RGBAAt(4, 4))
+	}
+	if c := g.SnapshotRect(image.Rect(3, 3, 8, 8)).RGBAAt(3, 3); c.R != 0xFF {
+		t.Errorf("cursor in the rectangle: %v", c)
+	}
+	if len(damage) != 2 || damage[0] != image.Rect(4, 4, 6, 6) || damage[1] != image.Rect(2, 2, 4, 4) {
+		t.Errorf("damage %v", damage)
+	}
+	select {
+	case <-updated:
+	default:
+		t.Error("moving the soft cursor did not signal Updated")
+	}
+
+	g.pdu.Emit("pointer_hide")
+	if c := g.Snapshot().RGBAAt(2, 2); c.R != 0 {
+		t.Errorf("hidden cursor drawn: %v", c)
+	}
+}
@@ -44,12 +44,21 @@ var rvPool = [4]*sync.Pool{
 	3: {New: func() any { v := make([]reflect.Value, 3); return &v }},
 }
 
-// Emitter is a reflect-minimal event emitter.
+// Emitter is a reflect-minimal event emitter.  Listeners may be added and
+// removed from any goroutine, including while an event is being emitted:
+// Emit calls the listeners registered when it started, outside the lock,
+// so a listener may itself register listeners or emit.
 type Emitter struct {
+	// mu guards events and onces.  It is a pointer so the structs that
+	// embed a copy of *NewEmitter() share it with no copy of a lock.
+	mu           *sync.Mutex
 	events       map[any][]listenerEntry
 	onces        map[any][]listenerEntry
 	recoverer    RecoveryListener
 	maxListeners int
+	// forwards holds the typed events standing for string events; see
+	// Event.Shim.
+	forwards map[any]func([]any)
 }
 
 // NewEmitter returns a new Emitter object, defaulting the
@@ -57,6 +66,7 @@ type Emitter struct {
 // constant and initializing its events map.
 func NewEmitter() *Emitter {
 	return &Emitter{
+		mu:           new(sync.Mutex),
 		events:       make(map[any][]listenerEntry),
 		onces:        make(map[any][]listenerEntry),
 		maxListeners: DefaultMaxListeners,
@@ -80,6 +90,8 @@ func (e *Emitter) AddListener(event, listener any) *Emitter {
 		e.recoverer(event, listener, ErrNoneFunction)
 		return e
 	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if e.maxListeners != -1 && e.maxListeners < len(e.events[event])+1 {
 		fmt.Fprintf(os.Stdout, "Warning: event `%v` has exceeded the maximum "+
 			"number of listeners of %d.\n", event, e.maxListeners)
@@ -99,13 +111,16 @@ func (e *Emitter) RemoveListener(event, listener any) *Emitter {
 		return e
 	}
 	ptr := rv.Pointer()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// The slices are cloned: an Emit in progress iterates the old ones.
 	if _, ok := e.events[event]; ok {
-		e.events[event] = slices.DeleteFunc(e.events[event], func(ent listenerEntry) bool {
+		e.events[event] = slices.DeleteFunc(slices.Clone(e.events[event]), func(ent listenerEntry) bool {
 			return ent.ptr == ptr
 		})
 	}
 	if _, ok := e.onces[event]; ok {
-		e.onces[event] = slices.DeleteFunc(e.onces[event], func(ent listenerEntry) bool {
+		e.onces[event] = slices.DeleteFunc(slices.Clone(e.onces[event]), func(ent listenerEntry) bool {
 			return ent.ptr == ptr
 		})
 	}
@@ -127,6 +142,8 @@ func (e *Emitter) Once(event, listener any) *Emitter {
 		e.recoverer(event, listener, ErrNoneFunction)
 		return e
 	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if e.maxListeners != -1 && e.maxListeners < len(e.onces[event])+1 {
 		fmt.Fprintf(os.Stdout, "Warning: event `%v` has exceeded the maximum "+
 			"number of listeners of %d.\n", event, e.maxListeners)
@@ -135,21 +152,37 @@ func (e *Emitter) Once(event, listener any) *Emitter {
 	return e
 }
 
-// Emit calls each listener registered for event with the supplied arguments.
+// Emit calls each listener registered for event with the supplied arguments,
+// after the subscribers of the typed event shimmed for it.
 func (e *Emitter) Emit(event any, arguments ...any) *Emitter {
-	if entries, ok := e.events[event]; ok {
-		for _, ent := range entries {
-			e.dispatch(ent, event, arguments)
-		}
+	if f := e.forwards[event]; f != nil {
+		f(arguments)
 	}
-	// Execute onces; preserve any new onces registered during execution
-	// (fix issue with nested Once — same semantics as original).
-	if entries, ok := e.onces[event]; ok {
-		origLen := len(entries)
-		for _, ent := range entries {
-			e.dispatch(ent, event, arguments)
-		}
-		e.onces[event] = e.onces[event][origLen:]
+	return e.emit(event, arguments)
+}
+
+// hasListeners reports whether On or Once registered listeners for event.
+func (e *Emitter) hasListeners(event any) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.events[event]) > 0 || len(e.onces[event]) > 0
+}
+
+func (e *Emitter) emit(event any, arguments []any) *Emitter {
+	e.mu.Lock()
+	entries := e.events[event]
+	// Take the onces before calling them, so a once registered during
+	// the calls waits for the next emission (fix issue with nested Once).
+	onces := e.onces[event]
+	if len(onces) > 0 {
+		e.onces[event] = nil
+	}
+	e.mu.Unlock()
+	for _, ent := range entries {
+		e.dispatch(ent, event, arguments)
+	}
+	for _, ent := range onces {
+		e.dispatch(ent, event, arguments)
 	}
 	return e
 }
@@ -180,6 +213,8 @@ func (e *Emitter) SetMaxListeners(max int) *Emitter {
 
 // GetListenerCount returns the number of listeners registered for event.
 func (e *Emitter) GetListenerCount(event any) (count int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	if entries, ok := e.events[event]; ok {
 		count = len(entries)
 	}
@@ -190,6 +225,8 @@ func (e *Emitter) GetListenerCount(event any) (count int) {
 // Use instead of e.On(event, fn) when the argument type is not covered by the
 // built-in fast paths (func(), func(error), func([]byte), func(uint16)).
 func On1[T any](e *Emitter, event any, fn func(T)) *Emitter {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.events[event] = append(e.events[event], listenerEntry{
 		call: func(args []any) {
 			if len(args) > 0 {
@@ -202,6 +239,8 @@ func On1[T any](e *Emitter, event any, fn func(T)) *Emitter {
 
 // Once1 registers a typed one-shot listener with zero reflection at emit time.
 func Once1[T any](e *Emitter, event any, fn func(T)) *Emitter {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.onces[event] = append(e.onces[event], listenerEntry{
 		call: func(args []any) {
 			if len(args) > 0 {
@@ -212,6 +251,10 @@ func Once1[T any](e *Emitter, event any, fn func(T)) *Emitter {
 	return e
 }
 
+func funcPtr(fn any) uintptr {
+	return reflect.ValueOf(fn).Pointer()
+}
+
 // buildEntry creates a listenerEntry for the given listener.
 // Returns (entry, true) on success, (zero, false) if listener is not a Func.
 //
@@ -220,10 +263,11 @@ func Once1[T any](e *Emitter, event any, fn func(T)) *Emitter {
 // Slow path: an unknown function type is wrapped with a pooled-reflect
 // wrapper that avoids heap allocation for 0–3 argument calls.
 func buildEntry(listener any) (listenerEntry, bool) {
-	// Fast path — type-assert well-known signatures.
+	// Fast path — type-assert well-known signatures.  The pointer is
+	// still recorded so RemoveListener finds them.
 	switch fn := listener.(type) {
 	case func():
-		return listenerEntry{call: func(_ []any) { fn() }}, true
+		return listenerEntry{call: func(_ []any) { fn() }, ptr: funcPtr(fn)}, true
 	case func(error):
 		return listenerEntry{call: func(args []any) {
 			var err error
@@ -231,19 +275,19 @@ func buildEntry(listener any) (listenerEntry, bool) {
 				err = args[0].(error)
 			}
 			fn(err)
-		}}, true
+		}, ptr: funcPtr(fn)}, true
 	case func([]byte):
 		return listenerEntry{call: func(args []any) {
 			if len(args) > 0 {
 				fn(args[0].([]byte))
 			}
-		}}, true
+		}, ptr: funcPtr(fn)}, true
 	case func(uint16):
 		return listenerEntry{call: func(args []any) {
 			if len(args) > 0 {
 				fn(args[0].(uint16))
 			}
-		}}, true
+		}, ptr: funcPtr(fn)}, true
 	}
 
 	// Reflection fallback — verify the value is a Func, then build a wrapper
@@ -0,0 +1,139 @@
+package emission
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// Event is a typed event.  Unlike the string events of Emitter, its
+// listeners take a T, so emitting neither boxes the value nor goes through
+// reflection, and every subscription returns a handle that removes it.
+// Subscribing, removing and emitting are safe from any goroutine; a
+// listener added while the event is being emitted is called from the next
+// emission on.
+//
+// The zero Event is ready to use.  Shim keeps code written against the
+// string event the Event replaces working.
+type Event[T any] struct {
+	mu     sync.Mutex                     // serializes changes of subs
+	subs   atomic.Pointer[[]*listener[T]] // copied on write
+	legacy *Emitter
+	name   any
+	args   func(T) []any
+}
+
+type listener[T any] struct {
+	f     func(T)
+	once  bool
+	fired atomic.Bool
+}
+
+// Subscription is the handle of a listener of an Event.
+type Subscription struct {
+	remove func()
+	once   sync.Once
+}
+
+// Remove unsubscribes the listener.  It may be called more than once and
+// on a nil Subscription.
+func (s *Subscription) Remove() {
+	if s == nil {
+		return
+	}
+	s.once.Do(s.remove)
+}
+
+// Subscribe calls f with every value emitted until the subscription is
+// removed.
+func (ev *Event[T]) Subscribe(f func(T)) *Subscription {
+	return ev.add(&listener[T]{f: f})
+}
+
+// SubscribeOnce calls f with the next value emitted only.
+func (ev *Event[T]) SubscribeOnce(f func(T)) *Subscription {
+	return ev.add(&listener[T]{f: f, once: true})
+}
+
+func (ev *Event[T]) add(l *listener[T]) *Subscription {
+	ev.mu.Lock()
+	var subs []*listener[T]
+	if p := ev.subs.Load(); p != nil {
+		subs = slices.Clone(*p)
+	}
+	subs = append(subs, l)
+	ev.subs.Store(&subs)
+	ev.mu.Unlock()
+	return &Subscription{remove: func() { ev.remove(l) }}
+}
+
+func (ev *Event[T]) remove(l *listener[T]) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	p := ev.subs.Load()
+	if p == nil {
+		return
+	}
+	subs := slices.DeleteFunc(slices.Clone(*p), func(s *listener[T]) bool { return s == l })
+	ev.subs.Store(&subs)
+}
+
+// Len returns the number of subscribed listeners.
+func (ev *Event[T]) Len() int {
+	if p := ev.subs.Load(); p != nil {
+		return len(*p)
+	}
+	return 0
+}
+
+// Emit calls the listeners with v, in the order they subscribed, and
+// then those registered for the shimmed string event.
+func (ev *Event[T]) Emit(v T) {
+	ev.emit(v)
+	if ev.legacy != nil && ev.legacy.hasListeners(ev.name) {
+		ev.legacy.emit(ev.name, ev.args(v))
+	}
+}
+
+func (ev *Event[T]) emit(v T) {
+	p := ev.subs.Load()
+	if p == nil {
+		return
+	}
+	for _, l := range *p {
+		if l.once {
+			if !l.fired.CompareAndSwap(false, true) {
+				continue
+			}
+			ev.remove(l)
+		}
+		l.f(v)
+	}
+}
+
+// Shim makes ev stand for the string event name of e: the listeners
+// registered with e.On(name, ...) keep receiving the values of ev, after
+// its own subscribers, and e.Emit(name, ...) reaches the subscribers of
+// ev.  args converts a value to the arguments of the string event and
+// value converts them back; nil for both passes the value as the only
+// argument, which also suits a T of struct{} for events without one.  It
+// must be called before either is used.
+func (ev *Event[T]) Shim(e *Emitter, name any, args func(T) []any, value func([]any) T) {
+	if args == nil {
+		args = func(v T) []any { return []any{v} }
+	}
+	if value == nil {
+		value = func(a []any) T {
+			var v T
+			if len(a) > 0 {
+				v, _ = a[0].(T)
+			}
+			return v
+		}
+	}
+	ev.legacy, ev.name, ev.args = e, name, args
+	if e.forwards == nil {
+		e.forwards = make(map[any]func([]any))
+	}
+	e.forwards[name] = func(a []any) { ev.emit(value(a)) }
+}
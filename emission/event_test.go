@@ -0,0 +1,65 @@
+package emission
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestEvent(t *testing.T) {
+	var ev Event[int]
+	var got []int
+	sub := ev.Subscribe(func(v int) { got = append(got, v) })
+	ev.SubscribeOnce(func(v int) { got = append(got, -v) })
+	ev.Emit(1)
+	ev.Emit(2)
+	sub.Remove()
+	sub.Remove()
+	ev.Emit(3)
+	if len(got) != 3 || got[0] != 1 || got[1] != -1 || got[2] != 2 || ev.Len() != 0 {
+		t.Errorf("got %v, %d listeners", got, ev.Len())
+	}
+}
+
+func TestEventShim(t *testing.T) {
+	e := NewEmitter()
+	var ev Event[[]byte]
+	ev.Shim(e, "data", nil, nil)
+	var typed, legacy int
+	ev.Subscribe(func(b []byte) { typed += len(b) })
+	e.On("data", func(b []byte) { legacy += len(b) })
+
+	ev.Emit([]byte{1, 2})
+	e.Emit("data", []byte{3})
+	if typed != 3 || legacy != 3 {
+		t.Errorf("typed %d, legacy %d", typed, legacy)
+	}
+}
+
+// TestEmitterConcurrent registers listeners while another goroutine
+// emits, as layers do with the reader goroutine of the connection; run it
+// with -race.
+func TestEmitterConcurrent(t *testing.T) {
+	e := NewEmitter()
+	e.SetMaxListeners(-1)
+	var n atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 1000 {
+			e.Emit("data", []byte{1})
+		}
+	}()
+	count := func(b []byte) { n.Add(1) }
+	for range 100 {
+		e.Once("data", count)
+		e.On("data", count)
+		e.Off("data", count)
+	}
+	<-done
+	e.Once("data", count)
+	e.Emit("data", []byte{1})
+	e.Emit("data", []byte{1})
+	if n.Load() == 0 || e.GetListenerCount("data") != 0 {
+		t.Errorf("%d calls, %d listeners", n.Load(), e.GetListenerCount("data"))
+	}
+}
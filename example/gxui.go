@@ -5,10 +5,8 @@ import (
 	"bytes"
 	"fmt"
 	"image"
-	"image/draw"
 	"io"
 	"log/slog"
-	"net"
 	"os"
 	"strings"
 	"strconv"
@@ -282,9 +280,7 @@ var (
 
 func uiRdp(hostPort, domain, user, password string, width, height int, keyboardType, keyboardLayout string) (error, *grdp.RdpClient) {
 	bitmapCH = make(chan timedBitmap, 500)
-	g := grdp.NewRdpClient(hostPort, width, height, func(hp string) (net.Conn, error) {
-		return net.DialTimeout("tcp", hp, 30*time.Second)
-	})
+	g := grdp.New(hostPort, grdp.WithResolution(width, height))
 	if keyboardType != "" {
 		g.SetKeyboardType(keyboardType)
 	}
@@ -753,14 +749,13 @@ func cloneRGBA(src *image.RGBA) *image.RGBA {
 
 func paintBitmapsLocked(bs []grdp.Bitmap) {
 	for _, bm := range bs {
-		m := bm.RGBA()
 		destRect := image.Rect(bm.DestLeft, bm.DestTop, bm.DestRight+1, bm.DestBottom+1)
-		draw.Draw(screenImage, destRect, m, image.Pt(0, 0), draw.Src)
+		bm.BitmapToRGBAInto(screenImage.SubImage(destRect).(*image.RGBA), destRect.Min)
 	}
 }
 
-func transKey(in gxui.KeyboardKey) int {
-	var KeyMap = map[gxui.KeyboardKey]int{
+func transKey(in gxui.KeyboardKey) grdp.Scancode {
+	var KeyMap = map[gxui.KeyboardKey]grdp.Scancode{
 		gxui.KeyUnknown:      0x0000,
 		gxui.KeyEscape:       0x0001,
 		gxui.Key1:            0x0002,
@@ -853,8 +848,8 @@ func transKey(in gxui.KeyboardKey) int {
 		gxui.KeyKpDivide:     0xE035,
 		gxui.KeyPrintScreen:  0xE037,
 		gxui.KeyRightAlt:     0xE038,
-		gxui.KeyNumLock:      0xE045,
-		gxui.KeyPause:        0xE046,
+		gxui.KeyNumLock:      0x0045,
+		gxui.KeyPause:        grdp.ScancodePause,
 		gxui.KeyHome:         0xE047,
 		gxui.KeyUp:           0xE048,
 		gxui.KeyPageUp:       0xE049,
@@ -0,0 +1,66 @@
+package grdp
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/nakagami/grdp/protocol/x224"
+)
+
+// ServerFingerprint is what an RDP server reveals before authentication.
+// The NTLM fields are empty when the server does not select CredSSP.
+type ServerFingerprint struct {
+	// Protocol is the x224 security protocol the server selected when
+	// offered TLS and CredSSP; see x224.ProtocolName.
+	Protocol uint32
+
+	NetBIOSComputerName string
+	NetBIOSDomainName   string
+	DNSComputerName     string
+	DNSDomainName       string
+	DNSTreeName         string
+
+	// OSVersion is "major.minor.build" from the NTLM version field, e.g.
+	// "10.0.20348", or empty when the server did not send one.
+	OSVersion string
+	// Timestamp is the server clock from the NTLM target info.
+	Timestamp time.Time
+
+	// Certificates is the TLS chain presented by the server, leaf first.
+	Certificates []*x509.Certificate
+}
+
+// Fingerprint connects to host only far enough to identify it: the x224
+// negotiation, the TLS handshake and, with CredSSP, the NTLM CHALLENGE.
+// No credentials are sent.  WithDialer and WithTimeouts control the
+// connection.
+func Fingerprint(host string, opts ...Option) (*ServerFingerprint, error) {
+	return New(host, opts...).Fingerprint()
+}
+
+// Fingerprint identifies the server without logging on; see the
+// package-level Fingerprint.
+func (g *RdpClient) Fingerprint() (*ServerFingerprint, error) {
+	r := g.probeConnect(context.Background(), x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID, true)
+	if r.err != nil {
+		return nil, r.err
+	}
+	fp := &ServerFingerprint{
+		Protocol:     r.selected,
+		Certificates: r.certs,
+	}
+	if info := r.info; info != nil {
+		fp.NetBIOSComputerName = info.NbComputerName
+		fp.NetBIOSDomainName = info.NbDomainName
+		fp.DNSComputerName = info.DnsComputerName
+		fp.DNSDomainName = info.DnsDomainName
+		fp.DNSTreeName = info.DnsTreeName
+		fp.Timestamp = info.Timestamp
+		if v := info.Version; v != nil {
+			fp.OSVersion = fmt.Sprintf("%d.%d.%d", v.ProductMajorVersion, v.ProductMinorVersion, v.ProductBuild)
+		}
+	}
+	return fp, nil
+}
@@ -0,0 +1,111 @@
+package grdp
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/protocol/nla"
+	"github.com/nakagami/grdp/protocol/x224"
+)
+
+type rawToken []byte
+
+func (m rawToken) Serialize() []byte { return m }
+
+// ntlmChallenge returns a CHALLENGE_MESSAGE with a version and a target
+// info holding the NetBIOS computer name "SRV".
+func ntlmChallenge() []byte {
+	info := &bytes.Buffer{}
+	name := []byte{'S', 0, 'R', 0, 'V', 0}
+	binary.Write(info, binary.LittleEndian, [2]uint16{nla.MsvAvNbComputerName, uint16(len(name))})
+	info.Write(name)
+	info.Write([]byte{0, 0, 0, 0})
+
+	msg := &bytes.Buffer{}
+	msg.WriteString("NTLMSSP\x00")
+	binary.Write(msg, binary.LittleEndian, uint32(2))
+	binary.Write(msg, binary.LittleEndian, [2]uint16{0, 0})
+	binary.Write(msg, binary.LittleEndian, uint32(56))
+	binary.Write(msg, binary.LittleEndian, uint32(nla.NTLMSSP_NEGOTIATE_UNICODE|nla.NTLMSSP_NEGOTIATE_VERSION))
+	msg.Write(make([]byte, 16)) // server challenge, reserved
+	binary.Write(msg, binary.LittleEndian, [2]uint16{uint16(info.Len()), uint16(info.Len())})
+	binary.Write(msg, binary.LittleEndian, uint32(56))
+	msg.Write([]byte{10, 0, 0x5c, 0x4f, 0, 0, 0, 15}) // 10.0.20316
+	msg.Write(info.Bytes())
+	return msg.Bytes()
+}
+
+// fakeNLAServer answers one connection with CredSSP, a TLS handshake and
+// reply to the NTLM NEGOTIATE, then waits for the client to hang up.
+func fakeNLAServer(t *testing.T, conn net.Conn, cert tls.Certificate, reply []byte) {
+	defer conn.Close()
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return
+	}
+	io.CopyN(io.Discard, conn, int64(binary.BigEndian.Uint16(hdr[2:])-4))
+	cc := []byte{0x0e, 0xd0, 0, 0, 0, 0, 0, byte(x224.TYPE_RDP_NEG_RSP), 0, 0x08, 0x00, byte(x224.PROTOCOL_HYBRID), 0, 0, 0}
+	conn.Write(append([]byte{3, 0, 0, byte(len(cc) + 4)}, cc...))
+
+	srv := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+	buf := make([]byte, 1024)
+	if _, err := srv.Read(buf); err != nil {
+		t.Errorf("server: read NEGOTIATE: %v", err)
+		return
+	}
+	srv.Write(reply)
+	if n, err := srv.Read(buf); err == nil {
+		t.Errorf("client sent %d bytes after the reply", n)
+	}
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestFingerprint(t *testing.T) {
+	cert := testCertificate(t)
+	reply, err := nla.EncodeDERTRequestVersion(6, []nla.Message{rawToken(ntlmChallenge())}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewRdpClient("srv:3389", 800, 600, func(string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go fakeNLAServer(t, server, cert, reply)
+		return client, nil
+	})
+	fp, err := g.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp.Protocol != x224.PROTOCOL_HYBRID || fp.NetBIOSComputerName != "SRV" || fp.OSVersion != "10.0.20316" {
+		t.Errorf("unexpected fingerprint %+v", fp)
+	}
+	if len(fp.Certificates) != 1 || !bytes.Equal(fp.Certificates[0].Raw, cert.Certificate[0]) {
+		t.Errorf("got %d certificates", len(fp.Certificates))
+	}
+}
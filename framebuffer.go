@@ -0,0 +1,182 @@
+package grdp
+
+import (
+	"image"
+	"image/draw"
+	"sync"
+	"time"
+)
+
+// framebuffer composites bitmap updates into a copy of the remote screen
+// and tracks the area damaged since it was last taken.
+type framebuffer struct {
+	mu        sync.Mutex
+	img       *image.RGBA
+	dirty     image.Rectangle
+	painted   image.Rectangle // bounds of everything painted
+	lastPaint time.Time
+	// updated is closed and replaced by every update.
+	updated chan struct{}
+}
+
+func newFramebuffer(width, height int) *framebuffer {
+	return &framebuffer{
+		img:     image.NewRGBA(image.Rect(0, 0, width, height)),
+		updated: make(chan struct{}),
+	}
+}
+
+// WithFramebuffer makes the client composite every bitmap, surface and
+// drawing order update into a copy of the remote screen, which Snapshot
+// returns, so a GUI only needs to redraw the areas OnDamage reports
+// instead of compositing the updates itself.  The copy follows the
+// desktop size.
+func WithFramebuffer() Option {
+	return func(g *RdpClient) {
+		g.fb = newFramebuffer(g.width, g.height)
+	}
+}
+
+// Snapshot returns a copy of the remote screen, with the remote cursor
+// drawn on it under SetSoftCursor, or nil without WithFramebuffer.  It is
+// safe to call from any goroutine.
+func (g *RdpClient) Snapshot() *image.RGBA {
+	if g.fb == nil {
+		return nil
+	}
+	img, _ := g.fb.snapshot(g.softCursorState())
+	return img
+}
+
+// SnapshotRect returns a copy of area r of the remote screen, at its
+// screen coordinates, or nil without WithFramebuffer.
+func (g *RdpClient) SnapshotRect(r image.Rectangle) *image.RGBA {
+	if g.fb == nil {
+		return nil
+	}
+	return g.fb.image(r, g.softCursorState())
+}
+
+// Updated returns a channel closed by the next update of the screen
+// Snapshot returns, nil without WithFramebuffer.  Waiting on it again
+// after each update, with a fresh call, follows the screen without
+// polling.
+func (g *RdpClient) Updated() <-chan struct{} {
+	if g.fb == nil {
+		return nil
+	}
+	g.fb.mu.Lock()
+	defer g.fb.mu.Unlock()
+	return g.fb.updated
+}
+
+// OnDamage registers a callback with the screen rectangles each update
+// changed, called after OnBitmap and, with WithFramebuffer, once Snapshot
+// shows them.  It runs on the goroutine that decoded the update.  Must be
+// called before Login.
+func (g *RdpClient) OnDamage(f func(rects []image.Rectangle)) *RdpClient {
+	g.onDamageFn = f
+	return g
+}
+
+// resize changes the screen size, keeping the pixels both sizes share,
+// and damages the whole screen.
+func (f *framebuffer) resize(width, height int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.img.Rect.Dx() == width && f.img.Rect.Dy() == height {
+		return
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Rect, f.img, image.Point{}, draw.Src)
+	f.img = img
+	f.dirty = img.Rect
+	f.painted = f.painted.Intersect(img.Rect)
+	f.signal()
+}
+
+// complete reports whether updates have covered the bounds of the whole
+// screen.
+func (f *framebuffer) complete() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.painted == f.img.Rect
+}
+
+// paint copies bitmaps into the screen image; Dest rectangles are
+// inclusive.
+func (f *framebuffer) paint(bitmaps []Bitmap) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range bitmaps {
+		r := bitmaps[i].paintInto(f.img)
+		f.dirty = f.dirty.Union(r)
+		f.painted = f.painted.Union(r)
+	}
+	if len(bitmaps) > 0 {
+		f.lastPaint = time.Now()
+		f.signal()
+	}
+}
+
+// notify wakes the waiters of Updated for a change drawn over the
+// screen, such as the soft cursor.
+func (f *framebuffer) notify() {
+	f.mu.Lock()
+	f.signal()
+	f.mu.Unlock()
+}
+
+// signal wakes the waiters of Updated.
+func (f *framebuffer) signal() {
+	close(f.updated)
+	f.updated = make(chan struct{})
+}
+
+// take returns a copy of the damaged area, or of the whole screen unless
+// regions is set, and clears the damage.  It returns nil when nothing
+// changed since the previous call.
+func (f *framebuffer) take(regions bool) *image.RGBA {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dirty.Empty() {
+		return nil
+	}
+	r := f.img.Rect
+	if regions {
+		r = f.dirty
+	}
+	f.dirty = image.Rectangle{}
+	img := image.NewRGBA(r)
+	draw.Draw(img, r, f.img, r.Min, draw.Src)
+	return img
+}
+
+// image returns a copy of area r of the screen, with cursor drawn on it
+// unless nil.
+func (f *framebuffer) image(r image.Rectangle, cursor *cursorState) *image.RGBA {
+	f.mu.Lock()
+	r = r.Intersect(f.img.Rect)
+	img := image.NewRGBA(r)
+	draw.Draw(img, r, f.img, r.Min, draw.Src)
+	f.mu.Unlock()
+	if cursor != nil {
+		cursor.draw(img)
+	}
+	return img
+}
+
+// snapshot returns a copy of the whole screen, with cursor drawn on it
+// unless nil, and the time of the last paint, zero if nothing has been
+// painted.
+func (f *framebuffer) snapshot(cursor *cursorState) (*image.RGBA, time.Time) {
+	f.mu.Lock()
+	img := image.NewRGBA(f.img.Rect)
+	copy(img.Pix, f.img.Pix)
+	last := f.lastPaint
+	f.mu.Unlock()
+	if cursor != nil {
+		cursor.draw(img)
+	}
+	return img, last
+}
@@ -0,0 +1,38 @@
+package grdp
+
+import (
+	"image"
+	"testing"
+)
+
+func TestFramebuffer(t *testing.T) {
+	var damage []image.Rectangle
+	g := NewRdpClient("host:3389", 64, 32, nil, WithFramebuffer()).
+		OnDamage(func(rects []image.Rectangle) { damage = append(damage, rects...) })
+
+	g.paint([]Bitmap{solid(10, 4, 4, 2, 0xFF, 0, 0), solid(60, 30, 8, 8, 0, 0xFF, 0)})
+	if len(damage) != 2 || damage[0] != image.Rect(10, 4, 14, 6) {
+		t.Errorf("damage %v", damage)
+	}
+	img := g.Snapshot()
+	if img.Rect != image.Rect(0, 0, 64, 32) || img.RGBAAt(13, 5).R != 0xFF || img.RGBAAt(63, 31).G != 0xFF {
+		t.Errorf("snapshot %v %v %v", img.Rect, img.RGBAAt(13, 5), img.RGBAAt(63, 31))
+	}
+	if r := g.SnapshotRect(image.Rect(12, 4, 100, 5)); r.Rect != image.Rect(12, 4, 64, 5) || r.RGBAAt(12, 4).R != 0xFF {
+		t.Errorf("snapshot rect %v", r.Rect)
+	}
+
+	if g.fb.complete() {
+		t.Error("partly painted screen complete")
+	}
+	g.paint([]Bitmap{solid(0, 0, 64, 32, 0, 0, 0xFF)})
+	if !g.fb.complete() {
+		t.Error("painted screen not complete")
+	}
+	g.paint([]Bitmap{solid(10, 4, 4, 2, 0xFF, 0, 0)})
+
+	g.fb.resize(32, 16)
+	if img := g.Snapshot(); img.Rect.Dx() != 32 || img.RGBAAt(13, 5).R != 0xFF {
+		t.Errorf("resized snapshot %v", img.Rect)
+	}
+}
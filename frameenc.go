@@ -0,0 +1,198 @@
+package grdp
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// FrameFormat selects the image encoding produced by a FrameEncoder.
+type FrameFormat int
+
+const (
+	FramePNG FrameFormat = iota
+	FrameJPEG
+)
+
+// Frame is one encoded image delivered by a FrameEncoder.
+type Frame struct {
+	Data []byte          // encoded PNG/JPEG (or custom encoder) bytes
+	Rect image.Rectangle // screen area covered by Data
+	Time time.Time       // when the frame was captured
+}
+
+// FrameEncoder composites bitmap updates into a screen image and encodes
+// it at most maxFPS times per second, for previews streamed over MJPEG or
+// a WebSocket.  Frames are only produced after the screen changed.  Pass
+// Paint to RdpClient.OnBitmap:
+//
+//	enc := grdp.NewFrameEncoder(w, h, grdp.FrameJPEG, 5, func(f grdp.Frame) {
+//		hub.Broadcast(f.Data)
+//	})
+//	defer enc.Close()
+//	client.OnBitmap(enc.Paint)
+//
+// For formats without a standard library encoder, such as WebP, supply
+// one with SetEncoder.
+type FrameEncoder struct {
+	fb *framebuffer
+
+	mu      sync.Mutex
+	format  FrameFormat
+	quality int
+	encode  func(w io.Writer, img image.Image) error
+	regions bool
+	overlay func(dst draw.Image)
+	log     *slog.Logger
+
+	interval  time.Duration
+	emit      func(Frame)
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFrameEncoder starts an encoder for a width x height screen that
+// calls emit from its own goroutine.  maxFPS <= 0 selects 1 frame per
+// second.
+func NewFrameEncoder(width, height int, format FrameFormat, maxFPS float64, emit func(Frame)) *FrameEncoder {
+	if maxFPS <= 0 {
+		maxFPS = 1
+	}
+	e := &FrameEncoder{
+		fb:       newFramebuffer(width, height),
+		format:   format,
+		quality:  jpeg.DefaultQuality,
+		log:      core.Logger(nil, "frameenc"),
+		interval: time.Duration(float64(time.Second) / maxFPS),
+		emit:     emit,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+// SetJPEGQuality sets the FrameJPEG quality (1-100, default 75).
+func (e *FrameEncoder) SetJPEGQuality(q int) *FrameEncoder {
+	e.mu.Lock()
+	e.quality = q
+	e.mu.Unlock()
+	return e
+}
+
+// SetEncoder replaces the built-in PNG/JPEG encoding, e.g. with a WebP
+// encoder.  nil restores the format chosen at construction.
+func (e *FrameEncoder) SetEncoder(encode func(w io.Writer, img image.Image) error) *FrameEncoder {
+	e.mu.Lock()
+	e.encode = encode
+	e.mu.Unlock()
+	return e
+}
+
+// SetRegions makes each Frame cover only the bounding box of the area
+// damaged since the previous frame instead of the whole screen.
+func (e *FrameEncoder) SetRegions(enabled bool) *FrameEncoder {
+	e.mu.Lock()
+	e.regions = enabled
+	e.mu.Unlock()
+	return e
+}
+
+// SetOverlay registers f to draw on each captured image before encoding,
+// typically RdpClient.DrawCursor with the soft cursor enabled.
+func (e *FrameEncoder) SetOverlay(f func(dst draw.Image)) *FrameEncoder {
+	e.mu.Lock()
+	e.overlay = f
+	e.mu.Unlock()
+	return e
+}
+
+// SetLogger logs the frames that fail to encode to l instead of
+// slog.Default(), typically the logger given to WithLogger.
+func (e *FrameEncoder) SetLogger(l *slog.Logger) *FrameEncoder {
+	e.mu.Lock()
+	e.log = core.Logger(l, "frameenc")
+	e.mu.Unlock()
+	return e
+}
+
+// Paint composites bitmaps into the screen image.  It copies the pixels,
+// so it can be used directly as an OnBitmap callback.
+func (e *FrameEncoder) Paint(bitmaps []Bitmap) {
+	e.fb.paint(bitmaps)
+}
+
+// Close stops the encoder goroutine; no frames are emitted after it
+// returns.
+func (e *FrameEncoder) Close() {
+	e.closeOnce.Do(func() {
+		close(e.stop)
+		<-e.done
+	})
+}
+
+func (e *FrameEncoder) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	var buf bytes.Buffer
+	for {
+		select {
+		case <-e.stop:
+			return
+		case now := <-ticker.C:
+			img, encode, log := e.capture()
+			if img == nil {
+				continue
+			}
+			buf.Reset()
+			if err := encode(&buf, img); err != nil {
+				log.Warn("FrameEncoder: encode failed", "err", err)
+				continue
+			}
+			e.emit(Frame{
+				Data: bytes.Clone(buf.Bytes()),
+				Rect: img.Rect,
+				Time: now,
+			})
+		}
+	}
+}
+
+// capture copies the damaged screen area, or the whole screen, and
+// returns it with the encoder and the logger to use.  It returns a nil
+// image when nothing changed since the previous frame.
+func (e *FrameEncoder) capture() (*image.RGBA, func(io.Writer, image.Image) error, *slog.Logger) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	img := e.fb.take(e.regions)
+	if img == nil {
+		return nil, nil, nil
+	}
+	if e.overlay != nil {
+		e.overlay(img)
+	}
+
+	encode := e.encode
+	if encode == nil {
+		switch e.format {
+		case FrameJPEG:
+			opts := &jpeg.Options{Quality: e.quality}
+			encode = func(w io.Writer, img image.Image) error {
+				return jpeg.Encode(w, img, opts)
+			}
+		default:
+			encode = png.Encode
+		}
+	}
+	return img, encode, e.log
+}
@@ -0,0 +1,51 @@
+package grdp
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestFrameEncoderRegions(t *testing.T) {
+	frames := make(chan Frame, 4)
+	enc := NewFrameEncoder(8, 8, FramePNG, 100, func(f Frame) { frames <- f })
+	defer enc.Close()
+	enc.SetRegions(true)
+
+	// 2x1 BGRA bitmap: blue, red.
+	enc.Paint([]Bitmap{{
+		DestLeft: 3, DestTop: 4, DestRight: 4, DestBottom: 4,
+		Width: 2, Height: 1, BitsPerPixel: 4,
+		Data: []byte{0xff, 0, 0, 0xff, 0, 0, 0xff, 0xff},
+	}})
+
+	var f Frame
+	select {
+	case f = <-frames:
+	case <-time.After(time.Second):
+		t.Fatal("no frame emitted")
+	}
+	if want := image.Rect(3, 4, 5, 5); f.Rect != want {
+		t.Errorf("Rect = %v, want %v", f.Rect, want)
+	}
+	img, err := png.Decode(bytes.NewReader(f.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Encoded images always start at the origin.
+	if r, _, b, _ := img.At(0, 0).RGBA(); b>>8 != 0xff || r != 0 {
+		t.Errorf("pixel (3,4) = %v, want blue", img.At(0, 0))
+	}
+	if r, _, _, _ := img.At(1, 0).RGBA(); r>>8 != 0xff {
+		t.Errorf("pixel (4,4) = %v, want red", img.At(1, 0))
+	}
+
+	// Nothing changed: no further frames.
+	select {
+	case f := <-frames:
+		t.Errorf("unexpected frame for unchanged screen: %v", f.Rect)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
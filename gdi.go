@@ -0,0 +1,524 @@
+package grdp
+
+import (
+	"encoding/binary"
+	"image"
+	"log/slog"
+	"sync"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+// gdi renders the primary drawing orders into a copy of the remote screen.
+// The bitmap updates are painted into it too, so ScrBlt and the raster
+// operations read what the server drew (MS-RDPEGDI 3.2.5.1).
+type gdi struct {
+	mu        sync.Mutex
+	screen    *image.RGBA
+	tile      *image.RGBA
+	decodeBuf []byte
+	depth     uint16
+	palette   *Palette
+	glyphs    [10]map[uint16]*pdu.CacheGlyph
+	fragments [256][]byte
+	log       *slog.Logger
+}
+
+func newGDI(width, height int) *gdi {
+	d := &gdi{screen: image.NewRGBA(image.Rect(0, 0, width, height)), palette: greyPalette, log: core.DefaultLogger}
+	for i := range d.glyphs {
+		d.glyphs[i] = make(map[uint16]*pdu.CacheGlyph)
+	}
+	return d
+}
+
+// resize starts a new, black screen of the given size.
+func (d *gdi) resize(width, height int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.screen = image.NewRGBA(image.Rect(0, 0, width, height))
+}
+
+// setPalette sets the colour table of an 8bpp session.
+func (d *gdi) setPalette(p *Palette) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.palette = p
+}
+
+// paint copies bitmaps into the screen; Dest rectangles are inclusive.
+func (d *gdi) paint(bitmaps []Bitmap) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range bitmaps {
+		bitmaps[i].paintInto(d.screen)
+	}
+}
+
+// draw renders orders, whose colours are in the session colour depth
+// and whose MemBlt bitmaps come from cache, and returns the area they
+// changed.
+func (d *gdi) draw(orders []pdu.OrderPdu, cache *pdu.BitmapCache, depth uint16) (damage image.Rectangle) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.depth = depth
+	for i := range orders {
+		o := &orders[i]
+		if o.Secondary != nil {
+			if cg, ok := o.Secondary.Order.(*pdu.CacheGlyphOrder); ok && int(cg.CacheId) < len(d.glyphs) {
+				for j := range cg.Glyphs {
+					d.glyphs[cg.CacheId][cg.Glyphs[j].Index] = &cg.Glyphs[j]
+				}
+			}
+			continue
+		}
+		if o.Primary == nil || o.Primary.Data == nil {
+			continue
+		}
+		clip := d.screen.Rect
+		if o.HasBounds() {
+			b := o.Primary.Bounds
+			clip = clip.Intersect(image.Rect(int(b.Left), int(b.Top), int(b.Right)+1, int(b.Bottom)+1))
+		}
+		var r image.Rectangle
+		switch p := o.Primary.Data.(type) {
+		case *pdu.Dstblt:
+			r = d.fill(orderRect(p.X, p.Y, p.Cx, p.Cy, clip), p.Opcode, nil, nil)
+		case *pdu.Patblt:
+			r = d.fill(orderRect(p.X, p.Y, p.Cx, p.Cy, clip), p.Opcode,
+				d.brush(&p.Brush, p.ForeColor, p.BackColor), nil)
+		case *pdu.OpaqueRect:
+			r = d.fill(orderRect(p.X, p.Y, p.Cx, p.Cy, clip), pdu.ROP3_PATCOPY, solidBrush(d.color(p.Color)), nil)
+		case *pdu.Scrblt:
+			r = d.scrblt(p, clip)
+		case *pdu.Memblt:
+			r = d.memblt(p.CacheId, p.CacheIdx, p.X, p.Y, p.Cx, p.Cy, p.Srcx, p.Srcy, p.Opcode, nil, cache, clip)
+		case *pdu.Mem3blt:
+			r = d.memblt(p.CacheId, p.CacheIdx, p.X, p.Y, p.Cx, p.Cy, p.Srcx, p.Srcy, p.Opcode,
+				d.brush(&p.Brush, p.ForeColor, p.BackColor), cache, clip)
+		case *pdu.LineTo:
+			r = d.line(int(p.Startx), int(p.Starty), int(p.Endx), int(p.Endy), d.color(p.Pen.Color), p.Opcode, clip)
+		case *pdu.Polyline:
+			x, y := int(p.Xstart), int(p.Ystart)
+			pen := d.color(p.PenColor)
+			for _, dp := range p.Deltas {
+				nx, ny := x+int(dp.X), y+int(dp.Y)
+				r = r.Union(d.line(x, y, nx, ny, pen, p.Opcode, clip))
+				x, y = nx, ny
+			}
+		case *pdu.GlayphIndex:
+			r = d.glyphIndex(p, clip)
+		default:
+			d.log.Debug("gdi: order not rendered", "type", p.Type())
+		}
+		damage = damage.Union(r)
+	}
+	return damage
+}
+
+// bitmap returns the screen area r as a top-down BGRA Bitmap.
+func (d *gdi) bitmap(r image.Rectangle) Bitmap {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r = r.Intersect(d.screen.Rect)
+	w, h := r.Dx(), r.Dy()
+	data := make([]byte, w*h*4)
+	for y := 0; y < h; y++ {
+		off := d.screen.PixOffset(r.Min.X, r.Min.Y+y)
+		copy(data[y*w*4:(y+1)*w*4], d.screen.Pix[off:off+w*4])
+	}
+	SwapRB(data)
+	return Bitmap{
+		DestLeft:     r.Min.X,
+		DestTop:      r.Min.Y,
+		DestRight:    r.Max.X - 1,
+		DestBottom:   r.Max.Y - 1,
+		Width:        w,
+		Height:       h,
+		BitsPerPixel: 4,
+		Data:         data,
+		UpdateType:   pdu.BITMAP_UPDATE_ORDERS,
+	}
+}
+
+func orderRect(x, y, cx, cy int32, clip image.Rectangle) image.Rectangle {
+	return image.Rect(int(x), int(y), int(x+cx), int(y+cy)).Intersect(clip)
+}
+
+// Pixels are handled as 0x00BBGGRR, the byte order of image.RGBA.
+
+func (d *gdi) get(x, y int) uint32 {
+	return binary.LittleEndian.Uint32(d.screen.Pix[d.screen.PixOffset(x, y):]) & 0xFFFFFF
+}
+
+func (d *gdi) set(x, y int, c uint32) {
+	binary.LittleEndian.PutUint32(d.screen.Pix[d.screen.PixOffset(x, y):], c|0xFF000000)
+}
+
+// color converts a Generic Color of the session colour depth.
+func (d *gdi) color(c uint32) uint32 {
+	switch d.depth {
+	case 15:
+		r, g, b := c>>10&0x1F, c>>5&0x1F, c&0x1F
+		return (r<<3 | r>>2) | (g<<3|g>>2)<<8 | (b<<3|b>>2)<<16
+	case 16:
+		r, g, b := c>>11&0x1F, c>>5&0x3F, c&0x1F
+		return (r<<3 | r>>2) | (g<<2|g>>4)<<8 | (b<<3|b>>2)<<16
+	case 8:
+		return d.palette[c&0xFF] & 0xFFFFFF
+	default:
+		return c & 0xFFFFFF
+	}
+}
+
+// rop3 applies the ternary raster operation rop to the pattern, source
+// and destination pixels: bit (P<<2 | S<<1 | D) of rop is the result.
+func rop3(rop uint8, p, s, dst uint32) uint32 {
+	switch rop {
+	case pdu.ROP3_BLACKNESS:
+		return 0
+	case pdu.ROP3_DSTINVERT:
+		return ^dst & 0xFFFFFF
+	case pdu.ROP3_PATINVERT:
+		return p ^ dst
+	case pdu.ROP3_SRCINVERT:
+		return s ^ dst
+	case pdu.ROP3_SRCAND:
+		return s & dst
+	case pdu.ROP3_NOP:
+		return dst
+	case pdu.ROP3_SRCCOPY:
+		return s
+	case pdu.ROP3_SRCPAINT:
+		return s | dst
+	case pdu.ROP3_PATCOPY:
+		return p
+	case pdu.ROP3_WHITENESS:
+		return 0xFFFFFF
+	}
+	var out uint32
+	for i := 0; i < 8; i++ {
+		if rop&(1<<i) == 0 {
+			continue
+		}
+		m := uint32(0xFFFFFF)
+		for bit, v := range [3]uint32{dst, s, p} {
+			if i&(1<<bit) != 0 {
+				m &= v
+			} else {
+				m &^= v
+			}
+		}
+		out |= m
+	}
+	return out
+}
+
+// rop2ToRop3 maps a binary raster operation (R2_BLACK = 1 to R2_WHITE =
+// 16) on the pen and destination to the ternary one.
+func rop2ToRop3(rop2 uint8) uint8 {
+	t := (rop2 - 1) & 0x0F
+	var rop uint8
+	for i := 0; i < 8; i++ {
+		if t&(1<<(i>>2<<1|i&1)) != 0 {
+			rop |= 1 << i
+		}
+	}
+	return rop
+}
+
+// pattern is an 8x8 brush aligned to the brush origin.
+type pattern struct {
+	pix        [64]uint32
+	orgX, orgY int
+}
+
+func (p *pattern) at(x, y int) uint32 {
+	return p.pix[(y-p.orgY)&7*8+(x-p.orgX)&7]
+}
+
+func solidBrush(c uint32) *pattern {
+	p := &pattern{}
+	for i := range p.pix {
+		p.pix[i] = c
+	}
+	return p
+}
+
+var hatchPatterns = [6][8]byte{
+	{0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, 0x00}, // HS_HORIZONTAL
+	{0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08}, // HS_VERTICAL
+	{0x80, 0x40, 0x20, 0x10, 0x08, 0x04, 0x02, 0x01}, // HS_FDIAGONAL
+	{0x01, 0x02, 0x04, 0x08, 0x10, 0x20, 0x40, 0x80}, // HS_BDIAGONAL
+	{0x08, 0x08, 0x08, 0xff, 0x08, 0x08, 0x08, 0x08}, // HS_CROSS
+	{0x81, 0x42, 0x24, 0x18, 0x18, 0x24, 0x42, 0x81}, // HS_DIAGCROSS
+}
+
+// brush returns the pattern of b: hatch lines are drawn in fore on back,
+// and the set bits of a BS_PATTERN bitmap in back.
+func (d *gdi) brush(b *pdu.Brush, fore, back uint32) *pattern {
+	fore, back = d.color(fore), d.color(back)
+	var rows [8]byte
+	set, unset := fore, back
+	switch {
+	case b.Style == pdu.BS_HATCHED && int(b.Hatch) < len(hatchPatterns):
+		rows = hatchPatterns[b.Hatch]
+	case b.Style == pdu.BS_PATTERN && len(b.Data) == 8:
+		for i := range rows {
+			rows[i] = b.Data[7-i]
+		}
+		set, unset = back, fore
+	default:
+		// BS_SOLID, and the cached brushes the client does not advertise.
+		return solidBrush(fore)
+	}
+	p := &pattern{orgX: int(b.X), orgY: int(b.Y)}
+	for y, row := range rows {
+		for x := 0; x < 8; x++ {
+			if row&(0x80>>x) != 0 {
+				p.pix[y*8+x] = set
+			} else {
+				p.pix[y*8+x] = unset
+			}
+		}
+	}
+	return p
+}
+
+// fill applies rop to r with the pattern pat and the source src, either
+// of which may be nil when rop does not use it.
+func (d *gdi) fill(r image.Rectangle, rop uint8, pat *pattern, src func(x, y int) uint32) image.Rectangle {
+	if r.Empty() {
+		return image.Rectangle{}
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			var p, s uint32
+			if pat != nil {
+				p = pat.at(x, y)
+			}
+			if src != nil {
+				s = src(x, y)
+			}
+			d.set(x, y, rop3(rop, p, s, d.get(x, y)))
+		}
+	}
+	return r
+}
+
+func (d *gdi) scrblt(o *pdu.Scrblt, clip image.Rectangle) image.Rectangle {
+	r := orderRect(o.X, o.Y, o.Cx, o.Cy, clip)
+	if r.Empty() {
+		return r
+	}
+	// Copy the source first: it may overlap the destination.
+	dx, dy := int(o.Srcx-o.X), int(o.Srcy-o.Y)
+	w := r.Dx()
+	src := make([]uint32, w*r.Dy())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if image.Pt(x+dx, y+dy).In(d.screen.Rect) {
+				src[(y-r.Min.Y)*w+x-r.Min.X] = d.get(x+dx, y+dy)
+			}
+		}
+	}
+	return d.fill(r, o.Opcode, nil, func(x, y int) uint32 {
+		return src[(y-r.Min.Y)*w+x-r.Min.X]
+	})
+}
+
+func (d *gdi) memblt(cacheId uint8, index uint16, x, y, cx, cy, srcx, srcy int32, rop uint8,
+	pat *pattern, cache *pdu.BitmapCache, clip image.Rectangle) image.Rectangle {
+	bm := cache.Get(int(cacheId), index)
+	if bm == nil {
+		d.log.Debug("gdi: MemBlt of an empty cache cell", "cacheId", cacheId, "index", index)
+		return image.Rectangle{}
+	}
+	tile := d.decodeCached(bm)
+	if tile == nil {
+		return image.Rectangle{}
+	}
+	dx, dy := int(srcx-x), int(srcy-y)
+	r := orderRect(x, y, cx, cy, clip).Intersect(tile.Rect.Sub(image.Pt(dx, dy)))
+	return d.fill(r, rop, pat, func(x, y int) uint32 {
+		return binary.LittleEndian.Uint32(tile.Pix[tile.PixOffset(x+dx, y+dy):]) & 0xFFFFFF
+	})
+}
+
+// decodeCached returns a cached bitmap as RGBA, valid until the next call.
+func (d *gdi) decodeCached(bm *pdu.CachedBitmap) *image.RGBA {
+	b := Bitmap{Width: int(bm.Width), Height: int(bm.Height), BitsPerPixel: bpp(bm.Bpp), Palette: d.palette}
+	if b.BitsPerPixel == 0 || b.Width == 0 || b.Height == 0 {
+		return nil
+	}
+	var err error
+	if bm.Compressed {
+		d.decodeBuf, err = core.DecompressIntoChecked(bm.Data, d.decodeBuf, b.Width, b.Height, b.BitsPerPixel)
+		if err != nil {
+			d.log.Debug("gdi: cached bitmap", "err", err)
+			return nil
+		}
+	} else {
+		// Uncompressed bitmaps are bottom-up.
+		stride := b.Width * b.BitsPerPixel
+		if len(bm.Data) < stride*b.Height {
+			return nil
+		}
+		d.decodeBuf = d.decodeBuf[:0]
+		for y := b.Height - 1; y >= 0; y-- {
+			d.decodeBuf = append(d.decodeBuf, bm.Data[y*stride:(y+1)*stride]...)
+		}
+	}
+	b.Data = d.decodeBuf
+	d.tile = b.FillRGBA(d.tile)
+	return d.tile
+}
+
+// line draws from (x0, y0) to (x1, y1), leaving out the end point as GDI
+// does.
+func (d *gdi) line(x0, y0, x1, y1 int, pen uint32, rop2 uint8, clip image.Rectangle) (damage image.Rectangle) {
+	rop := rop2ToRop3(rop2)
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for x, y := x0, y0; x != x1 || y != y1; {
+		if image.Pt(x, y).In(clip) {
+			d.set(x, y, rop3(rop, pen, 0, d.get(x, y)))
+			damage = damage.Union(image.Rect(x, y, x+1, y+1))
+		}
+		if e2 := 2 * e; e2 >= dy {
+			e += dy
+			x += sx
+		} else {
+			e += dx
+			y += sy
+		}
+	}
+	return damage
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func (d *gdi) glyphIndex(o *pdu.GlayphIndex, clip image.Rectangle) (damage image.Rectangle) {
+	// BackColor is the text colour, ForeColor the opaque rectangle's.
+	if o.OpRight > o.OpLeft {
+		r := image.Rect(int(o.OpLeft), int(o.OpTop), int(o.OpRight)+1, int(o.OpBottom)+1)
+		damage = d.fill(r.Intersect(clip), pdu.ROP3_PATCOPY, solidBrush(d.color(o.ForeColor)), nil)
+	} else if o.FOpRedundant != 0 && o.BkRight > o.BkLeft {
+		r := image.Rect(int(o.BkLeft), int(o.BkTop), int(o.BkRight)+1, int(o.BkBottom)+1)
+		damage = d.fill(r.Intersect(clip), pdu.ROP3_PATCOPY, solidBrush(d.color(o.ForeColor)), nil)
+	}
+	if int(o.CacheId) >= len(d.glyphs) {
+		return damage
+	}
+	t := &textRun{d: d, o: o, x: int(o.X), y: int(o.Y), color: d.color(o.BackColor), clip: clip}
+	data := o.Data
+	for n := 0; n < len(data); {
+		switch data[n] {
+		case pdu.GLYPH_FRAGMENT_USE:
+			if n+1 >= len(data) {
+				return damage.Union(t.damage)
+			}
+			frag := d.fragments[data[n+1]]
+			n += 2
+			if t.variableAdvance() {
+				n += t.advance(data[n:])
+			}
+			for i := 0; i < len(frag); {
+				i += t.glyph(frag[i:])
+			}
+		case pdu.GLYPH_FRAGMENT_ADD:
+			if n+2 >= len(data) {
+				return damage.Union(t.damage)
+			}
+			// The fragment is made of the size bytes before the operation.
+			if size := int(data[n+2]); size <= n {
+				d.fragments[data[n+1]] = append([]byte(nil), data[n-size:n]...)
+			}
+			n += 3
+		default:
+			n += t.glyph(data[n:])
+		}
+	}
+	return damage.Union(t.damage)
+}
+
+// textRun is the pen position of a GlyphIndex order.
+type textRun struct {
+	d      *gdi
+	o      *pdu.GlayphIndex
+	x, y   int
+	color  uint32
+	clip   image.Rectangle
+	damage image.Rectangle
+}
+
+// variableAdvance reports whether each glyph is preceded by the distance
+// from the previous one.
+func (t *textRun) variableAdvance() bool {
+	return t.o.UlCharInc == 0 && t.o.FlAccel&pdu.SO_CHAR_INC_EQUAL_BM_BASE == 0
+}
+
+// advance moves the pen by the distance at the start of b, one signed
+// byte or 0x80 and a 16-bit value, and returns its length.
+func (t *textRun) advance(b []byte) int {
+	var v, n int
+	switch {
+	case len(b) >= 3 && b[0] == 0x80:
+		v, n = int(int16(binary.LittleEndian.Uint16(b[1:]))), 3
+	case len(b) >= 1:
+		v, n = int(int8(b[0])), 1
+	}
+	t.move(v)
+	return n
+}
+
+func (t *textRun) move(v int) {
+	if t.o.FlAccel&pdu.SO_VERTICAL != 0 {
+		t.y += v
+	} else {
+		t.x += v
+	}
+}
+
+// glyph draws the glyph whose index starts b and returns the number of
+// bytes it used.
+func (t *textRun) glyph(b []byte) int {
+	n := 1
+	if t.variableAdvance() {
+		n += t.advance(b[1:])
+	}
+	g := t.d.glyphs[t.o.CacheId][uint16(b[0])]
+	if g == nil {
+		return n
+	}
+	stride := (int(g.Width) + 7) / 8
+	gx, gy := t.x+int(g.X), t.y+int(g.Y)
+	for y := 0; y < int(g.Height); y++ {
+		for x := 0; x < int(g.Width); x++ {
+			if g.Data[y*stride+x/8]&(0x80>>(x%8)) == 0 || !image.Pt(gx+x, gy+y).In(t.clip) {
+				continue
+			}
+			t.d.set(gx+x, gy+y, t.color)
+		}
+	}
+	t.damage = t.damage.Union(image.Rect(gx, gy, gx+int(g.Width), gy+int(g.Height)).Intersect(t.clip))
+	if t.o.FlAccel&pdu.SO_CHAR_INC_EQUAL_BM_BASE != 0 {
+		t.move(int(g.Width))
+	} else if t.o.UlCharInc != 0 {
+		t.move(int(t.o.UlCharInc))
+	}
+	return n
+}
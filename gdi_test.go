@@ -0,0 +1,67 @@
+package grdp
+
+import (
+	"image"
+	"testing"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+func primary(p pdu.PrimaryOrder) pdu.OrderPdu {
+	return pdu.OrderPdu{ControlFlags: pdu.TS_STANDARD, Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: p}}
+}
+
+func TestGDIOrders(t *testing.T) {
+	d := newGDI(16, 8)
+	cache := pdu.NewBitmapCache()
+	orders := []pdu.OrderPdu{
+		primary(&pdu.OpaqueRect{X: 0, Y: 0, Cx: 4, Cy: 4, Color: 0x0000FF}),
+		// Copy the red square 2 to the right, over itself.
+		primary(&pdu.Scrblt{X: 2, Y: 0, Cx: 4, Cy: 4, Opcode: pdu.ROP3_SRCCOPY}),
+		primary(&pdu.Patblt{X: 8, Y: 0, Cx: 8, Cy: 1, Opcode: pdu.ROP3_PATCOPY,
+			ForeColor: 0x00FF00, BackColor: 0xFF0000,
+			Brush: pdu.Brush{Style: pdu.BS_HATCHED, Hatch: 1}}),
+	}
+	if r := d.draw(orders, cache, 24); r != image.Rect(0, 0, 16, 4) {
+		t.Errorf("damage = %v", r)
+	}
+	for x, want := range map[int]uint32{0: 0x0000FF, 5: 0x0000FF, 6: 0, 12: 0x00FF00, 13: 0xFF0000} {
+		if got := d.get(x, 0); got != want {
+			t.Errorf("pixel %d = %06x, want %06x", x, got, want)
+		}
+	}
+}
+
+func TestGDIGlyphIndex(t *testing.T) {
+	d := newGDI(16, 8)
+	// A 2x2 glyph with its top-left pixel set, drawn twice 3 apart, the
+	// second time through a fragment.
+	glyphs := &pdu.CacheGlyphOrder{CacheId: 1, Glyphs: []pdu.CacheGlyph{
+		{Index: 7, X: 0, Y: -2, Width: 2, Height: 2, Data: []byte{0x80, 0, 0, 0}},
+	}}
+	text := &pdu.GlayphIndex{CacheId: 1, FlAccel: pdu.SO_HORIZONTAL, BackColor: 0xFFFFFF,
+		X: 1, Y: 4, Data: []byte{7, 0, pdu.GLYPH_FRAGMENT_ADD, 0, 2, pdu.GLYPH_FRAGMENT_USE, 0, 3}}
+	orders := []pdu.OrderPdu{
+		{Type: pdu.ORDER_SECONDARY, Secondary: &pdu.Secondary{Order: glyphs}},
+		primary(text),
+	}
+	d.draw(orders, pdu.NewBitmapCache(), 32)
+	for x := 0; x < 8; x++ {
+		want := uint32(0)
+		if x == 1 || x == 4 {
+			want = 0xFFFFFF
+		}
+		if got := d.get(x, 2); got != want {
+			t.Errorf("pixel %d = %06x, want %06x", x, got, want)
+		}
+	}
+}
+
+func TestRop2ToRop3(t *testing.T) {
+	for rop2, want := range map[uint8]uint8{1: pdu.ROP3_BLACKNESS, 6: pdu.ROP3_DSTINVERT,
+		7: pdu.ROP3_PATINVERT, 11: pdu.ROP3_NOP, 13: pdu.ROP3_PATCOPY, 16: pdu.ROP3_WHITENESS} {
+		if got := rop2ToRop3(rop2); got != want {
+			t.Errorf("rop2 %d = %#x, want %#x", rop2, got, want)
+		}
+	}
+}
@@ -1,10 +1,17 @@
 package grdp
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"image"
+	"image/draw"
+	"io"
 	"log/slog"
 	"net"
+	"os"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,11 +21,18 @@ import (
 	"github.com/nakagami/grdp/plugin"
 	"github.com/nakagami/grdp/plugin/cliprdr"
 	"github.com/nakagami/grdp/plugin/drdynvc"
+	"github.com/nakagami/grdp/plugin/rail"
+	"github.com/nakagami/grdp/plugin/rdpdr"
+	"github.com/nakagami/grdp/plugin/rdpdr/scard"
+	"github.com/nakagami/grdp/plugin/rdpeai"
 	"github.com/nakagami/grdp/plugin/rdpedisp"
+	"github.com/nakagami/grdp/plugin/rdpeeco"
+	"github.com/nakagami/grdp/plugin/rdpei"
 	"github.com/nakagami/grdp/plugin/rdpgfx"
 	"github.com/nakagami/grdp/plugin/rdpsnd"
 
 	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/emission"
 	"github.com/nakagami/grdp/protocol/nla"
 	"github.com/nakagami/grdp/protocol/pdu"
 	"github.com/nakagami/grdp/protocol/sec"
@@ -41,7 +55,8 @@ type mouseCoalescer struct {
 	pduBuf  [1]pdu.InputEventsInterface
 }
 
-// wheelCoalescer holds all state for vertical-scroll coalescing.
+// wheelCoalescer holds all state for vertical- or horizontal-scroll
+// coalescing, flag being PTRFLAGS_WHEEL or PTRFLAGS_HWHEEL.
 // Rapid scroll events are accumulated over mouseCoalesceInterval and sent as
 // a single PDU whose rotation value is the sum of all deltas in that window.
 // wheelAccum is stored in RDP WHEEL_DELTA units (120 per physical notch).
@@ -52,20 +67,22 @@ type wheelCoalescer struct {
 	lastTx time.Time
 	pdu    pdu.PointerEvent
 	pduBuf [1]pdu.InputEventsInterface
+	flag   uint16
 }
 
-// stubChannel is a no-op virtual channel handler for channels the server
-// expects to be present (e.g. rdpdr, cliprdr) but that we don't process.
-type stubChannel struct {
-	name   string
-	option uint32
-	sender core.ChannelSender
-}
-
-func (s *stubChannel) GetType() (string, uint32)   { return s.name, s.option }
-func (s *stubChannel) Sender(f core.ChannelSender) { s.sender = f }
-func (s *stubChannel) Process(data []byte)         {}
-
+// RdpClient is a connection to an RDP server.
+//
+// The input methods (KeyDown, MouseMove, SendInputEvents...), SendToChannel,
+// RequestKeyframe, the getters and Close are safe to call from any
+// goroutine, including from the callbacks: the writes of all goroutines are
+// serialized, each PDU going out whole and, under Standard RDP Security,
+// encrypted in the order it is sent.
+//
+// The On* callbacks are called one at a time, in the order the server sent
+// the PDUs, on the goroutine reading the connection, or on the RDPGFX
+// decode goroutine for the graphics of a graphics pipeline session.  A slow
+// callback delays what follows it.  Register them before Login: a callback
+// replaced while connected may still be called once.
 type RdpClient struct {
 	hostPort        string // ip:port
 	width           int
@@ -80,9 +97,24 @@ type RdpClient struct {
 	pdu             *pdu.Client
 	channels        *plugin.Channels
 	eventReady      atomic.Bool
+	bitmapSeq       atomic.Uint64 // last Bitmap.Seq handed to OnBitmap
+	stats           sessionStats
 	decompressPool  sync.Pool // pools []uint8 buffers for bitmap decompression
 	flipLinePool    sync.Pool // pools line-sized []uint8 buffers for bitmap vertical flip
 	closed          atomic.Bool
+	state           *stateMachine
+
+	// disconnectReason is the t125.RN_* reason of the server's Disconnect
+	// Provider Ultimatum plus one, 0 when none was received.  serverError
+	// is the last Set Error Info PDU.  shutdownDone is signalled when the
+	// server answers a Shutdown Request PDU.
+	disconnectReason atomic.Uint32
+	serverError      atomic.Pointer[ServerError]
+	shutdownDone     chan struct{}
+
+	// arcCookie is the auto-reconnect cookie of the last Save Session Info
+	// PDU, kept across reconnects.
+	arcCookie atomic.Pointer[autoReconnectCookie]
 
 	// credentials stored for reconnection
 	domain   string
@@ -103,22 +135,38 @@ type RdpClient struct {
 	onH264RawFn       func(destX, destY, w, h int, isKey bool, data []byte)
 	onH264I420Fn      func(destX, destY, w, h int, y []byte, yStride int, u []byte, uStride int, v []byte, vStride int)
 	onH264NV12Fn      func(destX, destY, w, h int, y []byte, yStride int, uv []byte, uvStride int)
+	onFrameFn         func(frameID uint32, img *image.RGBA, damage image.Rectangle)
+	onH264NALFn       func(rdpgfx.H264NAL)
 	onDecoderBrokenFn func()
+	onLogonFn         func(sessionId uint32, username, domain string)
+	onLogonErrorFn    func(code uint32)
+	onKbdIndicatorsFn func(numLock, capsLock, scrollLock, kanaLock bool)
+
+	// toggleKeys holds the TS_SYNC_* lock state sent after every
+	// activation; SyncToggleKeys sets it.
+	toggleKeys atomic.Uint32
 
 	// clipboard callbacks and handler
 	onClipboardFn  func(text string) // remote → local
 	getClipboardFn func() string     // local → remote
 	cliprdrHandler *cliprdr.CliprdrHandler
 
+	// clipboard, when set by SetClipboard, is the local content offered
+	// to the server, again after a reconnect.  onRemoteClipboardFn is
+	// called when the server clipboard changes.
+	clipboard           *cliprdr.Content
+	onRemoteClipboardFn func(*cliprdr.RemoteClipboard)
+
 	// reconnectMu serialises concurrent Reconnect() calls.
 	// reconnecting is also set during async server redirects to suppress
 	// user-facing callbacks while the transport is being re-established.
 	reconnectMu  sync.Mutex
 	reconnecting atomic.Bool
 
-	// mouse and wheel hold all coalescing state for pointer input.
-	mouse mouseCoalescer
-	wheel wheelCoalescer
+	// mouse, wheel and hwheel hold all coalescing state for pointer input.
+	mouse  mouseCoalescer
+	wheel  wheelCoalescer
+	hwheel wheelCoalescer
 
 	// gfxHandler is the active RDPGFX handler; nil when not connected.
 	// Stored here so closeTransport() can stop its goroutines.
@@ -130,12 +178,238 @@ type RdpClient struct {
 	avc444Disabled bool
 
 	// dispHandler is the active MS-RDPEDISP handler; nil when not connected.
-	// Used by SetResolution to send MONITOR_LAYOUT PDUs.
+	// Used by SetResolution and Resize to send MONITOR_LAYOUT PDUs.
 	dispHandler *rdpedisp.Handler
 
-	dialer func(hostPort string) (net.Conn, error)
+	// onResizeFn is called when the server changes the desktop size.
+	onResizeFn func(width, height int)
+
+	// touchHandler is the active MS-RDPEI handler; nil when not connected.
+	// Used by the touch and pen methods.
+	touchHandler *rdpei.Handler
+
+	// echoHandler is the active MS-RDPEECO handler; nil when not connected.
+	// Used by Ping.
+	echoHandler *rdpeeco.Handler
+
+	// colorDepth is the preferred bpp set by RequestColorDepth; 0 keeps the
+	// default 32 bpp request.  Preserved across reconnects.
+	colorDepth int
+
+	// dialer opens the TCP connection; nil dials with dialTimeout.
+	// connectTimeout bounds the connection sequence after it, and
+	// readTimeout, when set, the wait for each packet.
+	dialer         func(hostPort string) (net.Conn, error)
+	dialTimeout    time.Duration
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+
+	// optionErr is the first invalid option, which Login returns.
+	optionErr error
+
+	// logger is the logger of WithLogger, that the client hands to its
+	// layers; redactLogs wraps it in core.NewRedactingHandler.  log is the
+	// client's own, with the attribute layer=grdp.
+	logger     *slog.Logger
+	redactLogs bool
+	log        *slog.Logger
+
+	// lastRecovery is the UnixNano time of the last refresh requested
+	// after a decode error.
+	lastRecovery atomic.Int64
+
+	// cursor follows the remote pointer shape and position; softCursor
+	// suppresses the OnPointer* callbacks in favour of DrawCursor.
+	cursor     cursorState
+	softCursor atomic.Bool
+
+	// fb, when non-nil, composites the screen for Snapshot, Screenshot
+	// and Run.
+	fb *framebuffer
+	// bitmapSub is the subscription of the bitmap updates of the session
+	// to paint, made once the PDU layer is built.
+	bitmapSub *emission.Subscription
+	// onDamageFn receives the screen areas each update changed.
+	onDamageFn func([]image.Rectangle)
+	// gdi renders the drawing orders unless noDrawingOrders is set.
+	gdi             *gdi
+	noDrawingOrders bool
+
+	// recorder, when non-nil, captures input sent through the Key* and
+	// Mouse* methods; see StartInputRecording.
+	recorder atomic.Pointer[InputRecorder]
+
+	// recordTo, when non-nil, receives the session recording written by
+	// sessionRec; see WithRecorder.
+	recordTo         io.Writer
+	keyframeInterval time.Duration
+	sessionRec       *sessionRecorder
+
+	// tap, when non-nil, receives the PDUs of the connections; see
+	// WithTap.
+	tap core.Tap
+
+	// routingToken is the load balance info received in the most recent
+	// Server Redirection PDU (or supplied via SetRoutingToken).  Login and
+	// Reconnect present it in the x224 Connection Request so a broker
+	// routes the client back to the same backend.  routingMu guards it:
+	// redirections store it on the reader goroutine.
+	routingMu    sync.Mutex
+	routingToken []byte
+	onRedirectFn func(RedirectInfo)
+
+	// keyExchange, when non-nil, generates and encrypts the Standard RDP
+	// Security client random instead of the built-in implementation.
+	keyExchange sec.KeyExchangeProvider
+
+	// identityStore remembers the TLS certificate fingerprint per host;
+	// onIdentityChangedFn is told when a host presents a different one.
+	identityStore       IdentityStore
+	onIdentityChangedFn func(ServerIdentityChange)
+
+	// remoteGuard, when non-nil, enables Remote Credential Guard: the
+	// password is never delegated to the server.
+	remoteGuard *nla.TSRemoteGuardCreds
+	// smartCard, when non-nil, supplies the smart card delegated by NLA.
+	smartCard nla.SmartCardProvider
+
+	// credentials, when non-nil, resolves secrets lazily; credAttempt and
+	// credErr describe the current Login attempt.
+	credentials CredentialProvider
+	credAttempt int
+	credErr     error
+
+	// nlaTimeout and nlaRetries configure the CredSSP exchange; zero
+	// timeout keeps the tpkt defaults.
+	nlaTimeout time.Duration
+	nlaRetries int
+
+	onDowngradeFn func(SecurityDowngrade) error
+
+	// tlsConfig, when non-nil, replaces the default TLS configuration;
+	// certPolicy, when non-nil, verifies the server certificate.
+	tlsConfig  *tls.Config
+	certPolicy *core.CertificatePolicy
+	// serverCertPolicy applies to the Standard RDP Security certificate.
+	serverCertPolicy sec.ServerCertPolicy
+
+	// spn, when set, replaces the TERMSRV/<host> service principal name.
+	spn string
+
+	// clientName and clientAddress, when set, override the computer name
+	// and IP address reported to the server.
+	clientName    *string
+	clientAddress string
+
+	// keyboardFnKeys and clientBuild, when non-zero, override the number
+	// of function keys and the build number sent in the GCC core data.
+	keyboardFnKeys uint32
+	clientBuild    uint32
+
+	// perfFlags and connType, when set, override the performance flags
+	// and connection type reported to the server.
+	perfFlags *uint32
+	connType  *connectionType
+
+	// channelPlugins are the channels added by RegisterStaticChannel and
+	// RegisterDynamicChannel, set up again on every connection;
+	// openChannels are those of the current connection.
+	channelPlugins []channelPlugin
+	openChannels   []pluginChannel
+
+	// drives are the drives added by RedirectDrive and smartCards the
+	// provider set by RedirectSmartCards; rdpdrClient serves them on the
+	// current connection.
+	drives      []redirectedDrive
+	smartCards  scard.Provider
+	rdpdrClient *rdpdr.Client
+
+	// remoteApp is the application set by SetRemoteApp; railClient runs
+	// it on the current connection and onWindowFn receives its events.
+	remoteApp  *remoteApp
+	railClient *rail.RailClient
+	onWindowFn func(rail.Event)
+
+	// audioSource is the microphone set by RedirectAudioInput;
+	// audioInput records from it on the current connection.
+	audioSource rdpeai.AudioSource
+	audioInput  *rdpeai.Handler
+
+	// audioDecoders and audioPassthrough, when set, are passed to the
+	// RDPSND handler's SetDecoder and SetPassthrough.
+	audioDecoders    map[uint16]rdpsnd.NewDecoderFunc
+	audioPassthrough *[]uint16
+
+	// timeZone, when set, is reported as the client time zone.
+	timeZone *time.Location
+
+	// compression, when set, is the bulk compression level requested.
+	compression *int
+
+	// monitors is the layout requested with WithMonitors, monitorLayout
+	// the last one the server reported.
+	monitors      []Monitor
+	monitorLayout atomic.Pointer[[]Monitor]
+
+	// desktopScale and deviceScale are the scale factors requested with
+	// WithScaleFactor, in percent; 0 when not requested.
+	desktopScale, deviceScale int
+
+	// palette is the colour table of an 8bpp session.
+	palette atomic.Pointer[Palette]
+
+	// maxUnackedFrames, when set, overrides the Frame Acknowledge
+	// capability frame count.
+	maxUnackedFrames *uint32
+
+	// capFilter adjusts the client capability sets of every Confirm Active.
+	capFilter pdu.CapabilityFilter
+
+	// memoryBudget is the limit of the budget of each connection, budget
+	// the budget of the current one.
+	memoryBudget int64
+	budget       *core.Budget
+
+	// bitmapCacheFile is where the persistent bitmap cache is kept between
+	// runs; bitmapCache is loaded from it once and shared by reconnects.
+	bitmapCacheFile string
+	bitmapCache     *pdu.BitmapCache
+	// gfxCacheFile and gfxCache are the same for the RDPGFX bitmap cache.
+	gfxCacheFile string
+	gfxCache     *rdpgfx.PersistentCache
+}
+
+// RedirectInfo describes a Server Redirection PDU received from a
+// connection broker.  Proxies can persist LoadBalanceInfo and hand it
+// back through SetRoutingToken to keep session affinity.
+type RedirectInfo struct {
+	SessionID         uint32
+	RedirFlags        uint32
+	LoadBalanceInfo   []byte
+	TargetNetAddress  string
+	TargetFQDN        string
+	TargetNetBiosName string
+	Username          string
+	Domain            string
 }
 
+// SecurityDowngrade describes a server that selected a weaker security
+// protocol than the strongest one the client requested.  Requested is the
+// x224 requestedProtocols mask and Selected the protocol chosen by the
+// server (x224.PROTOCOL_*).
+type SecurityDowngrade struct {
+	Requested uint32
+	Selected  uint32
+}
+
+func (d SecurityDowngrade) String() string {
+	return fmt.Sprintf("security downgraded to %s", x224.ProtocolName(d.Selected))
+}
+
+// ErrSecurityDowngrade can be returned by an OnSecurityDowngrade callback
+// to refuse a downgraded connection.
+var ErrSecurityDowngrade = errors.New("server selected a weaker security protocol than requested")
+
 const mouseCoalesceInterval = 16 * time.Millisecond
 
 // Bitmap is a single rendered region delivered to the OnBitmap callback.
@@ -155,6 +429,43 @@ type Bitmap struct {
 	Height       int
 	BitsPerPixel int
 	Data         []byte
+
+	// Seq numbers the update batch this rectangle belongs to.  It is the
+	// same for every Bitmap of one OnBitmap call and increases by one per
+	// call, across all update types and reconnects.
+	Seq uint64
+	// UpdateType is the kind of update that carried the rectangle.
+	UpdateType pdu.BitmapUpdateType
+	// Compressed reports interleaved RLE compression on the wire.
+	Compressed bool
+	// Codec is the surface bits codec ID (1 NSCodec, 3 RemoteFX) for
+	// surface command updates, 0 otherwise.
+	Codec uint8
+	// EncodedSize is the number of bytes received for the rectangle, or
+	// 0 when unknown (RDPGFX).
+	EncodedSize int
+	// Palette maps the colour indexes of an 8bpp bitmap (BitsPerPixel 1);
+	// without it BitsPerPixel 1 is taken as RGB555.
+	Palette *Palette
+
+	// src, when set, holds the pixels at the Dest rectangle instead of
+	// Data: the rectangle was decoded straight into that screen.
+	src *image.RGBA
+}
+
+// paintInto paints the bitmap at its Dest rectangle of dst and returns
+// the rectangle of dst written.
+func (bm *Bitmap) paintInto(dst *image.RGBA) image.Rectangle {
+	dest := image.Rect(bm.DestLeft, bm.DestTop, bm.DestRight+1, bm.DestBottom+1)
+	switch {
+	case bm.src == dst:
+		return dest.Intersect(dst.Rect)
+	case bm.src != nil:
+		r := dest.Intersect(dst.Rect).Intersect(bm.src.Rect)
+		draw.Draw(dst, r, bm.src, r.Min, draw.Src)
+		return r
+	}
+	return bm.BitmapToRGBAInto(dst.SubImage(dest).(*image.RGBA), dest.Min)
 }
 
 // FillRGBA converts the bitmap's pixel data to RGBA format, writing into dst.
@@ -168,8 +479,47 @@ func (bm *Bitmap) FillRGBA(dst *image.RGBA) *image.RGBA {
 	if dst == nil || dst.Bounds().Dx() != bm.Width || dst.Bounds().Dy() != bm.Height {
 		dst = image.NewRGBA(image.Rect(0, 0, bm.Width, bm.Height))
 	}
-	pix := dst.Pix
-	data := bm.Data
+	bm.toRGBA(dst.Pix, bm.Data)
+	return dst
+}
+
+// BitmapToRGBAInto converts the bitmap's pixel data straight into dst,
+// with its top left corner at at, clipped to the bounds of dst, and
+// returns the rectangle of dst written.  Unlike FillRGBA and draw.Draw it
+// needs no intermediate image: each row is converted into the stride of
+// dst.  Pass a SubImage of dst to clip further, as to the Dest rectangle:
+//
+//	dest := image.Rect(bm.DestLeft, bm.DestTop, bm.DestRight+1, bm.DestBottom+1)
+//	bm.BitmapToRGBAInto(screen.SubImage(dest).(*image.RGBA), dest.Min)
+func (bm *Bitmap) BitmapToRGBAInto(dst *image.RGBA, at image.Point) image.Rectangle {
+	r := image.Rectangle{at, at.Add(image.Pt(bm.Width, bm.Height))}.Intersect(dst.Rect)
+	size := bm.pixelSize()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		src := ((y-at.Y)*bm.Width + r.Min.X - at.X) * size
+		if src >= len(bm.Data) {
+			break
+		}
+		i := dst.PixOffset(r.Min.X, y)
+		bm.toRGBA(dst.Pix[i:i+r.Dx()*4], bm.Data[src:])
+	}
+	return r
+}
+
+// pixelSize returns the bytes a pixel takes in Data.
+func (bm *Bitmap) pixelSize() int {
+	if bm.BitsPerPixel == 1 && bm.Palette == nil {
+		return 2 // RGB555
+	}
+	return bm.BitsPerPixel
+}
+
+// toRGBA converts the pixels of data, in the format of the bitmap, into
+// pix, as many as both hold.
+func (bm *Bitmap) toRGBA(pix, data []byte) {
+	if bm.BitsPerPixel == 1 && bm.Palette != nil {
+		paletteBatchToRGBA(pix, data, min(len(pix)>>2, len(data)), bm.Palette, false)
+		return
+	}
 
 	// Per-format specialised loops avoid a per-pixel switch and let the
 	// compiler hoist bounds checks and emit tight, branch-free inner code.
@@ -209,12 +559,12 @@ func (bm *Bitmap) FillRGBA(dst *image.RGBA) *image.RGBA {
 			}
 		}
 	}
-	return dst
 }
 
 // RGBA converts the bitmap pixel data to an *image.RGBA.
 // A new *image.RGBA is allocated on each call.  If the caller processes tiles
-// of the same dimensions across frames, prefer FillRGBA to avoid allocations.
+// of the same dimensions across frames, prefer FillRGBA to avoid allocations,
+// or BitmapToRGBAInto to paint the bitmap into a larger image.
 func (bm *Bitmap) RGBA() *image.RGBA {
 	return bm.FillRGBA(nil)
 }
@@ -247,6 +597,10 @@ func (bm *Bitmap) FillBGRA(dst []byte) []byte {
 	}
 	dst = dst[:need]
 	data := bm.Data
+	if bm.BitsPerPixel == 1 && bm.Palette != nil {
+		paletteBatchToRGBA(dst, data, n, bm.Palette, true)
+		return dst
+	}
 
 	switch bm.BitsPerPixel {
 	case 2:
@@ -282,7 +636,26 @@ func (bm *Bitmap) FillBGRA(dst []byte) []byte {
 	return dst
 }
 
-func NewRdpClient(host string, width, height int, dialer func(string) (net.Conn, error)) *RdpClient {
+// New returns a client for host, "host:port", configured by opts.  The
+// desktop is DefaultWidth x DefaultHeight unless WithResolution or
+// WithMonitors says otherwise, and the client dials TCP itself unless
+// WithDialer is given.
+//
+//	client := grdp.New("10.0.0.5:3389",
+//		grdp.WithResolution(1920, 1080),
+//		grdp.WithDomainUser("CORP", "alice", password),
+//		grdp.WithTimeouts(grdp.Timeouts{Connect: time.Minute}))
+//	err := client.Login("", "", "")
+func New(host string, opts ...Option) *RdpClient {
+	return NewRdpClient(host, DefaultWidth, DefaultHeight, nil, opts...)
+}
+
+// NewRdpClient returns a client for host with a width x height desktop
+// that opens its connections with dialer, nil for plain TCP.
+//
+// Deprecated: use New with WithResolution and WithDialer, which new
+// settings can be added to without changing the signature.
+func NewRdpClient(host string, width, height int, dialer func(string) (net.Conn, error), opts ...Option) *RdpClient {
 	g := &RdpClient{
 		hostPort:        host,
 		width:           width,
@@ -291,6 +664,12 @@ func NewRdpClient(host string, width, height int, dialer func(string) (net.Conn,
 		keyboardType:    uint32(gcc.KT_IBM_101_102_KEYS),
 		keyboardSubType: 0,
 		dialer:          dialer,
+		dialTimeout:     defaultDialTimeout,
+		connectTimeout:  defaultConnectTimeout,
+		memoryBudget:    core.DefaultBudget,
+		identityStore:   NewMemoryIdentityStore(),
+		state:           newStateMachine(),
+		log:             core.Logger(nil, "grdp"),
 		decompressPool: sync.Pool{
 			New: func() any { return []uint8(nil) },
 		},
@@ -302,6 +681,19 @@ func NewRdpClient(host string, width, height int, dialer func(string) (net.Conn,
 	// sendMouseMoveLocked / sendWheelLocked need no per-call allocations.
 	g.mouse.pduBuf[0] = &g.mouse.pdu
 	g.wheel.pduBuf[0] = &g.wheel.pdu
+	g.hwheel.pduBuf[0] = &g.hwheel.pdu
+	g.wheel.flag = pdu.PTRFLAGS_WHEEL
+	g.hwheel.flag = pdu.PTRFLAGS_HWHEEL
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.logger == nil {
+		g.logger = core.DefaultLogger
+	}
+	if g.redactLogs {
+		g.logger = slog.New(core.NewRedactingHandler(g.logger.Handler()))
+	}
+	g.log = core.Logger(g.logger, "grdp")
 	return g
 }
 
@@ -343,7 +735,7 @@ func (g *RdpClient) SetKeyboardLayout(layout string) {
 	if v, ok := keyboardLayoutMap[strings.ToUpper(layout)]; ok {
 		g.kbdLayout = v
 	} else {
-		slog.Warn("Unknown keyboard layout, falling back to US", "layout", layout)
+		g.log.Warn("Unknown keyboard layout, falling back to US", "layout", layout)
 		g.kbdLayout = uint32(gcc.US)
 	}
 }
@@ -354,11 +746,84 @@ func (g *RdpClient) SetKeyboardType(keyboardType string) {
 	if v, ok := keyboardTypeMap[strings.ToUpper(keyboardType)]; ok {
 		g.keyboardType = v
 	} else {
-		slog.Warn("Unknown keyboard type, falling back to IBM_101_102_KEYS", "keyboardType", keyboardType)
+		g.log.Warn("Unknown keyboard type, falling back to IBM_101_102_KEYS", "keyboardType", keyboardType)
 		g.keyboardType = uint32(gcc.KT_IBM_101_102_KEYS)
 	}
 }
 
+// SetKeyExchangeProvider delegates the client random generation and RSA
+// encryption of Standard RDP Security to p, e.g. to draw the random from
+// a hardware generator.  The random p returns, and the session keys
+// derived from it, are still held in process memory; see
+// sec.KeyExchangeProvider.  It has no effect on TLS or NLA connections.
+// Call before Login.
+func (g *RdpClient) SetKeyExchangeProvider(p sec.KeyExchangeProvider) *RdpClient {
+	g.keyExchange = p
+	return g
+}
+
+// SetRemoteCredentialGuard enables Remote Credential Guard for hosts that
+// enforce it.  The client requests REDIRECTED_AUTHENTICATION_MODE_REQUIRED
+// and, once NLA has authenticated the user, delegates logon (and optional
+// supplemental) package credentials such as a Kerberos ticket instead of
+// the password.  The connection fails if the server does not support
+// redirected authentication.  Call before Login.
+func (g *RdpClient) SetRemoteCredentialGuard(logon nla.TSRemoteGuardPackageCred, supplemental ...nla.TSRemoteGuardPackageCred) *RdpClient {
+	g.remoteGuard = &nla.TSRemoteGuardCreds{
+		LogonCred:         logon,
+		SupplementalCreds: supplemental,
+	}
+	return g
+}
+
+// OnSecurityDowngrade registers f to be called when the server selects a
+// weaker protocol than requested, e.g. TLS-only instead of NLA, or
+// Standard RDP Security.  It runs before the TLS handshake; returning a
+// non-nil error (such as ErrSecurityDowngrade) aborts Login with it,
+// returning nil lets the connection continue.
+func (g *RdpClient) OnSecurityDowngrade(f func(SecurityDowngrade) error) *RdpClient {
+	g.onDowngradeFn = f
+	return g
+}
+
+// SetSmartCardProvider makes NLA delegate a smart card logon (PIN, CSP
+// and reader) obtained from p instead of the password, so the session is
+// logged on with the card.  The NLA authentication itself still uses the
+// domain and user passed to Login.  Call before Login; nil restores
+// password delegation.
+func (g *RdpClient) SetSmartCardProvider(p nla.SmartCardProvider) *RdpClient {
+	g.smartCard = p
+	return g
+}
+
+// SetServicePrincipalName overrides the SPN the client authenticates to,
+// e.g. a name shared by all hosts of a clustered farm.  An empty spn
+// restores TERMSRV/<host>, derived from the current (possibly redirected)
+// host.
+func (g *RdpClient) SetServicePrincipalName(spn string) *RdpClient {
+	g.spn = spn
+	return g
+}
+
+// ServicePrincipalName returns the SPN sent during NLA.
+func (g *RdpClient) ServicePrincipalName() string {
+	if g.spn != "" {
+		return g.spn
+	}
+	return nla.ServicePrincipalName(g.hostPort)
+}
+
+// SetNLATimeout bounds each message of the NLA (CredSSP) handshake to
+// timeout; a server that stalls is given retries further periods before
+// Login fails with a *tpkt.NLATimeoutError naming the message it was
+// waiting for.  The defaults are tpkt.DefaultNLATimeout and
+// tpkt.DefaultNLARetries.  Call before Login.
+func (g *RdpClient) SetNLATimeout(timeout time.Duration, retries int) *RdpClient {
+	g.nlaTimeout = timeout
+	g.nlaRetries = retries
+	return g
+}
+
 // DisableAVC444 prevents the client from advertising AVC444/AVC444v2 support.
 // When called before Login, the RDPGFX CAPS_ADVERTISE is limited to v8.1
 // (AVC420 only), so the server will never send LC=2 chroma-upgrade frames.
@@ -370,8 +835,12 @@ func (g *RdpClient) DisableAVC444() *RdpClient {
 	return g
 }
 
+// bpp returns the bytes per pixel of a bitmap depth, 0 for a depth the
+// client does not decode.
 func bpp(BitsPerPixel uint16) int {
 	switch BitsPerPixel {
+	case 8:
+		return 1
 	case 15, 16:
 		return 2
 	case 24:
@@ -379,7 +848,6 @@ func bpp(BitsPerPixel uint16) int {
 	case 32:
 		return 4
 	default:
-		slog.Error("invalid bitmap data format")
 		return 0
 	}
 }
@@ -398,49 +866,266 @@ func mouseButtonFlag(button int) uint16 {
 	}
 }
 
+// mouseXButtonFlag returns the Extended Mouse Event flag of the fourth
+// (3) and fifth (4) mouse buttons.
+func mouseXButtonFlag(button int) (uint16, bool) {
+	switch button {
+	case 3:
+		return pdu.PTRXFLAGS_BUTTON1, true
+	case 4:
+		return pdu.PTRXFLAGS_BUTTON2, true
+	}
+	return 0, false
+}
+
+// Login connects and logs on as user.  Called with only empty strings it
+// logs on with the account of WithDomainUser or SetCredentials.  It
+// returns once the session is active, or with a *LoginError holding the
+// state the connection failed in and the error of the layer that failed.
 func (g *RdpClient) Login(domain string, user string, password string) error {
-	slog.Debug("Login", "Host", g.hostPort, "domain", domain, "user", user)
+	return g.LoginContext(context.Background(), domain, user, password)
+}
 
-	g.domain = domain
-	g.user = user
-	g.password = password
+// LoginContext is Login with a context whose end aborts the connection
+// sequence; LoginContext then returns a *LoginError wrapping ctx.Err().
+// The timeouts of WithTimeouts still apply.
+func (g *RdpClient) LoginContext(ctx context.Context, domain string, user string, password string) error {
+	if g.optionErr != nil {
+		return g.optionErr
+	}
+	if domain != "" || user != "" || password != "" {
+		g.domain = domain
+		g.user = user
+		g.password = password
+	}
+	g.log.Debug("Login", "Host", g.hostPort, "domain", core.Secret(g.domain), "user", core.Secret(g.user))
+
+	g.credAttempt, g.credErr = 1, nil
+	err := g.doLogin(ctx, g.RoutingToken())
+	for g.credentials != nil && errors.Is(err, nla.ErrBadCredentials) && g.credAttempt < MaxCredentialAttempts {
+		g.log.Warn("Login: credentials rejected", "attempt", g.credAttempt, "err", err)
+		g.closeTransport()
+		g.credAttempt++
+		g.credErr = err
+		err = g.doLogin(ctx, g.RoutingToken())
+	}
+	return err
+}
 
-	return g.doLogin(nil)
+// RoutingToken returns a copy of the load balance info received during
+// the last server redirection, or the token set by SetRoutingToken.
+// It returns nil when no redirection has happened.  It is safe to call
+// from any goroutine.
+func (g *RdpClient) RoutingToken() []byte {
+	g.routingMu.Lock()
+	defer g.routingMu.Unlock()
+	if g.routingToken == nil {
+		return nil
+	}
+	return append([]byte(nil), g.routingToken...)
 }
 
-// doLogin establishes an RDP connection.
-// When routingToken is non-nil it replaces the username cookie in the
-// x224 Connection Request (required for Server Redirection).
-func (g *RdpClient) doLogin(routingToken []byte) error {
-	conn, err := g.dialer(g.hostPort)
-	if err != nil {
-		return fmt.Errorf("[dial err] %v", err)
+// SetRoutingToken sets the load balance info sent in the x224 Connection
+// Request instead of the username cookie.  Call before Login to reach a
+// backend remembered from a previous redirection; nil restores the
+// default cookie.
+func (g *RdpClient) SetRoutingToken(token []byte) *RdpClient {
+	g.setRoutingToken(token)
+	return g
+}
+
+func (g *RdpClient) setRoutingToken(token []byte) {
+	g.routingMu.Lock()
+	defer g.routingMu.Unlock()
+	if token == nil {
+		g.routingToken = nil
+	} else {
+		g.routingToken = append([]byte(nil), token...)
 	}
+}
 
-	host, _, _ := net.SplitHostPort(g.hostPort)
-	g.tpkt = tpkt.New(core.NewSocketLayer(conn, host), nla.NewNTLMv2(g.domain, g.user, g.password))
-	g.x224 = x224.New(g.tpkt)
-	g.mcs = t125.NewMCSClient(g.x224, g.kbdLayout, g.keyboardType, g.keyboardSubType)
+// OnRedirect registers f to be called whenever the server redirects the
+// client, before the new connection is attempted.
+func (g *RdpClient) OnRedirect(f func(RedirectInfo)) *RdpClient {
+	g.onRedirectFn = f
+	return g
+}
+
+// recordRedirect stores the routing token of redir and notifies the
+// OnRedirect callback.
+func (g *RdpClient) recordRedirect(redir *pdu.ServerRedirectionPDU) {
+	g.setRoutingToken(redir.LoadBalanceInfo)
+	if g.onRedirectFn != nil {
+		g.onRedirectFn(RedirectInfo{
+			SessionID:         redir.SessionID,
+			RedirFlags:        redir.RedirFlags,
+			LoadBalanceInfo:   append([]byte(nil), redir.LoadBalanceInfo...),
+			TargetNetAddress:  redir.TargetNetAddress,
+			TargetFQDN:        redir.TargetFQDN,
+			TargetNetBiosName: redir.TargetNetBiosName,
+			Username:          redir.Username,
+			Domain:            redir.Domain,
+		})
+	}
+}
+
+// setupSession builds the MCS, security, PDU and channel layers of a
+// connection on t and wires them to the client.  doLogin passes the X.224
+// layer; Replay a transport that discards what the client sends.
+func (g *RdpClient) setupSession(t core.Transport) {
+	g.mcs = t125.NewMCSClient(t, g.kbdLayout, g.keyboardType, g.keyboardSubType)
+	g.mcs.SetLogger(g.logger)
 	g.sec = sec.NewClient(g.mcs)
+	g.sec.SetLogger(g.logger)
+	g.sec.SetKeyExchangeProvider(g.keyExchange)
+	g.sec.SetServerCertPolicy(g.serverCertPolicy)
 	g.pdu = pdu.NewClient(g.sec)
+	g.pdu.SetLogger(g.logger)
 	g.channels = plugin.NewChannels(g.sec)
+	g.channels.SetLogger(g.logger)
+	g.budget = core.NewBudget(g.memoryBudget)
+	g.channels.SetBudget(g.budget)
 
 	// Wire user-registered callbacks now that g.pdu is initialised.
 	// This allows callers to invoke On* methods before Login.
 	g.reregisterCallbacks()
+	// The framebuffer and the paint callbacks follow the new PDU layer.
+	g.bitmapSub = nil
+	if g.painting() {
+		g.subscribeBitmaps()
+	}
+	g.trackCursor()
+	g.countFrames()
+	g.pdu.On("decodeError", g.recoverDisplay)
+
+	g.disconnectReason.Store(0)
+	g.mcs.On("disconnect", func(reason uint8) {
+		g.disconnectReason.Store(uint32(reason) + 1)
+	})
+	g.serverError.Store(nil)
+	g.pdu.On("errorInfo", func(e *ServerError) {
+		g.serverError.Store(e)
+	})
+	g.pdu.On("autoReconnectCookie", func(sessionId uint32, random []byte) {
+		g.arcCookie.Store(&autoReconnectCookie{sessionId, random})
+	})
+	shutdownDone := make(chan struct{}, 1)
+	g.shutdownDone = shutdownDone
+	signalShutdown := func() {
+		select {
+		case shutdownDone <- struct{}{}:
+		default:
+		}
+	}
+	g.pdu.On("shutdownDenied", signalShutdown)
+	g.pdu.On("close", signalShutdown)
 
 	// Wire RemoteFX surface decoder so the pdu layer can decode
 	// codecID=3 in surface bitmap commands without importing rdpgfx.
 	pdu.DecodeRemoteFX = rdpgfx.DecodeSurfaceRFX
 
 	g.mcs.SetClientDesktop(uint16(g.width), uint16(g.height))
+	if len(g.monitors) > 0 {
+		g.mcs.SetClientMonitors(g.monitorDefs())
+		g.mcs.SetClientMonitorAttributes(g.monitorAttributes())
+		w, h := g.mcs.ClientDesktop()
+		g.width, g.height = int(w), int(h)
+	}
+	if g.fb != nil {
+		g.fb.resize(g.width, g.height)
+	}
+	if desktop, device := g.scaleFactors(); desktop != 0 {
+		g.mcs.SetClientScale(desktop, device)
+	}
+	g.monitorLayout.Store(nil)
+	g.pdu.On("monitorLayout", func(defs []gcc.MonitorDef) {
+		m := monitorsFromDefs(defs)
+		g.monitorLayout.Store(&m)
+	})
+	if g.colorDepth != 0 {
+		g.mcs.SetClientColorDepth(g.colorDepth)
+		g.pdu.SetPreferredColorDepth(uint16(g.colorDepth))
+	}
+	if g.maxUnackedFrames != nil {
+		g.pdu.SetMaxUnacknowledgedFrames(*g.maxUnackedFrames)
+	}
+	if g.capFilter != nil {
+		g.pdu.SetCapabilityFilter(g.capFilter)
+	}
+	if g.bitmapCacheFile != "" {
+		if g.bitmapCache == nil {
+			bc, err := pdu.LoadBitmapCacheFile(g.bitmapCacheFile)
+			if err != nil {
+				g.log.Warn("load bitmap cache", "file", g.bitmapCacheFile, "err", err)
+			}
+			g.bitmapCache = bc
+		}
+		g.pdu.SetBitmapCache(g.bitmapCache)
+	}
+	g.gdi = nil
+	if g.noDrawingOrders {
+		g.pdu.SetDrawingOrders(false)
+	} else {
+		g.gdi = newGDI(g.width, g.height)
+		g.gdi.log = g.log
+	}
+	g.palette.Store(greyPalette)
+	g.pdu.On("palette", func(entries []pdu.PaletteEntry) {
+		p := newPalette(entries)
+		g.palette.Store(p)
+		if g.gdi != nil {
+			g.gdi.setPalette(p)
+		}
+	})
+	if g.clientName != nil {
+		g.mcs.SetClientName(*g.clientName)
+	}
+	if g.clientBuild != 0 {
+		g.mcs.SetClientBuild(g.clientBuild)
+	}
+	if g.keyboardFnKeys != 0 {
+		g.mcs.SetKeyboardFunctionKeys(g.keyboardFnKeys)
+	}
+	if g.clientAddress != "" {
+		g.sec.SetClientAddress(g.clientAddress)
+	}
+	if g.perfFlags != nil {
+		g.sec.SetPerformanceFlags(*g.perfFlags)
+	}
+	if g.connType != nil {
+		g.mcs.SetConnectionType(g.connType.t, g.connType.autodetect)
+	}
+	if g.timeZone != nil {
+		g.sec.SetTimeZone(g.timeZone)
+	}
+	if g.compression != nil {
+		g.sec.SetCompression(*g.compression)
+	}
+	if g.audioSource != nil {
+		g.sec.SetAudioCapture()
+	}
 
 	// Register channels in order: rdpdr, rdpsnd, cliprdr, drdynvc
 	// (matching the channel order that Windows servers expect)
 
-	// rdpdr (Device Redirection) — stub, required for server to enable audio
-	g.channels.Register(&stubChannel{name: "rdpdr",
-		option: plugin.CHANNEL_OPTION_INITIALIZED | plugin.CHANNEL_OPTION_ENCRYPT_RDP | plugin.CHANNEL_OPTION_COMPRESS_RDP})
+	// rdpdr (Device Redirection) — required for server to enable audio,
+	// and serves the drives added by RedirectDrive
+	computerName := ""
+	if g.clientName != nil {
+		computerName = *g.clientName
+	} else {
+		computerName, _ = os.Hostname()
+	}
+	var devices []rdpdr.Device
+	for _, d := range g.drives {
+		devices = append(devices, rdpdr.NewDrive(d.name, d.fsys))
+	}
+	if g.smartCards != nil {
+		devices = append(devices, scard.NewDevice(g.smartCards))
+	}
+	g.rdpdrClient = rdpdr.NewClient(computerName, devices...)
+	g.rdpdrClient.SetLogger(g.logger)
+	g.channels.Register(g.rdpdrClient)
 	g.mcs.SetClientDeviceRedirection()
 
 	// RDPSND (Audio Output) handler — static virtual channel + DVC paths
@@ -454,6 +1139,13 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 			g.onAudioResetFn()
 		}
 	})
+	rdpsndHandler.SetLogger(g.logger)
+	for tag, f := range g.audioDecoders {
+		rdpsndHandler.SetDecoder(tag, f)
+	}
+	if g.audioPassthrough != nil {
+		rdpsndHandler.SetPassthrough(*g.audioPassthrough...)
+	}
 	g.channels.Register(rdpsndHandler)
 	g.mcs.SetClientSoundProtocol()
 
@@ -471,20 +1163,41 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 			return ""
 		},
 	)
+	cliprdrHandler.SetRemoteClipboardFunc(func(rc *cliprdr.RemoteClipboard) {
+		if g.onRemoteClipboardFn != nil {
+			g.onRemoteClipboardFn(rc)
+		}
+	})
+	if g.clipboard != nil {
+		cliprdrHandler.SetClipboard(*g.clipboard)
+	}
+	cliprdrHandler.SetLogger(g.logger)
 	g.cliprdrHandler = cliprdrHandler
 	g.channels.Register(cliprdrHandler)
 	g.mcs.SetClientClipboard()
 
+	// rail (RemoteApp) — only for sessions started by SetRemoteApp
+	g.railClient = nil
+	if g.remoteApp != nil {
+		g.setupRail()
+	}
+
 	// drdynvc (Dynamic Virtual Channels)
 	dvcClient := drdynvc.NewDvcClient()
+	dvcClient.SetLogger(g.logger)
+	dvcClient.SetBudget(g.budget)
 	g.channels.Register(dvcClient)
 	g.mcs.SetClientDynvcProtocol()
 
+	// Channels registered by the application come after the built-in ones.
+	g.setupStaticChannels()
+
 	// RDPGFX (Graphics Pipeline) handler
 	gfxHandler := rdpgfx.NewGfxHandler(func(updates []rdpgfx.BitmapUpdate) {
-		if g.onBitmapPaintFn == nil {
+		if !g.painting() {
 			return
 		}
+		seq := g.bitmapSeq.Add(1)
 		bs := make([]Bitmap, len(updates))
 		for i, u := range updates {
 			bs[i] = Bitmap{
@@ -496,18 +1209,35 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 				Height:       u.Height,
 				BitsPerPixel: u.Bpp,
 				Data:         u.Data,
+				Seq:          seq,
+				UpdateType:   pdu.BITMAP_UPDATE_GFX,
 			}
 		}
-		g.onBitmapPaintFn(bs)
+		g.paint(bs)
 	})
+	gfxHandler.SetLogger(g.logger)
+	gfxHandler.SetBudget(g.budget)
 	gfxHandler.SetDecoderBrokenCallback(func() {
-		slog.Debug("H.264 decoder broken")
+		g.log.Debug("H.264 decoder broken")
 		if g.onDecoderBrokenFn != nil {
 			g.onDecoderBrokenFn()
 		}
 	})
+	gfxHandler.SetResetGraphicsCallback(func(width, height int) {
+		if width == g.width && height == g.height {
+			return
+		}
+		g.log.Debug("RDPGFX desktop resize", "width", width, "height", height)
+		g.width, g.height = width, height
+		if g.fb != nil {
+			g.fb.resize(width, height)
+		}
+		if g.onResizeFn != nil {
+			g.onResizeFn(width, height)
+		}
+	})
 	gfxHandler.SetKeyframeRequestFunc(func() {
-		slog.Debug("H.264: requesting keyframe via force refresh")
+		g.log.Debug("H.264: requesting keyframe via force refresh")
 		if g.pdu != nil {
 			// SendRefreshRect is silently ignored by Windows servers while
 			// an H.264 video stream is active.  Use the suppress→allow
@@ -528,6 +1258,22 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 	if g.avc444Disabled {
 		gfxHandler.SetAVC444Disabled(true)
 	}
+	if g.onFrameFn != nil {
+		gfxHandler.SetFrameCallback(g.frameCallback())
+	}
+	if g.onH264NALFn != nil {
+		gfxHandler.SetH264NALCallback(g.onH264NALFn)
+	}
+	if g.gfxCacheFile != "" {
+		if g.gfxCache == nil {
+			gc, err := rdpgfx.LoadPersistentCacheFile(g.gfxCacheFile)
+			if err != nil {
+				g.log.Warn("load rdpgfx cache", "file", g.gfxCacheFile, "err", err)
+			}
+			g.gfxCache = gc
+		}
+		gfxHandler.SetPersistentCache(g.gfxCache)
+	}
 	g.gfxHandler = gfxHandler
 	dvcClient.RegisterHandler(rdpgfx.ChannelName, gfxHandler)
 
@@ -536,9 +1282,37 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 	// dimensions so the handler sends an initial MONITOR_LAYOUT PDU as soon
 	// as the channel opens, prompting the server to resize to g.width×g.height.
 	dispHandler := rdpedisp.NewHandler(uint32(g.width), uint32(g.height))
+	dispHandler.SetLogger(g.logger)
+	if layout := g.displayLayout(); layout != nil {
+		dispHandler.SetInitialLayout(layout)
+	}
 	g.dispHandler = dispHandler
 	dvcClient.RegisterHandler(rdpedisp.ChannelName, dispHandler)
 
+	// RDPEI (Input Virtual Channel) handler — carries native touch and pen
+	// input once the server opens the channel (MS-RDPEI).
+	touchHandler := rdpei.NewHandler()
+	touchHandler.SetLogger(g.logger)
+	g.touchHandler = touchHandler
+	dvcClient.RegisterHandler(rdpei.ChannelName, touchHandler)
+
+	// MS-RDPEECO echo, which answers the latency probes of the server and
+	// carries those of Ping.
+	echoHandler := rdpeeco.NewHandler()
+	echoHandler.SetLogger(g.logger)
+	g.echoHandler = echoHandler
+	dvcClient.RegisterHandler(rdpeeco.ChannelName, echoHandler)
+
+	// MS-RDPEAI audio input, when the application supplies a microphone.
+	g.audioInput = nil
+	if g.audioSource != nil {
+		g.audioInput = rdpeai.NewHandler(g.audioSource)
+		g.audioInput.SetLogger(g.logger)
+		dvcClient.RegisterHandler(rdpeai.ChannelName, g.audioInput)
+	}
+
+	g.setupDynamicChannels(dvcClient)
+
 	// Reject Video Optimized Remoting (VOR) channels so the server keeps
 	// sending video through the RDPGFX pipeline which we do handle.
 	// Without this, the server detects video playback (e.g. YouTube) and
@@ -563,10 +1337,89 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 	g.sec.SetPwd(g.password)
 	g.sec.SetDomain(g.domain)
 
-	g.tpkt.SetFastPathListener(g.sec)
-	g.sec.SetFastPathListener(g.pdu)
+	var fastPath core.FastPathListener = g.pdu
+	if g.recordTo != nil {
+		fastPath = g.tapSession()
+	}
+	g.sec.SetFastPathListener(fastPath)
 	g.sec.SetChannelSender(g.mcs)
 	g.channels.SetChannelSender(g.sec)
+	g.pdu.SetFastPathSender(g.sec)
+
+	// DeactivateAllPDU during an active session means the server is
+	// reactivating (e.g. desktop resize). Pause input until "ready"
+	// fires again after the reactivation handshake completes.
+	g.pdu.On("deactivateAll", func() {
+		g.eventReady.Store(false)
+	})
+	// The Demand Active of a reactivation may carry a new desktop size.
+	g.pdu.On("desktopResize", func(width, height uint16) {
+		g.log.Debug("server desktop resize", "width", width, "height", height)
+		g.width, g.height = int(width), int(height)
+		if g.gdi != nil {
+			g.gdi.resize(g.width, g.height)
+		}
+		if g.fb != nil {
+			g.fb.resize(g.width, g.height)
+		}
+		if g.onResizeFn != nil {
+			g.onResizeFn(g.width, g.height)
+		}
+	})
+}
+
+// doLogin establishes an RDP connection.
+// When routingToken is non-nil it replaces the username cookie in the
+// x224 Connection Request (required for Server Redirection).
+func (g *RdpClient) doLogin(ctx context.Context, routingToken []byte) (err error) {
+	gen := g.state.begin()
+	defer func() {
+		if _, ok := err.(*LoginError); err != nil && !ok {
+			err = g.state.fail(gen, err)
+		}
+	}()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dial := g.dialer
+	if dial == nil {
+		dial = func(hostPort string) (net.Conn, error) {
+			d := net.Dialer{Timeout: g.dialTimeout}
+			return d.DialContext(ctx, "tcp", hostPort)
+		}
+	}
+	conn, err := dial(g.hostPort)
+	if err != nil {
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(g.hostPort)
+	ntlm := nla.NewNTLMv2(g.domain, g.user, g.password)
+	ntlm.SetTargetName(g.ServicePrincipalName())
+	ntlm.SetLogger(g.logger)
+	g.tpkt = tpkt.New(core.NewSocketLayer(conn, host), ntlm)
+	g.tpkt.SetLogger(g.logger)
+	if g.tap != nil {
+		g.tpkt.SetTap(g.tap)
+	}
+	g.tpkt.SetTLSConfig(g.tlsConfig)
+	g.tpkt.SetCertificatePolicy(g.certPolicy)
+	if g.nlaTimeout > 0 {
+		g.tpkt.SetNLATimeout(g.nlaTimeout, g.nlaRetries)
+	}
+	g.tpkt.SetReadTimeout(g.readTimeout)
+	g.x224 = x224.New(g.tpkt)
+	g.x224.SetLogger(g.logger)
+	// Registered before the MCS client so a changed identity is reported
+	// before any connection data goes out.
+	g.x224.On("connect", func() {
+		if cert, err := g.tpkt.Conn.PeerCertificate(); err == nil {
+			g.checkServerIdentity(cert)
+		}
+	})
+	g.setupSession(g.x224)
+
+	g.tpkt.SetFastPathListener(g.sec)
 
 	// Wire fast-path output: pdu → sec → tpkt.  This enables the much
 	// shorter Fast-Path Client Input PDU framing for mouse/keyboard events
@@ -574,18 +1427,39 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 	// negotiation in the PDU layer and by sec.SendFastPath itself, which
 	// refuses when legacy RDP encryption is in effect.
 	g.sec.SetFastPathSender(g.tpkt)
-	g.pdu.SetFastPathSender(g.sec)
 
-	g.x224.SetRequestedProtocol(x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID)
+	if g.remoteGuard != nil {
+		// Redirected authentication is only defined for CredSSP.
+		g.x224.SetRequestedProtocol(x224.PROTOCOL_HYBRID)
+		g.x224.SetRequestFlags(x224.REDIRECTED_AUTHENTICATION_MODE_REQUIRED)
+		g.tpkt.SetRemoteGuardCredentials(g.remoteGuard)
+	} else {
+		g.x224.SetRequestedProtocol(x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID)
+	}
+	g.tpkt.SetSmartCardProvider(g.smartCardProvider())
+	if g.credentials != nil {
+		resolve := g.credentialsFunc()
+		g.tpkt.SetCredentialsFunc(resolve)
+		g.sec.SetCredentialsFunc(resolve)
+	}
+	g.x224.SetDowngradeHandler(func(requested, selected uint32) error {
+		if g.onDowngradeFn == nil {
+			return nil
+		}
+		return g.onDowngradeFn(SecurityDowngrade{Requested: requested, Selected: selected})
+	})
 	if routingToken != nil {
 		g.x224.SetRoutingToken(routingToken)
 	} else {
 		g.x224.SetUsername(g.user)
 	}
 
+	g.trackState(gen)
+	g.state.set(gen, StateNegotiating, nil)
 	err = g.x224.Connect()
 	if err != nil {
-		return fmt.Errorf("[x224 connect err] %v", err)
+		g.tpkt.Close()
+		return err
 	}
 
 	// Wait for the RDP handshake to complete or fail.
@@ -610,6 +1484,9 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 	g.pdu.On("ready", func() {
 		g.eventReady.Store(true)
 		readyFired = true
+		g.state.set(gen, StateActive, nil)
+		g.openStaticChannels()
+		g.pdu.SendSynchronizeEvent(g.toggleKeys.Load())
 		send(connResult{})
 	})
 
@@ -620,6 +1497,7 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 			// Mid-session error: stop accepting input so we don't
 			// try to write to the now-dead transport.
 			g.eventReady.Store(false)
+			g.state.set(gen, StateClosed, err)
 		}
 	})
 
@@ -635,45 +1513,70 @@ func (g *RdpClient) doLogin(routingToken []byte) error {
 		}
 	})
 
-	// DeactivateAllPDU during an active session means the server is
-	// reactivating (e.g. desktop resize). Pause input until "ready"
-	// fires again after the reactivation handshake completes.
-	g.pdu.On("deactivateAll", func() {
-		g.eventReady.Store(false)
-	})
-
-	select {
-	case r := <-ch:
-		if r.err != nil {
+	timeout := time.NewTimer(g.connectTimeout)
+	defer timeout.Stop()
+	for {
+		_, changed, _ := g.state.get()
+		select {
+		case r := <-ch:
+			if r.err != nil {
+				g.tpkt.Close()
+				return r.err
+			}
+			if r.redirect != nil {
+				g.log.Debug("Server redirect", "loadBalanceInfo", string(r.redirect.LoadBalanceInfo))
+				g.tpkt.Close()
+				g.eventReady.Store(false)
+				g.recordRedirect(r.redirect)
+				return g.doLogin(ctx, r.redirect.LoadBalanceInfo)
+			}
+			// "ready" received — session established.
+			return nil
+		case <-changed:
+			if g.closed.Load() {
+				return ErrClosed
+			}
+		case <-ctx.Done():
 			g.tpkt.Close()
-			return fmt.Errorf("[connection err] %v", r.err)
-		}
-		if r.redirect != nil {
-			slog.Debug("Server redirect", "loadBalanceInfo", string(r.redirect.LoadBalanceInfo))
+			return ctx.Err()
+		case <-timeout.C:
 			g.tpkt.Close()
-			g.eventReady.Store(false)
-			return g.doLogin(r.redirect.LoadBalanceInfo)
+			return ErrConnectionTimeout
 		}
-		// "ready" received — session established.
-		return nil
-	case <-time.After(30 * time.Second):
-		g.tpkt.Close()
-		return fmt.Errorf("[connection timeout]")
+	}
+}
+
+// recoveryInterval rate-limits the refresh requests sent by recoverDisplay.
+const recoveryInterval = time.Second
+
+// recoverDisplay resynchronises the screen after a codec failure: the
+// corrupt update has already been dropped, so ask the server to repaint
+// the whole desktop with a Refresh Rect PDU.
+func (g *RdpClient) recoverDisplay(err error) {
+	now := time.Now().UnixNano()
+	last := g.lastRecovery.Load()
+	if now-last < int64(recoveryInterval) || !g.lastRecovery.CompareAndSwap(last, now) {
+		return
+	}
+	g.log.Warn("decode error, requesting full refresh", "err", err)
+	if g.pdu != nil && g.eventReady.Load() {
+		g.pdu.SendRefreshRect(uint16(g.width), uint16(g.height))
 	}
 }
 
 // handleRedirect handles a Server Redirection PDU that arrives after
 // "ready" (e.g. GNOME Remote Desktop). Runs asynchronously.
 func (g *RdpClient) handleRedirect(redir *pdu.ServerRedirectionPDU) {
-	slog.Debug("Async server redirect", "loadBalanceInfo", string(redir.LoadBalanceInfo))
+	g.log.Debug("Async server redirect", "loadBalanceInfo", string(redir.LoadBalanceInfo))
 	g.reconnecting.Store(true)
 	g.tpkt.Close()
 	g.eventReady.Store(false)
+	g.recordRedirect(redir)
 
-	err := g.doLogin(redir.LoadBalanceInfo)
+	err := g.doLogin(context.Background(), redir.LoadBalanceInfo)
 	g.reconnecting.Store(false)
 	if err != nil {
-		slog.Error("handleRedirect: login failed", "err", err)
+		g.log.Error("handleRedirect: login failed", "err", err)
 		if g.onErrorFn != nil {
 			g.onErrorFn(err)
 		}
@@ -682,6 +1585,17 @@ func (g *RdpClient) handleRedirect(redir *pdu.ServerRedirectionPDU) {
 	g.reregisterCallbacks()
 }
 
+// Channels returns the static virtual channels requested for the current
+// connection with the MCS channel IDs and option flags negotiated with
+// the server.  Channels the server refused have Joined set to false.
+// It returns nil before Login.
+func (g *RdpClient) Channels() []t125.VirtualChannelInfo {
+	if g.mcs == nil {
+		return nil
+	}
+	return g.mcs.VirtualChannels()
+}
+
 func (g *RdpClient) Width() int {
 	return g.width
 }
@@ -702,6 +1616,9 @@ func (g *RdpClient) OnError(f func(e error)) *RdpClient {
 	return g
 }
 
+// OnClose registers f to be called when the connection closes.  Use
+// ServerError and DisconnectReason in f to tell a server-initiated
+// disconnect from a network failure.
 func (g *RdpClient) OnClose(f func()) *RdpClient {
 	g.onCloseFn = f
 	if g.pdu != nil {
@@ -736,61 +1653,299 @@ func (g *RdpClient) OnReady(f func()) *RdpClient {
 // the raw pixel data beyond paint, copy it or call bm.RGBA() inside paint.
 func (g *RdpClient) OnBitmap(paint func([]Bitmap)) *RdpClient {
 	g.onBitmapPaintFn = paint
-	if g.pdu == nil {
-		return g
-	}
-	g.pdu.On("bitmap", func(rectangles []pdu.BitmapData) {
-		bs := make([]Bitmap, 0, len(rectangles))
-		var pooled [][]uint8 // track buffers borrowed from pool
-
-		for _, v := range rectangles {
-			data := v.BitmapDataStream
-			Bpp := bpp(v.BitsPerPixel)
-
-			if v.Flags&pdu.BITMAP_NO_PROCESSING != 0 {
-				// Surface command: data is already decoded top-down BGRA
-			} else if v.IsCompress() {
-				buf := g.decompressPool.Get().([]uint8)
-				buf = core.DecompressInto(v.BitmapDataStream, buf, int(v.Width), int(v.Height), Bpp)
-				data = buf
-				pooled = append(pooled, buf)
-			} else {
-				// Uncompressed bitmaps are bottom-up; flip to top-down.
-				stride := int(v.Width) * Bpp
-				h := int(v.Height)
-				tmp := g.flipLinePool.Get().([]byte)
-				if cap(tmp) < stride {
-					tmp = make([]byte, stride)
-				} else {
-					tmp = tmp[:stride]
-				}
-				for y := 0; y < h/2; y++ {
-					top := y * stride
-					bot := (h - 1 - y) * stride
-					copy(tmp, data[top:top+stride])
-					copy(data[top:top+stride], data[bot:bot+stride])
-					copy(data[bot:bot+stride], tmp)
-				}
-				g.flipLinePool.Put(tmp[:cap(tmp)])
-			}
+	if g.pdu != nil && g.bitmapSub == nil {
+		g.subscribeBitmaps()
+	}
+	return g
+}
 
-			b := Bitmap{int(v.DestLeft), int(v.DestTop), int(v.DestRight), int(v.DestBottom),
-				int(v.Width), int(v.Height), Bpp, data}
-			bs = append(bs, b)
+// painting reports whether the updates are painted: into the
+// framebuffer or for the OnBitmap and OnDamage callbacks.
+func (g *RdpClient) painting() bool {
+	return g.onBitmapPaintFn != nil || g.fb != nil || g.onDamageFn != nil
+}
+
+// subscribeBitmaps decodes the bitmap updates and drawing orders of the
+// PDU layer and hands them to paint.
+func (g *RdpClient) subscribeBitmaps() {
+	g.bitmapSub = g.pdu.OnBitmap(func(u pdu.BitmapUpdate) {
+		bs, pooled := g.decodeBitmaps(u)
+		if g.gdi != nil {
+			g.gdi.paint(bs)
 		}
-		paint(bs)
+		g.paint(bs)
 
 		for _, buf := range pooled {
 			g.decompressPool.Put(buf[:cap(buf)])
 		}
 	})
-	return g
+	// Drawing orders are rendered and handed to paint as the BGRA pixels
+	// of the area they changed.
+	g.pdu.On("orders", func(orders []pdu.OrderPdu) {
+		if g.gdi == nil {
+			return
+		}
+		r := g.gdi.draw(orders, g.pdu.BitmapCache(), g.pdu.ColorDepth())
+		if r.Empty() {
+			return
+		}
+		b := g.gdi.bitmap(r)
+		b.Seq = g.bitmapSeq.Add(1)
+		g.paint([]Bitmap{b})
+	})
+}
+
+// parallelBitmapThreshold is the number of rectangles from which an
+// update is decoded on several goroutines; below it the goroutines cost
+// more than they save.
+const parallelBitmapThreshold = 8
+
+// decodedRect is a rectangle of a bitmap update once decoded.
+type decodedRect struct {
+	data   []byte
+	pooled []uint8 // borrowed from decompressPool, nil if none
+	err    error
+}
+
+// decodeBitmaps decodes the rectangles of u into the bitmaps handed to
+// paint, in the order of the update, and returns the buffers borrowed
+// from decompressPool with them.  The rectangles are independent, so a
+// large update is decoded by up to GOMAXPROCS goroutines.  A rectangle
+// that does not decode is dropped and a refresh of the display asked for.
+// When directTarget allows it the rectangles are decoded straight into an
+// internal screen instead, leaving Bitmap.Data nil.
+func (g *RdpClient) decodeBitmaps(u pdu.BitmapUpdate) ([]Bitmap, [][]uint8) {
+	rectangles := u.Rectangles
+	seq := g.bitmapSeq.Add(1)
+	decoded := make([]decodedRect, len(rectangles))
+	target := g.directTarget(rectangles)
+	decode := func(i int) {
+		d := &decoded[i]
+		if target != nil {
+			d.err = g.decodeDirect(&rectangles[i], target.img)
+			return
+		}
+		d.data, d.pooled, d.err = g.decodeRect(&rectangles[i])
+	}
+	if workers := min(runtime.GOMAXPROCS(0), len(rectangles)); workers > 1 && len(rectangles) >= parallelBitmapThreshold &&
+		(target == nil || !overlapping(rectangles)) {
+		ch := make(chan int, len(rectangles))
+		for i := range rectangles {
+			ch <- i
+		}
+		close(ch)
+		var wg sync.WaitGroup
+		for range workers {
+			wg.Go(func() {
+				for i := range ch {
+					decode(i)
+				}
+			})
+		}
+		wg.Wait()
+	} else {
+		for i := range rectangles {
+			decode(i)
+		}
+	}
+	if target != nil {
+		target.mu.Unlock()
+	}
+
+	bs := make([]Bitmap, 0, len(rectangles))
+	var pooled [][]uint8
+	for i, d := range decoded {
+		if d.pooled != nil {
+			pooled = append(pooled, d.pooled)
+		}
+		if d.err != nil {
+			// Drop the corrupt rectangle; the refresh repaints it.
+			g.recoverDisplay(d.err)
+			continue
+		}
+		v := &rectangles[i]
+		b := Bitmap{
+			DestLeft:     int(v.DestLeft),
+			DestTop:      int(v.DestTop),
+			DestRight:    int(v.DestRight),
+			DestBottom:   int(v.DestBottom),
+			Width:        int(v.Width),
+			Height:       int(v.Height),
+			BitsPerPixel: bpp(v.BitsPerPixel),
+			Data:         d.data,
+			Seq:          seq,
+			UpdateType:   u.UpdateType,
+			Compressed:   v.IsCompress(),
+			Codec:        v.CodecID,
+			EncodedSize:  v.EncodedLength,
+		}
+		if b.BitsPerPixel == 1 {
+			b.Palette = g.palette.Load()
+		}
+		if target != nil {
+			b.src = target.img
+		}
+		bs = append(bs, b)
+	}
+	return bs, pooled
+}
+
+// decodeRect decodes the pixels of a rectangle top-down, with the buffer
+// borrowed from decompressPool for them if any.  Uncompressed rectangles
+// are flipped in place.
+func (g *RdpClient) decodeRect(v *pdu.BitmapData) (data, pooled []uint8, err error) {
+	data = v.BitmapDataStream
+	Bpp := bpp(v.BitsPerPixel)
+
+	if v.Flags&pdu.BITMAP_NO_PROCESSING != 0 {
+		// Surface command: data is already decoded top-down BGRA
+		return data, nil, nil
+	}
+	if Bpp == 0 {
+		return nil, nil, fmt.Errorf("%w: %d bits per pixel", core.ErrBitmapDecompress, v.BitsPerPixel)
+	}
+	if v.IsCompress() {
+		buf := g.decompressPool.Get().([]uint8)
+		start := time.Now()
+		buf, err = core.DecompressIntoChecked(v.BitmapDataStream, buf, int(v.Width), int(v.Height), Bpp)
+		g.stats.decodeTime.Add(int64(time.Since(start)))
+		return buf, buf, err
+	}
+	// Uncompressed bitmaps are bottom-up; flip to top-down.
+	stride := int(v.Width) * Bpp
+	h := int(v.Height)
+	if len(data) < stride*h {
+		return nil, nil, fmt.Errorf("%w: %d bytes for an uncompressed %dx%d bitmap",
+			core.ErrBitmapDecompress, len(data), v.Width, v.Height)
+	}
+	tmp := g.flipLinePool.Get().([]byte)
+	if cap(tmp) < stride {
+		tmp = make([]byte, stride)
+	} else {
+		tmp = tmp[:stride]
+	}
+	for y := 0; y < h/2; y++ {
+		top := y * stride
+		bot := (h - 1 - y) * stride
+		copy(tmp, data[top:top+stride])
+		copy(data[top:top+stride], data[bot:bot+stride])
+		copy(data[bot:bot+stride], tmp)
+	}
+	g.flipLinePool.Put(tmp[:cap(tmp)])
+	return data, nil, nil
+}
+
+// directScreen is an internal screen the rectangles of an update are
+// decoded straight into, locked with mu while they are.
+type directScreen struct {
+	mu  *sync.Mutex
+	img *image.RGBA
+}
+
+// directTarget returns, locked, the screen the rectangles can be decoded
+// straight into: the GDI screen, or the framebuffer without one, which
+// then copies them from it.  It returns nil when an OnBitmap callback
+// needs Bitmap.Data or a rectangle is not 32 bpp; the other depths are
+// interleaved RLE, whose decoder reads back the previous scanline in the
+// native format.
+func (g *RdpClient) directTarget(rectangles []pdu.BitmapData) *directScreen {
+	if g.onBitmapPaintFn != nil || len(rectangles) == 0 {
+		return nil
+	}
+	for i := range rectangles {
+		if bpp(rectangles[i].BitsPerPixel) != 4 {
+			return nil
+		}
+	}
+	switch {
+	case g.gdi != nil:
+		g.gdi.mu.Lock()
+		return &directScreen{&g.gdi.mu, g.gdi.screen}
+	case g.fb != nil:
+		g.fb.mu.Lock()
+		return &directScreen{&g.fb.mu, g.fb.img}
+	}
+	return nil
+}
+
+// decodeDirect decodes a 32 bpp rectangle straight into dst at its Dest
+// rectangle: planar bitmaps with core.DecompressPlanarInto, uncompressed
+// and surface command BGRA rows converted into the stride of dst.
+func (g *RdpClient) decodeDirect(v *pdu.BitmapData, dst *image.RGBA) error {
+	dest := image.Rect(int(v.DestLeft), int(v.DestTop), int(v.DestRight)+1, int(v.DestBottom)+1)
+	sub := dst.SubImage(dest).(*image.RGBA)
+	w, h := int(v.Width), int(v.Height)
+	surface := v.Flags&pdu.BITMAP_NO_PROCESSING != 0
+	if !surface && v.IsCompress() {
+		start := time.Now()
+		_, err := core.DecompressPlanarInto(v.BitmapDataStream, sub, dest.Min, w, h, true)
+		g.stats.decodeTime.Add(int64(time.Since(start)))
+		return err
+	}
+	if len(v.BitmapDataStream) < w*h*4 {
+		return fmt.Errorf("%w: %d bytes for a %dx%d bitmap",
+			core.ErrBitmapDecompress, len(v.BitmapDataStream), v.Width, v.Height)
+	}
+	// Uncompressed bitmaps are bottom-up, surface command data top-down.
+	r := image.Rectangle{dest.Min, dest.Min.Add(image.Pt(w, h))}.Intersect(sub.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := y - dest.Min.Y
+		if !surface {
+			row = h - 1 - row
+		}
+		src := (row*w + r.Min.X - dest.Min.X) * 4
+		i := sub.PixOffset(r.Min.X, y)
+		bgr32BatchToRGBA(sub.Pix[i:i+r.Dx()*4], v.BitmapDataStream[src:], r.Dx())
+	}
+	return nil
+}
+
+// overlapping reports whether Dest rectangles of rectangles intersect, so
+// that decoding them in parallel straight into a screen could paint them
+// out of order.
+func overlapping(rectangles []pdu.BitmapData) bool {
+	for i := range rectangles {
+		a := &rectangles[i]
+		ra := image.Rect(int(a.DestLeft), int(a.DestTop), int(a.DestRight)+1, int(a.DestBottom)+1)
+		for j := range rectangles[:i] {
+			b := &rectangles[j]
+			if ra.Overlaps(image.Rect(int(b.DestLeft), int(b.DestTop), int(b.DestRight)+1, int(b.DestBottom)+1)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// paint applies bitmaps to the framebuffer, then hands them to the
+// OnBitmap and OnDamage callbacks.
+func (g *RdpClient) paint(bs []Bitmap) {
+	if g.fb != nil {
+		g.fb.paint(bs)
+	}
+	if g.sessionRec != nil {
+		g.sessionRec.keyframe(g.fb, g.softCursorState())
+	}
+	if g.onBitmapPaintFn != nil {
+		g.onBitmapPaintFn(bs)
+	}
+	if g.onDamageFn != nil && len(bs) > 0 {
+		rects := make([]image.Rectangle, len(bs))
+		for i, bm := range bs {
+			rects[i] = image.Rect(bm.DestLeft, bm.DestTop, bm.DestRight+1, bm.DestBottom+1)
+		}
+		g.onDamageFn(rects)
+	}
 }
 
 func (g *RdpClient) OnPointerHide(f func()) *RdpClient {
 	g.onPointerHideFn = f
 	if g.pdu != nil {
-		g.pdu.On("pointer_hide", f)
+		g.pdu.On("pointer_hide", func() {
+			if !g.softCursor.Load() {
+				f()
+			}
+		})
 	}
 	return g
 }
@@ -798,7 +1953,11 @@ func (g *RdpClient) OnPointerHide(f func()) *RdpClient {
 func (g *RdpClient) OnPointerCached(f func(uint16)) *RdpClient {
 	g.onPointerCachedFn = f
 	if g.pdu != nil {
-		g.pdu.On("pointer_cached", f)
+		g.pdu.On("pointer_cached", func(idx uint16) {
+			if !g.softCursor.Load() {
+				f(idx)
+			}
+		})
 	}
 	return g
 }
@@ -807,55 +1966,10 @@ func (g *RdpClient) OnPointerUpdate(f func(uint16, uint16, uint16, uint16, uint1
 	g.onPointerUpdateFn = f
 	if g.pdu != nil {
 		g.pdu.On("pointer_update", func(p *pdu.FastPathUpdatePointerPDU) {
-			w := int(p.Width)
-			h := int(p.Height)
-
-			// XOR mask data is stored bottom-up per MS-RDPBCGR spec; flip to top-down.
-			// Stride is padded to a 2-byte boundary.
-			var xorData []byte
-			if len(p.Data) > 0 && h > 0 && w > 0 {
-				xorBpp := int(p.XorBpp)
-				if xorBpp == 0 {
-					xorBpp = 1
-				}
-				xorStride := ((w*xorBpp + 15) / 16) * 2
-				xorData = make([]byte, len(p.Data))
-				copy(xorData, p.Data)
-				tmp := make([]byte, xorStride)
-				for y := 0; y < h/2; y++ {
-					top := y * xorStride
-					bot := (h - 1 - y) * xorStride
-					if top+xorStride <= len(xorData) && bot+xorStride <= len(xorData) {
-						copy(tmp, xorData[top:top+xorStride])
-						copy(xorData[top:top+xorStride], xorData[bot:bot+xorStride])
-						copy(xorData[bot:bot+xorStride], tmp)
-					}
-				}
-			} else {
-				xorData = p.Data
-			}
-
-			// AND mask data is also bottom-up; flip to top-down.
-			// Stride is 1-bpp padded to a 2-byte boundary.
-			var andMask []byte
-			if len(p.Mask) > 0 && h > 0 && w > 0 {
-				andStride := ((w + 15) / 16) * 2
-				andMask = make([]byte, len(p.Mask))
-				copy(andMask, p.Mask)
-				tmp := make([]byte, andStride)
-				for y := 0; y < h/2; y++ {
-					top := y * andStride
-					bot := (h - 1 - y) * andStride
-					if top+andStride <= len(andMask) && bot+andStride <= len(andMask) {
-						copy(tmp, andMask[top:top+andStride])
-						copy(andMask[top:top+andStride], andMask[bot:bot+andStride])
-						copy(andMask[bot:bot+andStride], tmp)
-					}
-				}
-			} else {
-				andMask = p.Mask
+			if g.softCursor.Load() {
+				return
 			}
-
+			andMask, xorData := flipPointerMasks(p)
 			f(p.CacheIdx, p.XorBpp, p.X, p.Y, p.Width, p.Height, andMask, xorData)
 		})
 	}
@@ -863,13 +1977,37 @@ func (g *RdpClient) OnPointerUpdate(f func(uint16, uint16, uint16, uint16, uint1
 }
 
 // OnAudio registers a callback for server audio data.
-// The callback receives the AudioFormat describing the PCM data and the raw audio bytes.
+// The callback receives the AudioFormat describing the data and the audio
+// bytes: PCM, or the compressed wave of a passthrough format (by default
+// AAC, see SetAudioPassthrough).
 // Must be called before Login.
 func (g *RdpClient) OnAudio(f func(rdpsnd.AudioFormat, []byte)) *RdpClient {
 	g.onAudioFn = f
 	return g
 }
 
+// SetAudioDecoder offers the server the audio formats of tag, such as
+// rdpsnd.WAVE_FORMAT_AAC, and decodes them to PCM with decoders from f
+// before OnAudio sees them; nil stops offering them.  MS-ADPCM is decoded
+// by default; on macOS, aac.New can be wrapped to decode AAC.
+// Must be called before Login.
+func (g *RdpClient) SetAudioDecoder(tag uint16, f rdpsnd.NewDecoderFunc) *RdpClient {
+	if g.audioDecoders == nil {
+		g.audioDecoders = make(map[uint16]rdpsnd.NewDecoderFunc)
+	}
+	g.audioDecoders[tag] = f
+	return g
+}
+
+// SetAudioPassthrough offers the server the audio formats of tags and
+// hands their waves to OnAudio compressed, as received, for a media
+// pipeline that decodes them itself.  It replaces the default, AAC.
+// Must be called before Login.
+func (g *RdpClient) SetAudioPassthrough(tags ...uint16) *RdpClient {
+	g.audioPassthrough = &tags
+	return g
+}
+
 // OnAudioReset registers a callback that is called when the server closes the
 // audio channel (e.g. media seek or stream restart). The application should
 // flush its audio playback buffer so that stale audio does not keep playing.
@@ -888,6 +2026,18 @@ func (g *RdpClient) OnH264Raw(fn func(destX, destY, w, h int, isKey bool, data [
 	return g
 }
 
+// OnH264NAL registers a callback that receives the AVC420 (H.264) frames
+// of the graphics pipeline undecoded: the Annex B NAL units with the
+// destination rectangle and the changed regions.  It is meant for
+// applications that decode in hardware.  While set, grdp does not decode
+// H.264 itself and only negotiates AVC420, so these frames are not
+// delivered via OnBitmap, OnH264I420 or OnH264NV12.  Register it before
+// Login.
+func (g *RdpClient) OnH264NAL(fn func(rdpgfx.H264NAL)) *RdpClient {
+	g.onH264NALFn = fn
+	return g
+}
+
 // OnH264I420 registers a callback that receives decoded H.264 frames in I420
 // planar format (Y, U, V planes with associated strides).  When set, the
 // decoded frame is NOT delivered via OnBitmap; the caller is responsible for
@@ -905,6 +2055,29 @@ func (g *RdpClient) OnH264I420(fn func(destX, destY, w, h int, y []byte, yStride
 	return g
 }
 
+// OnFrame registers a callback that receives the desktop composited by
+// the graphics pipeline (RDPGFX) at the end of each frame, together with
+// the area that changed.  img is reused for the next frame; copy it to
+// keep it.  Frames are only produced when the server uses RDPGFX, and do
+// not include H.264 frames delivered to OnH264I420 or OnH264NV12.
+func (g *RdpClient) OnFrame(fn func(frameID uint32, img *image.RGBA, damage image.Rectangle)) *RdpClient {
+	g.onFrameFn = fn
+	if g.gfxHandler != nil {
+		g.gfxHandler.SetFrameCallback(g.frameCallback())
+	}
+	return g
+}
+
+func (g *RdpClient) frameCallback() func(rdpgfx.Frame) {
+	fn := g.onFrameFn
+	if fn == nil {
+		return nil
+	}
+	return func(f rdpgfx.Frame) {
+		fn(f.ID, f.Image, f.Damage)
+	}
+}
+
 // OnH264NV12 registers a callback that receives decoded H.264 frames in NV12
 // format (Y plane plus interleaved UV plane).  This is the fastest SDL2 path
 // on platforms whose hardware decoder already outputs NV12 (notably macOS
@@ -933,6 +2106,44 @@ func (g *RdpClient) OnDecoderBroken(f func()) *RdpClient {
 	return g
 }
 
+// OnLogon registers f to be called when the server reports that the user
+// logged on to sessionId.  The user name and domain are empty when the
+// server sends a plain notification.
+func (g *RdpClient) OnLogon(f func(sessionId uint32, username, domain string)) *RdpClient {
+	g.onLogonFn = f
+	if g.pdu != nil {
+		g.pdu.On("logon", f)
+	}
+	return g
+}
+
+// OnLogonError registers f to be called with the pdu.LOGON_FAILED_* or
+// pdu.LOGON_MSG_* code of each logon error or status the server reports,
+// e.g. LOGON_FAILED_BAD_PASSWORD when the user must log on interactively.
+func (g *RdpClient) OnLogonError(f func(code uint32)) *RdpClient {
+	g.onLogonErrorFn = f
+	if g.pdu != nil {
+		g.pdu.On("logonError", func(code, data uint32) {
+			f(code)
+		})
+	}
+	return g
+}
+
+// OnKeyboardIndicators registers f to be called when the server sets the
+// keyboard LEDs with a Set Keyboard Indicators PDU, for example after a
+// remote application toggled Caps Lock.
+func (g *RdpClient) OnKeyboardIndicators(f func(numLock, capsLock, scrollLock, kanaLock bool)) *RdpClient {
+	g.onKbdIndicatorsFn = f
+	if g.pdu != nil {
+		g.pdu.On("keyboardIndicators", func(leds uint16) {
+			f(leds&pdu.TS_SYNC_NUM_LOCK != 0, leds&pdu.TS_SYNC_CAPS_LOCK != 0,
+				leds&pdu.TS_SYNC_SCROLL_LOCK != 0, leds&pdu.TS_SYNC_KANA_LOCK != 0)
+		})
+	}
+	return g
+}
+
 // OnClipboard registers callbacks for bidirectional clipboard sharing.
 //
 //   - onRemote is called with the text when the RDP server's clipboard
@@ -956,39 +2167,88 @@ func (g *RdpClient) NotifyClipboardChanged() {
 	}
 }
 
+// SetClipboard makes c the local clipboard content and announces its
+// formats to the server, which asks for the data when it pastes.  It
+// replaces the getLocal callback of OnClipboard, and may be called
+// before Login or while connected.
+func (g *RdpClient) SetClipboard(c cliprdr.Content) {
+	g.clipboard = &c
+	if g.cliprdrHandler != nil {
+		g.cliprdrHandler.SetClipboard(c)
+	}
+}
+
+// OnRemoteClipboard registers a callback called each time the server
+// clipboard changes.  f runs on a goroutine of its own and may fetch
+// the formats it wants from rc; rc is invalid once the server clipboard
+// changes again.
+func (g *RdpClient) OnRemoteClipboard(f func(rc *cliprdr.RemoteClipboard)) *RdpClient {
+	g.onRemoteClipboardFn = f
+	return g
+}
+
 func (g *RdpClient) notifyGfxLocalInput() {
 	if gfx := g.gfxHandler; gfx != nil {
 		gfx.NotifyLocalInput()
 	}
 }
 
-func (g *RdpClient) KeyUp(sc int) {
+// SyncToggleKeys sets the remote lock keys with a Synchronize Input Event.
+// The state is kept and sent again after every activation, so the remote
+// lock state keeps matching the local keyboard across reconnects and
+// reactivations; it starts with all locks off.
+func (g *RdpClient) SyncToggleKeys(numLock, capsLock, scrollLock, kanaLock bool) {
+	var flags uint32
+	for _, f := range []struct {
+		on   bool
+		flag uint32
+	}{
+		{numLock, pdu.TS_SYNC_NUM_LOCK},
+		{capsLock, pdu.TS_SYNC_CAPS_LOCK},
+		{scrollLock, pdu.TS_SYNC_SCROLL_LOCK},
+		{kanaLock, pdu.TS_SYNC_KANA_LOCK},
+	} {
+		if f.on {
+			flags |= f.flag
+		}
+	}
+	g.toggleKeys.Store(flags)
 	if !g.eventReady.Load() {
 		return
 	}
-	slog.Debug("KeyUp", "sc", sc)
+	g.log.Debug("SyncToggleKeys", "flags", flags)
 	g.flushMouseMove()
 	g.flushWheel()
+	g.pdu.SendSynchronizeEvent(flags)
+}
 
-	p := &pdu.ScancodeKeyEvent{}
-	p.KeyCode = uint16(sc)
-	p.KeyboardFlags |= pdu.KBDFLAGS_RELEASE
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_SCANCODE, []pdu.InputEventsInterface{p})
-	g.notifyGfxLocalInput()
+// KeyUp releases the key sc.
+func (g *RdpClient) KeyUp(sc Scancode) {
+	if !g.eventReady.Load() {
+		return
+	}
+	g.log.Debug("KeyUp")
+	g.recordInput(InputEvent{Kind: InputKeyUp, Scancode: int(sc)})
+	g.sendKey(sc, true)
 }
 
-func (g *RdpClient) KeyDown(sc int) {
+// KeyDown presses the key sc.
+func (g *RdpClient) KeyDown(sc Scancode) {
 	if !g.eventReady.Load() {
 		return
 	}
-	slog.Debug("KeyDown", "sc", sc)
+	g.log.Debug("KeyDown")
+	g.recordInput(InputEvent{Kind: InputKeyDown, Scancode: int(sc)})
+	g.sendKey(sc, false)
+}
+
+func (g *RdpClient) sendKey(sc Scancode, release bool) {
 	g.flushMouseMove()
 	g.flushWheel()
-
-	p := &pdu.ScancodeKeyEvent{}
-	p.KeyCode = uint16(sc)
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_SCANCODE, []pdu.InputEventsInterface{p})
-	g.notifyGfxLocalInput()
+	if events := sc.keyEvents(release); len(events) > 0 {
+		g.pdu.SendInputEvents(pdu.INPUT_EVENT_SCANCODE, events)
+		g.notifyGfxLocalInput()
+	}
 }
 
 // MouseMove queues a mouse-move event.  Successive moves within
@@ -999,6 +2259,8 @@ func (g *RdpClient) MouseMove(x, y int) {
 	if !g.eventReady.Load() {
 		return
 	}
+	g.recordInput(InputEvent{Kind: InputMouseMove, X: x, Y: y})
+	g.cursor.move(x, y)
 
 	g.mouse.mu.Lock()
 	g.mouse.x = x
@@ -1067,66 +2329,96 @@ func (g *RdpClient) MouseWheel(delta float64) {
 	if !g.eventReady.Load() {
 		return
 	}
-	slog.Debug("MouseWheel", "delta", delta)
+	g.log.Debug("MouseWheel", "delta", delta)
+	g.recordInput(InputEvent{Kind: InputMouseWheel, Delta: delta})
 	g.flushMouseMove()
+	g.flushScroll(&g.hwheel)
+	g.scroll(&g.wheel, delta)
+}
 
+// MouseWheelH sends a horizontal scroll event, delta notches as for
+// MouseWheel; positive values scroll right.  It is dropped when the
+// server does not advertise INPUT_FLAG_MOUSE_HWHEEL.
+func (g *RdpClient) MouseWheelH(delta float64) {
+	if !g.eventReady.Load() {
+		return
+	}
+	if g.pdu.ServerInputFlags()&pdu.INPUT_FLAG_MOUSE_HWHEEL == 0 {
+		g.log.Debug("MouseWheelH: server does not support horizontal wheel")
+		return
+	}
+	g.log.Debug("MouseWheelH", "delta", delta)
+	g.recordInput(InputEvent{Kind: InputMouseWheelH, Delta: delta})
+	g.flushMouseMove()
+	g.flushScroll(&g.wheel)
+	g.scroll(&g.hwheel, delta)
+}
+
+// scroll adds delta notches to w and sends them once the coalescing
+// interval has passed.
+func (g *RdpClient) scroll(w *wheelCoalescer, delta float64) {
 	// Convert notch count to RDP WHEEL_DELTA units (120 per notch).
 	const wheelDelta = 120
-	g.wheel.mu.Lock()
-	g.wheel.accum += delta * wheelDelta
-	if g.wheel.accum == 0 {
+	w.mu.Lock()
+	w.accum += delta * wheelDelta
+	if w.accum == 0 {
 		// Opposite deltas cancelled out; nothing to send.
-		g.wheel.mu.Unlock()
+		w.mu.Unlock()
 		return
 	}
 
 	now := time.Now()
-	since := now.Sub(g.wheel.lastTx)
+	since := now.Sub(w.lastTx)
 	if since >= mouseCoalesceInterval {
-		g.sendWheelLocked(now)
-		g.wheel.mu.Unlock()
+		g.sendWheelLocked(w, now)
+		w.mu.Unlock()
 		return
 	}
 
-	if g.wheel.timer == nil {
+	if w.timer == nil {
 		delay := mouseCoalesceInterval - since
-		g.wheel.timer = time.AfterFunc(delay, g.flushWheelTimer)
+		w.timer = time.AfterFunc(delay, func() { g.flushWheelTimer(w) })
 	}
-	g.wheel.mu.Unlock()
+	w.mu.Unlock()
 }
 
-// flushWheel sends any pending wheel event synchronously.  Called before any
-// non-wheel input event to preserve server-side ordering.
+// flushWheel sends any pending wheel events synchronously.  Called before
+// any non-wheel input event to preserve server-side ordering.
 func (g *RdpClient) flushWheel() {
-	g.wheel.mu.Lock()
-	if g.wheel.timer != nil {
-		g.wheel.timer.Stop()
-		g.wheel.timer = nil
+	g.flushScroll(&g.wheel)
+	g.flushScroll(&g.hwheel)
+}
+
+func (g *RdpClient) flushScroll(w *wheelCoalescer) {
+	w.mu.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
 	}
-	if g.wheel.accum != 0 {
-		g.sendWheelLocked(time.Now())
+	if w.accum != 0 {
+		g.sendWheelLocked(w, time.Now())
 	}
-	g.wheel.mu.Unlock()
+	w.mu.Unlock()
 }
 
 // flushWheelTimer is the time.AfterFunc callback for wheel coalescing.
-func (g *RdpClient) flushWheelTimer() {
-	g.wheel.mu.Lock()
-	g.wheel.timer = nil
-	if g.wheel.accum != 0 && g.eventReady.Load() {
-		g.sendWheelLocked(time.Now())
+func (g *RdpClient) flushWheelTimer(w *wheelCoalescer) {
+	w.mu.Lock()
+	w.timer = nil
+	if w.accum != 0 && g.eventReady.Load() {
+		g.sendWheelLocked(w, time.Now())
 	}
-	g.wheel.mu.Unlock()
+	w.mu.Unlock()
 }
 
-// sendWheelLocked must be called with wheel.mu held.
+// sendWheelLocked must be called with w.mu held.
 // Modelled on FreeRDP's send_mouse_wheel in client/SDL/SDL2/sdl_touch.cpp.
-func (g *RdpClient) sendWheelLocked(now time.Time) {
+func (g *RdpClient) sendWheelLocked(w *wheelCoalescer, now time.Time) {
 	// Truncate the accumulated float to a whole WHEEL_DELTA integer; keep the
 	// fractional remainder so sub-notch trackpad movements aren't discarded.
-	iaccum := int(g.wheel.accum)
-	g.wheel.accum -= float64(iaccum)
-	g.wheel.lastTx = now
+	iaccum := int(w.accum)
+	w.accum -= float64(iaccum)
+	w.lastTx = now
 
 	if iaccum == 0 {
 		return
@@ -1137,7 +2429,7 @@ func (g *RdpClient) sendWheelLocked(now time.Time) {
 		iaccum = -iaccum
 	}
 
-	baseFlags := uint16(pdu.PTRFLAGS_WHEEL)
+	baseFlags := w.flag
 	if negative {
 		baseFlags |= uint16(pdu.PTRFLAGS_WHEEL_NEGATIVE)
 	}
@@ -1154,11 +2446,11 @@ func (g *RdpClient) sendWheelLocked(now time.Time) {
 		if negative {
 			// 9-bit two's complement: keep flags in bits 8–15, set bits 0–7
 			// to (0x100 - cval) so the receiver recovers the correct magnitude.
-			g.wheel.pdu.PointerFlags = (baseFlags & 0xFF00) | uint16(0x100-cval)
+			w.pdu.PointerFlags = (baseFlags & 0xFF00) | uint16(0x100-cval)
 		} else {
-			g.wheel.pdu.PointerFlags = baseFlags | uint16(cval)
+			w.pdu.PointerFlags = baseFlags | uint16(cval)
 		}
-		g.pdu.SendInputEvents(pdu.INPUT_EVENT_MOUSE, g.wheel.pduBuf[:])
+		g.pdu.SendInputEvents(pdu.INPUT_EVENT_MOUSE, w.pduBuf[:])
 	}
 	g.notifyGfxLocalInput()
 }
@@ -1167,42 +2459,64 @@ func (g *RdpClient) MouseUp(button int, x, y int) {
 	if !g.eventReady.Load() {
 		return
 	}
-	slog.Debug("MouseUp", "x", x, "y", y, "button", button)
+	g.log.Debug("MouseUp", "x", x, "y", y, "button", button)
+	g.recordInput(InputEvent{Kind: InputMouseUp, Button: button, X: x, Y: y})
 	g.flushMouseMove()
 	g.flushWheel()
-	p := &pdu.PointerEvent{}
-	p.PointerFlags = mouseButtonFlag(button)
-	p.XPos = uint16(x)
-	p.YPos = uint16(y)
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_MOUSE, []pdu.InputEventsInterface{p})
-	g.notifyGfxLocalInput()
+	g.sendMouseButton(button, false, x, y)
 }
 
+// MouseDown presses button at (x, y): 0 is the left button, 1 the
+// middle, 2 the right, and 3 and 4 the fourth and fifth buttons.
 func (g *RdpClient) MouseDown(button int, x, y int) {
 	if !g.eventReady.Load() {
 		return
 	}
-	slog.Debug("MouseDown", "x", x, "y", y, "button", button)
+	g.log.Debug("MouseDown", "x", x, "y", y, "button", button)
+	g.recordInput(InputEvent{Kind: InputMouseDown, Button: button, X: x, Y: y})
 	g.flushMouseMove()
 	g.flushWheel()
-	p := &pdu.PointerEvent{}
-	p.PointerFlags = pdu.PTRFLAGS_DOWN | mouseButtonFlag(button)
-	p.XPos = uint16(x)
-	p.YPos = uint16(y)
-	g.pdu.SendInputEvents(pdu.INPUT_EVENT_MOUSE, []pdu.InputEventsInterface{p})
+	g.sendMouseButton(button, true, x, y)
+}
+
+// sendMouseButton sends a button press or release.  Buttons 3 and 4, the
+// fourth and fifth mouse buttons, need the Extended Mouse Event and are
+// dropped when the server does not advertise INPUT_FLAG_MOUSEX.
+func (g *RdpClient) sendMouseButton(button int, down bool, x, y int) {
+	var ev pdu.InputEventsInterface
+	msgType := uint16(pdu.INPUT_EVENT_MOUSE)
+	if flag, ok := mouseXButtonFlag(button); ok {
+		if g.pdu.ServerInputFlags()&pdu.INPUT_FLAG_MOUSEX == 0 {
+			g.log.Debug("sendMouseButton: server does not support extended buttons", "button", button)
+			return
+		}
+		if down {
+			flag |= pdu.PTRXFLAGS_DOWN
+		}
+		ev = &pdu.ExtendedMouseEvent{PointerFlags: flag, XPos: uint16(x), YPos: uint16(y)}
+		msgType = pdu.INPUT_EVENT_MOUSEX
+	} else {
+		flag := mouseButtonFlag(button)
+		if down {
+			flag |= pdu.PTRFLAGS_DOWN
+		}
+		ev = &pdu.PointerEvent{PointerFlags: flag, XPos: uint16(x), YPos: uint16(y)}
+	}
+	g.pdu.SendInputEvents(msgType, []pdu.InputEventsInterface{ev})
 	g.notifyGfxLocalInput()
 }
 
 // SetResolution requests a desktop resolution change via the MS-RDPEDISP
 // Display Update Virtual Channel.  The server will reshape the desktop to the
-// given dimensions and send a fresh RDPGFX ResetGraphics command.
+// given dimensions and send a fresh RDPGFX ResetGraphics command.  The
+// scale factors of WithScaleFactor are sent along.
 //
 // width must be even and both width and height must be >= 200.
 // This method is a no-op when the RDPEDISP channel has not been established
 // (e.g. when the server does not support it).
 func (g *RdpClient) SetResolution(width, height int) {
 	if g.dispHandler == nil {
-		slog.Warn("SetResolution: RDPEDISP channel not available")
+		g.log.Warn("SetResolution: RDPEDISP channel not available")
 		return
 	}
 	w := uint32(width)
@@ -1212,6 +2526,7 @@ func (g *RdpClient) SetResolution(width, height int) {
 	w = max(w, 200)
 	h := uint32(height)
 	h = max(h, 200)
+	desktopScale, deviceScale := g.monitorScale(Monitor{})
 	g.dispHandler.SendMonitorLayout([]rdpedisp.Monitor{
 		{
 			Flags:              rdpedisp.MonitorFlagPrimary,
@@ -1222,11 +2537,91 @@ func (g *RdpClient) SetResolution(width, height int) {
 			PhysicalWidth:      0,
 			PhysicalHeight:     0,
 			Orientation:        0,
-			DesktopScaleFactor: 100,
-			DeviceScaleFactor:  100,
+			DesktopScaleFactor: desktopScale,
+			DeviceScaleFactor:  deviceScale,
 		},
 	})
-	slog.Debug("SetResolution", "width", w, "height", h)
+	g.log.Debug("SetResolution", "width", w, "height", h)
+}
+
+// Resize asks the server to change the desktop to width x height pixels
+// at scaleFactor percent (100 to 500) over the MS-RDPEDISP Display Update
+// Virtual Channel, without reconnecting.  An odd width is rounded down.
+// It returns an error when the channel is not open or the server cannot
+// show the size.
+//
+// The server applies the new size either with an RDPGFX ResetGraphics
+// command or by deactivating and reactivating the session, during which
+// input is dropped; either way OnResize reports the size it chose, which
+// the bitmaps that follow use.
+func (g *RdpClient) Resize(width, height, scaleFactor int) error {
+	if g.dispHandler == nil {
+		return rdpedisp.ErrNotOpen
+	}
+	if width < 0 || height < 0 || scaleFactor < 0 {
+		return fmt.Errorf("resize %dx%d at %d%%: negative value", width, height, scaleFactor)
+	}
+	if err := g.dispHandler.Resize(uint32(width), uint32(height), uint32(scaleFactor)); err != nil {
+		return err
+	}
+	g.log.Debug("Resize", "width", width, "height", height, "scale", scaleFactor)
+	return nil
+}
+
+// OnResize registers a callback for the changes of the desktop size the
+// server makes, after a Resize or on its own.  It is called on the
+// connection's reader goroutine, or on the RDPGFX decode goroutine for a
+// graphics pipeline session, before the first bitmap of the new size.
+func (g *RdpClient) OnResize(f func(width, height int)) *RdpClient {
+	g.onResizeFn = f
+	return g
+}
+
+// ColorDepth returns the colour depth in bits per pixel negotiated for the
+// current session, or 0 before the session is active.  RDPGFX sessions
+// always render at 32 bpp regardless of this value.
+func (g *RdpClient) ColorDepth() int {
+	if g.pdu == nil {
+		return 0
+	}
+	return int(g.pdu.ColorDepth())
+}
+
+// CompressionType returns the name of the bulk compressor the server
+// compresses the session with, such as "MPPC-64K" or "XCRUSH", or "" while
+// it has sent no compressed PDU.
+func (g *RdpClient) CompressionType() string {
+	if g.pdu == nil || g.pdu.CompressionType() < 0 {
+		return ""
+	}
+	return core.CompressionTypeName(g.pdu.CompressionType())
+}
+
+// RequestColorDepth changes the preferred colour depth to bpp (8, 15, 16,
+// 24 or 32).  The new depth is advertised at the next capability exchange:
+// when the RDPEDISP channel is available the current layout is re-sent so
+// that servers which reactivate on display updates renegotiate without a
+// reconnect; otherwise, or when the server keeps its depth, it takes effect
+// on the next Reconnect.  Compare ColorDepth after OnReady fires to see
+// whether the server accepted it.
+func (g *RdpClient) RequestColorDepth(bpp int) error {
+	switch bpp {
+	case 8, 15, 16, 24, 32:
+	default:
+		return fmt.Errorf("unsupported color depth %d", bpp)
+	}
+	g.colorDepth = bpp
+	if g.mcs != nil {
+		g.mcs.SetClientColorDepth(bpp)
+	}
+	if g.pdu != nil {
+		g.pdu.SetPreferredColorDepth(uint16(bpp))
+	}
+	if g.dispHandler != nil && int(g.pdu.ColorDepth()) != bpp {
+		g.log.Debug("RequestColorDepth: requesting reactivation", "bpp", bpp)
+		g.SetResolution(g.width, g.height)
+	}
+	return nil
 }
 
 // SetQueueDepthHint controls the frame-rate and encoding quality reported to
@@ -1273,7 +2668,7 @@ func (g *RdpClient) Reconnect(width, height int) error {
 	g.reconnecting.Store(true)
 	defer func() { g.reconnecting.Store(false) }()
 
-	slog.Debug("Reconnect", "width", width, "height", height)
+	g.log.Debug("Reconnect", "width", width, "height", height)
 	g.closeTransport()
 	g.width = width
 	g.height = height
@@ -1288,20 +2683,20 @@ func (g *RdpClient) Reconnect(width, height int) error {
 		if attempt > 1 {
 			delay = time.Duration(1<<uint(attempt-2)) * time.Second
 		}
-		slog.Debug("Reconnect: waiting before attempt", "attempt", attempt, "delay", delay)
+		g.log.Debug("Reconnect: waiting before attempt", "attempt", attempt, "delay", delay)
 		time.Sleep(delay)
 
 		err := g.Login(g.domain, g.user, g.password)
 		if err != nil {
-			slog.Warn("Reconnect: login failed", "attempt", attempt, "err", err)
+			g.log.Warn("Reconnect: login failed", "attempt", attempt, "err", err)
 			if attempt < maxRetries {
 				g.closeTransport()
 				continue
 			}
-			return fmt.Errorf("[reconnect err] %v", err)
+			return fmt.Errorf("[reconnect err] %w", err)
 		}
 
-		slog.Debug("Reconnect: succeeded", "attempt", attempt)
+		g.log.Debug("Reconnect: succeeded", "attempt", attempt)
 		return nil
 	}
 
@@ -1321,9 +2716,6 @@ func (g *RdpClient) reregisterCallbacks() {
 	if g.onReadyFn != nil {
 		g.OnReady(g.onReadyFn)
 	}
-	if g.onBitmapPaintFn != nil {
-		g.OnBitmap(g.onBitmapPaintFn)
-	}
 	if g.onPointerHideFn != nil {
 		g.OnPointerHide(g.onPointerHideFn)
 	}
@@ -1339,6 +2731,15 @@ func (g *RdpClient) reregisterCallbacks() {
 	if g.onDecoderBrokenFn != nil {
 		g.OnDecoderBroken(g.onDecoderBrokenFn)
 	}
+	if g.onLogonFn != nil {
+		g.OnLogon(g.onLogonFn)
+	}
+	if g.onLogonErrorFn != nil {
+		g.OnLogonError(g.onLogonErrorFn)
+	}
+	if g.onKbdIndicatorsFn != nil {
+		g.OnKeyboardIndicators(g.onKbdIndicatorsFn)
+	}
 }
 
 // closeTransport closes the underlying transport and stops any active GFX handler.
@@ -1347,13 +2748,101 @@ func (g *RdpClient) closeTransport() {
 		g.gfxHandler.Close()
 		g.gfxHandler = nil
 	}
+	g.closeChannels()
+	if g.rdpdrClient != nil {
+		g.rdpdrClient.Close()
+	}
+	if g.audioInput != nil {
+		g.audioInput.Close()
+	}
 	if g.tpkt != nil {
 		g.tpkt.Close()
 	}
 }
 
+// shutdownTimeout bounds how long Close waits for the server to answer
+// the Shutdown Request PDU.
+const shutdownTimeout = time.Second
+
+// Close disconnects.  An active session is left the way mstsc does: a
+// Shutdown Request PDU, then an MCS Disconnect Provider Ultimatum and an
+// X.224 Disconnect Request once the server has answered, before the TCP
+// connection is closed.  Calls after the first do nothing.
 func (g *RdpClient) Close() {
-	slog.Debug("Close()")
-	g.closed.Store(true)
+	if g.closed.Swap(true) {
+		return
+	}
+	g.log.Debug("Close()")
+	gen := g.state.current()
+	g.state.set(gen, StateClosing, nil)
+	g.disconnect()
 	g.closeTransport()
+	g.state.set(gen, StateClosed, ErrClosed)
+	if g.bitmapCache != nil {
+		if err := g.bitmapCache.SaveFile(g.bitmapCacheFile); err != nil {
+			g.log.Warn("save bitmap cache", "file", g.bitmapCacheFile, "err", err)
+		}
+	}
+	if g.gfxCache != nil {
+		if err := g.gfxCache.SaveFile(g.gfxCacheFile); err != nil {
+			g.log.Warn("save rdpgfx cache", "file", g.gfxCacheFile, "err", err)
+		}
+	}
+	if g.sessionRec != nil {
+		if err := g.sessionRec.w.Close(); err != nil {
+			g.log.Warn("session recording", "err", err)
+		}
+	}
+}
+
+func (g *RdpClient) disconnect() {
+	if g.pdu == nil || !g.eventReady.CompareAndSwap(true, false) {
+		return
+	}
+	g.pdu.SendShutdownRequest()
+	select {
+	case <-g.shutdownDone:
+	case <-time.After(shutdownTimeout):
+		g.log.Debug("disconnect: no answer to Shutdown Request")
+	}
+	g.mcs.SendDisconnectProviderUltimatum(t125.RN_USER_REQUESTED)
+	g.x224.SendDisconnectRequest()
+}
+
+type autoReconnectCookie struct {
+	sessionId uint32
+	random    []byte
+}
+
+// AutoReconnectCookie returns the session ID and ArcRandomBits of the
+// auto-reconnect cookie the server last sent, or false when it sent none.
+func (g *RdpClient) AutoReconnectCookie() (sessionId uint32, random []byte, ok bool) {
+	c := g.arcCookie.Load()
+	if c == nil {
+		return 0, nil, false
+	}
+	return c.sessionId, c.random, true
+}
+
+// ServerError is re-exported from pdu; its Code is one of the
+// pdu.ERRINFO_* constants.
+type ServerError = pdu.ServerError
+
+// DisconnectReason returns the t125.RN_* reason of the Disconnect Provider
+// Ultimatum the server sent on the current connection, or false when it
+// sent none.
+func (g *RdpClient) DisconnectReason() (uint8, bool) {
+	r := g.disconnectReason.Load()
+	if r == 0 {
+		return 0, false
+	}
+	return uint8(r - 1), true
+}
+
+// ServerError returns the reason the server gave in a Set Error Info PDU
+// on the current connection, such as ERRINFO_LOGOFF_BY_USER, or nil.  The
+// same error is passed to OnError, and errors.As finds it in the error
+// returned by Login.
+func (g *RdpClient) ServerError() *ServerError {
+	return g.serverError.Load()
 }
@@ -0,0 +1,403 @@
+package grdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"testing"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/plugin/rdpedisp"
+	"github.com/nakagami/grdp/protocol/pdu"
+	"github.com/nakagami/grdp/protocol/t125/gcc"
+	"github.com/nakagami/grdp/protocol/x224"
+	"github.com/nakagami/grdp/testutil"
+)
+
+// TestConcurrentInput sends input from several goroutines while the
+// reader goroutine paints, then closes the client twice at once; run it
+// with -race.
+func TestConcurrentInput(t *testing.T) {
+	// a fast-path update painting a red 2x1 uncompressed bitmap
+	update := testutil.Hex(`
+		01 1e 00  01 00 01 00
+		00 00 00 00 01 00 00 00 02 00 01 00 20 00 00 00 08 00
+		00 00 ff 00 00 00 ff 00`)
+
+	tr := testutil.NewTransport()
+	g := NewRdpClient("host:3389", 2, 1, nil, WithFramebuffer())
+	g.x224 = x224.New(tr)
+	g.setupSession(tr)
+	core := gcc.NewClientCoreData(0x409, 4, 0)
+	core.DesktopWidth, core.DesktopHeight = 2, 1
+	g.sec.Emit("connect", core, uint16(1007), uint16(1003))
+	g.eventReady.Store(true)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			g.sec.RecvFastPath(0, update)
+		}
+	}()
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 100 {
+				g.KeyDown(Scancode(0x1e))
+				g.MouseMove(i, j)
+				g.MouseWheel(1)
+				g.KeyUp(Scancode(0x1e))
+			}
+		}()
+	}
+	wg.Wait()
+
+	g.shutdownDone <- struct{}{} // the server answers the Shutdown Request
+	var closers sync.WaitGroup
+	for range 2 {
+		closers.Add(1)
+		go func() {
+			defer closers.Done()
+			g.Close()
+		}()
+	}
+	closers.Wait()
+	if len(tr.Frames()) == 0 {
+		t.Error("no input sent")
+	}
+}
+
+// TestDecodeBitmapsOrder decodes an update large enough to be decoded in
+// parallel and checks the bitmaps keep the order of its rectangles.
+func TestDecodeBitmapsOrder(t *testing.T) {
+	g := NewRdpClient("host:3389", 640, 480, nil)
+	var rects []pdu.BitmapData
+	for i := range 3 * parallelBitmapThreshold {
+		r := pdu.BitmapData{DestLeft: uint16(i), Width: 1, Height: 2, BitsPerPixel: 32}
+		switch i % 3 {
+		case 0: // uncompressed, bottom-up
+			r.BitmapDataStream = []byte{byte(i), 0, 0, 0, 0, byte(i), 0, 0}
+		case 1: // RLE: a black pixel and a white one
+			r.Width, r.Height, r.BitsPerPixel = 2, 1, 24
+			r.Flags = pdu.BITMAP_COMPRESSION
+			r.BitmapDataStream = []byte{0xfd, 0xfe}
+		case 2: // corrupt
+			r.Flags = pdu.BITMAP_COMPRESSION
+			r.BitmapDataStream = []byte{0x60}
+		}
+		rects = append(rects, r)
+	}
+	white, _ := core.DecompressIntoChecked([]byte{0xfd, 0xfe}, nil, 2, 1, 3)
+
+	bs, _ := g.decodeBitmaps(pdu.BitmapUpdate{Rectangles: rects})
+	if len(bs) != 2*parallelBitmapThreshold {
+		t.Fatalf("%d bitmaps", len(bs))
+	}
+	for j, b := range bs {
+		i := j/2*3 + j%2
+		want := white
+		if i%3 == 0 {
+			want = []byte{0, byte(i), 0, 0, byte(i), 0, 0, 0}
+		}
+		if b.DestLeft != i || !bytes.Equal(b.Data, want) {
+			t.Errorf("bitmap %d at %d: % x, want % x at %d", j, b.DestLeft, b.Data, want, i)
+		}
+	}
+}
+
+// TestBitmapToRGBAInto checks BitmapToRGBAInto clips as FillRGBA and
+// draw.Draw do, without allocating.
+func TestBitmapToRGBAInto(t *testing.T) {
+	data := make([]byte, 3*2*4)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	for _, bm := range []Bitmap{
+		{Width: 3, Height: 2, BitsPerPixel: 4, Data: data},
+		{Width: 3, Height: 2, BitsPerPixel: 3, Data: data[:18]},
+		{Width: 3, Height: 2, BitsPerPixel: 2, Data: data[:12]},
+		{Width: 3, Height: 2, BitsPerPixel: 1, Data: data[:6], Palette: newPalette(make([]pdu.PaletteEntry, 256))},
+	} {
+		dest := image.Rect(2, 1, 4, 3) // the right column is padding, and (4, 2) off screen
+		want := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		draw.Draw(want, dest, bm.FillRGBA(nil), image.Point{}, draw.Src)
+
+		got := image.NewRGBA(image.Rect(0, 0, 4, 4))
+		sub := got.SubImage(dest).(*image.RGBA)
+		var r image.Rectangle
+		allocs := testing.AllocsPerRun(10, func() { r = bm.BitmapToRGBAInto(sub, dest.Min) })
+		if r != dest || !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("%d bytes a pixel: wrote %v\n% x, want\n% x", bm.BitsPerPixel, r, got.Pix, want.Pix)
+		}
+		if allocs != 0 {
+			t.Errorf("%d bytes a pixel: %v allocations", bm.BitsPerPixel, allocs)
+		}
+	}
+}
+
+// TestDecodeDirect decodes 32 bpp rectangles straight into the screens
+// and checks they paint what decoding through Bitmap.Data paints.
+func TestDecodeDirect(t *testing.T) {
+	update := func() pdu.BitmapUpdate {
+		return pdu.BitmapUpdate{Rectangles: []pdu.BitmapData{
+			// Uncompressed, bottom-up, 3 wide with a padding column.
+			{DestLeft: 0, DestTop: 0, DestRight: 1, DestBottom: 1, Width: 3, Height: 2, BitsPerPixel: 32,
+				BitmapDataStream: []byte{
+					0xff, 0, 0, 0, 0xff, 0, 0, 0, 1, 1, 1, 0,
+					0, 0, 0xff, 0, 0, 0xff, 0, 0, 1, 1, 1, 0}},
+			// Planar with raw planes, red then green, past the right edge.
+			{DestLeft: 2, DestTop: 0, DestRight: 4, DestBottom: 0, Width: 3, Height: 1, BitsPerPixel: 32,
+				Flags: pdu.BITMAP_COMPRESSION, BitmapDataStream: []byte{core.PLANAR_FORMAT_HEADER_NA,
+					0xff, 0, 9, 0, 0xff, 9, 0, 0, 9}},
+			// Surface command data, top-down.
+			{DestLeft: 3, DestTop: 1, DestRight: 3, DestBottom: 1, Width: 1, Height: 1, BitsPerPixel: 32,
+				Flags: pdu.BITMAP_NO_PROCESSING, BitmapDataStream: []byte{0xff, 0xff, 0xff, 0xff}},
+		}}
+	}
+	paint := func(g *RdpClient) []Bitmap {
+		bs, _ := g.decodeBitmaps(update())
+		if g.gdi != nil {
+			g.gdi.paint(bs)
+		}
+		g.paint(bs)
+		return bs
+	}
+
+	g, _ := newSession(4, 2, WithFramebuffer())
+	g.OnBitmap(func([]Bitmap) {})
+	bs := paint(g)
+	if bs[0].Data == nil || bs[0].src != nil {
+		t.Fatal("rectangles decoded straight into the screen for OnBitmap")
+	}
+	want := g.Snapshot()
+
+	for _, opts := range [][]Option{{WithFramebuffer()}, {WithFramebuffer(), WithDrawingOrders(false)}} {
+		g, _ = newSession(4, 2, opts...)
+		bs = paint(g)
+		if len(bs) != 3 || bs[0].Data != nil || bs[0].src == nil {
+			t.Fatalf("%d bitmaps, not decoded straight into the screen", len(bs))
+		}
+		if got := g.Snapshot(); !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("drawing orders %v: screen\n% x, want\n% x", g.gdi != nil, got.Pix, want.Pix)
+		}
+		if g.gdi != nil && !bytes.Equal(g.gdi.screen.Pix, want.Pix) {
+			t.Errorf("GDI screen\n% x, want\n% x", g.gdi.screen.Pix, want.Pix)
+		}
+	}
+	for _, p := range []struct {
+		x, y int
+		c    color.RGBA
+	}{
+		{0, 0, color.RGBA{0xff, 0, 0, 0xff}},
+		{0, 1, color.RGBA{0, 0, 0xff, 0xff}},
+		{2, 0, color.RGBA{0xff, 0, 0, 0xff}},
+		{3, 0, color.RGBA{0, 0xff, 0, 0xff}},
+		{3, 1, color.RGBA{0xff, 0xff, 0xff, 0xff}},
+	} {
+		if c := want.RGBAAt(p.x, p.y); c != p.c {
+			t.Errorf("pixel %d,%d = %v, want %v", p.x, p.y, c, p.c)
+		}
+	}
+}
+
+// TestRoutingToken stores routing tokens from redirections while other
+// goroutines read and set them; run it with -race.
+func TestRoutingToken(t *testing.T) {
+	g := NewRdpClient("host:3389", 640, 480, nil)
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Go(func() {
+			for range 100 {
+				g.SetRoutingToken([]byte("Cookie: msts=1"))
+				g.RoutingToken()
+			}
+		})
+	}
+	info := []byte("Cookie: msts=2")
+	for range 100 {
+		g.recordRedirect(&pdu.ServerRedirectionPDU{LoadBalanceInfo: info})
+	}
+	wg.Wait()
+
+	g.recordRedirect(&pdu.ServerRedirectionPDU{LoadBalanceInfo: info})
+	info[len(info)-1] = '3'
+	if got := string(g.RoutingToken()); got != "Cookie: msts=2" {
+		t.Errorf("routing token %q", got)
+	}
+	if g.SetRoutingToken(nil).RoutingToken() != nil {
+		t.Error("token not cleared")
+	}
+}
+
+// newSession returns a client connected on a test transport.
+func newSession(width, height int, opts ...Option) (*RdpClient, *testutil.Transport) {
+	g := NewRdpClient("host:3389", width, height, nil, opts...)
+	return g, connect(g)
+}
+
+// connect sets up the layers of g above x224 on a test transport, as if
+// the MCS connection had just been established, and returns it.
+func connect(g *RdpClient) *testutil.Transport {
+	tr := testutil.NewTransport()
+	g.x224 = x224.New(tr)
+	g.setupSession(tr)
+	data := gcc.NewClientCoreData(0x409, 4, 0)
+	data.DesktopWidth, data.DesktopHeight = uint16(g.width), uint16(g.height)
+	g.sec.Emit("connect", data, uint16(1007), uint16(1003))
+	return tr
+}
+
+// slowPath frames msg in a share control header, as the sec layer hands
+// slow-path PDUs to the PDU layer.
+func slowPath(msg pdu.PDUMessage) []byte {
+	b := msg.Serialize()
+	h := binary.LittleEndian.AppendUint16(nil, uint16(6+len(b)))
+	h = binary.LittleEndian.AppendUint16(h, msg.Type())
+	h = binary.LittleEndian.AppendUint16(h, 1002)
+	return append(h, b...)
+}
+
+// activate plays the server side of a capability exchange and connection
+// finalization announcing a session of bpp bits per pixel.
+func activate(g *RdpClient, bpp int) {
+	g.sec.Emit("data", slowPath(&pdu.DemandActivePDU{
+		SharedId:               0x103ea,
+		LengthSourceDescriptor: 4,
+		SourceDescriptor:       []byte("RDP\x00"),
+		CapabilitySets: []pdu.Capability{&pdu.BitmapCapability{
+			PreferredBitsPerPixel: gcc.HighColor(bpp),
+			DesktopWidth:          uint16(g.width),
+			DesktopHeight:         uint16(g.height),
+		}},
+	}))
+	for _, d := range []pdu.DataPDUData{
+		pdu.NewSynchronizeDataPDU(1007),
+		&pdu.ControlDataPDU{Action: pdu.CTRLACTION_COOPERATE},
+		&pdu.ControlDataPDU{Action: pdu.CTRLACTION_GRANTED_CONTROL},
+		&pdu.FontMapDataPDU{MapFlags: 0x0003, EntrySize: 0x0004},
+	} {
+		g.sec.Emit("data", slowPath(pdu.NewDataPDU(d, 0x103ea)))
+	}
+}
+
+// TestBitmapMetadata feeds fast-path, slow-path and surface bits updates
+// and checks what the bitmaps report about them.
+func TestBitmapMetadata(t *testing.T) {
+	g, _ := newSession(4, 4)
+	var got []Bitmap
+	g.OnBitmap(func(bs []Bitmap) { got = append(got, bs...) })
+	activate(g, 32)
+
+	// An uncompressed 2x1 rectangle and an RLE compressed one, without
+	// their compression header.
+	g.sec.RecvFastPath(0, testutil.Hex(`
+		01 32 00  01 00 02 00
+		00 00 00 00 01 00 00 00 02 00 01 00 20 00 00 00 08 00
+		00 00 ff 00 00 00 ff 00
+		00 00 01 00 01 00 01 00 02 00 01 00 18 00 01 04 02 00
+		fd fe`))
+	// The same rectangles in a slow-path Update PDU.
+	update := testutil.Hex(`
+		ea 03 01 00  00 01 00 00  02 00 00 00
+		01 00 02 00
+		00 00 00 00 01 00 00 00 02 00 01 00 20 00 00 00 08 00
+		00 00 ff 00 00 00 ff 00
+		00 00 01 00 01 00 01 00 02 00 01 00 18 00 01 04 02 00
+		fd fe`)
+	g.sec.Emit("data", append(testutil.Hex("44 00 17 00 ea 03"), update...))
+	// A 1x1 RemoteFX surface bits command.
+	decode := pdu.DecodeRemoteFX
+	t.Cleanup(func() { pdu.DecodeRemoteFX = decode })
+	pdu.DecodeRemoteFX = func(data []byte, width, height int) []byte { return make([]byte, width*height*4) }
+	g.sec.RecvFastPath(0, testutil.Hex(`
+		04 1a 00  01 00
+		00 00 00 00 01 00 01 00  20 00 00 03 01 00 01 00 04 00 00 00
+		01 02 03 04`))
+
+	if len(got) != 5 {
+		t.Fatalf("%d bitmaps", len(got))
+	}
+	seq := got[0].Seq
+	for i, want := range []Bitmap{
+		{Seq: seq, UpdateType: pdu.BITMAP_UPDATE_FASTPATH, EncodedSize: 8},
+		{Seq: seq, UpdateType: pdu.BITMAP_UPDATE_FASTPATH, Compressed: true, EncodedSize: 2},
+		{Seq: seq + 1, UpdateType: pdu.BITMAP_UPDATE_SLOWPATH, EncodedSize: 8},
+		{Seq: seq + 1, UpdateType: pdu.BITMAP_UPDATE_SLOWPATH, Compressed: true, EncodedSize: 2},
+		{Seq: seq + 2, UpdateType: pdu.BITMAP_UPDATE_SURFACE_BITS, Codec: 3, EncodedSize: 4},
+	} {
+		b := got[i]
+		if b.Seq != want.Seq || b.UpdateType != want.UpdateType || b.Compressed != want.Compressed ||
+			b.Codec != want.Codec || b.EncodedSize != want.EncodedSize {
+			t.Errorf("bitmap %d: seq %d, %v, compressed %v, codec %d, %d bytes", i,
+				b.Seq, b.UpdateType, b.Compressed, b.Codec, b.EncodedSize)
+		}
+	}
+	if got[0].Seq == 0 {
+		t.Error("sequence numbers start at 0")
+	}
+}
+
+// TestRequestColorDepth requests depths before the connection, before the
+// display channel opens and once it is open, when the request reactivates
+// the session.
+func TestRequestColorDepth(t *testing.T) {
+	var preferred []gcc.HighColor
+	g := NewRdpClient("host:3389", 640, 480, nil, WithCapabilityFilter(func(caps map[pdu.CapsType]pdu.Capability) {
+		if b, ok := caps[pdu.CAPSTYPE_BITMAP].(*pdu.BitmapCapability); ok {
+			preferred = append(preferred, b.PreferredBitsPerPixel)
+		}
+	}))
+	invalid := func() {
+		t.Helper()
+		for _, bpp := range []int{0, 4, 12, 48} {
+			if err := g.RequestColorDepth(bpp); err == nil {
+				t.Errorf("depth %d accepted", bpp)
+			}
+		}
+	}
+
+	// Not connected: the depth waits for the capability exchange.
+	invalid()
+	if err := g.RequestColorDepth(16); err != nil {
+		t.Fatal(err)
+	}
+	invalid()
+	connect(g)
+	activate(g, 16)
+	if g.ColorDepth() != 16 || len(preferred) != 1 || preferred[0] != 16 {
+		t.Fatalf("depth %d, preferred %v", g.ColorDepth(), preferred)
+	}
+
+	// Connected before the display channel opens: the depth waits for
+	// the next capability exchange.
+	if err := g.RequestColorDepth(24); err != nil {
+		t.Fatal(err)
+	}
+
+	// With the display channel a new depth re-sends the layout, so the
+	// server reactivates the session, and the same depth does not.
+	disp := rdpedisp.NewHandler(0, 0)
+	var layouts [][]byte
+	disp.SetSendFunc(func(b []byte) { layouts = append(layouts, b) })
+	g.dispHandler = disp
+	g.RequestColorDepth(16)
+	if len(layouts) != 0 {
+		t.Errorf("layout sent for the current depth")
+	}
+	g.RequestColorDepth(32)
+	invalid()
+	if len(layouts) != 1 || binary.LittleEndian.Uint32(layouts[0][28:]) != 640 || binary.LittleEndian.Uint32(layouts[0][32:]) != 480 {
+		t.Fatalf("layouts %x", layouts)
+	}
+	g.sec.Emit("data", slowPath(&pdu.DeactiveAllPDU{ShareId: 0x103ea, LengthSourceDescriptor: 1, SourceDescriptor: []byte{0}}))
+	activate(g, 32)
+	if g.ColorDepth() != 32 || len(preferred) != 2 || preferred[1] != 32 {
+		t.Errorf("depth %d, preferred %v after reactivation", g.ColorDepth(), preferred)
+	}
+}
@@ -0,0 +1,210 @@
+package grdp
+
+import (
+	"bufio"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// IdentityStore persists the server certificate fingerprint seen for each
+// host, in the spirit of SSH known_hosts.  Implementations must be safe for
+// concurrent use.
+type IdentityStore interface {
+	// Lookup returns the fingerprint recorded for host, or ok == false
+	// when the host has not been seen before.
+	Lookup(host string) (fingerprint string, ok bool, err error)
+	// Store records fingerprint as the identity of host.
+	Store(host, fingerprint string) error
+}
+
+// ServerIdentityChange is passed to the OnServerIdentityChanged callback
+// when a host presents a certificate that differs from the recorded one.
+type ServerIdentityChange struct {
+	Host        string
+	Old         string // fingerprint recorded in the IdentityStore
+	New         string // fingerprint of Certificate
+	Certificate *x509.Certificate
+}
+
+// CertificatePolicy and CertificateError are re-exported from core for
+// use with WithCertificatePolicy.
+type (
+	CertificatePolicy = core.CertificatePolicy
+	CertificateError  = core.CertificateError
+)
+
+// CertificateFingerprint returns the SHA-256 fingerprint of cert as
+// lowercase hex, the format used by IdentityStore.
+func CertificateFingerprint(cert *x509.Certificate) string {
+	return core.CertFingerprint(cert)
+}
+
+// MemoryIdentityStore is an IdentityStore that lives as long as the
+// process.  It is the default and detects changes across Reconnect and
+// server redirections.
+type MemoryIdentityStore struct {
+	mu    sync.Mutex
+	hosts map[string]string
+}
+
+func NewMemoryIdentityStore() *MemoryIdentityStore {
+	return &MemoryIdentityStore{hosts: make(map[string]string)}
+}
+
+func (m *MemoryIdentityStore) Lookup(host string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fp, ok := m.hosts[host]
+	return fp, ok, nil
+}
+
+func (m *MemoryIdentityStore) Store(host, fingerprint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hosts[host] = fingerprint
+	return nil
+}
+
+// FileIdentityStore is an IdentityStore backed by a text file with one
+// "host sha256-hex" pair per line.  Blank lines and lines starting with
+// '#' are ignored.  The file is created on the first Store.
+type FileIdentityStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileIdentityStore(path string) *FileIdentityStore {
+	return &FileIdentityStore{path: path}
+}
+
+func (f *FileIdentityStore) Lookup(host string) (string, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hosts, err := f.load()
+	if err != nil {
+		return "", false, err
+	}
+	fp, ok := hosts[host]
+	return fp, ok, nil
+}
+
+func (f *FileIdentityStore) Store(host, fingerprint string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hosts, err := f.load()
+	if err != nil {
+		return err
+	}
+	hosts[host] = fingerprint
+
+	names := make([]string, 0, len(hosts))
+	for h := range hosts {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, h := range names {
+		fmt.Fprintf(&b, "%s %s\n", h, hosts[h])
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+func (f *FileIdentityStore) load() (map[string]string, error) {
+	hosts := make(map[string]string)
+	file, err := os.Open(f.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return hosts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sc := bufio.NewScanner(file)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: malformed identity line", f.path, n)
+		}
+		hosts[fields[0]] = fields[1]
+	}
+	return hosts, sc.Err()
+}
+
+// PeerCertificates returns the certificate chain presented by the server
+// on the current connection, leaf first, or nil for connections without
+// TLS.  A chain rejected by the certificate policy is available from the
+// CertificateError instead.
+func (g *RdpClient) PeerCertificates() []*x509.Certificate {
+	if g.tpkt == nil {
+		return nil
+	}
+	return g.tpkt.Conn.PeerCertificates()
+}
+
+// SetIdentityStore replaces the store used to remember server
+// certificates.  Pass a FileIdentityStore to detect changes across
+// process restarts; nil disables identity tracking.
+func (g *RdpClient) SetIdentityStore(s IdentityStore) *RdpClient {
+	g.identityStore = s
+	return g
+}
+
+// OnServerIdentityChanged registers f to be called when the server
+// presents a TLS certificate whose fingerprint differs from the one
+// recorded for the host, which may indicate a man-in-the-middle.  The
+// recorded fingerprint is left untouched; to accept the new certificate,
+// call Store on the IdentityStore with change.New.  f may call Close to
+// abort the connection.
+func (g *RdpClient) OnServerIdentityChanged(f func(change ServerIdentityChange)) *RdpClient {
+	g.onIdentityChangedFn = f
+	return g
+}
+
+// checkServerIdentity compares cert with the fingerprint recorded for the
+// host, recording it on first use.
+func (g *RdpClient) checkServerIdentity(cert *x509.Certificate) {
+	if g.identityStore == nil {
+		return
+	}
+	fp := CertificateFingerprint(cert)
+	old, ok, err := g.identityStore.Lookup(g.hostPort)
+	if err != nil {
+		g.log.Warn("identity store lookup failed", "host", g.hostPort, "err", err)
+		return
+	}
+	if !ok {
+		if err := g.identityStore.Store(g.hostPort, fp); err != nil {
+			g.log.Warn("identity store update failed", "host", g.hostPort, "err", err)
+		}
+		return
+	}
+	if old == fp {
+		return
+	}
+	g.log.Warn("server identity changed", "host", g.hostPort, "old", old, "new", fp)
+	if g.onIdentityChangedFn != nil {
+		g.onIdentityChangedFn(ServerIdentityChange{
+			Host:        g.hostPort,
+			Old:         old,
+			New:         fp,
+			Certificate: cert,
+		})
+	}
+}
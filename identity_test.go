@@ -0,0 +1,55 @@
+package grdp
+
+import (
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileIdentityStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	s := NewFileIdentityStore(path)
+	if _, ok, err := s.Lookup("a:3389"); ok || err != nil {
+		t.Fatalf("empty store: ok=%v err=%v", ok, err)
+	}
+	if err := s.Store("a:3389", "aa"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store("b:3389", "bb"); err != nil {
+		t.Fatal(err)
+	}
+	fp, ok, err := NewFileIdentityStore(path).Lookup("a:3389")
+	if err != nil || !ok || fp != "aa" {
+		t.Errorf("got %q %v %v, want aa", fp, ok, err)
+	}
+}
+
+func TestCheckServerIdentity(t *testing.T) {
+	g := NewRdpClient("host:3389", 800, 600, nil)
+	var changes []ServerIdentityChange
+	g.OnServerIdentityChanged(func(c ServerIdentityChange) {
+		changes = append(changes, c)
+	})
+
+	first := &x509.Certificate{Raw: []byte("first")}
+	second := &x509.Certificate{Raw: []byte("second")}
+	g.checkServerIdentity(first)
+	g.checkServerIdentity(first)
+	if len(changes) != 0 {
+		t.Fatalf("unexpected change on first use: %+v", changes)
+	}
+	g.checkServerIdentity(second)
+	if len(changes) != 1 {
+		t.Fatalf("got %d changes, want 1", len(changes))
+	}
+	c := changes[0]
+	if c.Host != "host:3389" || c.Old != CertificateFingerprint(first) ||
+		c.New != CertificateFingerprint(second) || c.Certificate != second {
+		t.Errorf("unexpected change %+v", c)
+	}
+	// The recorded identity is kept until the caller accepts the new one.
+	g.checkServerIdentity(second)
+	if len(changes) != 2 {
+		t.Errorf("got %d changes, want 2", len(changes))
+	}
+}
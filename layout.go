@@ -0,0 +1,167 @@
+package grdp
+
+import (
+	"strings"
+	"unicode/utf16"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+// Layout maps the characters of a keyboard layout to the scancodes, and
+// the Shift or AltGr modifier, that type them.  SendText sends characters
+// a layout does not map, including dead-key accents, as unicode events;
+// the zero Layout sends every character that way.
+type Layout struct {
+	name string
+	keys map[rune]keyStroke
+}
+
+// keyStroke is a set 1 scancode and the modifier held while pressing it.
+type keyStroke struct {
+	sc  Scancode
+	mod Scancode // 0, scShift or scAltGr
+}
+
+const (
+	scShift = ScancodeLeftShift
+	scAltGr = ScancodeRightAlt
+	scEnter = Scancode(0x1C)
+)
+
+// String returns the layout name, such as "US".
+func (l Layout) String() string {
+	return l.name
+}
+
+// layoutRow lists the characters of consecutive keys starting at scancode
+// first, unshifted, with Shift and with AltGr.  A space marks a key that
+// has no character, or only a dead key, at that level.
+type layoutRow struct {
+	first                Scancode
+	normal, shift, altGr string
+}
+
+func newLayout(name string, rows ...layoutRow) Layout {
+	l := Layout{name: name, keys: map[rune]keyStroke{
+		' ':  {sc: 0x39},
+		'\t': {sc: 0x0F},
+		'\n': {sc: scEnter},
+	}}
+	// Prefer the unshifted key when a character appears on several.
+	for level, mod := range []Scancode{0, scShift, scAltGr} {
+		for _, row := range rows {
+			chars := [...]string{row.normal, row.shift, row.altGr}[level]
+			for i, r := range []rune(chars) {
+				if _, ok := l.keys[r]; ok || r == ' ' {
+					continue
+				}
+				l.keys[r] = keyStroke{sc: row.first + Scancode(i), mod: mod}
+			}
+		}
+	}
+	return l
+}
+
+// Built-in layouts for SendText.  The server must use the same keyboard
+// layout, see SetKeyboardLayout.
+var (
+	LayoutUS = newLayout("US",
+		layoutRow{0x02, "1234567890-=", "!@#$%^&*()_+", ""},
+		layoutRow{0x10, "qwertyuiop[]", "QWERTYUIOP{}", ""},
+		layoutRow{0x1E, "asdfghjkl;'`", "ASDFGHJKL:\"~", ""},
+		layoutRow{0x2B, "\\zxcvbnm,./", "|ZXCVBNM<>?", ""},
+	)
+	LayoutUK = newLayout("UK",
+		layoutRow{0x02, "1234567890-=", "!\"£$%^&*()_+", "   €"},
+		layoutRow{0x10, "qwertyuiop[]", "QWERTYUIOP{}", ""},
+		layoutRow{0x1E, "asdfghjkl;'`", "ASDFGHJKL:@¬", "           ¦"},
+		layoutRow{0x2B, "#zxcvbnm,./", "~ZXCVBNM<>?", ""},
+		layoutRow{0x56, "\\", "|", ""},
+	)
+	LayoutDE = newLayout("DE",
+		layoutRow{0x02, "1234567890ß", "!\"§$%&/()=?", " ²³   {[]}\\"},
+		layoutRow{0x10, "qwertzuiopü+", "QWERTZUIOPÜ*", "@ €        ~"},
+		layoutRow{0x1E, "asdfghjklöä", "ASDFGHJKLÖÄ°", ""},
+		layoutRow{0x2B, "#yxcvbnm,.-", "'YXCVBNM;:_", "       µ"},
+		layoutRow{0x56, "<", ">", "|"},
+	)
+	LayoutFR = newLayout("FR",
+		layoutRow{0x02, "&é\"'(-è_çà)=", "1234567890°+", "  #{[| \\^@]}"},
+		layoutRow{0x10, "azertyuiop $", "AZERTYUIOP £", "  €        ¤"},
+		layoutRow{0x1E, "qsdfghjklmù²", "QSDFGHJKLM%", ""},
+		layoutRow{0x2B, "*wxcvbn,;:!", "µWXCVBN?./§", ""},
+		layoutRow{0x56, "<", ">", ""},
+	)
+	LayoutJP = newLayout("JP",
+		layoutRow{0x02, "1234567890-^", "!\"#$%&'() =~", ""},
+		layoutRow{0x10, "qwertyuiop@[", "QWERTYUIOP`{", ""},
+		layoutRow{0x1E, "asdfghjkl;:", "ASDFGHJKL+*", ""},
+		layoutRow{0x2B, "]zxcvbnm,./", "}ZXCVBNM<>?", ""},
+		layoutRow{0x73, " ", "_", ""},
+		layoutRow{0x7D, "\\", "|", ""},
+	)
+)
+
+// textKey is one input event of SendText: a scancode press or release,
+// or, when sc is 0, a unicode code unit.
+type textKey struct {
+	sc      Scancode
+	unicode uint16
+	release bool
+}
+
+// textKeys returns the input events that type s with layout l.
+func textKeys(s string, l Layout) []textKey {
+	var keys []textKey
+	for _, r := range strings.ReplaceAll(s, "\r\n", "\n") {
+		if r == '\r' {
+			r = '\n'
+		}
+		k, ok := l.keys[r]
+		if !ok {
+			for _, u := range utf16.Encode([]rune{r}) {
+				keys = append(keys, textKey{unicode: u}, textKey{unicode: u, release: true})
+			}
+			continue
+		}
+		if k.mod != 0 {
+			keys = append(keys, textKey{sc: k.mod})
+		}
+		keys = append(keys, textKey{sc: k.sc}, textKey{sc: k.sc, release: true})
+		if k.mod != 0 {
+			keys = append(keys, textKey{sc: k.mod, release: true})
+		}
+	}
+	return keys
+}
+
+// SendText types s as key presses of layout, holding Shift or AltGr where
+// the layout needs them.  Characters the layout cannot type are sent as
+// unicode events.
+func (g *RdpClient) SendText(s string, layout Layout) {
+	for _, k := range textKeys(s, layout) {
+		switch {
+		case k.sc != 0 && k.release:
+			g.KeyUp(k.sc)
+		case k.sc != 0:
+			g.KeyDown(k.sc)
+		default:
+			g.sendUnicodeKey(k.unicode, k.release)
+		}
+	}
+}
+
+func (g *RdpClient) sendUnicodeKey(u uint16, release bool) {
+	if !g.eventReady.Load() {
+		return
+	}
+	g.flushMouseMove()
+	g.flushWheel()
+
+	p := &pdu.UnicodeKeyEvent{Unicode: u}
+	if release {
+		p.KeyboardFlags |= pdu.KBDFLAGS_RELEASE
+	}
+	g.pdu.SendInputEvents(pdu.INPUT_EVENT_UNICODE, []pdu.InputEventsInterface{p})
+	g.notifyGfxLocalInput()
+}
@@ -0,0 +1,33 @@
+package grdp
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTextKeys(t *testing.T) {
+	for _, tt := range []struct {
+		s      string
+		layout Layout
+		want   []textKey
+	}{
+		{"aA", LayoutUS, []textKey{
+			{sc: 0x1E}, {sc: 0x1E, release: true},
+			{sc: scShift}, {sc: 0x1E}, {sc: 0x1E, release: true}, {sc: scShift, release: true},
+		}},
+		{"z@", LayoutDE, []textKey{
+			{sc: 0x15}, {sc: 0x15, release: true},
+			{sc: scAltGr}, {sc: 0x10}, {sc: 0x10, release: true}, {sc: scAltGr, release: true},
+		}},
+		{"\r\n", LayoutFR, []textKey{{sc: scEnter}, {sc: scEnter, release: true}}},
+		{"é", LayoutUS, []textKey{{unicode: 0xE9}, {unicode: 0xE9, release: true}}},
+		{"😀", Layout{}, []textKey{
+			{unicode: 0xD83D}, {unicode: 0xD83D, release: true},
+			{unicode: 0xDE00}, {unicode: 0xDE00, release: true},
+		}},
+	} {
+		if got := textKeys(tt.s, tt.layout); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("textKeys(%q, %v) = %+v, want %+v", tt.s, tt.layout, got, tt.want)
+		}
+	}
+}
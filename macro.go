@@ -0,0 +1,136 @@
+package grdp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// InputEventKind identifies which RdpClient input method an InputEvent
+// replays.
+type InputEventKind string
+
+const (
+	InputKeyDown     InputEventKind = "keydown"
+	InputKeyUp       InputEventKind = "keyup"
+	InputMouseMove   InputEventKind = "move"
+	InputMouseDown   InputEventKind = "mousedown"
+	InputMouseUp     InputEventKind = "mouseup"
+	InputMouseWheel  InputEventKind = "wheel"
+	InputMouseWheelH InputEventKind = "hwheel"
+)
+
+// InputEvent is one recorded call to a Key* or Mouse* method.
+type InputEvent struct {
+	Offset   time.Duration  `json:"offset"` // since the recording started
+	Kind     InputEventKind `json:"kind"`
+	Scancode int            `json:"scancode,omitempty"`
+	Button   int            `json:"button,omitempty"`
+	X        int            `json:"x,omitempty"`
+	Y        int            `json:"y,omitempty"`
+	Delta    float64        `json:"delta,omitempty"`
+}
+
+// InputMacro is a recorded sequence of input events.
+type InputMacro struct {
+	Events []InputEvent `json:"events"`
+}
+
+// InputRecorder collects the input sent by an RdpClient between
+// StartInputRecording and StopInputRecording.
+type InputRecorder struct {
+	mu     sync.Mutex
+	start  time.Time
+	events []InputEvent
+}
+
+// StartInputRecording begins capturing every event passed to KeyDown,
+// KeyUp, MouseMove, MouseDown, MouseUp, MouseWheel and MouseWheelH while
+// the session is ready, discarding any recording in progress.
+func (g *RdpClient) StartInputRecording() *RdpClient {
+	g.recorder.Store(&InputRecorder{start: time.Now()})
+	return g
+}
+
+// StopInputRecording ends the recording and returns it, or nil when no
+// recording was in progress.
+func (g *RdpClient) StopInputRecording() *InputMacro {
+	rec := g.recorder.Swap(nil)
+	if rec == nil {
+		return nil
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return &InputMacro{Events: rec.events}
+}
+
+func (g *RdpClient) recordInput(ev InputEvent) {
+	rec := g.recorder.Load()
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	ev.Offset = time.Since(rec.start)
+	rec.events = append(rec.events, ev)
+	rec.mu.Unlock()
+}
+
+// Play re-injects the macro into g with the original pacing, measured
+// from the call to Play.  Events are dropped while g is not ready, as
+// with live input, so wait for OnReady first.  It returns ctx.Err() if ctx
+// is cancelled before the last event.
+func (m *InputMacro) Play(ctx context.Context, g *RdpClient) error {
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for _, ev := range m.Events {
+		if d := time.Until(start.Add(ev.Offset)); d > 0 {
+			timer.Reset(d)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+			}
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		switch ev.Kind {
+		case InputKeyDown:
+			g.KeyDown(Scancode(ev.Scancode))
+		case InputKeyUp:
+			g.KeyUp(Scancode(ev.Scancode))
+		case InputMouseMove:
+			g.MouseMove(ev.X, ev.Y)
+		case InputMouseDown:
+			g.MouseDown(ev.Button, ev.X, ev.Y)
+		case InputMouseUp:
+			g.MouseUp(ev.Button, ev.X, ev.Y)
+		case InputMouseWheel:
+			g.MouseWheel(ev.Delta)
+		case InputMouseWheelH:
+			g.MouseWheelH(ev.Delta)
+		default:
+			return fmt.Errorf("unknown input event kind %q", ev.Kind)
+		}
+	}
+	return nil
+}
+
+// Save writes the macro as JSON.
+func (m *InputMacro) Save(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// LoadInputMacro reads a macro written by Save.
+func LoadInputMacro(r io.Reader) (*InputMacro, error) {
+	m := &InputMacro{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("load input macro: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,46 @@
+package grdp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInputMacroRoundTrip(t *testing.T) {
+	g := NewRdpClient("host:3389", 800, 600, nil)
+	g.recordInput(InputEvent{Kind: InputKeyDown, Scancode: 0x1e})
+	if g.StopInputRecording() != nil {
+		t.Fatal("recording without StartInputRecording")
+	}
+
+	g.StartInputRecording()
+	g.recordInput(InputEvent{Kind: InputKeyDown, Scancode: 0x1e})
+	g.recordInput(InputEvent{Kind: InputMouseDown, Button: 1, X: 10, Y: 20})
+	g.recordInput(InputEvent{Kind: InputMouseWheel, Delta: -0.5})
+	m := g.StopInputRecording()
+	if len(m.Events) != 3 || m.Events[1].Offset < m.Events[0].Offset {
+		t.Fatalf("unexpected events %+v", m.Events)
+	}
+
+	var buf bytes.Buffer
+	if err := m.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadInputMacro(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, m) {
+		t.Errorf("got %+v, want %+v", loaded, m)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := &InputMacro{Events: []InputEvent{{Offset: time.Hour, Kind: InputKeyUp}}}
+	if err := slow.Play(ctx, g); !errors.Is(err, context.Canceled) {
+		t.Errorf("Play on cancelled context: %v", err)
+	}
+}
@@ -0,0 +1,184 @@
+package grdp
+
+import (
+	"log/slog"
+
+	"github.com/nakagami/grdp/plugin/rdpedisp"
+	"github.com/nakagami/grdp/protocol/t125/gcc"
+)
+
+// Monitor is one screen of a multi-monitor desktop.  Left and Top are in
+// virtual desktop coordinates, in which the primary monitor is at 0,0.
+//
+// ScaleFactor is the desktop scale of the monitor in percent, its DPI
+// times 100 / 96, from 100 to 500; 0 uses the one of WithScaleFactor.
+// PhysicalWidth and PhysicalHeight are its size in millimetres, 0 when
+// unknown.
+type Monitor struct {
+	Left, Top     int
+	Width, Height int
+	Primary       bool
+
+	ScaleFactor                   int
+	PhysicalWidth, PhysicalHeight int
+}
+
+// WithScaleFactor renders the remote desktop for a high-DPI client: the
+// desktop scale factor, 100 to 500 percent, makes the server scale its
+// UI, and the device scale factor, 100, 140 or 180 percent, its Modern
+// apps.  A device scale of 0 picks the one closest to the desktop scale.
+// Both are sent at connection time and with SetResolution.
+func WithScaleFactor(desktopScale, deviceScale int) Option {
+	return func(g *RdpClient) {
+		g.desktopScale, g.deviceScale = desktopScale, deviceScale
+	}
+}
+
+// WithMonitors requests a desktop spanning monitors instead of a single
+// width x height screen.  The first monitor is the primary one unless
+// another is marked Primary; at most 16 monitors are sent.  The server may
+// adjust the layout: Monitors returns the one in use.
+func WithMonitors(monitors ...Monitor) Option {
+	return func(g *RdpClient) {
+		g.monitors = append([]Monitor(nil), monitors...)
+	}
+}
+
+// Monitors returns the monitor layout of the session, as reported by the
+// server in a Monitor Layout PDU, or else the requested one.
+func (g *RdpClient) Monitors() []Monitor {
+	if m := g.monitorLayout.Load(); m != nil {
+		return append([]Monitor(nil), (*m)...)
+	}
+	return append([]Monitor(nil), g.monitors...)
+}
+
+// monitorDefs converts the requested monitors for the Client Monitor Data.
+func (g *RdpClient) monitorDefs() []gcc.MonitorDef {
+	return toMonitorDefs(g.monitors, g.log)
+}
+
+func toMonitorDefs(monitors []Monitor, log *slog.Logger) []gcc.MonitorDef {
+	if len(monitors) > gcc.MONITOR_MAX_COUNT {
+		log.Warn("too many monitors, sending the first ones", "count", len(monitors))
+		monitors = monitors[:gcc.MONITOR_MAX_COUNT]
+	}
+	primary := 0
+	for i, m := range monitors {
+		if m.Primary {
+			primary = i
+			break
+		}
+	}
+	defs := make([]gcc.MonitorDef, len(monitors))
+	for i, m := range monitors {
+		defs[i] = gcc.MonitorDef{
+			Left:   int32(m.Left),
+			Top:    int32(m.Top),
+			Right:  int32(m.Left + m.Width - 1),
+			Bottom: int32(m.Top + m.Height - 1),
+		}
+		if i == primary {
+			defs[i].Flags = gcc.TS_MONITOR_PRIMARY
+		}
+	}
+	return defs
+}
+
+// scaleFactors returns the desktop and device scale factors of
+// WithScaleFactor, or 0, 0 when none or invalid ones were given.
+func (g *RdpClient) scaleFactors() (desktop, device uint32) {
+	if g.desktopScale == 0 {
+		return 0, 0
+	}
+	if g.desktopScale < rdpedisp.MinDesktopScale || g.desktopScale > rdpedisp.MaxDesktopScale {
+		g.log.Warn("desktop scale factor out of range, ignored", "scale", g.desktopScale)
+		return 0, 0
+	}
+	desktop, device = uint32(g.desktopScale), uint32(g.deviceScale)
+	switch device {
+	case 100, 140, 180:
+	default:
+		device = rdpedisp.DeviceScale(desktop)
+	}
+	return desktop, device
+}
+
+// monitorScale returns the scale factors of m, its own or the session's.
+func (g *RdpClient) monitorScale(m Monitor) (desktop, device uint32) {
+	desktop, device = g.scaleFactors()
+	if m.ScaleFactor >= rdpedisp.MinDesktopScale && m.ScaleFactor <= rdpedisp.MaxDesktopScale {
+		desktop = uint32(m.ScaleFactor)
+		device = rdpedisp.DeviceScale(desktop)
+	}
+	if desktop == 0 {
+		desktop, device = rdpedisp.MinDesktopScale, rdpedisp.DefaultDeviceScale
+	}
+	return desktop, device
+}
+
+// monitorAttributes converts the requested monitors for the Client
+// Monitor Extended Data, or returns nil when none has a scale factor or
+// physical size to report.
+func (g *RdpClient) monitorAttributes() []gcc.MonitorAttributes {
+	monitors := g.monitors[:min(len(g.monitors), gcc.MONITOR_MAX_COUNT)]
+	desktop, _ := g.scaleFactors()
+	needed := desktop != 0
+	for _, m := range monitors {
+		needed = needed || m.ScaleFactor != 0 || m.PhysicalWidth != 0 || m.PhysicalHeight != 0
+	}
+	if !needed {
+		return nil
+	}
+	attrs := make([]gcc.MonitorAttributes, len(monitors))
+	for i, m := range monitors {
+		attrs[i].DesktopScaleFactor, attrs[i].DeviceScaleFactor = g.monitorScale(m)
+		attrs[i].PhysicalWidth, attrs[i].PhysicalHeight = uint32(m.PhysicalWidth), uint32(m.PhysicalHeight)
+	}
+	return attrs
+}
+
+// displayLayout returns the requested monitors with their scale factors
+// for the display control channel, or nil when neither monitors nor a
+// scale factor were requested.  Widths are rounded down to even.
+func (g *RdpClient) displayLayout() []rdpedisp.Monitor {
+	monitors := g.monitors
+	if len(monitors) == 0 {
+		if desktop, _ := g.scaleFactors(); desktop == 0 {
+			return nil
+		}
+		monitors = []Monitor{{Width: g.width, Height: g.height, Primary: true}}
+	}
+	defs := toMonitorDefs(monitors, g.log)
+	layout := make([]rdpedisp.Monitor, len(defs))
+	for i, d := range defs {
+		m := monitors[i]
+		layout[i] = rdpedisp.Monitor{
+			Left:           d.Left,
+			Top:            d.Top,
+			Width:          uint32(m.Width) &^ 1,
+			Height:         uint32(m.Height),
+			PhysicalWidth:  uint32(m.PhysicalWidth),
+			PhysicalHeight: uint32(m.PhysicalHeight),
+		}
+		if d.Flags&gcc.TS_MONITOR_PRIMARY != 0 {
+			layout[i].Flags = rdpedisp.MonitorFlagPrimary
+		}
+		layout[i].DesktopScaleFactor, layout[i].DeviceScaleFactor = g.monitorScale(m)
+	}
+	return layout
+}
+
+func monitorsFromDefs(defs []gcc.MonitorDef) []Monitor {
+	monitors := make([]Monitor, len(defs))
+	for i, d := range defs {
+		monitors[i] = Monitor{
+			Left:    int(d.Left),
+			Top:     int(d.Top),
+			Width:   int(d.Right-d.Left) + 1,
+			Height:  int(d.Bottom-d.Top) + 1,
+			Primary: d.Flags&gcc.TS_MONITOR_PRIMARY != 0,
+		}
+	}
+	return monitors
+}
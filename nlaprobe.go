@@ -0,0 +1,167 @@
+package grdp
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/protocol/nla"
+	"github.com/nakagami/grdp/protocol/tpkt"
+	"github.com/nakagami/grdp/protocol/x224"
+)
+
+// NLAProbe reports how a server handles Network Level Authentication.
+type NLAProbe struct {
+	// Supported is set when the server selected CredSSP and answered the
+	// NTLM NEGOTIATE with a CHALLENGE.
+	Supported bool
+	// Enforced is set when the server refused a TLS-only connection with
+	// HYBRID_REQUIRED_BY_SERVER.
+	Enforced bool
+	// Challenge is what the server disclosed in its CHALLENGE; nil unless
+	// Supported.
+	Challenge *nla.ChallengeInfo
+}
+
+// ProbeNLA checks whether the server supports and enforces NLA without
+// attempting a logon.  It makes two short connections: one requesting
+// CredSSP, which stops after the NTLM CHALLENGE with empty credentials,
+// and one requesting TLS only.  Since no AUTHENTICATE message is ever
+// sent, scanners can use it without risk of locking accounts.
+// Credentials passed to Login are not used.
+func (g *RdpClient) ProbeNLA() (*NLAProbe, error) {
+	result := &NLAProbe{}
+
+	r := g.probeConnect(context.Background(), x224.PROTOCOL_SSL|x224.PROTOCOL_HYBRID, true)
+	if r.err != nil && !isNegotiationFailure(r.err) {
+		return nil, r.err
+	}
+	if r.err == nil && r.selected == x224.PROTOCOL_HYBRID {
+		result.Supported = true
+		result.Challenge = r.info
+	}
+
+	err := g.probeConnect(context.Background(), x224.PROTOCOL_SSL, false).err
+	var negErr *x224.NegotiationFailureError
+	switch {
+	case errors.As(err, &negErr):
+		result.Enforced = negErr.Code == x224.HYBRID_REQUIRED_BY_SERVER
+	case err != nil:
+		return nil, err
+	}
+	return result, nil
+}
+
+// ErrNLANotSelected is returned by CheckCredentials when the server does
+// not accept a CredSSP connection.
+var ErrNLANotSelected = errors.New("server did not select NLA")
+
+// CheckCredentials runs the CredSSP handshake to completion with the
+// credentials from SetCredentials (or a CredentialProvider) and
+// disconnects before MCS, without creating a desktop session.  It returns
+// nil when the server accepted the credentials, an error matching
+// nla.ErrBadCredentials or another nla sentinel when CredSSP failed, a
+// *tpkt.NLATimeoutError when the server stalled, and ErrNLANotSelected
+// when the server does not offer NLA.  Servers older than CredSSP v3
+// report bad credentials by closing the connection instead.
+func (g *RdpClient) CheckCredentials(ctx context.Context) error {
+	g.credAttempt, g.credErr = 1, nil
+	r := g.probeConnect(ctx, x224.PROTOCOL_HYBRID, false)
+	if r.err != nil {
+		if isNegotiationFailure(r.err) {
+			return fmt.Errorf("%w: %w", ErrNLANotSelected, r.err)
+		}
+		return r.err
+	}
+	if r.selected != x224.PROTOCOL_HYBRID {
+		return ErrNLANotSelected
+	}
+	return nil
+}
+
+func isNegotiationFailure(err error) bool {
+	var negErr *x224.NegotiationFailureError
+	return errors.As(err, &negErr)
+}
+
+// probeResult is the outcome of probeConnect.
+type probeResult struct {
+	selected uint32
+	info     *nla.ChallengeInfo
+	certs    []*x509.Certificate
+	err      error
+}
+
+// probeConnect sends an x224 Connection Request for requested and waits
+// for the security layer to come up.  With nlaProbe the CredSSP exchange
+// stops after the CHALLENGE with empty credentials; otherwise it runs to
+// completion with the client's credentials.  The connection is always
+// closed on return.
+func (g *RdpClient) probeConnect(ctx context.Context, requested uint32, nlaProbe bool) probeResult {
+	conn, err := g.dialer(g.hostPort)
+	if err != nil {
+		return probeResult{err: fmt.Errorf("[dial err] %v", err)}
+	}
+	host, _, _ := net.SplitHostPort(g.hostPort)
+	ntlm := nla.NewNTLMv2("", "", "")
+	if !nlaProbe {
+		ntlm = nla.NewNTLMv2(g.domain, g.user, g.password)
+		ntlm.SetTargetName(g.ServicePrincipalName())
+	}
+	ntlm.SetLogger(g.logger)
+	t := tpkt.New(core.NewSocketLayer(conn, host), ntlm)
+	defer t.Close()
+	t.SetLogger(g.logger)
+	t.SetTLSConfig(g.tlsConfig)
+	t.SetCertificatePolicy(g.certPolicy)
+	timeout := tpkt.DefaultNLATimeout
+	if g.nlaTimeout > 0 {
+		t.SetNLATimeout(g.nlaTimeout, g.nlaRetries)
+		timeout = g.nlaTimeout
+	}
+	if !nlaProbe {
+		t.SetRemoteGuardCredentials(g.remoteGuard)
+		t.SetSmartCardProvider(g.smartCardProvider())
+		if g.credentials != nil {
+			t.SetCredentialsFunc(g.credentialsFunc())
+		}
+	}
+
+	ch := make(chan probeResult, 1)
+	send := func(r probeResult) {
+		select {
+		case ch <- r:
+		default:
+		}
+	}
+	x := x224.New(t)
+	x.SetLogger(g.logger)
+	x.SetRequestedProtocol(requested)
+	x.SetNLAProbe(nlaProbe)
+	x.On("connect", func(selected uint32) {
+		send(probeResult{selected: selected})
+	}).On("nlaProbe", func(info *nla.ChallengeInfo) {
+		send(probeResult{selected: x224.PROTOCOL_HYBRID, info: info})
+	}).On("error", func(err error) {
+		send(probeResult{err: err})
+	}).On("close", func() {
+		send(probeResult{err: errors.New("connection closed during probe")})
+	})
+	if err := x.Connect(); err != nil {
+		return probeResult{err: fmt.Errorf("[x224 connect err] %v", err)}
+	}
+
+	select {
+	case r := <-ch:
+		r.certs = t.Conn.PeerCertificates()
+		return r
+	case <-ctx.Done():
+		return probeResult{err: ctx.Err()}
+	case <-time.After(2 * timeout):
+		return probeResult{err: errors.New("timed out waiting for probe response")}
+	}
+}
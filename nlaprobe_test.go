@@ -0,0 +1,27 @@
+package grdp
+
+import (
+	"context"
+	"encoding/asn1"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/nakagami/grdp/protocol/nla"
+)
+
+func TestCheckCredentialsRejected(t *testing.T) {
+	cert := testCertificate(t)
+	reply, err := asn1.Marshal(nla.TSRequest{Version: 6, ErrorCode: nla.STATUS_LOGON_FAILURE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewRdpClient("srv:3389", 800, 600, func(string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go fakeNLAServer(t, server, cert, reply)
+		return client, nil
+	}).SetCredentials("CORP", "alice", "wrong")
+	if err := g.CheckCredentials(context.Background()); !errors.Is(err, nla.ErrBadCredentials) {
+		t.Errorf("got %v, want ErrBadCredentials", err)
+	}
+}
@@ -0,0 +1,364 @@
+package grdp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/plugin"
+	"github.com/nakagami/grdp/protocol/pdu"
+	"github.com/nakagami/grdp/protocol/sec"
+	"github.com/nakagami/grdp/protocol/t125/gcc"
+	"github.com/nakagami/grdp/protocol/tpkt"
+)
+
+// Option configures an RdpClient at construction time.
+type Option func(*RdpClient)
+
+// WithTLSConfig sets the TLS configuration used for TLS and NLA
+// connections: protocol versions, cipher suites, SNI (ServerName),
+// client certificates and RootCAs.  The config is cloned for every
+// connection and an empty ServerName defaults to the target host.
+// Without this option any server certificate is accepted and only
+// TLS 1.2 is negotiated.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(g *RdpClient) {
+		g.tlsConfig = config
+	}
+}
+
+// WithClientName sets the client computer name sent in the GCC core data
+// instead of the local hostname, so server-side audit logs show the origin
+// workstation of a jump host deployment.  At most 15 characters are sent;
+// an empty name keeps the hostname out of the server's event logs.
+func WithClientName(name string) Option {
+	return func(g *RdpClient) {
+		g.clientName = &name
+	}
+}
+
+// WithClientBuild sets the client build number sent in the GCC core data.
+// The default is 22621.
+func WithClientBuild(build uint32) Option {
+	return func(g *RdpClient) {
+		g.clientBuild = build
+	}
+}
+
+// WithKeyboardLayout sets the input locale identifier sent in the GCC
+// core data, which the server uses as the session keyboard layout: one of
+// the gcc constants such as gcc.GERMAN, or any layout ID, for example
+// gcc.KeyboardLayout(0x00000813) for Belgian (Period).  SetKeyboardLayout
+// does the same by name.
+func WithKeyboardLayout(layout gcc.KeyboardLayout) Option {
+	return func(g *RdpClient) {
+		g.kbdLayout = uint32(layout)
+	}
+}
+
+// WithKeyboardType sets the keyboard type (gcc.KT_*), OEM subtype and
+// number of function keys sent in the GCC core data.  A Japanese 106/109
+// keyboard, for instance, is gcc.KT_JAPANESE with subtype 2 and 12
+// function keys.  The default is gcc.KT_IBM_101_102_KEYS, subtype 0 and
+// 12 function keys.
+func WithKeyboardType(keyboardType, subType, functionKeys uint32) Option {
+	return func(g *RdpClient) {
+		g.keyboardType = keyboardType
+		g.keyboardSubType = subType
+		g.keyboardFnKeys = functionKeys
+	}
+}
+
+// WithClientAddress sets the client IP address reported in the extended
+// Client Info PDU (IPv4 or IPv6 in textual form), truncated to the 39
+// characters the field holds.  By default no address is reported.
+func WithClientAddress(addr string) Option {
+	return func(g *RdpClient) {
+		g.clientAddress = addr
+	}
+}
+
+// WithPerformanceFlags sets the sec.PERF_* flags sent to the server,
+// trading visual quality for bandwidth: for example
+// sec.PERF_DISABLE_WALLPAPER|sec.PERF_DISABLE_THEMING for a slow link, or
+// only sec.PERF_ENABLE_FONT_SMOOTHING|sec.PERF_ENABLE_DESKTOP_COMPOSITION
+// for the full desktop experience.  The default disables the wallpaper,
+// full window drag and menu animations and enables font smoothing and
+// desktop composition.
+func WithPerformanceFlags(flags uint32) Option {
+	return func(g *RdpClient) {
+		g.perfFlags = &flags
+	}
+}
+
+// WithConnectionType sets the connection type the client reports, one of
+// the gcc.CONNECTION_TYPE_* values, and whether it supports network
+// characteristics autodetection.  gcc.CONNECTION_TYPE_AUTODETECT lets the
+// server measure the link and always enables autodetection.  The default
+// is gcc.CONNECTION_TYPE_LAN with autodetection.
+func WithConnectionType(t gcc.ConnectionType, autodetect bool) Option {
+	return func(g *RdpClient) {
+		g.connType = &connectionType{t, autodetect}
+	}
+}
+
+// connectionType is the setting of WithConnectionType.
+type connectionType struct {
+	t          gcc.ConnectionType
+	autodetect bool
+}
+
+// WithTimeZone sends loc as the client time zone, so the remote session
+// shows the local time of the user when the server allows time zone
+// redirection.  Without this option the client reports UTC.
+func WithTimeZone(loc *time.Location) Option {
+	return func(g *RdpClient) {
+		g.timeZone = loc
+	}
+}
+
+// WithCompression asks the server to bulk compress the PDUs it sends, at
+// up to level: core.PACKET_COMPR_TYPE_8K, _64K or _RDP61.  RDP 6.0
+// (NCRUSH) has no decoder yet, so Login fails with an error wrapping
+// core.ErrUnsupportedCompression for _RDP6 as for any other value.
+// Without this option the session is not compressed.
+// Stats().Compressor reports the compressor the server picked.
+func WithCompression(level int) Option {
+	return func(g *RdpClient) {
+		switch level {
+		case core.PACKET_COMPR_TYPE_8K, core.PACKET_COMPR_TYPE_64K, core.PACKET_COMPR_TYPE_RDP61:
+			g.compression = &level
+		default:
+			g.setOptionErr(fmt.Errorf("compression %s: %w", core.CompressionTypeName(level), core.ErrUnsupportedCompression))
+		}
+	}
+}
+
+// WithCertificatePolicy verifies the server certificate of TLS and NLA
+// connections with p: against system or custom roots, SHA-256 fingerprint
+// pins or a callback.  A rejected certificate fails Login with a
+// *CertificateError.  Without this option any certificate is accepted.
+func WithCertificatePolicy(p CertificatePolicy) Option {
+	return func(g *RdpClient) {
+		g.certPolicy = &p
+	}
+}
+
+// WithServerCertPolicy sets what happens when the certificate a server
+// sends for Standard RDP Security, a proprietary certificate or an X.509
+// chain, fails signature verification.  The default, sec.ServerCertWarn,
+// only logs; sec.ServerCertStrict fails Login.
+func WithServerCertPolicy(p sec.ServerCertPolicy) Option {
+	return func(g *RdpClient) {
+		g.serverCertPolicy = p
+	}
+}
+
+// WithMaxUnacknowledgedFrames sets how many frames the server may send
+// before the client acknowledges them; a frame is acknowledged once the
+// OnBitmap callback for it returns, so a slow client slows the server
+// down instead of queueing updates.  The default is 2 and 0 turns frame
+// acknowledgement off.
+func WithMaxUnacknowledgedFrames(n int) Option {
+	return func(g *RdpClient) {
+		v := uint32(max(n, 0))
+		g.maxUnackedFrames = &v
+	}
+}
+
+// WithMemoryBudget caps the memory each connection holds in buffers whose
+// size the server chooses, such as the surfaces of the graphics pipeline
+// and the virtual channel messages being reassembled, at limit bytes: the
+// PDUs asking for more are dropped.  The default is core.DefaultBudget, 1
+// GiB, and a limit of 0 or less lifts the cap.
+func WithMemoryBudget(limit int64) Option {
+	return func(g *RdpClient) {
+		g.memoryBudget = limit
+	}
+}
+
+// WithCapabilityFilter lets f tune the capability sets the client
+// advertises, and so what the server is allowed to send, before each
+// Confirm Active PDU: for example clearing OrderCapability.OrderSupport
+// entries or lowering the VirtualChannelCapability chunk size.  The sets
+// are keyed by type, such as pdu.CAPSTYPE_ORDER.
+func WithCapabilityFilter(f pdu.CapabilityFilter) Option {
+	return func(g *RdpClient) {
+		g.capFilter = f
+	}
+}
+
+// WithBitmapCacheFile keeps a persistent bitmap cache in path: the bitmaps
+// the server marks persistent are saved there on Close and offered to the
+// server when the next session starts, so it can skip sending them again.
+func WithBitmapCacheFile(path string) Option {
+	return func(g *RdpClient) {
+		g.bitmapCacheFile = path
+	}
+}
+
+// WithGfxCacheFile keeps the RDPGFX bitmap cache in path: the bitmaps
+// the server caches are saved there on Close and offered in the Cache
+// Import Offer of the next session.
+func WithGfxCacheFile(path string) Option {
+	return func(g *RdpClient) {
+		g.gfxCacheFile = path
+	}
+}
+
+// WithDrawingOrders sets whether the client lets the server draw with
+// primary drawing orders, which it renders and passes to OnBitmap as
+// BITMAP_UPDATE_ORDERS bitmaps.  It is on by default; off, the server
+// sends the screen as bitmaps only, which costs more bandwidth but saves
+// keeping a copy of the screen.
+func WithDrawingOrders(on bool) Option {
+	return func(g *RdpClient) {
+		g.noDrawingOrders = !on
+	}
+}
+
+// Timeouts bound the stages of Login; a zero field keeps the default.
+type Timeouts struct {
+	// Dial bounds the TCP connection, 30 seconds by default.  It does
+	// not apply to the dialer of WithDialer.
+	Dial time.Duration
+	// NLA bounds each message of the CredSSP handshake, as
+	// SetNLATimeout does.
+	NLA time.Duration
+	// Connect bounds the connection sequence from the X.224 negotiation
+	// to the first Demand Active PDU, 30 seconds by default.
+	Connect time.Duration
+	// Read ends the session when the server sends nothing for that long.
+	// A server sends nothing while the screen does not change unless it
+	// sends heartbeats, so the default is to wait forever.
+	Read time.Duration
+}
+
+const (
+	defaultDialTimeout    = 30 * time.Second
+	defaultConnectTimeout = 30 * time.Second
+)
+
+// WithTimeouts sets the timeouts of Login.
+func WithTimeouts(t Timeouts) Option {
+	return func(g *RdpClient) {
+		if t.Dial > 0 {
+			g.dialTimeout = t.Dial
+		}
+		if t.NLA > 0 {
+			g.nlaTimeout = t.NLA
+			if g.nlaRetries == 0 {
+				g.nlaRetries = tpkt.DefaultNLARetries
+			}
+		}
+		if t.Connect > 0 {
+			g.connectTimeout = t.Connect
+		}
+		if t.Read > 0 {
+			g.readTimeout = t.Read
+		}
+	}
+}
+
+// WithResolution sets the size of the desktop requested from the server,
+// DefaultWidth x DefaultHeight for New.
+func WithResolution(width, height int) Option {
+	return func(g *RdpClient) {
+		g.width, g.height = width, height
+		if g.fb != nil {
+			g.fb.resize(width, height)
+		}
+	}
+}
+
+// WithDialer makes the client open its TCP connection with dial, for
+// instance through a proxy or a net.Dialer with a local address.
+func WithDialer(dial func(hostPort string) (net.Conn, error)) Option {
+	return func(g *RdpClient) {
+		g.dialer = dial
+	}
+}
+
+// WithTap hands a copy of every TPKT frame and fast-path PDU of the
+// connections to tap, after TLS decryption, for instance a pcapng.Writer
+// writing a capture for Wireshark.
+func WithTap(tap core.Tap) Option {
+	return func(g *RdpClient) {
+		g.tap = tap
+	}
+}
+
+// WithColorDepth sets the color depth requested from the server, as
+// RequestColorDepth does: 8, 15, 16, 24 or 32 bits per pixel.  Login
+// fails with an error for another value.
+func WithColorDepth(bpp int) Option {
+	return func(g *RdpClient) {
+		g.setOptionErr(g.RequestColorDepth(bpp))
+	}
+}
+
+// WithDomainUser sets the account Login logs on with when it is called
+// with empty strings, as SetCredentials does.
+func WithDomainUser(domain, user, password string) Option {
+	return func(g *RdpClient) {
+		g.SetCredentials(domain, user, password)
+	}
+}
+
+// Channel describes a virtual channel for WithChannels.
+type Channel struct {
+	// Name is the name of the channel, at most 7 characters for a
+	// static channel.
+	Name string
+	// Dynamic opens the channel over DRDYNVC instead of as a static
+	// channel.
+	Dynamic bool
+	// Options are the CHANNEL_OPTION flags of a static channel, 0 for
+	// the defaults of RegisterStaticChannel.
+	Options uint32
+	// Plugin handles the channel.
+	Plugin plugin.ChannelPlugin
+}
+
+// WithChannels registers the channels with RegisterStaticChannel or
+// RegisterDynamicChannel.  Login fails with the error of an invalid one.
+func WithChannels(channels ...Channel) Option {
+	return func(g *RdpClient) {
+		for _, c := range channels {
+			if c.Dynamic {
+				g.setOptionErr(g.RegisterDynamicChannel(c.Name, c.Plugin))
+			} else {
+				g.setOptionErr(g.RegisterStaticChannel(c.Name, c.Options, c.Plugin))
+			}
+		}
+	}
+}
+
+// WithLogger makes the client and all its protocol layers and channels log
+// to l instead of slog.Default().  The records carry the attribute "layer"
+// (core.LogLayer) naming the layer that logged, and "channel" and "pdu"
+// where they are about a virtual channel or a PDU type.
+func WithLogger(l *slog.Logger) Option {
+	return func(g *RdpClient) {
+		g.logger = l
+	}
+}
+
+// WithLogRedaction, when on, keeps credentials, session keys and payload
+// bytes out of the logs: user names and keys are logged as "[redacted]"
+// and decrypted PDUs by their length only.
+func WithLogRedaction(on bool) Option {
+	return func(g *RdpClient) {
+		g.redactLogs = on
+	}
+}
+
+// setOptionErr keeps the first error of the options for Login.
+func (g *RdpClient) setOptionErr(err error) {
+	if err != nil && g.optionErr == nil {
+		g.optionErr = fmt.Errorf("grdp option: %w", err)
+	}
+}
@@ -0,0 +1,179 @@
+package grdp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/protocol/t125"
+	"github.com/nakagami/grdp/protocol/t125/gcc"
+	"github.com/nakagami/grdp/protocol/x224"
+	"github.com/nakagami/grdp/testutil"
+)
+
+func TestNewOptions(t *testing.T) {
+	g := New("host:3389")
+	if g.width != DefaultWidth || g.height != DefaultHeight || g.connectTimeout != defaultConnectTimeout {
+		t.Errorf("defaults %dx%d %v", g.width, g.height, g.connectTimeout)
+	}
+
+	errDial := errors.New("dial")
+	var dialed string
+	g = New("host:3389",
+		WithFramebuffer(),
+		WithResolution(800, 600),
+		WithColorDepth(16),
+		WithDomainUser("CORP", "alice", "secret"),
+		WithTimeouts(Timeouts{Connect: time.Minute}),
+		WithDialer(func(hostPort string) (net.Conn, error) {
+			dialed = hostPort
+			return nil, errDial
+		}))
+	if g.width != 800 || g.height != 600 || g.fb.img.Rect.Dx() != 800 || g.colorDepth != 16 || g.connectTimeout != time.Minute {
+		t.Errorf("options %dx%d fb %v bpp %d %v", g.width, g.height, g.fb.img.Rect, g.colorDepth, g.connectTimeout)
+	}
+	if err := g.Login("", "", ""); err == nil || dialed != "host:3389" {
+		t.Errorf("login = %v, dialed %q", err, dialed)
+	}
+	if g.domain != "CORP" || g.user != "alice" || g.password != "secret" {
+		t.Errorf("account %s\\%s", g.domain, g.user)
+	}
+
+	g = New("host:3389", WithColorDepth(12), WithChannels(Channel{Name: "toolongname"}))
+	if err := g.Login("", "user", "password"); err == nil {
+		t.Error("login with invalid options succeeded")
+	}
+	g = New("host:3389", WithCompression(core.PACKET_COMPR_TYPE_RDP6))
+	if err := g.Login("", "user", "password"); !errors.Is(err, core.ErrUnsupportedCompression) {
+		t.Errorf("login with NCRUSH compression = %v", err)
+	}
+}
+
+func TestWithLogRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	l := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	g := New("host:3389", WithLogger(l), WithLogRedaction(true),
+		WithDialer(func(string) (net.Conn, error) { return nil, errors.New("dial") }))
+	g.Login("CORP", "alice", "secret")
+	out := buf.String()
+	if !strings.Contains(out, "layer=grdp") || !strings.Contains(out, "user=[redacted]") {
+		t.Errorf("log %q", out)
+	}
+	if strings.Contains(out, "alice") || strings.Contains(out, "CORP") {
+		t.Errorf("credentials logged: %q", out)
+	}
+}
+
+// clientCore returns the CS_CORE block of the MCS Connect Initial a
+// client built with opts sends.
+func clientCore(t *testing.T, opts ...Option) []byte {
+	t.Helper()
+	g := NewRdpClient("host:3389", 640, 480, nil, opts...)
+	tr := testutil.NewTransport()
+	g.x224 = x224.New(tr)
+	g.setupSession(tr)
+	tr.Emit("connect", uint32(x224.PROTOCOL_SSL))
+	frames := tr.Frames()
+	if len(frames) != 1 {
+		t.Fatalf("sent %d frames", len(frames))
+	}
+	i := bytes.Index(frames[0].Data, []byte{0x01, 0xc0, 0xd8, 0x00})
+	if i < 0 {
+		t.Fatal("no CS_CORE block in the Connect Initial")
+	}
+	return frames[0].Data[i:]
+}
+
+// clientName decodes the clientName field of a CS_CORE block.
+func clientName(data []byte) string {
+	u := make([]uint16, 0, 16)
+	for i := 24; i < 56; i += 2 {
+		if c := binary.LittleEndian.Uint16(data[i:]); c != 0 {
+			u = append(u, c)
+		}
+	}
+	return string(utf16.Decode(u))
+}
+
+func TestClientCoreOptions(t *testing.T) {
+	host, _ := os.Hostname()
+	if len(host) > 15 {
+		host = host[:15]
+	}
+	for _, tt := range []struct {
+		opts []Option
+		want string
+	}{
+		{nil, host},
+		{[]Option{WithClientName("")}, ""},
+		{[]Option{WithClientName("WORKSTATION-0042")}, "WORKSTATION-004"},
+	} {
+		if name := clientName(clientCore(t, tt.opts...)); name != tt.want {
+			t.Errorf("client name = %q, want %q", name, tt.want)
+		}
+	}
+
+	data := clientCore(t, WithClientBuild(19045), WithKeyboardLayout(gcc.JAPANESE),
+		WithKeyboardType(uint32(gcc.KT_JAPANESE), 2, 15))
+	for _, f := range []struct {
+		name      string
+		off, want uint32
+	}{
+		{"keyboardLayout", 16, uint32(gcc.JAPANESE)},
+		{"clientBuild", 20, 19045},
+		{"keyboardType", 56, uint32(gcc.KT_JAPANESE)},
+		{"keyboardSubType", 60, 2},
+		{"keyboardFunctionKey", 64, 15},
+	} {
+		if v := binary.LittleEndian.Uint32(data[f.off:]); v != f.want {
+			t.Errorf("%s = %d, want %d", f.name, v, f.want)
+		}
+	}
+}
+
+func TestPerformanceOptions(t *testing.T) {
+	for _, tt := range []struct {
+		t          gcc.ConnectionType
+		autodetect bool
+	}{
+		{gcc.CONNECTION_TYPE_MODEM, false},
+		{gcc.CONNECTION_TYPE_BROADBAND_HIGH, true},
+		{gcc.CONNECTION_TYPE_AUTODETECT, false},
+	} {
+		data := clientCore(t, WithConnectionType(tt.t, tt.autodetect))
+		flags := binary.LittleEndian.Uint16(data[144:])
+		if data[210] != uint8(tt.t) || flags&gcc.RNS_UD_CS_VALID_CONNECTION_TYPE == 0 {
+			t.Errorf("connection type %d: sent %d, flags %#x", tt.t, data[210], flags)
+		}
+		want := tt.autodetect || tt.t == gcc.CONNECTION_TYPE_AUTODETECT
+		if got := flags&gcc.RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT != 0; got != want {
+			t.Errorf("connection type %d: autodetect %v, want %v", tt.t, got, want)
+		}
+	}
+
+	// The performance flags end the Client Info PDU sent once MCS is up.
+	g := NewRdpClient("host:3389", 640, 480, nil, WithPerformanceFlags(0x11223344))
+	tr := testutil.NewTransport()
+	g.x224 = x224.New(tr)
+	g.setupSession(tr)
+	data := gcc.NewClientCoreData(0x409, 4, 0)
+	data.ServerSelectedProtocol = uint32(x224.PROTOCOL_SSL)
+	g.mcs.Emit("connect", []any{data, gcc.NewClientSecurityData(), gcc.NewClientNetworkData()}, []any{},
+		uint16(1007), []t125.MCSChannelInfo{{ID: 1003, Name: t125.GLOBAL_CHANNEL_NAME}})
+	frames := tr.Frames()
+	if len(frames) != 1 {
+		t.Fatalf("sent %d frames", len(frames))
+	}
+	info := frames[0].Data
+	if flags := binary.LittleEndian.Uint32(info[len(info)-4:]); flags != 0x11223344 {
+		t.Errorf("performance flags = %#x", flags)
+	}
+}
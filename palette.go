@@ -0,0 +1,45 @@
+package grdp
+
+import (
+	"unsafe"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+// Palette is the colour table of an 8bpp session: entry i is the RGBA
+// pixel, packed R at the lowest byte, of colour index i.
+type Palette [256]uint32
+
+// greyPalette is used until the server sends its first Palette Update.
+var greyPalette = func() *Palette {
+	var p Palette
+	for i := range p {
+		c := uint32(i)
+		p[i] = c | c<<8 | c<<16 | 0xFF000000
+	}
+	return &p
+}()
+
+func newPalette(entries []pdu.PaletteEntry) *Palette {
+	var p Palette
+	for i, e := range entries {
+		p[i] = uint32(e.Red) | uint32(e.Green)<<8 | uint32(e.Blue)<<16 | 0xFF000000
+	}
+	for i := len(entries); i < len(p); i++ {
+		p[i] = 0xFF000000
+	}
+	return &p
+}
+
+// paletteBatchToRGBA looks up n colour indexes of src, writing RGBA
+// pixels to dst, or BGRA pixels when bgra is set.
+func paletteBatchToRGBA(dst, src []byte, n int, p *Palette, bgra bool) {
+	n = min(n, len(src), len(dst)/4)
+	for i := range n {
+		c := p[src[i]]
+		if bgra {
+			c = c&0xFF00FF00 | c>>16&0xFF | c&0xFF<<16
+		}
+		*(*uint32)(unsafe.Pointer(&dst[i*4])) = c
+	}
+}
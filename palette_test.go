@@ -0,0 +1,30 @@
+package grdp
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+func TestPaletteBitmap(t *testing.T) {
+	// Fast-path TS_UPDATE_PALETTE_DATA with two colours.
+	raw := []byte{0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x10, 0x20, 0x30, 0xFF, 0x00, 0x80}
+	var up pdu.PaletteUpdateDataPDU
+	if err := up.Unpack(bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if up.NumberColors != 2 || up.Entries[1] != (pdu.PaletteEntry{Red: 0xFF, Blue: 0x80}) {
+		t.Fatalf("palette update = %+v", up)
+	}
+
+	bm := Bitmap{Width: 3, Height: 1, BitsPerPixel: bpp(8), Data: []byte{0, 1, 2}, Palette: newPalette(up.Entries)}
+	img := bm.FillRGBA(nil)
+	want := []byte{0x10, 0x20, 0x30, 0xFF, 0xFF, 0x00, 0x80, 0xFF, 0, 0, 0, 0xFF}
+	if !bytes.Equal(img.Pix, want) {
+		t.Errorf("RGBA = % x, want % x", img.Pix, want)
+	}
+	if got := bm.FillBGRA(nil); !bytes.Equal(got[4:8], []byte{0x80, 0x00, 0xFF, 0xFF}) {
+		t.Errorf("BGRA = % x", got)
+	}
+}
@@ -0,0 +1,205 @@
+// Package pcapng writes the PDUs of a connection tapped with core.Tap to
+// a pcapng capture that Wireshark opens, with the payloads as they are
+// inside TLS: the decrypted TPKT frames and fast-path PDUs of the session.
+//
+// The PDUs are laid out as the segments of one TCP connection over IPv4
+// between the client at 10.0.0.1 port 49152 and the server at 10.0.0.2
+// port 3389, the layer of each PDU in the packet comment.  Standard RDP
+// Security, the legacy encryption of the RDP security layer, is not
+// removed.
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/nakagami/grdp/core"
+)
+
+const (
+	blockSectionHeader         = 0x0A0D0D0A
+	blockInterface             = 0x00000001
+	blockEnhancedPacket        = 0x00000006
+	byteOrderMagic             = 0x1A2B3C4D
+	linkTypeRaw                = 101 // raw IPv4 or IPv6 packets
+	optEnd                     = 0
+	optComment                 = 1
+	optShbUserAppl             = 4
+	optEpbFlags                = 2
+	epbFlagsInbound            = 1
+	epbFlagsOutbound           = 2
+	ipHeaderSize               = 20
+	tcpHeaderSize              = 20
+	maxSegment                 = 0xFFFF - ipHeaderSize - tcpHeaderSize
+	clientPort          uint16 = 49152
+	serverPort          uint16 = 3389
+)
+
+var (
+	clientAddr = [4]byte{10, 0, 0, 1}
+	serverAddr = [4]byte{10, 0, 0, 2}
+)
+
+// Writer writes a capture.  It implements core.Tap; give it to
+// grdp.WithTap.
+type Writer struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+	// seq is the next TCP sequence number of the client and the server.
+	seq [2]uint32
+	buf bytes.Buffer
+}
+
+// NewWriter writes the header of a capture to w.  Each packet is written
+// to w with a single Write as it is tapped, so a capture cut short still
+// holds the packets before the cut.
+func NewWriter(w io.Writer) (*Writer, error) {
+	pw := &Writer{w: w, seq: [2]uint32{1, 1}}
+	var shb, idb bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&shb, le, uint32(byteOrderMagic))
+	binary.Write(&shb, le, uint16(1)) // major version
+	binary.Write(&shb, le, uint16(0)) // minor version
+	binary.Write(&shb, le, int64(-1)) // section length: unspecified
+	writeOption(&shb, optShbUserAppl, []byte("grdp"))
+	writeOption(&shb, optEnd, nil)
+	pw.block(blockSectionHeader, shb.Bytes())
+	binary.Write(&idb, le, uint16(linkTypeRaw))
+	binary.Write(&idb, le, uint16(0)) // reserved
+	binary.Write(&idb, le, uint32(0)) // snap length: unlimited
+	pw.block(blockInterface, idb.Bytes())
+	if _, err := w.Write(pw.buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Capture writes p as one TCP segment, or several when it does not fit
+// in an IPv4 packet.  Once a write fails, Capture drops the packets and
+// Err reports the failure.
+func (w *Writer) Capture(p core.TapPDU) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+	w.buf.Reset()
+	for data := p.Data; ; {
+		n := min(len(data), maxSegment)
+		w.packet(p, data[:n])
+		data = data[n:]
+		if len(data) == 0 {
+			break
+		}
+	}
+	_, w.err = w.w.Write(w.buf.Bytes())
+}
+
+// Err returns the error of the write that failed, nil when none did.
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// packet buffers an Enhanced Packet Block holding segment.
+func (w *Writer) packet(p core.TapPDU, segment []byte) {
+	src, dst, sport, dport, from := clientAddr, serverAddr, clientPort, serverPort, 0
+	flags := uint32(epbFlagsOutbound)
+	if !p.Outbound {
+		src, dst, sport, dport, from = serverAddr, clientAddr, serverPort, clientPort, 1
+		flags = epbFlagsInbound
+	}
+	pkt := make([]byte, ipHeaderSize+tcpHeaderSize, ipHeaderSize+tcpHeaderSize+len(segment))
+	be := binary.BigEndian
+	// IPv4 header
+	pkt[0] = 0x45
+	be.PutUint16(pkt[2:], uint16(len(pkt)+len(segment)))
+	pkt[6] = 0x40 // don't fragment
+	pkt[8] = 64   // TTL
+	pkt[9] = 6    // TCP
+	copy(pkt[12:], src[:])
+	copy(pkt[16:], dst[:])
+	be.PutUint16(pkt[10:], checksum(0, pkt[:ipHeaderSize]))
+	// TCP header
+	tcp := pkt[ipHeaderSize:]
+	be.PutUint16(tcp[0:], sport)
+	be.PutUint16(tcp[2:], dport)
+	be.PutUint32(tcp[4:], w.seq[from])
+	be.PutUint32(tcp[8:], w.seq[1-from])
+	tcp[12] = tcpHeaderSize / 4 << 4
+	tcp[13] = 0x18 // PSH, ACK
+	be.PutUint16(tcp[14:], 0xFFFF)
+	pkt = append(pkt, segment...)
+	tcp = pkt[ipHeaderSize:]
+	var pseudo [12]byte
+	copy(pseudo[0:], src[:])
+	copy(pseudo[4:], dst[:])
+	pseudo[9] = 6
+	be.PutUint16(pseudo[10:], uint16(len(tcp)))
+	be.PutUint16(tcp[16:], checksum(sum(0, pseudo[:]), tcp))
+	w.seq[from] += uint32(len(segment))
+
+	var epb bytes.Buffer
+	le := binary.LittleEndian
+	us := uint64(p.Time.UnixMicro())
+	binary.Write(&epb, le, uint32(0)) // interface
+	binary.Write(&epb, le, uint32(us>>32))
+	binary.Write(&epb, le, uint32(us))
+	binary.Write(&epb, le, uint32(len(pkt)))
+	binary.Write(&epb, le, uint32(len(pkt)))
+	epb.Write(pkt)
+	pad(&epb, len(pkt))
+	var f [4]byte
+	le.PutUint32(f[:], flags)
+	writeOption(&epb, optEpbFlags, f[:])
+	writeOption(&epb, optComment, []byte(p.Layer))
+	writeOption(&epb, optEnd, nil)
+	w.block(blockEnhancedPacket, epb.Bytes())
+}
+
+// block buffers a block of type typ with body, a multiple of 4 bytes.
+func (w *Writer) block(typ uint32, body []byte) {
+	le := binary.LittleEndian
+	size := uint32(12 + len(body))
+	binary.Write(&w.buf, le, typ)
+	binary.Write(&w.buf, le, size)
+	w.buf.Write(body)
+	binary.Write(&w.buf, le, size)
+}
+
+func writeOption(b *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(b, binary.LittleEndian, code)
+	binary.Write(b, binary.LittleEndian, uint16(len(value)))
+	b.Write(value)
+	pad(b, len(value))
+}
+
+// pad pads b to a multiple of 4 bytes after n bytes of data.
+func pad(b *bytes.Buffer, n int) {
+	b.Write(make([]byte, -n&3))
+}
+
+// sum adds b to the ones' complement sum s of the Internet checksum.
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+// checksum returns the Internet checksum of b, s the sum of the data
+// before it.
+func checksum(s uint32, b []byte) uint16 {
+	s = sum(s, b)
+	for s > 0xFFFF {
+		s = s>>16 + s&0xFFFF
+	}
+	return ^uint16(s)
+}
@@ -0,0 +1,101 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+)
+
+func TestWriter(t *testing.T) {
+	var out bytes.Buffer
+	w, err := NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := []byte{3, 0, 0, 11, 6, 0xE0, 0, 0, 0, 0, 0}
+	w.Capture(core.TapPDU{Time: time.Unix(1, 0), Outbound: true, Layer: "x224", Data: request})
+	w.Capture(core.TapPDU{Time: time.Unix(2, 0), Layer: "fastpath", Data: make([]byte, 70000)})
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	le, be := binary.LittleEndian, binary.BigEndian
+	var types []uint32
+	var packets [][]byte
+	for b := out.Bytes(); len(b) > 0; {
+		typ, size := le.Uint32(b), le.Uint32(b[4:])
+		if size%4 != 0 || int(size) > len(b) || le.Uint32(b[size-4:]) != size {
+			t.Fatalf("block of type %d with size %d", typ, size)
+		}
+		types = append(types, typ)
+		if typ == blockEnhancedPacket {
+			n := le.Uint32(b[20:])
+			packets = append(packets, b[28:28+n])
+		}
+		b = b[size:]
+	}
+	if len(types) != 5 || types[0] != blockSectionHeader || types[1] != blockInterface {
+		t.Fatalf("blocks %v", types)
+	}
+
+	// the fast-path PDU is split in two segments from the server
+	var seq []uint32
+	for i, p := range packets {
+		if checksum(0, p[:ipHeaderSize]) != 0 {
+			t.Errorf("packet %d: bad IP checksum", i)
+		}
+		tcp := p[ipHeaderSize:]
+		seq = append(seq, be.Uint32(tcp[4:]))
+		if i > 0 && be.Uint16(tcp[0:]) != serverPort {
+			t.Errorf("packet %d from port %d", i, be.Uint16(tcp[0:]))
+		}
+	}
+	if !bytes.Equal(packets[0][ipHeaderSize+tcpHeaderSize:], request) {
+		t.Errorf("payload % x", packets[0][ipHeaderSize+tcpHeaderSize:])
+	}
+	if seq[0] != 1 || seq[1] != 1 || seq[2] != 1+maxSegment {
+		t.Errorf("sequence numbers %v", seq)
+	}
+}
+
+func TestReader(t *testing.T) {
+	request := []byte{3, 0, 0, 11, 6, 0xE0, 0, 0, 0, 0, 0}
+	data := make([]byte, 0xFFFF) // split in two segments
+	copy(data, []byte{3, 0, 0xFF, 0xFF, 2, 0xF0, 0x80})
+	update := make([]byte, 300)
+	copy(update, []byte{0, 0x81, 0x2C})
+	want := []core.TapPDU{
+		{Time: time.Unix(1, 0), Outbound: true, Layer: "x224", Data: request},
+		{Time: time.Unix(2, 5000), Layer: "mcs", Data: data},
+		{Time: time.Unix(3, 0), Layer: "fastpath", Data: update},
+	}
+	var out bytes.Buffer
+	w, err := NewWriter(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range want {
+		w.Capture(p)
+	}
+
+	r, err := NewReader(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, w := range want {
+		p, err := r.Next()
+		if err != nil {
+			t.Fatalf("PDU %d: %v", i, err)
+		}
+		if !p.Time.Equal(w.Time) || p.Outbound != w.Outbound || p.Layer != w.Layer || !bytes.Equal(p.Data, w.Data) {
+			t.Errorf("PDU %d: %v %v %s %d bytes", i, p.Time, p.Outbound, p.Layer, len(p.Data))
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("after the last PDU: %v", err)
+	}
+}
@@ -0,0 +1,314 @@
+package pcapng
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+)
+
+const (
+	linkTypeEthernet = 1
+	linkTypeLinuxSLL = 113
+	optIfTsresol     = 9
+	maxBlock         = 16 << 20
+)
+
+// Reader reads the PDUs of an RDP connection back from a pcapng capture:
+// one written by Writer, or a capture of a connection without TLS, whose
+// frames are readable on the wire.  It follows the first TCP connection to
+// port 3389 over IPv4, on raw IP, Ethernet or Linux cooked captures,
+// reassembles the two directions of its stream and splits them into the
+// TPKT frames and fast-path PDUs Writer taps; the packets of other
+// connections are skipped.
+type Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	// links holds the link type and timestamp resolution of the
+	// interfaces of the current section.
+	links []link
+	conn  *[2]uint16 // client and server port of the connection followed
+	// streams holds the bytes of the client and the server not yet
+	// framed.
+	streams [2]stream
+	queue   []core.TapPDU
+}
+
+type link struct {
+	typ   uint16
+	tsres byte // if_tsresol: 10^-n seconds a tick, 2^-n with the high bit
+}
+
+// time converts timestamp ts of the interface.
+func (l link) time(ts uint64) time.Time {
+	if l.tsres <= 9 {
+		return time.Unix(0, int64(ts)*int64(math.Pow10(9-int(l.tsres))))
+	}
+	unit := math.Pow(2, -float64(l.tsres&0x7F))
+	if l.tsres&0x80 == 0 {
+		unit = math.Pow10(-int(l.tsres))
+	}
+	return time.Unix(0, int64(float64(ts)*unit*float64(time.Second)))
+}
+
+type stream struct {
+	started bool
+	next    uint32 // TCP sequence number of the next byte
+	buf     []byte
+}
+
+// NewReader reads the Section Header Block at the start of r.
+func NewReader(r io.Reader) (*Reader, error) {
+	pr := &Reader{r: bufio.NewReader(r)}
+	typ, _, err := pr.block()
+	if err != nil {
+		return nil, fmt.Errorf("[pcapng err] %w", err)
+	}
+	if typ != blockSectionHeader {
+		return nil, errors.New("[pcapng err] not a pcapng capture")
+	}
+	return pr, nil
+}
+
+// Next returns the next PDU of the connection, in the order its last
+// byte was captured, timestamped with that packet.  It returns io.EOF at
+// the end of the capture.  A stream missing a segment or holding bytes
+// that are neither TPKT nor fast-path, such as the TLS records of an
+// encrypted connection, is an error.
+func (r *Reader) Next() (core.TapPDU, error) {
+	for len(r.queue) == 0 {
+		typ, body, err := r.block()
+		if err == io.EOF {
+			return core.TapPDU{}, io.EOF
+		}
+		if err != nil {
+			return core.TapPDU{}, fmt.Errorf("[pcapng err] %w", err)
+		}
+		switch typ {
+		case blockSectionHeader:
+			r.links = r.links[:0]
+		case blockInterface:
+			r.addInterface(body)
+		case blockEnhancedPacket:
+			if err := r.packet(body); err != nil {
+				return core.TapPDU{}, fmt.Errorf("[pcapng err] %w", err)
+			}
+		}
+	}
+	p := r.queue[0]
+	r.queue = r.queue[1:]
+	return p, nil
+}
+
+// block reads a block and returns its type and body.  A Section Header
+// Block sets the byte order of the blocks after it.
+func (r *Reader) block() (uint32, []byte, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r.r, hdr[:8]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated block")
+		}
+		return 0, nil, err
+	}
+	if binary.LittleEndian.Uint32(hdr[:]) == blockSectionHeader {
+		if _, err := io.ReadFull(r.r, hdr[8:]); err != nil {
+			return 0, nil, errors.New("truncated section header")
+		}
+		switch {
+		case binary.LittleEndian.Uint32(hdr[8:]) == byteOrderMagic:
+			r.order = binary.LittleEndian
+		case binary.BigEndian.Uint32(hdr[8:]) == byteOrderMagic:
+			r.order = binary.BigEndian
+		default:
+			return 0, nil, errors.New("bad byte-order magic")
+		}
+	} else if r.order == nil {
+		return 0, nil, errors.New("not a pcapng capture")
+	}
+	typ, size := r.order.Uint32(hdr[:]), r.order.Uint32(hdr[4:])
+	read := uint32(8)
+	if typ == blockSectionHeader {
+		read = 12
+	}
+	if size < read+4 || size%4 != 0 || size > maxBlock {
+		return 0, nil, fmt.Errorf("block 0x%08x: bad length %d", typ, size)
+	}
+	body := make([]byte, size-read)
+	if _, err := io.ReadFull(r.r, body); err != nil {
+		return 0, nil, fmt.Errorf("block 0x%08x: truncated", typ)
+	}
+	if r.order.Uint32(body[len(body)-4:]) != size {
+		return 0, nil, fmt.Errorf("block 0x%08x: trailing length mismatch", typ)
+	}
+	return typ, body[:len(body)-4], nil
+}
+
+// addInterface records the link type and timestamp resolution of an
+// Interface Description Block.
+func (r *Reader) addInterface(body []byte) {
+	l := link{tsres: 6}
+	if len(body) >= 8 {
+		l.typ = r.order.Uint16(body)
+		for opts := body[8:]; len(opts) >= 4; {
+			code, n := r.order.Uint16(opts), int(r.order.Uint16(opts[2:]))
+			if code == optEnd || 4+n > len(opts) {
+				break
+			}
+			if code == optIfTsresol && n >= 1 {
+				l.tsres = opts[4]
+			}
+			opts = opts[4+n+(-n&3):]
+		}
+	}
+	r.links = append(r.links, l)
+}
+
+// packet takes the TCP payload of an Enhanced Packet Block.
+func (r *Reader) packet(body []byte) error {
+	if len(body) < 20 {
+		return errors.New("truncated enhanced packet block")
+	}
+	iface := int(r.order.Uint32(body))
+	ts := uint64(r.order.Uint32(body[4:]))<<32 | uint64(r.order.Uint32(body[8:]))
+	n := int(r.order.Uint32(body[12:]))
+	if iface >= len(r.links) || n > len(body)-20 {
+		return errors.New("bad enhanced packet block")
+	}
+	l := r.links[iface]
+	ip, ok := network(l.typ, body[20:20+n])
+	if !ok || len(ip) < ipHeaderSize || ip[0]>>4 != 4 || ip[9] != 6 {
+		return nil
+	}
+	ihl := int(ip[0]&0x0F) * 4
+	total := int(binary.BigEndian.Uint16(ip[2:]))
+	if ihl < ipHeaderSize || total < ihl || total > len(ip) {
+		return nil
+	}
+	tcp := ip[ihl:total]
+	if len(tcp) < tcpHeaderSize {
+		return nil
+	}
+	off := int(tcp[12]>>4) * 4
+	if off < tcpHeaderSize || off > len(tcp) {
+		return nil
+	}
+	be := binary.BigEndian
+	sport, dport := be.Uint16(tcp), be.Uint16(tcp[2:])
+	if r.conn == nil {
+		switch {
+		case dport == serverPort:
+			r.conn = &[2]uint16{sport, dport}
+		case sport == serverPort:
+			r.conn = &[2]uint16{dport, sport}
+		default:
+			return nil
+		}
+	}
+	from := 0
+	switch {
+	case sport == r.conn[0] && dport == r.conn[1]:
+	case sport == r.conn[1] && dport == r.conn[0]:
+		from = 1
+	default:
+		return nil
+	}
+	s := &r.streams[from]
+	seq, payload := be.Uint32(tcp[4:]), tcp[off:]
+	if tcp[13]&0x02 != 0 { // SYN
+		s.started, s.next = true, seq+1
+		return nil
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	if !s.started {
+		s.started, s.next = true, seq
+	}
+	// a retransmission repeats bytes already taken
+	if d := int32(s.next - seq); d > 0 {
+		if int(d) >= len(payload) {
+			return nil
+		}
+		payload, seq = payload[d:], s.next
+	}
+	if seq != s.next {
+		return fmt.Errorf("%d bytes missing from the TCP stream", seq-s.next)
+	}
+	s.next += uint32(len(payload))
+	s.buf = append(s.buf, payload...)
+	return r.frame(s, from == 0, l.time(ts))
+}
+
+// network returns the IP packet of a frame of link type typ.
+func network(typ uint16, frame []byte) ([]byte, bool) {
+	switch typ {
+	case linkTypeRaw:
+		return frame, true
+	case linkTypeEthernet:
+		off := 12
+		for len(frame) >= off+2 && binary.BigEndian.Uint16(frame[off:]) == 0x8100 { // VLAN tag
+			off += 4
+		}
+		if len(frame) < off+2 || binary.BigEndian.Uint16(frame[off:]) != 0x0800 {
+			return nil, false
+		}
+		return frame[off+2:], true
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 || binary.BigEndian.Uint16(frame[14:]) != 0x0800 {
+			return nil, false
+		}
+		return frame[16:], true
+	}
+	return nil, false
+}
+
+// frame queues the complete PDUs at the start of the stream.
+func (r *Reader) frame(s *stream, outbound bool, t time.Time) error {
+	for len(s.buf) >= 2 {
+		var n int
+		switch s.buf[0] & 0x3 {
+		case 0x3: // FASTPATH_ACTION_X224
+			if len(s.buf) < 4 {
+				return nil
+			}
+			n = int(binary.BigEndian.Uint16(s.buf[2:]))
+		case 0x0: // FASTPATH_ACTION_FASTPATH
+			n = int(s.buf[1])
+			if n&0x80 != 0 {
+				if len(s.buf) < 3 {
+					return nil
+				}
+				n = (n&0x7F)<<8 | int(s.buf[2])
+			}
+		default:
+			return fmt.Errorf("byte 0x%02x starts neither a TPKT frame nor a fast-path PDU", s.buf[0])
+		}
+		if n < 4 {
+			return fmt.Errorf("PDU of bad length %d", n)
+		}
+		if len(s.buf) < n {
+			return nil
+		}
+		data := append([]byte(nil), s.buf[:n]...)
+		s.buf = s.buf[n:]
+		r.queue = append(r.queue, core.TapPDU{Time: t, Outbound: outbound, Layer: layer(data), Data: data})
+	}
+	return nil
+}
+
+// layer names the layer of a frame as core.TapPDU does.
+func layer(frame []byte) string {
+	if frame[0]&0x3 != 0x3 {
+		return "fastpath"
+	}
+	// the TPDU code follows the TPKT header and the length indicator
+	if len(frame) > 5 && frame[5] == 0xF0 {
+		return "mcs"
+	}
+	return "x224"
+}
@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"fmt"
 	"log/slog"
-	"slices"
 	"sync"
 	"unsafe"
 
@@ -13,11 +12,9 @@ import (
 	"github.com/nakagami/grdp/emission"
 )
 
-// chunkBufPool reuses the header+payload buffers for outbound channel chunks.
+// chunkBufs reuses the header+payload buffers for outbound channel chunks.
 // Each buffer is pre-sized to the largest possible chunk (8-byte header + 1600 bytes data).
-var chunkBufPool = sync.Pool{
-	New: func() any { return make([]byte, 0, 8+CHANNEL_CHUNK_LENGTH) },
-}
+var chunkBufs = core.NewBufferPool(8+CHANNEL_CHUNK_LENGTH, 8+CHANNEL_CHUNK_LENGTH)
 
 const (
 	CHANNEL_RC_OK                         = 0
@@ -203,6 +200,24 @@ const (
 	CHANNEL_FLAG_SHOW_PROTOCOL = 0x10
 )
 
+/**
+ * Bulk compression of channel chunks, the PACKET_* flags of core shifted
+ * into the upper half of the CHANNEL_PDU_HEADER flags (MS-RDPBCGR 2.2.6.1.1)
+ */
+const (
+	CHANNEL_PACKET_COMPRESSED = 0x00200000
+	CHANNEL_PACKET_AT_FRONT   = 0x00400000
+	CHANNEL_PACKET_FLUSHED    = 0x00800000
+)
+
+// maxChannelPDU caps the totalLength reserved up front for a chunked
+// channel PDU; larger PDUs grow the buffer as chunks arrive.
+const maxChannelPDU = 1 << 20
+
+// maxChannelMessage bounds the totalLength of a chunked channel PDU, so
+// that a server cannot make the client buffer without limit.
+const maxChannelMessage = 64 << 20
+
 type ChannelTransport interface {
 	GetType() (string, uint32)
 	Sender(core.ChannelSender)
@@ -215,10 +230,20 @@ type ChannelClient struct {
 
 type Channels struct {
 	emission.Emitter
-	channels      map[string]ChannelClient
-	transport     core.Transport
-	buff          *bytes.Buffer
+	channels  map[string]ChannelClient
+	transport core.Transport
+	// pending holds the chunks received so far of each channel's PDU.
+	pending map[string]*pendingPDU
+	// budget holds the totalLength of the pending PDUs.
+	budget *core.Budget
+	// bulk decompresses the chunks the server compressed; all channels
+	// share one history.
+	bulk          *core.BulkDecompressor
 	channelSender core.ChannelSender
+	// sendMu keeps the chunks of one PDU together when several goroutines
+	// write to the channels.
+	sendMu sync.Mutex
+	log    *slog.Logger
 }
 
 func NewChannels(t core.Transport) *Channels {
@@ -226,12 +251,26 @@ func NewChannels(t core.Transport) *Channels {
 		Emitter:   *emission.NewEmitter(),
 		channels:  make(map[string]ChannelClient, 20),
 		transport: t,
-		buff:      &bytes.Buffer{},
+		pending:   make(map[string]*pendingPDU),
+		bulk:      core.NewBulkDecompressor(),
+		log:       core.Logger(nil, "channels"),
 	}
 	t.On("channel", c.process)
 	return c
 }
 
+// SetLogger makes the channels log to l, with the attribute
+// layer=channels.
+func (c *Channels) SetLogger(l *slog.Logger) {
+	c.log = core.Logger(l, "channels")
+}
+
+// SetBudget makes the channels reserve the length of the PDUs they
+// reassemble from b, and drop those that do not fit.
+func (c *Channels) SetBudget(b *core.Budget) {
+	c.budget = b
+}
+
 func (c *Channels) SetChannelSender(f core.ChannelSender) {
 	c.channelSender = f
 }
@@ -239,17 +278,19 @@ func (c *Channels) Register(t ChannelTransport) {
 	name, option := t.GetType()
 	_, ok := c.channels[name]
 	if ok {
-		slog.Warn("Already register", "channel", name)
+		c.log.Warn("Already register", core.LogChannel, name)
 		return
 	}
 	t.Sender(c)
 	c.channels[name] = ChannelClient{ChannelDef{name, option}, t}
 }
 
+// SendToChannel sends s to channel, split into CHANNEL_CHUNK_LENGTH
+// chunks flagged CHANNEL_FLAG_FIRST and CHANNEL_FLAG_LAST.
 func (c *Channels) SendToChannel(channel string, s []byte) (int, error) {
 	cli, ok := c.channels[channel]
 	if !ok {
-		slog.Warn("No register", "channel", channel)
+		c.log.Warn("No register", core.LogChannel, channel)
 		return 0, fmt.Errorf("No register channel: %s", channel)
 	}
 	totalLen := len(s)
@@ -257,52 +298,110 @@ func (c *Channels) SendToChannel(channel string, s []byte) (int, error) {
 	if cli.Options&CHANNEL_OPTION_SHOW_PROTOCOL != 0 {
 		baseFlag |= CHANNEL_FLAG_SHOW_PROTOCOL
 	}
-	buf := chunkBufPool.Get().([]byte)
-	first := true
-	remaining := totalLen
-	for chunk := range slices.Chunk(s, CHANNEL_CHUNK_LENGTH) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	buf := chunkBufs.Get(0)
+	defer buf.Release()
+	for off := 0; off == 0 || off < totalLen; off += CHANNEL_CHUNK_LENGTH {
+		chunk := s[off:min(off+CHANNEL_CHUNK_LENGTH, totalLen)]
 		flag := baseFlag
-		if first {
+		if off == 0 {
 			flag |= CHANNEL_FLAG_FIRST
-			first = false
 		}
-		remaining -= len(chunk)
-		if remaining == 0 {
+		if off+len(chunk) == totalLen {
 			flag |= CHANNEL_FLAG_LAST
 		}
-		slog.Debug("SendToChannel", "len", len(chunk), "flag", flag)
-		buf = buf[:8+len(chunk)]
-		binary.LittleEndian.PutUint32(buf[0:], uint32(totalLen))
-		binary.LittleEndian.PutUint32(buf[4:], flag)
-		copy(buf[8:], chunk)
-		c.channelSender.SendToChannel(channel, buf)
+		c.log.Debug("SendToChannel", "len", len(chunk), "flag", flag)
+		b := buf.B[:8+len(chunk)]
+		binary.LittleEndian.PutUint32(b[0:], uint32(totalLen))
+		binary.LittleEndian.PutUint32(b[4:], flag)
+		copy(b[8:], chunk)
+		if _, err := c.channelSender.SendToChannel(channel, b); err != nil {
+			return off, err
+		}
 	}
-	chunkBufPool.Put(buf[:0])
-	return 0, nil
+	return totalLen, nil
 }
 
+// process handles one chunk received on channel: it decompresses it if
+// needed and passes the PDU to the channel once its last chunk is in.
+// Each channel reassembles separately, so chunks of different channels
+// may interleave.
 func (c *Channels) process(channel string, s []byte) {
 	cli, ok := c.channels[channel]
 	if !ok {
-		slog.Warn("process No found channel", "channel", channel)
+		c.log.Warn("process No found channel", core.LogChannel, channel)
 		return
 	}
 	if len(s) < 8 {
 		return
 	}
-	// Parse 8-byte header directly: totalLen(4) + flags(4)
-	flags := uint32(s[4]) | uint32(s[5])<<8 | uint32(s[6])<<16 | uint32(s[7])<<24
+	totalLen := int(binary.LittleEndian.Uint32(s))
+	flags := binary.LittleEndian.Uint32(s[4:])
 	payload := s[8:]
-	if flags&CHANNEL_FLAG_FIRST == 0 || flags&CHANNEL_FLAG_LAST == 0 {
-		if flags&CHANNEL_FLAG_FIRST != 0 {
-			c.buff.Reset()
+	if flags&(CHANNEL_PACKET_COMPRESSED|CHANNEL_PACKET_AT_FRONT|CHANNEL_PACKET_FLUSHED) != 0 {
+		var err error
+		payload, err = c.bulk.Decompress(byte(flags>>16), payload)
+		if err != nil {
+			c.log.Warn("channel chunk decompression failed", core.LogChannel, channel, "err", err)
+			c.drop(channel)
+			return
+		}
+	}
+
+	if flags&CHANNEL_FLAG_FIRST != 0 && flags&CHANNEL_FLAG_LAST != 0 {
+		c.drop(channel)
+		// s is a slice of the frame the transport read, which it reuses
+		// once this returns, and the plugins may keep what they are given
+		cli.t.Process(bytes.Clone(payload))
+		return
+	}
+	p := c.pending[channel]
+	if flags&CHANNEL_FLAG_FIRST != 0 {
+		if p != nil {
+			c.log.Warn("channel PDU restarted before its last chunk", core.LogChannel, channel)
+			c.drop(channel)
+		}
+		if totalLen > maxChannelMessage {
+			c.log.Warn("channel PDU too long, dropped", core.LogChannel, channel, "total", totalLen)
+			return
 		}
-		c.buff.Write(payload)
-		if flags&CHANNEL_FLAG_LAST == 0 {
+		if err := c.budget.Reserve(totalLen); err != nil {
+			c.log.Warn("channel PDU dropped", core.LogChannel, channel, "err", err)
 			return
 		}
-		cli.t.Process(c.buff.Bytes())
-	} else {
-		cli.t.Process(payload)
+		p = &pendingPDU{buf: make([]byte, 0, min(totalLen, maxChannelPDU)), total: totalLen}
+		c.pending[channel] = p
+	} else if p == nil {
+		c.log.Warn("channel chunk without a first chunk", core.LogChannel, channel)
+		return
+	}
+	if len(p.buf)+len(payload) > p.total {
+		c.log.Warn("channel PDU longer than announced, dropped", core.LogChannel, channel, "total", p.total)
+		c.drop(channel)
+		return
+	}
+	p.buf = append(p.buf, payload...)
+	if flags&CHANNEL_FLAG_LAST == 0 {
+		return
+	}
+	c.drop(channel)
+	if len(p.buf) != p.total {
+		c.log.Warn("channel PDU length mismatch", core.LogChannel, channel, "got", len(p.buf), "want", p.total)
+	}
+	cli.t.Process(p.buf)
+}
+
+// pendingPDU is a chunked channel PDU whose last chunk has not arrived.
+type pendingPDU struct {
+	buf   []byte
+	total int // the totalLength of its first chunk, reserved from the budget
+}
+
+// drop forgets the pending PDU of channel.
+func (c *Channels) drop(channel string) {
+	if p := c.pending[channel]; p != nil {
+		c.budget.Release(p.total)
+		delete(c.pending, channel)
 	}
 }
@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/testutil"
+)
+
+type testChannel struct {
+	name string
+	got  [][]byte
+}
+
+func (t *testChannel) GetType() (string, uint32) { return t.name, CHANNEL_OPTION_INITIALIZED }
+func (t *testChannel) Sender(core.ChannelSender) {}
+func (t *testChannel) Process(s []byte)          { t.got = append(t.got, bytes.Clone(s)) }
+
+type chunkRecorder struct{ chunks [][]byte }
+
+func (r *chunkRecorder) SendToChannel(channel string, s []byte) (int, error) {
+	r.chunks = append(r.chunks, bytes.Clone(s))
+	return len(s), nil
+}
+
+func chunk(total int, flags uint32, data []byte) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(total))
+	b = binary.LittleEndian.AppendUint32(b, flags)
+	return append(b, data...)
+}
+
+func TestChannelChunks(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewChannels(tr)
+	a, b := &testChannel{name: "cliprdr"}, &testChannel{name: "rdpdr"}
+	c.Register(a)
+	c.Register(b)
+	rec := &chunkRecorder{}
+	c.SetChannelSender(rec)
+
+	data := bytes.Repeat([]byte("0123456789"), 400)
+	if n, err := c.SendToChannel("cliprdr", data); err != nil || n != len(data) {
+		t.Fatalf("SendToChannel = %d, %v", n, err)
+	}
+	wantFlags := []uint32{CHANNEL_FLAG_FIRST, 0, CHANNEL_FLAG_LAST}
+	if len(rec.chunks) != len(wantFlags) {
+		t.Fatalf("got %d chunks, want %d", len(rec.chunks), len(wantFlags))
+	}
+	var sent []byte
+	for i, ch := range rec.chunks {
+		if total, flags := binary.LittleEndian.Uint32(ch), binary.LittleEndian.Uint32(ch[4:]); total != 4000 || flags != wantFlags[i] {
+			t.Errorf("chunk %d: totalLength %d flags %#x", i, total, flags)
+		}
+		sent = append(sent, ch[8:]...)
+	}
+	if !bytes.Equal(sent, data) {
+		t.Error("chunks do not add up to the data")
+	}
+
+	// Chunks of two channels interleaved.
+	tr.Emit("channel", "cliprdr", chunk(4000, CHANNEL_FLAG_FIRST, data[:1600]))
+	tr.Emit("channel", "rdpdr", chunk(3, CHANNEL_FLAG_FIRST|CHANNEL_FLAG_LAST, []byte("abc")))
+	tr.Emit("channel", "cliprdr", chunk(4000, 0, data[1600:3200]))
+	tr.Emit("channel", "rdpdr", chunk(4, CHANNEL_FLAG_FIRST, []byte("de")))
+	tr.Emit("channel", "cliprdr", chunk(4000, CHANNEL_FLAG_LAST, data[3200:]))
+	tr.Emit("channel", "rdpdr", chunk(4, CHANNEL_FLAG_LAST, []byte("fg")))
+	if len(a.got) != 1 || !bytes.Equal(a.got[0], data) {
+		t.Errorf("cliprdr got %d PDUs", len(a.got))
+	}
+	if len(b.got) != 2 || string(b.got[0]) != "abc" || string(b.got[1]) != "defg" {
+		t.Errorf("rdpdr got %q", b.got)
+	}
+
+	// A chunk whose first chunk was lost is dropped.
+	tr.Emit("channel", "rdpdr", chunk(4, CHANNEL_FLAG_LAST, []byte("hi")))
+	if len(b.got) != 2 {
+		t.Errorf("orphan chunk delivered: %q", b.got[2:])
+	}
+
+	// The announced lengths are reserved from the budget, and a PDU that
+	// does not fit or runs past its length is dropped.
+	budget := core.NewBudget(8)
+	c.SetBudget(budget)
+	tr.Emit("channel", "rdpdr", chunk(9, CHANNEL_FLAG_FIRST, []byte("jk")))
+	tr.Emit("channel", "rdpdr", chunk(4, CHANNEL_FLAG_FIRST, []byte("lm")))
+	if budget.Used() != 4 {
+		t.Errorf("%d bytes of the budget used", budget.Used())
+	}
+	tr.Emit("channel", "rdpdr", chunk(4, CHANNEL_FLAG_LAST, []byte("nop")))
+	if len(b.got) != 2 || budget.Used() != 0 {
+		t.Errorf("overlong PDU: got %q, %d bytes of the budget used", b.got[2:], budget.Used())
+	}
+}
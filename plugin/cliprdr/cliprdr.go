@@ -20,12 +20,14 @@ type CliprdrClient struct {
 	hasHugeFileSupport    bool
 	formatIdMap           map[uint32]uint32
 	reply                 chan []byte
+	log                   *slog.Logger
 }
 
 func NewCliprdrClient() *CliprdrClient {
 	c := &CliprdrClient{
 		formatIdMap: make(map[uint32]uint32, 20),
 		reply:       make(chan []byte, 100),
+		log:         core.Logger(nil, "cliprdr"),
 	}
 
 	go ClipWatcher(c)
@@ -33,6 +35,11 @@ func NewCliprdrClient() *CliprdrClient {
 	return c
 }
 
+// SetLogger makes the client log to l, with the attribute layer=cliprdr.
+func (c *CliprdrClient) SetLogger(l *slog.Logger) {
+	c.log = core.Logger(l, "cliprdr")
+}
+
 func (c *CliprdrClient) Sender(f core.ChannelSender) {
 	c.w = f
 }
@@ -46,53 +53,53 @@ func (c *CliprdrClient) Process(s []byte) {
 	msgType, _ := core.ReadUint16LE(r)
 	flag, _ := core.ReadUint16LE(r)
 	length, _ := core.ReadUInt32LE(r)
-	slog.Debug(fmt.Sprintf("cliprdr: type=0x%x flag=%d length=%d, all=%d", msgType, flag, length, r.Len()))
+	c.log.Debug(fmt.Sprintf("cliprdr: type=0x%x flag=%d length=%d, all=%d", msgType, flag, length, r.Len()))
 
 	b, _ := core.ReadBytes(int(length), r)
 
 	switch msgType {
 	case CB_CLIP_CAPS:
-		slog.Debug("CB_CLIP_CAPS")
+		c.log.Debug("CB_CLIP_CAPS")
 		c.processClipCaps(b)
 
 	case CB_MONITOR_READY:
-		slog.Debug("CB_MONITOR_READY")
+		c.log.Debug("CB_MONITOR_READY")
 		c.processMonitorReady(b)
 
 	case CB_FORMAT_LIST:
-		slog.Debug("CB_FORMAT_LIST")
+		c.log.Debug("CB_FORMAT_LIST")
 		c.processFormatList(b)
 
 	case CB_FORMAT_LIST_RESPONSE:
-		slog.Debug("CB_FORMAT_LIST_RESPONSE")
+		c.log.Debug("CB_FORMAT_LIST_RESPONSE")
 		c.processFormatListResponse(flag, b)
 
 	case CB_FORMAT_DATA_REQUEST:
-		slog.Debug("CB_FORMAT_DATA_REQUEST")
+		c.log.Debug("CB_FORMAT_DATA_REQUEST")
 		c.processFormatDataRequest(b)
 
 	case CB_FORMAT_DATA_RESPONSE:
-		slog.Debug("CB_FORMAT_DATA_RESPONSE")
+		c.log.Debug("CB_FORMAT_DATA_RESPONSE")
 		c.processFormatDataResponse(flag, b)
 
 	case CB_FILECONTENTS_REQUEST:
-		slog.Debug("CB_FILECONTENTS_REQUEST")
+		c.log.Debug("CB_FILECONTENTS_REQUEST")
 		c.processFileContentsRequest(b)
 
 	case CB_FILECONTENTS_RESPONSE:
-		slog.Debug("CB_FILECONTENTS_RESPONSE")
+		c.log.Debug("CB_FILECONTENTS_RESPONSE")
 		c.processFileContentsResponse(flag, b)
 
 	case CB_LOCK_CLIPDATA:
-		slog.Debug("CB_LOCK_CLIPDATA")
+		c.log.Debug("CB_LOCK_CLIPDATA")
 		c.processLockClipData(b)
 
 	case CB_UNLOCK_CLIPDATA:
-		slog.Debug("CB_UNLOCK_CLIPDATA")
+		c.log.Debug("CB_UNLOCK_CLIPDATA")
 		c.processUnlockClipData(b)
 
 	default:
-		slog.Error(fmt.Sprintf("type 0x%x not supported", msgType))
+		c.log.Error(fmt.Sprintf("type 0x%x not supported", msgType))
 	}
 }
 func (c *CliprdrClient) processClipCaps(b []byte) {
@@ -100,20 +107,20 @@ func (c *CliprdrClient) processClipCaps(b []byte) {
 	var cp CliprdrCapabilitiesPDU
 	err := struc.Unpack(r, &cp)
 	if err != nil {
-		slog.Error("Failed to unpack", "error", err)
+		c.log.Error("Failed to unpack", "error", err)
 		return
 	}
-	slog.Debug(fmt.Sprintf("Capabilities:%+v", cp))
+	c.log.Debug(fmt.Sprintf("Capabilities:%+v", cp))
 	c.useLongFormatNames = cp.CapabilitySets[0].GeneralFlags&CB_USE_LONG_FORMAT_NAMES != 0
 	c.streamFileClipEnabled = cp.CapabilitySets[0].GeneralFlags&CB_STREAM_FILECLIP_ENABLED != 0
 	c.fileClipNoFilePaths = cp.CapabilitySets[0].GeneralFlags&CB_FILECLIP_NO_FILE_PATHS != 0
 	c.canLockClipData = cp.CapabilitySets[0].GeneralFlags&CB_CAN_LOCK_CLIPDATA != 0
 	c.hasHugeFileSupport = cp.CapabilitySets[0].GeneralFlags&CB_HUGE_FILE_SUPPORT_ENABLED != 0
-	slog.Debug("UseLongFormatNames", "value", c.useLongFormatNames)
-	slog.Debug("StreamFileClipEnabled", "value", c.streamFileClipEnabled)
-	slog.Debug("FileClipNoFilePaths", "value", c.fileClipNoFilePaths)
-	slog.Debug("CanLockClipData", "value", c.canLockClipData)
-	slog.Debug("HasHugeFileSupport", "value", c.hasHugeFileSupport)
+	c.log.Debug("UseLongFormatNames", "value", c.useLongFormatNames)
+	c.log.Debug("StreamFileClipEnabled", "value", c.streamFileClipEnabled)
+	c.log.Debug("FileClipNoFilePaths", "value", c.fileClipNoFilePaths)
+	c.log.Debug("CanLockClipData", "value", c.canLockClipData)
+	c.log.Debug("HasHugeFileSupport", "value", c.hasHugeFileSupport)
 }
 
 func (c *CliprdrClient) processMonitorReady(b []byte) {
@@ -124,16 +131,16 @@ func (c *CliprdrClient) processMonitorReady(b []byte) {
 func (c *CliprdrClient) processFormatList(b []byte) {
 	EmptyClipboard()
 	fl, _ := c.readFormatList(b)
-	slog.Debug("numFormats", "count", fl.NumFormats)
+	c.log.Debug("numFormats", "count", fl.NumFormats)
 	c.sendFormatListResponse(CB_RESPONSE_OK)
 }
 
 func (c *CliprdrClient) processFormatListResponse(flag uint16, b []byte) {
 	if flag != CB_RESPONSE_OK {
-		slog.Error("Format List Response Failed")
+		c.log.Error("Format List Response Failed")
 		return
 	}
-	slog.Debug("Format List Response OK")
+	c.log.Debug("Format List Response OK")
 }
 
 func (c *CliprdrClient) processFormatDataRequest(b []byte) {
@@ -143,7 +150,7 @@ func (c *CliprdrClient) processFormatDataRequest(b []byte) {
 	buff := &bytes.Buffer{}
 	// Text-only: directly get clipboard data for any text format
 	data := GetClipboardText()
-	slog.Debug("clipboard data", "content", data)
+	c.log.Debug("clipboard data", "content", data)
 	buff.Write(core.UnicodeEncode(data))
 	buff.Write([]byte{0, 0})
 
@@ -151,14 +158,14 @@ func (c *CliprdrClient) processFormatDataRequest(b []byte) {
 }
 func (c *CliprdrClient) processFormatDataResponse(flag uint16, b []byte) {
 	if flag != CB_RESPONSE_OK {
-		slog.Error("Format Data Response Failed")
+		c.log.Error("Format Data Response Failed")
 	}
 	c.reply <- b
 }
 
 func (c *CliprdrClient) processFileContentsRequest(b []byte) {
 	// Text-only mode doesn't support file transfer
-	slog.Debug("File transfer not supported in text-only mode")
+	c.log.Debug("File transfer not supported in text-only mode")
 }
 
 func (c *CliprdrClient) processFileContentsResponse(flag uint16, b []byte) {
@@ -177,7 +184,7 @@ func (c *CliprdrClient) processUnlockClipData(b []byte) {
 }
 
 func (c *CliprdrClient) sendClientCapabilitiesPDU() {
-	slog.Debug("Send Client Clipboard Capabilities PDU (text-only mode)")
+	c.log.Debug("Send Client Clipboard Capabilities PDU (text-only mode)")
 	var cs CliprdrGeneralCapabilitySet
 	cs.CapabilitySetLength = 12
 	cs.CapabilitySetType = CB_CAPSTYPE_GENERAL
@@ -192,13 +199,13 @@ func (c *CliprdrClient) sendClientCapabilitiesPDU() {
 }
 
 func (c *CliprdrClient) sendTemporaryDirectoryPDU() {
-	slog.Debug("Send Temporary Directory PDU (ignored in text-only mode)")
+	c.log.Debug("Send Temporary Directory PDU (ignored in text-only mode)")
 }
 
 func (c *CliprdrClient) sendFormatListPDU() {
-	slog.Debug("Send Format List PDU (text formats only)")
+	c.log.Debug("Send Format List PDU (text formats only)")
 	formats := GetFormatList()
-	slog.Debug("available formats", "count", len(formats), "formats", formats)
+	c.log.Debug("available formats", "count", len(formats), "formats", formats)
 
 	body := &bytes.Buffer{}
 	for _, v := range formats {
@@ -231,10 +238,10 @@ func (c *CliprdrClient) readFormatList(b []byte) (*CliprdrFormatList, bool) {
 			bs = append(bs, b)
 		}
 		name := string(utf16.Decode(bs))
-		slog.Debug(fmt.Sprintf("Format:%d Name:<%s>", formatId, name))
+		c.log.Debug(fmt.Sprintf("Format:%d Name:<%s>", formatId, name))
 		if name != "" {
 			localId := RegisterClipboardFormat(name)
-			slog.Debug("format mapping", "local", localId, "remote", formatId)
+			c.log.Debug("format mapping", "local", localId, "remote", formatId)
 			c.formatIdMap[localId] = formatId
 		} else {
 			c.formatIdMap[formatId] = formatId
@@ -248,18 +255,18 @@ func (c *CliprdrClient) readFormatList(b []byte) (*CliprdrFormatList, bool) {
 }
 
 func (c *CliprdrClient) sendFormatListResponse(flags uint16) {
-	slog.Debug("Send Format List Response")
+	c.log.Debug("Send Format List Response")
 	sendClipPDU(c.w, CB_FORMAT_LIST_RESPONSE, flags, nil)
 }
 
 func (c *CliprdrClient) sendFormatDataRequest(id uint32) {
-	slog.Debug("Send Format Data Request")
+	c.log.Debug("Send Format Data Request")
 	body := &bytes.Buffer{}
 	core.WriteUInt32LE(id, body)
 	sendClipPDU(c.w, CB_FORMAT_DATA_REQUEST, 0, body.Bytes())
 }
 
 func (c *CliprdrClient) sendFormatDataResponse(b []byte) {
-	slog.Debug("Send Format Data Response")
+	c.log.Debug("Send Format Data Response")
 	sendClipPDU(c.w, CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_OK, b)
 }
@@ -1,10 +1,6 @@
 // Generic, OS-independent clipboard support with text format only
 package cliprdr
 
-import (
-	"log/slog"
-)
-
 // SimpleTextClipboard provides OS-independent text-only clipboard support
 type SimpleTextClipboard struct {
 	textContent string
@@ -20,7 +16,6 @@ func GetClipboardText() string {
 // SetClipboardText sets the clipboard text content
 func SetClipboardText(text string) {
 	textClipboard.textContent = text
-	slog.Debug("Text clipboard set", "length", len(text))
 }
 
 // GetFormatList returns available formats (text only in generic mode)
@@ -36,7 +31,6 @@ func GetFormatList() []CliprdrFormat {
 
 // ClipWatcher is a no-op in generic mode
 func ClipWatcher(c *CliprdrClient) {
-	slog.Debug("Generic clipboard watcher (text-only mode) started")
 	// In generic mode, we don't actively monitor system clipboard
 	// Format list is provided statically
 	select {} // Block indefinitely
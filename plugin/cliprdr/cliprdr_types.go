@@ -168,7 +168,7 @@ const (
 )
 
 // fileDescriptorZero is a reusable zero block for FileDescriptor padding writes.
-var fileDescriptorZero [512]byte
+var fileDescriptorZero [520]byte
 
 type FileGroupDescriptor struct {
 	CItems uint32           `struc:"little"`
@@ -185,7 +185,7 @@ type FileDescriptor struct {
 	LastWriteTime  []byte   `struc:"[8]byte"` //8
 	FileSizeHigh   uint32   `struc:"little"`
 	FileSizeLow    uint32   `struc:"little"`
-	FileName       []byte   `struc:"[512]byte"`
+	FileName       []byte   `struc:"[520]byte"`
 }
 
 func (f *FileGroupDescriptor) Unpack(b []byte) error {
@@ -203,7 +203,7 @@ func (f *FileDescriptor) serialize() []byte {
 	core.WriteUInt32LE(f.FileSizeHigh, b)
 	core.WriteUInt32LE(f.FileSizeLow, b)
 	b.Write(f.FileName)
-	if pad := 512 - len(f.FileName); pad > 0 {
+	if pad := 520 - len(f.FileName); pad > 0 {
 		b.Write(fileDescriptorZero[:pad])
 	}
 	return b.Bytes()
@@ -249,7 +249,9 @@ const (
 // Standard clipboard format IDs
 const (
 	CF_TEXT        = 1
+	CF_DIB         = 8
 	CF_UNICODETEXT = 13
+	CF_DIBV5       = 17
 )
 
 // lock or unlock
@@ -0,0 +1,500 @@
+package cliprdr
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FORMAT_NAME_FILES is the registered format of a file list, a
+// CLIPRDR_FILELIST of FILEDESCRIPTORW (MS-RDPECLIP 2.2.5.2.3).
+const FORMAT_NAME_FILES = "FileGroupDescriptorW"
+
+// localFormatFiles is the ID under which the client offers file lists.
+const localFormatFiles = 0xC0F2
+
+const (
+	fileDescriptorSize     = 592
+	fileNameChars          = 260
+	FILE_ATTRIBUTE_ARCHIVE = 0x00000020
+)
+
+// fileContentsChunk is the size of the ranges ReadFile asks for; one
+// range of a file is in flight at a time, so a paste of any size holds
+// at most this much.
+const fileContentsChunk = 64 * 1024
+
+// maxFileContentsRange caps the range served for one FileContents
+// Request, and maxFileContentsServed the requests served at once; the
+// server gets a shorter range or waits.
+const (
+	maxFileContentsRange  = 8 << 20
+	maxFileContentsServed = 4
+)
+
+// FileInfo describes a file or directory of a clipboard file list.
+type FileInfo struct {
+	// Name is the path relative to the copied set, with "/" or "\"
+	// separators; a directory comes before the files in it.
+	Name    string
+	Size    int64
+	IsDir   bool
+	ModTime time.Time
+}
+
+// FileProvider supplies the files the client offers on its clipboard;
+// grdp never opens local files itself.  Its methods are called from
+// goroutines serving the server's FileContents Requests.
+type FileProvider interface {
+	// Files lists the files and directories offered.
+	Files() []FileInfo
+	// ReadFileAt reads from the file at index of Files, like io.ReaderAt.
+	ReadFileAt(index int, p []byte, off int64) (int, error)
+}
+
+// FileSink receives the files pasted from the server clipboard.
+type FileSink interface {
+	// CreateFile returns where to write the contents of f, or nil to
+	// skip it.  It is called for directories too, whose writer is
+	// closed without data.
+	CreateFile(f FileInfo) (io.WriteCloser, error)
+}
+
+// ProgressSink is a FileSink that is told how the copy of each file
+// progresses.
+type ProgressSink interface {
+	FileSink
+	// Progress is called after each range of f is written, with the
+	// bytes written so far.
+	Progress(f FileInfo, written int64)
+}
+
+var (
+	// ErrFileContentsFailed is returned when the server fails a
+	// FileContents Request.
+	ErrFileContentsFailed = errors.New("cliprdr: file contents request failed")
+	// ErrLockUnsupported is returned by Lock when the server did not
+	// announce CB_CAN_LOCK_CLIPDATA.
+	ErrLockUnsupported = errors.New("cliprdr: server cannot lock clipboard data")
+)
+
+// unixEpochFiletime is the Unix epoch as a FILETIME, in 100 ns
+// intervals since 1601.
+const unixEpochFiletime = 116444736000000000
+
+func toFiletime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.Unix()*1e7 + int64(t.Nanosecond()/100) + unixEpochFiletime)
+}
+
+func fromFiletime(ft uint64) time.Time {
+	if ft == 0 {
+		return time.Time{}
+	}
+	d := int64(ft) - unixEpochFiletime
+	return time.Unix(d/1e7, d%1e7*100).UTC()
+}
+
+// encodeFileList returns the CLIPRDR_FILELIST of files.
+func encodeFileList(files []FileInfo) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(files)))
+	for _, f := range files {
+		d := make([]byte, fileDescriptorSize)
+		binary.LittleEndian.PutUint32(d, FD_ATTRIBUTES|FD_FILESIZE|FD_WRITESTIME|FD_PROGRESSUI)
+		attrs := uint32(FILE_ATTRIBUTE_ARCHIVE)
+		if f.IsDir {
+			attrs = FILE_ATTRIBUTE_DIRECTORY
+		}
+		binary.LittleEndian.PutUint32(d[36:], attrs)
+		binary.LittleEndian.PutUint64(d[56:], toFiletime(f.ModTime))
+		binary.LittleEndian.PutUint32(d[64:], uint32(uint64(f.Size)>>32))
+		binary.LittleEndian.PutUint32(d[68:], uint32(f.Size))
+		name := utf16.Encode([]rune(strings.ReplaceAll(f.Name, "/", `\`)))
+		if len(name) > fileNameChars-1 {
+			name = name[:fileNameChars-1]
+		}
+		for i, c := range name {
+			binary.LittleEndian.PutUint16(d[72+2*i:], c)
+		}
+		b = append(b, d...)
+	}
+	return b
+}
+
+// decodeFileList parses a CLIPRDR_FILELIST.  Names keep the "\"
+// separators of the server.
+func decodeFileList(b []byte) ([]FileInfo, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("cliprdr: file list truncated")
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	if n > len(b)/fileDescriptorSize {
+		return nil, fmt.Errorf("cliprdr: file list of %d files truncated", n)
+	}
+	files := make([]FileInfo, n)
+	for i := range files {
+		d := b[i*fileDescriptorSize:]
+		flags := binary.LittleEndian.Uint32(d)
+		f := &files[i]
+		f.Name = strings.TrimRight(decodeUTF16LE(d[72:72+2*fileNameChars]), "\x00")
+		if j := strings.IndexByte(f.Name, 0); j >= 0 {
+			f.Name = f.Name[:j]
+		}
+		if flags&FD_ATTRIBUTES != 0 {
+			f.IsDir = binary.LittleEndian.Uint32(d[36:])&FILE_ATTRIBUTE_DIRECTORY != 0
+		}
+		if flags&FD_WRITESTIME != 0 {
+			f.ModTime = fromFiletime(binary.LittleEndian.Uint64(d[56:]))
+		}
+		if flags&FD_FILESIZE != 0 {
+			f.Size = int64(binary.LittleEndian.Uint32(d[64:]))<<32 | int64(binary.LittleEndian.Uint32(d[68:]))
+		}
+	}
+	return files, nil
+}
+
+// fileContentsRequest is a CLIPRDR_FILECONTENTS_REQUEST (MS-RDPECLIP
+// 2.2.5.3).
+// clipDataId is present when the request reads locked data.
+type fileContentsRequest struct {
+	streamId      uint32
+	index         int
+	flags         uint32
+	position      int64
+	cbRequested   uint32
+	clipDataId    uint32
+	hasClipDataId bool
+}
+
+func (r *fileContentsRequest) serialize() []byte {
+	b := binary.LittleEndian.AppendUint32(nil, r.streamId)
+	b = binary.LittleEndian.AppendUint32(b, uint32(r.index))
+	b = binary.LittleEndian.AppendUint32(b, r.flags)
+	b = binary.LittleEndian.AppendUint64(b, uint64(r.position))
+	b = binary.LittleEndian.AppendUint32(b, r.cbRequested)
+	if r.hasClipDataId {
+		b = binary.LittleEndian.AppendUint32(b, r.clipDataId)
+	}
+	return b
+}
+
+func readFileContentsRequest(b []byte) (*fileContentsRequest, error) {
+	if len(b) < 24 {
+		return nil, fmt.Errorf("cliprdr: file contents request truncated")
+	}
+	r := &fileContentsRequest{
+		streamId:    binary.LittleEndian.Uint32(b),
+		index:       int(int32(binary.LittleEndian.Uint32(b[4:]))),
+		flags:       binary.LittleEndian.Uint32(b[8:]),
+		position:    int64(binary.LittleEndian.Uint64(b[12:])),
+		cbRequested: binary.LittleEndian.Uint32(b[20:]),
+	}
+	if len(b) >= 28 {
+		r.clipDataId = binary.LittleEndian.Uint32(b[24:])
+		r.hasClipDataId = true
+	}
+	return r, nil
+}
+
+type fileContentsResponse struct {
+	data []byte
+	ok   bool
+}
+
+// processFileContentsRequest serves a request of the server from the
+// FileProvider of the local content, or of the content locked under its
+// clipDataId, on a goroutine so that slow reads do not hold up the
+// channel.
+func (h *CliprdrHandler) processFileContentsRequest(body []byte) {
+	req, err := readFileContentsRequest(body)
+	if err != nil {
+		h.log.Warn("cliprdr: FileContents Request", "err", err)
+		return
+	}
+	var p FileProvider
+	if locked, ok := h.localLocks[req.clipDataId]; ok && req.hasClipDataId {
+		p = locked
+	} else if h.local != nil {
+		p = h.local.Files
+	}
+	go h.serveFileContents(p, req)
+}
+
+// serveFileContents answers one FileContents Request.  A FileProvider
+// cancels a transfer by returning an error; the server then aborts the
+// paste.
+func (h *CliprdrHandler) serveFileContents(p FileProvider, req *fileContentsRequest) {
+	h.serving <- struct{}{}
+	defer func() { <-h.serving }()
+
+	fail := func(err error) {
+		h.log.Debug("cliprdr: FileContents Request failed", "index", req.index, "err", err)
+		h.sendPDU(CB_FILECONTENTS_RESPONSE, CB_RESPONSE_FAIL, binary.LittleEndian.AppendUint32(nil, req.streamId))
+	}
+	if p == nil {
+		fail(errors.New("no files on the clipboard"))
+		return
+	}
+	files := p.Files()
+	if req.index < 0 || req.index >= len(files) {
+		fail(fmt.Errorf("no file %d", req.index))
+		return
+	}
+	resp := binary.LittleEndian.AppendUint32(nil, req.streamId)
+	switch {
+	case req.flags&FILECONTENTS_SIZE != 0:
+		resp = binary.LittleEndian.AppendUint64(resp, uint64(files[req.index].Size))
+	case req.flags&FILECONTENTS_RANGE != 0:
+		buf := make([]byte, min(int64(req.cbRequested), maxFileContentsRange, max(files[req.index].Size-req.position, 0)))
+		n, err := p.ReadFileAt(req.index, buf, req.position)
+		if err != nil && !(errors.Is(err, io.EOF) && n > 0) && len(buf) > 0 {
+			fail(err)
+			return
+		}
+		resp = append(resp, buf[:n]...)
+	default:
+		fail(fmt.Errorf("flags %#x", req.flags))
+		return
+	}
+	h.sendPDU(CB_FILECONTENTS_RESPONSE, CB_RESPONSE_OK, resp)
+}
+
+func (h *CliprdrHandler) processFileContentsResponse(body []byte, msgFlags uint16) {
+	if len(body) < 4 {
+		h.log.Warn("cliprdr: FileContents Response truncated")
+		return
+	}
+	streamId := binary.LittleEndian.Uint32(body)
+	ch, ok := h.fileStreams[streamId]
+	if !ok {
+		h.log.Debug("cliprdr: FileContents Response without a request", "streamId", streamId)
+		return
+	}
+	delete(h.fileStreams, streamId)
+	ch <- fileContentsResponse{data: body[4:], ok: msgFlags&CB_RESPONSE_OK != 0}
+}
+
+// processLockClipData keeps the local files readable under clipDataId
+// until the server unlocks them, whatever SetClipboard sets meanwhile.
+func (h *CliprdrHandler) processLockClipData(body []byte, lock bool) {
+	if len(body) < 4 {
+		return
+	}
+	id := binary.LittleEndian.Uint32(body)
+	if !lock {
+		delete(h.localLocks, id)
+		return
+	}
+	var p FileProvider
+	if h.local != nil {
+		p = h.local.Files
+	}
+	h.localLocks[id] = p
+}
+
+// Lock asks the server to keep the file data of r readable, even after
+// its clipboard changes, until Unlock.  CopyFiles locks by itself.
+func (r *RemoteClipboard) Lock() error {
+	h := r.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.serverCanLock {
+		return ErrLockUnsupported
+	}
+	if r.locked {
+		return nil
+	}
+	if h.remoteSeq != r.seq {
+		return ErrClipboardChanged
+	}
+	h.nextClipDataId++
+	r.clipDataId = h.nextClipDataId
+	r.locked = true
+	h.sendPDU(CB_LOCK_CLIPDATA, 0, binary.LittleEndian.AppendUint32(nil, r.clipDataId))
+	return nil
+}
+
+// Unlock releases the lock taken by Lock.
+func (r *RemoteClipboard) Unlock() {
+	h := r.h
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !r.locked {
+		return
+	}
+	r.locked = false
+	h.sendPDU(CB_UNLOCK_CLIPDATA, 0, binary.LittleEndian.AppendUint32(nil, r.clipDataId))
+}
+
+// fileContents sends a FileContents Request and waits for its response.
+// Requests on different streams may be in flight together.  Cancelling
+// ctx abandons the request; its response is dropped when it comes.
+func (r *RemoteClipboard) fileContents(ctx context.Context, req *fileContentsRequest) ([]byte, error) {
+	h := r.h
+	h.mu.Lock()
+	if r.locked {
+		req.clipDataId, req.hasClipDataId = r.clipDataId, true
+	} else if h.remoteSeq != r.seq {
+		h.mu.Unlock()
+		return nil, ErrClipboardChanged
+	}
+	h.nextStreamId++
+	req.streamId = h.nextStreamId
+	ch := make(chan fileContentsResponse, 1)
+	h.fileStreams[req.streamId] = ch
+	h.sendPDU(CB_FILECONTENTS_REQUEST, 0, req.serialize())
+	h.mu.Unlock()
+
+	select {
+	case resp := <-ch:
+		if !resp.ok {
+			return nil, ErrFileContentsFailed
+		}
+		return resp.data, nil
+	case <-ctx.Done():
+		h.mu.Lock()
+		delete(h.fileStreams, req.streamId)
+		h.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// HasFiles reports whether the server offers a file list.
+func (r *RemoteClipboard) HasFiles() bool {
+	_, ok := r.findFormat(FORMAT_NAME_FILES)
+	return ok
+}
+
+// Files fetches the file list.
+func (r *RemoteClipboard) Files(ctx context.Context) ([]FileInfo, error) {
+	id, ok := r.findFormat(FORMAT_NAME_FILES)
+	if !ok {
+		return nil, ErrFormatUnavailable
+	}
+	b, err := r.Data(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return decodeFileList(b)
+}
+
+// FileSize asks the server for the size of the file at index of Files.
+func (r *RemoteClipboard) FileSize(ctx context.Context, index int) (int64, error) {
+	b, err := r.fileContents(ctx, &fileContentsRequest{index: index, flags: FILECONTENTS_SIZE, cbRequested: 8})
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < 8 {
+		return 0, fmt.Errorf("cliprdr: file size truncated")
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
+
+// ReadFileAt reads len(p) bytes at off of the file at index of Files.
+// It returns io.EOF when the server sends fewer bytes.
+func (r *RemoteClipboard) ReadFileAt(ctx context.Context, index int, p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		want := min(len(p)-n, fileContentsChunk)
+		b, err := r.fileContents(ctx, &fileContentsRequest{
+			index: index, flags: FILECONTENTS_RANGE, position: off + int64(n), cbRequested: uint32(want),
+		})
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], b)
+		if len(b) < want {
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+// ReadFile copies the file at index of Files, size bytes long, to w.
+func (r *RemoteClipboard) ReadFile(ctx context.Context, index int, size int64, w io.Writer) (int64, error) {
+	buf := make([]byte, fileContentsChunk)
+	var written int64
+	for written < size {
+		n, err := r.ReadFileAt(ctx, index, buf[:min(int64(len(buf)), size-written)], written)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if errors.Is(err, io.EOF) {
+			return written, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// CopyFiles fetches the file list and copies every file to sink, one
+// range at a time.  The server clipboard is locked meanwhile if the
+// server can lock it.  Cancelling ctx stops the copy.
+func (r *RemoteClipboard) CopyFiles(ctx context.Context, sink FileSink) error {
+	if err := r.Lock(); err == nil {
+		defer r.Unlock()
+	} else if !errors.Is(err, ErrLockUnsupported) {
+		return err
+	}
+	files, err := r.Files(ctx)
+	if err != nil {
+		return err
+	}
+	progress, _ := sink.(ProgressSink)
+	for i, f := range files {
+		w, err := sink.CreateFile(f)
+		if err != nil {
+			return err
+		}
+		if w == nil {
+			continue
+		}
+		if !f.IsDir {
+			if f.Size == 0 {
+				// The list may leave out the size.
+				f.Size, err = r.FileSize(ctx, i)
+			}
+			if err == nil {
+				var dst io.Writer = w
+				if progress != nil {
+					dst = &progressWriter{w: w, f: f, sink: progress}
+				}
+				_, err = r.ReadFile(ctx, i, f.Size, dst)
+			}
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("cliprdr: copy %s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+type progressWriter struct {
+	w       io.Writer
+	f       FileInfo
+	sink    ProgressSink
+	written int64
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.written += int64(n)
+	p.sink.Progress(p.f, p.written)
+	return n, err
+}
@@ -0,0 +1,189 @@
+package cliprdr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+)
+
+// Content is clipboard content in the formats the application can give
+// the server.  Only the non-empty fields are offered, and each is
+// converted to the format the server asks for only when it asks.
+type Content struct {
+	// Text is offered as CF_UNICODETEXT.
+	Text string
+	// HTML is an HTML fragment, offered in the Windows "HTML Format".
+	HTML string
+	// PNG is a PNG encoded image, offered as "PNG" and as CF_DIB.
+	PNG []byte
+	// Files, when set, is offered as a "FileGroupDescriptorW" list whose
+	// contents the server streams from it.
+	Files FileProvider
+}
+
+// Names of the registered clipboard formats grdp converts.
+const (
+	FORMAT_NAME_HTML = "HTML Format"
+	FORMAT_NAME_PNG  = "PNG"
+)
+
+// IDs under which the client offers its registered formats.  A client
+// picks the IDs of the formats it registers; the server maps them by
+// name (MS-RDPECLIP 2.2.3.1).
+const (
+	localFormatHTML = 0xC0F0
+	localFormatPNG  = 0xC0F1
+)
+
+const (
+	bitmapInfoHeaderSize = 40
+	BI_RGB               = 0
+	BI_BITFIELDS         = 3
+)
+
+// dibToPNG converts a CF_DIB or CF_DIBV5 packed bitmap, 24 or 32 bits
+// per pixel, to PNG.
+func dibToPNG(b []byte) ([]byte, error) {
+	if len(b) < bitmapInfoHeaderSize {
+		return nil, fmt.Errorf("cliprdr: DIB header truncated")
+	}
+	headerSize := int(binary.LittleEndian.Uint32(b))
+	width := int(int32(binary.LittleEndian.Uint32(b[4:])))
+	height := int(int32(binary.LittleEndian.Uint32(b[8:])))
+	bpp := int(binary.LittleEndian.Uint16(b[14:]))
+	compression := binary.LittleEndian.Uint32(b[16:])
+	if headerSize < bitmapInfoHeaderSize || headerSize > len(b) {
+		return nil, fmt.Errorf("cliprdr: DIB header size %d", headerSize)
+	}
+	if bpp != 24 && bpp != 32 {
+		return nil, fmt.Errorf("cliprdr: %d bpp DIB not supported", bpp)
+	}
+	if compression != BI_RGB && !(compression == BI_BITFIELDS && bpp == 32) {
+		return nil, fmt.Errorf("cliprdr: DIB compression %d not supported", compression)
+	}
+	topDown := height < 0
+	if topDown {
+		height = -height
+	}
+	if width <= 0 || height <= 0 || width > 1<<15 || height > 1<<15 {
+		return nil, fmt.Errorf("cliprdr: DIB size %dx%d", width, height)
+	}
+	offset := headerSize
+	// With BI_BITFIELDS a BITMAPINFOHEADER is followed by the three
+	// colour masks; the larger headers hold them.
+	if compression == BI_BITFIELDS && headerSize == bitmapInfoHeaderSize {
+		offset += 12
+	}
+	stride := (width*bpp/8 + 3) &^ 3
+	if offset+stride*height > len(b) {
+		return nil, fmt.Errorf("cliprdr: DIB pixels truncated")
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	hasAlpha := false
+	for y := range height {
+		row := b[offset+y*stride:]
+		dy := height - 1 - y
+		if topDown {
+			dy = y
+		}
+		for x := range width {
+			p := row[x*bpp/8:]
+			c := color.NRGBA{R: p[2], G: p[1], B: p[0], A: 0xFF}
+			if bpp == 32 {
+				c.A = p[3]
+				hasAlpha = hasAlpha || p[3] != 0
+			}
+			img.SetNRGBA(x, dy, c)
+		}
+	}
+	// Most 32 bpp DIBs leave the fourth byte zero: treat them as opaque.
+	if bpp == 32 && !hasAlpha {
+		for i := 3; i < len(img.Pix); i += 4 {
+			img.Pix[i] = 0xFF
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pngToDIB converts a PNG image to a 32 bpp bottom-up CF_DIB.
+func pngToDIB(b []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("cliprdr: %w", err)
+	}
+	r := img.Bounds()
+	width, height := r.Dx(), r.Dy()
+	out := make([]byte, bitmapInfoHeaderSize, bitmapInfoHeaderSize+width*height*4)
+	binary.LittleEndian.PutUint32(out, bitmapInfoHeaderSize)
+	binary.LittleEndian.PutUint32(out[4:], uint32(width))
+	binary.LittleEndian.PutUint32(out[8:], uint32(height))
+	binary.LittleEndian.PutUint16(out[12:], 1) // planes
+	binary.LittleEndian.PutUint16(out[14:], 32)
+	binary.LittleEndian.PutUint32(out[16:], BI_RGB)
+	binary.LittleEndian.PutUint32(out[20:], uint32(width*height*4))
+	for y := r.Max.Y - 1; y >= r.Min.Y; y-- {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			out = append(out, c.B, c.G, c.R, c.A)
+		}
+	}
+	return out, nil
+}
+
+// cfHTMLHeader is the description that starts the Windows "HTML Format";
+// the offsets are byte offsets into the whole UTF-8 data.
+const cfHTMLHeader = "Version:0.9\r\nStartHTML:%010d\r\nEndHTML:%010d\r\nStartFragment:%010d\r\nEndFragment:%010d\r\n"
+
+// encodeHTMLFormat wraps an HTML fragment in the "HTML Format".
+func encodeHTMLFormat(fragment string) []byte {
+	const (
+		prefix = "<html><body>\r\n<!--StartFragment-->"
+		suffix = "<!--EndFragment-->\r\n</body></html>"
+	)
+	headerLen := len(fmt.Sprintf(cfHTMLHeader, 0, 0, 0, 0))
+	startFragment := headerLen + len(prefix)
+	endFragment := startFragment + len(fragment)
+	endHTML := endFragment + len(suffix)
+	s := fmt.Sprintf(cfHTMLHeader, headerLen, endHTML, startFragment, endFragment) + prefix + fragment + suffix
+	return append([]byte(s), 0)
+}
+
+// decodeHTMLFormat returns the fragment of "HTML Format" data, or the
+// whole HTML if the fragment offsets are missing.
+func decodeHTMLFormat(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	s := string(b)
+	offset := func(key string) int {
+		i := strings.Index(s, key+":")
+		if i < 0 {
+			return -1
+		}
+		v := s[i+len(key)+1:]
+		if j := strings.IndexAny(v, "\r\n"); j >= 0 {
+			v = v[:j]
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n < 0 || n > len(s) {
+			return -1
+		}
+		return n
+	}
+	if start, end := offset("StartFragment"), offset("EndFragment"); start >= 0 && end >= start {
+		return s[start:end]
+	}
+	if start, end := offset("StartHTML"), offset("EndHTML"); start >= 0 && end >= start {
+		return s[start:end]
+	}
+	return s
+}
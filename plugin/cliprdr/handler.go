@@ -1,15 +1,20 @@
 // Package cliprdr handler.go implements a cross-platform CLIPRDR
 // (Clipboard Virtual Channel Extension, MS-RDPECLIP) handler for
-// bidirectional text clipboard sharing between RDP client and server.
+// bidirectional clipboard sharing between RDP client and server.
 //
-// Only text formats (CF_UNICODETEXT / CF_TEXT) are supported.
+// Text (CF_UNICODETEXT / CF_TEXT), HTML ("HTML Format"), images ("PNG",
+// CF_DIB / CF_DIBV5) and files ("FileGroupDescriptorW" with FileContents
+// streaming) are supported.
 package cliprdr
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"log/slog"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf16"
 
 	"github.com/nakagami/grdp/core"
@@ -43,8 +48,53 @@ type CliprdrHandler struct {
 	// server→client clipboard update triggers a local clipboard change
 	// event which would otherwise be sent back to the server.
 	suppressNextLocalChange bool
+
+	// mu guards the handler: Process runs on the connection's reader
+	// goroutine, the public methods on the application's.
+	mu sync.Mutex
+
+	// local, once set by SetClipboard, is the content offered to the
+	// server; until then getLocalClipboardText supplies the text.
+	local *Content
+
+	// remoteSeq counts the Format Lists received; a RemoteClipboard is
+	// valid while it matches.
+	remoteSeq uint64
+
+	// onRemoteClipboard is called with each Format List of the server.
+	onRemoteClipboard func(*RemoteClipboard)
+
+	// reqMu keeps one Format Data Request in flight, since a response
+	// does not say which format it carries.  pending receives it.
+	reqMu   sync.Mutex
+	pending chan formatDataResponse
+
+	// fileStreams receive the FileContents Responses by stream ID.
+	fileStreams  map[uint32]chan fileContentsResponse
+	nextStreamId uint32
+
+	// serverCanLock is set when the server announced
+	// CB_CAN_LOCK_CLIPDATA.  nextClipDataId numbers the locks the client
+	// takes; localLocks holds the local files the server locked.
+	serverCanLock  bool
+	nextClipDataId uint32
+	localLocks     map[uint32]FileProvider
+
+	// serving limits the FileContents Requests served at once.
+	serving chan struct{}
+
+	log *slog.Logger
+}
+
+type formatDataResponse struct {
+	data []byte
+	ok   bool
 }
 
+// remoteTextTimeout bounds the text request made for the onRemote
+// callback of NewHandler.
+const remoteTextTimeout = 10 * time.Second
+
 // NewHandler creates a CliprdrHandler.
 //
 //   - onRemote is called when the server clipboard text is received.
@@ -55,9 +105,18 @@ func NewHandler(onRemote func(text string), getLocal func() string) *CliprdrHand
 	return &CliprdrHandler{
 		onRemoteClipboardChanged: onRemote,
 		getLocalClipboardText:    getLocal,
+		fileStreams:              make(map[uint32]chan fileContentsResponse),
+		localLocks:               make(map[uint32]FileProvider),
+		serving:                  make(chan struct{}, maxFileContentsServed),
+		log:                      core.Logger(nil, "cliprdr"),
 	}
 }
 
+// SetLogger makes the handler log to l, with the attribute layer=cliprdr.
+func (h *CliprdrHandler) SetLogger(l *slog.Logger) {
+	h.log = core.Logger(l, "cliprdr")
+}
+
 // --- plugin.ChannelTransport interface ------------------------------------
 
 func (h *CliprdrHandler) GetType() (string, uint32) {
@@ -73,18 +132,21 @@ func (h *CliprdrHandler) Process(s []byte) {
 	if len(s) < 8 {
 		return
 	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	r := bytes.NewReader(s)
 	msgType, _ := core.ReadUint16LE(r)
 	msgFlags, _ := core.ReadUint16LE(r)
 	dataLen, _ := core.ReadUInt32LE(r)
 
-	body := make([]byte, dataLen)
-	if dataLen > 0 {
+	// a dataLen past the end of the PDU gets the bytes the PDU holds
+	body := make([]byte, min(int(dataLen), r.Len()))
+	if len(body) > 0 {
 		n, _ := r.Read(body)
 		body = body[:n]
 	}
 
-	slog.Debug("cliprdr recv", "msgType", msgType, "msgFlags", msgFlags, "dataLen", dataLen)
+	h.log.Debug("cliprdr recv", "msgType", msgType, "msgFlags", msgFlags, "dataLen", dataLen)
 
 	switch msgType {
 	case CB_CLIP_CAPS:
@@ -99,10 +161,16 @@ func (h *CliprdrHandler) Process(s []byte) {
 		h.processFormatDataRequest(body)
 	case CB_FORMAT_DATA_RESPONSE:
 		h.processFormatDataResponse(body, msgFlags)
-	case CB_LOCK_CLIPDATA, CB_UNLOCK_CLIPDATA:
-		// ignored
+	case CB_FILECONTENTS_REQUEST:
+		h.processFileContentsRequest(body)
+	case CB_FILECONTENTS_RESPONSE:
+		h.processFileContentsResponse(body, msgFlags)
+	case CB_LOCK_CLIPDATA:
+		h.processLockClipData(body, true)
+	case CB_UNLOCK_CLIPDATA:
+		h.processLockClipData(body, false)
 	default:
-		slog.Debug("cliprdr: unhandled msgType", "msgType", msgType)
+		h.log.Debug("cliprdr: unhandled msgType", "msgType", msgType)
 	}
 }
 
@@ -124,7 +192,8 @@ func (h *CliprdrHandler) processClipCaps(body []byte) {
 		if capType == CB_CAPSTYPE_GENERAL && capLen >= 12 {
 			generalFlags := binary.LittleEndian.Uint32(body[offset+8:])
 			h.useLongFormatNames = generalFlags&CB_USE_LONG_FORMAT_NAMES != 0
-			slog.Debug("cliprdr: server caps", "generalFlags", generalFlags, "longNames", h.useLongFormatNames)
+			h.serverCanLock = generalFlags&CB_CAN_LOCK_CLIPDATA != 0
+			h.log.Debug("cliprdr: server caps", "generalFlags", generalFlags, "longNames", h.useLongFormatNames)
 		}
 		offset += int(capLen)
 	}
@@ -142,7 +211,7 @@ func (h *CliprdrHandler) sendClipCaps() {
 	binary.Write(b, binary.LittleEndian, uint16(CB_CAPSTYPE_GENERAL))
 	binary.Write(b, binary.LittleEndian, uint16(12))
 	binary.Write(b, binary.LittleEndian, uint32(CB_CAPS_VERSION_2))
-	binary.Write(b, binary.LittleEndian, uint32(CB_USE_LONG_FORMAT_NAMES))
+	binary.Write(b, binary.LittleEndian, uint32(CB_USE_LONG_FORMAT_NAMES|CB_STREAM_FILECLIP_ENABLED|CB_FILECLIP_NO_FILE_PATHS|CB_CAN_LOCK_CLIPDATA|CB_HUGE_FILE_SUPPORT_ENABLED))
 
 	// cCapabilitySets(2) + pad1(2) + capabilitySet
 	body := &bytes.Buffer{}
@@ -156,7 +225,7 @@ func (h *CliprdrHandler) sendClipCaps() {
 // --- Monitor Ready (MS-RDPECLIP 2.2.2.2) ----------------------------------
 
 func (h *CliprdrHandler) processMonitorReady() {
-	slog.Debug("cliprdr: server Monitor Ready")
+	h.log.Debug("cliprdr: server Monitor Ready")
 	h.monitorReady = true
 	h.sendClipCaps()
 	// Per MS-RDPECLIP §1.3.2.1 the server sends CB_CLIP_CAPS before
@@ -170,42 +239,83 @@ func (h *CliprdrHandler) processMonitorReady() {
 
 // --- Format List (MS-RDPECLIP 2.2.3.1) ------------------------------------
 
+// localFormats returns the formats of the local clipboard content.
+func (h *CliprdrHandler) localFormats() []CliprdrFormat {
+	if h.local == nil {
+		return []CliprdrFormat{{CF_UNICODETEXT, ""}}
+	}
+	var formats []CliprdrFormat
+	if h.local.Text != "" {
+		formats = append(formats, CliprdrFormat{CF_UNICODETEXT, ""})
+	}
+	if h.local.HTML != "" {
+		formats = append(formats, CliprdrFormat{localFormatHTML, FORMAT_NAME_HTML})
+	}
+	if len(h.local.PNG) > 0 {
+		formats = append(formats, CliprdrFormat{localFormatPNG, FORMAT_NAME_PNG}, CliprdrFormat{CF_DIB, ""})
+	}
+	if h.local.Files != nil {
+		formats = append(formats, CliprdrFormat{localFormatFiles, FORMAT_NAME_FILES})
+	}
+	return formats
+}
+
 func (h *CliprdrHandler) sendFormatList() {
 	b := &bytes.Buffer{}
-	if h.useLongFormatNames {
-		// Long Format Name: formatId(4) + wszFormatName(null-terminated UTF-16LE)
-		binary.Write(b, binary.LittleEndian, uint32(CF_UNICODETEXT))
-		b.Write([]byte{0, 0}) // empty name = standard format
-	} else {
-		// Short Format Name: formatId(4) + formatName[32]
-		binary.Write(b, binary.LittleEndian, uint32(CF_UNICODETEXT))
-		b.Write(make([]byte, 32))
+	for _, f := range h.localFormats() {
+		binary.Write(b, binary.LittleEndian, f.FormatId)
+		name := encodeUTF16LE(f.FormatName)
+		if h.useLongFormatNames {
+			// Long Format Name: formatId(4) + wszFormatName(null-terminated UTF-16LE)
+			b.Write(name)
+			b.Write([]byte{0, 0}) // empty name = standard format
+		} else {
+			// Short Format Name: formatId(4) + formatName[32]
+			short := make([]byte, 32)
+			copy(short[:30], name)
+			b.Write(short)
+		}
 	}
 	h.sendPDU(CB_FORMAT_LIST, 0, b.Bytes())
 }
 
 func (h *CliprdrHandler) processFormatList(body []byte, msgFlags uint16) {
 	formats := h.parseFormatList(body, msgFlags)
-	slog.Debug("cliprdr: server Format List", "formats", formats)
+	h.log.Debug("cliprdr: server Format List", "formats", formats)
 
 	// Always respond OK
 	h.sendPDU(CB_FORMAT_LIST_RESPONSE, CB_RESPONSE_OK, nil)
 
-	// Request text data if available
-	for _, f := range formats {
-		if f.FormatId == CF_UNICODETEXT {
-			h.sendFormatDataRequest(CF_UNICODETEXT)
-			return
-		}
+	// The data stays on the server until asked for (delayed rendering).
+	h.remoteSeq++
+	rc := &RemoteClipboard{h: h, seq: h.remoteSeq, formats: formats}
+	if h.onRemoteClipboard != nil {
+		go h.onRemoteClipboard(rc)
 	}
-	for _, f := range formats {
-		if f.FormatId == CF_TEXT {
-			h.sendFormatDataRequest(CF_TEXT)
-			return
-		}
+	if h.onRemoteClipboardChanged != nil && rc.HasText() {
+		go h.fetchRemoteText(rc)
 	}
 }
 
+// fetchRemoteText passes the text of rc to the onRemote callback.
+func (h *CliprdrHandler) fetchRemoteText(rc *RemoteClipboard) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTextTimeout)
+	defer cancel()
+	text, err := rc.Text(ctx)
+	if err != nil {
+		h.log.Debug("cliprdr: remote text", "err", err)
+		return
+	}
+	if text == "" {
+		return
+	}
+	h.log.Debug("cliprdr: received text", "len", len(text))
+	h.mu.Lock()
+	h.suppressNextLocalChange = true
+	h.mu.Unlock()
+	h.onRemoteClipboardChanged(text)
+}
+
 func (h *CliprdrHandler) parseFormatList(body []byte, msgFlags uint16) []CliprdrFormat {
 	var formats []CliprdrFormat
 	if h.useLongFormatNames && (msgFlags&CB_ASCII_NAMES == 0) {
@@ -248,9 +358,9 @@ func (h *CliprdrHandler) parseFormatList(body []byte, msgFlags uint16) []Cliprdr
 
 func (h *CliprdrHandler) processFormatListResponse(msgFlags uint16) {
 	if msgFlags&CB_RESPONSE_OK != 0 {
-		slog.Debug("cliprdr: Format List Response OK")
+		h.log.Debug("cliprdr: Format List Response OK")
 	} else {
-		slog.Warn("cliprdr: Format List Response FAIL")
+		h.log.Warn("cliprdr: Format List Response FAIL")
 	}
 }
 
@@ -260,7 +370,7 @@ func (h *CliprdrHandler) sendFormatDataRequest(formatId uint32) {
 	b := make([]byte, 4)
 	binary.LittleEndian.PutUint32(b, formatId)
 	h.sendPDU(CB_FORMAT_DATA_REQUEST, 0, b)
-	slog.Debug("cliprdr: sent Format Data Request", "formatId", formatId)
+	h.log.Debug("cliprdr: sent Format Data Request", "formatId", formatId)
 }
 
 func (h *CliprdrHandler) processFormatDataRequest(body []byte) {
@@ -269,39 +379,75 @@ func (h *CliprdrHandler) processFormatDataRequest(body []byte) {
 		return
 	}
 	requestedFormat := binary.LittleEndian.Uint32(body[0:4])
-	slog.Debug("cliprdr: server requests format", "formatId", requestedFormat)
+	h.log.Debug("cliprdr: server requests format", "formatId", requestedFormat)
 
-	text := ""
-	if h.getLocalClipboardText != nil {
-		text = h.getLocalClipboardText()
+	data, ok := h.renderLocal(requestedFormat)
+	if !ok {
+		h.sendPDU(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_FAIL, nil)
+		return
 	}
+	h.sendPDU(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_OK, data)
+}
 
-	switch requestedFormat {
+// renderLocal converts the local clipboard content to formatId.
+func (h *CliprdrHandler) renderLocal(formatId uint32) ([]byte, bool) {
+	if h.local == nil {
+		text := ""
+		if h.getLocalClipboardText != nil {
+			text = h.getLocalClipboardText()
+		}
+		return renderText(text, formatId)
+	}
+	switch formatId {
+	case CF_UNICODETEXT, CF_TEXT:
+		if h.local.Text != "" {
+			return renderText(h.local.Text, formatId)
+		}
+	case localFormatHTML:
+		if h.local.HTML != "" {
+			return encodeHTMLFormat(h.local.HTML), true
+		}
+	case localFormatPNG:
+		if len(h.local.PNG) > 0 {
+			return h.local.PNG, true
+		}
+	case localFormatFiles:
+		if h.local.Files != nil {
+			return encodeFileList(h.local.Files.Files()), true
+		}
+	case CF_DIB:
+		if len(h.local.PNG) > 0 {
+			dib, err := pngToDIB(h.local.PNG)
+			if err != nil {
+				h.log.Warn("cliprdr: convert PNG to DIB", "err", err)
+				return nil, false
+			}
+			return dib, true
+		}
+	}
+	return nil, false
+}
+
+func renderText(text string, formatId uint32) ([]byte, bool) {
+	switch formatId {
 	case CF_UNICODETEXT:
-		encoded := encodeUTF16LE(text + "\x00")
-		h.sendPDU(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_OK, encoded)
+		return encodeUTF16LE(text + "\x00"), true
 	case CF_TEXT:
-		h.sendPDU(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_OK, []byte(text+"\x00"))
-	default:
-		h.sendPDU(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_FAIL, nil)
+		return []byte(text + "\x00"), true
 	}
+	return nil, false
 }
 
 func (h *CliprdrHandler) processFormatDataResponse(body []byte, msgFlags uint16) {
 	if msgFlags&CB_RESPONSE_OK == 0 {
-		slog.Warn("cliprdr: Format Data Response FAIL")
-		return
+		h.log.Warn("cliprdr: Format Data Response FAIL")
 	}
-
-	// Try to decode as UTF-16LE (CF_UNICODETEXT)
-	text := decodeUTF16LE(body)
-	text = strings.TrimRight(text, "\x00")
-
-	if text != "" && h.onRemoteClipboardChanged != nil {
-		slog.Debug("cliprdr: received text", "len", len(text))
-		h.suppressNextLocalChange = true
-		h.onRemoteClipboardChanged(text)
+	if h.pending == nil {
+		h.log.Debug("cliprdr: Format Data Response without a request")
+		return
 	}
+	h.pending <- formatDataResponse{data: body, ok: msgFlags&CB_RESPONSE_OK != 0}
+	h.pending = nil
 }
 
 // --- Public API for local clipboard changes --------------------------------
@@ -310,16 +456,39 @@ func (h *CliprdrHandler) processFormatDataResponse(body []byte, msgFlags uint16)
 // content has changed.  Call this from the UI when the system clipboard
 // changes (e.g. via polling or a platform clipboard-change signal).
 func (h *CliprdrHandler) OnLocalClipboardChanged() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	if h.suppressNextLocalChange {
 		h.suppressNextLocalChange = false
 		return
 	}
 	if h.channelSender != nil {
 		h.sendFormatList()
-		slog.Debug("cliprdr: local clipboard changed, sent Format List")
+		h.log.Debug("cliprdr: local clipboard changed, sent Format List")
 	}
 }
 
+// SetClipboard replaces the local clipboard content offered to the
+// server with c and announces its formats.  From then on the text
+// callback of NewHandler is no longer used.
+func (h *CliprdrHandler) SetClipboard(c Content) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.local = &c
+	h.suppressNextLocalChange = false
+	if h.channelSender != nil && h.monitorReady && h.serverCapsReceived {
+		h.sendFormatList()
+	}
+}
+
+// SetRemoteClipboardFunc sets the function called, on a goroutine of its
+// own, each time the server clipboard changes.
+func (h *CliprdrHandler) SetRemoteClipboardFunc(f func(*RemoteClipboard)) {
+	h.mu.Lock()
+	h.onRemoteClipboard = f
+	h.mu.Unlock()
+}
+
 // --- Send helpers ----------------------------------------------------------
 
 func (h *CliprdrHandler) sendPDU(msgType, msgFlags uint16, body []byte) {
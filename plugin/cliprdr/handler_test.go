@@ -0,0 +1,300 @@
+package cliprdr
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"testing"
+	"time"
+)
+
+type pduRecorder struct{ pdus chan []byte }
+
+func (r *pduRecorder) SendToChannel(channel string, s []byte) (int, error) {
+	r.pdus <- bytes.Clone(s)
+	return len(s), nil
+}
+
+func (r *pduRecorder) next(t *testing.T, msgType uint16) []byte {
+	t.Helper()
+	select {
+	case p := <-r.pdus:
+		if got := binary.LittleEndian.Uint16(p); got != msgType {
+			t.Fatalf("sent msgType %#x, want %#x", got, msgType)
+		}
+		return p[8:]
+	case <-time.After(time.Second):
+		t.Fatalf("no PDU %#x sent", msgType)
+	}
+	return nil
+}
+
+func clipPDU(msgType, msgFlags uint16, body []byte) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, msgType)
+	b = binary.LittleEndian.AppendUint16(b, msgFlags)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(body)))
+	return append(b, body...)
+}
+
+// readyHandler returns a handler past the initialization sequence with
+// long format names and the server general flags extra.
+func readyHandler(t *testing.T, extra ...byte) (*CliprdrHandler, *pduRecorder) {
+	h := NewHandler(nil, nil)
+	rec := &pduRecorder{pdus: make(chan []byte, 8)}
+	h.Sender(rec)
+	flags := byte(CB_USE_LONG_FORMAT_NAMES)
+	for _, f := range extra {
+		flags |= f
+	}
+	caps := []byte{1, 0, 0, 0, 1, 0, 12, 0, 2, 0, 0, 0, flags, 0, 0, 0}
+	h.Process(clipPDU(CB_CLIP_CAPS, 0, caps))
+	h.Process(clipPDU(CB_MONITOR_READY, 0, nil))
+	rec.next(t, CB_CLIP_CAPS)
+	rec.next(t, CB_FORMAT_LIST)
+	return h, rec
+}
+
+func testPNG(t *testing.T) ([]byte, *image.NRGBA) {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 10)
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xFF
+	}
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), img
+}
+
+func TestLocalClipboardFormats(t *testing.T) {
+	h, rec := readyHandler(t)
+	pngData, img := testPNG(t)
+	h.SetClipboard(Content{Text: "hi", HTML: "<b>hi</b>", PNG: pngData})
+
+	want := []byte{13, 0, 0, 0, 0, 0}
+	want = binary.LittleEndian.AppendUint32(want, localFormatHTML)
+	want = append(append(want, encodeUTF16LE(FORMAT_NAME_HTML)...), 0, 0)
+	want = binary.LittleEndian.AppendUint32(want, localFormatPNG)
+	want = append(append(want, encodeUTF16LE(FORMAT_NAME_PNG)...), 0, 0)
+	want = append(want, 8, 0, 0, 0, 0, 0)
+	if got := rec.next(t, CB_FORMAT_LIST); !bytes.Equal(got, want) {
+		t.Errorf("format list\n got %x\nwant %x", got, want)
+	}
+
+	h.Process(clipPDU(CB_FORMAT_DATA_REQUEST, 0, []byte{CF_DIB, 0, 0, 0}))
+	dib := rec.next(t, CB_FORMAT_DATA_RESPONSE)
+	back, err := dibToPNG(dib)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(back))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := range 2 {
+		for x := range 3 {
+			if got, want := color.NRGBAModel.Convert(decoded.At(x, y)), img.NRGBAAt(x, y); got != want {
+				t.Errorf("pixel %d,%d = %v, want %v", x, y, got, want)
+			}
+		}
+	}
+
+	binary.LittleEndian.PutUint32(want, localFormatHTML)
+	h.Process(clipPDU(CB_FORMAT_DATA_REQUEST, 0, want[:4]))
+	if got := decodeHTMLFormat(rec.next(t, CB_FORMAT_DATA_RESPONSE)); got != "<b>hi</b>" {
+		t.Errorf("HTML fragment %q", got)
+	}
+}
+
+func TestRemoteClipboard(t *testing.T) {
+	h, rec := readyHandler(t)
+	clips := make(chan *RemoteClipboard, 1)
+	h.SetRemoteClipboardFunc(func(rc *RemoteClipboard) { clips <- rc })
+
+	list := []byte{13, 0, 0, 0, 0, 0, 0x04, 0xC0, 0, 0}
+	list = append(append(list, encodeUTF16LE(FORMAT_NAME_HTML)...), 0, 0)
+	h.Process(clipPDU(CB_FORMAT_LIST, 0, list))
+	rec.next(t, CB_FORMAT_LIST_RESPONSE)
+	rc := <-clips
+	if !rc.HasText() || !rc.HasHTML() || rc.HasImage() {
+		t.Fatalf("formats %v", rc.Formats())
+	}
+
+	type result struct {
+		html string
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		html, err := rc.HTML(context.Background())
+		done <- result{html, err}
+	}()
+	if got := rec.next(t, CB_FORMAT_DATA_REQUEST); !bytes.Equal(got, []byte{0x04, 0xC0, 0, 0}) {
+		t.Errorf("requested %x", got)
+	}
+	h.Process(clipPDU(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_OK, encodeHTMLFormat("<i>x</i>")))
+	if r := <-done; r.err != nil || r.html != "<i>x</i>" {
+		t.Errorf("HTML = %q, %v", r.html, r.err)
+	}
+
+	h.Process(clipPDU(CB_FORMAT_LIST, 0, nil))
+	rec.next(t, CB_FORMAT_LIST_RESPONSE)
+	if _, err := rc.Text(context.Background()); err != ErrClipboardChanged {
+		t.Errorf("Text after a new format list: %v", err)
+	}
+}
+
+type memFiles struct {
+	files []FileInfo
+	data  [][]byte
+}
+
+func (m *memFiles) Files() []FileInfo { return m.files }
+func (m *memFiles) ReadFileAt(i int, p []byte, off int64) (int, error) {
+	return bytes.NewReader(m.data[i]).ReadAt(p, off)
+}
+
+type memSink map[string]*bytes.Buffer
+
+type nopCloser struct{ *bytes.Buffer }
+
+func (nopCloser) Close() error { return nil }
+
+func (s memSink) CreateFile(f FileInfo) (io.WriteCloser, error) {
+	s[f.Name] = &bytes.Buffer{}
+	return nopCloser{s[f.Name]}, nil
+}
+
+func fileContentsRequestPDU(streamId uint32, index int, flags uint32, pos int64, n uint32) []byte {
+	r := &fileContentsRequest{streamId: streamId, index: index, flags: flags, position: pos, cbRequested: n}
+	return clipPDU(CB_FILECONTENTS_REQUEST, 0, r.serialize())
+}
+
+func TestClipboardFiles(t *testing.T) {
+	modTime := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	content := bytes.Repeat([]byte("grdp"), 20000)
+	files := &memFiles{
+		files: []FileInfo{{Name: "dir", IsDir: true, ModTime: modTime}, {Name: "dir/a.txt", Size: int64(len(content)), ModTime: modTime}},
+		data:  [][]byte{nil, content},
+	}
+
+	// Local files, read by the server.
+	h, rec := readyHandler(t)
+	h.SetClipboard(Content{Files: files})
+	rec.next(t, CB_FORMAT_LIST)
+	h.Process(clipPDU(CB_FORMAT_DATA_REQUEST, 0, binary.LittleEndian.AppendUint32(nil, localFormatFiles)))
+	list, err := decodeFileList(rec.next(t, CB_FORMAT_DATA_RESPONSE))
+	if err != nil || len(list) != 2 || list[1].Name != `dir\a.txt` || list[1].Size != 80000 || !list[0].IsDir || !list[1].ModTime.Equal(modTime) {
+		t.Fatalf("file list %+v, %v", list, err)
+	}
+	h.Process(fileContentsRequestPDU(7, 1, FILECONTENTS_SIZE, 0, 8))
+	if got := rec.next(t, CB_FILECONTENTS_RESPONSE); !bytes.Equal(got, []byte{7, 0, 0, 0, 0x80, 0x38, 1, 0, 0, 0, 0, 0}) {
+		t.Errorf("size response %x", got)
+	}
+	h.Process(fileContentsRequestPDU(8, 1, FILECONTENTS_RANGE, 79998, 100))
+	if got := rec.next(t, CB_FILECONTENTS_RESPONSE); !bytes.Equal(got, []byte{8, 0, 0, 0, 'd', 'p'}) {
+		t.Errorf("range response %x", got)
+	}
+
+	// Remote files, pasted by the client.
+	h, rec = readyHandler(t)
+	clips := make(chan *RemoteClipboard, 1)
+	h.SetRemoteClipboardFunc(func(rc *RemoteClipboard) { clips <- rc })
+	fl := []byte{0x05, 0xC0, 0, 0}
+	fl = append(append(fl, encodeUTF16LE(FORMAT_NAME_FILES)...), 0, 0)
+	h.Process(clipPDU(CB_FORMAT_LIST, 0, fl))
+	rec.next(t, CB_FORMAT_LIST_RESPONSE)
+	rc := <-clips
+	sink := memSink{}
+	done := make(chan error)
+	go func() { done <- rc.CopyFiles(context.Background(), sink) }()
+	rec.next(t, CB_FORMAT_DATA_REQUEST)
+	h.Process(clipPDU(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_OK, encodeFileList(files.files)))
+	for off := 0; off < len(content); off += fileContentsChunk {
+		req, err := readFileContentsRequest(rec.next(t, CB_FILECONTENTS_REQUEST))
+		if err != nil || req.index != 1 || req.flags != FILECONTENTS_RANGE || req.position != int64(off) {
+			t.Fatalf("request %+v, %v", req, err)
+		}
+		data := content[off:min(off+int(req.cbRequested), len(content))]
+		h.Process(clipPDU(CB_FILECONTENTS_RESPONSE, CB_RESPONSE_OK, append(binary.LittleEndian.AppendUint32(nil, req.streamId), data...)))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := sink[`dir\a.txt`]; got == nil || !bytes.Equal(got.Bytes(), content) || sink["dir"] == nil {
+		t.Errorf("copied %v", sink)
+	}
+}
+
+type progressSink struct {
+	memSink
+	written []int64
+}
+
+func (s *progressSink) Progress(f FileInfo, written int64) { s.written = append(s.written, written) }
+
+func TestClipboardLock(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), fileContentsChunk+10)
+	files := &memFiles{files: []FileInfo{{Name: "a", Size: int64(len(content))}}, data: [][]byte{content}}
+
+	// The server locks the local files before they change.
+	h, rec := readyHandler(t, CB_CAN_LOCK_CLIPDATA)
+	h.SetClipboard(Content{Files: files})
+	rec.next(t, CB_FORMAT_LIST)
+	h.Process(clipPDU(CB_LOCK_CLIPDATA, 0, []byte{5, 0, 0, 0}))
+	h.SetClipboard(Content{Text: "other"})
+	rec.next(t, CB_FORMAT_LIST)
+	req := &fileContentsRequest{streamId: 1, flags: FILECONTENTS_RANGE, cbRequested: 4, clipDataId: 5, hasClipDataId: true}
+	h.Process(clipPDU(CB_FILECONTENTS_REQUEST, 0, req.serialize()))
+	if got := rec.next(t, CB_FILECONTENTS_RESPONSE); !bytes.Equal(got, []byte{1, 0, 0, 0, 'x', 'x', 'x', 'x'}) {
+		t.Errorf("locked range response %x", got)
+	}
+	h.Process(clipPDU(CB_UNLOCK_CLIPDATA, 0, []byte{5, 0, 0, 0}))
+	h.Process(clipPDU(CB_FILECONTENTS_REQUEST, 0, req.serialize()))
+	if p := <-rec.pdus; !bytes.Equal(p, clipPDU(CB_FILECONTENTS_RESPONSE, CB_RESPONSE_FAIL, []byte{1, 0, 0, 0})) {
+		t.Errorf("range response after unlock %x", p)
+	}
+
+	// The client locks the server files for the duration of a copy.
+	h, rec = readyHandler(t, CB_CAN_LOCK_CLIPDATA)
+	clips := make(chan *RemoteClipboard, 1)
+	h.SetRemoteClipboardFunc(func(rc *RemoteClipboard) { clips <- rc })
+	fl := append(append([]byte{0x05, 0xC0, 0, 0}, encodeUTF16LE(FORMAT_NAME_FILES)...), 0, 0)
+	h.Process(clipPDU(CB_FORMAT_LIST, 0, fl))
+	rec.next(t, CB_FORMAT_LIST_RESPONSE)
+	rc := <-clips
+	sink := &progressSink{memSink: memSink{}}
+	done := make(chan error)
+	go func() { done <- rc.CopyFiles(context.Background(), sink) }()
+	lock := rec.next(t, CB_LOCK_CLIPDATA)
+	rec.next(t, CB_FORMAT_DATA_REQUEST)
+	h.Process(clipPDU(CB_FORMAT_DATA_RESPONSE, CB_RESPONSE_OK, encodeFileList(files.files)))
+	// A clipboard change does not invalidate the locked data.
+	h.Process(clipPDU(CB_FORMAT_LIST, 0, nil))
+	rec.next(t, CB_FORMAT_LIST_RESPONSE)
+	<-clips
+	for off := 0; off < len(content); off += fileContentsChunk {
+		req, err := readFileContentsRequest(rec.next(t, CB_FILECONTENTS_REQUEST))
+		if err != nil || !req.hasClipDataId || req.clipDataId != binary.LittleEndian.Uint32(lock) {
+			t.Fatalf("request %+v, %v", req, err)
+		}
+		data := content[off:min(off+int(req.cbRequested), len(content))]
+		h.Process(clipPDU(CB_FILECONTENTS_RESPONSE, CB_RESPONSE_OK, append(binary.LittleEndian.AppendUint32(nil, req.streamId), data...)))
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := rec.next(t, CB_UNLOCK_CLIPDATA); !bytes.Equal(got, lock) {
+		t.Errorf("unlocked %x, locked %x", got, lock)
+	}
+	if len(sink.written) != 2 || sink.written[1] != int64(len(content)) {
+		t.Errorf("progress %v", sink.written)
+	}
+}
@@ -0,0 +1,158 @@
+package cliprdr
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+)
+
+var (
+	// ErrFormatUnavailable is returned when the server clipboard does not
+	// hold the format asked for.
+	ErrFormatUnavailable = errors.New("cliprdr: format not on the server clipboard")
+	// ErrClipboardChanged is returned when the server clipboard changed
+	// since the RemoteClipboard was announced.
+	ErrClipboardChanged = errors.New("cliprdr: server clipboard changed")
+	// ErrDataRequestFailed is returned when the server fails a Format
+	// Data Request.
+	ErrDataRequestFailed = errors.New("cliprdr: format data request failed")
+)
+
+// RemoteClipboard is the server clipboard announced by one Format List
+// PDU.  Its data stays on the server until asked for; the methods that
+// fetch it send a Format Data Request and wait for the response, so they
+// must not be called from the connection's goroutine.
+type RemoteClipboard struct {
+	h       *CliprdrHandler
+	seq     uint64
+	formats []CliprdrFormat
+
+	// locked and clipDataId, guarded by h.mu, are set by Lock.
+	locked     bool
+	clipDataId uint32
+}
+
+// Formats returns the formats the server offers.
+func (r *RemoteClipboard) Formats() []CliprdrFormat {
+	return slices.Clone(r.formats)
+}
+
+// findFormat returns the ID of the first format of ids, or named name,
+// that the server offers.
+func (r *RemoteClipboard) findFormat(name string, ids ...uint32) (uint32, bool) {
+	for _, f := range r.formats {
+		if name != "" && f.FormatName == name {
+			return f.FormatId, true
+		}
+	}
+	for _, id := range ids {
+		for _, f := range r.formats {
+			if f.FormatId == id {
+				return id, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// HasText reports whether the server offers text.
+func (r *RemoteClipboard) HasText() bool {
+	_, ok := r.findFormat("", CF_UNICODETEXT, CF_TEXT)
+	return ok
+}
+
+// HasHTML reports whether the server offers HTML.
+func (r *RemoteClipboard) HasHTML() bool {
+	_, ok := r.findFormat(FORMAT_NAME_HTML)
+	return ok
+}
+
+// HasImage reports whether the server offers an image.
+func (r *RemoteClipboard) HasImage() bool {
+	_, ok := r.findFormat(FORMAT_NAME_PNG, CF_DIBV5, CF_DIB)
+	return ok
+}
+
+// Text fetches the text, preferring CF_UNICODETEXT over CF_TEXT.
+func (r *RemoteClipboard) Text(ctx context.Context) (string, error) {
+	id, ok := r.findFormat("", CF_UNICODETEXT, CF_TEXT)
+	if !ok {
+		return "", ErrFormatUnavailable
+	}
+	b, err := r.Data(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if id == CF_UNICODETEXT {
+		return strings.TrimRight(decodeUTF16LE(b), "\x00"), nil
+	}
+	// CF_TEXT is in the server's ANSI code page: keep Latin-1.
+	if i := slices.Index(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes), nil
+}
+
+// HTML fetches the HTML fragment of the "HTML Format".
+func (r *RemoteClipboard) HTML(ctx context.Context) (string, error) {
+	id, ok := r.findFormat(FORMAT_NAME_HTML)
+	if !ok {
+		return "", ErrFormatUnavailable
+	}
+	b, err := r.Data(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	return decodeHTMLFormat(b), nil
+}
+
+// PNG fetches the image as PNG, converting a CF_DIBV5 or CF_DIB bitmap
+// when the server offers no PNG.
+func (r *RemoteClipboard) PNG(ctx context.Context) ([]byte, error) {
+	id, ok := r.findFormat(FORMAT_NAME_PNG, CF_DIBV5, CF_DIB)
+	if !ok {
+		return nil, ErrFormatUnavailable
+	}
+	b, err := r.Data(ctx, id)
+	if err != nil || (id != CF_DIBV5 && id != CF_DIB) {
+		return b, err
+	}
+	return dibToPNG(b)
+}
+
+// Data fetches the raw data of formatId.
+func (r *RemoteClipboard) Data(ctx context.Context, formatId uint32) ([]byte, error) {
+	h := r.h
+	h.reqMu.Lock()
+	defer h.reqMu.Unlock()
+
+	h.mu.Lock()
+	if h.remoteSeq != r.seq {
+		h.mu.Unlock()
+		return nil, ErrClipboardChanged
+	}
+	ch := make(chan formatDataResponse, 1)
+	h.pending = ch
+	h.sendFormatDataRequest(formatId)
+	h.mu.Unlock()
+
+	select {
+	case resp := <-ch:
+		if !resp.ok {
+			return nil, ErrDataRequestFailed
+		}
+		return resp.data, nil
+	case <-ctx.Done():
+		h.mu.Lock()
+		if h.pending == ch {
+			h.pending = nil
+		}
+		h.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
@@ -1,11 +1,22 @@
+// Package drdynvc implements the Dynamic Virtual Channel manager
+// (MS-RDPEDYC), which multiplexes the dynamic channels, such as the
+// graphics pipeline and display control, over the static channel:
+//
+//	"drdynvc"
+//
+// The manager negotiates the protocol version with the server, routes
+// each channel the server creates to the handler registered for its
+// name, reassembles the messages the server fragments and fragments
+// the messages the handlers send, sharing the static channel between
+// the priority classes of the channels.
 package drdynvc
 
 import (
 	"bytes"
-	"encoding/hex"
 	"io"
 	"log/slog"
 	"strings"
+	"sync"
 
 	"github.com/nakagami/grdp/core"
 	"github.com/nakagami/grdp/plugin"
@@ -33,52 +44,118 @@ const (
 	DYNVC_SOFT_SYNC_RESPONSE    = 0x09
 )
 
+// Protocol versions of the Capabilities PDU
+const (
+	DYNVC_CAPS_VERSION1 = 0x0001
+	DYNVC_CAPS_VERSION2 = 0x0002
+	DYNVC_CAPS_VERSION3 = 0x0003
+)
+
+// E_FAIL is the CreationStatus of a channel the client refuses.
+const E_FAIL = 0x80004005
+
+// maxPduSize is the size of the largest DVC PDU, which must fit in one
+// chunk of the static channel.
+const maxPduSize = plugin.CHANNEL_CHUNK_LENGTH
+
+// maxMessageSize bounds the length a DATA_FIRST PDU announces, so that
+// a server cannot make the client buffer without limit.
+const maxMessageSize = 64 << 20
+
 // DvcChannelHandler processes data for a specific dynamic virtual channel.
+//
+// A handler may also implement:
+//
+//	SetSendFunc(func([]byte))  to be given the function that sends on the channel
+//	OnChannelCreated()         to be told the channel has been accepted
+//	OnChannelClosed()          to be told the channel has been closed
 type DvcChannelHandler interface {
 	Process(data []byte)
 }
 
-type ChannelClient struct {
-	name          string
-	id            uint32
-	channelSender core.ChannelSender
-}
-
-type dvcChannelInfo struct {
+// dvcChannel is an open dynamic channel.
+type dvcChannel struct {
 	name    string
 	id      uint32
 	cbChId  uint8
 	handler DvcChannelHandler
-}
-
-type dvcReassembly struct {
-	buf      bytes.Buffer
-	totalLen uint32
+	// priority is the priority class the server created the channel
+	// with, 0 before version 2.
+	priority uint8
+
+	// buf holds the fragments of the message a DATA_FIRST PDU began,
+	// totalLen bytes long, until the last DATA PDU completes it.
+	buf      []byte
+	totalLen int
+	// reserved is the length of the message taken from the budget,
+	// guarded by the mu of the client.
+	reserved int
+
+	// sendMu keeps the fragments of a message the client sends together
+	// on the channel; the fragments of other channels may come between.
+	sendMu sync.Mutex
 }
 
 type DvcClient struct {
-	w                 core.ChannelSender
-	channels          map[string]ChannelClient
-	handlers          map[string]DvcChannelHandler // channelName → handler
-	rejectedChannels  map[string]bool              // channelName → explicitly rejected
-	channelById       map[uint32]*dvcChannelInfo   // channelId → info
-	reassembly        map[uint32]*dvcReassembly    // channelId → reassembly state
+	w core.ChannelSender
+	// writeMu serializes the PDUs sent on the static channel.
+	writeMu sync.Mutex
+	// sched orders the data PDUs of the channels by priority class.
+	sched *scheduler
+
+	// mu guards the registrations, the open channels and the
+	// negotiated state.
+	mu               sync.Mutex
+	handlers         map[string]DvcChannelHandler        // channelName → handler
+	listeners        map[string]func() DvcChannelHandler // channelName → handler factory
+	rejectedChannels map[string]bool                     // channelName → explicitly rejected
+	channelById      map[uint32]*dvcChannel              // channelId → open channel
+
 	negotiatedVersion uint16
+
+	// budget holds the length of the messages being reassembled.
+	budget *core.Budget
+
+	log *slog.Logger
 }
 
 func NewDvcClient() *DvcClient {
 	return &DvcClient{
-		channels:         make(map[string]ChannelClient, 100),
 		handlers:         make(map[string]DvcChannelHandler),
+		listeners:        make(map[string]func() DvcChannelHandler),
 		rejectedChannels: make(map[string]bool),
-		channelById:      make(map[uint32]*dvcChannelInfo),
-		reassembly:       make(map[uint32]*dvcReassembly),
+		channelById:      make(map[uint32]*dvcChannel),
+		sched:            newScheduler(),
+		log:              core.Logger(nil, "drdynvc"),
 	}
 }
 
-// RegisterHandler registers a handler for a named DVC channel.
+// SetLogger makes the client log to l, with the attribute layer=drdynvc.
+func (c *DvcClient) SetLogger(l *slog.Logger) {
+	c.log = core.Logger(l, "drdynvc")
+}
+
+// SetBudget makes the client reserve the length of the messages it
+// reassembles from b, and drop those that do not fit.
+func (c *DvcClient) SetBudget(b *core.Budget) {
+	c.budget = b
+}
+
+// RegisterHandler registers a handler for a named DVC channel.  Every
+// instance of the channel the server creates is served by handler.
 func (c *DvcClient) RegisterHandler(name string, handler DvcChannelHandler) {
+	c.mu.Lock()
 	c.handlers[name] = handler
+	c.mu.Unlock()
+}
+
+// RegisterListener registers newHandler to create the handler of each
+// instance of the named DVC channel the server creates, for channels
+// that may be open more than once at a time.
+func (c *DvcClient) RegisterListener(name string, newHandler func() DvcChannelHandler) {
+	c.mu.Lock()
+	c.listeners[name] = newHandler
+	c.mu.Unlock()
 }
 
 // RegisterRejectedChannel marks a DVC channel to be explicitly rejected
@@ -87,11 +164,17 @@ func (c *DvcClient) RegisterHandler(name string, handler DvcChannelHandler) {
 // rejecting AUDIO_PLAYBACK_LOSSY_DVC forces gnome-remote-desktop to
 // fall back to lossless AUDIO_PLAYBACK_DVC (PCM).
 func (c *DvcClient) RegisterRejectedChannel(name string) {
+	c.mu.Lock()
 	c.rejectedChannels[name] = true
+	c.mu.Unlock()
 }
 
-func (c *DvcClient) LoadAddin(f core.ChannelSender) {
-
+// Version returns the protocol version negotiated with the server, or 0
+// before the Capabilities PDU.
+func (c *DvcClient) Version() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.negotiatedVersion
 }
 
 type DvcHeader struct {
@@ -111,35 +194,119 @@ func readHeader(r io.Reader) *DvcHeader {
 func (h *DvcHeader) serialize(channelId uint32) []byte {
 	b := &bytes.Buffer{}
 	core.WriteUInt8((h.cmd<<4)|(h.sp<<2)|h.cbChId, b)
-	if h.cbChId == 0 {
-		core.WriteUInt8(uint8(channelId), b)
-	} else if h.cbChId == 1 {
-		core.WriteUInt16LE(uint16(channelId), b)
-	} else {
-		core.WriteUInt32LE(channelId, b)
+	writeVarUint(b, h.cbChId, channelId)
+	return b.Bytes()
+}
+
+// varUintSize is the size of a field of the 2-bit length code cb: 1, 2
+// or 4 bytes.
+func varUintSize(cb uint8) int {
+	switch cb {
+	case 0:
+		return 1
+	case 1:
+		return 2
 	}
+	return 4
+}
 
-	return b.Bytes()
+// varUintCode is the length code of the smallest field holding v.
+func varUintCode(v uint32) uint8 {
+	switch {
+	case v <= 0xFF:
+		return 0
+	case v <= 0xFFFF:
+		return 1
+	}
+	return 2
+}
+
+func writeVarUint(w io.Writer, cb uint8, v uint32) {
+	switch cb {
+	case 0:
+		core.WriteUInt8(uint8(v), w)
+	case 1:
+		core.WriteUInt16LE(uint16(v), w)
+	default:
+		core.WriteUInt32LE(v, w)
+	}
 }
 
 func (c *DvcClient) Send(s []byte) (int, error) {
-	slog.Debug("dvc Send", "len", len(s), "data", hex.EncodeToString(s))
+	c.log.Debug("dvc Send", "len", len(s), "data", core.Hex(s))
 	name, _ := c.GetType()
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	return c.w.SendToChannel(name, s)
 }
 
-// SendDvcData sends data on a DVC channel wrapped in a DYNVC_DATA PDU.
+// SendDvcData sends data as one message on a DVC channel: a DYNVC_DATA
+// PDU, or a DYNVC_DATA_FIRST PDU and the DYNVC_DATA PDUs that follow it
+// when the message does not fit in one PDU.  Data for a channel that is
+// not open is dropped.  It is safe to call from any goroutine; while
+// channels of several priority classes send, each PDU waits for the turn
+// of its class.
 func (c *DvcClient) SendDvcData(channelId uint32, data []byte) {
+	c.mu.Lock()
 	ch, ok := c.channelById[channelId]
+	c.mu.Unlock()
 	if !ok {
 		return
 	}
-	hdr := &DvcHeader{cmd: DYNVC_DATA, sp: 0, cbChId: ch.cbChId}
+	ch.sendMu.Lock()
+	defer ch.sendMu.Unlock()
+
+	hdrLen := 1 + varUintSize(ch.cbChId)
+	if hdrLen+len(data) <= maxPduSize {
+		c.sendFragment(ch, &DvcHeader{cmd: DYNVC_DATA, cbChId: ch.cbChId}, nil, data)
+		return
+	}
+	sp := varUintCode(uint32(len(data)))
+	lenField := &bytes.Buffer{}
+	writeVarUint(lenField, sp, uint32(len(data)))
+	n := maxPduSize - hdrLen - lenField.Len()
+	if !c.sendFragment(ch, &DvcHeader{cmd: DYNVC_DATA_FIRST, sp: sp, cbChId: ch.cbChId}, lenField.Bytes(), data[:n]) {
+		return
+	}
+	for off := n; off < len(data); {
+		m := min(len(data)-off, maxPduSize-hdrLen)
+		if !c.sendFragment(ch, &DvcHeader{cmd: DYNVC_DATA, cbChId: ch.cbChId}, nil, data[off:off+m]) {
+			return
+		}
+		off += m
+	}
+}
+
+// sendFragment sends one PDU of a message in the turn of its priority
+// class, unless the channel has been closed since the message began.
+func (c *DvcClient) sendFragment(ch *dvcChannel, hdr *DvcHeader, lenField, data []byte) bool {
 	b := &bytes.Buffer{}
-	b.Write(hdr.serialize(channelId))
+	b.Write(hdr.serialize(ch.id))
+	b.Write(lenField)
 	b.Write(data)
-	c.Send(b.Bytes())
+	var open bool
+	c.sched.send(ch.priority, b.Len(), func() {
+		c.mu.Lock()
+		open = c.channelById[ch.id] == ch
+		c.mu.Unlock()
+		if open {
+			c.Send(b.Bytes())
+		}
+	})
+	return open
 }
+
+// CloseChannel closes a channel the server created: the server is told
+// and the handler gets OnChannelClosed.
+func (c *DvcClient) CloseChannel(channelId uint32) {
+	ch := c.removeChannel(channelId)
+	if ch == nil {
+		return
+	}
+	c.sendClose(ch)
+	notifyClosed(ch)
+}
+
 func (c *DvcClient) Sender(f core.ChannelSender) {
 	c.w = f
 }
@@ -150,19 +317,22 @@ func (c *DvcClient) GetType() (string, uint32) {
 func (c *DvcClient) Process(s []byte) {
 	defer func() {
 		if r := recover(); r != nil {
-			slog.Error("dvc: panic in Process", "err", r)
+			c.log.Error("dvc: panic in Process", "err", r)
 		}
 	}()
-	r := bytes.NewReader(s)
-	hdr := readHeader(r)
-	b, _ := core.ReadBytes(r.Len(), r)
+	if len(s) == 0 {
+		c.malformed("DVC", s, io.ErrUnexpectedEOF)
+		return
+	}
+	hdr := readHeader(bytes.NewReader(s))
+	b := s[1:]
 
 	switch hdr.cmd {
 	case DYNVC_CAPABILITIES:
-		slog.Debug("DYNVC_CAPABILITIES")
+		c.log.Debug("DYNVC_CAPABILITIES")
 		c.processCapsPdu(hdr, b)
 	case DYNVC_CREATE_REQ:
-		slog.Debug("DYNVC_CREATE_REQ")
+		c.log.Debug("DYNVC_CREATE_REQ")
 		c.processCreateReq(hdr, b)
 	case DYNVC_DATA_FIRST:
 		c.processDataFirst(hdr, b)
@@ -171,75 +341,159 @@ func (c *DvcClient) Process(s []byte) {
 	case DYNVC_CLOSE:
 		c.processClose(hdr, b)
 	case DYNVC_SOFT_SYNC_REQUEST:
-		slog.Debug("DYNVC_SOFT_SYNC_REQUEST")
+		c.log.Debug("DYNVC_SOFT_SYNC_REQUEST")
 		c.processSoftSyncRequest(hdr, b)
+	case DYNVC_DATA_FIRST_COMPRESSED, DYNVC_DATA_COMPRESSED:
+		// Servers compress only for clients that ask for it; grdp
+		// has no RDP8 bulk decompressor for dynamic channels.
+		c.log.Warn("dvc: compressed data not supported, dropped", "cmd", hdr.cmd)
 	default:
-		slog.Warn("dvc: unhandled cmd", "cmd", hdr.cmd)
+		c.log.Warn("dvc: unhandled cmd", "cmd", hdr.cmd)
+	}
+}
+
+// malformed logs and drops a PDU the server truncated or corrupted; the
+// other channels carry on.
+func (c *DvcClient) malformed(name string, s []byte, err error) {
+	c.log.Warn("dvc: PDU dropped", "err", core.NewProtocolError("drdynvc", name, s, err), core.LogPDU, core.Hex(s))
+}
+
+func (c *DvcClient) removeChannel(channelId uint32) *dvcChannel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.channelById[channelId]
+	if !ok {
+		return nil
+	}
+	delete(c.channelById, channelId)
+	c.budget.Release(ch.reserved)
+	ch.reserved = 0
+	return ch
+}
+
+// reserve takes the length n of the message ch is reassembling from the
+// budget.
+func (c *DvcClient) reserve(ch *dvcChannel, n int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.budget.Reserve(n); err != nil {
+		return err
 	}
+	ch.reserved = n
+	return nil
 }
+
+// dropMessage forgets the message ch is reassembling.
+func (c *DvcClient) dropMessage(ch *dvcChannel) {
+	ch.buf = nil
+	c.mu.Lock()
+	c.budget.Release(ch.reserved)
+	ch.reserved = 0
+	c.mu.Unlock()
+}
+
+func (c *DvcClient) sendClose(ch *dvcChannel) {
+	hdr := &DvcHeader{cmd: DYNVC_CLOSE, cbChId: ch.cbChId}
+	c.Send(hdr.serialize(ch.id))
+}
+
+func notifyClosed(ch *dvcChannel) {
+	if h, ok := ch.handler.(interface{ OnChannelClosed() }); ok {
+		h.OnChannelClosed()
+	}
+}
+
+// processClose closes the channel the server closes and confirms it
+// with a Close Response.
 func (c *DvcClient) processClose(hdr *DvcHeader, s []byte) {
-	r := bytes.NewReader(s)
+	r := core.NewErrReader(bytes.NewReader(s))
 	channelId := readDvcId(r, hdr.cbChId)
-	ch, ok := c.channelById[channelId]
-	name := "(unknown)"
-	if ok {
-		name = ch.name
-		delete(c.channelById, channelId)
-		delete(c.reassembly, channelId)
+	if err := r.Err(); err != nil {
+		c.malformed("Close", s, err)
+		return
 	}
-	slog.Debug("dvc: CLOSE", "channelId", channelId, "name", name)
+	ch := c.removeChannel(channelId)
+	if ch == nil {
+		// The answer to a close of the client, or an unknown channel.
+		c.log.Debug("dvc: CLOSE", "channelId", channelId, "name", "(unknown)")
+		return
+	}
+	c.log.Debug("dvc: CLOSE", "channelId", channelId, "name", ch.name)
+	c.sendClose(ch)
+	notifyClosed(ch)
 }
 
 func (c *DvcClient) processCreateReq(hdr *DvcHeader, s []byte) {
-	r := bytes.NewReader(s)
+	r := core.NewErrReader(bytes.NewReader(s))
 	channelId := readDvcId(r, hdr.cbChId)
 	nameBytes, _ := core.ReadBytes(r.Len(), r)
-	channelName := strings.TrimRight(string(nameBytes), "\x00")
-	slog.Debug("dvc: create request", "channelId", channelId, "name", channelName)
-
-	// Associate handler if registered
-	var handler DvcChannelHandler
-	if h, ok := c.handlers[channelName]; ok {
-		handler = h
-		info := &dvcChannelInfo{
-			name:    channelName,
-			id:      channelId,
-			cbChId:  hdr.cbChId,
-			handler: handler,
-		}
-		c.channelById[channelId] = info
-
-		// Provide send callback if handler supports it
-		if setter, ok := handler.(interface{ SetSendFunc(func([]byte)) }); ok {
-			chId := channelId
-			setter.SetSendFunc(func(data []byte) {
-				c.SendDvcData(chId, data)
-			})
-		}
-		slog.Debug("dvc: handler registered", "channel", channelName, "id", channelId)
+	if err := r.Err(); err != nil {
+		c.malformed("Create Request", s, err)
+		return
 	}
+	channelName, _, _ := strings.Cut(string(nameBytes), "\x00")
+	// From version 2 on, Sp is the priority class of the channel.
+	c.log.Debug("dvc: create request", "channelId", channelId, "name", channelName, "priority", hdr.sp)
+
+	rspHdr := &DvcHeader{cmd: DYNVC_CREATE_REQ, sp: 0, cbChId: hdr.cbChId}
+	rsp := &bytes.Buffer{}
+	rsp.Write(rspHdr.serialize(channelId))
 
+	c.mu.Lock()
 	// If explicitly rejected, send a non-zero CreationStatus so the server
 	// does not use this channel (e.g. AUDIO_PLAYBACK_LOSSY_DVC → fallback to PCM).
 	if c.rejectedChannels[channelName] {
-		slog.Debug("dvc: rejecting channel", "channel", channelName, "id", channelId)
-		rspHdr := &DvcHeader{cmd: DYNVC_CREATE_REQ, sp: 0, cbChId: hdr.cbChId}
-		b := &bytes.Buffer{}
-		b.Write(rspHdr.serialize(channelId))
-		core.WriteUInt32LE(0x80004005, b) // E_FAIL
-		c.Send(b.Bytes())
+		c.mu.Unlock()
+		c.log.Debug("dvc: rejecting channel", "channel", channelName, "id", channelId)
+		core.WriteUInt32LE(E_FAIL, rsp)
+		c.Send(rsp.Bytes())
 		return
 	}
+	handler := c.handlers[channelName]
+	if f, ok := c.listeners[channelName]; ok {
+		handler = f()
+	}
+	ch := &dvcChannel{
+		name:    channelName,
+		id:      channelId,
+		cbChId:  hdr.cbChId,
+		handler: handler,
+	}
+	if c.negotiatedVersion >= DYNVC_CAPS_VERSION2 {
+		ch.priority = hdr.sp
+	}
+	prev := c.channelById[channelId]
+	if prev != nil {
+		c.budget.Release(prev.reserved)
+		prev.reserved = 0
+	}
+	if handler != nil {
+		c.channelById[channelId] = ch
+	} else {
+		delete(c.channelById, channelId)
+	}
+	c.mu.Unlock()
+	if prev != nil {
+		c.log.Debug("dvc: channel id reused", "id", channelId, "old", prev.name)
+		notifyClosed(prev)
+	}
+
+	if handler != nil {
+		// Provide send callback if handler supports it
+		if setter, ok := handler.(interface{ SetSendFunc(func([]byte)) }); ok {
+			setter.SetSendFunc(func(data []byte) {
+				c.SendDvcData(channelId, data)
+			})
+		}
+		c.log.Debug("dvc: handler registered", "channel", channelName, "id", channelId)
+	}
 
 	// Send success response (Sp SHOULD be 0 per MS-RDPEDYC 2.2.2.2).
 	// Always accept: some Windows servers stop sending data on static
 	// virtual channels (e.g. cliprdr) when DVC creation requests are
 	// rejected, even for unrelated channels.
-	rspHdr := &DvcHeader{cmd: DYNVC_CREATE_REQ, sp: 0, cbChId: hdr.cbChId}
-	b := &bytes.Buffer{}
-	b.Write(rspHdr.serialize(channelId))
-	core.WriteUInt32LE(0, b)
-	c.Send(b.Bytes())
+	core.WriteUInt32LE(0, rsp)
+	c.Send(rsp.Bytes())
 
 	// Notify handler that channel is ready (CREATE_RSP has been sent)
 	if handler != nil {
@@ -262,103 +516,136 @@ func readDvcId(r io.Reader, cbLen uint8) (id uint32) {
 	}
 	return
 }
-func (c *DvcClient) processDataFirst(hdr *DvcHeader, s []byte) {
-	defer func() {
-		if r := recover(); r != nil {
-			slog.Error("dvc: panic in processDataFirst", "err", r)
-		}
-	}()
-	r := bytes.NewReader(s)
-	channelId := readDvcId(r, hdr.cbChId)
 
-	// Read total length (encoding based on sp/Len field)
-	var totalLen uint32
-	switch hdr.sp {
-	case 0:
-		l, _ := core.ReadUInt8(r)
-		totalLen = uint32(l)
-	case 1:
-		l, _ := core.ReadUint16LE(r)
-		totalLen = uint32(l)
-	default:
-		totalLen, _ = core.ReadUInt32LE(r)
-	}
+func (c *DvcClient) channel(channelId uint32) *dvcChannel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channelById[channelId]
+}
 
+func (c *DvcClient) processDataFirst(hdr *DvcHeader, s []byte) {
+	r := core.NewErrReader(bytes.NewReader(s))
+	channelId := readDvcId(r, hdr.cbChId)
+	// Sp is the size of the Length field.
+	totalLen := int(readDvcId(r, hdr.sp))
 	data, _ := core.ReadBytes(r.Len(), r)
-	ch, ok := c.channelById[channelId]
-	if !ok || ch.handler == nil {
+	if err := r.Err(); err != nil {
+		c.malformed("Data First", s, err)
 		return
 	}
 
-	if uint32(len(data)) >= totalLen {
-		ch.handler.Process(data[:totalLen])
-	} else {
-		ra := &dvcReassembly{totalLen: totalLen}
-		ra.buf.Write(data)
-		c.reassembly[channelId] = ra
+	ch := c.channel(channelId)
+	if ch == nil {
+		return
+	}
+	if ch.buf != nil {
+		c.log.Warn("dvc: message interrupted by DATA_FIRST", "channel", ch.name, "have", len(ch.buf), "want", ch.totalLen)
+		c.dropMessage(ch)
+	}
+	switch {
+	case len(data) > totalLen:
+		c.log.Warn("dvc: DATA_FIRST longer than its message", "channel", ch.name, "len", len(data), "total", totalLen)
+	case len(data) == totalLen:
+		ch.handler.Process(data)
+	case totalLen > maxMessageSize:
+		c.log.Warn("dvc: message too long, dropped", "channel", ch.name, "total", totalLen)
+	default:
+		if err := c.reserve(ch, totalLen); err != nil {
+			c.log.Warn("dvc: message dropped", "channel", ch.name, "err", err)
+			return
+		}
+		ch.buf = append(make([]byte, 0, totalLen), data...)
+		ch.totalLen = totalLen
 	}
 }
 
 func (c *DvcClient) processData(hdr *DvcHeader, s []byte) {
-	defer func() {
-		if r := recover(); r != nil {
-			slog.Error("dvc: panic in processData", "err", r)
-		}
-	}()
-	r := bytes.NewReader(s)
+	r := core.NewErrReader(bytes.NewReader(s))
 	channelId := readDvcId(r, hdr.cbChId)
 	data, _ := core.ReadBytes(r.Len(), r)
-
-	ch, ok := c.channelById[channelId]
-	if !ok || ch.handler == nil {
+	if err := r.Err(); err != nil {
+		c.malformed("Data", s, err)
 		return
 	}
 
-	ra, hasReassembly := c.reassembly[channelId]
-	if hasReassembly {
-		ra.buf.Write(data)
-		if uint32(ra.buf.Len()) >= ra.totalLen {
-			ch.handler.Process(ra.buf.Bytes()[:ra.totalLen])
-			delete(c.reassembly, channelId)
-		}
-	} else {
+	ch := c.channel(channelId)
+	if ch == nil {
+		return
+	}
+	if ch.buf == nil {
 		ch.handler.Process(data)
+		return
+	}
+	if len(ch.buf)+len(data) > ch.totalLen {
+		c.log.Warn("dvc: message longer than announced, dropped", "channel", ch.name, "total", ch.totalLen)
+		c.dropMessage(ch)
+		return
+	}
+	ch.buf = append(ch.buf, data...)
+	if len(ch.buf) == ch.totalLen {
+		msg := ch.buf
+		c.dropMessage(ch)
+		ch.handler.Process(msg)
 	}
 }
 
+// processCapsPdu answers the Capabilities PDU with the highest version
+// both sides support.  From version 2 on, the server also sends the
+// charges of the four channel priority classes, which weigh the data
+// the client sends on them.
 func (c *DvcClient) processCapsPdu(hdr *DvcHeader, s []byte) {
-	r := bytes.NewReader(s)
+	r := core.NewErrReader(bytes.NewReader(s))
 	core.ReadUInt8(r)
 	ver, _ := core.ReadUint16LE(r)
-	slog.Debug("Server supports dvc", "version", ver)
+	if err := r.Err(); err != nil {
+		c.malformed("Capabilities", s, err)
+		return
+	}
+	// A server leaving the charges out is still answered, with the
+	// classes weighed alike.
+	var charges [4]uint16
+	if ver >= DYNVC_CAPS_VERSION2 {
+		for i := range charges {
+			charges[i], _ = core.ReadUint16LE(r)
+		}
+		c.sched.setCharges(charges)
+	}
+	c.log.Debug("Server supports dvc", "version", ver, "priorityCharges", charges)
 
 	// Respond with the server's version (up to 3).
 	// Version 3 is required for some servers to activate RDPGFX.
-	ver = min(ver, 3)
+	ver = min(ver, DYNVC_CAPS_VERSION3)
 
 	// Client CAPS response: header(1) + pad(1) + version(2) = 4 bytes
 	// Priority charges are only in the server's CAPS request, not the client response.
 	b := &bytes.Buffer{}
-	core.WriteUInt8(0x50, b) // header: Cmd=5(CAPS), Sp=0, CbChId=0
-	core.WriteUInt8(0x00, b) // pad
+	core.WriteUInt8(DYNVC_CAPABILITIES<<4, b) // header: Cmd=5(CAPS), Sp=0, CbChId=0
+	core.WriteUInt8(0x00, b)                  // pad
 	core.WriteUInt16LE(ver, b)
-	slog.Debug("dvc: CAPS response", "version", ver, "len", b.Len())
+	c.log.Debug("dvc: CAPS response", "version", ver, "len", b.Len())
 	c.Send(b.Bytes())
+
+	c.mu.Lock()
 	c.negotiatedVersion = ver
+	c.mu.Unlock()
 }
 
+// processSoftSyncRequest answers the Soft-Sync Request of a server that
+// moves channels to a UDP transport.  grdp has no such transport, so no
+// tunnel is switched.
 func (c *DvcClient) processSoftSyncRequest(hdr *DvcHeader, s []byte) {
 	r := bytes.NewReader(s)
 	core.ReadUInt8(r)                 // Pad
 	length, _ := core.ReadUInt32LE(r) // Length
 	flags, _ := core.ReadUint16LE(r)  // Flags
 	numTunnels, _ := core.ReadUint16LE(r)
-	slog.Debug("DYNVC_SOFT_SYNC_REQUEST", "length", length, "flags", flags, "numTunnels", numTunnels)
+	c.log.Debug("DYNVC_SOFT_SYNC_REQUEST", "length", length, "flags", flags, "numTunnels", numTunnels)
 
-	// Send SOFT_SYNC_RESPONSE: header + pad + length(4)
+	// Send SOFT_SYNC_RESPONSE: header + pad + NumberOfTunnels(4), with
+	// no TunnelsToSwitch.
 	b := &bytes.Buffer{}
-	core.WriteUInt8((DYNVC_SOFT_SYNC_RESPONSE<<4)|0x00, b) // cmd=9, sp=0, cbChId=0
-	core.WriteUInt8(0, b)                                  // Pad
-	core.WriteUInt32LE(0x04, b)                            // Length = 4 (just the length field)
+	core.WriteUInt8(DYNVC_SOFT_SYNC_RESPONSE<<4, b) // cmd=9, sp=0, cbChId=0
+	core.WriteUInt8(0, b)                           // Pad
+	core.WriteUInt32LE(0, b)                        // NumberOfTunnels
 	c.Send(b.Bytes())
 }
@@ -0,0 +1,217 @@
+package drdynvc
+
+import (
+	"bytes"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+type sendRecorder struct {
+	mu   sync.Mutex
+	pdus [][]byte
+}
+
+func (s *sendRecorder) SendToChannel(channel string, b []byte) (int, error) {
+	s.mu.Lock()
+	s.pdus = append(s.pdus, bytes.Clone(b))
+	s.mu.Unlock()
+	return len(b), nil
+}
+
+func (s *sendRecorder) take() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.pdus
+	s.pdus = nil
+	return p
+}
+
+type recordHandler struct {
+	msgs   [][]byte
+	send   func([]byte)
+	closed int
+}
+
+func (h *recordHandler) Process(data []byte)        { h.msgs = append(h.msgs, bytes.Clone(data)) }
+func (h *recordHandler) SetSendFunc(f func([]byte)) { h.send = f }
+func (h *recordHandler) OnChannelClosed()           { h.closed++ }
+
+func TestCapabilitiesAndCreate(t *testing.T) {
+	rec := &sendRecorder{}
+	c := NewDvcClient()
+	c.Sender(rec)
+	h := &recordHandler{}
+	c.RegisterHandler("echo", h)
+	c.RegisterRejectedChannel("video")
+
+	// Version 2 with its four priority charges.
+	c.Process([]byte{0x50, 0, 2, 0, 0x36, 0x01, 0x33, 0x33, 0x23, 0x0E, 0x00, 0x00})
+	if p := rec.take(); len(p) != 1 || !bytes.Equal(p[0], []byte{0x50, 0, 2, 0}) {
+		t.Errorf("caps response %x", p)
+	}
+	if c.Version() != DYNVC_CAPS_VERSION2 {
+		t.Errorf("version %d", c.Version())
+	}
+
+	c.Process(append([]byte{0x10, 3}, "echo\x00"...))
+	c.Process(append([]byte{0x10, 4}, "video\x00"...))
+	p := rec.take()
+	if len(p) != 2 || !bytes.Equal(p[0], []byte{0x10, 3, 0, 0, 0, 0}) || !bytes.Equal(p[1], []byte{0x10, 4, 0x05, 0x40, 0x00, 0x80}) {
+		t.Errorf("create responses %x", p)
+	}
+	if h.send == nil {
+		t.Fatal("no send function")
+	}
+
+	c.Process([]byte{0x40, 3})
+	if p := rec.take(); len(p) != 1 || !bytes.Equal(p[0], []byte{0x40, 3}) {
+		t.Errorf("close response %x", p)
+	}
+	if h.closed != 1 {
+		t.Errorf("closed %d times", h.closed)
+	}
+	h.send([]byte{1})
+	if p := rec.take(); len(p) != 0 {
+		t.Errorf("sent on a closed channel: %x", p)
+	}
+}
+
+func TestFragmentation(t *testing.T) {
+	rec := &sendRecorder{}
+	c := NewDvcClient()
+	c.Sender(rec)
+	h := &recordHandler{}
+	c.RegisterHandler("big", h)
+	c.Process(append([]byte{0x11, 0x00, 0x01}, "big\x00"...)) // 2-byte channel ID 0x100
+	rec.take()
+
+	msg := make([]byte, 4000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	h.send(msg)
+	pdus := rec.take()
+	if len(pdus) != 3 {
+		t.Fatalf("sent %d PDUs, want 3", len(pdus))
+	}
+	// DATA_FIRST with Sp=1 (2-byte length), then DATA.
+	if pdus[0][0] != 0x25 || pdus[0][3] != 0xA0 || pdus[0][4] != 0x0F || pdus[1][0] != 0x31 || pdus[2][0] != 0x31 {
+		t.Errorf("headers %x %x %x", pdus[0][:5], pdus[1][:3], pdus[2][:3])
+	}
+	for _, p := range pdus {
+		if len(p) > maxPduSize {
+			t.Errorf("PDU of %d bytes", len(p))
+		}
+	}
+
+	// The server's fragments of the same message are reassembled.
+	for _, p := range pdus {
+		c.Process(p)
+	}
+	if len(h.msgs) != 1 || !bytes.Equal(h.msgs[0], msg) {
+		t.Errorf("reassembled %d messages", len(h.msgs))
+	}
+}
+
+func TestConcurrentSend(t *testing.T) {
+	rec := &sendRecorder{}
+	c := NewDvcClient()
+	c.Sender(rec)
+	h := &recordHandler{}
+	c.RegisterHandler("a", h)
+	c.RegisterHandler("b", &recordHandler{})
+	c.Process(append([]byte{0x10, 1}, "a\x00"...))
+	send := h.send
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				send(make([]byte, 3000))
+			}
+		}()
+	}
+	// Other channels open and close meanwhile.
+	for i := range 50 {
+		c.Process(append([]byte{0x10, byte(2 + i)}, "b\x00"...))
+		c.Process([]byte{0x40, byte(2 + i)})
+	}
+	wg.Wait()
+
+	// Each DATA_FIRST of channel 1 is followed by the rest of its message.
+	pending, messages := 0, 0
+	for _, p := range rec.take() {
+		if p[1] != 1 {
+			continue
+		}
+		switch p[0] >> 4 {
+		case DYNVC_DATA_FIRST:
+			if pending != 0 {
+				t.Fatal("messages interleaved on one channel")
+			}
+			pending = 3000 - (len(p) - 4)
+			messages++
+		case DYNVC_DATA:
+			pending -= len(p) - 2
+		}
+	}
+	if pending != 0 || messages != 200 {
+		t.Errorf("%d messages sent, %d bytes missing", messages, pending)
+	}
+}
+
+func TestPriorityCharges(t *testing.T) {
+	c := NewDvcClient()
+	c.Sender(&sendRecorder{})
+	c.RegisterHandler("echo", &recordHandler{})
+	// Version 2, class 1 charged three times class 0.
+	c.Process([]byte{0x50, 0, 2, 0, 1, 0, 3, 0, 1, 0, 1, 0})
+	c.Process(append([]byte{0x14, 3}, "echo\x00"...)) // Pri=1
+	if ch := c.channelById[3]; ch == nil || ch.priority != 1 {
+		t.Fatalf("channel %+v", ch)
+	}
+
+	// Hold the channel with a class 2 PDU until six PDUs of each of
+	// classes 0 and 1 wait, then see who sends.
+	s := c.sched
+	release := make(chan struct{})
+	held := make(chan struct{})
+	go s.send(2, 1, func() { close(held); <-release })
+	<-held
+	var mu sync.Mutex
+	var order []uint8
+	var wg sync.WaitGroup
+	for _, pri := range []uint8{0, 1} {
+		for range 6 {
+			wg.Add(1)
+			go s.send(pri, 1, func() {
+				mu.Lock()
+				order = append(order, pri)
+				mu.Unlock()
+				wg.Done()
+			})
+		}
+	}
+	for {
+		s.mu.Lock()
+		n := s.waiting[0] + s.waiting[1]
+		s.mu.Unlock()
+		if n == 12 {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	var counts [2]int
+	for _, p := range order[:8] {
+		counts[p]++
+	}
+	if counts != [2]int{6, 2} {
+		t.Errorf("first 8 PDUs by class %v, order %v", counts, order)
+	}
+}
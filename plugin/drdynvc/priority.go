@@ -0,0 +1,77 @@
+package drdynvc
+
+import "sync"
+
+// scheduler shares the static channel between the four priority classes
+// of the dynamic channels, weighted by the priority charges of the
+// server's Capabilities PDU.  Sending a PDU costs its length times the
+// charge of its class, and of the classes with a PDU waiting the one
+// that has spent the least sends next: while classes compete, each gets
+// a share of the channel inversely proportional to its charge, and a
+// class alone gets all of it.
+type scheduler struct {
+	mu      sync.Mutex
+	cond    sync.Cond
+	charges [4]uint64
+	spent   [4]uint64
+	// now is what the class of the last PDU sent had spent before it.
+	now     uint64
+	waiting [4]int
+	busy    bool
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{charges: [4]uint64{1, 1, 1, 1}}
+	s.cond.L = &s.mu
+	return s
+}
+
+// setCharges weighs the classes with the charges of a version 2 or 3
+// server.  A zero charge counts as 1.
+func (s *scheduler) setCharges(charges [4]uint16) {
+	s.mu.Lock()
+	for i, c := range charges {
+		s.charges[i] = max(uint64(c), 1)
+	}
+	s.mu.Unlock()
+}
+
+// send calls f to send a PDU of n bytes of priority class pri once it
+// is the turn of the class.
+func (s *scheduler) send(pri uint8, n int, f func()) {
+	p := pri & 3
+	s.mu.Lock()
+	if s.waiting[p] == 0 {
+		// A class back from idle starts level with the last PDU sent:
+		// it does not get to spend the share it left the others.
+		s.spent[p] = max(s.spent[p], s.now)
+	}
+	s.waiting[p]++
+	for s.busy || !s.turn(p) {
+		s.cond.Wait()
+	}
+	s.waiting[p]--
+	s.busy = true
+	s.now = s.spent[p]
+	s.spent[p] += uint64(n) * s.charges[p]
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.busy = false
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}()
+	f()
+}
+
+// turn reports whether class p has spent the least of the classes
+// waiting, the lower class winning a tie.
+func (s *scheduler) turn(p uint8) bool {
+	for q := range uint8(len(s.waiting)) {
+		if q != p && s.waiting[q] > 0 && (s.spent[q] < s.spent[p] || s.spent[q] == s.spent[p] && q < p) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package rail
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+// The icon caches the client offers in its Window List capability.
+const (
+	NumIconCaches       = 3
+	NumIconCacheEntries = 12
+)
+
+var errIcon = errors.New("rail: malformed icon")
+
+// iconImage converts the bitmap of an icon to an image.  The pixels the
+// AND mask sets are transparent, except in a 32 bpp icon with an alpha
+// channel of its own.
+func iconImage(i *pdu.IconInfo) (*image.NRGBA, error) {
+	w, h := int(i.Width), int(i.Height)
+	if w == 0 || h == 0 {
+		return nil, errIcon
+	}
+	bpp := int(i.Bpp)
+	switch bpp {
+	case 1, 4, 8, 16, 24, 32:
+	default:
+		return nil, errIcon
+	}
+	// The scanlines are padded, usually to 4 bytes; derive the stride
+	// from the data rather than trusting the padding.
+	stride := len(i.BitsColor) / h
+	if stride < (w*bpp+7)/8 {
+		return nil, errIcon
+	}
+	var palette []color.NRGBA
+	if bpp <= 8 {
+		palette = make([]color.NRGBA, 1<<bpp)
+		for n := range palette {
+			if 4*n+3 < len(i.ColorTable) {
+				q := i.ColorTable[4*n:]
+				palette[n] = color.NRGBA{q[2], q[1], q[0], 0xFF}
+			}
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	hasAlpha := false
+	for y := 0; y < h; y++ {
+		row := i.BitsColor[(h-1-y)*stride:]
+		for x := 0; x < w; x++ {
+			var c color.NRGBA
+			switch bpp {
+			case 1, 4, 8:
+				bit := x * bpp
+				v := row[bit/8] >> (8 - bpp - bit%8) & (1<<bpp - 1)
+				c = palette[v]
+			case 16:
+				v := binary.LittleEndian.Uint16(row[2*x:])
+				c = color.NRGBA{uint8(v>>10&0x1F) << 3, uint8(v>>5&0x1F) << 3, uint8(v&0x1F) << 3, 0xFF}
+			case 24:
+				c = color.NRGBA{row[3*x+2], row[3*x+1], row[3*x], 0xFF}
+			case 32:
+				c = color.NRGBA{row[4*x+2], row[4*x+1], row[4*x], row[4*x+3]}
+				hasAlpha = hasAlpha || c.A != 0
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	if hasAlpha {
+		return img, nil
+	}
+
+	maskStride := len(i.BitsMask) / h
+	if maskStride < (w+7)/8 {
+		// No usable mask: the icon is opaque.
+		if bpp == 32 {
+			for n := 3; n < len(img.Pix); n += 4 {
+				img.Pix[n] = 0xFF
+			}
+		}
+		return img, nil
+	}
+	for y := 0; y < h; y++ {
+		row := i.BitsMask[(h-1-y)*maskStride:]
+		for x := 0; x < w; x++ {
+			a := uint8(0xFF)
+			if row[x/8]&(0x80>>(x%8)) != 0 {
+				a = 0
+			}
+			img.Pix[y*img.Stride+4*x+3] = a
+		}
+	}
+	return img, nil
+}
+
+// iconCache holds the icons the server caches, by cache ID and entry.
+type iconCache [NumIconCaches][NumIconCacheEntries]image.Image
+
+// icon returns the image of the icon of an icon order, caching it, or
+// the cached icon the order names.
+func (c *iconCache) icon(info *pdu.IconInfo, cached *pdu.CachedIcon) (image.Image, error) {
+	if cached != nil {
+		if int(cached.CacheId) >= NumIconCaches || int(cached.CacheEntry) >= NumIconCacheEntries {
+			return nil, errIcon
+		}
+		if img := c[cached.CacheId][cached.CacheEntry]; img != nil {
+			return img, nil
+		}
+		return nil, errors.New("rail: cached icon not found")
+	}
+	img, err := iconImage(info)
+	if err != nil {
+		return nil, err
+	}
+	if info.CacheId != pdu.ICON_CACHE_NONE && int(info.CacheId) < NumIconCaches && int(info.CacheEntry) < NumIconCacheEntries {
+		c[info.CacheId][info.CacheEntry] = img
+	}
+	return img, nil
+}
@@ -0,0 +1,185 @@
+package rail
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// Language bar states of LanguageBarInfo
+const (
+	TF_SFT_SHOWNORMAL              = 0x00000001
+	TF_SFT_DOCK                    = 0x00000002
+	TF_SFT_MINIMIZED               = 0x00000004
+	TF_SFT_HIDDEN                  = 0x00000008
+	TF_SFT_NOTRANSPARENCY          = 0x00000010
+	TF_SFT_LOWTRANSPARENCY         = 0x00000020
+	TF_SFT_HIGHTRANSPARENCY        = 0x00000040
+	TF_SFT_LABELS                  = 0x00000080
+	TF_SFT_NOLABELS                = 0x00000100
+	TF_SFT_EXTRAICONSONMINIMIZED   = 0x00000200
+	TF_SFT_NOEXTRAICONSONMINIMIZED = 0x00000400
+	TF_SFT_DESKBAND                = 0x00000800
+)
+
+// Profile types of LanguageProfile
+const (
+	TF_PROFILETYPE_INPUTPROCESSOR = 0x00000001
+	TF_PROFILETYPE_KEYBOARDLAYOUT = 0x00000002
+)
+
+// IME states of CompartmentInfo
+const (
+	IME_STATE_CLOSED = 0x00000000
+	IME_STATE_OPEN   = 0x00000001
+
+	IME_CMODE_NATIVE       = 0x00000001
+	IME_CMODE_KATAKANA     = 0x00000002
+	IME_CMODE_FULLSHAPE    = 0x00000008
+	IME_CMODE_ROMAN        = 0x00000010
+	IME_CMODE_CHARCODE     = 0x00000020
+	IME_CMODE_HANJACONVERT = 0x00000040
+	IME_CMODE_SOFTKBD      = 0x00000080
+	IME_CMODE_NOCONVERSION = 0x00000100
+	IME_CMODE_EUDC         = 0x00000200
+	IME_CMODE_SYMBOL       = 0x00000400
+	IME_CMODE_FIXED        = 0x00000800
+
+	IME_SMODE_NONE          = 0x00000000
+	IME_SMODE_PLURALCASE    = 0x00000001
+	IME_SMODE_SINGLECONVERT = 0x00000002
+	IME_SMODE_AUTOMATIC     = 0x00000004
+	IME_SMODE_PHRASEPREDICT = 0x00000008
+	IME_SMODE_CONVERSATION  = 0x00000010
+
+	KANA_MODE_OFF = 0x00000000
+	KANA_MODE_ON  = 0x00000001
+)
+
+// LanguageBarInfo reports the TF_SFT_* state of the language bar of the
+// server, which the client shows docked in its own taskbar.
+type LanguageBarInfo struct {
+	Status uint32
+}
+
+// CompartmentInfo is the IME state of the focused input context: the
+// IME_STATE_*, IME_CMODE_* conversion, IME_SMODE_* sentence and
+// KANA_MODE_* values.
+type CompartmentInfo struct {
+	ImeState        uint32
+	ImeConvMode     uint32
+	ImeSentenceMode uint32
+	KanaMode        uint32
+}
+
+// LanguageProfile is the active input language of the client: a
+// keyboard layout, or a text service such as an IME, which ProfileCLSID
+// and ProfileGUID, in their little-endian wire layout, name.
+type LanguageProfile struct {
+	ProfileType    uint32
+	LanguageId     uint32
+	ProfileCLSID   [16]byte
+	ProfileGUID    [16]byte
+	KeyboardLayout uint32
+}
+
+func (*LanguageBarInfo) railEvent() {}
+func (*CompartmentInfo) railEvent() {}
+
+var errNoImeSync = errors.New("rail: server does not synchronize the language and IME")
+
+// SetServerSupportLevel records the TS_RAIL_LEVEL_* values of the Remote
+// Programs capability of the server, which decide the language bar and
+// IME messages it accepts.
+func (c *RailClient) SetServerSupportLevel(level uint32) {
+	c.mu.Lock()
+	c.serverLevel = level
+	c.mu.Unlock()
+}
+
+func (c *RailClient) serverSupports(level uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.serverLevel&level != 0
+}
+
+// SetLanguageBarStatus tells the server the TF_SFT_* state the user gave
+// the docked language bar.
+func (c *RailClient) SetLanguageBarStatus(status uint32) error {
+	if !c.serverSupports(TS_RAIL_LEVEL_DOCKED_LANGBAR_SUPPORTED) {
+		return errors.New("rail: server has no docked language bar")
+	}
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(status, b)
+	c.sendData(TS_RAIL_ORDER_LANGBARINFO, b.Bytes())
+	return nil
+}
+
+// SetLanguageProfile tells the server the input language the user
+// switched to on the client.
+func (c *RailClient) SetLanguageProfile(p LanguageProfile) error {
+	if !c.serverSupports(TS_RAIL_LEVEL_LANGUAGE_IME_SYNC_SUPPORTED) {
+		return errNoImeSync
+	}
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(p.ProfileType, b)
+	core.WriteUInt32LE(p.LanguageId, b)
+	core.WriteBytes(p.ProfileCLSID[:], b)
+	core.WriteBytes(p.ProfileGUID[:], b)
+	core.WriteUInt32LE(p.KeyboardLayout, b)
+	c.sendData(TS_RAIL_ORDER_LANGUAGEIMEINFO, b.Bytes())
+	return nil
+}
+
+// SetKeyboardLayout tells the server the user switched to the keyboard
+// layout, an input locale identifier such as 0x00000411 for Japanese.
+func (c *RailClient) SetKeyboardLayout(layout uint32) error {
+	return c.SetLanguageProfile(LanguageProfile{
+		ProfileType:    TF_PROFILETYPE_KEYBOARDLAYOUT,
+		LanguageId:     layout & 0xFFFF,
+		KeyboardLayout: layout,
+	})
+}
+
+// SetCompartmentInfo tells the server the IME state the user set on the
+// client, such as turning Japanese input on.
+func (c *RailClient) SetCompartmentInfo(ci CompartmentInfo) error {
+	if !c.serverSupports(TS_RAIL_LEVEL_LANGUAGE_IME_SYNC_SUPPORTED) {
+		return errNoImeSync
+	}
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(ci.ImeState, b)
+	core.WriteUInt32LE(ci.ImeConvMode, b)
+	core.WriteUInt32LE(ci.ImeSentenceMode, b)
+	core.WriteUInt32LE(ci.KanaMode, b)
+	c.sendData(TS_RAIL_ORDER_COMPARTMENTINFO, b.Bytes())
+	return nil
+}
+
+// sendKeyboardLayout sends KeyboardLayout when the session starts, if
+// the server synchronizes it.
+func (c *RailClient) sendKeyboardLayout() {
+	if c.KeyboardLayout == 0 || !c.serverSupports(TS_RAIL_LEVEL_LANGUAGE_IME_SYNC_SUPPORTED) {
+		return
+	}
+	c.SetKeyboardLayout(c.KeyboardLayout)
+}
+
+func (c *RailClient) processLanguageBarInfo(b []byte) {
+	r := bytes.NewReader(b)
+	var e LanguageBarInfo
+	e.Status, _ = core.ReadUInt32LE(r)
+	c.log.Debug("rail: language bar", "status", e.Status)
+	c.emit(&e)
+}
+
+func (c *RailClient) processCompartmentInfo(b []byte) {
+	r := bytes.NewReader(b)
+	var e CompartmentInfo
+	for _, v := range []*uint32{&e.ImeState, &e.ImeConvMode, &e.ImeSentenceMode, &e.KanaMode} {
+		*v, _ = core.ReadUInt32LE(r)
+	}
+	c.log.Debug("rail: IME state", "state", e.ImeState, "conversion", e.ImeConvMode)
+	c.emit(&e)
+}
@@ -3,9 +3,10 @@ package rail
 
 import (
 	"bytes"
-	"encoding/hex"
 	"fmt"
+	"image"
 	"log/slog"
+	"sync"
 
 	"github.com/nakagami/grdp/core"
 	"github.com/nakagami/grdp/plugin"
@@ -44,6 +45,40 @@ const (
 	TS_RAIL_ORDER_EXEC_RESULT           = 0x0080
 )
 
+// RAIL_BUILD_NUMBER is the build number the client reports in its
+// Handshake PDU.
+const RAIL_BUILD_NUMBER = 0x00001DB0
+
+// Handshake Ex flags (MS-RDPERP 2.2.2.2.3)
+const (
+	TS_RAIL_ORDER_HANDSHAKEEX_FLAGS_HIDEF                   = 0x00000001
+	TS_RAIL_ORDER_HANDSHAKE_EX_FLAGS_EXTENDED_SPI_SUPPORTED = 0x00000002
+	TS_RAIL_ORDER_HANDSHAKE_EX_FLAGS_SNAP_ARRANGE_SUPPORTED = 0x00000004
+)
+
+// Remote Programs capability support levels (MS-RDPERP 2.2.1.1.1)
+const (
+	TS_RAIL_LEVEL_SUPPORTED                           = 0x00000001
+	TS_RAIL_LEVEL_DOCKED_LANGBAR_SUPPORTED            = 0x00000002
+	TS_RAIL_LEVEL_SHELL_INTEGRATION_SUPPORTED         = 0x00000004
+	TS_RAIL_LEVEL_LANGUAGE_IME_SYNC_SUPPORTED         = 0x00000008
+	TS_RAIL_LEVEL_SERVER_TO_CLIENT_IME_SYNC_SUPPORTED = 0x00000010
+	TS_RAIL_LEVEL_HIDE_MINIMIZED_APPS_SUPPORTED       = 0x00000020
+	TS_RAIL_LEVEL_WINDOW_CLOAKING_SUPPORTED           = 0x00000040
+	TS_RAIL_LEVEL_HANDSHAKE_EX_SUPPORTED              = 0x00000080
+)
+
+// Window List capability support levels (MS-RDPERP 2.2.1.1.2)
+const (
+	TS_WINDOW_LEVEL_NOT_SUPPORTED = 0x00000000
+	TS_WINDOW_LEVEL_SUPPORTED     = 0x00000001
+	TS_WINDOW_LEVEL_SUPPORTED_EX  = 0x00000002
+)
+
+// RailClient serves the RAIL static virtual channel of a RemoteApp
+// session: it launches the remote application once the server greets
+// it, reports the window orders and channel messages of the server as
+// Events, and sends the commands of the local window manager back.
 type RailClient struct {
 	w                        core.ChannelSender
 	DesktopWidth             uint16
@@ -51,6 +86,27 @@ type RailClient struct {
 	RemoteApplicationProgram string
 	ShellWorkingDirectory    string
 	RemoteApplicationCmdLine string
+	// ExecFlags are the TS_RAIL_EXEC_FLAG_* values of the Client
+	// Execute PDU.
+	ExecFlags uint16
+	// KeyboardLayout is the input locale identifier of the client, sent
+	// when the session starts if the server synchronizes the language.
+	KeyboardLayout uint32
+
+	onEvent func(Event)
+
+	// mu guards windows, the server windows by ID, notifyIcons, the
+	// notification icons by window and icon ID, the icon cache and the
+	// desktop state.
+	mu           sync.Mutex
+	windows      map[uint32]*Window
+	notifyIcons  map[[2]uint32]*NotifyIcon
+	icons        iconCache
+	activeWindow uint32
+	zOrder       []uint32
+	serverLevel  uint32
+
+	log *slog.Logger
 }
 
 func NewClient() *RailClient {
@@ -59,6 +115,26 @@ func NewClient() *RailClient {
 		DesktopHeight:            600,
 		RemoteApplicationProgram: "calc",
 		ShellWorkingDirectory:    "/tmp",
+		windows:                  make(map[uint32]*Window),
+		notifyIcons:              make(map[[2]uint32]*NotifyIcon),
+		log:                      core.Logger(nil, "rail"),
+	}
+}
+
+// SetLogger makes the client log to l, with the attribute layer=rail.
+func (c *RailClient) SetLogger(l *slog.Logger) {
+	c.log = core.Logger(l, "rail")
+}
+
+// OnEvent sets the function that receives the Events of the session.
+// It is called from the goroutine reading the connection.
+func (c *RailClient) OnEvent(f func(Event)) {
+	c.onEvent = f
+}
+
+func (c *RailClient) emit(e Event) {
+	if c.onEvent != nil {
+		c.onEvent(e)
 	}
 }
 
@@ -81,9 +157,11 @@ func (h *RailPDUHeader) serialize() []byte {
 	return b.Bytes()
 }
 
-func (c *RailClient) sendData(mType uint16, ln int, s []byte) {
-	slog.Debug("sendData", "ln", ln, "s_length", len(s), "data", hex.EncodeToString(s))
-	header := NewRailPDUHeader(mType, uint16(ln))
+// sendData sends the order mType with body s; the order length counts
+// the header.
+func (c *RailClient) sendData(mType uint16, s []byte) {
+	c.log.Debug("sendData", "type", mType, "data", core.Hex(s))
+	header := NewRailPDUHeader(mType, uint16(4+len(s)))
 
 	b := &bytes.Buffer{}
 	core.WriteBytes(header.serialize(), b)
@@ -93,7 +171,10 @@ func (c *RailClient) sendData(mType uint16, ln int, s []byte) {
 }
 
 func (c *RailClient) Send(s []byte) (int, error) {
-	slog.Debug("send", "len", len(s), "data", hex.EncodeToString(s))
+	c.log.Debug("send", "len", len(s), "data", core.Hex(s))
+	if c.w == nil {
+		return 0, fmt.Errorf("rail: channel not open")
+	}
 	name, _ := c.GetType()
 	return c.w.SendToChannel(name, s)
 }
@@ -105,36 +186,63 @@ func (c *RailClient) GetType() (string, uint32) {
 }
 
 func (c *RailClient) Process(s []byte) {
-	slog.Debug("recv", "data", hex.EncodeToString(s))
+	c.log.Debug("recv", "data", core.Hex(s))
 	r := bytes.NewReader(s)
 	msgType, _ := core.ReadUint16LE(r)
 	length, _ := core.ReadUint16LE(r)
 
-	slog.Debug("rail", "type", fmt.Sprintf("0x%x", msgType), "length", length, "remaining", r.Len())
+	c.log.Debug("rail", "type", fmt.Sprintf("0x%x", msgType), "length", length, "remaining", r.Len())
 
-	b, _ := core.ReadBytes(int(length), r)
-	slog.Debug("recv body", "data", hex.EncodeToString(b))
+	// The order length counts the header.
+	b, _ := core.ReadBytes(max(int(length)-4, 0), r)
+	c.log.Debug("recv body", "data", core.Hex(b))
 
 	switch msgType {
 	case TS_RAIL_ORDER_HANDSHAKE:
-		slog.Debug("TS_RAIL_ORDER_HANDSHAKE")
-		c.processOrderHandshake(b)
+		c.log.Debug("TS_RAIL_ORDER_HANDSHAKE")
+		c.processOrderHandshake(b, false)
+	case TS_RAIL_ORDER_HANDSHAKE_EX:
+		c.log.Debug("TS_RAIL_ORDER_HANDSHAKE_EX")
+		c.processOrderHandshake(b, true)
 	case TS_RAIL_ORDER_SYSPARAM:
-		slog.Debug("TS_RAIL_ORDER_SYSPARAM")
+		c.log.Debug("TS_RAIL_ORDER_SYSPARAM")
 		c.processOrderSysparam(b)
 	case TS_RAIL_ORDER_EXEC_RESULT:
-		slog.Debug("TS_RAIL_ORDER_EXEC_RESULT")
+		c.log.Debug("TS_RAIL_ORDER_EXEC_RESULT")
 		c.processExecResult(b)
+	case TS_RAIL_ORDER_LOCALMOVESIZE:
+		c.processLocalMoveSize(b)
+	case TS_RAIL_ORDER_MINMAXINFO:
+		c.processMinMaxInfo(b)
+	case TS_RAIL_ORDER_LANGBARINFO:
+		c.processLanguageBarInfo(b)
+	case TS_RAIL_ORDER_COMPARTMENTINFO:
+		c.processCompartmentInfo(b)
+	case TS_RAIL_ORDER_ZORDER_SYNC, TS_RAIL_ORDER_CLOAK, TS_RAIL_ORDER_POWER_DISPLAY_REQUEST,
+		TS_RAIL_ORDER_GET_APPID_RESP, TS_RAIL_ORDER_GET_APPID_RESP_EX:
+		c.log.Debug("rail: order ignored", "msgType", fmt.Sprintf("0x%x", msgType))
 
 	default:
-		slog.Error("type not supported", "msgType", fmt.Sprintf("0x%x", msgType))
+		c.log.Error("type not supported", "msgType", fmt.Sprintf("0x%x", msgType))
 	}
 }
 
-func (c *RailClient) processOrderHandshake(b []byte) {
+// processOrderHandshake answers the Handshake or Handshake Ex PDU of the
+// server with the client Handshake, Client Information, System
+// Parameters and Execute PDUs, and the Language Profile of the keyboard
+// layout.
+func (c *RailClient) processOrderHandshake(b []byte, ex bool) {
 	r := bytes.NewReader(b)
 	buildNumber, _ := core.ReadUInt32LE(r)
-	slog.Debug("processOrderHandshake", "buildNumber", buildNumber)
+	var flags uint32
+	if ex {
+		flags, _ = core.ReadUInt32LE(r)
+	}
+	c.log.Debug("processOrderHandshake", "buildNumber", buildNumber, "flags", flags)
+
+	hs := &bytes.Buffer{}
+	core.WriteUInt32LE(RAIL_BUILD_NUMBER, hs)
+	c.sendData(TS_RAIL_ORDER_HANDSHAKE, hs.Bytes())
 
 	//send client info
 	c.sendClientStatus()
@@ -144,6 +252,8 @@ func (c *RailClient) processOrderHandshake(b []byte) {
 
 	//send client execute
 	c.sendClientExecute()
+
+	c.sendKeyboardLayout()
 }
 
 const (
@@ -159,7 +269,7 @@ const (
 )
 
 func (c *RailClient) sendClientStatus() {
-	slog.Debug("Send client Status")
+	c.log.Debug("Send client Status")
 	var flags uint32 = TS_RAIL_CLIENTSTATUS_ALLOWLOCALMOVESIZE
 
 	//if (settings->AutoReconnectionEnabled)
@@ -174,7 +284,7 @@ func (c *RailClient) sendClientStatus() {
 	b := &bytes.Buffer{}
 	core.WriteUInt32LE(flags, b)
 
-	c.sendData(TS_RAIL_ORDER_CLIENTSTATUS, 4, b.Bytes())
+	c.sendData(TS_RAIL_ORDER_CLIENTSTATUS, b.Bytes())
 }
 
 const (
@@ -251,7 +361,7 @@ type RailSysparamOrder struct {
 }
 
 func (c *RailClient) sendClientSystemparam() {
-	slog.Debug("Send client Systemparam")
+	c.log.Debug("Send client Systemparam")
 
 	var sp RailSysparamOrder
 	sp.params = 0
@@ -305,13 +415,12 @@ func (c *RailClient) sendClientSystemparam() {
 
 	if sp.params&SPI_MASK_SET_WORK_AREA != 0 {
 		sp.param = SPI_SET_WORK_AREA
-		slog.Debug("SPI_SET_WORK_AREA")
+		c.log.Debug("SPI_SET_WORK_AREA")
 		c.sendOneClientSysparam(&sp)
 	}
 }
 
 func (c *RailClient) sendOneClientSysparam(sp *RailSysparamOrder) {
-	length := 0
 	b := &bytes.Buffer{}
 	core.WriteUInt32LE(sp.param, b)
 	switch sp.param {
@@ -346,9 +455,12 @@ func (c *RailClient) sendOneClientSysparam(sp *RailSysparamOrder) {
 		core.WriteUInt16LE(sp.taskbarPos.bottom, b)
 
 	case SPI_SET_HIGH_CONTRAST:
-		core.WriteUInt32LE(sp.highContrast.flags, b)
-		core.WriteUInt32LE(sp.highContrast.colorSchemeLength, b)
+		// The colour scheme is a UNICODE_STRING; its length counts the
+		// byte count before the text.
 		data := core.UnicodeEncode(sp.highContrast.colorScheme)
+		core.WriteUInt32LE(sp.highContrast.flags, b)
+		core.WriteUInt32LE(uint32(2+len(data)), b)
+		core.WriteUInt16LE(uint16(len(data)), b)
 		core.WriteBytes(data, b)
 
 	case SPI_SETFILTERKEYS:
@@ -367,20 +479,53 @@ func (c *RailClient) sendOneClientSysparam(sp *RailSysparamOrder) {
 	case SPI_SETTOGGLEKEYS:
 		core.WriteUInt32LE(sp.toggleKeys, b)
 
-	case SPI_MASK_SET_SET_SCREEN_SAVE_SECURE:
+	case SPI_SET_SCREEN_SAVE_SECURE:
 		core.WriteUInt8(sp.setScreenSaveSecure, b)
 
-	case SPI_MASK_SET_SCREEN_SAVE_ACTIVE:
+	case SPI_SET_SCREEN_SAVE_ACTIVE:
 		core.WriteUInt8(sp.setScreenSaveActive, b)
 
 	default:
-		slog.Error("ERROR_BAD_ARGUMENTS")
+		c.log.Error("ERROR_BAD_ARGUMENTS")
 		return
 	}
 
-	c.sendData(TS_RAIL_ORDER_SYSPARAM, length+b.Len(), b.Bytes())
+	c.sendData(TS_RAIL_ORDER_SYSPARAM, b.Bytes())
+}
+
+// UpdateWorkArea tells the server the work area of the local desktop,
+// the part not covered by its taskbars and docks, after it changes.
+func (c *RailClient) UpdateWorkArea(r image.Rectangle) {
+	c.sendRectSysparam(SPI_SET_WORK_AREA, r)
+}
+
+// UpdateDisplay tells the server the bounds of the local display after
+// they change.
+func (c *RailClient) UpdateDisplay(r image.Rectangle) {
+	c.sendRectSysparam(SPI_DISPLAY_CHANGE, r)
+}
+
+// UpdateTaskbarPos tells the server where the local taskbar is, so that
+// remote applications keep clear of it.
+func (c *RailClient) UpdateTaskbarPos(r image.Rectangle) {
+	c.sendRectSysparam(SPI_TASKBAR_POS, r)
+}
+
+func (c *RailClient) sendRectSysparam(param uint32, r image.Rectangle) {
+	rect := Rectangle16{uint16(r.Min.X), uint16(r.Min.Y), uint16(r.Max.X), uint16(r.Max.Y)}
+	sp := RailSysparamOrder{param: param, workArea: rect, displayChange: rect, taskbarPos: rect}
+	c.sendOneClientSysparam(&sp)
 }
 
+// Client Execute flags (MS-RDPERP 2.2.2.3.1)
+const (
+	TS_RAIL_EXEC_FLAG_EXPAND_WORKINGDIRECTORY = 0x0001
+	TS_RAIL_EXEC_FLAG_TRANSLATE_FILES         = 0x0002
+	TS_RAIL_EXEC_FLAG_FILE                    = 0x0004
+	TS_RAIL_EXEC_FLAG_EXPAND_ARGUMENTS        = 0x0008
+	TS_RAIL_EXEC_FLAG_APP_USER_MODEL_ID       = 0x0010
+)
+
 type RailExecOrder struct {
 	flags                       uint16
 	RemoteApplicationProgram    string
@@ -389,9 +534,9 @@ type RailExecOrder struct {
 }
 
 func (c *RailClient) sendClientExecute() {
-	slog.Debug("Send Client Execute")
+	c.log.Debug("Send Client Execute")
 	var exec RailExecOrder
-	//exec.flags = TS_RAIL_EXEC_FLAG_EXPAND_ARGUMENTS
+	exec.flags = c.ExecFlags
 	exec.RemoteApplicationProgram = c.RemoteApplicationProgram
 	exec.RemoteApplicationWorkingDir = c.ShellWorkingDirectory
 	exec.RemoteApplicationArguments = c.RemoteApplicationCmdLine
@@ -400,7 +545,6 @@ func (c *RailClient) sendClientExecute() {
 	workdir := core.UnicodeEncode(exec.RemoteApplicationWorkingDir)
 	arguments := core.UnicodeEncode(exec.RemoteApplicationArguments)
 
-	length := 4
 	b := &bytes.Buffer{}
 	core.WriteUInt16LE(exec.flags, b)
 	core.WriteUInt16LE(uint16(len(program)), b)
@@ -409,17 +553,26 @@ func (c *RailClient) sendClientExecute() {
 	core.WriteBytes(program, b)
 	core.WriteBytes(workdir, b)
 	core.WriteBytes(arguments, b)
-	length += b.Len()
 
-	c.sendData(TS_RAIL_ORDER_EXEC, length, b.Bytes())
+	c.sendData(TS_RAIL_ORDER_EXEC, b.Bytes())
+}
 
+// Execute launches another application or file in the session, which
+// answers with an *ExecResult.
+func (c *RailClient) Execute(program, workingDir, arguments string, flags uint16) {
+	c.RemoteApplicationProgram = program
+	c.ShellWorkingDirectory = workingDir
+	c.RemoteApplicationCmdLine = arguments
+	c.ExecFlags = flags
+	c.sendClientExecute()
 }
 
 func (c *RailClient) processOrderSysparam(b []byte) {
 	r := bytes.NewReader(b)
 	systemParam, _ := core.ReadUInt32LE(r)
 	body, _ := core.ReadUInt8(r)
-	slog.Debug("processOrderSysparam", "systemParam", fmt.Sprintf("0x%x", systemParam), "body", body)
+	c.log.Debug("processOrderSysparam", "systemParam", fmt.Sprintf("0x%x", systemParam), "body", body)
+	c.emit(&ServerSysparam{Param: systemParam, Enabled: body != 0})
 }
 
 const (
@@ -447,6 +600,10 @@ func (c *RailClient) processExecResult(b []byte) {
 	core.ReadUint16LE(r)
 	exeOrFileLength, _ := core.ReadUint16LE(r)
 	exeOrFile, _ := core.ReadBytes(r.Len(), r)
-	slog.Debug("processExecResult", "flags", flags, "execResult", execResult, "rawResult", rawResult)
-	slog.Debug("processExecResult", "length", exeOrFileLength, "file", core.UnicodeDecode(exeOrFile))
+	c.log.Debug("processExecResult", "flags", flags, "execResult", execResult, "rawResult", rawResult)
+	c.log.Debug("processExecResult", "length", exeOrFileLength, "file", core.UnicodeDecode(exeOrFile))
+	if int(exeOrFileLength) < len(exeOrFile) {
+		exeOrFile = exeOrFile[:exeOrFileLength]
+	}
+	c.emit(&ExecResult{Flags: flags, Result: execResult, RawResult: rawResult, ExeOrFile: core.UnicodeDecode(exeOrFile)})
 }
@@ -0,0 +1,153 @@
+package rail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/color"
+	"testing"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+type sendRecorder struct {
+	pdus [][]byte
+}
+
+func (s *sendRecorder) SendToChannel(channel string, b []byte) (int, error) {
+	s.pdus = append(s.pdus, bytes.Clone(b))
+	return len(b), nil
+}
+
+func TestHandshake(t *testing.T) {
+	rec := &sendRecorder{}
+	c := NewClient()
+	c.Sender(rec)
+	c.Process([]byte{TS_RAIL_ORDER_HANDSHAKE, 0, 8, 0, 0xB0, 0x1D, 0, 0})
+
+	if len(rec.pdus) < 4 {
+		t.Fatalf("sent %d PDUs", len(rec.pdus))
+	}
+	var types []uint16
+	for _, b := range rec.pdus {
+		types = append(types, binary.LittleEndian.Uint16(b))
+		if n := binary.LittleEndian.Uint16(b[2:]); int(n) != len(b) {
+			t.Errorf("order 0x%x: length %d, sent %d bytes", types[len(types)-1], n, len(b))
+		}
+	}
+	if types[0] != TS_RAIL_ORDER_HANDSHAKE || types[1] != TS_RAIL_ORDER_CLIENTSTATUS ||
+		types[len(types)-1] != TS_RAIL_ORDER_EXEC {
+		t.Errorf("order types %x", types)
+	}
+	for _, ty := range types[2 : len(types)-1] {
+		if ty != TS_RAIL_ORDER_SYSPARAM {
+			t.Errorf("order types %x", types)
+		}
+	}
+}
+
+func TestWindowOrders(t *testing.T) {
+	c := NewClient()
+	var events []*WindowEvent
+	c.OnEvent(func(e Event) { events = append(events, e.(*WindowEvent)) })
+
+	c.ProcessOrder(&pdu.WindowOrder{
+		FieldsPresent: pdu.WINDOW_ORDER_TYPE_WINDOW | pdu.WINDOW_ORDER_STATE_NEW | pdu.WINDOW_ORDER_FIELD_TITLE,
+		WindowId:      7,
+		Title:         "Notepad",
+	})
+	c.ProcessOrder(&pdu.WindowOrder{
+		FieldsPresent: pdu.WINDOW_ORDER_TYPE_WINDOW | pdu.WINDOW_ORDER_FIELD_SHOW,
+		WindowId:      7,
+		ShowState:     3,
+	})
+	if ws := c.Windows(); len(ws) != 1 || ws[0].Title != "Notepad" || ws[0].ShowState != 3 {
+		t.Errorf("windows = %+v", ws)
+	}
+	c.ProcessOrder(&pdu.WindowOrder{
+		FieldsPresent: pdu.WINDOW_ORDER_TYPE_WINDOW | pdu.WINDOW_ORDER_STATE_DELETED,
+		WindowId:      7,
+	})
+
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	for i, want := range []EventType{Created, Updated, Deleted} {
+		if events[i].Type != want || events[i].Window.Id != 7 {
+			t.Errorf("event %d = %v %d, want %v", i, events[i].Type, events[i].Window.Id, want)
+		}
+	}
+	if events[1].Window.Title != "Notepad" {
+		t.Errorf("updated window lost its title: %+v", events[1].Window)
+	}
+	if len(c.Windows()) != 0 {
+		t.Error("deleted window still listed")
+	}
+}
+
+func TestWindowIcon(t *testing.T) {
+	c := NewClient()
+	var last *WindowEvent
+	c.OnEvent(func(e Event) { last = e.(*WindowEvent) })
+	c.ProcessOrder(&pdu.WindowOrder{FieldsPresent: pdu.WINDOW_ORDER_TYPE_WINDOW | pdu.WINDOW_ORDER_STATE_NEW, WindowId: 1})
+
+	// A 2x2 24 bpp icon, bottom-up with 4-byte aligned rows: blue and
+	// green at the bottom, red and white at the top, whose white pixel
+	// the mask makes transparent.
+	c.ProcessOrder(&pdu.WindowOrder{
+		FieldsPresent: pdu.WINDOW_ORDER_TYPE_WINDOW | pdu.WINDOW_ORDER_ICON,
+		WindowId:      1,
+		Icon: &pdu.IconInfo{
+			CacheEntry: 1, CacheId: 0, Bpp: 24, Width: 2, Height: 2,
+			BitsMask:  []byte{0, 0, 0, 0, 0x40, 0, 0, 0},
+			BitsColor: []byte{0xFF, 0, 0, 0, 0xFF, 0, 0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0},
+		},
+	})
+	if last == nil || last.Window.Icon == nil {
+		t.Fatal("no icon")
+	}
+	img := last.Window.Icon
+	for _, p := range []struct {
+		x, y       int
+		r, g, b, a uint8
+	}{{0, 0, 0xFF, 0, 0, 0xFF}, {1, 0, 0xFF, 0xFF, 0xFF, 0}, {0, 1, 0, 0, 0xFF, 0xFF}, {1, 1, 0, 0xFF, 0, 0xFF}} {
+		got := color.NRGBAModel.Convert(img.At(p.x, p.y)).(color.NRGBA)
+		if want := (color.NRGBA{p.r, p.g, p.b, p.a}); got != want {
+			t.Errorf("pixel (%d, %d) = %v, want %v", p.x, p.y, got, want)
+		}
+	}
+
+	c.ProcessOrder(&pdu.WindowOrder{
+		FieldsPresent: pdu.WINDOW_ORDER_TYPE_WINDOW | pdu.WINDOW_ORDER_CACHED_ICON | pdu.WINDOW_ORDER_FIELD_ICON_BIG,
+		WindowId:      1,
+		CachedIcon:    &pdu.CachedIcon{CacheEntry: 1, CacheId: 0},
+	})
+	if last.Window.BigIcon != img {
+		t.Error("cached icon not used as the big icon")
+	}
+}
+
+func TestLanguageSync(t *testing.T) {
+	rec := &sendRecorder{}
+	c := NewClient()
+	c.Sender(rec)
+	c.KeyboardLayout = 0x00000411
+	if err := c.SetCompartmentInfo(CompartmentInfo{ImeState: IME_STATE_OPEN}); err == nil {
+		t.Error("IME state sent to a server that does not synchronize it")
+	}
+
+	c.SetServerSupportLevel(TS_RAIL_LEVEL_SUPPORTED | TS_RAIL_LEVEL_LANGUAGE_IME_SYNC_SUPPORTED)
+	c.Process([]byte{TS_RAIL_ORDER_HANDSHAKE, 0, 8, 0, 0xB0, 0x1D, 0, 0})
+	last := rec.pdus[len(rec.pdus)-1]
+	if len(last) != 4+44 || binary.LittleEndian.Uint16(last) != TS_RAIL_ORDER_LANGUAGEIMEINFO ||
+		binary.LittleEndian.Uint32(last[4:]) != TF_PROFILETYPE_KEYBOARDLAYOUT ||
+		binary.LittleEndian.Uint32(last[8:]) != 0x0411 || binary.LittleEndian.Uint32(last[44:]) != 0x00000411 {
+		t.Errorf("language profile %x", last)
+	}
+
+	var got *CompartmentInfo
+	c.OnEvent(func(e Event) { got = e.(*CompartmentInfo) })
+	c.Process([]byte{TS_RAIL_ORDER_COMPARTMENTINFO, 0, 20, 0, 1, 0, 0, 0, 0x19, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0})
+	if got == nil || *got != (CompartmentInfo{IME_STATE_OPEN, IME_CMODE_NATIVE | IME_CMODE_FULLSHAPE | IME_CMODE_ROMAN, IME_SMODE_NONE, KANA_MODE_ON}) {
+		t.Errorf("compartment info = %+v", got)
+	}
+}
@@ -0,0 +1,488 @@
+package rail
+
+import (
+	"bytes"
+	"cmp"
+	"image"
+	"slices"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+// Event is a change reported by a RemoteApp session: a *WindowEvent,
+// *NotifyIconEvent, *DesktopEvent, *ExecResult, *LocalMoveSize,
+// *MinMaxInfo, *ServerSysparam, *LanguageBarInfo or *CompartmentInfo.
+type Event interface {
+	railEvent()
+}
+
+// EventType tells whether a window or notification icon is new, changed
+// or gone.
+type EventType int
+
+const (
+	Created EventType = iota
+	Updated
+	Deleted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case Created:
+		return "Created"
+	case Updated:
+		return "Updated"
+	case Deleted:
+		return "Deleted"
+	}
+	return "Unknown"
+}
+
+// Window styles that decide whether a window has a taskbar entry
+const (
+	WS_CHILD         = 0x40000000
+	WS_VISIBLE       = 0x10000000
+	WS_EX_TOOLWINDOW = 0x00000080
+	WS_EX_APPWINDOW  = 0x00040000
+)
+
+// Window is the state of a server window, as built up by the window
+// orders of the server.  The rectangles are in server desktop
+// coordinates.
+type Window struct {
+	Id            uint32
+	OwnerId       uint32
+	Style         uint32
+	ExtendedStyle uint32
+	// ShowState is the SW_* value of the window: 0 hidden, 2 minimized,
+	// 3 maximized, 5 shown.
+	ShowState  uint8
+	Title      string
+	Bounds     image.Rectangle
+	ClientArea image.Rectangle
+	RootParent uint32
+	// Rects is the shape of the window, relative to Bounds.Min, and
+	// Visibility its visible region, relative to VisibleOffset; a window
+	// with no Rects is rectangular.
+	Rects         []image.Rectangle
+	VisibleOffset image.Point
+	Visibility    []image.Rectangle
+	// Icon is the small icon of the window, for its title bar, and
+	// BigIcon the icon for the taskbar and task switcher; either is nil
+	// until the server sends it.
+	Icon    image.Image
+	BigIcon image.Image
+	// TaskbarButton is set when the window is a tab of a taskbar button
+	// group that should not be shown as its own tab.
+	TaskbarButton bool
+}
+
+// ShowInTaskbar reports whether the window should have a taskbar entry
+// of its own, as Windows decides: a visible top-level window that is
+// not a tool window, and is unowned unless it asks for an entry.
+func (w *Window) ShowInTaskbar() bool {
+	if w.Style&WS_VISIBLE == 0 || w.Style&WS_CHILD != 0 || w.ShowState == 0 {
+		return false
+	}
+	if w.ExtendedStyle&WS_EX_APPWINDOW != 0 {
+		return true
+	}
+	return w.ExtendedStyle&WS_EX_TOOLWINDOW == 0 && w.OwnerId == 0
+}
+
+// WindowEvent reports a window order: the window after the change, and
+// the WINDOW_ORDER_FIELD_* values of the fields it changed.
+type WindowEvent struct {
+	Type   EventType
+	Window Window
+	Fields uint32
+}
+
+// NotifyIcon is the state of an icon in the notification area of the
+// server taskbar.
+type NotifyIcon struct {
+	WindowId uint32
+	Id       uint32
+	Version  uint32
+	ToolTip  string
+	InfoTip  pdu.NotifyIconInfoTip
+	State    uint32
+	Icon     image.Image
+}
+
+// NotifyIconEvent reports a notification icon order.
+type NotifyIconEvent struct {
+	Type   EventType
+	Icon   NotifyIcon
+	Fields uint32
+}
+
+// DesktopEvent reports a desktop order.  Fields tells which of
+// ActiveWindowId and ZOrder are set; WINDOW_ORDER_FIELD_DESKTOP_NONE
+// means the server is not monitoring its desktop.
+type DesktopEvent struct {
+	Fields         uint32
+	ActiveWindowId uint32
+	ZOrder         []uint32
+}
+
+// ExecResult is the answer of the server to a Client Execute PDU.
+// Result is a RAIL_EXEC_* value.
+type ExecResult struct {
+	Flags     uint16
+	Result    uint16
+	RawResult uint32
+	ExeOrFile string
+}
+
+// Move/size types of LocalMoveSize
+const (
+	RAIL_WMSZ_LEFT        = 0x0001
+	RAIL_WMSZ_RIGHT       = 0x0002
+	RAIL_WMSZ_TOP         = 0x0003
+	RAIL_WMSZ_TOPLEFT     = 0x0004
+	RAIL_WMSZ_TOPRIGHT    = 0x0005
+	RAIL_WMSZ_BOTTOM      = 0x0006
+	RAIL_WMSZ_BOTTOMLEFT  = 0x0007
+	RAIL_WMSZ_BOTTOMRIGHT = 0x0008
+	RAIL_WMSZ_MOVE        = 0x0009
+	RAIL_WMSZ_KEYMOVE     = 0x000A
+	RAIL_WMSZ_KEYSIZE     = 0x000B
+)
+
+// LocalMoveSize asks the local window manager to start or reports the
+// end of a move or resize of a window, a RAIL_WMSZ_* Type, which the
+// user began on the server.  X and Y are the cursor position for mouse
+// moves and sizes.  Once the local move ends, MoveWindow tells the
+// server the final rectangle.
+type LocalMoveSize struct {
+	WindowId uint32
+	Start    bool
+	Type     uint16
+	X, Y     int16
+}
+
+// MinMaxInfo bounds the size and position of a window the local window
+// manager moves or resizes.
+type MinMaxInfo struct {
+	WindowId       uint32
+	MaxWidth       int16
+	MaxHeight      int16
+	MaxPosX        int16
+	MaxPosY        int16
+	MinTrackWidth  int16
+	MinTrackHeight int16
+	MaxTrackWidth  int16
+	MaxTrackHeight int16
+}
+
+// ServerSysparam reports a system parameter of the server, such as
+// SPI_SET_SCREEN_SAVE_ACTIVE.
+type ServerSysparam struct {
+	Param   uint32
+	Enabled bool
+}
+
+func (*WindowEvent) railEvent()     {}
+func (*NotifyIconEvent) railEvent() {}
+func (*DesktopEvent) railEvent()    {}
+func (*ExecResult) railEvent()      {}
+func (*LocalMoveSize) railEvent()   {}
+func (*MinMaxInfo) railEvent()      {}
+func (*ServerSysparam) railEvent()  {}
+
+// ProcessOrder applies a window, notification icon or desktop order of
+// the server and reports it as an Event.  Other orders are ignored.
+func (c *RailClient) ProcessOrder(order any) {
+	switch o := order.(type) {
+	case *pdu.WindowOrder:
+		c.processWindowOrder(o)
+	case *pdu.NotifyIconOrder:
+		c.processNotifyIconOrder(o)
+	case *pdu.DesktopOrder:
+		c.processDesktopOrder(o)
+	}
+}
+
+func (c *RailClient) processWindowOrder(o *pdu.WindowOrder) {
+	if o.FieldsPresent&(pdu.WINDOW_ORDER_ICON|pdu.WINDOW_ORDER_CACHED_ICON) != 0 {
+		c.processWindowIcon(o)
+		return
+	}
+	c.mu.Lock()
+	w, ok := c.windows[o.WindowId]
+	t := Updated
+	switch {
+	case o.FieldsPresent&pdu.WINDOW_ORDER_STATE_DELETED != 0:
+		if !ok {
+			c.mu.Unlock()
+			return
+		}
+		delete(c.windows, o.WindowId)
+		t = Deleted
+	case !ok || o.FieldsPresent&pdu.WINDOW_ORDER_STATE_NEW != 0:
+		w = &Window{Id: o.WindowId}
+		c.windows[o.WindowId] = w
+		t = Created
+	}
+	if t != Deleted {
+		applyWindowOrder(w, o)
+	}
+	e := &WindowEvent{Type: t, Window: *w, Fields: o.FieldsPresent}
+	c.mu.Unlock()
+	c.emit(e)
+}
+
+// processWindowIcon sets the icon of a window an icon order sends or
+// names.
+func (c *RailClient) processWindowIcon(o *pdu.WindowOrder) {
+	c.mu.Lock()
+	w, ok := c.windows[o.WindowId]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	img, err := c.icons.icon(o.Icon, o.CachedIcon)
+	if err != nil {
+		c.mu.Unlock()
+		c.log.Debug("rail: window icon", "window", o.WindowId, "err", err)
+		return
+	}
+	if o.FieldsPresent&pdu.WINDOW_ORDER_FIELD_ICON_BIG != 0 {
+		w.BigIcon = img
+	} else {
+		w.Icon = img
+	}
+	e := &WindowEvent{Type: Updated, Window: *w, Fields: o.FieldsPresent}
+	c.mu.Unlock()
+	c.emit(e)
+}
+
+func rects(rs []pdu.WindowRect) []image.Rectangle {
+	out := make([]image.Rectangle, len(rs))
+	for i, r := range rs {
+		out[i] = image.Rect(int(r.Left), int(r.Top), int(r.Right), int(r.Bottom))
+	}
+	return out
+}
+
+func applyWindowOrder(w *Window, o *pdu.WindowOrder) {
+	f := o.FieldsPresent
+	if f&pdu.WINDOW_ORDER_FIELD_OWNER != 0 {
+		w.OwnerId = o.OwnerWindowId
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_STYLE != 0 {
+		w.Style, w.ExtendedStyle = o.Style, o.ExtendedStyle
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_SHOW != 0 {
+		w.ShowState = o.ShowState
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_TITLE != 0 {
+		w.Title = o.Title
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_WND_OFFSET != 0 {
+		w.Bounds = w.Bounds.Sub(w.Bounds.Min).Add(image.Pt(int(o.WindowOffsetX), int(o.WindowOffsetY)))
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_WND_SIZE != 0 {
+		w.Bounds.Max = w.Bounds.Min.Add(image.Pt(int(o.WindowWidth), int(o.WindowHeight)))
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_CLIENT_AREA_OFFSET != 0 {
+		w.ClientArea = w.ClientArea.Sub(w.ClientArea.Min).Add(image.Pt(int(o.ClientOffsetX), int(o.ClientOffsetY)))
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_CLIENT_AREA_SIZE != 0 {
+		w.ClientArea.Max = w.ClientArea.Min.Add(image.Pt(int(o.ClientAreaWidth), int(o.ClientAreaHeight)))
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_ROOT_PARENT != 0 {
+		w.RootParent = o.RootParentHandle
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_WND_RECTS != 0 {
+		w.Rects = rects(o.WindowRects)
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_VIS_OFFSET != 0 {
+		w.VisibleOffset = image.Pt(int(o.VisibleOffsetX), int(o.VisibleOffsetY))
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_VISIBILITY != 0 {
+		w.Visibility = rects(o.VisibilityRects)
+	}
+	if f&pdu.WINDOW_ORDER_FIELD_TASKBAR_BUTTON != 0 {
+		w.TaskbarButton = o.TaskbarButton != 0
+	}
+}
+
+func (c *RailClient) processNotifyIconOrder(o *pdu.NotifyIconOrder) {
+	key := [2]uint32{o.WindowId, o.NotifyIconId}
+	f := o.FieldsPresent
+	c.mu.Lock()
+	p, ok := c.notifyIcons[key]
+	t := Updated
+	switch {
+	case f&pdu.WINDOW_ORDER_STATE_DELETED != 0:
+		if !ok {
+			c.mu.Unlock()
+			return
+		}
+		delete(c.notifyIcons, key)
+		t = Deleted
+	case !ok || f&pdu.WINDOW_ORDER_STATE_NEW != 0:
+		p = &NotifyIcon{WindowId: o.WindowId, Id: o.NotifyIconId}
+		c.notifyIcons[key] = p
+		t = Created
+	}
+	if t != Deleted {
+		if f&pdu.WINDOW_ORDER_FIELD_NOTIFY_VERSION != 0 {
+			p.Version = o.Version
+		}
+		if f&pdu.WINDOW_ORDER_FIELD_NOTIFY_TIP != 0 {
+			p.ToolTip = o.ToolTip
+		}
+		if f&pdu.WINDOW_ORDER_FIELD_NOTIFY_INFO_TIP != 0 {
+			p.InfoTip = o.InfoTip
+		}
+		if f&pdu.WINDOW_ORDER_FIELD_NOTIFY_STATE != 0 {
+			p.State = o.State
+		}
+		if o.Icon != nil || o.CachedIcon != nil {
+			if img, err := c.icons.icon(o.Icon, o.CachedIcon); err == nil {
+				p.Icon = img
+			} else {
+				c.log.Debug("rail: notification icon", "window", o.WindowId, "id", o.NotifyIconId, "err", err)
+			}
+		}
+	}
+	e := &NotifyIconEvent{Type: t, Icon: *p, Fields: f}
+	c.mu.Unlock()
+	c.emit(e)
+}
+
+func (c *RailClient) processDesktopOrder(o *pdu.DesktopOrder) {
+	c.mu.Lock()
+	if o.FieldsPresent&pdu.WINDOW_ORDER_FIELD_DESKTOP_ACTIVE_WND != 0 {
+		c.activeWindow = o.ActiveWindowId
+	}
+	if o.FieldsPresent&pdu.WINDOW_ORDER_FIELD_DESKTOP_ZORDER != 0 {
+		c.zOrder = o.ZOrder
+	}
+	c.mu.Unlock()
+	c.emit(&DesktopEvent{Fields: o.FieldsPresent, ActiveWindowId: o.ActiveWindowId, ZOrder: o.ZOrder})
+}
+
+// Windows returns the server windows front to back, as far as the
+// desktop orders tell the z-order, then the others by ID.
+func (c *RailClient) Windows() []Window {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ws := make([]Window, 0, len(c.windows))
+	for _, w := range c.windows {
+		ws = append(ws, *w)
+	}
+	rank := func(id uint32) int {
+		if i := slices.Index(c.zOrder, id); i >= 0 {
+			return i
+		}
+		return len(c.zOrder)
+	}
+	slices.SortFunc(ws, func(a, b Window) int {
+		return cmp.Or(cmp.Compare(rank(a.Id), rank(b.Id)), cmp.Compare(a.Id, b.Id))
+	})
+	return ws
+}
+
+// ActiveWindow returns the ID of the active server window, or 0 if the
+// desktop orders have not told it.
+func (c *RailClient) ActiveWindow() uint32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.activeWindow
+}
+
+func (c *RailClient) processLocalMoveSize(b []byte) {
+	r := bytes.NewReader(b)
+	var e LocalMoveSize
+	e.WindowId, _ = core.ReadUInt32LE(r)
+	start, _ := core.ReadUint16LE(r)
+	e.Start = start != 0
+	e.Type, _ = core.ReadUint16LE(r)
+	x, _ := core.ReadUint16LE(r)
+	y, _ := core.ReadUint16LE(r)
+	e.X, e.Y = int16(x), int16(y)
+	c.log.Debug("rail: local move/size", "window", e.WindowId, "start", e.Start, "type", e.Type)
+	c.emit(&e)
+}
+
+func (c *RailClient) processMinMaxInfo(b []byte) {
+	r := bytes.NewReader(b)
+	var e MinMaxInfo
+	e.WindowId, _ = core.ReadUInt32LE(r)
+	for _, v := range []*int16{&e.MaxWidth, &e.MaxHeight, &e.MaxPosX, &e.MaxPosY,
+		&e.MinTrackWidth, &e.MinTrackHeight, &e.MaxTrackWidth, &e.MaxTrackHeight} {
+		u, _ := core.ReadUint16LE(r)
+		*v = int16(u)
+	}
+	c.emit(&e)
+}
+
+// System commands of SysCommand
+const (
+	SC_SIZE     = 0xF000
+	SC_MOVE     = 0xF010
+	SC_MINIMIZE = 0xF020
+	SC_MAXIMIZE = 0xF030
+	SC_CLOSE    = 0xF060
+	SC_KEYMENU  = 0xF100
+	SC_RESTORE  = 0xF120
+	SC_DEFAULT  = 0xF160
+)
+
+// Activate tells the server that the local window of windowId gained
+// or, if enabled is false, lost the focus.
+func (c *RailClient) Activate(windowId uint32, enabled bool) {
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(windowId, b)
+	if enabled {
+		core.WriteUInt8(1, b)
+	} else {
+		core.WriteUInt8(0, b)
+	}
+	c.sendData(TS_RAIL_ORDER_ACTIVATE, b.Bytes())
+}
+
+// SysCommand applies an SC_* command, such as the local window manager
+// minimizing or closing the window, to a server window.
+func (c *RailClient) SysCommand(windowId uint32, command uint16) {
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(windowId, b)
+	core.WriteUInt16LE(command, b)
+	c.sendData(TS_RAIL_ORDER_SYSCOMMAND, b.Bytes())
+}
+
+// MoveWindow moves a server window to r, in server desktop coordinates,
+// after a local move or resize.
+func (c *RailClient) MoveWindow(windowId uint32, r image.Rectangle) {
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(windowId, b)
+	for _, v := range []int{r.Min.X, r.Min.Y, r.Max.X, r.Max.Y} {
+		core.WriteUInt16LE(uint16(int16(v)), b)
+	}
+	c.sendData(TS_RAIL_ORDER_WINDOWMOVE, b.Bytes())
+}
+
+// SysMenu opens the system menu of a server window at p, in server
+// desktop coordinates.
+func (c *RailClient) SysMenu(windowId uint32, p image.Point) {
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(windowId, b)
+	core.WriteUInt16LE(uint16(int16(p.X)), b)
+	core.WriteUInt16LE(uint16(int16(p.Y)), b)
+	c.sendData(TS_RAIL_ORDER_SYSMENU, b.Bytes())
+}
+
+// NotifyIconEvent forwards a mouse or keyboard message, such as
+// WM_LBUTTONDOWN (0x0201), on a local notification icon to the server.
+func (c *RailClient) NotifyIconEvent(windowId, notifyIconId, message uint32) {
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(windowId, b)
+	core.WriteUInt32LE(notifyIconId, b)
+	core.WriteUInt32LE(message, b)
+	c.sendData(TS_RAIL_ORDER_NOTIFY_EVENT, b.Bytes())
+}
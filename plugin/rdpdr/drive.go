@@ -0,0 +1,891 @@
+package rdpdr
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// NTSTATUS values (MS-ERREF 2.3)
+const (
+	STATUS_SUCCESS               = 0x00000000
+	STATUS_NO_MORE_FILES         = 0x80000006
+	STATUS_UNSUCCESSFUL          = 0xC0000001
+	STATUS_INVALID_HANDLE        = 0xC0000008
+	STATUS_INVALID_PARAMETER     = 0xC000000D
+	STATUS_NO_SUCH_DEVICE        = 0xC000000E
+	STATUS_NO_SUCH_FILE          = 0xC000000F
+	STATUS_ACCESS_DENIED         = 0xC0000022
+	STATUS_OBJECT_NAME_INVALID   = 0xC0000033
+	STATUS_OBJECT_NAME_NOT_FOUND = 0xC0000034
+	STATUS_OBJECT_NAME_COLLISION = 0xC0000035
+	STATUS_OBJECT_PATH_NOT_FOUND = 0xC000003A
+	STATUS_MEDIA_WRITE_PROTECTED = 0xC00000A2
+	STATUS_FILE_IS_A_DIRECTORY   = 0xC00000BA
+	STATUS_NOT_SUPPORTED         = 0xC00000BB
+	STATUS_DIRECTORY_NOT_EMPTY   = 0xC0000101
+	STATUS_NOT_A_DIRECTORY       = 0xC0000103
+)
+
+// DR_CREATE_REQ CreateDisposition
+const (
+	FILE_SUPERSEDE    = 0x00000000
+	FILE_OPEN         = 0x00000001
+	FILE_CREATE       = 0x00000002
+	FILE_OPEN_IF      = 0x00000003
+	FILE_OVERWRITE    = 0x00000004
+	FILE_OVERWRITE_IF = 0x00000005
+)
+
+// DR_CREATE_REQ CreateOptions
+const (
+	FILE_DIRECTORY_FILE     = 0x00000001
+	FILE_NON_DIRECTORY_FILE = 0x00000040
+	FILE_DELETE_ON_CLOSE    = 0x00001000
+)
+
+// DR_CREATE_RSP Information
+const (
+	FILE_SUPERSEDED  = 0x00
+	FILE_OPENED      = 0x01
+	FILE_OVERWRITTEN = 0x03
+)
+
+// File attributes (MS-FSCC 2.6)
+const (
+	FILE_ATTRIBUTE_READONLY  = 0x00000001
+	FILE_ATTRIBUTE_HIDDEN    = 0x00000002
+	FILE_ATTRIBUTE_DIRECTORY = 0x00000010
+	FILE_ATTRIBUTE_ARCHIVE   = 0x00000020
+)
+
+// File information classes (MS-FSCC 2.4)
+const (
+	FILE_DIRECTORY_INFORMATION      = 1
+	FILE_FULL_DIRECTORY_INFORMATION = 2
+	FILE_BOTH_DIRECTORY_INFORMATION = 3
+	FILE_BASIC_INFORMATION          = 4
+	FILE_STANDARD_INFORMATION       = 5
+	FILE_RENAME_INFORMATION         = 10
+	FILE_NAMES_INFORMATION          = 12
+	FILE_DISPOSITION_INFORMATION    = 13
+	FILE_ALLOCATION_INFORMATION     = 19
+	FILE_END_OF_FILE_INFORMATION    = 20
+	FILE_ATTRIBUTE_TAG_INFORMATION  = 35
+)
+
+// File system information classes (MS-FSCC 2.5)
+const (
+	FILE_FS_VOLUME_INFORMATION    = 1
+	FILE_FS_SIZE_INFORMATION      = 3
+	FILE_FS_DEVICE_INFORMATION    = 4
+	FILE_FS_ATTRIBUTE_INFORMATION = 5
+	FILE_FS_FULL_SIZE_INFORMATION = 7
+)
+
+// FileFsAttributeInformation FileSystemAttributes
+const (
+	FILE_CASE_SENSITIVE_SEARCH = 0x00000001
+	FILE_CASE_PRESERVED_NAMES  = 0x00000002
+	FILE_UNICODE_ON_DISK       = 0x00000004
+	FILE_READ_ONLY_VOLUME      = 0x00080000
+)
+
+// FileFsDeviceInformation values
+const (
+	FILE_DEVICE_DISK      = 0x00000007
+	FILE_READ_ONLY_DEVICE = 0x00000002
+	FILE_REMOTE_DEVICE    = 0x00000010
+)
+
+const (
+	// maxIOLength bounds the data returned by one read; the server asks
+	// again for the rest.
+	maxIOLength = 1 << 20
+	// The volume geometry reported: 4 KiB allocation units.
+	bytesPerSector  = 512
+	sectorsPerUnit  = 8
+	allocationUnit  = bytesPerSector * sectorsPerUnit
+	maxComponentLen = 255
+	// defaultVolumeSize is the volume size reported when the fs.FS is
+	// not a UsageFS.
+	defaultVolumeSize = 1 << 40
+)
+
+// errReadOnly is returned when the server modifies a read-only drive.
+var errReadOnly = errors.New("rdpdr: read-only drive")
+
+// Drive is a redirected drive backed by an fs.FS.  If the fs.FS is a
+// WritableFS the server can also create, write, rename and delete
+// files; otherwise the drive is read-only.
+type Drive struct {
+	name string
+	fsys fs.FS
+	wfs  WritableFS
+
+	// mu guards files: requests arrive on the connection's goroutine,
+	// Close is called when it ends.
+	mu         sync.Mutex
+	files      map[uint32]*driveFile
+	nextFileId uint32
+}
+
+// driveFile is a file or directory opened by IRP_MJ_CREATE.  Its
+// handles are opened when first needed.
+type driveFile struct {
+	name          string
+	isDir         bool
+	r             fs.File
+	w             File
+	deleteOnClose bool
+
+	// entries and next are the state of a directory query.
+	entries []dirEntry
+	next    int
+}
+
+type dirEntry struct {
+	name string
+	info fs.FileInfo
+}
+
+// NewDrive returns the drive name backed by fsys.  The server shows it
+// as \\tsclient\name; the first 7 characters are its DOS name.
+func NewDrive(name string, fsys fs.FS) *Drive {
+	d := &Drive{name: name, fsys: fsys, files: make(map[uint32]*driveFile)}
+	d.wfs, _ = fsys.(WritableFS)
+	return d
+}
+
+func (d *Drive) DeviceType() uint32 { return RDPDR_DTYP_FILESYSTEM }
+
+func (d *Drive) DosName() string { return d.name }
+
+// DeviceData returns the null-terminated UTF-16 drive name: the name
+// servers prefer over the DOS name.
+func (d *Drive) DeviceData() []byte {
+	return core.UnicodeEncode(d.name + "\x00")
+}
+
+// Close closes the files the server left open.
+func (d *Drive) Close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, f := range d.files {
+		f.closeHandles()
+		delete(d.files, id)
+	}
+}
+
+// IORequest handles the I/O requests of the drive.  They are served
+// synchronously, except change notifications, which stay pending.
+func (d *Drive) IORequest(r *IORequest) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r.MajorFunction == IRP_MJ_CREATE {
+		d.create(r)
+		return
+	}
+	f := d.files[r.FileId]
+	if f == nil {
+		r.Complete(STATUS_INVALID_HANDLE, errorOutput(r.MajorFunction))
+		return
+	}
+	switch r.MajorFunction {
+	case IRP_MJ_CLOSE:
+		d.close(r, f)
+	case IRP_MJ_READ:
+		d.read(r, f)
+	case IRP_MJ_WRITE:
+		d.write(r, f)
+	case IRP_MJ_QUERY_INFORMATION:
+		d.queryInformation(r, f)
+	case IRP_MJ_SET_INFORMATION:
+		d.setInformation(r, f)
+	case IRP_MJ_QUERY_VOLUME_INFORMATION:
+		d.queryVolumeInformation(r)
+	case IRP_MJ_DIRECTORY_CONTROL:
+		switch r.MinorFunction {
+		case IRP_MN_QUERY_DIRECTORY:
+			d.queryDirectory(r, f)
+		case IRP_MN_NOTIFY_CHANGE_DIRECTORY:
+			// Changes are not watched: the request stays pending.
+		default:
+			r.Complete(STATUS_NOT_SUPPORTED, errorOutput(r.MajorFunction))
+		}
+	case IRP_MJ_DEVICE_CONTROL:
+		r.Complete(STATUS_SUCCESS, make([]byte, 4))
+	case IRP_MJ_LOCK_CONTROL:
+		r.Complete(STATUS_SUCCESS, make([]byte, 5))
+	default:
+		r.Complete(STATUS_NOT_SUPPORTED, errorOutput(r.MajorFunction))
+	}
+}
+
+// errorOutput returns the output of a failed request of major: the
+// response fields of the function, zeroed.
+func errorOutput(major uint32) []byte {
+	switch major {
+	case IRP_MJ_CREATE, IRP_MJ_WRITE, IRP_MJ_LOCK_CONTROL:
+		return make([]byte, 5)
+	}
+	return make([]byte, 4)
+}
+
+// create serves DR_CREATE_REQ (MS-RDPEFS 2.2.1.4.1).
+func (d *Drive) create(r *IORequest) {
+	b := r.Data
+	out := make([]byte, 5)
+	if len(b) < 32 {
+		r.Complete(STATUS_INVALID_PARAMETER, out)
+		return
+	}
+	disposition := binary.LittleEndian.Uint32(b[20:])
+	options := binary.LittleEndian.Uint32(b[24:])
+	pathLen := binary.LittleEndian.Uint32(b[28:])
+	if uint64(pathLen) > uint64(len(b)-32) {
+		r.Complete(STATUS_INVALID_PARAMETER, out)
+		return
+	}
+	name, ok := fsPath(b[32 : 32+pathLen])
+	if !ok {
+		r.Complete(STATUS_OBJECT_NAME_INVALID, out)
+		return
+	}
+	f, information, status := d.open(name, disposition, options)
+	if status != STATUS_SUCCESS {
+		r.Complete(status, out)
+		return
+	}
+	d.nextFileId++
+	d.files[d.nextFileId] = f
+	binary.LittleEndian.PutUint32(out, d.nextFileId)
+	out[4] = information
+	r.Complete(STATUS_SUCCESS, out)
+}
+
+func (d *Drive) open(name string, disposition, options uint32) (*driveFile, byte, uint32) {
+	f := &driveFile{name: name, deleteOnClose: options&FILE_DELETE_ON_CLOSE != 0}
+	if f.deleteOnClose && d.wfs == nil {
+		return nil, 0, STATUS_MEDIA_WRITE_PROTECTED
+	}
+	fi, err := fs.Stat(d.fsys, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, ntStatus(err)
+	}
+	if err == nil {
+		if disposition == FILE_CREATE {
+			return nil, 0, STATUS_OBJECT_NAME_COLLISION
+		}
+		if options&FILE_DIRECTORY_FILE != 0 && !fi.IsDir() {
+			return nil, 0, STATUS_NOT_A_DIRECTORY
+		}
+		if options&FILE_NON_DIRECTORY_FILE != 0 && fi.IsDir() {
+			return nil, 0, STATUS_FILE_IS_A_DIRECTORY
+		}
+		f.isDir = fi.IsDir()
+		switch disposition {
+		case FILE_SUPERSEDE, FILE_OVERWRITE, FILE_OVERWRITE_IF:
+			if f.isDir {
+				return nil, 0, STATUS_ACCESS_DENIED
+			}
+			if d.wfs == nil {
+				return nil, 0, STATUS_MEDIA_WRITE_PROTECTED
+			}
+			if f.w, err = d.wfs.OpenFile(name, os.O_RDWR|os.O_TRUNC, 0); err != nil {
+				return nil, 0, ntStatus(err)
+			}
+			if disposition == FILE_SUPERSEDE {
+				return f, FILE_SUPERSEDED, STATUS_SUCCESS
+			}
+			return f, FILE_OVERWRITTEN, STATUS_SUCCESS
+		}
+		return f, FILE_OPENED, STATUS_SUCCESS
+	}
+
+	if _, err := fs.Stat(d.fsys, path.Dir(name)); err != nil {
+		return nil, 0, STATUS_OBJECT_PATH_NOT_FOUND
+	}
+	if disposition == FILE_OPEN || disposition == FILE_OVERWRITE {
+		return nil, 0, STATUS_OBJECT_NAME_NOT_FOUND
+	}
+	if d.wfs == nil {
+		return nil, 0, STATUS_MEDIA_WRITE_PROTECTED
+	}
+	if options&FILE_DIRECTORY_FILE != 0 {
+		f.isDir = true
+		err = d.wfs.Mkdir(name, 0o777)
+	} else {
+		f.w, err = d.wfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o666)
+	}
+	if err != nil {
+		return nil, 0, ntStatus(err)
+	}
+	return f, FILE_SUPERSEDED, STATUS_SUCCESS
+}
+
+// close serves DR_CLOSE_REQ, deleting the file if asked to.
+func (d *Drive) close(r *IORequest, f *driveFile) {
+	delete(d.files, r.FileId)
+	f.closeHandles()
+	status := uint32(STATUS_SUCCESS)
+	if f.deleteOnClose {
+		status = ntStatus(d.wfs.Remove(f.name))
+	}
+	r.Complete(status, make([]byte, 4))
+}
+
+// read serves DR_READ_REQ.
+func (d *Drive) read(r *IORequest, f *driveFile) {
+	b := r.Data
+	if len(b) < 12 {
+		r.Complete(STATUS_INVALID_PARAMETER, make([]byte, 4))
+		return
+	}
+	length := min(binary.LittleEndian.Uint32(b), maxIOLength)
+	offset := int64(binary.LittleEndian.Uint64(b[4:]))
+	ra, err := d.reader(f)
+	if err != nil {
+		r.Complete(ntStatus(err), make([]byte, 4))
+		return
+	}
+	out := make([]byte, 4+length)
+	n, err := ra.ReadAt(out[4:], offset)
+	if err != nil && err != io.EOF {
+		r.Complete(ntStatus(err), make([]byte, 4))
+		return
+	}
+	binary.LittleEndian.PutUint32(out, uint32(n))
+	r.Complete(STATUS_SUCCESS, out[:4+n])
+}
+
+// write serves DR_WRITE_REQ.
+func (d *Drive) write(r *IORequest, f *driveFile) {
+	b := r.Data
+	out := make([]byte, 5)
+	if len(b) < 32 {
+		r.Complete(STATUS_INVALID_PARAMETER, out)
+		return
+	}
+	length := binary.LittleEndian.Uint32(b)
+	offset := int64(binary.LittleEndian.Uint64(b[4:]))
+	if uint64(length) > uint64(len(b)-32) {
+		r.Complete(STATUS_INVALID_PARAMETER, out)
+		return
+	}
+	w, err := d.writer(f)
+	if err != nil {
+		r.Complete(ntStatus(err), out)
+		return
+	}
+	n, err := w.WriteAt(b[32:32+length], offset)
+	binary.LittleEndian.PutUint32(out, uint32(n))
+	r.Complete(ntStatus(err), out)
+}
+
+// queryInformation serves DR_DRIVE_QUERY_INFORMATION_REQ.
+func (d *Drive) queryInformation(r *IORequest, f *driveFile) {
+	if len(r.Data) < 4 {
+		r.Complete(STATUS_INVALID_PARAMETER, make([]byte, 4))
+		return
+	}
+	fi, err := fs.Stat(d.fsys, f.name)
+	if err != nil {
+		r.Complete(ntStatus(err), make([]byte, 4))
+		return
+	}
+	var buf []byte
+	switch binary.LittleEndian.Uint32(r.Data) {
+	case FILE_BASIC_INFORMATION:
+		buf = make([]byte, 36)
+		putTimes(buf, fi)
+		binary.LittleEndian.PutUint32(buf[32:], d.attributes(f.name, fi))
+	case FILE_STANDARD_INFORMATION:
+		buf = make([]byte, 22)
+		binary.LittleEndian.PutUint64(buf, allocationSize(fi))
+		binary.LittleEndian.PutUint64(buf[8:], uint64(fileSize(fi)))
+		binary.LittleEndian.PutUint32(buf[16:], 1) // NumberOfLinks
+		if f.deleteOnClose {
+			buf[20] = 1
+		}
+		if fi.IsDir() {
+			buf[21] = 1
+		}
+	case FILE_ATTRIBUTE_TAG_INFORMATION:
+		buf = make([]byte, 8)
+		binary.LittleEndian.PutUint32(buf, d.attributes(f.name, fi))
+	default:
+		r.Complete(STATUS_NOT_SUPPORTED, make([]byte, 4))
+		return
+	}
+	r.Complete(STATUS_SUCCESS, append(binary.LittleEndian.AppendUint32(nil, uint32(len(buf))), buf...))
+}
+
+// setInformation serves DR_DRIVE_SET_INFORMATION_REQ.
+func (d *Drive) setInformation(r *IORequest, f *driveFile) {
+	b := r.Data
+	if len(b) < 32 {
+		r.Complete(STATUS_INVALID_PARAMETER, make([]byte, 4))
+		return
+	}
+	class := binary.LittleEndian.Uint32(b)
+	length := binary.LittleEndian.Uint32(b[4:])
+	buf := b[32:]
+	if uint64(length) < uint64(len(buf)) {
+		buf = buf[:length]
+	}
+	out := binary.LittleEndian.AppendUint32(nil, length)
+	if d.wfs == nil {
+		r.Complete(STATUS_MEDIA_WRITE_PROTECTED, out)
+		return
+	}
+	var err error
+	switch class {
+	case FILE_BASIC_INFORMATION:
+		if len(buf) < 36 {
+			r.Complete(STATUS_INVALID_PARAMETER, out)
+			return
+		}
+		err = d.setTimes(f, int64(binary.LittleEndian.Uint64(buf[8:])), int64(binary.LittleEndian.Uint64(buf[16:])))
+	case FILE_END_OF_FILE_INFORMATION, FILE_ALLOCATION_INFORMATION:
+		if len(buf) < 8 {
+			r.Complete(STATUS_INVALID_PARAMETER, out)
+			return
+		}
+		size := int64(binary.LittleEndian.Uint64(buf))
+		var fi fs.FileInfo
+		if fi, err = fs.Stat(d.fsys, f.name); err == nil && (class == FILE_END_OF_FILE_INFORMATION || size < fi.Size()) {
+			var w File
+			if w, err = d.writer(f); err == nil {
+				err = w.Truncate(size)
+			}
+		}
+	case FILE_DISPOSITION_INFORMATION:
+		del := len(buf) == 0 || buf[0] != 0
+		if del && f.isDir {
+			var entries []fs.DirEntry
+			if entries, err = fs.ReadDir(d.fsys, f.name); err == nil && len(entries) > 0 {
+				r.Complete(STATUS_DIRECTORY_NOT_EMPTY, out)
+				return
+			}
+		}
+		f.deleteOnClose = del
+	case FILE_RENAME_INFORMATION:
+		if len(buf) < 6 {
+			r.Complete(STATUS_INVALID_PARAMETER, out)
+			return
+		}
+		replace := buf[0] != 0
+		nameLen := binary.LittleEndian.Uint32(buf[2:])
+		if uint64(nameLen) > uint64(len(buf)-6) {
+			r.Complete(STATUS_INVALID_PARAMETER, out)
+			return
+		}
+		name, ok := fsPath(buf[6 : 6+nameLen])
+		if !ok {
+			r.Complete(STATUS_OBJECT_NAME_INVALID, out)
+			return
+		}
+		if _, err := fs.Stat(d.fsys, name); err == nil && !replace {
+			r.Complete(STATUS_OBJECT_NAME_COLLISION, out)
+			return
+		}
+		// Some systems cannot rename open files.
+		f.closeHandles()
+		if err = d.wfs.Rename(f.name, name); err == nil {
+			f.name = name
+		}
+	default:
+		r.Complete(STATUS_NOT_SUPPORTED, out)
+		return
+	}
+	r.Complete(ntStatus(err), out)
+}
+
+// setTimes applies the FILETIME access and write times of a
+// FileBasicInformation; 0 and -1 leave a time unchanged.  Without a
+// ChtimesFS the times are ignored.
+func (d *Drive) setTimes(f *driveFile, atime, mtime int64) error {
+	c, ok := d.wfs.(ChtimesFS)
+	if !ok || (atime <= 0 && mtime <= 0) {
+		return nil
+	}
+	fi, err := fs.Stat(d.fsys, f.name)
+	if err != nil {
+		return err
+	}
+	m := fi.ModTime()
+	if mtime > 0 {
+		m = fromFiletime(uint64(mtime))
+	}
+	a := m
+	if atime > 0 {
+		a = fromFiletime(uint64(atime))
+	}
+	return c.Chtimes(f.name, a, m)
+}
+
+// queryVolumeInformation serves DR_DRIVE_QUERY_VOLUME_INFORMATION_REQ.
+func (d *Drive) queryVolumeInformation(r *IORequest) {
+	if len(r.Data) < 4 {
+		r.Complete(STATUS_INVALID_PARAMETER, make([]byte, 4))
+		return
+	}
+	var buf []byte
+	switch binary.LittleEndian.Uint32(r.Data) {
+	case FILE_FS_VOLUME_INFORMATION:
+		label := core.UnicodeEncode(d.name)
+		buf = make([]byte, 17, 17+len(label))
+		binary.LittleEndian.PutUint32(buf[8:], crc32.ChecksumIEEE([]byte(d.name)))
+		binary.LittleEndian.PutUint32(buf[12:], uint32(len(label)))
+		buf = append(buf, label...)
+	case FILE_FS_SIZE_INFORMATION:
+		total, free := d.usage()
+		buf = make([]byte, 24)
+		binary.LittleEndian.PutUint64(buf, total/allocationUnit)
+		binary.LittleEndian.PutUint64(buf[8:], free/allocationUnit)
+		binary.LittleEndian.PutUint32(buf[16:], sectorsPerUnit)
+		binary.LittleEndian.PutUint32(buf[20:], bytesPerSector)
+	case FILE_FS_FULL_SIZE_INFORMATION:
+		total, free := d.usage()
+		buf = make([]byte, 32)
+		binary.LittleEndian.PutUint64(buf, total/allocationUnit)
+		binary.LittleEndian.PutUint64(buf[8:], free/allocationUnit)
+		binary.LittleEndian.PutUint64(buf[16:], free/allocationUnit)
+		binary.LittleEndian.PutUint32(buf[24:], sectorsPerUnit)
+		binary.LittleEndian.PutUint32(buf[28:], bytesPerSector)
+	case FILE_FS_ATTRIBUTE_INFORMATION:
+		fsName := core.UnicodeEncode("NTFS")
+		attributes := uint32(FILE_CASE_SENSITIVE_SEARCH | FILE_CASE_PRESERVED_NAMES | FILE_UNICODE_ON_DISK)
+		if d.wfs == nil {
+			attributes |= FILE_READ_ONLY_VOLUME
+		}
+		buf = binary.LittleEndian.AppendUint32(nil, attributes)
+		buf = binary.LittleEndian.AppendUint32(buf, maxComponentLen)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(fsName)))
+		buf = append(buf, fsName...)
+	case FILE_FS_DEVICE_INFORMATION:
+		characteristics := uint32(FILE_REMOTE_DEVICE)
+		if d.wfs == nil {
+			characteristics |= FILE_READ_ONLY_DEVICE
+		}
+		buf = binary.LittleEndian.AppendUint32(nil, FILE_DEVICE_DISK)
+		buf = binary.LittleEndian.AppendUint32(buf, characteristics)
+	default:
+		r.Complete(STATUS_NOT_SUPPORTED, make([]byte, 4))
+		return
+	}
+	r.Complete(STATUS_SUCCESS, append(binary.LittleEndian.AppendUint32(nil, uint32(len(buf))), buf...))
+}
+
+// usage returns the volume size and free space reported.
+func (d *Drive) usage() (total, free uint64) {
+	if u, ok := d.fsys.(UsageFS); ok {
+		if total, free, err := u.DiskUsage(); err == nil {
+			return total, free
+		}
+	}
+	if d.wfs == nil {
+		return defaultVolumeSize, 0
+	}
+	return defaultVolumeSize, defaultVolumeSize
+}
+
+// queryDirectory serves DR_DRIVE_QUERY_DIRECTORY_REQ, one entry per
+// request.  The initial query lists the directory entries matching the
+// pattern that ends its path.
+func (d *Drive) queryDirectory(r *IORequest, f *driveFile) {
+	b := r.Data
+	if len(b) < 32 {
+		r.Complete(STATUS_INVALID_PARAMETER, make([]byte, 5))
+		return
+	}
+	class := binary.LittleEndian.Uint32(b)
+	initial := b[4] != 0
+	pathLen := binary.LittleEndian.Uint32(b[5:])
+	if !f.isDir {
+		r.Complete(STATUS_NOT_A_DIRECTORY, make([]byte, 5))
+		return
+	}
+	if initial {
+		pattern := "*"
+		if uint64(pathLen) <= uint64(len(b)-32) {
+			if p := decodePath(b[32 : 32+pathLen]); p != "" {
+				pattern = p[strings.LastIndexByte(p, '\\')+1:]
+			}
+		}
+		entries, err := d.list(f, pattern)
+		if err != nil {
+			r.Complete(ntStatus(err), make([]byte, 5))
+			return
+		}
+		f.entries, f.next = entries, 0
+		if len(entries) == 0 {
+			r.Complete(STATUS_NO_SUCH_FILE, make([]byte, 5))
+			return
+		}
+	}
+	if f.next >= len(f.entries) {
+		r.Complete(STATUS_NO_MORE_FILES, make([]byte, 5))
+		return
+	}
+	buf := d.directoryEntry(class, f.entries[f.next])
+	if buf == nil {
+		r.Complete(STATUS_NOT_SUPPORTED, make([]byte, 5))
+		return
+	}
+	f.next++
+	r.Complete(STATUS_SUCCESS, append(binary.LittleEndian.AppendUint32(nil, uint32(len(buf))), buf...))
+}
+
+// list returns the entries of the directory f matching pattern,
+// including "." and ".." below the drive root.
+func (d *Drive) list(f *driveFile, pattern string) ([]dirEntry, error) {
+	des, err := fs.ReadDir(d.fsys, f.name)
+	if err != nil {
+		return nil, err
+	}
+	var entries []dirEntry
+	if f.name != "." {
+		for _, e := range []dirEntry{{name: "."}, {name: ".."}} {
+			p := f.name
+			if e.name == ".." {
+				p = path.Dir(p)
+			}
+			if e.info, err = fs.Stat(d.fsys, p); err == nil && matchPattern(pattern, e.name) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	for _, de := range des {
+		if !matchPattern(pattern, de.Name()) {
+			continue
+		}
+		if info, err := de.Info(); err == nil {
+			entries = append(entries, dirEntry{name: de.Name(), info: info})
+		}
+	}
+	return entries, nil
+}
+
+// directoryEntry returns the FILE_*_INFORMATION entry of class for e,
+// or nil if the class is not supported.
+func (d *Drive) directoryEntry(class uint32, e dirEntry) []byte {
+	name := core.UnicodeEncode(e.name)
+	var size int
+	switch class {
+	case FILE_DIRECTORY_INFORMATION:
+		size = 64
+	case FILE_FULL_DIRECTORY_INFORMATION:
+		size = 68
+	case FILE_BOTH_DIRECTORY_INFORMATION:
+		size = 93
+	case FILE_NAMES_INFORMATION:
+		buf := make([]byte, 12, 12+len(name))
+		binary.LittleEndian.PutUint32(buf[8:], uint32(len(name)))
+		return append(buf, name...)
+	default:
+		return nil
+	}
+	// NextEntryOffset and FileIndex are zero; so are EaSize and the
+	// short name of the larger classes.
+	buf := make([]byte, size, size+len(name))
+	putTimes(buf[8:], e.info)
+	binary.LittleEndian.PutUint64(buf[40:], uint64(fileSize(e.info)))
+	binary.LittleEndian.PutUint64(buf[48:], allocationSize(e.info))
+	binary.LittleEndian.PutUint32(buf[56:], d.attributes(e.name, e.info))
+	binary.LittleEndian.PutUint32(buf[60:], uint32(len(name)))
+	return append(buf, name...)
+}
+
+// attributes returns the FILE_ATTRIBUTE_* flags of the file name.
+func (d *Drive) attributes(name string, fi fs.FileInfo) uint32 {
+	var a uint32 = FILE_ATTRIBUTE_ARCHIVE
+	if fi.IsDir() {
+		a = FILE_ATTRIBUTE_DIRECTORY
+	} else if d.wfs == nil || fi.Mode().Perm()&0o200 == 0 {
+		a |= FILE_ATTRIBUTE_READONLY
+	}
+	if base := path.Base(name); strings.HasPrefix(base, ".") && base != "." && base != ".." {
+		a |= FILE_ATTRIBUTE_HIDDEN
+	}
+	return a
+}
+
+// reader returns a ReaderAt for f.
+func (d *Drive) reader(f *driveFile) (io.ReaderAt, error) {
+	if f.isDir {
+		return nil, syscall.EISDIR
+	}
+	if f.w != nil {
+		return f.w, nil
+	}
+	if f.r == nil {
+		r, err := d.fsys.Open(f.name)
+		if err != nil {
+			return nil, err
+		}
+		f.r = r
+	}
+	switch r := f.r.(type) {
+	case io.ReaderAt:
+		return r, nil
+	case io.ReadSeeker:
+		return seekReaderAt{r}, nil
+	}
+	return nil, errors.ErrUnsupported
+}
+
+// writer returns f opened for writing.
+func (d *Drive) writer(f *driveFile) (File, error) {
+	if f.isDir {
+		return nil, syscall.EISDIR
+	}
+	if f.w != nil {
+		return f.w, nil
+	}
+	if d.wfs == nil {
+		return nil, errReadOnly
+	}
+	w, err := d.wfs.OpenFile(f.name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if f.r != nil {
+		f.r.Close()
+		f.r = nil
+	}
+	f.w = w
+	return w, nil
+}
+
+func (f *driveFile) closeHandles() {
+	if f.r != nil {
+		f.r.Close()
+		f.r = nil
+	}
+	if f.w != nil {
+		f.w.Close()
+		f.w = nil
+	}
+}
+
+// seekReaderAt reads at offsets of a file that can only seek.
+type seekReaderAt struct {
+	io.ReadSeeker
+}
+
+func (s seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(s.ReadSeeker, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// ntStatus maps an fs error to an NTSTATUS.
+func ntStatus(err error) uint32 {
+	switch {
+	case err == nil:
+		return STATUS_SUCCESS
+	case errors.Is(err, errReadOnly):
+		return STATUS_MEDIA_WRITE_PROTECTED
+	case errors.Is(err, fs.ErrNotExist):
+		return STATUS_OBJECT_NAME_NOT_FOUND
+	case errors.Is(err, fs.ErrExist):
+		return STATUS_OBJECT_NAME_COLLISION
+	case errors.Is(err, fs.ErrPermission):
+		return STATUS_ACCESS_DENIED
+	case errors.Is(err, fs.ErrInvalid):
+		return STATUS_OBJECT_NAME_INVALID
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return STATUS_DIRECTORY_NOT_EMPTY
+	case errors.Is(err, syscall.ENOTDIR):
+		return STATUS_OBJECT_PATH_NOT_FOUND
+	case errors.Is(err, syscall.EISDIR):
+		return STATUS_FILE_IS_A_DIRECTORY
+	case errors.Is(err, errors.ErrUnsupported):
+		return STATUS_NOT_SUPPORTED
+	}
+	return STATUS_UNSUCCESSFUL
+}
+
+// decodePath returns a UTF-16 path of a request without its terminating
+// null.
+func decodePath(b []byte) string {
+	return strings.TrimRight(core.UnicodeDecode(b), "\x00")
+}
+
+// fsPath converts the server's path, relative to the drive root with
+// backslash separators, to an fs.FS name.
+func fsPath(b []byte) (string, bool) {
+	p := strings.Trim(strings.ReplaceAll(decodePath(b), "\\", "/"), "/")
+	if p == "" {
+		return ".", true
+	}
+	return p, fs.ValidPath(p)
+}
+
+// matchPattern reports whether name matches the directory query
+// pattern, case-insensitively.  "<" and ">", the DOS forms of "*" and
+// "?", are treated as those.
+func matchPattern(pattern, name string) bool {
+	if pattern == "*" || pattern == "*.*" {
+		return true
+	}
+	if !strings.ContainsAny(pattern, "*?<>") {
+		return strings.EqualFold(pattern, name)
+	}
+	pattern = strings.NewReplacer("<", "*", ">", "?", "[", "\\[").Replace(strings.ToLower(pattern))
+	ok, _ := path.Match(pattern, strings.ToLower(name))
+	return ok
+}
+
+// putTimes puts the CreationTime, LastAccessTime, LastWriteTime and
+// ChangeTime of fi, all its modification time, at the start of b.
+func putTimes(b []byte, fi fs.FileInfo) {
+	ft := toFiletime(fi.ModTime())
+	for i := range 4 {
+		binary.LittleEndian.PutUint64(b[8*i:], ft)
+	}
+}
+
+func fileSize(fi fs.FileInfo) int64 {
+	if fi.IsDir() {
+		return 0
+	}
+	return fi.Size()
+}
+
+func allocationSize(fi fs.FileInfo) uint64 {
+	return (uint64(fileSize(fi)) + allocationUnit - 1) / allocationUnit * allocationUnit
+}
+
+// unixEpochFiletime is the Unix epoch as a FILETIME, in 100 ns
+// intervals since 1601.
+const unixEpochFiletime = 116444736000000000
+
+func toFiletime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.Unix()*1e7 + int64(t.Nanosecond()/100) + unixEpochFiletime)
+}
+
+func fromFiletime(ft uint64) time.Time {
+	d := int64(ft) - unixEpochFiletime
+	return time.Unix(d/1e7, d%1e7*100).UTC()
+}
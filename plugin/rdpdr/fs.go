@@ -0,0 +1,111 @@
+package rdpdr
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// WritableFS is an fs.FS the server may also modify.  A drive backed by
+// an fs.FS that is not a WritableFS is read-only.  As with fs.FS, names
+// are slash-separated paths satisfying fs.ValidPath.
+type WritableFS interface {
+	fs.FS
+	// OpenFile opens name with the os.O_* flags, creating it with perm
+	// if os.O_CREATE is given.
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Mkdir(name string, perm fs.FileMode) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	Rename(oldname, newname string) error
+}
+
+// File is a file opened by WritableFS.OpenFile.
+type File interface {
+	fs.File
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// ChtimesFS is implemented by a WritableFS that can change the access
+// and modification times of a file.
+type ChtimesFS interface {
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// UsageFS is implemented by an fs.FS that can report the size of the
+// volume it is on and the space left, in bytes.
+type UsageFS interface {
+	DiskUsage() (total, free uint64, err error)
+}
+
+// Dir is a WritableFS of the directory tree rooted at a local
+// directory.  It is built on os.Root, so the server cannot reach files
+// outside the tree, through symbolic links or otherwise.
+type Dir struct {
+	root *os.Root
+	fsys fs.FS
+}
+
+// OpenDir returns a Dir for the directory dir.
+func OpenDir(dir string) (*Dir, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Dir{root: root, fsys: root.FS()}, nil
+}
+
+// Close closes the directory; the Dir cannot be used afterwards.
+func (d *Dir) Close() error {
+	return d.root.Close()
+}
+
+func (d *Dir) Open(name string) (fs.File, error) {
+	return d.fsys.Open(name)
+}
+
+func (d *Dir) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(d.fsys, name)
+}
+
+func (d *Dir) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(d.fsys, name)
+}
+
+func (d *Dir) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return d.root.OpenFile(name, flag, perm)
+}
+
+func (d *Dir) Mkdir(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return d.root.Mkdir(name, perm)
+}
+
+func (d *Dir) Remove(name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	return d.root.Remove(name)
+}
+
+func (d *Dir) Rename(oldname, newname string) error {
+	if !fs.ValidPath(oldname) || !fs.ValidPath(newname) {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrInvalid}
+	}
+	return d.root.Rename(oldname, newname)
+}
+
+func (d *Dir) Chtimes(name string, atime, mtime time.Time) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "chtimes", Path: name, Err: fs.ErrInvalid}
+	}
+	return d.root.Chtimes(name, atime, mtime)
+}
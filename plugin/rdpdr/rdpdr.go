@@ -0,0 +1,394 @@
+// Package rdpdr implements the client side of the RDPDR (File System
+// Virtual Channel Extension, MS-RDPEFS) static virtual channel: the
+// core initialization sequence, device announcement and dispatch of
+// I/O requests to the redirected devices.
+//
+// Drive implements a redirected drive backed by an fs.FS, reachable in
+// the session as \\tsclient\<name>.
+package rdpdr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sync"
+	"unicode/utf16"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/plugin"
+)
+
+const (
+	ChannelName   = plugin.RDPDR_SVC_CHANNEL_NAME
+	ChannelOption = plugin.CHANNEL_OPTION_INITIALIZED |
+		plugin.CHANNEL_OPTION_ENCRYPT_RDP |
+		plugin.CHANNEL_OPTION_COMPRESS_RDP
+)
+
+// RDPDR_HEADER components (MS-RDPEFS 2.2.1.1)
+const (
+	RDPDR_CTYP_CORE = 0x4472
+	RDPDR_CTYP_PRN  = 0x5052
+)
+
+// RDPDR_HEADER packet IDs (MS-RDPEFS 2.2.1.1)
+const (
+	PAKID_CORE_SERVER_ANNOUNCE     = 0x496E
+	PAKID_CORE_CLIENTID_CONFIRM    = 0x4343
+	PAKID_CORE_CLIENT_NAME         = 0x434E
+	PAKID_CORE_DEVICELIST_ANNOUNCE = 0x4441
+	PAKID_CORE_DEVICE_REPLY        = 0x6472
+	PAKID_CORE_DEVICE_IOREQUEST    = 0x4952
+	PAKID_CORE_DEVICE_IOCOMPLETION = 0x4943
+	PAKID_CORE_SERVER_CAPABILITY   = 0x5350
+	PAKID_CORE_CLIENT_CAPABILITY   = 0x4350
+	PAKID_CORE_DEVICELIST_REMOVE   = 0x444D
+	PAKID_CORE_USER_LOGGEDON       = 0x554C
+)
+
+// Capability types (MS-RDPEFS 2.2.1.2.1)
+const (
+	CAP_GENERAL_TYPE   = 0x0001
+	CAP_PRINTER_TYPE   = 0x0002
+	CAP_PORT_TYPE      = 0x0003
+	CAP_DRIVE_TYPE     = 0x0004
+	CAP_SMARTCARD_TYPE = 0x0005
+)
+
+// GENERAL_CAPS_SET extendedPDU flags
+const (
+	RDPDR_DEVICE_REMOVE_PDUS      = 0x00000001
+	RDPDR_CLIENT_DISPLAY_NAME_PDU = 0x00000002
+	RDPDR_USER_LOGGEDON_PDU       = 0x00000004
+)
+
+// Device types (MS-RDPEFS 2.2.1.3)
+const (
+	RDPDR_DTYP_SERIAL     = 0x00000001
+	RDPDR_DTYP_PARALLEL   = 0x00000002
+	RDPDR_DTYP_PRINT      = 0x00000004
+	RDPDR_DTYP_FILESYSTEM = 0x00000008
+	RDPDR_DTYP_SMARTCARD  = 0x00000020
+)
+
+// I/O request major functions (MS-RDPEFS 2.2.1.4)
+const (
+	IRP_MJ_CREATE                   = 0x00000000
+	IRP_MJ_CLOSE                    = 0x00000002
+	IRP_MJ_READ                     = 0x00000003
+	IRP_MJ_WRITE                    = 0x00000004
+	IRP_MJ_QUERY_INFORMATION        = 0x00000005
+	IRP_MJ_SET_INFORMATION          = 0x00000006
+	IRP_MJ_QUERY_VOLUME_INFORMATION = 0x0000000A
+	IRP_MJ_SET_VOLUME_INFORMATION   = 0x0000000B
+	IRP_MJ_DIRECTORY_CONTROL        = 0x0000000C
+	IRP_MJ_DEVICE_CONTROL           = 0x0000000E
+	IRP_MJ_LOCK_CONTROL             = 0x00000011
+)
+
+// IRP_MJ_DIRECTORY_CONTROL minor functions
+const (
+	IRP_MN_QUERY_DIRECTORY         = 0x00000001
+	IRP_MN_NOTIFY_CHANGE_DIRECTORY = 0x00000002
+)
+
+const (
+	// rdpdrVersionMinor is the highest protocol minor version the
+	// client implements.
+	rdpdrVersionMinor = 0x000C
+	// preferredDosNameLen is the size of PreferredDosName, including the
+	// terminating null.
+	preferredDosNameLen = 8
+	// ioRequestHeaderSize is the size of DR_DEVICE_IOREQUEST, header
+	// included.
+	ioRequestHeaderSize = 24
+)
+
+// Device is a device redirected over the channel.
+type Device interface {
+	// DeviceType returns the RDPDR_DTYP_* type of the device.
+	DeviceType() uint32
+	// DosName returns the preferred DOS name: at most 7 ASCII characters.
+	DosName() string
+	// DeviceData returns the type-specific data of the device announce.
+	DeviceData() []byte
+	// IORequest handles an I/O request for the device.  It is called on
+	// the connection's goroutine and may complete r there, later from
+	// another goroutine, or never if the request stays pending.
+	IORequest(r *IORequest)
+}
+
+// IORequest is a Device I/O Request (DR_DEVICE_IOREQUEST).
+type IORequest struct {
+	DeviceId      uint32
+	FileId        uint32
+	CompletionId  uint32
+	MajorFunction uint32
+	MinorFunction uint32
+	// Data holds the function-specific fields that follow the header.
+	Data []byte
+
+	c *Client
+}
+
+// Complete sends the Device I/O Response for r with the NTSTATUS
+// status and the function-specific output.
+func (r *IORequest) Complete(status uint32, output []byte) {
+	b := make([]byte, 16, 16+len(output))
+	binary.LittleEndian.PutUint16(b, RDPDR_CTYP_CORE)
+	binary.LittleEndian.PutUint16(b[2:], PAKID_CORE_DEVICE_IOCOMPLETION)
+	binary.LittleEndian.PutUint32(b[4:], r.DeviceId)
+	binary.LittleEndian.PutUint32(b[8:], r.CompletionId)
+	binary.LittleEndian.PutUint32(b[12:], status)
+	r.c.send(append(b, output...))
+}
+
+// Client implements plugin.ChannelTransport for the "rdpdr" static
+// virtual channel.  The server needs the channel to enable audio
+// output, so the client runs the initialization sequence even without
+// devices.
+type Client struct {
+	channelSender core.ChannelSender
+	computerName  string
+
+	// devices are the redirected devices; the device ID of devices[i]
+	// is i+1.  announced records which have been announced.
+	devices   []Device
+	announced []bool
+
+	versionMinor uint16
+	clientId     uint32
+
+	// sendMu serializes sends: devices may complete requests from their
+	// own goroutines.
+	sendMu sync.Mutex
+
+	log *slog.Logger
+}
+
+// NewClient returns an RDPDR client that announces devices under the
+// client computer name computerName.
+func NewClient(computerName string, devices ...Device) *Client {
+	return &Client{
+		computerName: computerName,
+		devices:      devices,
+		announced:    make([]bool, len(devices)),
+		log:          core.Logger(nil, "rdpdr"),
+	}
+}
+
+// SetLogger makes the client log to l, with the attribute layer=rdpdr,
+// and the devices that have a SetLogger method as well.
+func (c *Client) SetLogger(l *slog.Logger) {
+	c.log = core.Logger(l, "rdpdr")
+	for _, d := range c.devices {
+		if d, ok := d.(interface{ SetLogger(*slog.Logger) }); ok {
+			d.SetLogger(l)
+		}
+	}
+}
+
+// --- plugin.ChannelTransport interface ---
+
+func (c *Client) GetType() (string, uint32) {
+	return ChannelName, ChannelOption
+}
+
+func (c *Client) Sender(s core.ChannelSender) {
+	c.channelSender = s
+}
+
+// Process handles a reassembled RDPDR PDU.
+func (c *Client) Process(s []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Error("rdpdr: panic in Process", "err", r)
+		}
+	}()
+	if len(s) < 4 {
+		return
+	}
+	component := binary.LittleEndian.Uint16(s)
+	packetId := binary.LittleEndian.Uint16(s[2:])
+	body := s[4:]
+	if component != RDPDR_CTYP_CORE {
+		c.log.Debug("rdpdr: ignoring component", "component", fmt.Sprintf("0x%04x", component))
+		return
+	}
+	switch packetId {
+	case PAKID_CORE_SERVER_ANNOUNCE:
+		c.processServerAnnounce(body)
+	case PAKID_CORE_SERVER_CAPABILITY:
+		c.sendClientCapability()
+	case PAKID_CORE_CLIENTID_CONFIRM:
+		// Servers of minor version 5 send no User Logged On PDU.
+		c.announceDevices(c.versionMinor == 0x0005, true)
+	case PAKID_CORE_USER_LOGGEDON:
+		c.announceDevices(true, false)
+	case PAKID_CORE_DEVICE_REPLY:
+		if len(body) >= 8 {
+			deviceId := binary.LittleEndian.Uint32(body)
+			result := binary.LittleEndian.Uint32(body[4:])
+			if result != STATUS_SUCCESS {
+				c.log.Warn("rdpdr: server refused device", "deviceId", deviceId,
+					"status", fmt.Sprintf("0x%08x", result))
+			}
+		}
+	case PAKID_CORE_DEVICE_IOREQUEST:
+		c.processIORequest(body)
+	default:
+		c.log.Debug("rdpdr: unknown packetId", "packetId", fmt.Sprintf("0x%04x", packetId))
+	}
+}
+
+// processServerAnnounce answers the Server Announce Request (MS-RDPEFS
+// 2.2.2.2) with the Client Announce Reply and the Client Name Request.
+func (c *Client) processServerAnnounce(body []byte) {
+	if len(body) < 8 {
+		c.log.Warn("rdpdr: Server Announce Request too short")
+		return
+	}
+	c.versionMinor = min(binary.LittleEndian.Uint16(body[2:]), rdpdrVersionMinor)
+	c.clientId = binary.LittleEndian.Uint32(body[4:])
+
+	b := header(PAKID_CORE_CLIENTID_CONFIRM)
+	b = binary.LittleEndian.AppendUint16(b, 1)
+	b = binary.LittleEndian.AppendUint16(b, c.versionMinor)
+	b = binary.LittleEndian.AppendUint32(b, c.clientId)
+	c.send(b)
+
+	name := utf16.Encode([]rune(c.computerName + "\x00"))
+	b = header(PAKID_CORE_CLIENT_NAME)
+	b = binary.LittleEndian.AppendUint32(b, 1) // UnicodeFlag
+	b = binary.LittleEndian.AppendUint32(b, 0) // CodePage
+	b = binary.LittleEndian.AppendUint32(b, uint32(2*len(name)))
+	b = append(b, core.UTF16ToLittleEndianBytes(name)...)
+	c.send(b)
+}
+
+// sendClientCapability sends the Client Core Capability Response
+// (MS-RDPEFS 2.2.2.8).
+func (c *Client) sendClientCapability() {
+	b := header(PAKID_CORE_CLIENT_CAPABILITY)
+	b = binary.LittleEndian.AppendUint16(b, 3) // numCapabilities
+	b = binary.LittleEndian.AppendUint16(b, 0) // padding
+
+	// GENERAL_CAPS_SET, version 2
+	b = capabilityHeader(b, CAP_GENERAL_TYPE, 44, 2)
+	b = binary.LittleEndian.AppendUint32(b, 0) // osType
+	b = binary.LittleEndian.AppendUint32(b, 0) // osVersion
+	b = binary.LittleEndian.AppendUint16(b, 1) // protocolMajorVersion
+	b = binary.LittleEndian.AppendUint16(b, c.versionMinor)
+	b = binary.LittleEndian.AppendUint32(b, 0x0000FFFF) // ioCode1: every IRP
+	b = binary.LittleEndian.AppendUint32(b, 0)          // ioCode2
+	b = binary.LittleEndian.AppendUint32(b, RDPDR_DEVICE_REMOVE_PDUS|
+		RDPDR_CLIENT_DISPLAY_NAME_PDU|RDPDR_USER_LOGGEDON_PDU)
+	b = binary.LittleEndian.AppendUint32(b, 0) // extraFlags1
+	b = binary.LittleEndian.AppendUint32(b, 0) // extraFlags2
+	b = binary.LittleEndian.AppendUint32(b, 0) // SpecialTypeDeviceCap
+
+	b = capabilityHeader(b, CAP_DRIVE_TYPE, 8, 2)
+	b = capabilityHeader(b, CAP_SMARTCARD_TYPE, 8, 1)
+	c.send(b)
+}
+
+// announceDevices sends a Client Device List Announce (MS-RDPEFS
+// 2.2.2.9) with the devices not announced yet: all of them once the
+// user has logged on, only smart cards before.  always sends the
+// announce even when it lists no device.
+func (c *Client) announceDevices(loggedOn, always bool) {
+	b := header(PAKID_CORE_DEVICELIST_ANNOUNCE)
+	b = binary.LittleEndian.AppendUint32(b, 0) // DeviceCount
+	n := 0
+	for i, d := range c.devices {
+		if c.announced[i] || (!loggedOn && d.DeviceType() != RDPDR_DTYP_SMARTCARD) {
+			continue
+		}
+		c.announced[i] = true
+		n++
+		data := d.DeviceData()
+		b = binary.LittleEndian.AppendUint32(b, d.DeviceType())
+		b = binary.LittleEndian.AppendUint32(b, uint32(i+1))
+		b = append(b, dosName(d.DosName())...)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+		b = append(b, data...)
+	}
+	if n == 0 && !always {
+		return
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(n))
+	c.send(b)
+}
+
+// processIORequest passes a Device I/O Request to its device.
+func (c *Client) processIORequest(body []byte) {
+	if len(body) < ioRequestHeaderSize-4 {
+		c.log.Warn("rdpdr: Device I/O Request too short")
+		return
+	}
+	r := &IORequest{
+		DeviceId:      binary.LittleEndian.Uint32(body),
+		FileId:        binary.LittleEndian.Uint32(body[4:]),
+		CompletionId:  binary.LittleEndian.Uint32(body[8:]),
+		MajorFunction: binary.LittleEndian.Uint32(body[12:]),
+		MinorFunction: binary.LittleEndian.Uint32(body[16:]),
+		Data:          body[20:],
+		c:             c,
+	}
+	i := int(r.DeviceId) - 1
+	if i < 0 || i >= len(c.devices) || !c.announced[i] {
+		c.log.Warn("rdpdr: I/O request for unknown device", "deviceId", r.DeviceId)
+		r.Complete(STATUS_NO_SUCH_DEVICE, make([]byte, 4))
+		return
+	}
+	c.devices[i].IORequest(r)
+}
+
+func (c *Client) send(data []byte) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.channelSender != nil {
+		c.channelSender.SendToChannel(ChannelName, data)
+	}
+}
+
+// header returns an RDPDR_HEADER of the core component.
+func header(packetId uint16) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, RDPDR_CTYP_CORE)
+	return binary.LittleEndian.AppendUint16(b, packetId)
+}
+
+// capabilityHeader appends a CAPABILITY_HEADER to b.
+func capabilityHeader(b []byte, capabilityType, length uint16, version uint32) []byte {
+	b = binary.LittleEndian.AppendUint16(b, capabilityType)
+	b = binary.LittleEndian.AppendUint16(b, length)
+	return binary.LittleEndian.AppendUint32(b, version)
+}
+
+// dosName returns name as a null-padded PreferredDosName, with
+// characters outside printable ASCII replaced by '_'.
+func dosName(name string) []byte {
+	b := make([]byte, preferredDosNameLen)
+	i := 0
+	for _, r := range name {
+		if i == preferredDosNameLen-1 {
+			break
+		}
+		if r <= ' ' || r > '~' {
+			r = '_'
+		}
+		b[i] = byte(r)
+		i++
+	}
+	return b
+}
+
+// Close releases what the devices hold, such as the files the server
+// left open on a Drive.
+func (c *Client) Close() {
+	for _, d := range c.devices {
+		if cl, ok := d.(interface{ Close() }); ok {
+			cl.Close()
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package rdpdr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/nakagami/grdp/core"
+)
+
+type sendRecorder struct {
+	pdus [][]byte
+}
+
+func (s *sendRecorder) SendToChannel(channel string, b []byte) (int, error) {
+	s.pdus = append(s.pdus, bytes.Clone(b))
+	return len(b), nil
+}
+
+func (s *sendRecorder) next(t *testing.T) []byte {
+	t.Helper()
+	if len(s.pdus) == 0 {
+		t.Fatal("nothing sent")
+	}
+	b := s.pdus[0]
+	s.pdus = s.pdus[1:]
+	return b
+}
+
+// completion returns the status and output of the next Device I/O Response.
+func (s *sendRecorder) completion(t *testing.T) (uint32, []byte) {
+	t.Helper()
+	b := s.next(t)
+	if binary.LittleEndian.Uint16(b[2:]) != PAKID_CORE_DEVICE_IOCOMPLETION {
+		t.Fatalf("sent %x, want an I/O completion", b)
+	}
+	return binary.LittleEndian.Uint32(b[12:]), b[16:]
+}
+
+func corePDU(packetId uint16, body ...byte) []byte {
+	return append(header(packetId), body...)
+}
+
+// connect runs the initialization sequence of a client serving d.
+func connect(t *testing.T, d Device) (*Client, *sendRecorder) {
+	t.Helper()
+	rec := &sendRecorder{}
+	c := NewClient("HOST", d)
+	c.Sender(rec)
+	c.Process(corePDU(PAKID_CORE_SERVER_ANNOUNCE, 1, 0, 0x0D, 0, 7, 0, 0, 0))
+	if want := corePDU(PAKID_CORE_CLIENTID_CONFIRM, 1, 0, 0x0C, 0, 7, 0, 0, 0); !bytes.Equal(rec.next(t), want) {
+		t.Fatal("bad Client Announce Reply")
+	}
+	if b := rec.next(t); binary.LittleEndian.Uint16(b[2:]) != PAKID_CORE_CLIENT_NAME || core.UnicodeDecode(b[16:]) != "HOST\x00" {
+		t.Fatalf("bad Client Name Request %x", b)
+	}
+	c.Process(corePDU(PAKID_CORE_SERVER_CAPABILITY, 0, 0, 0, 0))
+	if b := rec.next(t); binary.LittleEndian.Uint16(b[2:]) != PAKID_CORE_CLIENT_CAPABILITY {
+		t.Fatalf("sent %x, want the capabilities", b)
+	}
+	c.Process(corePDU(PAKID_CORE_CLIENTID_CONFIRM, 1, 0, 0x0C, 0, 7, 0, 0, 0))
+	if want := corePDU(PAKID_CORE_DEVICELIST_ANNOUNCE, 0, 0, 0, 0); !bytes.Equal(rec.next(t), want) {
+		t.Fatal("drive announced before logon")
+	}
+	c.Process(corePDU(PAKID_CORE_USER_LOGGEDON))
+	b := rec.next(t)
+	if binary.LittleEndian.Uint32(b[4:]) != 1 || binary.LittleEndian.Uint32(b[8:]) != RDPDR_DTYP_FILESYSTEM ||
+		binary.LittleEndian.Uint32(b[12:]) != 1 || string(b[16:24]) != "Share\x00\x00\x00" {
+		t.Fatalf("bad device announce %x", b)
+	}
+	return c, rec
+}
+
+// irp sends a Device I/O Request to device 1.
+func irp(c *Client, fileId, major, minor uint32, data []byte) {
+	b := corePDU(PAKID_CORE_DEVICE_IOREQUEST)
+	for _, v := range []uint32{1, fileId, 9, major, minor} {
+		b = binary.LittleEndian.AppendUint32(b, v)
+	}
+	c.Process(append(b, data...))
+}
+
+func create(t *testing.T, c *Client, rec *sendRecorder, name string, disposition, options uint32) (uint32, uint32) {
+	t.Helper()
+	p := core.UnicodeEncode(name + "\x00")
+	b := make([]byte, 32)
+	binary.LittleEndian.PutUint32(b[20:], disposition)
+	binary.LittleEndian.PutUint32(b[24:], options)
+	binary.LittleEndian.PutUint32(b[28:], uint32(len(p)))
+	irp(c, 0, IRP_MJ_CREATE, 0, append(b, p...))
+	status, out := rec.completion(t)
+	return status, binary.LittleEndian.Uint32(out)
+}
+
+func readFile(t *testing.T, c *Client, rec *sendRecorder, fileId uint32) string {
+	t.Helper()
+	b := make([]byte, 32)
+	binary.LittleEndian.PutUint32(b, 100)
+	irp(c, fileId, IRP_MJ_READ, 0, b)
+	status, out := rec.completion(t)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("read status 0x%08x", status)
+	}
+	return string(out[4 : 4+binary.LittleEndian.Uint32(out)])
+}
+
+func TestReadOnlyDrive(t *testing.T) {
+	fsys := fstest.MapFS{
+		"docs/a.txt": {Data: []byte("hello")},
+		"docs/b.log": {Data: []byte("log")},
+	}
+	c, rec := connect(t, NewDrive("Share", fsys))
+
+	status, id := create(t, c, rec, `\docs\a.txt`, FILE_OPEN, FILE_NON_DIRECTORY_FILE)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("create status 0x%08x", status)
+	}
+	if got := readFile(t, c, rec, id); got != "hello" {
+		t.Errorf("read %q", got)
+	}
+	b := make([]byte, 32)
+	binary.LittleEndian.PutUint32(b, FILE_STANDARD_INFORMATION)
+	irp(c, id, IRP_MJ_QUERY_INFORMATION, 0, b)
+	if status, out := rec.completion(t); status != STATUS_SUCCESS || binary.LittleEndian.Uint64(out[12:]) != 5 {
+		t.Errorf("standard information 0x%08x %x", status, out)
+	}
+	b = make([]byte, 32+5)
+	binary.LittleEndian.PutUint32(b, 4)
+	irp(c, id, IRP_MJ_WRITE, 0, b)
+	if status, _ := rec.completion(t); status != STATUS_MEDIA_WRITE_PROTECTED {
+		t.Errorf("write status 0x%08x", status)
+	}
+	if status, _ := create(t, c, rec, `\new.txt`, FILE_CREATE, 0); status != STATUS_MEDIA_WRITE_PROTECTED {
+		t.Errorf("create new status 0x%08x", status)
+	}
+	if status, _ := create(t, c, rec, `\missing\x`, FILE_OPEN, 0); status != STATUS_OBJECT_PATH_NOT_FOUND {
+		t.Errorf("missing parent status 0x%08x", status)
+	}
+
+	status, dir := create(t, c, rec, `\docs`, FILE_OPEN, FILE_DIRECTORY_FILE)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("open directory status 0x%08x", status)
+	}
+	pattern := core.UnicodeEncode(`\docs\*.TXT` + "\x00")
+	q := make([]byte, 32)
+	binary.LittleEndian.PutUint32(q, FILE_NAMES_INFORMATION)
+	q[4] = 1
+	binary.LittleEndian.PutUint32(q[5:], uint32(len(pattern)))
+	irp(c, dir, IRP_MJ_DIRECTORY_CONTROL, IRP_MN_QUERY_DIRECTORY, append(q, pattern...))
+	status, out := rec.completion(t)
+	if status != STATUS_SUCCESS || core.UnicodeDecode(out[4+12:]) != "a.txt" {
+		t.Errorf("query directory 0x%08x %x", status, out)
+	}
+	q[4] = 0
+	irp(c, dir, IRP_MJ_DIRECTORY_CONTROL, IRP_MN_QUERY_DIRECTORY, q)
+	if status, _ := rec.completion(t); status != STATUS_NO_MORE_FILES {
+		t.Errorf("second query status 0x%08x", status)
+	}
+
+	irp(c, id, IRP_MJ_CLOSE, 0, make([]byte, 32))
+	if status, _ := rec.completion(t); status != STATUS_SUCCESS {
+		t.Errorf("close status 0x%08x", status)
+	}
+	irp(c, id, IRP_MJ_READ, 0, make([]byte, 32))
+	if status, _ := rec.completion(t); status != STATUS_INVALID_HANDLE {
+		t.Errorf("read after close status 0x%08x", status)
+	}
+}
+
+func TestWritableDrive(t *testing.T) {
+	dir := t.TempDir()
+	root, err := OpenDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	c, rec := connect(t, NewDrive("Share", root))
+
+	status, id := create(t, c, rec, `\out.txt`, FILE_OVERWRITE_IF, FILE_NON_DIRECTORY_FILE)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("create status 0x%08x", status)
+	}
+	b := make([]byte, 32)
+	binary.LittleEndian.PutUint32(b, 6)
+	irp(c, id, IRP_MJ_WRITE, 0, append(b, "result"...))
+	if status, out := rec.completion(t); status != STATUS_SUCCESS || binary.LittleEndian.Uint32(out) != 6 {
+		t.Errorf("write 0x%08x %x", status, out)
+	}
+
+	name := core.UnicodeEncode(`\renamed.txt`)
+	set := make([]byte, 32)
+	binary.LittleEndian.PutUint32(set, FILE_RENAME_INFORMATION)
+	binary.LittleEndian.PutUint32(set[4:], uint32(6+len(name)))
+	set = append(set, 0, 0)
+	set = binary.LittleEndian.AppendUint32(set, uint32(len(name)))
+	irp(c, id, IRP_MJ_SET_INFORMATION, 0, append(set, name...))
+	if status, _ := rec.completion(t); status != STATUS_SUCCESS {
+		t.Errorf("rename status 0x%08x", status)
+	}
+	if got := readFile(t, c, rec, id); got != "result" {
+		t.Errorf("read after rename %q", got)
+	}
+	irp(c, id, IRP_MJ_CLOSE, 0, make([]byte, 32))
+	rec.completion(t)
+	if b, err := os.ReadFile(filepath.Join(dir, "renamed.txt")); err != nil || string(b) != "result" {
+		t.Errorf("renamed.txt = %q, %v", b, err)
+	}
+
+	status, id = create(t, c, rec, `\renamed.txt`, FILE_OPEN, FILE_DELETE_ON_CLOSE)
+	if status != STATUS_SUCCESS {
+		t.Fatalf("open status 0x%08x", status)
+	}
+	irp(c, id, IRP_MJ_CLOSE, 0, make([]byte, 32))
+	if status, _ := rec.completion(t); status != STATUS_SUCCESS {
+		t.Errorf("delete on close status 0x%08x", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "renamed.txt")); !os.IsNotExist(err) {
+		t.Errorf("renamed.txt not deleted: %v", err)
+	}
+	if status, _ := create(t, c, rec, `\..\escape`, FILE_CREATE, 0); status != STATUS_OBJECT_NAME_INVALID {
+		t.Errorf("escaping path status 0x%08x", status)
+	}
+}
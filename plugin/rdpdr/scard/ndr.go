@@ -0,0 +1,169 @@
+package scard
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// The IOCTL buffers are NDR structures in the type serialization
+// version 1 of MS-RPCE 2.2.6: a common and a private header, then the
+// structure, its deferred pointer data following it.
+
+// ndrHeaderSize is the size of the common and private type headers.
+const ndrHeaderSize = 16
+
+// maxNDRCount bounds the element count of an array read, far above
+// what a legitimate call holds.
+const maxNDRCount = 1 << 20
+
+var errNDR = errors.New("scard: malformed NDR data")
+
+// ndrReader decodes an NDR stream; the first error sticks.
+type ndrReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+// newNDRReader returns a reader of the structure in an IOCTL input
+// buffer.
+func newNDRReader(b []byte) *ndrReader {
+	if len(b) < ndrHeaderSize || b[0] != 1 || b[1] != 0x10 {
+		return &ndrReader{err: errNDR}
+	}
+	return &ndrReader{b: b[ndrHeaderSize:]}
+}
+
+func (r *ndrReader) align(n int) {
+	r.off = (r.off + n - 1) &^ (n - 1)
+}
+
+func (r *ndrReader) next(n int) []byte {
+	if r.err != nil || n < 0 || r.off+n > len(r.b) {
+		r.err = errNDR
+		return nil
+	}
+	b := r.b[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *ndrReader) uint32() uint32 {
+	r.align(4)
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// pointer reads a referent ID and reports whether it is not NULL.
+func (r *ndrReader) pointer() bool {
+	return r.uint32() != 0
+}
+
+// fixed reads an embedded array of n bytes.
+func (r *ndrReader) fixed(n int) []byte {
+	return r.next(n)
+}
+
+// array reads the deferred data of a conformant byte array.
+func (r *ndrReader) array() []byte {
+	n := r.uint32()
+	if n > maxNDRCount {
+		r.err = errNDR
+		return nil
+	}
+	return r.next(int(n))
+}
+
+// stringA reads the deferred data of a conformant varying ANSI string.
+func (r *ndrReader) stringA() string {
+	r.uint32() // maximum count
+	r.uint32() // offset
+	n := r.uint32()
+	if n > maxNDRCount {
+		r.err = errNDR
+		return ""
+	}
+	return strings.TrimRight(string(r.next(int(n))), "\x00")
+}
+
+// stringW reads the deferred data of a conformant varying UTF-16 string.
+func (r *ndrReader) stringW() string {
+	r.uint32() // maximum count
+	r.uint32() // offset
+	n := r.uint32()
+	if n > maxNDRCount {
+		r.err = errNDR
+		return ""
+	}
+	return strings.TrimRight(core.UnicodeDecode(r.next(2*int(n))), "\x00")
+}
+
+// ndrWriter encodes an NDR stream.
+type ndrWriter struct {
+	b        []byte
+	referent uint32
+}
+
+func (w *ndrWriter) align(n int) {
+	for len(w.b)%n != 0 {
+		w.b = append(w.b, 0)
+	}
+}
+
+func (w *ndrWriter) uint32(v uint32) {
+	w.align(4)
+	w.b = binary.LittleEndian.AppendUint32(w.b, v)
+}
+
+// pointer writes a referent ID, or NULL if present is false.
+func (w *ndrWriter) pointer(present bool) {
+	if !present {
+		w.uint32(0)
+		return
+	}
+	w.referent += 4
+	w.uint32(0x00020000 + w.referent)
+}
+
+// fixed writes an embedded array of n bytes from b, zero padded.
+func (w *ndrWriter) fixed(b []byte, n int) {
+	p := make([]byte, n)
+	copy(p, b)
+	w.b = append(w.b, p...)
+}
+
+// array writes the deferred data of a conformant byte array.
+func (w *ndrWriter) array(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.b = append(w.b, b...)
+	w.align(4)
+}
+
+// bytes returns the stream with the type serialization headers.
+func (w *ndrWriter) bytes() []byte {
+	w.align(8)
+	b := make([]byte, ndrHeaderSize, ndrHeaderSize+len(w.b))
+	copy(b, []byte{1, 0x10, 8, 0, 0xCC, 0xCC, 0xCC, 0xCC})
+	binary.LittleEndian.PutUint32(b[8:], uint32(len(w.b)))
+	return append(b, w.b...)
+}
+
+// multiString encodes names as a multi-string: each null terminated,
+// then an empty string.  wide selects UTF-16 over ANSI.
+func multiString(names []string, wide bool) []byte {
+	s := strings.Join(names, "\x00") + "\x00\x00"
+	if len(names) == 0 {
+		s = "\x00"
+	}
+	if wide {
+		return core.UTF16ToLittleEndianBytes(utf16.Encode([]rune(s)))
+	}
+	return []byte(s)
+}
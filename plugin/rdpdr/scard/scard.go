@@ -0,0 +1,830 @@
+// Package scard implements the smart card device of the RDPDR channel
+// (Smart Card Virtual Channel Extension, MS-RDPESC).  The server
+// forwards the PC/SC calls of the session's applications as device
+// control requests; Device decodes them and hands them to a Provider,
+// typically a binding of pcsc-lite, so that the user can log on to the
+// session with a smart card attached to a non-Windows client.
+package scard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/plugin/rdpdr"
+)
+
+// Smart card IOCTLs (MS-RDPESC 3.1.4)
+const (
+	SCARD_IOCTL_ESTABLISHCONTEXT    = 0x00090014
+	SCARD_IOCTL_RELEASECONTEXT      = 0x00090018
+	SCARD_IOCTL_ISVALIDCONTEXT      = 0x0009001C
+	SCARD_IOCTL_LISTREADERGROUPSA   = 0x00090020
+	SCARD_IOCTL_LISTREADERGROUPSW   = 0x00090024
+	SCARD_IOCTL_LISTREADERSA        = 0x00090028
+	SCARD_IOCTL_LISTREADERSW        = 0x0009002C
+	SCARD_IOCTL_GETSTATUSCHANGEA    = 0x000900A0
+	SCARD_IOCTL_GETSTATUSCHANGEW    = 0x000900A4
+	SCARD_IOCTL_CANCEL              = 0x000900A8
+	SCARD_IOCTL_CONNECTA            = 0x000900AC
+	SCARD_IOCTL_CONNECTW            = 0x000900B0
+	SCARD_IOCTL_RECONNECT           = 0x000900B4
+	SCARD_IOCTL_DISCONNECT          = 0x000900B8
+	SCARD_IOCTL_BEGINTRANSACTION    = 0x000900BC
+	SCARD_IOCTL_ENDTRANSACTION      = 0x000900C0
+	SCARD_IOCTL_STATE               = 0x000900C4
+	SCARD_IOCTL_STATUSA             = 0x000900C8
+	SCARD_IOCTL_STATUSW             = 0x000900CC
+	SCARD_IOCTL_TRANSMIT            = 0x000900D0
+	SCARD_IOCTL_CONTROL             = 0x000900D4
+	SCARD_IOCTL_GETATTRIB           = 0x000900D8
+	SCARD_IOCTL_SETATTRIB           = 0x000900DC
+	SCARD_IOCTL_ACCESSSTARTEDEVENT  = 0x000900E0
+	SCARD_IOCTL_RELEASESTARTEDEVENT = 0x000900E4
+	SCARD_IOCTL_READCACHEA          = 0x000900F0
+	SCARD_IOCTL_READCACHEW          = 0x000900F4
+	SCARD_IOCTL_WRITECACHEA         = 0x000900F8
+	SCARD_IOCTL_WRITECACHEW         = 0x000900FC
+	SCARD_IOCTL_GETTRANSMITCOUNT    = 0x00090100
+)
+
+// PC/SC return codes
+const (
+	SCARD_S_SUCCESS              = 0x00000000
+	SCARD_F_INTERNAL_ERROR       = 0x80100001
+	SCARD_E_CANCELLED            = 0x80100002
+	SCARD_E_INVALID_HANDLE       = 0x80100003
+	SCARD_E_INVALID_PARAMETER    = 0x80100004
+	SCARD_E_INSUFFICIENT_BUFFER  = 0x80100008
+	SCARD_E_UNKNOWN_READER       = 0x80100009
+	SCARD_E_TIMEOUT              = 0x8010000A
+	SCARD_E_NO_SMARTCARD         = 0x8010000C
+	SCARD_E_NOT_TRANSACTED       = 0x80100016
+	SCARD_E_READER_UNAVAILABLE   = 0x80100017
+	SCARD_E_NO_SERVICE           = 0x8010001D
+	SCARD_E_UNSUPPORTED_FEATURE  = 0x80100022
+	SCARD_E_NO_READERS_AVAILABLE = 0x8010002E
+	SCARD_W_REMOVED_CARD         = 0x80100069
+	SCARD_W_CACHE_ITEM_NOT_FOUND = 0x80100070
+)
+
+const (
+	// SCARD_AUTOALLOCATE as a buffer length lets the callee size it.
+	SCARD_AUTOALLOCATE = 0xFFFFFFFF
+	// INFINITE as a GetStatusChange timeout waits for ever.
+	INFINITE = 0xFFFFFFFF
+	// atrSize is the size of the rgbAtr of a ReaderState.
+	atrSize = 36
+	// maxReaderStates bounds the readers of one GetStatusChange.
+	maxReaderStates = 64
+	// defaultReaderGroup is the only reader group reported.
+	defaultReaderGroup = "SCard$DefaultReaders"
+)
+
+// Error is a PC/SC return code, such as SCARD_E_TIMEOUT.  A Provider
+// returns one to give the application a specific code; other errors
+// are reported as SCARD_F_INTERNAL_ERROR.
+type Error uint32
+
+func (e Error) Error() string {
+	return fmt.Sprintf("scard: error 0x%08X", uint32(e))
+}
+
+// Provider is the PC/SC resource manager the calls are forwarded to.
+// Its methods and those of the Contexts and Cards it returns may be
+// called concurrently; state values, protocols and attribute IDs are
+// those of the Windows PC/SC API, which pcsc-lite shares except for
+// the card state of Status.
+type Provider interface {
+	EstablishContext(scope uint32) (Context, error)
+}
+
+// Context is a PC/SC resource manager context (SCARDCONTEXT).
+type Context interface {
+	ListReaders() ([]string, error)
+	// GetStatusChange waits until the state of a reader differs from
+	// its CurrentState, or for timeout (negative: no timeout), and
+	// updates EventState and ATR of states.
+	GetStatusChange(timeout time.Duration, states []ReaderState) error
+	// Cancel makes a pending GetStatusChange return SCARD_E_CANCELLED.
+	Cancel() error
+	// Connect connects to the card in reader and returns the protocol
+	// in use.
+	Connect(reader string, shareMode, preferredProtocols uint32) (Card, uint32, error)
+	Release() error
+}
+
+// Card is a connection to a card (SCARDHANDLE).
+type Card interface {
+	Reconnect(shareMode, preferredProtocols, initialization uint32) (uint32, error)
+	Disconnect(disposition uint32) error
+	BeginTransaction() error
+	EndTransaction(disposition uint32) error
+	Status() (Status, error)
+	// Transmit sends an APDU with protocol and returns the response.
+	Transmit(protocol uint32, command []byte) ([]byte, error)
+	Control(code uint32, in []byte) ([]byte, error)
+	GetAttrib(id uint32) ([]byte, error)
+	SetAttrib(id uint32, value []byte) error
+}
+
+// ReaderState is a reader queried by GetStatusChange.
+type ReaderState struct {
+	Reader       string
+	CurrentState uint32
+	EventState   uint32
+	ATR          []byte
+}
+
+// Status is the state of a card connection.
+type Status struct {
+	Readers  []string
+	State    uint32
+	Protocol uint32
+	ATR      []byte
+}
+
+// Device is the smart card device of the RDPDR channel.
+type Device struct {
+	p Provider
+
+	// mu guards the handles: each call runs on a goroutine of its own,
+	// so that a blocking GetStatusChange does not hold up the rest.
+	mu       sync.Mutex
+	contexts map[uint32]Context
+	cards    map[uint32]*card
+	nextId   uint32
+
+	log *slog.Logger
+}
+
+// card is a Card with the context it was connected in.
+type card struct {
+	Card
+	context   uint32
+	transmits uint32
+}
+
+// NewDevice returns a smart card device forwarding calls to p.
+func NewDevice(p Provider) *Device {
+	return &Device{p: p, contexts: make(map[uint32]Context), cards: make(map[uint32]*card), log: core.Logger(nil, "scard")}
+}
+
+// SetLogger makes the device log to l, with the attribute layer=scard.
+// rdpdr.Client.SetLogger calls it.
+func (d *Device) SetLogger(l *slog.Logger) {
+	d.log = core.Logger(l, "scard")
+}
+
+func (d *Device) DeviceType() uint32 { return rdpdr.RDPDR_DTYP_SMARTCARD }
+
+func (d *Device) DosName() string { return "SCARD" }
+
+func (d *Device) DeviceData() []byte { return nil }
+
+// Close releases the contexts the session left, which disconnects
+// their cards.
+func (d *Device) Close() {
+	d.mu.Lock()
+	contexts := d.contexts
+	d.contexts = make(map[uint32]Context)
+	d.cards = make(map[uint32]*card)
+	d.mu.Unlock()
+	for _, c := range contexts {
+		c.Cancel()
+		c.Release()
+	}
+}
+
+// IORequest serves the device control requests carrying the calls.
+func (d *Device) IORequest(r *rdpdr.IORequest) {
+	switch r.MajorFunction {
+	case rdpdr.IRP_MJ_CREATE:
+		r.Complete(rdpdr.STATUS_SUCCESS, []byte{1, 0, 0, 0, 0})
+	case rdpdr.IRP_MJ_CLOSE:
+		r.Complete(rdpdr.STATUS_SUCCESS, make([]byte, 4))
+	case rdpdr.IRP_MJ_DEVICE_CONTROL:
+		// DR_CONTROL_REQ
+		if len(r.Data) < 32 {
+			r.Complete(rdpdr.STATUS_INVALID_PARAMETER, make([]byte, 4))
+			return
+		}
+		inLen := binary.LittleEndian.Uint32(r.Data[4:])
+		code := binary.LittleEndian.Uint32(r.Data[8:])
+		in := r.Data[32:]
+		if uint64(inLen) < uint64(len(in)) {
+			in = in[:inLen]
+		}
+		in = bytes.Clone(in)
+		go func() {
+			out := d.call(code, in)
+			r.Complete(rdpdr.STATUS_SUCCESS, append(binary.LittleEndian.AppendUint32(nil, uint32(len(out))), out...))
+		}()
+	default:
+		r.Complete(rdpdr.STATUS_NOT_SUPPORTED, make([]byte, 4))
+	}
+}
+
+// call decodes the call of an IOCTL, makes it and returns the encoded
+// return structure.
+func (d *Device) call(code uint32, in []byte) []byte {
+	defer func() {
+		if r := recover(); r != nil {
+			d.log.Error("scard: panic in provider", "ioctl", fmt.Sprintf("0x%08x", code), "err", r)
+		}
+	}()
+	r := newNDRReader(in)
+	w := &ndrWriter{}
+	switch code {
+	case SCARD_IOCTL_ESTABLISHCONTEXT:
+		d.establishContext(r, w)
+	case SCARD_IOCTL_RELEASECONTEXT, SCARD_IOCTL_ISVALIDCONTEXT, SCARD_IOCTL_CANCEL:
+		d.contextCall(code, r, w)
+	case SCARD_IOCTL_LISTREADERGROUPSA, SCARD_IOCTL_LISTREADERGROUPSW:
+		d.listReaderGroups(code == SCARD_IOCTL_LISTREADERGROUPSW, r, w)
+	case SCARD_IOCTL_LISTREADERSA, SCARD_IOCTL_LISTREADERSW:
+		d.listReaders(code == SCARD_IOCTL_LISTREADERSW, r, w)
+	case SCARD_IOCTL_GETSTATUSCHANGEA, SCARD_IOCTL_GETSTATUSCHANGEW:
+		d.getStatusChange(code == SCARD_IOCTL_GETSTATUSCHANGEW, r, w)
+	case SCARD_IOCTL_CONNECTA, SCARD_IOCTL_CONNECTW:
+		d.connect(code == SCARD_IOCTL_CONNECTW, r, w)
+	case SCARD_IOCTL_RECONNECT:
+		d.reconnect(r, w)
+	case SCARD_IOCTL_DISCONNECT, SCARD_IOCTL_BEGINTRANSACTION, SCARD_IOCTL_ENDTRANSACTION:
+		d.dispositionCall(code, r, w)
+	case SCARD_IOCTL_STATE:
+		d.state(r, w)
+	case SCARD_IOCTL_STATUSA, SCARD_IOCTL_STATUSW:
+		d.status(code == SCARD_IOCTL_STATUSW, r, w)
+	case SCARD_IOCTL_TRANSMIT:
+		d.transmit(r, w)
+	case SCARD_IOCTL_CONTROL:
+		d.control(r, w)
+	case SCARD_IOCTL_GETATTRIB:
+		d.getAttrib(r, w)
+	case SCARD_IOCTL_SETATTRIB:
+		d.setAttrib(r, w)
+	case SCARD_IOCTL_GETTRANSMITCOUNT:
+		d.getTransmitCount(r, w)
+	case SCARD_IOCTL_ACCESSSTARTEDEVENT, SCARD_IOCTL_RELEASESTARTEDEVENT, SCARD_IOCTL_WRITECACHEA, SCARD_IOCTL_WRITECACHEW:
+		// The resource manager is always started; nothing is cached.
+		w.uint32(SCARD_S_SUCCESS)
+	case SCARD_IOCTL_READCACHEA, SCARD_IOCTL_READCACHEW:
+		w.uint32(SCARD_W_CACHE_ITEM_NOT_FOUND)
+		w.uint32(0)
+		w.pointer(false)
+	default:
+		d.log.Debug("scard: unsupported IOCTL", "ioctl", fmt.Sprintf("0x%08x", code))
+		w.uint32(SCARD_E_UNSUPPORTED_FEATURE)
+	}
+	return w.bytes()
+}
+
+// returnCode returns the PC/SC code of a Provider error.
+func (d *Device) returnCode(err error) uint32 {
+	if err == nil {
+		return SCARD_S_SUCCESS
+	}
+	var e Error
+	if errors.As(err, &e) {
+		return uint32(e)
+	}
+	d.log.Debug("scard: provider error", "err", err)
+	return SCARD_F_INTERNAL_ERROR
+}
+
+// handleRef reads the cbContext or cbHandle and the pointer of a
+// REDIR_SCARDCONTEXT or REDIR_SCARDHANDLE.
+func (r *ndrReader) handleRef() bool {
+	r.uint32()
+	return r.pointer()
+}
+
+// handleId reads the deferred bytes of a handle as the ID the device
+// gave it.
+func (r *ndrReader) handleId(present bool) uint32 {
+	if !present {
+		return 0
+	}
+	b := r.array()
+	if len(b) < 4 {
+		r.err = errNDR
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+// cardRef reads a REDIR_SCARDHANDLE; ids returns the IDs of its
+// context and card from the deferred data.
+func (r *ndrReader) cardRef() (ids func() (uint32, uint32)) {
+	cp := r.handleRef()
+	hp := r.handleRef()
+	return func() (uint32, uint32) {
+		return r.handleId(cp), r.handleId(hp)
+	}
+}
+
+func (w *ndrWriter) handleId(id uint32) {
+	w.array(binary.LittleEndian.AppendUint32(nil, id))
+}
+
+func (d *Device) context(id uint32) (Context, uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.contexts[id]
+	if !ok {
+		return nil, SCARD_E_INVALID_HANDLE
+	}
+	return c, SCARD_S_SUCCESS
+}
+
+func (d *Device) card(id uint32) (*card, uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	c, ok := d.cards[id]
+	if !ok {
+		return nil, SCARD_E_INVALID_HANDLE
+	}
+	return c, SCARD_S_SUCCESS
+}
+
+// readCard reads a call made on a card handle: fields reads the fields
+// after the handle and deferred, if not nil, the deferred data after
+// that of the handle.  It returns the card.
+func (d *Device) readCard(r *ndrReader, fields, deferred func()) (*card, uint32) {
+	ids := r.cardRef()
+	fields()
+	_, cardId := ids()
+	if deferred != nil {
+		deferred()
+	}
+	if r.err != nil {
+		return nil, SCARD_E_INVALID_PARAMETER
+	}
+	return d.card(cardId)
+}
+
+// EstablishContext_Call
+func (d *Device) establishContext(r *ndrReader, w *ndrWriter) {
+	scope := r.uint32()
+	rc := uint32(SCARD_E_INVALID_PARAMETER)
+	var id uint32
+	if r.err == nil {
+		c, err := d.p.EstablishContext(scope)
+		if rc = d.returnCode(err); rc == SCARD_S_SUCCESS {
+			d.mu.Lock()
+			d.nextId++
+			id = d.nextId
+			d.contexts[id] = c
+			d.mu.Unlock()
+		}
+	}
+	w.uint32(rc)
+	if rc != SCARD_S_SUCCESS {
+		w.uint32(0)
+		w.pointer(false)
+		return
+	}
+	w.uint32(4)
+	w.pointer(true)
+	w.handleId(id)
+}
+
+// Context_Call of ReleaseContext, IsValidContext and Cancel
+func (d *Device) contextCall(code uint32, r *ndrReader, w *ndrWriter) {
+	id := r.handleId(r.handleRef())
+	if r.err != nil {
+		w.uint32(SCARD_E_INVALID_PARAMETER)
+		return
+	}
+	c, rc := d.context(id)
+	if rc != SCARD_S_SUCCESS {
+		w.uint32(rc)
+		return
+	}
+	switch code {
+	case SCARD_IOCTL_RELEASECONTEXT:
+		d.mu.Lock()
+		delete(d.contexts, id)
+		for cardId, card := range d.cards {
+			if card.context == id {
+				delete(d.cards, cardId)
+			}
+		}
+		d.mu.Unlock()
+		rc = d.returnCode(c.Release())
+	case SCARD_IOCTL_CANCEL:
+		rc = d.returnCode(c.Cancel())
+	}
+	w.uint32(rc)
+}
+
+// writeMultiString writes the cBytes and data of a multi-string return;
+// the data is left out if isNull.
+func writeMultiString(w *ndrWriter, rc uint32, names []string, wide, isNull bool) {
+	w.uint32(rc)
+	if rc != SCARD_S_SUCCESS {
+		w.uint32(0)
+		w.pointer(false)
+		return
+	}
+	b := multiString(names, wide)
+	w.uint32(uint32(len(b)))
+	w.pointer(!isNull)
+	if !isNull {
+		w.array(b)
+	}
+}
+
+// ListReaderGroups_Call
+func (d *Device) listReaderGroups(wide bool, r *ndrReader, w *ndrWriter) {
+	cp := r.handleRef()
+	isNull := r.uint32() != 0
+	r.uint32() // cchGroups
+	_, rc := d.context(r.handleId(cp))
+	if r.err != nil {
+		rc = SCARD_E_INVALID_PARAMETER
+	}
+	writeMultiString(w, rc, []string{defaultReaderGroup}, wide, isNull)
+}
+
+// ListReaders_Call
+func (d *Device) listReaders(wide bool, r *ndrReader, w *ndrWriter) {
+	cp := r.handleRef()
+	r.uint32() // cBytes
+	groupsPtr := r.pointer()
+	isNull := r.uint32() != 0
+	r.uint32() // cchReaders
+	id := r.handleId(cp)
+	if groupsPtr {
+		r.array()
+	}
+	var readers []string
+	c, rc := d.context(id)
+	if r.err != nil {
+		rc = SCARD_E_INVALID_PARAMETER
+	}
+	if rc == SCARD_S_SUCCESS {
+		var err error
+		readers, err = c.ListReaders()
+		rc = d.returnCode(err)
+		if rc == SCARD_S_SUCCESS && len(readers) == 0 {
+			rc = SCARD_E_NO_READERS_AVAILABLE
+		}
+	}
+	writeMultiString(w, rc, readers, wide, isNull)
+}
+
+// GetStatusChangeA_Call and GetStatusChangeW_Call
+func (d *Device) getStatusChange(wide bool, r *ndrReader, w *ndrWriter) {
+	cp := r.handleRef()
+	timeoutMs := r.uint32()
+	n := r.uint32()
+	statesPtr := r.pointer()
+	id := r.handleId(cp)
+	var states []ReaderState
+	if statesPtr {
+		if r.uint32() != n || n > maxReaderStates {
+			r.err = errNDR
+		}
+		states = make([]ReaderState, 0, min(n, maxReaderStates))
+		var named []bool
+		for range n {
+			if r.err != nil {
+				break
+			}
+			named = append(named, r.pointer())
+			s := ReaderState{CurrentState: r.uint32(), EventState: r.uint32()}
+			cbAtr := r.uint32()
+			s.ATR = bytes.Clone(r.fixed(atrSize)[:min(cbAtr, atrSize)])
+			states = append(states, s)
+		}
+		for i := range named {
+			if r.err != nil {
+				break
+			}
+			if !named[i] {
+				continue
+			}
+			if wide {
+				states[i].Reader = r.stringW()
+			} else {
+				states[i].Reader = r.stringA()
+			}
+		}
+	}
+	c, rc := d.context(id)
+	if r.err != nil {
+		rc, states = SCARD_E_INVALID_PARAMETER, nil
+	}
+	if rc == SCARD_S_SUCCESS {
+		timeout := time.Duration(timeoutMs) * time.Millisecond
+		if timeoutMs == INFINITE {
+			timeout = -1
+		}
+		rc = d.returnCode(c.GetStatusChange(timeout, states))
+	}
+	w.uint32(rc)
+	w.uint32(uint32(len(states)))
+	w.pointer(true)
+	w.uint32(uint32(len(states)))
+	for _, s := range states {
+		w.uint32(s.CurrentState)
+		w.uint32(s.EventState)
+		w.uint32(uint32(min(len(s.ATR), atrSize)))
+		w.fixed(s.ATR, atrSize)
+	}
+}
+
+// ConnectA_Call and ConnectW_Call
+func (d *Device) connect(wide bool, r *ndrReader, w *ndrWriter) {
+	readerPtr := r.pointer()
+	cp := r.handleRef()
+	shareMode := r.uint32()
+	protocols := r.uint32()
+	var reader string
+	if readerPtr {
+		if wide {
+			reader = r.stringW()
+		} else {
+			reader = r.stringA()
+		}
+	}
+	contextId := r.handleId(cp)
+	c, rc := d.context(contextId)
+	if r.err != nil {
+		rc = SCARD_E_INVALID_PARAMETER
+	}
+	var cardId, protocol uint32
+	if rc == SCARD_S_SUCCESS {
+		var h Card
+		var err error
+		h, protocol, err = c.Connect(reader, shareMode, protocols)
+		if rc = d.returnCode(err); rc == SCARD_S_SUCCESS {
+			d.mu.Lock()
+			d.nextId++
+			cardId = d.nextId
+			d.cards[cardId] = &card{Card: h, context: contextId}
+			d.mu.Unlock()
+		}
+	}
+	w.uint32(rc)
+	ok := rc == SCARD_S_SUCCESS
+	for range 2 {
+		if ok {
+			w.uint32(4)
+		} else {
+			w.uint32(0)
+		}
+		w.pointer(ok)
+	}
+	w.uint32(protocol)
+	if ok {
+		w.handleId(contextId)
+		w.handleId(cardId)
+	}
+}
+
+// Reconnect_Call
+func (d *Device) reconnect(r *ndrReader, w *ndrWriter) {
+	var shareMode, protocols, initialization uint32
+	c, rc := d.readCard(r, func() {
+		shareMode = r.uint32()
+		protocols = r.uint32()
+		initialization = r.uint32()
+	}, nil)
+	var protocol uint32
+	if rc == SCARD_S_SUCCESS {
+		var err error
+		protocol, err = c.Reconnect(shareMode, protocols, initialization)
+		rc = d.returnCode(err)
+	}
+	w.uint32(rc)
+	w.uint32(protocol)
+}
+
+// HCardAndDisposition_Call of Disconnect, BeginTransaction and
+// EndTransaction
+func (d *Device) dispositionCall(code uint32, r *ndrReader, w *ndrWriter) {
+	var disposition uint32
+	c, rc := d.readCard(r, func() { disposition = r.uint32() }, nil)
+	if rc == SCARD_S_SUCCESS {
+		switch code {
+		case SCARD_IOCTL_DISCONNECT:
+			rc = d.returnCode(c.Disconnect(disposition))
+			d.mu.Lock()
+			for id, card := range d.cards {
+				if card == c {
+					delete(d.cards, id)
+				}
+			}
+			d.mu.Unlock()
+		case SCARD_IOCTL_BEGINTRANSACTION:
+			rc = d.returnCode(c.BeginTransaction())
+		case SCARD_IOCTL_ENDTRANSACTION:
+			rc = d.returnCode(c.EndTransaction(disposition))
+		}
+	}
+	w.uint32(rc)
+}
+
+// State_Call
+func (d *Device) state(r *ndrReader, w *ndrWriter) {
+	var atrIsNull bool
+	c, rc := d.readCard(r, func() {
+		atrIsNull = r.uint32() != 0
+		r.uint32() // cbAtrLen
+	}, nil)
+	var s Status
+	if rc == SCARD_S_SUCCESS {
+		var err error
+		s, err = c.Status()
+		rc = d.returnCode(err)
+	}
+	w.uint32(rc)
+	w.uint32(s.State)
+	w.uint32(s.Protocol)
+	w.uint32(uint32(len(s.ATR)))
+	w.pointer(!atrIsNull && rc == SCARD_S_SUCCESS)
+	if !atrIsNull && rc == SCARD_S_SUCCESS {
+		w.array(s.ATR)
+	}
+}
+
+// Status_Call
+func (d *Device) status(wide bool, r *ndrReader, w *ndrWriter) {
+	var namesIsNull bool
+	c, rc := d.readCard(r, func() {
+		namesIsNull = r.uint32() != 0
+		r.uint32() // cchReaderLen
+		r.uint32() // cbAtrLen
+	}, nil)
+	var s Status
+	if rc == SCARD_S_SUCCESS {
+		var err error
+		s, err = c.Status()
+		rc = d.returnCode(err)
+	}
+	var names []byte
+	if rc == SCARD_S_SUCCESS {
+		names = multiString(s.Readers, wide)
+	}
+	w.uint32(rc)
+	w.uint32(uint32(len(names)))
+	w.pointer(names != nil && !namesIsNull)
+	w.uint32(s.State)
+	w.uint32(s.Protocol)
+	w.fixed(s.ATR, 32)
+	w.uint32(uint32(min(len(s.ATR), 32)))
+	if names != nil && !namesIsNull {
+		w.array(names)
+	}
+}
+
+// Transmit_Call
+func (d *Device) transmit(r *ndrReader, w *ndrWriter) {
+	var protocol, recvLen uint32
+	var send []byte
+	var extraPtr, sendPtr, recvPciPtr bool
+	c, rc := d.readCard(r, func() {
+		// ioSendPci
+		protocol = r.uint32()
+		r.uint32() // cbExtraBytes
+		extraPtr = r.pointer()
+		r.uint32() // cbSendLength
+		sendPtr = r.pointer()
+		recvPciPtr = r.pointer()
+		r.uint32() // fpbRecvBufferIsNULL
+		recvLen = r.uint32()
+	}, func() {
+		if extraPtr {
+			r.array()
+		}
+		if sendPtr {
+			send = r.array()
+		}
+		if recvPciPtr {
+			r.uint32() // dwProtocol
+			r.uint32() // cbExtraBytes
+			if r.pointer() {
+				r.array()
+			}
+		}
+	})
+	var resp []byte
+	if rc == SCARD_S_SUCCESS {
+		var err error
+		resp, err = c.Transmit(protocol, send)
+		rc = d.returnCode(err)
+		d.mu.Lock()
+		c.transmits++
+		d.mu.Unlock()
+		if rc == SCARD_S_SUCCESS && recvLen != SCARD_AUTOALLOCATE && uint64(len(resp)) > uint64(recvLen) {
+			rc, resp = SCARD_E_INSUFFICIENT_BUFFER, nil
+		}
+	}
+	w.uint32(rc)
+	w.pointer(false) // pioRecvPci
+	w.uint32(uint32(len(resp)))
+	w.pointer(rc == SCARD_S_SUCCESS)
+	if rc == SCARD_S_SUCCESS {
+		w.array(resp)
+	}
+}
+
+// Control_Call
+func (d *Device) control(r *ndrReader, w *ndrWriter) {
+	var controlCode, outLen uint32
+	var in []byte
+	var inPtr bool
+	c, rc := d.readCard(r, func() {
+		controlCode = r.uint32()
+		r.uint32() // cbInBufferSize
+		inPtr = r.pointer()
+		r.uint32() // fpvOutBufferIsNULL
+		outLen = r.uint32()
+	}, func() {
+		if inPtr {
+			in = r.array()
+		}
+	})
+	var out []byte
+	if rc == SCARD_S_SUCCESS {
+		var err error
+		out, err = c.Control(controlCode, in)
+		rc = d.returnCode(err)
+		if rc == SCARD_S_SUCCESS && outLen != SCARD_AUTOALLOCATE && uint64(len(out)) > uint64(outLen) {
+			rc, out = SCARD_E_INSUFFICIENT_BUFFER, nil
+		}
+	}
+	w.uint32(rc)
+	w.uint32(uint32(len(out)))
+	w.pointer(rc == SCARD_S_SUCCESS)
+	if rc == SCARD_S_SUCCESS {
+		w.array(out)
+	}
+}
+
+// GetAttrib_Call
+func (d *Device) getAttrib(r *ndrReader, w *ndrWriter) {
+	var attrId, attrLen uint32
+	var isNull bool
+	c, rc := d.readCard(r, func() {
+		attrId = r.uint32()
+		isNull = r.uint32() != 0
+		attrLen = r.uint32()
+	}, nil)
+	var attr []byte
+	if rc == SCARD_S_SUCCESS {
+		var err error
+		attr, err = c.GetAttrib(attrId)
+		rc = d.returnCode(err)
+		if rc == SCARD_S_SUCCESS && !isNull && attrLen != SCARD_AUTOALLOCATE && uint64(len(attr)) > uint64(attrLen) {
+			rc, attr = SCARD_E_INSUFFICIENT_BUFFER, nil
+		}
+	}
+	w.uint32(rc)
+	w.uint32(uint32(len(attr)))
+	w.pointer(rc == SCARD_S_SUCCESS && !isNull)
+	if rc == SCARD_S_SUCCESS && !isNull {
+		w.array(attr)
+	}
+}
+
+// SetAttrib_Call
+func (d *Device) setAttrib(r *ndrReader, w *ndrWriter) {
+	var attrId uint32
+	var attr []byte
+	var attrPtr bool
+	c, rc := d.readCard(r, func() {
+		attrId = r.uint32()
+		r.uint32() // cbAttrLen
+		attrPtr = r.pointer()
+	}, func() {
+		if attrPtr {
+			attr = r.array()
+		}
+	})
+	if rc == SCARD_S_SUCCESS {
+		rc = d.returnCode(c.SetAttrib(attrId, attr))
+	}
+	w.uint32(rc)
+}
+
+// GetTransmitCount_Call
+func (d *Device) getTransmitCount(r *ndrReader, w *ndrWriter) {
+	c, rc := d.readCard(r, func() {}, nil)
+	var n uint32
+	if rc == SCARD_S_SUCCESS {
+		d.mu.Lock()
+		n = c.transmits
+		d.mu.Unlock()
+	}
+	w.uint32(rc)
+	w.uint32(n)
+}
@@ -0,0 +1,238 @@
+package scard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/plugin/rdpdr"
+)
+
+// fakeCard answers every APDU with 90 00 after echoing it.
+type fakeCard struct {
+	reader string
+}
+
+func (c *fakeCard) Reconnect(shareMode, protocols, initialization uint32) (uint32, error) {
+	return 2, nil
+}
+func (c *fakeCard) Disconnect(disposition uint32) error     { return nil }
+func (c *fakeCard) BeginTransaction() error                 { return nil }
+func (c *fakeCard) EndTransaction(disposition uint32) error { return nil }
+func (c *fakeCard) Status() (Status, error) {
+	return Status{Readers: []string{c.reader}, State: 6, Protocol: 2, ATR: []byte{0x3B, 0x8F}}, nil
+}
+func (c *fakeCard) Transmit(protocol uint32, command []byte) ([]byte, error) {
+	return append(bytes.Clone(command), 0x90, 0x00), nil
+}
+func (c *fakeCard) Control(code uint32, in []byte) ([]byte, error) {
+	return nil, Error(SCARD_E_UNSUPPORTED_FEATURE)
+}
+func (c *fakeCard) GetAttrib(id uint32) ([]byte, error)     { return []byte("attr"), nil }
+func (c *fakeCard) SetAttrib(id uint32, value []byte) error { return nil }
+
+type fakeContext struct{}
+
+func (fakeContext) ListReaders() ([]string, error) { return []string{"Reader 0"}, nil }
+func (fakeContext) GetStatusChange(timeout time.Duration, states []ReaderState) error {
+	for i := range states {
+		states[i].EventState = states[i].CurrentState | 0x20
+	}
+	return nil
+}
+func (fakeContext) Cancel() error  { return nil }
+func (fakeContext) Release() error { return nil }
+func (fakeContext) Connect(reader string, shareMode, protocols uint32) (Card, uint32, error) {
+	if reader != "Reader 0" {
+		return nil, 0, Error(SCARD_E_UNKNOWN_READER)
+	}
+	return &fakeCard{reader: reader}, 2, nil
+}
+
+type fakeProvider struct{}
+
+func (fakeProvider) EstablishContext(scope uint32) (Context, error) { return fakeContext{}, nil }
+
+// stringW writes the deferred data of a conformant varying string.
+func (w *ndrWriter) stringW(s string) {
+	b := core.UnicodeEncode(s + "\x00")
+	w.uint32(uint32(len(b) / 2))
+	w.uint32(0)
+	w.uint32(uint32(len(b) / 2))
+	w.b = append(w.b, b...)
+	w.align(4)
+}
+
+// handle writes a REDIR_SCARDHANDLE; its IDs go in the deferred data.
+func (w *ndrWriter) handle() {
+	w.uint32(4)
+	w.pointer(true)
+	w.uint32(4)
+	w.pointer(true)
+}
+
+func call(t *testing.T, d *Device, code uint32, w *ndrWriter) *ndrReader {
+	t.Helper()
+	r := newNDRReader(d.call(code, w.bytes()))
+	if rc := r.uint32(); rc != SCARD_S_SUCCESS {
+		t.Fatalf("IOCTL 0x%08x returned 0x%08x", code, rc)
+	}
+	return r
+}
+
+func TestSmartCardCalls(t *testing.T) {
+	d := NewDevice(fakeProvider{})
+
+	w := &ndrWriter{}
+	w.uint32(2) // SCARD_SCOPE_SYSTEM
+	r := call(t, d, SCARD_IOCTL_ESTABLISHCONTEXT, w)
+	context := r.handleId(r.handleRef())
+
+	w = &ndrWriter{}
+	w.uint32(4)
+	w.pointer(true)
+	w.uint32(0)      // cBytes
+	w.pointer(false) // mszGroups
+	w.uint32(0)      // fmszReadersIsNULL
+	w.uint32(SCARD_AUTOALLOCATE)
+	w.handleId(context)
+	r = call(t, d, SCARD_IOCTL_LISTREADERSW, w)
+	r.uint32()
+	r.pointer()
+	if got := core.UnicodeDecode(r.array()); got != "Reader 0\x00\x00" {
+		t.Errorf("readers %q", got)
+	}
+
+	w = &ndrWriter{}
+	w.uint32(4)
+	w.pointer(true)
+	w.uint32(1000)
+	w.uint32(1)
+	w.pointer(true)
+	w.handleId(context)
+	w.uint32(1)
+	w.pointer(true)
+	w.uint32(0x10) // SCARD_STATE_PRESENT
+	w.uint32(0)
+	w.uint32(0)
+	w.fixed(nil, atrSize)
+	w.stringW("Reader 0")
+	r = call(t, d, SCARD_IOCTL_GETSTATUSCHANGEW, w)
+	if n := r.uint32(); n != 1 {
+		t.Fatalf("%d reader states", n)
+	}
+	r.pointer()
+	r.uint32()
+	if cur, ev := r.uint32(), r.uint32(); cur != 0x10 || ev != 0x30 {
+		t.Errorf("reader state %x %x", cur, ev)
+	}
+
+	w = &ndrWriter{}
+	w.pointer(true)
+	w.uint32(4)
+	w.pointer(true)
+	w.uint32(2) // SCARD_SHARE_SHARED
+	w.uint32(3) // T0 | T1
+	w.stringW("Reader 0")
+	w.handleId(context)
+	r = call(t, d, SCARD_IOCTL_CONNECTW, w)
+	cp, hp := r.handleRef(), r.handleRef()
+	if protocol := r.uint32(); protocol != 2 {
+		t.Errorf("protocol %d", protocol)
+	}
+	r.handleId(cp)
+	card := r.handleId(hp)
+
+	w = &ndrWriter{}
+	w.handle()
+	w.uint32(2) // ioSendPci.dwProtocol
+	w.uint32(0)
+	w.pointer(false)
+	w.uint32(4)
+	w.pointer(true)
+	w.pointer(false) // pioRecvPci
+	w.uint32(0)
+	w.uint32(SCARD_AUTOALLOCATE)
+	w.handleId(context)
+	w.handleId(card)
+	w.array([]byte{0x00, 0xA4, 0x04, 0x00})
+	r = call(t, d, SCARD_IOCTL_TRANSMIT, w)
+	r.pointer()
+	r.uint32()
+	r.pointer()
+	if got := r.array(); !bytes.Equal(got, []byte{0x00, 0xA4, 0x04, 0x00, 0x90, 0x00}) {
+		t.Errorf("response %x", got)
+	}
+
+	w = &ndrWriter{}
+	w.handle()
+	w.handleId(context)
+	w.handleId(card)
+	r = call(t, d, SCARD_IOCTL_GETTRANSMITCOUNT, w)
+	if n := r.uint32(); n != 1 {
+		t.Errorf("transmit count %d", n)
+	}
+
+	w = &ndrWriter{}
+	w.handle()
+	w.uint32(0) // SCARD_LEAVE_CARD
+	w.handleId(context)
+	w.handleId(card)
+	call(t, d, SCARD_IOCTL_DISCONNECT, w)
+	r = newNDRReader(d.call(SCARD_IOCTL_TRANSMIT, w.bytes()))
+	if rc := r.uint32(); rc != SCARD_E_INVALID_HANDLE && rc != SCARD_E_INVALID_PARAMETER {
+		t.Errorf("transmit after disconnect returned 0x%08x", rc)
+	}
+}
+
+type sendRecorder struct {
+	pdus chan []byte
+}
+
+func (s *sendRecorder) SendToChannel(channel string, b []byte) (int, error) {
+	s.pdus <- bytes.Clone(b)
+	return len(b), nil
+}
+
+func TestSmartCardAnnouncedBeforeLogon(t *testing.T) {
+	rec := &sendRecorder{pdus: make(chan []byte, 8)}
+	c := rdpdr.NewClient("HOST", NewDevice(fakeProvider{}))
+	c.Sender(rec)
+	pdu := func(packetId uint16, body ...byte) []byte {
+		b := binary.LittleEndian.AppendUint16(nil, rdpdr.RDPDR_CTYP_CORE)
+		return append(binary.LittleEndian.AppendUint16(b, packetId), body...)
+	}
+	c.Process(pdu(rdpdr.PAKID_CORE_SERVER_ANNOUNCE, 1, 0, 0x0C, 0, 1, 0, 0, 0))
+	c.Process(pdu(rdpdr.PAKID_CORE_CLIENTID_CONFIRM, 1, 0, 0x0C, 0, 1, 0, 0, 0))
+	<-rec.pdus // Client Announce Reply
+	<-rec.pdus // Client Name Request
+	b := <-rec.pdus
+	if binary.LittleEndian.Uint32(b[4:]) != 1 || binary.LittleEndian.Uint32(b[8:]) != rdpdr.RDPDR_DTYP_SMARTCARD ||
+		string(b[16:24]) != "SCARD\x00\x00\x00" {
+		t.Fatalf("device announce %x", b)
+	}
+
+	// An IOCTL is answered from a goroutine of its own.
+	w := &ndrWriter{}
+	w.uint32(2)
+	in := w.bytes()
+	req := pdu(rdpdr.PAKID_CORE_DEVICE_IOREQUEST)
+	for _, v := range []uint32{1, 0, 5, rdpdr.IRP_MJ_DEVICE_CONTROL, 0, 1024, uint32(len(in)), SCARD_IOCTL_ESTABLISHCONTEXT} {
+		req = binary.LittleEndian.AppendUint32(req, v)
+	}
+	c.Process(append(append(req, make([]byte, 20)...), in...))
+	select {
+	case b := <-rec.pdus:
+		if binary.LittleEndian.Uint32(b[8:]) != 5 || binary.LittleEndian.Uint32(b[12:]) != rdpdr.STATUS_SUCCESS {
+			t.Fatalf("completion %x", b)
+		}
+		r := newNDRReader(b[20:])
+		if rc := r.uint32(); rc != SCARD_S_SUCCESS {
+			t.Errorf("EstablishContext returned 0x%08x", rc)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no completion")
+	}
+}
@@ -0,0 +1,319 @@
+// Package rdpeai implements the Audio Input Redirection Virtual Channel
+// (MS-RDPEAI), which lets the session record from a microphone attached
+// to the client.  The channel name is:
+//
+//	"AUDIO_INPUT"
+//
+// The server lists the formats it accepts; the handler offers those its
+// AudioSource can capture, and when the server opens the channel it
+// streams the packets the source captures until the server closes it.
+package rdpeai
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/plugin/rdpsnd"
+)
+
+// ChannelName is the well-known DVC name for the Audio Input channel.
+const ChannelName = "AUDIO_INPUT"
+
+// Message IDs
+const (
+	MSG_SNDIN_VERSION       = 0x01
+	MSG_SNDIN_FORMATS       = 0x02
+	MSG_SNDIN_OPEN          = 0x03
+	MSG_SNDIN_OPEN_REPLY    = 0x04
+	MSG_SNDIN_DATA_INCOMING = 0x05
+	MSG_SNDIN_DATA          = 0x06
+	MSG_SNDIN_FORMATCHANGE  = 0x07
+)
+
+// Protocol versions
+const (
+	SNDIN_VERSION_Version_1 = 0x00000001
+	SNDIN_VERSION_Version_2 = 0x00000002
+)
+
+// E_FAIL is the Open Reply result when the source cannot be opened.
+const E_FAIL = 0x80004005
+
+// AudioSource captures the audio sent to the server.
+type AudioSource interface {
+	// Formats returns the formats the source can capture, most preferred
+	// first.  The server picks among those it also accepts.
+	Formats() []rdpsnd.AudioFormat
+	// Open starts capturing in format.  Each Read of the returned stream
+	// returns one packet of framesPerPacket frames, or fewer; Close stops
+	// the capture and makes a pending Read return.
+	Open(format rdpsnd.AudioFormat, framesPerPacket int) (io.ReadCloser, error)
+}
+
+// Handler is the DVC handler for the Audio Input channel.
+// It implements the drdynvc.DvcChannelHandler interface and the optional
+// SetSendFunc / OnChannelClosed extension interfaces.
+type Handler struct {
+	source AudioSource
+
+	// formats are the formats offered to the server; the server refers
+	// to them by index.
+	formats         []rdpsnd.AudioFormat
+	framesPerPacket int
+
+	mu      sync.Mutex // guards send and stream, serializes sending
+	send    func([]byte)
+	stream  io.ReadCloser
+	capture sync.WaitGroup
+
+	log *slog.Logger
+}
+
+// NewHandler returns a Handler recording from source.
+func NewHandler(source AudioSource) *Handler {
+	return &Handler{source: source, log: core.Logger(nil, "rdpeai")}
+}
+
+// SetLogger makes the handler log to l, with the attribute layer=rdpeai.
+func (h *Handler) SetLogger(l *slog.Logger) {
+	h.log = core.Logger(l, "rdpeai")
+}
+
+// SetSendFunc is called by the DVC client to provide a write-back function.
+func (h *Handler) SetSendFunc(f func([]byte)) {
+	h.mu.Lock()
+	h.send = f
+	h.mu.Unlock()
+}
+
+// OnChannelClosed is called by the DVC client when the server closes the
+// channel; the capture stops.
+func (h *Handler) OnChannelClosed() {
+	h.Close()
+}
+
+// Close stops the capture, if any.
+func (h *Handler) Close() {
+	h.mu.Lock()
+	if h.stream != nil {
+		h.stream.Close()
+		h.stream = nil
+	}
+	h.mu.Unlock()
+	h.capture.Wait()
+}
+
+// Process handles a message from the server.
+func (h *Handler) Process(data []byte) {
+	if len(data) < 1 {
+		return
+	}
+	body := data[1:]
+	switch data[0] {
+	case MSG_SNDIN_VERSION:
+		h.processVersion(body)
+	case MSG_SNDIN_FORMATS:
+		h.processFormats(body)
+	case MSG_SNDIN_OPEN:
+		h.processOpen(body)
+	case MSG_SNDIN_FORMATCHANGE:
+		h.processFormatChange(body)
+	default:
+		h.log.Debug("rdpeai: unknown message", "id", data[0])
+	}
+}
+
+// processVersion answers the Version PDU.
+func (h *Handler) processVersion(body []byte) {
+	if len(body) < 4 {
+		h.log.Warn("rdpeai: Version PDU too short")
+		return
+	}
+	version := min(binary.LittleEndian.Uint32(body), SNDIN_VERSION_Version_2)
+	h.log.Debug("rdpeai: server version", "version", binary.LittleEndian.Uint32(body))
+	h.write(binary.LittleEndian.AppendUint32([]byte{MSG_SNDIN_VERSION}, version))
+}
+
+// processFormats answers the Sound Formats PDU with the
+// server formats the source can capture.
+func (h *Handler) processFormats(body []byte) {
+	if len(body) < 8 {
+		h.log.Warn("rdpeai: Sound Formats PDU too short")
+		return
+	}
+	n := int(binary.LittleEndian.Uint32(body))
+	var server []rdpsnd.AudioFormat
+	for off := 8; len(server) < n; {
+		f, next, ok := unpackFormat(body, off)
+		if !ok {
+			break
+		}
+		server = append(server, f)
+		off = next
+	}
+	h.Close()
+	h.formats = nil
+	for _, want := range h.source.Formats() {
+		for _, f := range server {
+			if sameFormat(f, want) {
+				h.formats = append(h.formats, f)
+				break
+			}
+		}
+	}
+	if len(h.formats) == 0 {
+		h.log.Warn("rdpeai: no server format can be captured")
+	}
+
+	b := []byte{MSG_SNDIN_FORMATS}
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(h.formats)))
+	b = binary.LittleEndian.AppendUint32(b, 0) // cbSizeFormatsPacket
+	for _, f := range h.formats {
+		b = appendFormat(b, f)
+	}
+	binary.LittleEndian.PutUint32(b[5:], uint32(len(b)))
+	h.write(b)
+}
+
+// processOpen starts the capture the Open PDU asks for,
+// confirming its format before the Open Reply.
+func (h *Handler) processOpen(body []byte) {
+	if len(body) < 8 {
+		h.log.Warn("rdpeai: Open PDU too short")
+		return
+	}
+	h.framesPerPacket = int(binary.LittleEndian.Uint32(body))
+	index := binary.LittleEndian.Uint32(body[4:])
+	result := uint32(0)
+	if err := h.start(index); err != nil {
+		h.log.Warn("rdpeai: open audio source", "err", err)
+		result = E_FAIL
+	} else {
+		h.write(binary.LittleEndian.AppendUint32([]byte{MSG_SNDIN_FORMATCHANGE}, index))
+	}
+	h.write(binary.LittleEndian.AppendUint32([]byte{MSG_SNDIN_OPEN_REPLY}, result))
+}
+
+// processFormatChange restarts the capture in the format the Format Change
+// PDU names and confirms it.
+func (h *Handler) processFormatChange(body []byte) {
+	if len(body) < 4 {
+		h.log.Warn("rdpeai: Format Change PDU too short")
+		return
+	}
+	index := binary.LittleEndian.Uint32(body)
+	if err := h.start(index); err != nil {
+		h.log.Warn("rdpeai: change audio format", "err", err)
+		return
+	}
+	h.write(binary.LittleEndian.AppendUint32([]byte{MSG_SNDIN_FORMATCHANGE}, index))
+}
+
+var errFormatIndex = errors.New("rdpeai: format index out of range")
+
+// start stops any capture and opens the source in the offered format at
+// index, then streams its packets from a goroutine.
+func (h *Handler) start(index uint32) error {
+	h.Close()
+	if index >= uint32(len(h.formats)) {
+		return errFormatIndex
+	}
+	f := h.formats[index]
+	h.log.Debug("rdpeai: capture", "fmt", f, "framesPerPacket", h.framesPerPacket)
+	stream, err := h.source.Open(f, h.framesPerPacket)
+	if err != nil {
+		return err
+	}
+	size := h.framesPerPacket * int(f.BlockAlign)
+	if size <= 0 || f.Tag != rdpsnd.WAVE_FORMAT_PCM {
+		size = 64 * 1024
+	}
+	h.mu.Lock()
+	h.stream = stream
+	h.mu.Unlock()
+	h.capture.Add(1)
+	go h.pump(stream, size)
+	return nil
+}
+
+// pump sends each packet read from stream as an Incoming Data PDU
+// followed by a Data PDU until the stream
+// fails or is closed.
+func (h *Handler) pump(stream io.ReadCloser, size int) {
+	defer h.capture.Done()
+	buf := make([]byte, 1+size)
+	buf[0] = MSG_SNDIN_DATA
+	for {
+		n, err := stream.Read(buf[1:])
+		if n > 0 {
+			h.mu.Lock()
+			if h.stream != stream {
+				h.mu.Unlock()
+				return
+			}
+			if h.send != nil {
+				h.send([]byte{MSG_SNDIN_DATA_INCOMING})
+				h.send(buf[:1+n])
+			}
+			h.mu.Unlock()
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+				h.log.Debug("rdpeai: audio source", "err", err)
+			}
+			return
+		}
+	}
+}
+
+func (h *Handler) write(b []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.send != nil {
+		h.send(b)
+	}
+}
+
+// sameFormat reports whether a and b describe the same encoding.
+func sameFormat(a, b rdpsnd.AudioFormat) bool {
+	return a.Tag == b.Tag && a.Channels == b.Channels && a.SamplesPerSec == b.SamplesPerSec && a.BitsPerSample == b.BitsPerSample
+}
+
+// unpackFormat reads the AUDIO_FORMAT at off.
+func unpackFormat(b []byte, off int) (rdpsnd.AudioFormat, int, bool) {
+	if len(b)-off < 18 {
+		return rdpsnd.AudioFormat{}, off, false
+	}
+	f := rdpsnd.AudioFormat{
+		Tag:            binary.LittleEndian.Uint16(b[off:]),
+		Channels:       binary.LittleEndian.Uint16(b[off+2:]),
+		SamplesPerSec:  binary.LittleEndian.Uint32(b[off+4:]),
+		AvgBytesPerSec: binary.LittleEndian.Uint32(b[off+8:]),
+		BlockAlign:     binary.LittleEndian.Uint16(b[off+12:]),
+		BitsPerSample:  binary.LittleEndian.Uint16(b[off+14:]),
+	}
+	n := int(binary.LittleEndian.Uint16(b[off+16:]))
+	off += 18
+	if len(b)-off < n {
+		return rdpsnd.AudioFormat{}, off, false
+	}
+	if n > 0 {
+		f.ExtraData = append([]byte(nil), b[off:off+n]...)
+	}
+	return f, off + n, true
+}
+
+func appendFormat(b []byte, f rdpsnd.AudioFormat) []byte {
+	b = binary.LittleEndian.AppendUint16(b, f.Tag)
+	b = binary.LittleEndian.AppendUint16(b, f.Channels)
+	b = binary.LittleEndian.AppendUint32(b, f.SamplesPerSec)
+	b = binary.LittleEndian.AppendUint32(b, f.AvgBytesPerSec)
+	b = binary.LittleEndian.AppendUint16(b, f.BlockAlign)
+	b = binary.LittleEndian.AppendUint16(b, f.BitsPerSample)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(f.ExtraData)))
+	return append(b, f.ExtraData...)
+}
@@ -0,0 +1,96 @@
+package rdpeai
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/plugin/rdpsnd"
+)
+
+var (
+	pcm16k = rdpsnd.AudioFormat{Tag: rdpsnd.WAVE_FORMAT_PCM, Channels: 1, SamplesPerSec: 16000, AvgBytesPerSec: 32000, BlockAlign: 2, BitsPerSample: 16}
+	pcm44k = rdpsnd.AudioFormat{Tag: rdpsnd.WAVE_FORMAT_PCM, Channels: 2, SamplesPerSec: 44100, AvgBytesPerSec: 176400, BlockAlign: 4, BitsPerSample: 16}
+	alaw   = rdpsnd.AudioFormat{Tag: rdpsnd.WAVE_FORMAT_ALAW, Channels: 1, SamplesPerSec: 8000, AvgBytesPerSec: 8000, BlockAlign: 1, BitsPerSample: 8}
+)
+
+// pipeSource captures what the test writes to its pipe.
+type pipeSource struct {
+	w      *io.PipeWriter
+	opened chan rdpsnd.AudioFormat
+}
+
+func (s *pipeSource) Formats() []rdpsnd.AudioFormat {
+	return []rdpsnd.AudioFormat{pcm16k, pcm44k}
+}
+
+func (s *pipeSource) Open(f rdpsnd.AudioFormat, framesPerPacket int) (io.ReadCloser, error) {
+	r, w := io.Pipe()
+	s.w = w
+	s.opened <- f
+	return r, nil
+}
+
+func TestAudioInput(t *testing.T) {
+	src := &pipeSource{opened: make(chan rdpsnd.AudioFormat, 1)}
+	h := NewHandler(src)
+	sent := make(chan []byte, 8)
+	h.SetSendFunc(func(b []byte) { sent <- bytes.Clone(b) })
+	next := func() []byte {
+		t.Helper()
+		select {
+		case b := <-sent:
+			return b
+		case <-time.After(time.Second):
+			t.Fatal("nothing sent")
+			return nil
+		}
+	}
+
+	h.Process([]byte{MSG_SNDIN_VERSION, 2, 0, 0, 0})
+	if b := next(); !bytes.Equal(b, []byte{MSG_SNDIN_VERSION, 2, 0, 0, 0}) {
+		t.Errorf("version reply %x", b)
+	}
+
+	b := []byte{MSG_SNDIN_FORMATS, 3, 0, 0, 0, 0, 0, 0, 0}
+	for _, f := range []rdpsnd.AudioFormat{alaw, pcm44k, pcm16k} {
+		b = appendFormat(b, f)
+	}
+	h.Process(b)
+	reply := next()
+	if reply[0] != MSG_SNDIN_FORMATS || binary.LittleEndian.Uint32(reply[1:]) != 2 || binary.LittleEndian.Uint32(reply[5:]) != uint32(len(reply)) {
+		t.Fatalf("formats reply %x", reply)
+	}
+	if f, _, _ := unpackFormat(reply, 9); !sameFormat(f, pcm16k) {
+		t.Errorf("first format %v, want %v", f, pcm16k)
+	}
+
+	open := []byte{MSG_SNDIN_OPEN}
+	open = binary.LittleEndian.AppendUint32(open, 160)
+	open = binary.LittleEndian.AppendUint32(open, 1)
+	h.Process(appendFormat(open, pcm44k))
+	if f := <-src.opened; !sameFormat(f, pcm44k) {
+		t.Errorf("opened %v", f)
+	}
+	if b := next(); !bytes.Equal(b, []byte{MSG_SNDIN_FORMATCHANGE, 1, 0, 0, 0}) {
+		t.Errorf("format change %x", b)
+	}
+	if b := next(); !bytes.Equal(b, []byte{MSG_SNDIN_OPEN_REPLY, 0, 0, 0, 0}) {
+		t.Errorf("open reply %x", b)
+	}
+
+	src.w.Write([]byte{1, 2, 3, 4})
+	if b := next(); !bytes.Equal(b, []byte{MSG_SNDIN_DATA_INCOMING}) {
+		t.Errorf("incoming data %x", b)
+	}
+	if b := next(); !bytes.Equal(b, []byte{MSG_SNDIN_DATA, 1, 2, 3, 4}) {
+		t.Errorf("data %x", b)
+	}
+
+	h.OnChannelClosed()
+	if _, err := src.w.Write([]byte{5}); err == nil {
+		t.Error("capture not stopped")
+	}
+}
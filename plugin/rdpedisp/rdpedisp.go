@@ -14,7 +14,12 @@ package rdpedisp
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"log/slog"
+	"sync"
+
+	"github.com/nakagami/grdp/core"
 )
 
 // ChannelName is the well-known DVC name for the Display Update channel.
@@ -51,13 +56,40 @@ type Monitor struct {
 	DeviceScaleFactor  uint32
 }
 
+// Bounds of a monitor of a MONITOR_LAYOUT PDU
+const (
+	MinMonitorSize     = 200
+	MaxMonitorSize     = 8192
+	MinDesktopScale    = 100
+	MaxDesktopScale    = 500
+	DefaultDeviceScale = 100
+)
+
+// Caps is the Capabilities PDU of the server: the most monitors
+// a layout may have, and the factors whose product with MaxNumMonitors
+// bounds the total area of the monitors.
+type Caps struct {
+	MaxNumMonitors        uint32
+	MaxMonitorAreaFactorA uint32
+	MaxMonitorAreaFactorB uint32
+}
+
+// ErrNotOpen is returned by Resize before the server has opened the
+// channel and sent its capabilities.
+var ErrNotOpen = errors.New("rdpedisp: display control channel not open")
+
 // Handler is the DVC handler for the Display Update channel.
 // It implements the drdynvc.DvcChannelHandler interface and the optional
-// SetSendFunc / OnChannelCreated extension interfaces.
+// SetSendFunc / OnChannelCreated / OnChannelClosed extension interfaces.
 type Handler struct {
+	mu            sync.Mutex // guards send and caps
 	send          func([]byte)
+	caps          *Caps
 	initialWidth  uint32
 	initialHeight uint32
+	initial       []Monitor
+
+	log *slog.Logger
 }
 
 // NewHandler returns a new Handler.
@@ -66,13 +98,58 @@ type Handler struct {
 // opens, mirroring FreeRDP's /size behaviour and prompting GNOME Remote
 // Desktop (headless or screen-share) to resize to the requested resolution.
 func NewHandler(width, height uint32) *Handler {
-	return &Handler{initialWidth: width, initialHeight: height}
+	return &Handler{initialWidth: width, initialHeight: height, log: core.Logger(nil, "rdpedisp")}
+}
+
+// SetInitialLayout replaces the single monitor of NewHandler with the
+// layout sent when the channel opens, so that the monitors of the session
+// keep their own scale factors.
+func (h *Handler) SetInitialLayout(monitors []Monitor) {
+	h.initial = append([]Monitor(nil), monitors...)
+}
+
+// DeviceScale returns the device scale factor, 100, 140 or 180 percent,
+// that goes with a desktop scale factor.
+func DeviceScale(desktopScale uint32) uint32 {
+	switch {
+	case desktopScale >= 180:
+		return 180
+	case desktopScale >= 140:
+		return 140
+	}
+	return DefaultDeviceScale
+}
+
+// SetLogger makes the handler log to l, with the attribute layer=rdpedisp.
+func (h *Handler) SetLogger(l *slog.Logger) {
+	h.log = core.Logger(l, "rdpedisp")
 }
 
 // SetSendFunc is called by the DVC client to provide a write-back function.
 // Required by the drdynvc channel plumbing.
 func (h *Handler) SetSendFunc(f func([]byte)) {
+	h.mu.Lock()
 	h.send = f
+	h.caps = nil
+	h.mu.Unlock()
+}
+
+// OnChannelClosed is called by the DVC client when the channel closes.
+func (h *Handler) OnChannelClosed() {
+	h.mu.Lock()
+	h.send = nil
+	h.caps = nil
+	h.mu.Unlock()
+}
+
+// Caps returns the capabilities of the server, once it has sent them.
+func (h *Handler) Caps() (Caps, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.caps == nil {
+		return Caps{}, false
+	}
+	return *h.caps, true
 }
 
 // OnChannelCreated is called by the DVC client after the CREATE_RSP has been sent.
@@ -80,7 +157,11 @@ func (h *Handler) SetSendFunc(f func([]byte)) {
 // sent immediately, mirroring FreeRDP's behaviour of advertising the desired
 // desktop size as soon as the display channel opens.
 func (h *Handler) OnChannelCreated() {
-	slog.Debug("rdpedisp: channel created")
+	h.log.Debug("rdpedisp: channel created")
+	if len(h.initial) > 0 {
+		h.SendMonitorLayout(h.initial)
+		return
+	}
 	if h.initialWidth > 0 && h.initialHeight > 0 {
 		h.SendMonitorLayout([]Monitor{
 			{
@@ -108,11 +189,19 @@ func (h *Handler) Process(data []byte) {
 	switch pduType {
 	case pduTypeCaps:
 		if len(data) >= 20 {
-			maxMonitors := binary.LittleEndian.Uint32(data[8:12])
-			slog.Debug("rdpedisp: server CAPS", "maxMonitors", maxMonitors)
+			c := &Caps{
+				MaxNumMonitors:        binary.LittleEndian.Uint32(data[8:12]),
+				MaxMonitorAreaFactorA: binary.LittleEndian.Uint32(data[12:16]),
+				MaxMonitorAreaFactorB: binary.LittleEndian.Uint32(data[16:20]),
+			}
+			h.log.Debug("rdpedisp: server CAPS", "maxMonitors", c.MaxNumMonitors,
+				"areaFactorA", c.MaxMonitorAreaFactorA, "areaFactorB", c.MaxMonitorAreaFactorB)
+			h.mu.Lock()
+			h.caps = c
+			h.mu.Unlock()
 		}
 	default:
-		slog.Debug("rdpedisp: unknown PDU type", "type", pduType)
+		h.log.Debug("rdpedisp: unknown PDU type", "type", pduType)
 	}
 }
 
@@ -123,8 +212,11 @@ func (h *Handler) Process(data []byte) {
 // The server will apply the new layout and—if using the RDPGFX pipeline—send
 // a ResetGraphics command that resets surface dimensions to match.
 func (h *Handler) SendMonitorLayout(monitors []Monitor) {
-	if h.send == nil {
-		slog.Warn("rdpedisp: SendMonitorLayout: channel not open")
+	h.mu.Lock()
+	send := h.send
+	h.mu.Unlock()
+	if send == nil {
+		h.log.Warn("rdpedisp: SendMonitorLayout: channel not open")
 		return
 	}
 
@@ -156,6 +248,57 @@ func (h *Handler) SendMonitorLayout(monitors []Monitor) {
 		off += monitorLayoutSize
 	}
 
-	slog.Debug("rdpedisp: sending MonitorLayout", "numMonitors", numMonitors)
-	h.send(pdu)
+	h.log.Debug("rdpedisp: sending MonitorLayout", "numMonitors", numMonitors)
+	send(pdu)
+}
+
+// Resize asks the server to change the desktop to a single monitor of
+// width x height pixels at desktopScale percent, checking the request
+// against the bounds of the protocol and the capabilities of the server.
+// An odd width is rounded down.  The device scale follows the desktop
+// scale, as DeviceScale returns.
+func (h *Handler) Resize(width, height, desktopScale uint32) error {
+	return h.Layout([]Monitor{{
+		Flags:              MonitorFlagPrimary,
+		Width:              width &^ 1,
+		Height:             height,
+		DesktopScaleFactor: desktopScale,
+		DeviceScaleFactor:  DeviceScale(desktopScale),
+	}})
+}
+
+// Layout asks the server to change the desktop to monitors, each with its
+// own scale factors, after checking them against the bounds of the
+// protocol and the capabilities of the server.
+func (h *Handler) Layout(monitors []Monitor) error {
+	caps, ok := h.Caps()
+	if !ok {
+		return ErrNotOpen
+	}
+	if len(monitors) == 0 || caps.MaxNumMonitors > 0 && uint32(len(monitors)) > caps.MaxNumMonitors {
+		return fmt.Errorf("rdpedisp: %d monitors, the server takes 1 to %d", len(monitors), caps.MaxNumMonitors)
+	}
+	var area uint64
+	for _, m := range monitors {
+		if m.Width%2 != 0 || m.Width < MinMonitorSize || m.Width > MaxMonitorSize || m.Height < MinMonitorSize || m.Height > MaxMonitorSize {
+			return fmt.Errorf("rdpedisp: size %dx%d out of range %d to %d or odd width", m.Width, m.Height, MinMonitorSize, MaxMonitorSize)
+		}
+		if m.DesktopScaleFactor < MinDesktopScale || m.DesktopScaleFactor > MaxDesktopScale {
+			return fmt.Errorf("rdpedisp: scale %d%% out of range %d%% to %d%%", m.DesktopScaleFactor, MinDesktopScale, MaxDesktopScale)
+		}
+		switch m.DeviceScaleFactor {
+		case 100, 140, 180:
+		default:
+			return fmt.Errorf("rdpedisp: device scale %d%% is not 100%%, 140%% or 180%%", m.DeviceScaleFactor)
+		}
+		area += uint64(m.Width) * uint64(m.Height)
+	}
+	if caps.MaxNumMonitors > 0 && caps.MaxMonitorAreaFactorA > 0 && caps.MaxMonitorAreaFactorB > 0 {
+		limit := uint64(caps.MaxNumMonitors) * uint64(caps.MaxMonitorAreaFactorA) * uint64(caps.MaxMonitorAreaFactorB)
+		if area > limit {
+			return fmt.Errorf("rdpedisp: %d pixels exceed the server limit of %d", area, limit)
+		}
+	}
+	h.SendMonitorLayout(monitors)
+	return nil
 }
@@ -0,0 +1,52 @@
+package rdpedisp
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestResize(t *testing.T) {
+	h := NewHandler(0, 0)
+	var sent [][]byte
+	h.SetSendFunc(func(b []byte) { sent = append(sent, b) })
+	if err := h.Resize(1280, 720, 100); err != ErrNotOpen {
+		t.Errorf("resize before caps: %v", err)
+	}
+
+	// One monitor of at most 2560x1600 pixels.
+	h.Process([]byte{5, 0, 0, 0, 20, 0, 0, 0, 1, 0, 0, 0, 0x00, 0x0A, 0, 0, 0x40, 0x06, 0, 0})
+	if c, ok := h.Caps(); !ok || c != (Caps{1, 2560, 1600}) {
+		t.Fatalf("caps = %+v", c)
+	}
+	for _, bad := range [][3]uint32{{100, 720, 100}, {1280, 9000, 100}, {1280, 720, 600}, {3840, 2160, 100}} {
+		if err := h.Resize(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("resize %v accepted", bad)
+		}
+	}
+	if len(sent) != 0 {
+		t.Fatalf("sent %d PDUs for rejected sizes", len(sent))
+	}
+
+	if err := h.Resize(1281, 720, 150); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || len(sent[0]) != 56 {
+		t.Fatalf("sent %d PDUs", len(sent))
+	}
+	p := sent[0]
+	var got []uint32
+	for off := 0; off < len(p); off += 4 {
+		got = append(got, binary.LittleEndian.Uint32(p[off:]))
+	}
+	want := []uint32{pduTypeMonitorLayout, 56, monitorLayoutSize, 1, MonitorFlagPrimary, 0, 0, 1280, 720, 0, 0, 0, 150, 140}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("field %d = %d, want %d", i, got[i], want[i])
+		}
+	}
+
+	h.OnChannelClosed()
+	if err := h.Resize(1280, 720, 100); err != ErrNotOpen {
+		t.Errorf("resize after close: %v", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Package rdpeeco implements the Echo Virtual Channel Extension
+// (MS-RDPEECO), over which the server measures the latency of the
+// connection by sending requests the client echoes.  The channel name is:
+//
+//	"ECHO"
+//
+// The handler also measures the round trip the other way: Ping sends a
+// request of its own and waits for the server endpoint to echo it.
+package rdpeeco
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// ChannelName is the well-known DVC name for the Echo channel.
+const ChannelName = "ECHO"
+
+// pingMagic starts the requests of Ping, followed by an 8-byte sequence
+// number, to tell their echoes from the requests of the server.
+var pingMagic = []byte("grdp-ping")
+
+// ErrNotOpen is returned by Ping while the server has not opened the
+// channel.
+var ErrNotOpen = errors.New("rdpeeco: echo channel not open")
+
+// Handler is the DVC handler for the Echo channel.
+// It implements the drdynvc.DvcChannelHandler interface and the optional
+// SetSendFunc / OnChannelClosed extension interfaces.
+type Handler struct {
+	mu       sync.Mutex // guards the fields below
+	send     func([]byte)
+	seq      uint64
+	pending  map[uint64]chan struct{}
+	rtt      time.Duration
+	requests uint32
+
+	log *slog.Logger
+}
+
+// NewHandler returns a new Handler.
+func NewHandler() *Handler {
+	return &Handler{pending: make(map[uint64]chan struct{}), log: core.Logger(nil, "rdpeeco")}
+}
+
+// SetLogger makes the handler log to l, with the attribute layer=rdpeeco.
+func (h *Handler) SetLogger(l *slog.Logger) {
+	h.log = core.Logger(l, "rdpeeco")
+}
+
+// SetSendFunc is called by the DVC client to provide a write-back function.
+func (h *Handler) SetSendFunc(f func([]byte)) {
+	h.mu.Lock()
+	h.send = f
+	h.mu.Unlock()
+}
+
+// OnChannelClosed is called by the DVC client when the channel closes.
+func (h *Handler) OnChannelClosed() {
+	h.mu.Lock()
+	h.send = nil
+	h.mu.Unlock()
+}
+
+// Process answers an ECHO_REQUEST_PDU of the server with an
+// ECHO_RESPONSE_PDU of the same bytes, or completes the Ping whose
+// request the server echoed.
+func (h *Handler) Process(data []byte) {
+	if len(data) == len(pingMagic)+8 && bytes.HasPrefix(data, pingMagic) {
+		seq := binary.LittleEndian.Uint64(data[len(pingMagic):])
+		h.mu.Lock()
+		done, ok := h.pending[seq]
+		delete(h.pending, seq)
+		h.mu.Unlock()
+		if ok {
+			close(done)
+			return
+		}
+	}
+	h.mu.Lock()
+	send := h.send
+	h.requests++
+	h.mu.Unlock()
+	if send == nil {
+		return
+	}
+	h.log.Debug("rdpeeco: echo request", "len", len(data))
+	send(bytes.Clone(data))
+}
+
+// Ping sends an echo request to the server endpoint of the channel and
+// returns the time until its echo arrives.  It returns ctx.Err() when ctx
+// ends first, which is also what happens when the server only sends
+// requests and does not echo those of the client.
+func (h *Handler) Ping(ctx context.Context) (time.Duration, error) {
+	h.mu.Lock()
+	send := h.send
+	if send == nil {
+		h.mu.Unlock()
+		return 0, ErrNotOpen
+	}
+	h.seq++
+	seq := h.seq
+	done := make(chan struct{})
+	h.pending[seq] = done
+	h.mu.Unlock()
+
+	req := binary.LittleEndian.AppendUint64(bytes.Clone(pingMagic), seq)
+	start := time.Now()
+	send(req)
+	select {
+	case <-done:
+		rtt := time.Since(start)
+		h.mu.Lock()
+		h.rtt = rtt
+		h.mu.Unlock()
+		return rtt, nil
+	case <-ctx.Done():
+		h.mu.Lock()
+		delete(h.pending, seq)
+		h.mu.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+// LastRTT returns the round-trip time of the last successful Ping, 0
+// before the first one.
+func (h *Handler) LastRTT() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rtt
+}
+
+// Requests returns the number of echo requests of the server answered.
+func (h *Handler) Requests() uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests
+}
@@ -0,0 +1,47 @@
+package rdpeeco
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestEcho(t *testing.T) {
+	h := NewHandler()
+	var sent [][]byte
+	h.SetSendFunc(func(b []byte) { sent = append(sent, b) })
+	h.Process([]byte{1, 2, 3})
+	if len(sent) != 1 || !bytes.Equal(sent[0], []byte{1, 2, 3}) || h.Requests() != 1 {
+		t.Errorf("echo %x", sent)
+	}
+}
+
+func TestPing(t *testing.T) {
+	h := NewHandler()
+	if _, err := h.Ping(context.Background()); err != ErrNotOpen {
+		t.Errorf("ping before open: %v", err)
+	}
+
+	// A server endpoint that echoes the client.
+	h.SetSendFunc(func(b []byte) { go h.Process(b) })
+	rtt, err := h.Ping(context.Background())
+	if err != nil || rtt <= 0 || h.LastRTT() != rtt {
+		t.Errorf("ping = %v, %v", rtt, err)
+	}
+	if h.Requests() != 0 {
+		t.Error("echo of a ping counted as a server request")
+	}
+
+	// One that does not.
+	h.SetSendFunc(func([]byte) {})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := h.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unanswered ping: %v", err)
+	}
+	if len(h.pending) != 0 {
+		t.Error("unanswered ping left pending")
+	}
+}
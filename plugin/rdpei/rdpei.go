@@ -0,0 +1,371 @@
+// Package rdpei implements the Input Virtual Channel Extension
+// (MS-RDPEI), which carries multi-touch frames and pen (stylus) input to
+// the server.  The channel name is:
+//
+//	"Microsoft::Windows::RDS::Input"
+//
+// The server opens the channel and announces its protocol version with
+// an SC_READY PDU; touch and pen frames can be sent once the client has
+// answered with CS_READY.
+package rdpei
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"sync"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// ChannelName is the well-known DVC name for the Input channel.
+const ChannelName = "Microsoft::Windows::RDS::Input"
+
+// PDU event IDs (MS-RDPEI 2.2.2.1)
+const (
+	eventIdScReady                = 0x0001
+	eventIdCsReady                = 0x0002
+	eventIdTouch                  = 0x0003
+	eventIdSuspendInput           = 0x0004
+	eventIdResumeInput            = 0x0005
+	eventIdDismissHoveringContact = 0x0006
+	eventIdPen                    = 0x0008
+)
+
+// Protocol versions (MS-RDPEI 2.2.3.1)
+const (
+	RDPINPUT_PROTOCOL_V10  = 0x00010000
+	RDPINPUT_PROTOCOL_V101 = 0x00010001
+	RDPINPUT_PROTOCOL_V200 = 0x00020000
+	RDPINPUT_PROTOCOL_V300 = 0x00030000
+)
+
+// CS_READY flags (MS-RDPEI 2.2.3.2)
+const (
+	READY_FLAGS_SHOW_TOUCH_VISUALS          = 0x00000001
+	READY_FLAGS_DISABLE_TIMESTAMP_INJECTION = 0x00000002
+)
+
+// Contact flags of touch and pen contacts (MS-RDPEI 2.2.3.3.1.1)
+const (
+	CONTACT_FLAG_DOWN      = 0x0001
+	CONTACT_FLAG_UPDATE    = 0x0002
+	CONTACT_FLAG_UP        = 0x0004
+	CONTACT_FLAG_INRANGE   = 0x0008
+	CONTACT_FLAG_INCONTACT = 0x0010
+	CONTACT_FLAG_CANCELED  = 0x0020
+)
+
+// Optional fields of a pen contact (MS-RDPEI 2.2.3.7.1.1)
+const (
+	PEN_CONTACT_PENFLAGS_PRESENT = 0x0001
+	PEN_CONTACT_PRESSURE_PRESENT = 0x0002
+	PEN_CONTACT_ROTATION_PRESENT = 0x0004
+	PEN_CONTACT_TILTX_PRESENT    = 0x0008
+	PEN_CONTACT_TILTY_PRESENT    = 0x0010
+)
+
+// Pen flags
+const (
+	PEN_FLAG_BARREL_PRESSED = 0x0001
+	PEN_FLAG_ERASER_PRESSED = 0x0002
+	PEN_FLAG_INVERTED       = 0x0004
+)
+
+// MaxTouchContacts is the number of simultaneous contacts announced to
+// the server.
+const MaxTouchContacts = 10
+
+// PenContact is one pen sample.  Flags holds the CONTACT_FLAG_* state
+// and FieldsPresent the PEN_CONTACT_*_PRESENT bits of the optional
+// fields that are sent: Pressure ranges 0 to 1024, Rotation 0 to 359
+// degrees and TiltX, TiltY -90 to 90 degrees.
+type PenContact struct {
+	X, Y          int32
+	Flags         uint32
+	FieldsPresent uint16
+	PenFlags      uint32
+	Pressure      uint32
+	Rotation      uint16
+	TiltX, TiltY  int16
+}
+
+// touchContact is the last state sent for an active touch contact.
+type touchContact struct {
+	x, y int32
+}
+
+// Handler is the DVC handler for the Input channel.
+type Handler struct {
+	mu        sync.Mutex
+	send      func([]byte)
+	version   uint32
+	ready     bool
+	suspended bool
+	// contacts holds the touch contacts that are down, by contact ID.
+	contacts map[uint8]touchContact
+
+	log *slog.Logger
+}
+
+// NewHandler returns a new Handler.
+func NewHandler() *Handler {
+	return &Handler{contacts: make(map[uint8]touchContact), log: core.Logger(nil, "rdpei")}
+}
+
+// SetLogger makes the handler log to l, with the attribute layer=rdpei.
+func (h *Handler) SetLogger(l *slog.Logger) {
+	h.log = core.Logger(l, "rdpei")
+}
+
+// SetSendFunc is called by the DVC client to provide a write-back function.
+func (h *Handler) SetSendFunc(f func([]byte)) {
+	h.mu.Lock()
+	h.send = f
+	h.mu.Unlock()
+}
+
+// Ready reports whether the channel is open and accepting input.
+func (h *Handler) Ready() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ready && !h.suspended
+}
+
+// Process handles the PDUs of the server.
+func (h *Handler) Process(data []byte) {
+	if len(data) < 6 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch eventId := binary.LittleEndian.Uint16(data); eventId {
+	case eventIdScReady:
+		if len(data) < 10 {
+			return
+		}
+		h.version = binary.LittleEndian.Uint32(data[6:])
+		h.log.Debug("rdpei: SC_READY", "version", h.version)
+		h.sendCsReady()
+	case eventIdSuspendInput:
+		h.log.Debug("rdpei: SUSPEND_INPUT")
+		h.suspended = true
+	case eventIdResumeInput:
+		h.log.Debug("rdpei: RESUME_INPUT")
+		h.suspended = false
+	default:
+		h.log.Debug("rdpei: unknown PDU", "eventId", eventId)
+	}
+}
+
+// sendCsReady answers SC_READY with RDPINPUT_CS_READY_PDU (MS-RDPEI
+// 2.2.3.2), offering version 2.0, the first with pen input.
+func (h *Handler) sendCsReady() {
+	body := binary.LittleEndian.AppendUint32(nil, READY_FLAGS_SHOW_TOUCH_VISUALS)
+	body = binary.LittleEndian.AppendUint32(body, RDPINPUT_PROTOCOL_V200)
+	body = binary.LittleEndian.AppendUint16(body, MaxTouchContacts)
+	h.sendPdu(eventIdCsReady, body)
+	h.ready = true
+	h.contacts = make(map[uint8]touchContact)
+}
+
+func (h *Handler) sendPdu(eventId uint16, body []byte) {
+	if h.send == nil {
+		return
+	}
+	p := binary.LittleEndian.AppendUint16(make([]byte, 0, 6+len(body)), eventId)
+	p = binary.LittleEndian.AppendUint32(p, uint32(6+len(body)))
+	h.send(append(p, body...))
+}
+
+// Touch sends a touch frame in which contact id goes down (CONTACT_FLAG_DOWN),
+// moves (CONTACT_FLAG_UPDATE), lifts (CONTACT_FLAG_UP) or is cancelled
+// (CONTACT_FLAG_UP|CONTACT_FLAG_CANCELED) at (x, y).  The other contacts
+// that are down are repeated in the frame at their last position, as
+// the server expects every active contact in each frame.  It reports
+// false when the channel is not ready or the contact state is invalid.
+func (h *Handler) Touch(id uint8, x, y int32, flags uint32) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.ready || h.suspended {
+		return false
+	}
+	_, down := h.contacts[id]
+	switch {
+	case flags&CONTACT_FLAG_DOWN != 0:
+		if down || len(h.contacts) >= MaxTouchContacts {
+			return false
+		}
+		flags |= CONTACT_FLAG_INRANGE | CONTACT_FLAG_INCONTACT
+	case flags&CONTACT_FLAG_UPDATE != 0:
+		if !down {
+			return false
+		}
+		flags |= CONTACT_FLAG_INRANGE | CONTACT_FLAG_INCONTACT
+	case flags&CONTACT_FLAG_UP != 0:
+		if !down {
+			return false
+		}
+	default:
+		return false
+	}
+
+	frame := appendTouchContact(nil, id, x, y, flags)
+	count := 1
+	for cid, c := range h.contacts {
+		if cid == id {
+			continue
+		}
+		frame = appendTouchContact(frame, cid, c.x, c.y,
+			CONTACT_FLAG_UPDATE|CONTACT_FLAG_INRANGE|CONTACT_FLAG_INCONTACT)
+		count++
+	}
+	if flags&CONTACT_FLAG_UP != 0 {
+		delete(h.contacts, id)
+	} else {
+		h.contacts[id] = touchContact{x, y}
+	}
+	h.sendPdu(eventIdTouch, frameBody(count, frame))
+	return true
+}
+
+// Pen sends a pen frame holding c (RDPINPUT_PEN_EVENT_PDU, MS-RDPEI
+// 2.2.3.7).  It reports false when the channel is not ready or the server
+// does not support pen input.
+func (h *Handler) Pen(c PenContact) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.ready || h.suspended || h.version < RDPINPUT_PROTOCOL_V200 {
+		return false
+	}
+	contact := []byte{0} // deviceId
+	contact = appendTwoByteUnsigned(contact, c.FieldsPresent)
+	contact = appendFourByteSigned(contact, c.X)
+	contact = appendFourByteSigned(contact, c.Y)
+	contact = appendFourByteUnsigned(contact, c.Flags)
+	if c.FieldsPresent&PEN_CONTACT_PENFLAGS_PRESENT != 0 {
+		contact = appendFourByteUnsigned(contact, c.PenFlags)
+	}
+	if c.FieldsPresent&PEN_CONTACT_PRESSURE_PRESENT != 0 {
+		contact = appendFourByteUnsigned(contact, c.Pressure)
+	}
+	if c.FieldsPresent&PEN_CONTACT_ROTATION_PRESENT != 0 {
+		contact = appendTwoByteUnsigned(contact, c.Rotation)
+	}
+	if c.FieldsPresent&PEN_CONTACT_TILTX_PRESENT != 0 {
+		contact = appendTwoByteSigned(contact, c.TiltX)
+	}
+	if c.FieldsPresent&PEN_CONTACT_TILTY_PRESENT != 0 {
+		contact = appendTwoByteSigned(contact, c.TiltY)
+	}
+	h.sendPdu(eventIdPen, frameBody(1, contact))
+	return true
+}
+
+// DismissHoveringContact tells the server to drop the hovering state of
+// contact id (RDPINPUT_DISMISS_HOVERING_CONTACT_PDU).
+func (h *Handler) DismissHoveringContact(id uint8) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ready {
+		h.sendPdu(eventIdDismissHoveringContact, []byte{id})
+	}
+}
+
+// appendTouchContact appends an RDPINPUT_CONTACT_DATA without the
+// optional fields (MS-RDPEI 2.2.3.3.1.1).
+func appendTouchContact(b []byte, id uint8, x, y int32, flags uint32) []byte {
+	b = append(b, id)
+	b = appendTwoByteUnsigned(b, 0) // fieldsPresent
+	b = appendFourByteSigned(b, x)
+	b = appendFourByteSigned(b, y)
+	return appendFourByteUnsigned(b, flags)
+}
+
+// frameBody returns the body of a touch or pen event PDU holding one
+// frame of count contacts: encodeTime, frameCount, then the frame's
+// contactCount and frameOffset.
+func frameBody(count int, contacts []byte) []byte {
+	b := appendFourByteUnsigned(nil, 0) // encodeTime
+	b = appendTwoByteUnsigned(b, 1)     // frameCount
+	b = appendTwoByteUnsigned(b, uint16(count))
+	b = appendEightByteUnsigned(b, 0) // frameOffset
+	return append(b, contacts...)
+}
+
+// The variable-length integers of MS-RDPEI 2.2.2.  Each stores its byte
+// count in the top bits of the first byte, followed by the value in
+// big-endian order; the signed ones carry a sign bit and the magnitude.
+
+// appendTwoByteUnsigned appends a TWO_BYTE_UNSIGNED_INTEGER (0 to 0x7FFF).
+func appendTwoByteUnsigned(b []byte, v uint16) []byte {
+	v = min(v, 0x7FFF)
+	if v <= 0x7F {
+		return append(b, byte(v))
+	}
+	return append(b, 0x80|byte(v>>8), byte(v))
+}
+
+// appendTwoByteSigned appends a TWO_BYTE_SIGNED_INTEGER (-0x3FFF to
+// 0x3FFF).
+func appendTwoByteSigned(b []byte, v int16) []byte {
+	var sign byte
+	m := int32(v)
+	if m < 0 {
+		sign, m = 0x40, -m
+	}
+	m = min(m, 0x3FFF)
+	if m <= 0x3F {
+		return append(b, sign|byte(m))
+	}
+	return append(b, 0x80|sign|byte(m>>8), byte(m))
+}
+
+// appendFourByteUnsigned appends a FOUR_BYTE_UNSIGNED_INTEGER (0 to
+// 0x3FFFFFFF).
+func appendFourByteUnsigned(b []byte, v uint32) []byte {
+	v = min(v, 0x3FFFFFFF)
+	n := 0
+	for n < 3 && v > 0x3F<<(8*n)|(1<<(8*n)-1) {
+		n++
+	}
+	b = append(b, byte(n<<6)|byte(v>>(8*n)))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
+
+// appendFourByteSigned appends a FOUR_BYTE_SIGNED_INTEGER (-0x1FFFFFFF
+// to 0x1FFFFFFF).
+func appendFourByteSigned(b []byte, v int32) []byte {
+	var sign byte
+	m := int64(v)
+	if m < 0 {
+		sign, m = 0x20, -m
+	}
+	m = min(m, 0x1FFFFFFF)
+	n := 0
+	for n < 3 && m > 0x1F<<(8*n)|(1<<(8*n)-1) {
+		n++
+	}
+	b = append(b, byte(n<<6)|sign|byte(m>>(8*n)))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(m>>(8*i)))
+	}
+	return b
+}
+
+// appendEightByteUnsigned appends an EIGHT_BYTE_UNSIGNED_INTEGER (0 to
+// 0x1FFFFFFFFFFFFFFF).
+func appendEightByteUnsigned(b []byte, v uint64) []byte {
+	v = min(v, 0x1FFFFFFFFFFFFFFF)
+	n := 0
+	for n < 7 && v > 0x1F<<(8*n)|(1<<(8*n)-1) {
+		n++
+	}
+	b = append(b, byte(n<<5)|byte(v>>(8*n)))
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(v>>(8*i)))
+	}
+	return b
+}
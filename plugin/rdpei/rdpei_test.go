@@ -0,0 +1,82 @@
+package rdpei
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVarInts(t *testing.T) {
+	tests := []struct {
+		name string
+		got  []byte
+		want []byte
+	}{
+		{"2BU small", appendTwoByteUnsigned(nil, 0x7F), []byte{0x7F}},
+		{"2BU large", appendTwoByteUnsigned(nil, 0x1234), []byte{0x92, 0x34}},
+		{"2BS negative", appendTwoByteSigned(nil, -5), []byte{0x45}},
+		{"2BS large", appendTwoByteSigned(nil, 0x100), []byte{0x81, 0x00}},
+		{"4BU small", appendFourByteUnsigned(nil, 0x3F), []byte{0x3F}},
+		{"4BU two", appendFourByteUnsigned(nil, 0x40), []byte{0x40, 0x40}},
+		{"4BU four", appendFourByteUnsigned(nil, 0x12345678), []byte{0xD2, 0x34, 0x56, 0x78}},
+		{"4BS negative", appendFourByteSigned(nil, -0x20), []byte{0x60, 0x20}},
+		{"4BS small", appendFourByteSigned(nil, 0x1F), []byte{0x1F}},
+		{"8BU zero", appendEightByteUnsigned(nil, 0), []byte{0x00}},
+		{"8BU two", appendEightByteUnsigned(nil, 0x100), []byte{0x21, 0x00}},
+	}
+	for _, tt := range tests {
+		if !bytes.Equal(tt.got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestTouchFrames(t *testing.T) {
+	h := NewHandler()
+	var sent [][]byte
+	h.SetSendFunc(func(b []byte) { sent = append(sent, b) })
+
+	if h.Touch(1, 10, 10, CONTACT_FLAG_DOWN) {
+		t.Fatal("Touch succeeded before SC_READY")
+	}
+	h.Process([]byte{0x01, 0x00, 0x0A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x00})
+	if len(sent) != 1 || !bytes.Equal(sent[0], []byte{
+		0x02, 0x00, 0x10, 0x00, 0x00, 0x00, // CS_READY header
+		0x01, 0x00, 0x00, 0x00, // flags
+		0x00, 0x00, 0x02, 0x00, // protocolVersion
+		0x0A, 0x00, // maxTouchContacts
+	}) {
+		t.Fatalf("CS_READY = % x", sent)
+	}
+
+	if !h.Touch(1, 10, 20, CONTACT_FLAG_DOWN) {
+		t.Fatal("Touch down failed")
+	}
+	want := []byte{
+		0x03, 0x00, 0x0F, 0x00, 0x00, 0x00, // TOUCH header
+		0x00, 0x01, // encodeTime, frameCount
+		0x01, 0x00, // contactCount, frameOffset
+		0x01, 0x00, 0x0A, 0x14, 0x19, // contact 1: id, fields, x, y, flags
+	}
+	if !bytes.Equal(sent[1], want) {
+		t.Errorf("touch down = % x, want % x", sent[1], want)
+	}
+
+	// A second contact repeats the first one in its frame.
+	h.Touch(2, 30, 40, CONTACT_FLAG_DOWN)
+	if got := sent[2][8]; got != 2 {
+		t.Errorf("contactCount = %d, want 2", got)
+	}
+	if h.Touch(2, 30, 40, CONTACT_FLAG_DOWN) {
+		t.Error("second down of contact 2 accepted")
+	}
+	h.Touch(2, 30, 40, CONTACT_FLAG_UP)
+	h.Touch(1, 10, 20, CONTACT_FLAG_UP)
+	if h.Touch(1, 10, 20, CONTACT_FLAG_UPDATE) {
+		t.Error("update of a lifted contact accepted")
+	}
+
+	h.Process([]byte{0x04, 0x00, 0x06, 0x00, 0x00, 0x00})
+	if h.Ready() || h.Touch(1, 10, 20, CONTACT_FLAG_DOWN) {
+		t.Error("touch sent while suspended")
+	}
+}
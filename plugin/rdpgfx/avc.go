@@ -76,7 +76,9 @@ func parseAVC420Stream(data []byte) (*avc420Stream, error) {
 //	LC=0: both streams present; stream1 = main (YUV420), stream2 = chroma upgrade.
 //	LC=1: main stream only; stream2 is nil.
 //	LC=2: auxiliary only (chroma upgrade); stream1 is nil.
-func parseAVC444Stream(data []byte) (stream1, stream2 *avc420Stream, lc uint8, err error) {
+//
+// A malformed stream2 is logged to log and dropped.
+func parseAVC444Stream(data []byte, log *slog.Logger) (stream1, stream2 *avc420Stream, lc uint8, err error) {
 	if len(data) < 4 {
 		return nil, nil, 0, fmt.Errorf("avc444 stream too short")
 	}
@@ -98,7 +100,7 @@ func parseAVC444Stream(data []byte) (stream1, stream2 *avc420Stream, lc uint8, e
 		if cbStream1 < len(rest) {
 			stream2, err = parseAVC420Stream(rest[cbStream1:])
 			if err != nil {
-				slog.Debug("RDPGFX: AVC444 stream2 parse error (LC=0)", "err", err)
+				log.Debug("RDPGFX: AVC444 stream2 parse error (LC=0)", "err", err)
 				stream2 = nil
 				err = nil
 			}
@@ -147,7 +149,7 @@ func (g *GfxHandler) fillAVC444Stream(data []byte) (stream1, stream2 *avc420Stre
 		stream1 = &g.avcStream1
 		if cbStream1 < len(rest) {
 			if err2 := fillAVC420Stream(rest[cbStream1:], &g.avcStream2); err2 != nil {
-				slog.Debug("RDPGFX: AVC444 stream2 parse error (LC=0)", "err", err2)
+				g.log.Debug("RDPGFX: AVC444 stream2 parse error (LC=0)", "err", err2)
 			} else {
 				stream2 = &g.avcStream2
 			}
@@ -276,7 +278,7 @@ func (g *GfxHandler) decodeAVC420(data []byte, destX, destY, destW, destH int) (
 		return nil, nil, false
 	}
 	if parseErr != nil {
-		slog.Warn("RDPGFX: AVC420 parse error", "err", parseErr)
+		g.log.Warn("RDPGFX: AVC420 parse error", "err", parseErr)
 		return nil, nil, false
 	}
 	if len(stream.h264Data) == 0 {
@@ -303,23 +305,23 @@ func (g *GfxHandler) decodeAVC420(data []byte, destX, destY, destW, destH int) (
 	}
 	frame, err := g.h264dec.Decode(stream.h264Data)
 	if err != nil {
-		slog.Warn("RDPGFX: H.264 decode error", "err", err)
+		g.log.Warn("RDPGFX: H.264 decode error", "err", err)
 		return nil, nil, false
 	}
 	if frame == nil {
 		g.maybeRequestKeyframe()
 		g.maybeNotifyDecoderBroken()
-		slog.Debug("RDPGFX: H.264 decode returned nil frame (buffering?)")
+		g.log.Debug("RDPGFX: H.264 decode returned nil frame (buffering?)")
 		return nil, nil, false
 	}
 	if frame.Dropped {
-		slog.Debug("RDPGFX: AVC420 frame intentionally dropped (zero-fill)")
+		g.log.Debug("RDPGFX: AVC420 frame intentionally dropped (zero-fill)")
 		g.trackSWFallbackDroppedFrame()
 		g.maybeRequestKeyframe()
 		return nil, nil, false
 	}
-	if slog.Default().Enabled(nil, slog.LevelDebug) {
-		slog.Debug("RDPGFX: AVC420 decoded", "frameW", frame.Width, "frameH", frame.Height, "destW", destW, "destH", destH, "regions", len(stream.regions), "h264Len", len(stream.h264Data))
+	if g.log.Enabled(nil, slog.LevelDebug) {
+		g.log.Debug("RDPGFX: AVC420 decoded", "frameW", frame.Width, "frameH", frame.Height, "destW", destW, "destH", destH, "regions", len(stream.regions), "h264Len", len(stream.h264Data))
 	}
 	g.noteSuccessfulDecode()
 	decoded, pooled := cropBGRA(frame.Data, frame.Width, frame.Height, destW, destH)
@@ -351,7 +353,7 @@ func (g *GfxHandler) decodeAVC444(data []byte, destX, destY, destW, destH int) (
 		return nil, nil, false
 	}
 	if parseErr != nil {
-		slog.Warn("RDPGFX: AVC444 parse error", "err", parseErr)
+		g.log.Warn("RDPGFX: AVC444 parse error", "err", parseErr)
 		return nil, nil, false
 	}
 	if lc == 2 {
@@ -399,7 +401,7 @@ func (g *GfxHandler) decodeAVC444(data []byte, destX, destY, destW, destH int) (
 		if i420dec, ok := g.h264dec.(I420Decoder); ok {
 			frame, i420out, err = i420dec.DecodeWithI420(stream1.h264Data)
 			if err != nil {
-				slog.Warn("RDPGFX: H.264 decode error (AVC444)", "err", err)
+				g.log.Warn("RDPGFX: H.264 decode error (AVC444)", "err", err)
 				return nil, nil, false
 			}
 			if i420out != nil {
@@ -420,7 +422,7 @@ func (g *GfxHandler) decodeAVC444(data []byte, destX, destY, destW, destH int) (
 		frame, err = g.h264dec.Decode(stream1.h264Data)
 	}
 	if err != nil {
-		slog.Warn("RDPGFX: H.264 decode error (AVC444)", "err", err)
+		g.log.Warn("RDPGFX: H.264 decode error (AVC444)", "err", err)
 		return nil, nil, false
 	}
 	// Prime the aux decoder before any nil/drop checks so the stream2 IDR is
@@ -447,7 +449,7 @@ func (g *GfxHandler) decodeAVC444(data []byte, destX, destY, destW, destH int) (
 		frame = &H264Frame{Data: bgra, Width: i420out.Width, Height: i420out.Height}
 	}
 	if frame.Dropped {
-		slog.Debug("RDPGFX: AVC444 frame intentionally dropped (zero-fill)")
+		g.log.Debug("RDPGFX: AVC444 frame intentionally dropped (zero-fill)")
 		g.trackSWFallbackDroppedFrame()
 		g.maybeRequestKeyframe()
 		// Touch Y cache timestamp so LC=2 can still combine with last valid luma
@@ -474,7 +476,7 @@ func (g *GfxHandler) decodeAVC444(data []byte, destX, destY, destW, destH int) (
 					rawU = i420out.U[(py/2)*i420out.UStride+(px/2)]
 					rawV = i420out.V[(py/2)*i420out.VStride+(px/2)]
 				}
-				slog.Debug("H.264: pixel sample (LC=0 IDR frame)",
+				g.log.Debug("H.264: pixel sample (LC=0 IDR frame)",
 					"x", px, "y", py,
 					"rawY", rawY, "rawU", rawU, "rawV", rawV,
 					"fullRange", i420out != nil && i420out.FullRange,
@@ -482,8 +484,8 @@ func (g *GfxHandler) decodeAVC444(data []byte, destX, destY, destW, destH int) (
 			}
 		}
 	}
-	if slog.Default().Enabled(nil, slog.LevelDebug) {
-		slog.Debug("RDPGFX: AVC444 decoded", "frameW", frame.Width, "frameH", frame.Height,
+	if g.log.Enabled(nil, slog.LevelDebug) {
+		g.log.Debug("RDPGFX: AVC444 decoded", "frameW", frame.Width, "frameH", frame.Height,
 			"destW", destW, "destH", destH, "h264Len", len(stream1.h264Data))
 	}
 	g.noteSuccessfulDecode()
@@ -500,7 +502,7 @@ func (g *GfxHandler) decodeAVC444(data []byte, destX, destY, destW, destH int) (
 // i420 is nil.
 func (g *GfxHandler) decodeAVC420WithI420(data []byte, destX, destY, destW, destH int) (decoded []byte, i420 *H264FrameI420, regions []avcRect, pooled bool) {
 	if err := fillAVC420Stream(data, &g.avcStream1); err != nil {
-		slog.Warn("RDPGFX: AVC420 parse error", "err", err)
+		g.log.Warn("RDPGFX: AVC420 parse error", "err", err)
 		return
 	}
 	stream := &g.avcStream1
@@ -523,7 +525,7 @@ func (g *GfxHandler) decodeAVC420WithI420(data []byte, destX, destY, destW, dest
 		var i420out *H264FrameI420
 		frame, i420out, err = i420dec.DecodeWithI420(stream.h264Data)
 		if err != nil {
-			slog.Warn("RDPGFX: H.264 decode error", "err", err)
+			g.log.Warn("RDPGFX: H.264 decode error", "err", err)
 			return
 		}
 		if i420out != nil && i420out.Width >= destW && i420out.Height >= destH {
@@ -532,7 +534,7 @@ func (g *GfxHandler) decodeAVC420WithI420(data []byte, destX, destY, destW, dest
 	} else {
 		frame, err = g.h264dec.Decode(stream.h264Data)
 		if err != nil {
-			slog.Warn("RDPGFX: H.264 decode error", "err", err)
+			g.log.Warn("RDPGFX: H.264 decode error", "err", err)
 			return
 		}
 	}
@@ -541,19 +543,19 @@ func (g *GfxHandler) decodeAVC420WithI420(data []byte, destX, destY, destW, dest
 	if frame == nil && i420 == nil {
 		g.maybeRequestKeyframe()
 		g.maybeNotifyDecoderBroken()
-		slog.Debug("RDPGFX: H.264 decode returned nil frame (buffering?)")
+		g.log.Debug("RDPGFX: H.264 decode returned nil frame (buffering?)")
 		return
 	}
 	if frame != nil && frame.Dropped {
-		slog.Debug("RDPGFX: AVC420 (WithI420) frame intentionally dropped (zero-fill)")
+		g.log.Debug("RDPGFX: AVC420 (WithI420) frame intentionally dropped (zero-fill)")
 		g.trackSWFallbackDroppedFrame()
 		g.maybeRequestKeyframe()
 		return
 	}
 	g.noteSuccessfulDecode()
 	if frame != nil {
-		if slog.Default().Enabled(nil, slog.LevelDebug) {
-			slog.Debug("RDPGFX: AVC420 decoded (WithI420)", "frameW", frame.Width, "frameH", frame.Height,
+		if g.log.Enabled(nil, slog.LevelDebug) {
+			g.log.Debug("RDPGFX: AVC420 decoded (WithI420)", "frameW", frame.Width, "frameH", frame.Height,
 				"destW", destW, "destH", destH, "hasI420", i420 != nil,
 				"regions", len(stream.regions), "h264Len", len(stream.h264Data))
 		}
@@ -568,7 +570,7 @@ func (g *GfxHandler) decodeAVC420WithI420(data []byte, destX, destY, destW, dest
 // If NV12 is unavailable, decoded may contain a BGRA fallback frame.
 func (g *GfxHandler) decodeAVC420WithNV12(data []byte, destX, destY, destW, destH int) (decoded []byte, nv12 *H264FrameNV12, regions []avcRect, pooled bool) {
 	if err := fillAVC420Stream(data, &g.avcStream1); err != nil {
-		slog.Warn("RDPGFX: AVC420 parse error", "err", err)
+		g.log.Warn("RDPGFX: AVC420 parse error", "err", err)
 		return
 	}
 	stream := &g.avcStream1
@@ -596,7 +598,7 @@ func (g *GfxHandler) decodeAVC420WithNV12(data []byte, destX, destY, destW, dest
 		var nv12out *H264FrameNV12
 		frame, nv12out, err = nv12dec.DecodeWithNV12(stream.h264Data)
 		if err != nil {
-			slog.Warn("RDPGFX: H.264 decode error", "err", err)
+			g.log.Warn("RDPGFX: H.264 decode error", "err", err)
 			return
 		}
 		if nv12out != nil && nv12out.Width >= destW && nv12out.Height >= destH {
@@ -605,26 +607,26 @@ func (g *GfxHandler) decodeAVC420WithNV12(data []byte, destX, destY, destW, dest
 	} else {
 		frame, err = g.h264dec.Decode(stream.h264Data)
 		if err != nil {
-			slog.Warn("RDPGFX: H.264 decode error", "err", err)
+			g.log.Warn("RDPGFX: H.264 decode error", "err", err)
 			return
 		}
 	}
 	if frame == nil && nv12 == nil {
 		g.maybeRequestKeyframe()
 		g.maybeNotifyDecoderBroken()
-		slog.Debug("RDPGFX: H.264 decode returned nil frame (buffering?)")
+		g.log.Debug("RDPGFX: H.264 decode returned nil frame (buffering?)")
 		return
 	}
 	if frame != nil && frame.Dropped {
-		slog.Debug("RDPGFX: AVC420 (WithNV12) frame intentionally dropped (zero-fill)")
+		g.log.Debug("RDPGFX: AVC420 (WithNV12) frame intentionally dropped (zero-fill)")
 		g.trackSWFallbackDroppedFrame()
 		g.maybeRequestKeyframe()
 		return
 	}
 	g.noteSuccessfulDecode()
 	if frame != nil {
-		if slog.Default().Enabled(nil, slog.LevelDebug) {
-			slog.Debug("RDPGFX: AVC420 decoded (WithNV12)", "frameW", frame.Width, "frameH", frame.Height,
+		if g.log.Enabled(nil, slog.LevelDebug) {
+			g.log.Debug("RDPGFX: AVC420 decoded (WithNV12)", "frameW", frame.Width, "frameH", frame.Height,
 				"destW", destW, "destH", destH, "hasNV12", nv12 != nil,
 				"regions", len(stream.regions), "h264Len", len(stream.h264Data))
 		}
@@ -653,7 +655,7 @@ func (g *GfxHandler) decodeAVC444WithI420(data []byte, destX, destY, destW, dest
 		g.onH264Raw(destX, destY, destW, destH, isKF, nalData)
 	}
 	if err != nil {
-		slog.Warn("RDPGFX: AVC444 parse error", "err", err)
+		g.log.Warn("RDPGFX: AVC444 parse error", "err", err)
 		return
 	}
 	if lc == 2 {
@@ -672,7 +674,7 @@ func (g *GfxHandler) decodeAVC444WithI420(data []byte, destX, destY, destW, dest
 		var i420out *H264FrameI420
 		frame, i420out, err = i420dec.DecodeWithI420(stream1.h264Data)
 		if err != nil {
-			slog.Warn("RDPGFX: H.264 decode error (AVC444)", "err", err)
+			g.log.Warn("RDPGFX: H.264 decode error (AVC444)", "err", err)
 			return
 		}
 		if i420out != nil {
@@ -686,7 +688,7 @@ func (g *GfxHandler) decodeAVC444WithI420(data []byte, destX, destY, destW, dest
 	} else {
 		frame, err = g.h264dec.Decode(stream1.h264Data)
 		if err != nil {
-			slog.Warn("RDPGFX: H.264 decode error (AVC444)", "err", err)
+			g.log.Warn("RDPGFX: H.264 decode error (AVC444)", "err", err)
 			return
 		}
 	}
@@ -703,7 +705,7 @@ func (g *GfxHandler) decodeAVC444WithI420(data []byte, destX, destY, destW, dest
 		return
 	}
 	if frame != nil && frame.Dropped {
-		slog.Debug("RDPGFX: AVC444 (WithI420) frame intentionally dropped (zero-fill)")
+		g.log.Debug("RDPGFX: AVC444 (WithI420) frame intentionally dropped (zero-fill)")
 		g.trackSWFallbackDroppedFrame()
 		g.maybeRequestKeyframe()
 		if g.avc444YPlane.w > 0 && !g.avc444YPlane.updatedAt.IsZero() {
@@ -713,8 +715,8 @@ func (g *GfxHandler) decodeAVC444WithI420(data []byte, destX, destY, destW, dest
 	}
 	g.noteSuccessfulDecode()
 	if frame != nil {
-		if slog.Default().Enabled(nil, slog.LevelDebug) {
-			slog.Debug("RDPGFX: AVC444 decoded (WithI420)", "frameW", frame.Width, "frameH", frame.Height,
+		if g.log.Enabled(nil, slog.LevelDebug) {
+			g.log.Debug("RDPGFX: AVC444 decoded (WithI420)", "frameW", frame.Width, "frameH", frame.Height,
 				"destW", destW, "destH", destH, "hasI420", i420 != nil, "h264Len", len(stream1.h264Data))
 		}
 		decoded, pooled = cropBGRA(frame.Data, frame.Width, frame.Height, destW, destH)
@@ -741,7 +743,7 @@ func (g *GfxHandler) decodeAVC444WithNV12(data []byte, destX, destY, destW, dest
 		g.onH264Raw(destX, destY, destW, destH, isKF, nalData)
 	}
 	if err != nil {
-		slog.Warn("RDPGFX: AVC444 parse error", "err", err)
+		g.log.Warn("RDPGFX: AVC444 parse error", "err", err)
 		return
 	}
 	if lc == 2 {
@@ -766,7 +768,7 @@ func (g *GfxHandler) decodeAVC444WithNV12(data []byte, destX, destY, destW, dest
 		var nv12out *H264FrameNV12
 		frame, nv12out, err = nv12dec.DecodeWithNV12(stream1.h264Data)
 		if err != nil {
-			slog.Warn("RDPGFX: H.264 decode error (AVC444 WithNV12)", "err", err)
+			g.log.Warn("RDPGFX: H.264 decode error (AVC444 WithNV12)", "err", err)
 			return
 		}
 		if nv12out != nil && nv12out.Width >= destW && nv12out.Height >= destH {
@@ -781,7 +783,7 @@ func (g *GfxHandler) decodeAVC444WithNV12(data []byte, destX, destY, destW, dest
 	} else {
 		frame, err = g.h264dec.Decode(stream1.h264Data)
 		if err != nil {
-			slog.Warn("RDPGFX: H.264 decode error (AVC444 WithNV12 fallback)", "err", err)
+			g.log.Warn("RDPGFX: H.264 decode error (AVC444 WithNV12 fallback)", "err", err)
 			return
 		}
 	}
@@ -808,11 +810,11 @@ func (g *GfxHandler) decodeAVC444WithNV12(data []byte, destX, destY, destW, dest
 	if frame == nil && nv12 == nil {
 		g.maybeRequestKeyframe()
 		g.maybeNotifyDecoderBroken()
-		slog.Debug("RDPGFX: H.264 decode returned nil frame/nv12 (buffering?)")
+		g.log.Debug("RDPGFX: H.264 decode returned nil frame/nv12 (buffering?)")
 		return
 	}
 	if frame != nil && frame.Dropped {
-		slog.Debug("RDPGFX: AVC444 (WithNV12) frame intentionally dropped (zero-fill)")
+		g.log.Debug("RDPGFX: AVC444 (WithNV12) frame intentionally dropped (zero-fill)")
 		g.trackSWFallbackDroppedFrame()
 		g.maybeRequestKeyframe()
 		if g.avc444YPlane.w > 0 && !g.avc444YPlane.updatedAt.IsZero() {
@@ -822,8 +824,8 @@ func (g *GfxHandler) decodeAVC444WithNV12(data []byte, destX, destY, destW, dest
 	}
 	g.noteSuccessfulDecode()
 	if frame != nil {
-		if slog.Default().Enabled(nil, slog.LevelDebug) {
-			slog.Debug("RDPGFX: AVC444 decoded (WithNV12)", "frameW", frame.Width, "frameH", frame.Height,
+		if g.log.Enabled(nil, slog.LevelDebug) {
+			g.log.Debug("RDPGFX: AVC444 decoded (WithNV12)", "frameW", frame.Width, "frameH", frame.Height,
 				"destW", destW, "destH", destH, "hasNV12", nv12 != nil, "h264Len", len(stream1.h264Data))
 		}
 		decoded, pooled = cropBGRA(frame.Data, frame.Width, frame.Height, destW, destH)
@@ -1015,11 +1017,11 @@ func (g *GfxHandler) maybeCacheStream1IDR(h264Data []byte) {
 		// IDR healed the picture.
 		g.swFallbackPrimed = false
 		g.swFallbackDroppedCount = 0
-		slog.Debug("H.264: natural IDR received during SW fallback — block noise should stop",
+		g.log.Debug("H.264: natural IDR received during SW fallback — block noise should stop",
 			"idrLen", len(h264Data),
 			"framesDecoded", g.lastStream1IDRFrame)
 	} else {
-		slog.Debug("H.264: stream1 IDR cached for SW fallback priming",
+		g.log.Debug("H.264: stream1 IDR cached for SW fallback priming",
 			"idrLen", len(h264Data),
 			"framesDecoded", g.lastStream1IDRFrame)
 	}
@@ -1492,7 +1494,7 @@ func (g *GfxHandler) primeH264dec2KeepDPB(h264Data []byte) {
 	}
 	_, _, err := i420dec.DecodeWithI420(h264Data)
 	if err != nil {
-		slog.Debug("RDPGFX: LC=2 DPB prime error", "err", err)
+		g.log.Debug("RDPGFX: LC=2 DPB prime error", "err", err)
 	}
 	if g.h264dec2 != nil && g.h264dec2.IsBroken() {
 		g.h264dec2.Close()
@@ -1515,14 +1517,14 @@ func (g *GfxHandler) primeAuxDecoder(h264Data []byte) {
 		// A stream2 IDR arrived — clear any permanent-degrade state so LC=2
 		// can recover (e.g. after a server-side GOP reset much later in the session).
 		if g.lc2PermanentlyDegraded {
-			slog.Debug("H.264: stream2 IDR received after LC=2 degrade — recovering aux decoder")
+			g.log.Debug("H.264: stream2 IDR received after LC=2 degrade — recovering aux decoder")
 			g.lc2PermanentlyDegraded = false
 			g.auxDecoderNoIDRRetries = 0
 		}
 		// Recreate aux decoder on a stream2 IDR so it starts with a clean
 		// reference frame.  This avoids the rapid create/destroy cycle that
 		// can destabilise the decoder.
-		slog.Debug("H.264: recreating aux decoder on stream2 IDR")
+		g.log.Debug("H.264: recreating aux decoder on stream2 IDR")
 		g.h264dec2 = newH264DecoderSW()
 		g.stopAuxDecoderBrokenTimer() // LC=0 IDR arrived; cancel recovery timer
 		// Fall through to prime the freshly-created decoder with this IDR.
@@ -1537,7 +1539,7 @@ func (g *GfxHandler) primeAuxDecoder(h264Data []byte) {
 		// and fall through to prime the fresh decoder with this IDR.
 		// (Previously this closed and waited for a *second* IDR which often
 		// never arrived, permanently losing LC=2 quality for the session.)
-		slog.Debug("H.264: recreating broken aux decoder on stream2 IDR")
+		g.log.Debug("H.264: recreating broken aux decoder on stream2 IDR")
 		g.h264dec2.Close()
 		g.h264dec2 = newH264DecoderSW()
 		g.stopAuxDecoderBrokenTimer()
@@ -1548,13 +1550,13 @@ func (g *GfxHandler) primeAuxDecoder(h264Data []byte) {
 	}
 	_, i420primed, err := i420dec.DecodeWithI420(h264Data)
 	if err != nil {
-		slog.Debug("RDPGFX: AVC444 aux prime error", "err", err)
+		g.log.Debug("RDPGFX: AVC444 aux prime error", "err", err)
 	}
 	// The pre-flight stall detector inside DecodeWithI420 can set broken=true
 	// and return nil,nil without an error (broken state invisible to caller).
 	// Check IsBroken() after the call to catch this case.
 	if g.h264dec2.IsBroken() {
-		slog.Debug("H.264: aux decoder broken after prime, waiting for IDR to recreate")
+		g.log.Debug("H.264: aux decoder broken after prime, waiting for IDR to recreate")
 		g.h264dec2.Close()
 		g.h264dec2 = nil
 		g.startAuxDecoderBrokenTimer()
@@ -1567,7 +1569,7 @@ func (g *GfxHandler) primeAuxDecoder(h264Data []byte) {
 	// the subsequent LC=2 standalone decode.  The IDR case is excluded because
 	// near-zero output is expected during codec initialisation.
 	if !isIDR && i420primed != nil && isAuxChromaBlank(i420primed) {
-		slog.Debug("H.264: aux decoder DPB desynced during priming (P-frame blank chroma), resetting")
+		g.log.Debug("H.264: aux decoder DPB desynced during priming (P-frame blank chroma), resetting")
 		g.h264dec2.Close()
 		g.h264dec2 = nil
 		g.startAuxDecoderBrokenTimer()
@@ -1594,13 +1596,13 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 		// IDR in the "duplicate" standalone LC=2 packet is the only opportunity
 		// to initialise the aux decoder without a full reconnect.
 		if stream2 != nil && len(stream2.h264Data) > 0 && isH264Keyframe(stream2.h264Data) {
-			slog.Debug("H.264: creating aux decoder from standalone LC=2 IDR")
+			g.log.Debug("H.264: creating aux decoder from standalone LC=2 IDR")
 			g.h264dec2 = newH264DecoderSW()
 			g.stopAuxDecoderBrokenTimer()
 			g.auxDecoderNoIDRRetries = 0
 			// Fall through to the decode path below.
 		} else {
-			slog.Debug("RDPGFX: AVC444 LC=2 skipped (no aux decoder)")
+			g.log.Debug("RDPGFX: AVC444 LC=2 skipped (no aux decoder)")
 			// Arm the renegotiation timer so maybeRenegotiateCapabilities fires if
 			// no stream2 IDR arrives to prime h264dec2 within auxDecoderBrokenTimeout.
 			// This is idempotent — subsequent calls are no-ops while the timer runs.
@@ -1609,7 +1611,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 		}
 	}
 	if stream2 == nil || len(stream2.h264Data) == 0 {
-		slog.Debug("RDPGFX: AVC444 LC=2 skipped (empty aux stream)")
+		g.log.Debug("RDPGFX: AVC444 LC=2 skipped (empty aux stream)")
 		return
 	}
 	// If the main decoder is broken (e.g. HW stall or no IDR received), trigger
@@ -1620,7 +1622,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 		return
 	}
 	if g.avc444YPlane.w == 0 {
-		slog.Debug("RDPGFX: AVC444 LC=2 skipped (no cached luma)")
+		g.log.Debug("RDPGFX: AVC444 LC=2 skipped (no cached luma)")
 		// Still advance h264dec2's DPB so the next standalone LC=2 P-frame
 		// finds the correct reference.  Without this the DPB falls behind and
 		// FFmpeg outputs all-zero chroma (green tiles) on the next LC=2 decode.
@@ -1634,7 +1636,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 	// delivers a fresh frame and refreshes the cache.
 	if !g.avc444YPlane.updatedAt.IsZero() && time.Since(g.avc444YPlane.updatedAt) > avc444YStaleness {
 		age := time.Since(g.avc444YPlane.updatedAt).Round(time.Millisecond)
-		slog.Debug("RDPGFX: AVC444 LC=2 skipped (Y cache stale, main decoder likely stalling)",
+		g.log.Debug("RDPGFX: AVC444 LC=2 skipped (Y cache stale, main decoder likely stalling)",
 			"age", age)
 		// Advance h264dec2's DPB even though we skip the combine, so that it
 		// stays in sync with the stream2 sequence and recovers cleanly once the
@@ -1659,12 +1661,12 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 	}
 	i420dec, ok := g.h264dec2.(I420Decoder)
 	if !ok {
-		slog.Debug("RDPGFX: AVC444 LC=2 skipped (aux decoder lacks I420 support)")
+		g.log.Debug("RDPGFX: AVC444 LC=2 skipped (aux decoder lacks I420 support)")
 		return
 	}
 	_, i420aux, err := i420dec.DecodeWithI420(stream2.h264Data)
 	if err != nil {
-		slog.Warn("RDPGFX: AVC444 LC=2 aux decode error", "err", err)
+		g.log.Warn("RDPGFX: AVC444 LC=2 aux decode error", "err", err)
 		if g.h264dec2.IsBroken() {
 			g.h264dec2.Close()
 			g.h264dec2 = nil
@@ -1673,7 +1675,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 		return
 	}
 	if i420aux == nil {
-		slog.Debug("RDPGFX: AVC444 LC=2 aux decode buffering",
+		g.log.Debug("RDPGFX: AVC444 LC=2 aux decode buffering",
 			"h264Len", len(stream2.h264Data),
 			"firstNAL", firstNALType(stream2.h264Data),
 			"isIDR", isH264Keyframe(stream2.h264Data))
@@ -1682,7 +1684,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 		// decoder will be recreated by primeAuxDecoder when the next stream2
 		// IDR arrives, avoiding a rapid VT session create/destroy cycle.
 		if g.h264dec2 != nil && g.h264dec2.IsBroken() {
-			slog.Debug("H.264: aux decoder broken during LC=2 decode, waiting for IDR to recreate")
+			g.log.Debug("H.264: aux decoder broken during LC=2 decode, waiting for IDR to recreate")
 			g.h264dec2.Close()
 			g.h264dec2 = nil
 			// Do NOT call maybeRequestKeyframe() here: ForceRefresh only delivers
@@ -1705,7 +1707,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 	// h264dec2 reset decision below.
 	stream2IsIDR := isH264Keyframe(stream2.h264Data)
 	if isAuxChromaBlank(i420aux) {
-		slog.Debug("RDPGFX: AVC444 LC=2 skipped (stream2 chroma invalid: near-zero or near-saturated)")
+		g.log.Debug("RDPGFX: AVC444 LC=2 skipped (stream2 chroma invalid: near-zero or near-saturated)")
 		// For P-frames, corrupt chroma means h264dec2's DPB has diverged from
 		// the server's reference (typically from a dropped LC=0 PDU).  Decoding
 		// further P-frames against this wrong DPB would produce equally wrong
@@ -1715,7 +1717,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 		// IDRs are excluded because near-zero chroma is expected at GOP start
 		// during stream2 codec initialisation and should not trigger a reset.
 		if !stream2IsIDR && g.h264dec2 != nil {
-			slog.Debug("H.264: aux decoder reset after P-frame blank chroma (DPB cascade prevention)")
+			g.log.Debug("H.264: aux decoder reset after P-frame blank chroma (DPB cascade prevention)")
 			g.h264dec2.Close()
 			g.h264dec2 = nil
 			g.startAuxDecoderBrokenTimer()
@@ -1733,11 +1735,11 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 	yp := &g.avc444YPlane
 	if stream2IsIDR && g.avc444IDRYPlane.w > 0 {
 		yp = &g.avc444IDRYPlane
-		slog.Debug("RDPGFX: AVC444 LC=2 IDR combine using IDR luma snapshot")
+		g.log.Debug("RDPGFX: AVC444 LC=2 IDR combine using IDR luma snapshot")
 	}
 	w, h := yp.w, yp.h
 	if i420aux.Width < w || i420aux.Height < h {
-		slog.Debug("RDPGFX: AVC444 LC=2 aux frame too small",
+		g.log.Debug("RDPGFX: AVC444 LC=2 aux frame too small",
 			"auxW", i420aux.Width, "auxH", i420aux.Height, "lumaW", w, "lumaH", h)
 		return
 	}
@@ -1746,7 +1748,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 	// with any stream2 chroma produces green/pink artefacts on the even-column,
 	// even-row pixels.  Skip the combine and ask for a fresh IDR.
 	if isAVC444YPlaneChromaBlank(yp) {
-		slog.Debug("RDPGFX: AVC444 LC=2 skipped (cached stream1 chroma blank/corrupt)")
+		g.log.Debug("RDPGFX: AVC444 LC=2 skipped (cached stream1 chroma blank/corrupt)")
 		g.primeH264dec2KeepDPB(stream2.h264Data)
 		g.maybeRequestKeyframe()
 		return
@@ -1827,7 +1829,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 				actualCr = i420aux.V[uvRow*i420aux.VStride+quarterW+k2]
 			}
 		}
-		slog.Debug("H.264: pixel sample (LC=2 combine)",
+		g.log.Debug("H.264: pixel sample (LC=2 combine)",
 			"x", px, "y", py,
 			"area", barea,
 			"isIDR", stream2IsIDR,
@@ -1880,7 +1882,7 @@ func (g *GfxHandler) decodeAVC444LC2(stream2 *avc420Stream, destW, destH int) (d
 		releaseBitmapBuf(combined)
 	}
 	regions = stream2.regions
-	slog.Debug("RDPGFX: AVC444 LC=2 decoded", "w", w, "h", h,
+	g.log.Debug("RDPGFX: AVC444 LC=2 decoded", "w", w, "h", h,
 		"destW", destW, "destH", destH, "h264Len", len(stream2.h264Data))
 	g.noteSuccessfulDecode()
 	return
@@ -1962,7 +1964,7 @@ func (g *GfxHandler) maybeNotifyDecoderBroken() {
 		// unnecessarily — Ubuntu GNOME Remote Desktop responds to ForceRefresh
 		// with DEACTIVATEALLPDU followed by a disconnect.
 		// Disable the H.264 decoder so the watchdog can never fire again.
-		slog.Debug("H.264: watchdog fired but no H.264 data received — server uses non-H.264 codec, disabling H.264 decoder")
+		g.log.Debug("H.264: watchdog fired but no H.264 data received — server uses non-H.264 codec, disabling H.264 decoder")
 		g.h264dec.Close()
 		g.h264dec = nil
 		return
@@ -1988,13 +1990,13 @@ func (g *GfxHandler) maybeNotifyDecoderBroken() {
 		const softResetLimitNoIDR = 1
 		if !g.usingSWFallback && g.noIDRSoftResetCount < softResetLimitNoIDR {
 			g.noIDRSoftResetCount++
-			slog.Debug("H.264: soft decoder reset (no-IDR)",
+			g.log.Debug("H.264: soft decoder reset (no-IDR)",
 				"attempt", g.noIDRSoftResetCount, "limit", softResetLimitNoIDR,
 				"reason", reason.String())
 			g.h264dec.Close()
 			g.h264dec = newH264DecoderWithWatchdog(g.watchdogCh)
 			if g.h264dec2 != nil && g.h264dec2.IsBroken() {
-				slog.Debug("H.264: aux decoder also broken on soft reset, waiting for IDR to recreate")
+				g.log.Debug("H.264: aux decoder also broken on soft reset, waiting for IDR to recreate")
 				g.h264dec2.Close()
 				g.h264dec2 = nil
 			}
@@ -2002,7 +2004,7 @@ func (g *GfxHandler) maybeNotifyDecoderBroken() {
 			g.maybeRequestKeyframe()
 			return
 		}
-		slog.Debug("H.264: escalating to reconnect after no-IDR soft reset exhausted",
+		g.log.Debug("H.264: escalating to reconnect after no-IDR soft reset exhausted",
 			"reason", reason.String())
 		g.decoderBrokenNotified = true
 		if g.onDecoderBroken != nil {
@@ -2017,11 +2019,11 @@ func (g *GfxHandler) maybeNotifyDecoderBroken() {
 			// Even if a proactive ForceRefresh was already sent, the server
 			// typically delivers the IDR within ~1-2 s; the SW decoder will
 			// pick it up and the session continues without a full reconnect.
-			slog.Debug("H.264: HW stall — falling back to software decoding",
+			g.log.Debug("H.264: HW stall — falling back to software decoding",
 				"attempt", g.softResetCount, "limit", softResetLimit)
 			g.usingSWFallback = true
 		} else {
-			slog.Debug("H.264: soft decoder reset",
+			g.log.Debug("H.264: soft decoder reset",
 				"attempt", g.softResetCount, "limit", softResetLimit,
 				"reason", reason.String())
 		}
@@ -2051,7 +2053,7 @@ func (g *GfxHandler) maybeNotifyDecoderBroken() {
 		idrFrameAge := g.framesDecoded.Load() - g.lastStream1IDRFrame
 		if g.usingSWFallback && len(g.lastStream1IDR) > 0 &&
 			!g.lastStream1IDRTime.IsZero() {
-			slog.Debug("H.264: priming SW fallback with cached stream1 IDR to avoid IDR wait",
+			g.log.Debug("H.264: priming SW fallback with cached stream1 IDR to avoid IDR wait",
 				"idrLen", len(g.lastStream1IDR),
 				"idrAge", idrAge.Round(time.Millisecond),
 				"idrFrameAge", idrFrameAge,
@@ -2060,11 +2062,11 @@ func (g *GfxHandler) maybeNotifyDecoderBroken() {
 			g.swFallbackDroppedCount = 0
 			g.swFallbackFirstDropTime = time.Time{}
 			if _, err := g.h264dec.Decode(g.lastStream1IDR); err != nil {
-				slog.Debug("H.264: cached IDR prime failed, watchdog will wait for natural IDR",
+				g.log.Debug("H.264: cached IDR prime failed, watchdog will wait for natural IDR",
 					"err", err)
 			}
 		} else if g.usingSWFallback {
-			slog.Debug("H.264: no cached stream1 IDR to prime SW fallback — watchdog will wait for a natural IDR",
+			g.log.Debug("H.264: no cached stream1 IDR to prime SW fallback — watchdog will wait for a natural IDR",
 				"idrAge", idrAge.Round(time.Millisecond),
 				"idrFrameAge", idrFrameAge,
 			)
@@ -2075,7 +2077,7 @@ func (g *GfxHandler) maybeNotifyDecoderBroken() {
 		// Always keep avc444YPlane so that LC=2 frames can continue to display
 		// stale-but-reasonable content during recovery.
 		if g.h264dec2 != nil && g.h264dec2.IsBroken() {
-			slog.Debug("H.264: aux decoder also broken on soft reset, waiting for IDR to recreate")
+			g.log.Debug("H.264: aux decoder also broken on soft reset, waiting for IDR to recreate")
 			g.h264dec2.Close()
 			g.h264dec2 = nil
 		}
@@ -2122,7 +2124,7 @@ func (g *GfxHandler) trackSWFallbackDroppedFrame() {
 	if g.swFallbackDroppedCount >= swFallbackDropLimit &&
 		!g.swFallbackFirstDropTime.IsZero() &&
 		time.Since(g.swFallbackFirstDropTime) >= swFallbackResyncTimeout {
-		slog.Warn("H.264: SW fallback stale IDR prime did not resync in time, escalating to reconnect",
+		g.log.Warn("H.264: SW fallback stale IDR prime did not resync in time, escalating to reconnect",
 			"dropped", g.swFallbackDroppedCount,
 			"persistedFor", time.Since(g.swFallbackFirstDropTime).Round(time.Millisecond))
 		g.swFallbackPrimed = false
@@ -2242,7 +2244,7 @@ func (g *GfxHandler) blitAndEmitAVCRegions(s *surface, left, top, frameW, frameH
 			copy(s.data[dstOff:dstOff+rowBytes],
 				decoded[srcOff:srcOff+rowBytes])
 		}
-		if !s.mapped || g.onBitmap == nil {
+		if !s.mapped || !g.hasOutput() {
 			releaseBitmapBuf(region)
 			continue
 		}
@@ -0,0 +1,80 @@
+package rdpgfx
+
+// AVCRegion is a rectangle of an AVC420 bitmap stream that the frame
+// updates, with its encoding quality (MS-RDPEGFX 2.2.4.4.1).  The
+// rectangle is relative to the destination of the frame; Right and
+// Bottom are exclusive.
+type AVCRegion struct {
+	Left, Top, Right, Bottom uint16
+	// QP is the H.264 quantization parameter, 0 to 51.
+	QP uint8
+	// Progressive is set when the region is progressively refined.
+	Progressive bool
+	// Quality is the encoding quality level, 0 to 100.
+	Quality uint8
+}
+
+// H264NAL is one AVC420 frame as received: the Annex B NAL units and the
+// metadata needed to place it on the remote desktop.
+type H264NAL struct {
+	SurfaceID uint16
+	// DestX and DestY are the desktop coordinates of the frame, Width and
+	// Height its size.
+	DestX, DestY  int
+	Width, Height int
+	// Keyframe is set when the NAL units start with an IDR picture.
+	Keyframe bool
+	// Regions lists the areas that changed; the rest of the frame equals
+	// the previous one.
+	Regions []AVCRegion
+	// Data holds the Annex B NAL units.  The callback owns it.
+	Data []byte
+}
+
+// SetH264NALCallback makes the handler pass AVC420 frames to fn instead of
+// decoding them, for consumers that decode H.264 themselves (typically in
+// hardware).  While set, only AVC420 is advertised, so the server never
+// sends AVC444 streams, and AVC frames produce no bitmap updates.
+func (g *GfxHandler) SetH264NALCallback(fn func(H264NAL)) {
+	g.onH264NAL = fn
+}
+
+// parseAVC420Regions returns the region rectangles and quality values of
+// an RDPGFX_AVC420_BITMAP_STREAM, and the NAL units that follow them.
+func parseAVC420Regions(data []byte) ([]AVCRegion, []byte, error) {
+	var stream avc420Stream
+	if err := fillAVC420Stream(data, &stream); err != nil {
+		return nil, nil, err
+	}
+	regions := make([]AVCRegion, len(stream.regions))
+	quant := data[4+len(regions)*8:]
+	for i, r := range stream.regions {
+		regions[i] = AVCRegion{
+			Left: r.left, Top: r.top, Right: r.right, Bottom: r.bottom,
+			QP:          quant[i*2] & 0x3F,
+			Progressive: quant[i*2]&0x80 != 0,
+			Quality:     quant[i*2+1],
+		}
+	}
+	return regions, stream.h264Data, nil
+}
+
+// forwardAVC420 hands an AVC420 bitmap stream to the NAL callback.
+func (g *GfxHandler) forwardAVC420(surfId uint16, destX, destY, w, h int, data []byte) {
+	regions, nal, err := parseAVC420Regions(data)
+	if err != nil {
+		g.log.Warn("RDPGFX: AVC420 parse error", "err", err)
+		return
+	}
+	if len(nal) == 0 {
+		return
+	}
+	g.onH264NAL(H264NAL{
+		SurfaceID: surfId,
+		DestX:     destX, DestY: destY,
+		Width: w, Height: h,
+		Keyframe: isH264Keyframe(nal),
+		Regions:  regions,
+		Data:     append([]byte(nil), nal...),
+	})
+}
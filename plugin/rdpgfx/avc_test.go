@@ -31,3 +31,28 @@ func TestParseAVC420Stream(t *testing.T) {
 		t.Fatalf("unexpected h264 payload: %v", stream.h264Data)
 	}
 }
+
+func TestAVC420NALCallback(t *testing.T) {
+	g := NewGfxHandler(nil)
+	defer g.Close()
+	var got []H264NAL
+	g.SetH264NALCallback(func(n H264NAL) { got = append(got, n) })
+	g.dispatchDecode(cmdidCreateSurface, le(uint16(1), uint16(256), uint16(256), uint8(0x20)), false)
+	g.dispatchDecode(cmdidMapSurfaceToOutput, le(uint16(1), uint16(0), uint32(100), uint32(50)), false)
+
+	stream := le(uint32(1), uint16(10), uint16(20), uint16(110), uint16(220), uint8(0x41), uint8(0x7F),
+		uint8(0), uint8(0), uint8(1), uint8(0x65))
+	wts := le(uint16(1), codecAVC420, uint8(0x20), uint16(0), uint16(0), uint16(128), uint16(128), uint32(len(stream)))
+	g.dispatchDecode(cmdidWireToSurface1, append(wts, stream...), false)
+
+	if len(got) != 1 {
+		t.Fatalf("got %d NAL callbacks, want 1", len(got))
+	}
+	n := got[0]
+	if n.DestX != 100 || n.DestY != 50 || n.Width != 128 || !n.Keyframe || len(n.Data) != 4 {
+		t.Errorf("NAL = %+v", n)
+	}
+	if want := (AVCRegion{Left: 10, Top: 20, Right: 110, Bottom: 220, QP: 1, Quality: 0x7F}); len(n.Regions) != 1 || n.Regions[0] != want {
+		t.Errorf("regions = %+v, want %+v", n.Regions, want)
+	}
+}
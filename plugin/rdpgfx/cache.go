@@ -0,0 +1,219 @@
+package rdpgfx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// maxCacheSlots is the number of bitmap cache slots of a session, or
+	// maxCacheSlotsSmall with capFlagSmallCache (MS-RDPEGFX 2.2.2.6).
+	maxCacheSlots      = 25600
+	maxCacheSlotsSmall = 4096
+	// maxCacheImportEntries is RDPGFX_CACHE_ENTRY_MAX_COUNT, the most
+	// entries one Cache Import Offer may carry.
+	maxCacheImportEntries = 5462
+)
+
+// PersistentCache keeps the bitmaps the server stored with Surface to
+// Cache under their 64-bit cache keys.  The next session offers them in
+// a Cache Import Offer, and the server fills the slots it accepts from
+// here instead of resending the pixels (MS-RDPEGFX 3.2.5.2).
+type PersistentCache struct {
+	mu      sync.Mutex
+	entries map[uint64]cacheEntry
+}
+
+func NewPersistentCache() *PersistentCache {
+	return &PersistentCache{entries: make(map[uint64]cacheEntry)}
+}
+
+func (c *PersistentCache) put(e cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[e.key]; !ok && len(c.entries) >= maxCacheImportEntries {
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[e.key] = e
+}
+
+func (c *PersistentCache) get(key uint64) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+// keys returns the cache keys to offer, at most maxCacheImportEntries.
+func (c *PersistentCache) keys() []uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]uint64, 0, min(len(c.entries), maxCacheImportEntries))
+	for k := range c.entries {
+		if len(keys) == maxCacheImportEntries {
+			break
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Len returns the number of cached bitmaps.
+func (c *PersistentCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+var persistentCacheMagic = []byte("GRDPGFX1")
+
+// Save writes the cached bitmaps to w.
+func (c *PersistentCache) Save(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	bw.Write(persistentCacheMagic)
+	var hdr [16]byte
+	for _, e := range c.entries {
+		binary.LittleEndian.PutUint64(hdr[0:], e.key)
+		binary.LittleEndian.PutUint16(hdr[8:], uint16(e.width))
+		binary.LittleEndian.PutUint16(hdr[10:], uint16(e.height))
+		binary.LittleEndian.PutUint32(hdr[12:], uint32(len(e.data)))
+		bw.Write(hdr[:])
+		bw.Write(e.data)
+	}
+	return bw.Flush()
+}
+
+// Load adds the bitmaps written by Save to the cache.
+func (c *PersistentCache) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(persistentCacheMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != string(persistentCacheMagic) {
+		return errors.New("rdpgfx cache: bad file header")
+	}
+	var hdr [16]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("rdpgfx cache: %w", err)
+		}
+		e := cacheEntry{
+			key:    binary.LittleEndian.Uint64(hdr[0:]),
+			width:  int(binary.LittleEndian.Uint16(hdr[8:])),
+			height: int(binary.LittleEndian.Uint16(hdr[10:])),
+		}
+		n := int(binary.LittleEndian.Uint32(hdr[12:]))
+		if n != e.width*e.height*4 {
+			return fmt.Errorf("rdpgfx cache: bad entry length %d", n)
+		}
+		e.data = make([]byte, n)
+		if _, err := io.ReadFull(br, e.data); err != nil {
+			return fmt.Errorf("rdpgfx cache: %w", err)
+		}
+		c.put(e)
+	}
+}
+
+// LoadPersistentCacheFile returns the cache saved in path, or an empty
+// cache when the file does not exist.
+func LoadPersistentCacheFile(path string) (*PersistentCache, error) {
+	c := NewPersistentCache()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return c, err
+	}
+	defer f.Close()
+	return c, c.Load(f)
+}
+
+// SaveFile writes the cached bitmaps to path.
+func (c *PersistentCache) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".gfxcache-*")
+	if err != nil {
+		return err
+	}
+	if err = c.Save(f); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// SetPersistentCache makes the handler offer the bitmaps of c to the
+// server after capability negotiation and store the bitmaps it caches
+// in c.
+func (g *GfxHandler) SetPersistentCache(c *PersistentCache) {
+	g.persistent = c
+}
+
+// sendCacheImportOffer sends RDPGFX_CACHE_IMPORT_OFFER_PDU
+// (MS-RDPEGFX 2.2.2.16) for the persistent cache.
+func (g *GfxHandler) sendCacheImportOffer() {
+	g.importOffer = nil
+	if g.persistent == nil {
+		return
+	}
+	keys := g.persistent.keys()
+	if len(keys) == 0 {
+		return
+	}
+	p := make([]byte, 2, 2+len(keys)*12)
+	binary.LittleEndian.PutUint16(p, uint16(len(keys)))
+	for _, k := range keys {
+		e, _ := g.persistent.get(k)
+		p = binary.LittleEndian.AppendUint64(p, k)
+		p = binary.LittleEndian.AppendUint32(p, uint32(len(e.data)))
+	}
+	g.importOffer = keys
+	g.log.Debug("RDPGFX: CACHE_IMPORT_OFFER", "entries", len(keys))
+	g.sendPdu(cmdidCacheImportOffer, p)
+}
+
+// onCacheImportReply handles RDPGFX_CACHE_IMPORT_REPLY_PDU (MS-RDPEGFX
+// 2.2.2.17): cacheSlots[i] is the slot the server assigned to the i-th
+// offered entry, 0 if it refused it.
+func (g *GfxHandler) onCacheImportReply(data []byte) {
+	if len(data) < 2 || g.persistent == nil {
+		return
+	}
+	n := int(binary.LittleEndian.Uint16(data))
+	imported := 0
+	for i := 0; i < n && i < len(g.importOffer) && 2+i*2+2 <= len(data); i++ {
+		slot := binary.LittleEndian.Uint16(data[2+i*2:])
+		if slot == 0 || int(slot) > g.maxCacheSlots() {
+			continue
+		}
+		if e, ok := g.persistent.get(g.importOffer[i]); ok && g.putCacheEntry(slot, e) {
+			imported++
+		}
+	}
+	g.log.Debug("RDPGFX: CACHE_IMPORT_REPLY", "imported", imported)
+	g.importOffer = nil
+}
+
+func (g *GfxHandler) maxCacheSlots() int {
+	if g.capsFlags&capFlagSmallCache != 0 {
+		return maxCacheSlotsSmall
+	}
+	return maxCacheSlots
+}
@@ -0,0 +1,107 @@
+package rdpgfx
+
+import (
+	"encoding/binary"
+	"image"
+	"time"
+)
+
+// Frame is the graphics output as composited at an End Frame PDU: every
+// update the server drew between Start Frame and End Frame is applied.
+// H.264 frames handed to the I420 or NV12 callback are not included.
+type Frame struct {
+	ID uint32
+	// Image is the whole output.  It is reused for the next frame, so
+	// it is only valid for the duration of the callback.
+	Image *image.RGBA
+	// Damage is the area that changed since the previous frame.
+	Damage image.Rectangle
+}
+
+// SetFrameCallback registers fn to receive each composited frame.
+func (g *GfxHandler) SetFrameCallback(fn func(Frame)) {
+	g.onFrame = fn
+}
+
+// Frames returns the number of frames the server ended so far.  It is
+// safe to call from any goroutine.
+func (g *GfxHandler) Frames() uint64 {
+	return g.frames.Load()
+}
+
+// DecodeTime returns the time spent decoding the surface commands so far,
+// not counting the onBitmap callback.  It is safe to call from any
+// goroutine.
+func (g *GfxHandler) DecodeTime() time.Duration {
+	return time.Duration(g.decodeTime.Load())
+}
+
+// hasOutput reports whether decoded updates are delivered anywhere.
+func (g *GfxHandler) hasOutput() bool {
+	return g.onBitmap != nil || g.onFrame != nil
+}
+
+// onStartFrame handles RDPGFX_START_FRAME_PDU (MS-RDPEGFX 2.2.2.11).
+func (g *GfxHandler) onStartFrame(data []byte) {
+	if len(data) < 8 {
+		return
+	}
+	g.frameID = binary.LittleEndian.Uint32(data[4:])
+}
+
+// resetOutput starts a new, black output of the given size.
+func (g *GfxHandler) resetOutput(width, height int) {
+	g.outputWidth, g.outputHeight = width, height
+	g.frame = nil
+	g.damage = image.Rectangle{}
+}
+
+// composite draws BGRA updates into the frame image.
+func (g *GfxHandler) composite(updates []BitmapUpdate) {
+	if g.onFrame == nil {
+		return
+	}
+	if g.frame == nil {
+		g.frame = image.NewRGBA(image.Rect(0, 0, g.outputWidth, g.outputHeight))
+	}
+	for i := range updates {
+		u := &updates[i]
+		r := image.Rect(u.DestLeft, u.DestTop, u.DestLeft+u.Width, u.DestTop+u.Height).Intersect(g.frame.Rect)
+		if r.Empty() {
+			continue
+		}
+		stride := u.Width * 4
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			src := (y-u.DestTop)*stride + (r.Min.X-u.DestLeft)*4
+			n := r.Dx() * 4
+			if src+n > len(u.Data) {
+				break
+			}
+			dst := g.frame.Pix[g.frame.PixOffset(r.Min.X, y):][:n]
+			bgraToRGBA(dst, u.Data[src:src+n])
+		}
+		g.damage = g.damage.Union(r)
+	}
+}
+
+// onFrameEnd hands the composited frame to the frame callback.
+func (g *GfxHandler) onFrameEnd(frameID uint32) {
+	g.frames.Add(1)
+	if frameID != g.frameID {
+		g.log.Debug("RDPGFX: END_FRAME without START_FRAME", "frameId", frameID, "started", g.frameID)
+	}
+	if g.onFrame == nil {
+		return
+	}
+	if g.frame == nil {
+		g.frame = image.NewRGBA(image.Rect(0, 0, g.outputWidth, g.outputHeight))
+	}
+	g.onFrame(Frame{ID: frameID, Image: g.frame, Damage: g.damage})
+	g.damage = image.Rectangle{}
+}
+
+func bgraToRGBA(dst, src []byte) {
+	for i := 0; i+4 <= len(src); i += 4 {
+		dst[i], dst[i+1], dst[i+2], dst[i+3] = src[i+2], src[i+1], src[i], 0xFF
+	}
+}
@@ -0,0 +1,124 @@
+package rdpgfx
+
+import (
+	"encoding/binary"
+	"image"
+	"testing"
+
+	"github.com/nakagami/grdp/core"
+)
+
+func le(vals ...any) []byte {
+	var b []byte
+	for _, v := range vals {
+		switch v := v.(type) {
+		case uint16:
+			b = binary.LittleEndian.AppendUint16(b, v)
+		case uint32:
+			b = binary.LittleEndian.AppendUint32(b, v)
+		case uint64:
+			b = binary.LittleEndian.AppendUint64(b, v)
+		case uint8:
+			b = append(b, v)
+		}
+	}
+	return b
+}
+
+func TestFrameCompositeAndCache(t *testing.T) {
+	g := NewGfxHandler(nil)
+	defer g.Close()
+	g.persistent = NewPersistentCache()
+	var frames []Frame
+	g.SetFrameCallback(func(f Frame) { frames = append(frames, f) })
+
+	g.dispatchDecode(cmdidResetGraphics, le(uint32(8), uint32(4), uint32(0)), false)
+	g.dispatchDecode(cmdidCreateSurface, le(uint16(1), uint16(4), uint16(4), uint8(0x20)), false)
+	g.dispatchDecode(cmdidMapSurfaceToOutput, le(uint16(1), uint16(0), uint32(4), uint32(0)), false)
+	copy(g.surfaces[1].data, []byte{0, 0, 0xFF, 0xFF}) // red at (0,0)
+
+	g.dispatchDecode(cmdidStartFrame, le(uint32(0), uint32(7)), false)
+	g.dispatchDecode(cmdidSurfaceToCache, le(uint16(1), uint64(0xABCD), uint16(1), uint16(0), uint16(0), uint16(2), uint16(2)), false)
+	g.dispatchDecode(cmdidCacheToSurface, le(uint16(1), uint16(1), uint16(1), uint16(2), uint16(2)), false)
+	g.dispatchDecode(cmdidEndFrame, le(uint32(7)), false)
+
+	if len(frames) != 1 || frames[0].ID != 7 {
+		t.Fatalf("frames = %+v", frames)
+	}
+	if want := image.Rect(6, 2, 8, 4); frames[0].Damage != want {
+		t.Errorf("damage = %v, want %v", frames[0].Damage, want)
+	}
+	if c := frames[0].Image.RGBAAt(6, 2); c.R != 0xFF || c.B != 0 {
+		t.Errorf("pixel (6,2) = %v", c)
+	}
+	if g.persistent.Len() != 1 {
+		t.Fatalf("persistent cache has %d entries", g.persistent.Len())
+	}
+
+	// The next session offers the cached bitmap and loads it into the
+	// slot the server assigns.
+	next := NewGfxHandler(nil)
+	defer next.Close()
+	next.persistent = g.persistent
+	var sent []byte
+	next.SetSendFunc(func(b []byte) { sent = append([]byte(nil), b...) })
+	next.dispatchDecode(cmdidCapsConfirm, le(capVersion10, uint32(4), uint32(0)), false)
+	if want := le(cmdidCacheImportOffer, uint16(0), uint32(headerSize+14), uint16(1), uint64(0xABCD), uint32(16)); string(sent) != string(want) {
+		t.Fatalf("offer = % x, want % x", sent, want)
+	}
+	next.dispatchDecode(cmdidCacheImportReply, le(uint16(1), uint16(5)), false)
+	if e, ok := next.cacheEntries[5]; !ok || e.width != 2 || e.data[2] != 0xFF {
+		t.Errorf("imported slot 5 = %+v", e)
+	}
+}
+
+func FuzzZgfxDecompress(f *testing.F) {
+	f.Add([]byte{0x00, 0x00})
+	f.Add([]byte{0x8F, 0x24, 0x31, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		z := newZgfxContext()
+		z.Decompress(data, nil)
+		z.Decompress(data, nil)
+	})
+}
+
+func FuzzClearCodecDecode(f *testing.F) {
+	f.Add(append(le(uint32(4), uint32(0), uint32(0)), 0xFF, 0x00, 0x00, 4))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		newClearCodecCtx().decode(data, 24, 16)
+	})
+}
+
+func TestSurfaceBudget(t *testing.T) {
+	g := NewGfxHandler(nil)
+	defer g.Close()
+	b := core.NewBudget(64*64*4 + 32*32*4 + 100)
+	g.SetBudget(b)
+
+	surface := func(id, w, h uint16) []byte { return le(id, w, h, uint8(0x20)) }
+	g.dispatchDecode(cmdidCreateSurface, surface(1, 64, 64), false)
+	g.dispatchDecode(cmdidCreateSurface, surface(2, 64, 64), false)
+	if _, ok := g.surfaces[2]; ok || b.Used() != 64*64*4 {
+		t.Fatalf("second surface created past the budget, %d bytes used", b.Used())
+	}
+	g.dispatchDecode(cmdidCreateSurface, surface(3, 40000, 1), false)
+	if _, ok := g.surfaces[3]; ok {
+		t.Fatal("surface wider than MaxBitmapDimension created")
+	}
+
+	// a cache entry takes from the same budget until it is evicted
+	g.dispatchDecode(cmdidSurfaceToCache, le(uint16(1), uint64(1), uint16(1), uint16(0), uint16(0), uint16(32), uint16(32)), false)
+	g.dispatchDecode(cmdidSurfaceToCache, le(uint16(1), uint64(2), uint16(2), uint16(0), uint16(0), uint16(32), uint16(32)), false)
+	if len(g.cacheEntries) != 1 {
+		t.Fatalf("%d cache entries", len(g.cacheEntries))
+	}
+	g.dispatchDecode(cmdidEvictCacheEntry, le(uint16(1)), false)
+	g.dispatchDecode(cmdidDeleteSurface, le(uint16(1)), false)
+	if b.Used() != 0 {
+		t.Fatalf("%d bytes still used", b.Used())
+	}
+	g.dispatchDecode(cmdidCreateSurface, surface(2, 64, 64), false)
+	if _, ok := g.surfaces[2]; !ok {
+		t.Error("surface refused after the first was deleted")
+	}
+}
@@ -2,11 +2,13 @@ package rdpgfx
 
 import (
 	"encoding/binary"
+	"image"
 	"log/slog"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/nakagami/grdp/core"
 	"github.com/nakagami/grdp/plugin"
 )
 
@@ -141,12 +143,22 @@ func releaseBitmapBuf(b []byte) {
 	bitmapBufPool.Put(b[:cap(b)])
 }
 
+// output composites updates and hands them to the onBitmap callback.
+func (g *GfxHandler) output(updates []BitmapUpdate) {
+	start := time.Now()
+	g.composite(updates)
+	if g.onBitmap != nil {
+		g.onBitmap(updates)
+	}
+	g.outputTime += time.Since(start)
+}
+
 // emitAndReleaseUpdates calls the onBitmap callback and then returns the
 // pooled Data buffers of the supplied updates back to bitmapBufPool.  All
 // updates passed in must have Data acquired via acquireBitmapBuf.
 func (g *GfxHandler) emitAndReleaseUpdates(updates []BitmapUpdate) {
-	if g.onBitmap != nil && len(updates) > 0 {
-		g.onBitmap(updates)
+	if g.hasOutput() && len(updates) > 0 {
+		g.output(updates)
 	}
 	for i := range updates {
 		releaseBitmapBuf(updates[i].Data)
@@ -194,6 +206,7 @@ func newClearCodecCtx() *clearCodecCtx {
 type cacheEntry struct {
 	data          []byte // BGRA pixel data
 	width, height int
+	key           uint64 // cacheKey of the Surface to Cache PDU
 }
 
 // GfxHandler implements the RDPGFX (MS-RDPEGFX) protocol.
@@ -205,6 +218,26 @@ type GfxHandler struct {
 	rfx          *rfxDecoder
 	progressive  *rfxProgressiveDecoder
 	h264dec      H264Decoder
+	// persistent, when set, receives the cached bitmaps and supplies the
+	// Cache Import Offer; importOffer holds the keys last offered.
+	persistent  *PersistentCache
+	importOffer []uint64
+	// budget holds the pixels of the surfaces and the cache entries.
+	budget *core.Budget
+	// capsFlags are the flags of the confirmed capability set.
+	capsFlags uint32
+	// onFrame receives the output composited into frame at each End
+	// Frame; damage is the area drawn since the previous one.
+	onFrame                   func(Frame)
+	frame                     *image.RGBA
+	damage                    image.Rectangle
+	outputWidth, outputHeight int
+	frameID                   uint32
+	// frames counts the End Frames; decodeTime is the time the surface
+	// commands took less outputTime, their time in composite and onBitmap.
+	frames     atomic.Uint64
+	decodeTime atomic.Int64
+	outputTime time.Duration
 	// h264dec2 is the auxiliary H.264 decoder used for AVC444v2 LC=2 chroma-upgrade
 	// frames.  It decodes stream2, which carries chroma values for positions not
 	// covered by stream1's 4:2:0 quantiser.  The decoded I420 planes are combined
@@ -245,6 +278,9 @@ type GfxHandler struct {
 	// the RDP session to create a fresh decoder.
 	onDecoderBroken       func()
 	decoderBrokenNotified bool
+	// resetGraphicsFn is called with the new desktop size of each
+	// ResetGraphics command.
+	resetGraphicsFn func(width, height int)
 	// watchdogCh receives signals from background timers inside ffmpegDecoder
 	// when stall-probe or IDR-wait timeouts expire independently of server
 	// frame rate.  decodeLoop selects on this channel so it calls
@@ -385,6 +421,8 @@ type GfxHandler struct {
 	// JavaScript WebCodecs VideoDecoder instead.
 	// destX, destY are the top-left canvas coordinates.
 	onH264Raw func(destX, destY, w, h int, isKey bool, data []byte)
+	// onH264NAL, when set, receives AVC420 frames instead of the decoder.
+	onH264NAL func(H264NAL)
 	// onI420 is called after a successful H.264 decode when I420 planar data
 	// is available.  The caller can upload the planes to an SDL2 IYUV texture
 	// for GPU-accelerated YUV→RGB conversion, bypassing the CPU colour path.
@@ -394,6 +432,8 @@ type GfxHandler struct {
 	// by SDL2 clients when available because VideoToolbox commonly outputs
 	// NV12 and SDL_UpdateNVTexture can upload it directly.
 	onNV12 func(destX, destY, w, h int, y []byte, yStride int, uv []byte, uvStride int)
+
+	log *slog.Logger
 }
 
 // NewGfxHandler creates a new RDPGFX handler.
@@ -412,7 +452,10 @@ func NewGfxHandler(onBitmap func([]BitmapUpdate)) *GfxHandler {
 		ackCh:      make(chan []byte, 512),
 		doneCh:     make(chan struct{}),
 		watchdogCh: make(chan struct{}, 4),
+		log:        core.Logger(nil, "rdpgfx"),
 	}
+	g.rfx.log = g.log
+	g.progressive.log = g.log
 	g.h264dec = newH264DecoderWithWatchdog(g.watchdogCh)
 	go g.decodeLoop()
 	go g.writeLoop()
@@ -500,7 +543,7 @@ func (g *GfxHandler) NotifyLocalInput() {
 	}
 	g.inputWatchdogMu.Unlock()
 
-	slog.Debug("H.264: local input armed stall watchdog",
+	g.log.Debug("H.264: local input armed stall watchdog",
 		"silentFor", silentFor.Round(time.Millisecond))
 }
 
@@ -594,7 +637,7 @@ func (g *GfxHandler) maybeRenegotiateCapabilities() {
 		// not send standalone LC=2 IDR frames, so the aux decoder can never be
 		// primed.  Reconnecting would reproduce the same failure.  Degrade
 		// gracefully: LC=2 is silently skipped for the remainder of this session.
-		slog.Warn("H.264: server never sent stream2 in LC=0, LC=2 degraded to LC=0 only (no reconnect)")
+		g.log.Warn("H.264: server never sent stream2 in LC=0, LC=2 degraded to LC=0 only (no reconnect)")
 		g.lc2PermanentlyDegraded = true
 		return
 	}
@@ -615,7 +658,7 @@ func (g *GfxHandler) maybeRenegotiateCapabilities() {
 		// always start from attempt 1.
 		g.auxDecoderNoIDRRetries++
 		if g.auxDecoderNoIDRRetries <= auxDecoderMaxIDRRetries {
-			slog.Debug("H.264: aux decoder not primed — requesting keyframe to get stream2 IDR",
+			g.log.Debug("H.264: aux decoder not primed — requesting keyframe to get stream2 IDR",
 				"attempt", g.auxDecoderNoIDRRetries, "maxRetries", auxDecoderMaxIDRRetries)
 			g.lastKeyframeRequest = time.Time{} // allow immediate send
 			g.maybeRequestKeyframe()
@@ -625,7 +668,7 @@ func (g *GfxHandler) maybeRenegotiateCapabilities() {
 		// requests and LC=2 has never decoded successfully this session.  Reconnecting
 		// reproduces the same failure because the server consistently omits stream2
 		// IDRs in LC=0 IDR packets.  Degrade gracefully to LC=0-only instead.
-		slog.Warn("H.264: aux decoder never primed despite keyframe request — degrading to LC=0 only (no reconnect)",
+		g.log.Warn("H.264: aux decoder never primed despite keyframe request — degrading to LC=0 only (no reconnect)",
 			"retries", g.auxDecoderNoIDRRetries)
 		g.lc2PermanentlyDegraded = true
 		return
@@ -635,7 +678,7 @@ func (g *GfxHandler) maybeRenegotiateCapabilities() {
 	// and continuously updating lastDecodedFrame even while the aux decoder
 	// (h264dec2) is broken, which would prevent this function from ever
 	// triggering a reconnect and permanently lose LC=2 chroma enhancement.
-	slog.Debug("H.264: aux decoder absent, server sending LC=2 — triggering reconnect")
+	g.log.Debug("H.264: aux decoder absent, server sending LC=2 — triggering reconnect")
 	g.decoderBrokenNotified = true
 	if g.onDecoderBroken != nil {
 		go g.onDecoderBroken()
@@ -691,11 +734,26 @@ func (g *GfxHandler) maybeTriggerInputStall() {
 		return
 	}
 	g.h264dec.ForceBroken(H264BrokenReasonHWStall)
-	slog.Debug("H.264: local input produced no new frame, marking decoder broken",
+	g.log.Debug("H.264: local input produced no new frame, marking decoder broken",
 		"silentFor", silentFor.Round(time.Millisecond),
 		"inputAgo", time.Since(time.Unix(0, inputNS)).Round(time.Millisecond))
 }
 
+// SetLogger makes the handler and its codecs log to l, with the attribute
+// layer=rdpgfx.  It must be called before the handler receives data.
+func (g *GfxHandler) SetLogger(l *slog.Logger) {
+	g.log = core.Logger(l, "rdpgfx")
+	g.rfx.log = g.log
+	g.progressive.log = g.log
+}
+
+// SetBudget makes the handler reserve the pixels of the surfaces and the
+// cache entries the server creates from b, and refuse those that do not
+// fit.  It must be called before the handler receives data.
+func (g *GfxHandler) SetBudget(b *core.Budget) {
+	g.budget = b
+}
+
 // SetSendFunc sets the function used to send RDPGFX responses via DVC.
 func (g *GfxHandler) SetSendFunc(fn func([]byte)) {
 	g.sendFn = fn
@@ -709,6 +767,14 @@ func (g *GfxHandler) SetDecoderBrokenCallback(fn func()) {
 	g.onDecoderBroken = fn
 }
 
+// SetResetGraphicsCallback registers a function that is called with the
+// desktop size of each ResetGraphics command, which the server sends when
+// the session starts and after each resize.  It runs on the decode
+// goroutine.
+func (g *GfxHandler) SetResetGraphicsCallback(fn func(width, height int)) {
+	g.resetGraphicsFn = fn
+}
+
 // SetKeyframeRequestFunc registers a function that is called after each
 // soft decoder reset to ask the server for a fresh IDR keyframe.  This
 // speeds up recovery: without it the decoder waits for the server to
@@ -774,13 +840,15 @@ func (g *GfxHandler) sendCapsAdvertise() {
 
 	// AVC capsets are advertised when we can deliver decoded frames either
 	// in-process (h264dec) or by handing the raw NALs off to the embedder
-	// (onH264Raw, used by the WASM build to forward to WebCodecs). Without
+	// (onH264Raw, used by the WASM build to forward to WebCodecs, or
+	// onH264NAL for hardware decoders). Without
 	// either, the v8.0+AVCDisabled fallback below forces the server to
 	// reject RDPGFX and use legacy bitmap PDUs.
-	if g.h264dec != nil || g.onH264Raw != nil {
-		if g.avc444Disabled {
-			// AVC444 disabled: advertise only v8.0 and v8.1 so the server
-			// uses AVC420 (4:2:0) exclusively and never sends LC=2 data.
+	if g.h264dec != nil || g.onH264Raw != nil || g.onH264NAL != nil {
+		if g.avc444Disabled || g.onH264NAL != nil {
+			// AVC444 disabled, or AVC420 frames handed to the embedder:
+			// advertise only v8.0 and v8.1 so the server uses AVC420
+			// (4:2:0) exclusively and never sends LC=2 data.
 			p = binary.LittleEndian.AppendUint16(p, 2) // capsSetCount
 
 			// v8.0 — baseline fallback (no AVC)
@@ -794,7 +862,7 @@ func (g *GfxHandler) sendCapsAdvertise() {
 			p = binary.LittleEndian.AppendUint32(p, capFlagSmallCache|capFlagAVC420Enabled)
 
 			g.sendPdu(cmdidCapsAdvertise, p)
-			slog.Debug("RDPGFX: sent CAPS_ADVERTISE (v8.1..v8.0, AVC444 disabled)")
+			g.log.Debug("RDPGFX: sent CAPS_ADVERTISE (v8.1..v8.0, AVC444 disabled)")
 		} else {
 			// Advertise capsets in ascending order (v8.0 → v10.7), matching
 			// rdpyqt / FreeRDP layout so servers pick the highest common version.
@@ -859,7 +927,7 @@ func (g *GfxHandler) sendCapsAdvertise() {
 			p = binary.LittleEndian.AppendUint32(p, capFlagSmallCache)
 
 			g.sendPdu(cmdidCapsAdvertise, p)
-			slog.Debug("RDPGFX: sent CAPS_ADVERTISE (v10.7..v8.0, AVC enabled)")
+			g.log.Debug("RDPGFX: sent CAPS_ADVERTISE (v10.7..v8.0, AVC enabled)")
 		}
 	} else {
 		p = binary.LittleEndian.AppendUint16(p, 1) // capsSetCount
@@ -871,7 +939,7 @@ func (g *GfxHandler) sendCapsAdvertise() {
 		// (0x0009) which servers send over RDPGFX when it stays open.
 		p = binary.LittleEndian.AppendUint32(p, capFlagThinClient|capFlagSmallCache|capFlagAVCDisabled)
 		g.sendPdu(cmdidCapsAdvertise, p)
-		slog.Debug("RDPGFX: sent CAPS_ADVERTISE (v8.0)")
+		g.log.Debug("RDPGFX: sent CAPS_ADVERTISE (v8.0)")
 	}
 }
 
@@ -894,7 +962,7 @@ const (
 func (g *GfxHandler) Process(data []byte) {
 	defer func() {
 		if r := recover(); r != nil {
-			slog.Error("RDPGFX: panic in Process", "err", r)
+			g.log.Error("RDPGFX: panic in Process", "err", r)
 		}
 	}()
 	if len(data) < 1 {
@@ -914,7 +982,7 @@ func (g *GfxHandler) Process(data []byte) {
 	case zgfxMultipart:
 		decompressed, decompPooled = g.decompressMultipart(data[1:])
 	default:
-		slog.Warn("RDPGFX: unknown ZGFX descriptor", "descriptor", descriptor)
+		g.log.Warn("RDPGFX: unknown ZGFX descriptor", "descriptor", descriptor)
 		decompressed = data
 	}
 
@@ -932,7 +1000,7 @@ func (g *GfxHandler) Process(data []byte) {
 		// Channel full — video decode is dropped, but we must still
 		// ACK any EndFrame PDUs so the server's outstanding-frame
 		// count stays accurate and it keeps sending.
-		slog.Warn("RDPGFX: decodeCh full, dropping frame (ACKs preserved)", "queueCap", cap(g.decodeCh))
+		g.log.Warn("RDPGFX: decodeCh full, dropping frame (ACKs preserved)", "queueCap", cap(g.decodeCh))
 		g.ackDroppedFrames(pkt)
 	}
 }
@@ -1015,8 +1083,9 @@ func (g *GfxHandler) decompressMultipart(data []byte) ([]byte, bool) {
 	offset := 6
 
 	// Pre-allocate to the advertised uncompressed size to avoid repeated
-	// buffer growths as each segment is appended.
-	buf := acquireBitmapBuf(int(uncompSize))
+	// buffer growths as each segment is appended, up to what the segments
+	// can hold: a segment decompresses to at most zgfxSegmentMax bytes.
+	buf := acquireBitmapBuf(min(int(uncompSize), int(segCount)*zgfxSegmentMax))
 	result := buf[:0]
 	for range segCount {
 		if offset+4 > len(data) {
@@ -1058,7 +1127,7 @@ func (g *GfxHandler) decompressMultipart(data []byte) ([]byte, bool) {
 func (g *GfxHandler) decodeLoop() {
 	defer func() {
 		if r := recover(); r != nil {
-			slog.Error("RDPGFX: panic in decodeLoop, restarting", "err", r)
+			g.log.Error("RDPGFX: panic in decodeLoop, restarting", "err", r)
 			select {
 			case <-g.doneCh:
 				// Shutting down — free h264dec resources on this final exit.
@@ -1085,7 +1154,6 @@ func (g *GfxHandler) decodeLoop() {
 			g.h264dec2 = nil
 		}
 	}()
-	slog.Debug("RDPGFX: decodeLoop started")
 	for {
 		select {
 		case <-g.doneCh:
@@ -1100,7 +1168,7 @@ func (g *GfxHandler) decodeLoop() {
 			// or IDR-wait timeout expired while the server was sending no frames
 			// (static screen → near-0 fps), or because local input produced no
 			// new frame while the decoder had already been silent too long.
-			slog.Debug("H.264: watchdog triggered, checking decoder state")
+			g.log.Debug("H.264: watchdog triggered, checking decoder state")
 			g.maybeTriggerInputStall()
 			g.maybeRenegotiateCapabilities()
 			g.maybeNotifyDecoderBroken()
@@ -1108,7 +1176,7 @@ func (g *GfxHandler) decodeLoop() {
 	}
 }
 
-// skipHeavyThreshold controls when CaVideo/progressive decode is skipped.
+// skipHeavyThreshold controls when CaVideo decode is skipped.
 // When the queue has more items than this, heavy decode is skipped to drain
 // the backlog quickly.  A small threshold means we decode almost every frame
 // during normal playback, only skipping under severe backpressure.
@@ -1116,7 +1184,7 @@ const skipHeavyThreshold = 16
 
 // decodePDUs processes all PDUs in decompressed data.
 // Frame ACKs (EndFrame) are ALWAYS processed so the server gets timely
-// acknowledgements.  Heavy CaVideo/progressive decode is skipped when
+// acknowledgements.  Heavy CaVideo decode is skipped when
 // the queue is significantly backed up.
 func (g *GfxHandler) decodePDUs(data []byte) {
 	skipHeavy := len(g.decodeCh) > skipHeavyThreshold
@@ -1134,7 +1202,7 @@ func (g *GfxHandler) decodePDUs(data []byte) {
 }
 
 // dispatchDecode routes a single PDU.  When skipHeavy is true, CaVideo
-// and progressive decode are skipped to drain the queue quickly.
+// decode is skipped to drain the queue quickly.
 // EndFrame (frame ACK) is always processed regardless of skipHeavy.
 func (g *GfxHandler) dispatchDecode(cmdId uint16, data []byte, skipHeavy bool) {
 	switch cmdId {
@@ -1149,32 +1217,42 @@ func (g *GfxHandler) dispatchDecode(cmdId uint16, data []byte, skipHeavy bool) {
 	case cmdidMapSurfaceToOutput:
 		g.onMapSurfaceToOutput(data)
 	case cmdidStartFrame:
-		// nothing to do
+		g.onStartFrame(data)
 	case cmdidSurfaceToSurface:
 		g.onSurfaceToSurface(data)
 	case cmdidEndFrame:
 		g.onEndFrame(data) // always ACK, even when skipHeavy
 	case cmdidWireToSurface1:
-		g.onWireToSurface1Decode(data, skipHeavy)
+		g.timeDecode(func() { g.onWireToSurface1Decode(data, skipHeavy) })
 	case cmdidWireToSurface2:
-		g.onWireToSurface2Decode(data, skipHeavy)
+		g.timeDecode(func() { g.onWireToSurface2Decode(data, skipHeavy) })
 	case cmdidSolidFill:
 		g.onSolidFill(data)
+	case cmdidSurfaceToCache:
+		g.onSurfaceToCache(data)
 	case cmdidCacheToSurface:
 		g.onCacheToSurface(data)
 	case cmdidEvictCacheEntry:
 		g.onEvictCacheEntry(data)
-	case cmdidCacheImportOffer:
-		g.onCacheImportOffer()
+	case cmdidCacheImportReply:
+		g.onCacheImportReply(data)
 	case cmdidMapSurfaceToWindow, cmdidMapSurfaceToScaledWindow:
 		// ignored — we don't support per-window mapping
 	case cmdidMapSurfaceToScaledOutput, cmdidMapSurfaceToScaledOutputV2:
 		g.onMapSurfaceToScaledOutput(data)
 	default:
-		slog.Debug("RDPGFX: unhandled cmd", "cmdId", cmdId)
+		g.log.Debug("RDPGFX: unhandled cmd", "cmdId", cmdId)
 	}
 }
 
+// timeDecode runs decode, the decoding of a surface command, and adds the
+// time it took, less the time spent in output, to decodeTime.
+func (g *GfxHandler) timeDecode(decode func()) {
+	start, output := time.Now(), g.outputTime
+	decode()
+	g.decodeTime.Add(int64(time.Since(start) - (g.outputTime - output)))
+}
+
 // writeLoop runs in a dedicated goroutine.  It reads serialized ACK
 // PDUs from ackCh and sends each one via sendFn.  Every ACK must reach
 // the server — the server tracks outstanding frames individually and
@@ -1183,7 +1261,7 @@ func (g *GfxHandler) dispatchDecode(cmdId uint16, data []byte, skipHeavy bool) {
 func (g *GfxHandler) writeLoop() {
 	defer func() {
 		if r := recover(); r != nil {
-			slog.Error("RDPGFX: panic in writeLoop, restarting", "err", r)
+			g.log.Error("RDPGFX: panic in writeLoop, restarting", "err", r)
 			select {
 			case <-g.doneCh:
 				// Shut down; do not restart.
@@ -1237,7 +1315,7 @@ func (g *GfxHandler) sendPdu(cmdId uint16, payload []byte) {
 
 func (g *GfxHandler) onCapsConfirm(data []byte) {
 	if len(data) < 12 {
-		slog.Debug("RDPGFX: CAPS_CONFIRM received (short)")
+		g.log.Debug("RDPGFX: CAPS_CONFIRM received (short)")
 		return
 	}
 	version := binary.LittleEndian.Uint32(data[0:])
@@ -1246,7 +1324,9 @@ func (g *GfxHandler) onCapsConfirm(data []byte) {
 	if dataLen >= 4 {
 		flags = binary.LittleEndian.Uint32(data[8:])
 	}
-	slog.Debug("RDPGFX: CAPS_CONFIRM", "version", version, "flags", flags)
+	g.log.Debug("RDPGFX: CAPS_CONFIRM", "version", version, "flags", flags)
+	g.capsFlags = flags
+	g.sendCacheImportOffer()
 }
 
 func (g *GfxHandler) onResetGraphics(data []byte) {
@@ -1255,8 +1335,15 @@ func (g *GfxHandler) onResetGraphics(data []byte) {
 	}
 	w := binary.LittleEndian.Uint32(data[0:])
 	h := binary.LittleEndian.Uint32(data[4:])
-	slog.Debug("RDPGFX: RESET_GRAPHICS", "w", w, "h", h)
-	g.surfaces = make(map[uint16]*surface)
+	g.log.Debug("RDPGFX: RESET_GRAPHICS", "w", w, "h", h)
+	if err := core.CheckBitmapSize(int(w), int(h)); err != nil {
+		g.log.Warn("RDPGFX: RESET_GRAPHICS ignored", "err", err)
+		return
+	}
+	for id := range g.surfaces {
+		g.dropSurface(id)
+	}
+	g.resetOutput(int(w), int(h))
 	g.clearCtx = newClearCodecCtx()
 	g.framesDecoded.Store(0)
 	g.softResetCount = 0
@@ -1288,6 +1375,9 @@ func (g *GfxHandler) onResetGraphics(data []byte) {
 	g.avc444YPlane = avc444YPlane{}
 	g.avc444IDRYPlane = avc444YPlane{}
 	g.progressive.Reset()
+	if g.resetGraphicsFn != nil {
+		g.resetGraphicsFn(int(w), int(h))
+	}
 }
 
 func (g *GfxHandler) onCreateSurface(data []byte) {
@@ -1298,10 +1388,20 @@ func (g *GfxHandler) onCreateSurface(data []byte) {
 	w := binary.LittleEndian.Uint16(data[2:])
 	h := binary.LittleEndian.Uint16(data[4:])
 	f := data[6]
-	slog.Debug("RDPGFX: CREATE_SURFACE", "id", id, "w", w, "h", h)
+	g.log.Debug("RDPGFX: CREATE_SURFACE", "id", id, "w", w, "h", h)
+	g.dropSurface(id)
+	size := int(w) * int(h) * 4
+	err := core.CheckBitmapSize(int(w), int(h))
+	if err == nil {
+		err = g.budget.Reserve(size)
+	}
+	if err != nil {
+		g.log.Warn("RDPGFX: CREATE_SURFACE refused", "id", id, "err", err)
+		return
+	}
 	g.surfaces[id] = &surface{
 		width: w, height: h, format: f,
-		data:        make([]byte, int(w)*int(h)*4),
+		data:        make([]byte, size),
 		shadowStale: true,
 	}
 }
@@ -1311,7 +1411,35 @@ func (g *GfxHandler) onDeleteSurface(data []byte) {
 		return
 	}
 	id := binary.LittleEndian.Uint16(data)
-	delete(g.surfaces, id)
+	g.dropSurface(id)
+	g.progressive.DeleteSurface(id)
+}
+
+// dropSurface deletes surface id and releases its pixels.
+func (g *GfxHandler) dropSurface(id uint16) {
+	if s, ok := g.surfaces[id]; ok {
+		g.budget.Release(len(s.data))
+		delete(g.surfaces, id)
+	}
+}
+
+// putCacheEntry stores e in cache slot, when its pixels fit in the budget.
+func (g *GfxHandler) putCacheEntry(slot uint16, e cacheEntry) bool {
+	g.dropCacheEntry(slot)
+	if err := g.budget.Reserve(len(e.data)); err != nil {
+		g.log.Warn("RDPGFX: cache entry refused", "slot", slot, "err", err)
+		return false
+	}
+	g.cacheEntries[slot] = e
+	return true
+}
+
+// dropCacheEntry empties cache slot and releases its pixels.
+func (g *GfxHandler) dropCacheEntry(slot uint16) {
+	if e, ok := g.cacheEntries[slot]; ok {
+		g.budget.Release(len(e.data))
+		delete(g.cacheEntries, slot)
+	}
 }
 
 func (g *GfxHandler) onMapSurfaceToOutput(data []byte) {
@@ -1322,7 +1450,7 @@ func (g *GfxHandler) onMapSurfaceToOutput(data []byte) {
 	// data[2:4] = reserved
 	ox := binary.LittleEndian.Uint32(data[4:])
 	oy := binary.LittleEndian.Uint32(data[8:])
-	slog.Debug("RDPGFX: MAP_SURFACE", "id", id, "ox", ox, "oy", oy)
+	g.log.Debug("RDPGFX: MAP_SURFACE", "id", id, "ox", ox, "oy", oy)
 	if s, ok := g.surfaces[id]; ok {
 		s.outputX = ox
 		s.outputY = oy
@@ -1339,7 +1467,7 @@ func (g *GfxHandler) onMapSurfaceToScaledOutput(data []byte) {
 	ox := binary.LittleEndian.Uint32(data[4:])
 	oy := binary.LittleEndian.Uint32(data[8:])
 	// data[12:16] = targetWidth, data[16:20] = targetHeight (unused)
-	slog.Debug("RDPGFX: MAP_SURFACE_SCALED", "id", id, "ox", ox, "oy", oy)
+	g.log.Debug("RDPGFX: MAP_SURFACE_SCALED", "id", id, "ox", ox, "oy", oy)
 	if s, ok := g.surfaces[id]; ok {
 		s.outputX = ox
 		s.outputY = oy
@@ -1371,7 +1499,7 @@ func (g *GfxHandler) sendFrameAck(frameId uint32, queueDepth uint32) {
 	case g.ackCh <- pdu:
 	default:
 		ackPDUPool.Put(pdu)
-		slog.Warn("RDPGFX: ackCh full, ACK dropped")
+		g.log.Warn("RDPGFX: ackCh full, ACK dropped")
 	}
 }
 
@@ -1383,7 +1511,9 @@ func (g *GfxHandler) onEndFrame(data []byte) {
 	if hint := g.queueDepthHint.Load(); hint > realDepth {
 		realDepth = hint
 	}
-	g.sendFrameAck(binary.LittleEndian.Uint32(data), realDepth)
+	frameID := binary.LittleEndian.Uint32(data)
+	g.sendFrameAck(frameID, realDepth)
+	g.onFrameEnd(frameID)
 }
 
 // SetQueueDepthHint sets a minimum queueDepth to report in FRAME_ACKNOWLEDGE
@@ -1419,13 +1549,13 @@ func (g *GfxHandler) onWireToSurface1Decode(data []byte, skipHeavy bool) {
 	}
 	bmpData := data[17 : 17+int(bmpLen)]
 
-	if slog.Default().Enabled(nil, slog.LevelDebug) {
-		slog.Debug("RDPGFX: WTS1", "surfId", surfId, "codecId", codecId,
+	if g.log.Enabled(nil, slog.LevelDebug) {
+		g.log.Debug("RDPGFX: WTS1", "surfId", surfId, "codecId", codecId,
 			"w", right-left, "h", bottom-top, "bmpLen", bmpLen)
 	}
 
-	w := int(right - left)
-	h := int(bottom - top)
+	w := int(right) - int(left)
+	h := int(bottom) - int(top)
 	if w <= 0 || h <= 0 {
 		return
 	}
@@ -1434,6 +1564,12 @@ func (g *GfxHandler) onWireToSurface1Decode(data []byte, skipHeavy bool) {
 	if !ok {
 		return
 	}
+	// the rectangle sizes the decode buffers, so it must lie in the surface
+	if right > s.width || bottom > s.height {
+		g.log.Warn("RDPGFX: WTS1 outside its surface", "surfId", surfId,
+			"right", right, "bottom", bottom, "width", s.width, "height", s.height)
+		return
+	}
 
 	// CaVideo (0x0003) carries RFX tile-encoded data; decode onto the
 	// persistent surface buffer like the progressive codec in WTS2.
@@ -1454,11 +1590,15 @@ func (g *GfxHandler) onWireToSurface1Decode(data []byte, skipHeavy bool) {
 		decoded = decodeUncompressed(bmpData, w, h, pixFmt)
 		owned = true
 	case codecPlanar:
-		decoded = decodePlanar(bmpData, w, h)
+		decoded = decodePlanar(bmpData, w, h, g.log)
 		owned = true
 	case codecAVC420:
 		destX := int(s.outputX) + int(left)
 		destY := int(s.outputY) + int(top)
+		if g.onH264NAL != nil {
+			g.forwardAVC420(surfId, destX, destY, w, h, bmpData)
+			return
+		}
 		if g.onNV12 != nil {
 			var ownedAVC bool
 			var nv12 *H264FrameNV12
@@ -1550,7 +1690,7 @@ func (g *GfxHandler) onWireToSurface1Decode(data []byte, skipHeavy bool) {
 			owned = ownedAVC
 		}
 	default:
-		slog.Warn("RDPGFX: unsupported codec in WTS1", "codecId", codecId, "surfId", surfId, "w", w, "h", h, "bmpLen", bmpLen)
+		g.log.Warn("RDPGFX: unsupported codec in WTS1", "codecId", codecId, "surfId", surfId, "w", w, "h", h, "bmpLen", bmpLen)
 		return
 	}
 	if decoded == nil {
@@ -1598,8 +1738,8 @@ func (g *GfxHandler) onWireToSurface2Decode(data []byte, skipHeavy bool) {
 	w := int(s.width)
 	h := int(s.height)
 
-	if slog.Default().Enabled(nil, slog.LevelDebug) {
-		slog.Debug("RDPGFX: WTS2", "surfId", surfId, "codecId", codecId,
+	if g.log.Enabled(nil, slog.LevelDebug) {
+		g.log.Debug("RDPGFX: WTS2", "surfId", surfId, "codecId", codecId,
 			"w", w, "h", h, "bmpLen", bmpLen)
 	}
 
@@ -1610,7 +1750,7 @@ func (g *GfxHandler) onWireToSurface2Decode(data []byte, skipHeavy bool) {
 		blitToSurface(s, 0, 0, w, h, decoded)
 		g.emitBitmapPooled(s, 0, 0, w, h, decoded)
 	case codecPlanar:
-		decoded = decodePlanar(bmpData, w, h)
+		decoded = decodePlanar(bmpData, w, h, g.log)
 		blitToSurface(s, 0, 0, w, h, decoded)
 		g.emitBitmapPooled(s, 0, 0, w, h, decoded)
 	case codecCaVideo:
@@ -1622,6 +1762,10 @@ func (g *GfxHandler) onWireToSurface2Decode(data []byte, skipHeavy bool) {
 	case codecAVC420:
 		destX := int(s.outputX)
 		destY := int(s.outputY)
+		if g.onH264NAL != nil {
+			g.forwardAVC420(surfId, destX, destY, w, h, bmpData)
+			return
+		}
 		if g.onNV12 != nil {
 			decoded, nv12, avcRegions, ownedAVC := g.decodeAVC420WithNV12(bmpData, destX, destY, w, h)
 			if nv12 != nil {
@@ -1766,11 +1910,10 @@ func (g *GfxHandler) onWireToSurface2Decode(data []byte, skipHeavy bool) {
 			}
 		}
 	case codecProgressive:
-		if skipHeavy {
-			break // frame drop
-		}
-		// Decode tiles directly onto the persistent surface buffer.
-		rects := g.progressive.Decode(bmpData, s.data, w, h)
+		// Never dropped under skipHeavy: upgrade passes refine the tiles
+		// decoded by earlier ones.  Decode tiles directly onto the
+		// persistent surface buffer.
+		rects := g.progressive.Decode(bmpData, surfId, s.data, w, h)
 		for _, rc := range rects {
 			needed := rc.w * rc.h * 4
 			region := regionPool.Get().([]byte)
@@ -1792,7 +1935,7 @@ func (g *GfxHandler) onWireToSurface2Decode(data []byte, skipHeavy bool) {
 			regionPool.Put(region)
 		}
 	default:
-		slog.Debug("RDPGFX: WTS2 unsupported codec", "codecId", codecId, "ctxId", codecCtxId)
+		g.log.Debug("RDPGFX: WTS2 unsupported codec", "codecId", codecId, "ctxId", codecCtxId)
 		return
 	}
 }
@@ -1854,7 +1997,7 @@ func (g *GfxHandler) onSolidFill(data []byte) {
 			}
 		}
 
-		if s.mapped && g.onBitmap != nil {
+		if s.mapped && g.hasOutput() {
 			// Build fill data: fill first row, then replicate (doubling).
 			fillData := acquireBitmapBuf(w * h * 4)
 			rowW := w * 4
@@ -1940,7 +2083,7 @@ func (g *GfxHandler) onSurfaceToSurface(data []byte) {
 			}
 			copy(dst.data[dstOff:dstOff+rowBytes], src.data[srcOff:srcOff+rowBytes])
 		}
-		g.emitBitmap(dst, dstX, dstY, w, h, dst.data)
+		g.emitSurfaceRegion(dst, dstX, dstY, w, h)
 	}
 }
 
@@ -1975,12 +2118,46 @@ func (g *GfxHandler) onEvictCacheEntry(data []byte) {
 		return
 	}
 	slot := binary.LittleEndian.Uint16(data)
-	delete(g.cacheEntries, slot)
+	g.dropCacheEntry(slot)
 }
 
-func (g *GfxHandler) onCacheImportOffer() {
-	var p [2]byte // importedEntriesCount = 0 (little-endian zero)
-	g.sendPdu(cmdidCacheImportReply, p[:])
+// onSurfaceToCache handles RDPGFX_SURFACE_TO_CACHE_PDU (MS-RDPEGFX 2.2.2.6).
+// It copies a surface rectangle into a cache slot for later Cache to
+// Surface PDUs, and into the persistent cache under its cache key.
+func (g *GfxHandler) onSurfaceToCache(data []byte) {
+	// surfaceId(2) + cacheKey(8) + cacheSlot(2) + rectSrc(8) = 20 bytes
+	if len(data) < 20 {
+		return
+	}
+	surfId := binary.LittleEndian.Uint16(data[0:])
+	key := binary.LittleEndian.Uint64(data[2:])
+	slot := binary.LittleEndian.Uint16(data[10:])
+	left := int(binary.LittleEndian.Uint16(data[12:]))
+	top := int(binary.LittleEndian.Uint16(data[14:]))
+	right := int(binary.LittleEndian.Uint16(data[16:]))
+	bottom := int(binary.LittleEndian.Uint16(data[18:]))
+
+	s, ok := g.surfaces[surfId]
+	if !ok || slot == 0 || int(slot) > g.maxCacheSlots() {
+		return
+	}
+	right, bottom = min(right, int(s.width)), min(bottom, int(s.height))
+	w, h := right-left, bottom-top
+	if w <= 0 || h <= 0 {
+		return
+	}
+	e := cacheEntry{data: make([]byte, w*h*4), width: w, height: h, key: key}
+	stride := int(s.width) * 4
+	for row := range h {
+		off := (top+row)*stride + left*4
+		copy(e.data[row*w*4:(row+1)*w*4], s.data[off:off+w*4])
+	}
+	if !g.putCacheEntry(slot, e) {
+		return
+	}
+	if g.persistent != nil {
+		g.persistent.put(e)
+	}
 }
 
 // --- Helpers ---
@@ -1989,7 +2166,7 @@ func (g *GfxHandler) onCacheImportOffer() {
 // pixel buffer into individual BitmapUpdate slices and emits them.
 // Used by both onWireToSurface1Decode and onWireToSurface2Decode.
 func (g *GfxHandler) emitCaVideoRects(s *surface, rects []rfxRect) {
-	if !s.mapped || g.onBitmap == nil || len(rects) == 0 {
+	if !s.mapped || !g.hasOutput() || len(rects) == 0 {
 		return
 	}
 	g.updatesBuf = g.updatesBuf[:0]
@@ -2016,6 +2193,14 @@ func (g *GfxHandler) emitCaVideoRects(s *surface, rects []rfxRect) {
 	g.emitAndReleaseUpdates(g.updatesBuf)
 }
 
+// emitSurfaceRegion emits a rectangle of the surface pixel buffer.
+func (g *GfxHandler) emitSurfaceRegion(s *surface, x, y, w, h int) {
+	if !s.mapped || !g.hasOutput() {
+		return
+	}
+	g.emitCaVideoRects(s, []rfxRect{{x: x, y: y, w: w, h: h}})
+}
+
 func blitToSurface(s *surface, x, y, w, h int, src []byte) {
 	stride := int(s.width) * 4
 	// Full-width fast path: when x==0 and w==surface.width the entire region
@@ -2047,7 +2232,7 @@ func blitToSurface(s *surface, x, y, w, h int, src []byte) {
 // for codec output buffers that the GfxHandler owns end-to-end (currently
 // uncompressed and planar).
 func (g *GfxHandler) emitBitmapPooled(s *surface, x, y, w, h int, decoded []byte) {
-	if !s.mapped || g.onBitmap == nil {
+	if !s.mapped || !g.hasOutput() {
 		releaseBitmapBuf(decoded)
 		return
 	}
@@ -2062,7 +2247,7 @@ func (g *GfxHandler) emitBitmapPooled(s *surface, x, y, w, h int, decoded []byte
 }
 
 func (g *GfxHandler) emitBitmap(s *surface, x, y, w, h int, decoded []byte) {
-	if !s.mapped || g.onBitmap == nil {
+	if !s.mapped || !g.hasOutput() {
 		return
 	}
 	destL := int(s.outputX) + x
@@ -2072,7 +2257,7 @@ func (g *GfxHandler) emitBitmap(s *surface, x, y, w, h int, decoded []byte) {
 		DestRight: destL + w - 1, DestBottom: destT + h - 1,
 		Width: w, Height: h, Bpp: 4, Data: decoded,
 	}
-	g.onBitmap(g.singleUpdate[:])
+	g.output(g.singleUpdate[:])
 	g.singleUpdate[0].Data = nil // release reference; decoded is not pooled
 }
 
@@ -2093,171 +2278,14 @@ func decodeUncompressed(data []byte, w, h int, pixFmt uint8) []byte {
 
 // --- Codec: Planar (RDP 6.0 Bitmap Codec, MS-RDPEGDI 2.2.2.5) ---
 
-func decodePlanar(data []byte, w, h int) []byte {
-	if len(data) < 1 {
-		return acquireBitmapBuf(w * h * 4)
-	}
-	header := data[0]
-	rle := (header >> 5) & 1
-	noAlpha := (header >> 6) & 1
-	planeSize := w * h
-	offset := 1
-
-	var alphaPlane, redPlane, greenPlane, bluePlane []byte
-	defer func() {
-		releasePlaneBuf(alphaPlane)
-		releasePlaneBuf(redPlane)
-		releasePlaneBuf(greenPlane)
-		releasePlaneBuf(bluePlane)
-	}()
-	if rle == 0 {
-		if noAlpha == 0 {
-			alphaPlane, offset = readRawPlane(data, offset, planeSize)
-		}
-		redPlane, offset = readRawPlane(data, offset, planeSize)
-		greenPlane, offset = readRawPlane(data, offset, planeSize)
-		bluePlane, offset = readRawPlane(data, offset, planeSize)
-	} else {
-		if noAlpha == 0 {
-			alphaPlane, offset = decodeNRLE(data, offset, planeSize)
-		}
-		redPlane, offset = decodeNRLE(data, offset, planeSize)
-		greenPlane, offset = decodeNRLE(data, offset, planeSize)
-		bluePlane, offset = decodeNRLE(data, offset, planeSize)
-	}
-	_ = offset
-
-	applyDelta(alphaPlane, w, h)
-	applyDelta(redPlane, w, h)
-	applyDelta(greenPlane, w, h)
-	applyDelta(bluePlane, w, h)
-
-	out := acquireBitmapBuf(planeSize * 4)
-	// Hoist the per-pixel nil/length checks: clamp each plane to
-	// `planeSize` (zero-fill missing planes) so the inner loop has no
-	// branches and the bounds checks are eliminated.
-	rp := planeOrZero(redPlane, planeSize)
-	gp := planeOrZero(greenPlane, planeSize)
-	bp := planeOrZero(bluePlane, planeSize)
-	ap := alphaPlane
-	hasAlpha := ap != nil && len(ap) >= planeSize
-	if hasAlpha {
-		ap = ap[:planeSize]
-		for i := range planeSize {
-			j := i * 4
-			out[j] = bp[i]
-			out[j+1] = gp[i]
-			out[j+2] = rp[i]
-			out[j+3] = ap[i]
-		}
-	} else {
-		for i := range planeSize {
-			j := i * 4
-			out[j] = bp[i]
-			out[j+1] = gp[i]
-			out[j+2] = rp[i]
-			out[j+3] = 0xFF
-		}
-	}
-	return out
-}
-
-// planeOrZero returns a slice of exactly `size` bytes, either the input
-// plane (truncated if longer) or a zero-filled buffer when the plane is
-// nil or short.  Used to drop per-pixel nil/bounds checks in decodePlanar.
-func planeOrZero(plane []byte, size int) []byte {
-	if len(plane) >= size {
-		return plane[:size]
+func decodePlanar(data []byte, w, h int, log *slog.Logger) []byte {
+	out, err := core.DecompressPlanar(data, acquireBitmapBuf(w*h*4), w, h, false)
+	if err != nil {
+		log.Debug("rdpgfx: planar", "err", err)
 	}
-	out := make([]byte, size)
-	copy(out, plane)
 	return out
 }
 
-func readRawPlane(data []byte, offset, size int) ([]byte, int) {
-	plane := acquirePlaneBuf(size)
-	end := min(offset+size, len(data))
-	if offset < end {
-		copy(plane, data[offset:end])
-		if end-offset < size {
-			clear(plane[end-offset:])
-		}
-	} else {
-		clear(plane)
-	}
-	return plane, offset + size
-}
-
-func decodeNRLE(data []byte, offset, planeSize int) ([]byte, int) {
-	out := acquirePlaneBuf(planeSize)
-	pos := 0
-	for pos < planeSize && offset < len(data) {
-		ctrl := data[offset]
-		offset++
-		runLen := int((ctrl >> 4) & 0x0F)
-		rawLen := int(ctrl & 0x0F)
-
-		if runLen == 15 {
-			if offset >= len(data) {
-				break
-			}
-			ext := int(data[offset])
-			offset++
-			runLen += ext
-			if ext == 0xFF {
-				if offset+1 >= len(data) {
-					break
-				}
-				runLen += int(binary.LittleEndian.Uint16(data[offset:]))
-				offset += 2
-			}
-		}
-		// Bulk-zero the run (clear is a runtime intrinsic; much faster than byte-by-byte).
-		end := min(pos+runLen, planeSize)
-		clear(out[pos:end])
-		pos = end
-
-		if rawLen == 15 {
-			if offset >= len(data) {
-				break
-			}
-			ext := int(data[offset])
-			offset++
-			rawLen += ext
-			if ext == 0xFF {
-				if offset+1 >= len(data) {
-					break
-				}
-				rawLen += int(binary.LittleEndian.Uint16(data[offset:]))
-				offset += 2
-			}
-		}
-		// Bulk-copy the raw run (copy is a runtime intrinsic; much faster than byte-by-byte).
-		n := min(rawLen, min(planeSize-pos, len(data)-offset))
-		copy(out[pos:pos+n], data[offset:offset+n])
-		pos += n
-		offset += n
-	}
-	return out, offset
-}
-
-func applyDelta(plane []byte, w, h int) {
-	if plane == nil || len(plane) < w*h {
-		return
-	}
-	// Process row-by-row: previous row XORs into current row using
-	// fixed-length slices so the compiler eliminates per-element
-	// bounds checks and the index multiplications hoist.
-	for y := 1; y < h; y++ {
-		base := y * w
-		prev := plane[base-w : base : base]
-		cur := plane[base : base+w : base+w]
-		for x := range w {
-			cur[x] ^= prev[x]
-		}
-	}
-}
-
 // --- Codec: ClearCodec (MS-RDPEGFX 2.2.4) ---
 
 func (ctx *clearCodecCtx) decode(data []byte, w, h int) []byte {
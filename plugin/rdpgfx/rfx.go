@@ -20,6 +20,8 @@ import (
 	"log/slog"
 	"runtime"
 	"sync"
+
+	"github.com/nakagami/grdp/core"
 )
 
 const (
@@ -45,10 +47,11 @@ type rfxDecoder struct {
 	rectsBuf  []rfxRect
 	tilesBuf  []rfxTileWork
 	quantsBuf []rfxQuant
+	log       *slog.Logger
 }
 
 func newRfxDecoder() *rfxDecoder {
-	return &rfxDecoder{}
+	return &rfxDecoder{log: core.DefaultLogger}
 }
 
 // Decode processes non-progressive RFX data, rendering tiles onto the
@@ -140,7 +143,7 @@ func (d *rfxDecoder) parseRegion(data []byte, left, top int) []rfxRect {
 	// Validate regionType
 	regionType := binary.LittleEndian.Uint16(data[off:])
 	if regionType != cbtRegion {
-		slog.Debug("RFX: unexpected regionType", "type", regionType)
+		d.log.Debug("RFX: unexpected regionType", "type", regionType)
 	}
 
 	return rects
@@ -237,7 +240,7 @@ func (d *rfxDecoder) decodeTileset(data []byte, left, top int, surfData []byte,
 			wg.Go(func() {
 				defer func() {
 					if r := recover(); r != nil {
-						slog.Error("RFX: tile decode panic", "err", r)
+						d.log.Error("RFX: tile decode panic", "err", r)
 					}
 				}()
 				for t := range ch {
@@ -8,6 +8,8 @@ import (
 	"log/slog"
 	"runtime"
 	"sync"
+
+	"github.com/nakagami/grdp/core"
 )
 
 // Progressive block types (different from non-progressive WBT_* at same values!)
@@ -31,18 +33,72 @@ type rfxQuant struct {
 	LH1, HL1, HH1      uint8
 }
 
-// rfxTileCoeffs holds the raw RLGR-decoded coefficients for one tile (all three
-// components), stored before LL3 differential decode and dequantization.  This
-// state is required to apply TILE_UPGRADE_FIRST delta data on top of a previous
-// TILE_FIRST (or TILE_SIMPLE) pass.
-//
-// The fields use *coeffArr (pooled) rather than []int16 to eliminate a
-// heap allocation per tile per frame.  Callers must return these to
-// coeffPool when replacing or discarding a cache entry.
-type rfxTileCoeffs struct {
-	y  *coeffArr
-	cb *coeffArr
-	cr *coeffArr
+// Progressive flags (MS-RDPEGFX 2.2.4.2.1.4 - 2.2.4.2.1.7).
+const (
+	progDWTReduceExtrapolate = 0x01 // RFX_DWT_REDUCE_EXTRAPOLATE, region flags
+	progTileDifference       = 0x01 // RFX_TILE_DIFFERENCE, tile flags
+	progQualityFull          = 0xFF // tile quality of a pass that completes the tile
+)
+
+// rfxProgQuant is an RFX_PROGRESSIVE_CODEC_QUANT: the number of low bits
+// of each band a quality level leaves out, on top of the quantization.
+type rfxProgQuant struct {
+	quality   uint8
+	y, cb, cr rfxQuant
+}
+
+// rfxBand is the position of a subband in the coefficient buffer of a tile.
+type rfxBand struct{ off, n int }
+
+// Subband layouts of a tile, in buffer order HL1, LH1, HH1, HL2, LH2, HH2,
+// HL3, LH3, HH3, LL3.  With RFX_DWT_REDUCE_EXTRAPOLATE the low bands are one
+// coefficient larger and the high bands one smaller at each level
+// (MS-RDPEGFX 3.2.8.1.2.1).
+var (
+	rfxBandsPlain = [10]rfxBand{
+		{0, 1024}, {1024, 1024}, {2048, 1024},
+		{3072, 256}, {3328, 256}, {3584, 256},
+		{3840, 64}, {3904, 64}, {3968, 64}, {4032, 64},
+	}
+	rfxBandsExtrapolate = [10]rfxBand{
+		{0, 1023}, {1023, 1023}, {2046, 961},
+		{3007, 272}, {3279, 272}, {3551, 256},
+		{3807, 72}, {3879, 72}, {3951, 64}, {4015, 81},
+	}
+)
+
+// bands returns the values of q in buffer order.
+func (q rfxQuant) bands() [10]uint8 {
+	return [10]uint8{q.HL1, q.LH1, q.HH1, q.HL2, q.LH2, q.HH2, q.HL3, q.LH3, q.HH3, q.LL3}
+}
+
+// rfxProgTile is the state a tile keeps between progressive passes: the
+// dequantized coefficients decoded so far and their signs per component,
+// and the bit position each band has been refined to (MS-RDPEGFX 3.2.8.1.3).
+type rfxProgTile struct {
+	current [3]coeffArr
+	sign    [3]coeffArr
+	bitPos  [3][10]uint8
+}
+
+// rfxProgRegion holds the tables of a PROGRESSIVE_WBT_REGION block that
+// its tiles refer to.
+type rfxProgRegion struct {
+	rects       []rfxRect
+	quants      []rfxQuant
+	progQuants  []rfxProgQuant
+	extrapolate bool
+}
+
+// progQuant returns the progressive quantization of a tile quality level.
+func (r *rfxProgRegion) progQuant(quality uint8) (rfxProgQuant, bool) {
+	if quality == progQualityFull {
+		return rfxProgQuant{quality: quality}, true
+	}
+	if int(quality) < len(r.progQuants) {
+		return r.progQuants[quality], true
+	}
+	return rfxProgQuant{}, false
 }
 
 type rfxProgTileWork struct {
@@ -51,50 +107,63 @@ type rfxProgTileWork struct {
 }
 
 type rfxProgressiveDecoder struct {
-	mu        sync.RWMutex
-	tileCache map[uint32]*rfxTileCoeffs // key: yIdx<<16 | xIdx
-	rectsBuf  []rfxRect
-	quantsBuf []rfxQuant
-	tilesBuf  []rfxProgTileWork
+	mu            sync.Mutex
+	tiles         map[uint64]*rfxProgTile // key: surfaceId<<32 | yIdx<<16 | xIdx
+	rectsBuf      []rfxRect
+	quantsBuf     []rfxQuant
+	progQuantsBuf []rfxProgQuant
+	tilesBuf      []rfxProgTileWork
+	log           *slog.Logger
 }
 
 func newRfxProgressiveDecoder() *rfxProgressiveDecoder {
 	return &rfxProgressiveDecoder{
-		tileCache: make(map[uint32]*rfxTileCoeffs),
+		tiles: make(map[uint64]*rfxProgTile),
+		log:   core.DefaultLogger,
 	}
 }
 
-// Reset discards the tile coefficient cache.  Call this whenever the server
+// Reset discards the state of all tiles.  Call this whenever the server
 // starts a new progressive sequence (e.g. on RESET_GRAPHICS).
 func (d *rfxProgressiveDecoder) Reset() {
 	d.mu.Lock()
-	old := d.tileCache
-	d.tileCache = make(map[uint32]*rfxTileCoeffs)
+	d.tiles = make(map[uint64]*rfxProgTile)
 	d.mu.Unlock()
-	// Return all cached coefficient arrays to the pool.
-	for _, tc := range old {
-		if tc != nil {
-			if tc.y != nil {
-				coeffPool.Put(tc.y)
-			}
-			if tc.cb != nil {
-				coeffPool.Put(tc.cb)
-			}
-			if tc.cr != nil {
-				coeffPool.Put(tc.cr)
-			}
+}
+
+// DeleteSurface discards the state of the tiles of a deleted surface.
+func (d *rfxProgressiveDecoder) DeleteSurface(surfId uint16) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key := range d.tiles {
+		if uint16(key>>32) == surfId {
+			delete(d.tiles, key)
 		}
 	}
 }
 
+// tile returns the state of a tile, creating it for a first pass.
+func (d *rfxProgressiveDecoder) tile(surfId uint16, xIdx, yIdx uint16, create bool) *rfxProgTile {
+	key := uint64(surfId)<<32 | uint64(yIdx)<<16 | uint64(xIdx)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t := d.tiles[key]
+	if t == nil && create {
+		t = new(rfxProgTile)
+		d.tiles[key] = t
+	}
+	return t
+}
+
 // rfxRect represents a rectangle of decoded tiles.
 type rfxRect struct {
 	x, y, w, h int
 }
 
-// Decode processes RFX Progressive codec data, rendering tiles onto the
-// provided surface buffer. Returns the bounding rectangles of decoded regions.
-func (d *rfxProgressiveDecoder) Decode(data []byte, surfData []byte, width, height int) []rfxRect {
+// Decode processes RFX Progressive codec data for surface surfId,
+// rendering tiles onto the provided surface buffer. Returns the
+// rectangles of decoded regions.
+func (d *rfxProgressiveDecoder) Decode(data []byte, surfId uint16, surfData []byte, width, height int) []rfxRect {
 	var rects []rfxRect
 
 	offset := 0
@@ -110,13 +179,13 @@ func (d *rfxProgressiveDecoder) Decode(data []byte, surfData []byte, width, heig
 
 		switch blockType {
 		case progWBTSync, progWBTFrameBegin, progWBTFrameEnd, progWBTContext:
-		// Infrastructure blocks — no action needed.
+		// Infrastructure blocks — no action needed.  RFX_SUBBAND_DIFFING
+		// in the context flags does not change how tiles are decoded.
 		case progWBTRegion:
 			// Tiles are embedded inside the region block; parseRegion decodes them.
-			regionRects, _ := d.parseRegion(blockData, surfData, width, height)
-			rects = append(rects, regionRects...)
+			rects = append(rects, d.parseRegion(blockData, surfId, surfData, width, height)...)
 		default:
-			slog.Debug("RFX: unknown progressive block type", "type", blockType)
+			d.log.Debug("RFX: unknown progressive block type", "type", blockType)
 		}
 
 		offset += int(blockLen)
@@ -127,18 +196,18 @@ func (d *rfxProgressiveDecoder) Decode(data []byte, surfData []byte, width, heig
 
 // parseRegion extracts rects and quant tables from a PROGRESSIVE_WBT_REGION block,
 // and decodes the tile sub-blocks embedded within it onto the surface.
-// Per MS-RDPEGFX 2.2.4, tile blocks (TILE_SIMPLE/TILE_FIRST) are sub-blocks
-// inside the REGION block, not top-level stream blocks.
-func (d *rfxProgressiveDecoder) parseRegion(data []byte, surfData []byte, outW, outH int) ([]rfxRect, []rfxQuant) {
+// Per MS-RDPEGFX 2.2.4, tile blocks (TILE_SIMPLE/TILE_FIRST/TILE_UPGRADE)
+// are sub-blocks inside the REGION block, not top-level stream blocks.
+func (d *rfxProgressiveDecoder) parseRegion(data []byte, surfId uint16, surfData []byte, outW, outH int) []rfxRect {
 	if len(data) < 12 {
-		return nil, nil
+		return nil
 	}
 
 	// tileSize := data[0]
 	numRects := binary.LittleEndian.Uint16(data[1:])
 	numQuant := data[3]
 	numProgQuant := data[4]
-	// flags := data[5]
+	flags := data[5]
 	numTiles := binary.LittleEndian.Uint16(data[6:])
 	// tileDataSize := binary.LittleEndian.Uint32(data[8:])
 
@@ -153,7 +222,7 @@ func (d *rfxProgressiveDecoder) parseRegion(data []byte, surfData []byte, outW,
 	rects := d.rectsBuf
 	for i := range numRects {
 		if offset+8 > len(data) {
-			return nil, nil
+			return nil
 		}
 		rx := int(binary.LittleEndian.Uint16(data[offset:]))
 		ry := int(binary.LittleEndian.Uint16(data[offset+2:]))
@@ -163,7 +232,7 @@ func (d *rfxProgressiveDecoder) parseRegion(data []byte, surfData []byte, outW,
 		offset += 8
 	}
 
-	// Parse quant values (5 bytes each)
+	// Parse quant values (RFX_COMPONENT_CODEC_QUANT, 5 bytes each)
 	if cap(d.quantsBuf) >= int(numQuant) {
 		d.quantsBuf = d.quantsBuf[:numQuant]
 	} else {
@@ -172,14 +241,38 @@ func (d *rfxProgressiveDecoder) parseRegion(data []byte, surfData []byte, outW,
 	quants := d.quantsBuf
 	for i := range numQuant {
 		if offset+5 > len(data) {
-			return nil, nil
+			return nil
 		}
-		quants[i] = parseRfxQuant(data[offset:])
+		quants[i] = parseProgQuant(data[offset:])
 		offset += 5
 	}
 
-	// Skip progressive quant values (RFX_PROGRESSIVE_CODEC_QUANT, 16 bytes each)
-	offset += int(numProgQuant) * 16
+	// Parse progressive quant values (RFX_PROGRESSIVE_CODEC_QUANT, 16 bytes each)
+	if cap(d.progQuantsBuf) >= int(numProgQuant) {
+		d.progQuantsBuf = d.progQuantsBuf[:numProgQuant]
+	} else {
+		d.progQuantsBuf = make([]rfxProgQuant, numProgQuant)
+	}
+	progQuants := d.progQuantsBuf
+	for i := range numProgQuant {
+		if offset+16 > len(data) {
+			return nil
+		}
+		progQuants[i] = rfxProgQuant{
+			quality: data[offset],
+			y:       parseProgQuant(data[offset+1:]),
+			cb:      parseProgQuant(data[offset+6:]),
+			cr:      parseProgQuant(data[offset+11:]),
+		}
+		offset += 16
+	}
+
+	region := &rfxProgRegion{
+		rects:       rects,
+		quants:      quants,
+		progQuants:  progQuants,
+		extrapolate: flags&progDWTReduceExtrapolate != 0,
+	}
 
 	// Collect all decodable tiles before dispatching, so we can parallelise
 	// when there are enough to amortise goroutine overhead (same threshold as
@@ -200,7 +293,7 @@ func (d *rfxProgressiveDecoder) parseRegion(data []byte, surfData []byte, outW,
 		case progWBTTileSimple, progWBTTileFirst, progWBTTileUpgrade:
 			tiles = append(tiles, rfxProgTileWork{tileType: tileType, data: data[offset+6 : offset+int(tileLen)]})
 		default:
-			slog.Debug("RFX: unknown progressive tile type", "type", tileType)
+			d.log.Debug("RFX: unknown progressive tile type", "type", tileType)
 		}
 		offset += int(tileLen)
 	}
@@ -209,12 +302,10 @@ func (d *rfxProgressiveDecoder) parseRegion(data []byte, surfData []byte, outW,
 	const parallelTileThreshold = 12
 	decodeTile := func(tw rfxProgTileWork, parallel bool) {
 		switch tw.tileType {
-		case progWBTTileSimple:
-			d.decodeTileSimple(tw.data, quants, surfData, outW, outH, parallel)
-		case progWBTTileFirst:
-			d.decodeTileFirst(tw.data, quants, surfData, outW, outH, parallel)
+		case progWBTTileSimple, progWBTTileFirst:
+			d.decodeTileFirst(tw.tileType, tw.data, region, surfId, surfData, outW, outH, parallel)
 		case progWBTTileUpgrade:
-			d.decodeTileUpgrade(tw.data, quants, surfData, outW, outH, parallel)
+			d.decodeTileUpgrade(tw.data, region, surfId, surfData, outW, outH, parallel)
 		}
 	}
 	if len(tiles) >= parallelTileThreshold {
@@ -229,7 +320,7 @@ func (d *rfxProgressiveDecoder) parseRegion(data []byte, surfData []byte, outW,
 			wg.Go(func() {
 				defer func() {
 					if r := recover(); r != nil {
-						slog.Error("RFX progressive: tile decode panic", "err", r)
+						d.log.Error("RFX progressive: tile decode panic", "err", r)
 					}
 				}()
 				for tw := range ch {
@@ -244,9 +335,10 @@ func (d *rfxProgressiveDecoder) parseRegion(data []byte, surfData []byte, outW,
 		}
 	}
 
-	return rects, quants
+	return rects
 }
 
+// parseRfxQuant parses a TS_RFX_CODEC_QUANT (MS-RDPRFX 2.2.2.1.5).
 func parseRfxQuant(data []byte) rfxQuant {
 	return rfxQuant{
 		LL3: data[0] & 0x0F,
@@ -262,220 +354,158 @@ func parseRfxQuant(data []byte) rfxQuant {
 	}
 }
 
-// decodeTileSimple handles PROGRESSIVE_WBT_TILE_SIMPLE (0xCCC5).
+// parseProgQuant parses an RFX_COMPONENT_CODEC_QUANT (MS-RDPEGFX
+// 2.2.4.2.1.5.1), whose bands are in a different order from
+// TS_RFX_CODEC_QUANT.
+func parseProgQuant(data []byte) rfxQuant {
+	return rfxQuant{
+		LL3: data[0] & 0x0F,
+		HL3: data[0] >> 4,
+		LH3: data[1] & 0x0F,
+		HH3: data[1] >> 4,
+		HL2: data[2] & 0x0F,
+		LH2: data[2] >> 4,
+		HH2: data[3] & 0x0F,
+		HL1: data[3] >> 4,
+		LH1: data[4] & 0x0F,
+		HH1: data[4] >> 4,
+	}
+}
+
+// decodeTileFirst handles PROGRESSIVE_WBT_TILE_SIMPLE (0xCCC5) and
+// PROGRESSIVE_WBT_TILE_FIRST (0xCCC6), which start the tile over.  A
+// simple tile is a first pass at full quality.
 // When parallelComponents is true the Y, Cb, and Cr channels are decoded
 // concurrently. Use true for the serial-tile path.
-func (d *rfxProgressiveDecoder) decodeTileSimple(data []byte, quants []rfxQuant, output []byte, outW, outH int, parallelComponents bool) {
-	if len(data) < 16 {
+func (d *rfxProgressiveDecoder) decodeTileFirst(tileType uint16, data []byte, r *rfxProgRegion, surfId uint16, output []byte, outW, outH int, parallelComponents bool) {
+	hdrLen, quality := 16, uint8(progQualityFull)
+	if tileType == progWBTTileFirst {
+		hdrLen = 17
+	}
+	if len(data) < hdrLen {
 		return
 	}
 
-	quantIdxY := data[0]
-	quantIdxCb := data[1]
-	quantIdxCr := data[2]
+	quantIdx := [3]uint8{data[0], data[1], data[2]}
 	xIdx := binary.LittleEndian.Uint16(data[3:])
 	yIdx := binary.LittleEndian.Uint16(data[5:])
-	// flags := data[7]
-	yLen := binary.LittleEndian.Uint16(data[8:])
-	cbLen := binary.LittleEndian.Uint16(data[10:])
-	crLen := binary.LittleEndian.Uint16(data[12:])
-	// tailLen := binary.LittleEndian.Uint16(data[14:])
-
-	off := 16
-	yData := safeSlice(data, off, int(yLen))
-	off += int(yLen)
-	cbData := safeSlice(data, off, int(cbLen))
-	off += int(cbLen)
-	crData := safeSlice(data, off, int(crLen))
-
-	qY := rfxGetQuant(quants, int(quantIdxY))
-	qCb := rfxGetQuant(quants, int(quantIdxCb))
-	qCr := rfxGetQuant(quants, int(quantIdxCr))
-
-	var yPixels, cbPixels, crPixels []int16
-	var newY, newCb, newCr *coeffArr
-	if parallelComponents {
-		var wg sync.WaitGroup
-		wg.Go(func() { yPixels, newY = rfxDecodeComponentProgressive(yData, qY, nil) })
-		wg.Go(func() { cbPixels, newCb = rfxDecodeComponentProgressive(cbData, qCb, nil) })
-		wg.Go(func() { crPixels, newCr = rfxDecodeComponentProgressive(crData, qCr, nil) })
-		wg.Wait()
-	} else {
-		yPixels, newY = rfxDecodeComponentProgressive(yData, qY, nil)
-		cbPixels, newCb = rfxDecodeComponentProgressive(cbData, qCb, nil)
-		crPixels, newCr = rfxDecodeComponentProgressive(crData, qCr, nil)
+	flags := data[7]
+	off := 8
+	if tileType == progWBTTileFirst {
+		quality = data[8]
+		off = 9
+	}
+	var compData [3][]byte
+	lens := data[off : off+6]
+	off = hdrLen // tailLen follows the component lengths and is unused
+	for c := range compData {
+		n := int(binary.LittleEndian.Uint16(lens[c*2:]))
+		compData[c] = safeSlice(data, off, n)
+		off += n
+	}
+
+	pq, ok := r.progQuant(quality)
+	if !ok {
+		d.log.Debug("RFX progressive: bad tile quality", "quality", quality)
+		return
 	}
-
-	rfxPlaceTile(yPixels, cbPixels, crPixels, int(xIdx), int(yIdx), output, outW, outH)
-
-	tileKey := uint32(yIdx)<<16 | uint32(xIdx)
-	d.mu.Lock()
-	old := d.tileCache[tileKey]
-	d.tileCache[tileKey] = &rfxTileCoeffs{y: newY, cb: newCb, cr: newCr}
-	d.mu.Unlock()
-	if old != nil {
-		if old.y != nil {
-			coeffPool.Put(old.y)
-		}
-		if old.cb != nil {
-			coeffPool.Put(old.cb)
-		}
-		if old.cr != nil {
-			coeffPool.Put(old.cr)
+	progBands := [3][10]uint8{pq.y.bands(), pq.cb.bands(), pq.cr.bands()}
+
+	t := d.tile(surfId, xIdx, yIdx, true)
+	diff := flags&progTileDifference != 0
+	var pixels [3][]int16
+	decode := func(c int) {
+		q := rfxGetQuant(r.quants, int(quantIdx[c])).bands()
+		var shift [10]uint8
+		for b := range q {
+			t.bitPos[c][b] = q[b] + progBands[c][b]
+			shift[b] = max(t.bitPos[c][b], 1) - 1
 		}
+		pixels[c] = coeffPool.Get().(*coeffArr)[:]
+		rfxProgDecodeFirst(compData[c], shift, diff, r.extrapolate, &t.current[c], &t.sign[c], pixels[c])
 	}
+	rfxProgDecodeComponents(decode, parallelComponents)
 
-	coeffPool.Put((*coeffArr)(yPixels))
-	coeffPool.Put((*coeffArr)(cbPixels))
-	coeffPool.Put((*coeffArr)(crPixels))
+	rfxPlaceTileClipped(pixels, int(xIdx), int(yIdx), r.rects, output, outW, outH)
+	for _, p := range pixels {
+		coeffPool.Put((*coeffArr)(p))
+	}
 }
-// When parallelComponents is true the Y, Cb, and Cr channels are decoded
-// concurrently. Use true for the serial-tile path.
-func (d *rfxProgressiveDecoder) decodeTileFirst(data []byte, quants []rfxQuant, output []byte, outW, outH int, parallelComponents bool) {
-	if len(data) < 17 {
+
+// decodeTileUpgrade handles PROGRESSIVE_WBT_TILE_UPGRADE (0xCCC7), which
+// refines a tile decoded by a previous pass with the next bits of its
+// coefficients.  Coefficients that were still zero are coded with the
+// simplified run-length code, the others with raw bits
+// (MS-RDPEGFX 3.2.8.1.3).
+func (d *rfxProgressiveDecoder) decodeTileUpgrade(data []byte, r *rfxProgRegion, surfId uint16, output []byte, outW, outH int, parallelComponents bool) {
+	if len(data) < 20 {
 		return
 	}
 
-	quantIdxY := data[0]
-	quantIdxCb := data[1]
-	quantIdxCr := data[2]
+	quantIdx := [3]uint8{data[0], data[1], data[2]}
 	xIdx := binary.LittleEndian.Uint16(data[3:])
 	yIdx := binary.LittleEndian.Uint16(data[5:])
-	// flags := data[7]
-	// quality := data[8]
-	yLen := binary.LittleEndian.Uint16(data[9:])
-	cbLen := binary.LittleEndian.Uint16(data[11:])
-	crLen := binary.LittleEndian.Uint16(data[13:])
-	// tailLen := binary.LittleEndian.Uint16(data[15:])
-
-	off := 17
-	yData := safeSlice(data, off, int(yLen))
-	off += int(yLen)
-	cbData := safeSlice(data, off, int(cbLen))
-	off += int(cbLen)
-	crData := safeSlice(data, off, int(crLen))
-
-	qY := rfxGetQuant(quants, int(quantIdxY))
-	qCb := rfxGetQuant(quants, int(quantIdxCb))
-	qCr := rfxGetQuant(quants, int(quantIdxCr))
-
-	var yPixels, cbPixels, crPixels []int16
-	var newY, newCb, newCr *coeffArr
-	if parallelComponents {
-		var wg sync.WaitGroup
-		wg.Go(func() { yPixels, newY = rfxDecodeComponentProgressive(yData, qY, nil) })
-		wg.Go(func() { cbPixels, newCb = rfxDecodeComponentProgressive(cbData, qCb, nil) })
-		wg.Go(func() { crPixels, newCr = rfxDecodeComponentProgressive(crData, qCr, nil) })
-		wg.Wait()
-	} else {
-		yPixels, newY = rfxDecodeComponentProgressive(yData, qY, nil)
-		cbPixels, newCb = rfxDecodeComponentProgressive(cbData, qCb, nil)
-		crPixels, newCr = rfxDecodeComponentProgressive(crData, qCr, nil)
-	}
-
-	rfxPlaceTile(yPixels, cbPixels, crPixels, int(xIdx), int(yIdx), output, outW, outH)
-
-	tileKey := uint32(yIdx)<<16 | uint32(xIdx)
-	d.mu.Lock()
-	old := d.tileCache[tileKey]
-	d.tileCache[tileKey] = &rfxTileCoeffs{y: newY, cb: newCb, cr: newCr}
-	d.mu.Unlock()
-	if old != nil {
-		if old.y != nil {
-			coeffPool.Put(old.y)
-		}
-		if old.cb != nil {
-			coeffPool.Put(old.cb)
-		}
-		if old.cr != nil {
-			coeffPool.Put(old.cr)
-		}
+	quality := data[7]
+	var srlData, rawData [3][]byte
+	off := 20
+	for c := range 3 {
+		srlLen := int(binary.LittleEndian.Uint16(data[8+c*4:]))
+		rawLen := int(binary.LittleEndian.Uint16(data[10+c*4:]))
+		srlData[c] = safeSlice(data, off, srlLen)
+		off += srlLen
+		rawData[c] = safeSlice(data, off, rawLen)
+		off += rawLen
+	}
+
+	pq, ok := r.progQuant(quality)
+	if !ok {
+		d.log.Debug("RFX progressive: bad tile quality", "quality", quality)
+		return
 	}
-
-	coeffPool.Put((*coeffArr)(yPixels))
-	coeffPool.Put((*coeffArr)(cbPixels))
-	coeffPool.Put((*coeffArr)(crPixels))
-}
-// The upgrade data contains RLGR-encoded delta coefficients that are added to
-// the raw coefficients cached from the preceding TILE_FIRST (or TILE_SIMPLE)
-// pass.  If no cached state exists for the tile (e.g. the session started
-// mid-stream), the delta is decoded as if it were a standalone tile so that
-// at least some image is rendered rather than nothing.
-func (d *rfxProgressiveDecoder) decodeTileUpgrade(data []byte, quants []rfxQuant, output []byte, outW, outH int, parallelComponents bool) {
-	if len(data) < 17 {
+	t := d.tile(surfId, xIdx, yIdx, false)
+	if t == nil {
+		d.log.Debug("RFX progressive: upgrade of an undecoded tile", "xIdx", xIdx, "yIdx", yIdx)
 		return
 	}
+	progBands := [3][10]uint8{pq.y.bands(), pq.cb.bands(), pq.cr.bands()}
 
-	quantIdxY := data[0]
-	quantIdxCb := data[1]
-	quantIdxCr := data[2]
-	xIdx := binary.LittleEndian.Uint16(data[3:])
-	yIdx := binary.LittleEndian.Uint16(data[5:])
-	// flags := data[7]
-	// quality := data[8]
-	yLen := binary.LittleEndian.Uint16(data[9:])
-	cbLen := binary.LittleEndian.Uint16(data[11:])
-	crLen := binary.LittleEndian.Uint16(data[13:])
-	// tailLen := binary.LittleEndian.Uint16(data[15:])
-
-	off := 17
-	yData := safeSlice(data, off, int(yLen))
-	off += int(yLen)
-	cbData := safeSlice(data, off, int(cbLen))
-	off += int(cbLen)
-	crData := safeSlice(data, off, int(crLen))
-
-	qY := rfxGetQuant(quants, int(quantIdxY))
-	qCb := rfxGetQuant(quants, int(quantIdxCb))
-	qCr := rfxGetQuant(quants, int(quantIdxCr))
-
-	tileKey := uint32(yIdx)<<16 | uint32(xIdx)
-	d.mu.RLock()
-	cached := d.tileCache[tileKey]
-	d.mu.RUnlock()
-
-	var prevY, prevCb, prevCr *coeffArr
-	if cached != nil {
-		prevY, prevCb, prevCr = cached.y, cached.cb, cached.cr
-	}
-
-	var yPixels, cbPixels, crPixels []int16
-	var newY, newCb, newCr *coeffArr
-	if parallelComponents {
-		var wg sync.WaitGroup
-		wg.Go(func() { yPixels, newY = rfxDecodeComponentProgressive(yData, qY, prevY) })
-		wg.Go(func() { cbPixels, newCb = rfxDecodeComponentProgressive(cbData, qCb, prevCb) })
-		wg.Go(func() { crPixels, newCr = rfxDecodeComponentProgressive(crData, qCr, prevCr) })
-		wg.Wait()
-	} else {
-		yPixels, newY = rfxDecodeComponentProgressive(yData, qY, prevY)
-		cbPixels, newCb = rfxDecodeComponentProgressive(cbData, qCb, prevCb)
-		crPixels, newCr = rfxDecodeComponentProgressive(crData, qCr, prevCr)
+	var pixels [3][]int16
+	decode := func(c int) {
+		q := rfxGetQuant(r.quants, int(quantIdx[c])).bands()
+		var shift, numBits [10]uint8
+		for b := range q {
+			bitPos := q[b] + progBands[c][b]
+			if t.bitPos[c][b] > bitPos {
+				numBits[b] = t.bitPos[c][b] - bitPos
+			}
+			shift[b] = max(bitPos, 1) - 1
+			t.bitPos[c][b] = bitPos
+		}
+		pixels[c] = coeffPool.Get().(*coeffArr)[:]
+		rfxProgDecodeUpgrade(srlData[c], rawData[c], shift, numBits, r.extrapolate, &t.current[c], &t.sign[c], pixels[c])
 	}
+	rfxProgDecodeComponents(decode, parallelComponents)
 
-	rfxPlaceTile(yPixels, cbPixels, crPixels, int(xIdx), int(yIdx), output, outW, outH)
-
-	d.mu.Lock()
-	d.tileCache[tileKey] = &rfxTileCoeffs{y: newY, cb: newCb, cr: newCr}
-	d.mu.Unlock()
+	rfxPlaceTileClipped(pixels, int(xIdx), int(yIdx), r.rects, output, outW, outH)
+	for _, p := range pixels {
+		coeffPool.Put((*coeffArr)(p))
+	}
+}
 
-	// Return the old cached coefficient arrays to the pool now that they are
-	// no longer referenced (the new entry has been stored above).
-	if cached != nil {
-		if cached.y != nil {
-			coeffPool.Put(cached.y)
-		}
-		if cached.cb != nil {
-			coeffPool.Put(cached.cb)
-		}
-		if cached.cr != nil {
-			coeffPool.Put(cached.cr)
+// rfxProgDecodeComponents runs decode for the Y, Cb and Cr components,
+// concurrently when parallel is set.
+func rfxProgDecodeComponents(decode func(c int), parallel bool) {
+	if !parallel {
+		for c := range 3 {
+			decode(c)
 		}
+		return
 	}
-
-	coeffPool.Put((*coeffArr)(yPixels))
-	coeffPool.Put((*coeffArr)(cbPixels))
-	coeffPool.Put((*coeffArr)(crPixels))
+	var wg sync.WaitGroup
+	for c := range 3 {
+		wg.Go(func() { decode(c) })
+	}
+	wg.Wait()
 }
 
 func rfxGetQuant(quants []rfxQuant, idx int) rfxQuant {
@@ -492,64 +522,247 @@ func safeSlice(data []byte, offset, length int) []byte {
 	return data[offset : offset+length]
 }
 
-// rfxDecodeComponentProgressive decodes one color component for a progressive
-// tile pass.  It always uses RLGR mode 1 (required by the progressive codec).
-//
-// If prevRaw is non-nil, it contains the raw RLGR-decoded coefficients from
-// the preceding TILE_FIRST/TILE_SIMPLE pass; the newly decoded values are
-// treated as a delta and added to prevRaw before processing.  Pass nil for
-// the first pass (TILE_FIRST / TILE_SIMPLE).
-//
-// Returns:
-//   - pixels: the fully decoded tile coefficients (pooled; caller must return
-//     via coeffPool.Put((*coeffArr)(pixels)) when done).
-//   - newRaw: the combined raw coefficients before LL3 differential decode and
-//     dequantization; pooled — the caller must return via coeffPool.Put(newRaw)
-//     when it is no longer needed (e.g. when replacing the tile cache entry).
-func rfxDecodeComponentProgressive(data []byte, quant rfxQuant, prevRaw *coeffArr) (pixels []int16, newRaw *coeffArr) {
-	const tilePixels = rfxTileSize * rfxTileSize
+func rfxBandLayout(extrapolate bool) *[10]rfxBand {
+	if extrapolate {
+		return &rfxBandsExtrapolate
+	}
+	return &rfxBandsPlain
+}
 
-	arr := coeffPool.Get().(*coeffArr)
-	work := arr[:]
+// rfxProgDecodeFirst decodes one component of a first pass into pixels.
+// The RLGR1 coefficients are kept in sign, and the dequantized ones,
+// added to the previous ones for RFX_TILE_DIFFERENCE, in current.
+func rfxProgDecodeFirst(data []byte, shift [10]uint8, diff, extrapolate bool, current, sign *coeffArr, pixels []int16) {
+	const tilePixels = rfxTileSize * rfxTileSize
 
 	if data == nil {
-		clear(work)
+		clear(pixels)
 	} else {
-		// Progressive codec always uses RLGR mode 1.
-		work = rlgr1Decode(data, tilePixels, work)
+		pixels = rlgr1Decode(data, tilePixels, pixels)
+	}
+	copy(sign[:], pixels)
+
+	bands := rfxBandLayout(extrapolate)
+	ll3 := bands[9]
+	for i := ll3.off + 1; i < ll3.off+ll3.n; i++ {
+		pixels[i] += pixels[i-1]
+	}
+	for b, band := range bands {
+		if shift[b] == 0 {
+			continue
+		}
+		for i := band.off; i < band.off+band.n; i++ {
+			pixels[i] <<= shift[b]
+		}
 	}
 
-	// Add delta from the previous quality pass when upgrading.
-	if prevRaw != nil {
-		prev := (*prevRaw)[:]
+	if diff {
 		for i := range tilePixels {
-			work[i] += prev[i]
+			pixels[i] += current[i]
 		}
 	}
+	copy(current[:], pixels)
+	rfxProgInverseDWT(pixels, extrapolate)
+}
 
-	// Cache the combined raw coefficients in a pooled buffer so a future
-	// upgrade pass can add its own delta on top — avoids a heap allocation.
-	newRaw = coeffPool.Get().(*coeffArr)
-	copy((*newRaw)[:], work[:tilePixels])
+// rfxProgDecodeUpgrade adds the numBits bits of an upgrade pass below the
+// bit position reached so far to the coefficients of current, and decodes
+// the result into pixels.
+func rfxProgDecodeUpgrade(srlData, rawData []byte, shift, numBits [10]uint8, extrapolate bool, current, sign *coeffArr, pixels []int16) {
+	srl := rfxSRLDecoder{br: rlgrBitReader{data: srlData}, kp: 8}
+	raw := rlgrBitReader{data: rawData}
 
-	// Apply LL3 differential decode and dequantize LL3 in a single pass
-	// (identical to rfxDecodeComponent step 2).
-	if quant.LL3 > 1 {
-		shift := quant.LL3 - 1
-		work[4032] <<= shift
-		for i := 4033; i < 4096; i++ {
-			work[i] = work[i-1] + work[i]<<shift
+	for b, band := range rfxBandLayout(extrapolate) {
+		n := int(numBits[b])
+		if n == 0 {
+			continue
 		}
-	} else {
-		for i := 4033; i < 4096; i++ {
-			work[i] += work[i-1]
+		cur := current[band.off : band.off+band.n]
+		if b == 9 {
+			// LL3 coefficients are refined with unsigned raw bits.
+			for i := range cur {
+				cur[i] += int16(raw.readBits(n) << shift[b])
+			}
+			continue
+		}
+		sgn := sign[band.off : band.off+band.n]
+		for i := range cur {
+			var v int32
+			switch {
+			case sgn[i] > 0:
+				v = int32(raw.readBits(n))
+			case sgn[i] < 0:
+				v = -int32(raw.readBits(n))
+			default:
+				v = srl.read(n)
+				sgn[i] = int16(v)
+			}
+			cur[i] += int16(v << shift[b])
+		}
+	}
+
+	copy(pixels, current[:])
+	rfxProgInverseDWT(pixels, extrapolate)
+}
+
+// rfxSRLDecoder decodes the simplified run-length code of the coefficients
+// an upgrade pass makes non-zero (MS-RDPEGFX 3.2.8.1.3.2).  Its state
+// carries over the bands of a component.
+type rfxSRLDecoder struct {
+	br    rlgrBitReader
+	kp    int
+	nz    int  // zeros left in the current run
+	unary bool // a value follows the current run
+}
+
+func (s *rfxSRLDecoder) read(numBits int) int32 {
+	if s.nz > 0 {
+		s.nz--
+		return 0
+	}
+	k := s.kp / 8
+	if !s.unary {
+		if s.br.readBits(1) == 0 {
+			// A full run of 1<<k zeros.
+			s.nz = 1<<k - 1
+			s.kp = min(s.kp+4, 80)
+			return 0
+		}
+		// A shorter run, its length in k bits, then a value.
+		s.unary = true
+		if k > 0 {
+			s.nz = int(s.br.readBits(k))
+		}
+		if s.nz > 0 {
+			s.nz--
+			return 0
 		}
 	}
+	s.unary = false
+	negative := s.br.readBits(1) != 0
+	s.kp = max(s.kp-6, 0)
+	mag := int32(1)
+	if numBits > 1 {
+		for limit := int32(1)<<numBits - 1; mag < limit && s.br.readBits(1) == 0; {
+			mag++
+		}
+	}
+	if negative {
+		return -mag
+	}
+	return mag
+}
+
+// rfxProgInverseDWT performs the inverse DWT of a tile in place.
+func rfxProgInverseDWT(coeffs []int16, extrapolate bool) {
+	if !extrapolate {
+		rfxInverseDWT2D(coeffs)
+		return
+	}
+	bufs := idwtBufPool.Get().(*idwtBufs)
+	rfxIDWTExtrapolateLevel(coeffs[3807:], bufs.tmp, 3)
+	rfxIDWTExtrapolateLevel(coeffs[3007:], bufs.tmp, 2)
+	rfxIDWTExtrapolateLevel(coeffs[0:], bufs.tmp, 1)
+	idwtBufPool.Put(bufs)
+}
+
+// rfxIDWTExtrapolateLevel performs one level of the reduce-extrapolate
+// inverse DWT (MS-RDPEGFX 3.2.8.1.2.1).  buf contains [HL|LH|HH|LL], with
+// nL low and nH high coefficients per dimension, and is replaced with the
+// (nL+nH)×(nL+nH) result.
+func rfxIDWTExtrapolateLevel(buf, tmp []int16, level int) {
+	nL := 64>>level + 1
+	nH := (64 + 1<<(level-1)) >> level
+	if level == 1 {
+		nH = 64>>1 - 1
+	}
+	size := nL + nH
+	hl := buf[0:]
+	lh := buf[nH*nL:]
+	hh := buf[2*nH*nL:]
+	ll := buf[2*nH*nL+nH*nH:]
+	l := tmp[0:]
+	h := tmp[nL*size:]
+
+	// Horizontal: LL+HL -> L (nL rows), LH+HH -> H (nH rows).
+	for row := range nL {
+		rfxIDWTExtrapolate1D(ll[row*nL:], 1, hl[row*nH:], 1, l[row*size:], 1, nL, nH)
+	}
+	for row := range nH {
+		rfxIDWTExtrapolate1D(lh[row*nL:], 1, hh[row*nH:], 1, h[row*size:], 1, nL, nH)
+	}
+	// Vertical: L+H -> output.
+	for col := range size {
+		rfxIDWTExtrapolate1D(l[col:], size, h[col:], size, buf[col:], size, nL, nH)
+	}
+}
 
-	rfxDequantizeSkipLL3(work, quant)
-	rfxInverseDWT2D(work)
+// rfxIDWTExtrapolate1D reconstructs nL+nH samples, dst[i*dstStep], from
+// nL low and nH high band samples.
+func rfxIDWTExtrapolate1D(low []int16, lowStep int, high []int16, highStep int, dst []int16, dstStep, nL, nH int) {
+	L := func(i int) int32 { return int32(low[i*lowStep]) }
+	H := func(i int) int32 { return int32(high[i*highStep]) }
+	out := func(i int, v int32) { dst[i*dstStep] = int16(v) }
+
+	h0 := H(0)
+	x0 := L(0) - h0
+	x2 := x0
+	j := 0
+	for ; j < nH-1; j++ {
+		h1 := H(j + 1)
+		x2 = L(j+1) - (h0+h1)/2
+		out(2*j, x0)
+		out(2*j+1, (x0+x2)/2+2*h0)
+		x0 = x2
+		h0 = h1
+	}
+	o := 2 * j
+	switch {
+	case nL <= nH:
+		out(o, x2)
+		out(o+1, x2+2*h0)
+	case nL == nH+1:
+		x0 = L(j+1) - h0
+		out(o, x2)
+		out(o+1, (x0+x2)/2+2*h0)
+		out(o+2, x0)
+	default:
+		x0 = L(j+1) - h0/2
+		out(o, x2)
+		out(o+1, (x0+x2)/2+2*h0)
+		out(o+2, x0)
+		out(o+3, (x0+L(j+2))/2)
+	}
+}
 
-	return work, newRaw
+// rfxPlaceTileClipped converts the YCbCr planes of the tile at (xIdx, yIdx)
+// to BGRA and writes the parts inside rects to the output buffer, or the
+// whole tile when there are no rects.
+func rfxPlaceTileClipped(planes [3][]int16, xIdx, yIdx int, rects []rfxRect, output []byte, outW, outH int) {
+	tileX, tileY := xIdx*rfxTileSize, yIdx*rfxTileSize
+	if len(rects) == 0 {
+		rfxPlaceTileAbs(planes[0], planes[1], planes[2], tileX, tileY, output, outW, outH)
+		return
+	}
+	var tile [rfxTileSize * rfxTileSize * 4]byte
+	rfxPlaceTileAbs(planes[0], planes[1], planes[2], 0, 0, tile[:], rfxTileSize, rfxTileSize)
+	for _, rc := range rects {
+		x0, y0 := max(rc.x, tileX), max(rc.y, tileY)
+		x1 := min(rc.x+rc.w, tileX+rfxTileSize, outW)
+		y1 := min(rc.y+rc.h, tileY+rfxTileSize, outH)
+		if x0 >= x1 {
+			continue
+		}
+		for y := y0; y < y1; y++ {
+			dst := (y*outW + x0) * 4
+			src := ((y-tileY)*rfxTileSize + x0 - tileX) * 4
+			n := (x1 - x0) * 4
+			if dst+n > len(output) {
+				break
+			}
+			copy(output[dst:dst+n], tile[src:src+n])
+		}
+	}
 }
 
 // rfxDecodeComponent decodes one color component (Y, Cb, or Cr) for a 64×64 tile.
@@ -1,6 +1,7 @@
 package rdpgfx
 
 import (
+	"bytes"
 	"testing"
 )
 
@@ -55,3 +56,120 @@ func BenchmarkRfxInverseDWT2D(b *testing.B) {
 		rfxInverseDWT2D(coeffs)
 	}
 }
+
+// progRegion wraps tiles in a PROGRESSIVE_WBT_REGION covering one 64×64
+// tile, with quant 6 everywhere and progressive quality 0 leaving out one
+// bit of every band.
+func progRegion(tiles ...[]byte) []byte {
+	body := le(uint8(64), uint16(1), uint8(1), uint8(1), uint8(0), uint16(len(tiles)), uint32(0),
+		uint16(0), uint16(0), uint16(64), uint16(64))
+	body = append(body, 0x66, 0x66, 0x66, 0x66, 0x66)
+	body = append(body, 0)
+	body = append(body, bytes.Repeat([]byte{0x11}, 15)...)
+	for _, t := range tiles {
+		body = append(body, t...)
+	}
+	return append(le(uint16(progWBTRegion), uint32(6+len(body))), body...)
+}
+
+func progBlock(blockType uint16, hdr []byte, data ...[]byte) []byte {
+	body := hdr
+	for _, d := range data {
+		body = append(body, d...)
+	}
+	return append(le(blockType, uint32(6+len(body))), body...)
+}
+
+func TestProgressiveUpgrade(t *testing.T) {
+	// Luma with only LL3 coefficients: the upgrade pass then reads raw bits
+	// for LL3 only, and simplified run-length zeros for every other band.
+	coeffs := make([]int16, 4096)
+	for i := 4032; i < 4096; i++ {
+		coeffs[i] = int16(i%5 - 2)
+	}
+	y := rlgr1Encode(coeffs)
+
+	// A first pass at quality 0 followed by an upgrade setting the missing
+	// low bit of every LL3 coefficient.
+	first := progBlock(progWBTTileFirst,
+		le(uint8(0), uint8(0), uint8(0), uint16(0), uint16(0), uint8(0), uint8(0),
+			uint16(len(y)), uint16(0), uint16(0), uint16(0)), y)
+	raw := bytes.Repeat([]byte{0xFF}, 8)
+	upgrade := progBlock(progWBTTileUpgrade,
+		le(uint8(0), uint8(0), uint8(0), uint16(0), uint16(0), uint8(progQualityFull),
+			uint16(0), uint16(len(raw)), uint16(0), uint16(0), uint16(0), uint16(0)), raw)
+
+	// The same coefficients at full quality in a single simple tile.
+	full := make([]int16, 4096)
+	prev := int16(0)
+	for i := 4032; i < 4096; i++ {
+		prev += coeffs[i]
+		full[i] = 2*prev + 1
+	}
+	for i := 4095; i > 4032; i-- {
+		full[i] -= full[i-1]
+	}
+	yFull := rlgr1Encode(full)
+	simple := progBlock(progWBTTileSimple,
+		le(uint8(0), uint8(0), uint8(0), uint16(0), uint16(0), uint8(0),
+			uint16(len(yFull)), uint16(0), uint16(0), uint16(0)), yFull)
+
+	d := newRfxProgressiveDecoder()
+	got := make([]byte, 64*64*4)
+	d.Decode(progRegion(first), 1, got, 64, 64)
+	afterFirst := bytes.Clone(got)
+	d.Decode(progRegion(upgrade), 1, got, 64, 64)
+	if bytes.Equal(got, afterFirst) {
+		t.Fatal("upgrade pass did not change the tile")
+	}
+
+	want := make([]byte, 64*64*4)
+	newRfxProgressiveDecoder().Decode(progRegion(simple), 1, want, 64, 64)
+	if !bytes.Equal(got, want) {
+		t.Error("first pass plus upgrade differs from the full quality tile")
+	}
+
+	// Upgrades of tiles with no first pass are ignored.
+	other := make([]byte, 64*64*4)
+	d.Decode(progRegion(upgrade), 2, other, 64, 64)
+	if !bytes.Equal(other, make([]byte, len(other))) {
+		t.Error("upgrade decoded without a first pass")
+	}
+}
+
+func TestProgressiveExtrapolateDWT(t *testing.T) {
+	coeffs := make([]int16, 4096)
+	for i := rfxBandsExtrapolate[9].off; i < 4096; i++ {
+		coeffs[i] = 64
+	}
+	rfxProgInverseDWT(coeffs, true)
+	for i, v := range coeffs {
+		if v != 64 {
+			t.Fatalf("coeffs[%d] = %d, want 64", i, v)
+		}
+	}
+}
+
+func FuzzProgressiveDecode(f *testing.F) {
+	y := rlgr1Encode(make([]int16, 4096))
+	f.Add(progRegion(progBlock(progWBTTileSimple,
+		le(uint8(0), uint8(0), uint8(0), uint16(0), uint16(0), uint8(0),
+			uint16(len(y)), uint16(0), uint16(0), uint16(0)), y)))
+	f.Add(progRegion(progBlock(progWBTTileUpgrade,
+		le(uint8(0), uint8(0), uint8(0), uint16(0), uint16(0), uint8(progQualityFull),
+			uint16(0), uint16(8), uint16(0), uint16(0), uint16(0), uint16(0)), bytes.Repeat([]byte{0xFF}, 8))))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d := newRfxProgressiveDecoder()
+		surf := make([]byte, 96*80*4)
+		// a second pass upgrades the tiles of the first
+		d.Decode(data, 1, surf, 96, 80)
+		d.Decode(data, 1, surf, 96, 80)
+	})
+}
+
+func FuzzDecodeSurfaceRFX(f *testing.F) {
+	f.Add(le(uint16(wbtContext), uint32(13), uint8(1), uint8(0xFF), uint8(0), uint16(64), uint16(0x28)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DecodeSurfaceRFX(data, 96, 80)
+	})
+}
@@ -6,6 +6,10 @@ package rdpgfx
 
 const zgfxHistorySize = 2500000
 
+// zgfxSegmentMax is the most bytes a segment decompresses to; Decompress
+// stops at the literal, match or raw bytes that would go past it.
+const zgfxSegmentMax = 65535
+
 type zgfxContext struct {
 	history    []byte
 	historyIdx int
@@ -299,7 +303,8 @@ func (z *zgfxContext) outputLiteral(b byte, out *[]byte) {
 // matches (count > distance) are handled via byte-wise copy after the first
 // pass, since the pattern grows as it is written.
 func (z *zgfxContext) outputMatch(distance, count int, out *[]byte) {
-	if distance <= 0 || count <= 0 {
+	// a distance beyond the history is corrupt data
+	if distance <= 0 || count <= 0 || distance > zgfxHistorySize {
 		return
 	}
 	o := *out
@@ -386,7 +391,7 @@ func (z *zgfxContext) Decompress(data []byte, buf []byte) []byte {
 		// decodeToken already consumed prefixLen bits.
 
 		if token.tokenType == tokenLiteral {
-			if br.bitsRemaining < uint32(token.valueBits) {
+			if br.bitsRemaining < uint32(token.valueBits) || len(out) >= zgfxSegmentMax {
 				break
 			}
 			value := token.valueBase + br.getBits(token.valueBits)
@@ -402,7 +407,10 @@ func (z *zgfxContext) Decompress(data []byte, buf []byte) []byte {
 
 			if distance != 0 {
 				// Match: copy from history
-				count := z.decodeMatchCount(br)
+				count, ok := z.decodeMatchCount(br)
+				if !ok || len(out)+count > zgfxSegmentMax {
+					break
+				}
 				z.outputMatch(distance, count, &out)
 			} else {
 				// Unencoded: read raw bytes
@@ -414,11 +422,15 @@ func (z *zgfxContext) Decompress(data []byte, buf []byte) []byte {
 				// Discard remaining bits in current byte to align to byte boundary
 				// (equivalent to FreeRDP's cBitsCurrent = 0; BitsCurrent = 0;)
 				if br.bitPos < 8 {
+					if uint32(br.bitPos) > br.bitsRemaining {
+						break
+					}
 					br.bitsRemaining -= uint32(br.bitPos)
 					br.bytePos++
 					br.bitPos = 8
 				}
-				if br.bytePos+rawCount > len(br.data) || uint32(rawCount)*8 > br.bitsRemaining {
+				if br.bytePos+rawCount > len(br.data) || uint32(rawCount)*8 > br.bitsRemaining ||
+					len(out)+rawCount > zgfxSegmentMax {
 					break
 				}
 				rawBytes := br.data[br.bytePos : br.bytePos+rawCount]
@@ -465,29 +477,41 @@ func (z *zgfxContext) decodeToken(br *bitReader) (zgfxToken, bool) {
 //	110 + 3 bits → 8 + value  (8..15)
 //	1110 + 4 bits → 16 + value (16..31)
 //	... and so on (each additional leading 1 doubles the base and adds 1 extra bit)
-func (z *zgfxContext) decodeMatchCount(br *bitReader) int {
+//
+// It returns false when the input ends inside the count or the count
+// exceeds zgfxSegmentMax, which no valid segment needs.
+func (z *zgfxContext) decodeMatchCount(br *bitReader) (int, bool) {
+	if br.bitsRemaining == 0 {
+		return 0, false
+	}
 	bit := br.getBit()
 	br.bitsRemaining--
 	if bit == 0 {
-		return 3
+		return 3, true
 	}
 
 	count := 4
 	extra := uint8(2)
-
-	bit = br.getBit()
-	br.bitsRemaining--
-	for bit == 1 {
-		count <<= 1
-		extra++
+	for {
+		if br.bitsRemaining == 0 {
+			return 0, false
+		}
 		bit = br.getBit()
 		br.bitsRemaining--
+		if bit == 0 {
+			break
+		}
+		count <<= 1
+		extra++
+		if count > zgfxSegmentMax {
+			return 0, false
+		}
 	}
 
 	if br.bitsRemaining < uint32(extra) {
-		return count
+		return 0, false
 	}
 	count += int(br.getBits(extra))
 	br.bitsRemaining -= uint32(extra)
-	return count
+	return count, true
 }
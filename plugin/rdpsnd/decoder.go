@@ -0,0 +1,133 @@
+package rdpsnd
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Decoder decodes the waves of a compressed audio format into signed
+// 16-bit little-endian PCM.  aac.Decoder is one.
+type Decoder interface {
+	// Decode decodes the audio of one wave.
+	Decode(data []byte) ([]byte, error)
+	// Close releases the resources held by the decoder.
+	Close()
+}
+
+// NewDecoderFunc returns a Decoder for format, or an error if it cannot
+// decode that format; the format is then not offered to the server.
+type NewDecoderFunc func(format AudioFormat) (Decoder, error)
+
+// PCMFormat returns the format of the PCM a Decoder produces for f.
+func (f AudioFormat) PCMFormat() AudioFormat {
+	return AudioFormat{
+		Tag:            WAVE_FORMAT_PCM,
+		Channels:       f.Channels,
+		SamplesPerSec:  f.SamplesPerSec,
+		AvgBytesPerSec: f.SamplesPerSec * uint32(f.Channels) * 2,
+		BlockAlign:     f.Channels * 2,
+		BitsPerSample:  16,
+	}
+}
+
+// msADPCMAdaptation is the step adaptation table of Microsoft ADPCM.
+var msADPCMAdaptation = [16]int32{
+	230, 230, 230, 230, 307, 409, 512, 614,
+	768, 614, 512, 409, 307, 230, 230, 230,
+}
+
+// msADPCMCoefficients are the standard predictor coefficient pairs,
+// used when the format does not carry its own.
+var msADPCMCoefficients = [][2]int32{
+	{256, 0}, {512, -256}, {0, 0}, {192, 64}, {240, 0}, {460, -208}, {392, -232},
+}
+
+// msADPCMDecoder decodes WAVE_FORMAT_ADPCM (Microsoft ADPCM), 4 bits per
+// sample in blocks of BlockAlign bytes.
+type msADPCMDecoder struct {
+	channels   int
+	blockAlign int
+	coef       [][2]int32
+}
+
+// NewMSADPCMDecoder returns a Decoder for a WAVE_FORMAT_ADPCM format.
+func NewMSADPCMDecoder(f AudioFormat) (Decoder, error) {
+	if f.Tag != WAVE_FORMAT_ADPCM || f.BitsPerSample != 4 || (f.Channels != 1 && f.Channels != 2) {
+		return nil, fmt.Errorf("rdpsnd: cannot decode %v as MS-ADPCM", f)
+	}
+	d := &msADPCMDecoder{channels: int(f.Channels), blockAlign: int(f.BlockAlign), coef: msADPCMCoefficients}
+	if d.blockAlign < 7*d.channels {
+		return nil, fmt.Errorf("rdpsnd: MS-ADPCM block size %d", d.blockAlign)
+	}
+	// ExtraData: wSamplesPerBlock, wNumCoef, then the coefficient pairs.
+	if len(f.ExtraData) >= 4 {
+		n := int(binary.LittleEndian.Uint16(f.ExtraData[2:]))
+		if n > 0 && len(f.ExtraData) >= 4+4*n {
+			d.coef = make([][2]int32, n)
+			for i := range d.coef {
+				d.coef[i][0] = int32(int16(binary.LittleEndian.Uint16(f.ExtraData[4+4*i:])))
+				d.coef[i][1] = int32(int16(binary.LittleEndian.Uint16(f.ExtraData[6+4*i:])))
+			}
+		}
+	}
+	return d, nil
+}
+
+// Decode decodes the blocks of data; a trailing partial block is
+// decoded as far as it goes.
+func (d *msADPCMDecoder) Decode(data []byte) ([]byte, error) {
+	var out []byte
+	for len(data) > 0 {
+		n := min(d.blockAlign, len(data))
+		var err error
+		if out, err = d.decodeBlock(out, data[:n]); err != nil {
+			return out, err
+		}
+		data = data[n:]
+	}
+	return out, nil
+}
+
+func (d *msADPCMDecoder) decodeBlock(out, b []byte) ([]byte, error) {
+	ch := d.channels
+	if len(b) < 7*ch {
+		return out, fmt.Errorf("rdpsnd: MS-ADPCM block truncated")
+	}
+	// Block header: predictor indexes, then per channel the initial
+	// delta and two samples, the older second.
+	var pred [2]int
+	var delta, s1, s2 [2]int32
+	for c := range ch {
+		pred[c] = int(b[c])
+		if pred[c] >= len(d.coef) {
+			return out, fmt.Errorf("rdpsnd: MS-ADPCM predictor %d", pred[c])
+		}
+		delta[c] = int32(int16(binary.LittleEndian.Uint16(b[ch+2*c:])))
+		s1[c] = int32(int16(binary.LittleEndian.Uint16(b[3*ch+2*c:])))
+		s2[c] = int32(int16(binary.LittleEndian.Uint16(b[5*ch+2*c:])))
+	}
+	for c := range ch {
+		out = binary.LittleEndian.AppendUint16(out, uint16(s2[c]))
+	}
+	for c := range ch {
+		out = binary.LittleEndian.AppendUint16(out, uint16(s1[c]))
+	}
+	// Each byte holds two samples, the high nibble first; in stereo the
+	// samples alternate between the channels.
+	c := 0
+	for _, v := range b[7*ch:] {
+		for _, nibble := range [2]byte{v >> 4, v & 0x0F} {
+			coef := d.coef[pred[c]]
+			p := (s1[c]*coef[0] + s2[c]*coef[1]) >> 8
+			p += int32(int8(nibble<<4)>>4) * delta[c]
+			p = max(-32768, min(32767, p))
+			s2[c], s1[c] = s1[c], p
+			delta[c] = max(16, msADPCMAdaptation[nibble]*delta[c]>>8)
+			out = binary.LittleEndian.AppendUint16(out, uint16(p))
+			c = (c + 1) % ch
+		}
+	}
+	return out, nil
+}
+
+func (d *msADPCMDecoder) Close() {}
@@ -165,18 +165,61 @@ type Handler struct {
 	// Application callback: called with the active AudioFormat and PCM data
 	onAudio func(AudioFormat, []byte)
 
+	// decoders decode the compressed formats offered to the server;
+	// passthrough holds the tags of those delivered as received.  decoder
+	// decodes the server format decoderFormat.
+	decoders      map[uint16]NewDecoderFunc
+	passthrough   map[uint16]bool
+	decoder       Decoder
+	decoderFormat int
+
 	// onAudioReset is called when the server closes the audio channel
 	// (SNDC_CLOSE). The application should flush its audio playback buffer
 	// so that stale audio from before a seek does not keep playing.
 	onAudioReset func()
+
+	log *slog.Logger
 }
 
 // NewHandler creates a new RDPSND handler.
-// onAudio is called with the active AudioFormat and PCM audio data for each wave.
+// onAudio is called with the PCM audio data of each wave and its format, or
+// with the wave as received and the server format for passthrough formats.
+// MS-ADPCM is decoded and AAC passed through until SetDecoder and
+// SetPassthrough say otherwise.
 func NewHandler(onAudio func(AudioFormat, []byte)) *Handler {
 	return &Handler{
 		activeFormatIndex: -1,
 		onAudio:           onAudio,
+		decoders:          map[uint16]NewDecoderFunc{WAVE_FORMAT_ADPCM: NewMSADPCMDecoder},
+		passthrough:       map[uint16]bool{WAVE_FORMAT_AAC: true},
+		decoderFormat:     -1,
+		log:               core.Logger(nil, "rdpsnd"),
+	}
+}
+
+// SetLogger makes the handler log to l, with the attribute layer=rdpsnd.
+func (h *Handler) SetLogger(l *slog.Logger) {
+	h.log = core.Logger(l, "rdpsnd")
+}
+
+// SetDecoder makes the handler offer the server formats of tag, decoding
+// their waves with decoders from newDecoder; nil stops offering them.
+// Call it before the server sends its formats.
+func (h *Handler) SetDecoder(tag uint16, newDecoder NewDecoderFunc) {
+	if newDecoder == nil {
+		delete(h.decoders, tag)
+		return
+	}
+	h.decoders[tag] = newDecoder
+}
+
+// SetPassthrough makes the handler offer the server formats of tags and
+// deliver their waves as received, for applications that hand compressed
+// audio straight to their media pipeline.  It replaces the previous tags.
+func (h *Handler) SetPassthrough(tags ...uint16) {
+	h.passthrough = make(map[uint16]bool, len(tags))
+	for _, t := range tags {
+		h.passthrough[t] = true
 	}
 }
 
@@ -201,7 +244,7 @@ func (h *Handler) Sender(s core.ChannelSender) {
 func (h *Handler) Process(s []byte) {
 	defer func() {
 		if r := recover(); r != nil {
-			slog.Error("rdpsnd: panic in Process", "err", r)
+			h.log.Error("rdpsnd: panic in Process", "err", r)
 		}
 	}()
 	h.viaDvc = false
@@ -238,14 +281,15 @@ func (h *Handler) ProcessData(data []byte) {
 	case SNDC_WAVE2:
 		h.processWave2(body)
 	case SNDC_CLOSE:
-		slog.Debug("rdpsnd: server closed audio channel")
+		h.log.Debug("rdpsnd: server closed audio channel")
+		h.closeDecoder()
 		if h.onAudioReset != nil {
 			h.onAudioReset()
 		}
 	case SNDC_SETVOLUME, SNDC_QUALITYMODE:
 		// ignored
 	default:
-		slog.Debug("rdpsnd: unknown msgType", "type", fmt.Sprintf("0x%02x", msgType))
+		h.log.Debug("rdpsnd: unknown msgType", "type", fmt.Sprintf("0x%02x", msgType))
 	}
 }
 
@@ -253,7 +297,7 @@ func (h *Handler) ProcessData(data []byte) {
 
 func (h *Handler) processServerFormats(body []byte) {
 	if len(body) < 20 {
-		slog.Warn("rdpsnd: Server Formats PDU too short")
+		h.log.Warn("rdpsnd: Server Formats PDU too short")
 		return
 	}
 
@@ -262,7 +306,7 @@ func (h *Handler) processServerFormats(body []byte) {
 	wNumberOfFormats := binary.LittleEndian.Uint16(body[14:])
 	wVersion := binary.LittleEndian.Uint16(body[17:])
 
-	slog.Debug("rdpsnd: Server Formats", "version", wVersion, "numFormats", wNumberOfFormats)
+	h.log.Debug("rdpsnd: Server Formats", "version", wVersion, "numFormats", wNumberOfFormats)
 
 	offset := 20
 	h.serverFormats = nil
@@ -272,25 +316,40 @@ func (h *Handler) processServerFormats(body []byte) {
 			break
 		}
 		h.serverFormats = append(h.serverFormats, fmt)
-		slog.Debug("rdpsnd: server format", "idx", i, "fmt", fmt)
+		h.log.Debug("rdpsnd: server format", "idx", i, "fmt", fmt)
 		offset = newOffset
 	}
 
-	// Prefer AAC formats first (hardware-decoded on macOS), then fall back to PCM.
+	// Prefer the passthrough formats (by default AAC, hardware-decoded on
+	// macOS), then the decoded ones, then fall back to PCM.
+	h.closeDecoder()
 	h.clientFormatIndices = nil
 	for i, f := range h.serverFormats {
-		if f.IsAAC() {
+		if h.passthrough[f.Tag] {
 			h.clientFormatIndices = append(h.clientFormatIndices, i)
 		}
 	}
 	for i, f := range h.serverFormats {
-		if f.IsPCM() && (f.BitsPerSample == 8 || f.BitsPerSample == 16) && (f.Channels == 1 || f.Channels == 2) {
+		newDecoder := h.decoders[f.Tag]
+		if newDecoder == nil || f.IsPCM() || h.passthrough[f.Tag] {
+			continue
+		}
+		dec, err := newDecoder(f)
+		if err != nil {
+			h.log.Debug("rdpsnd: format not decoded", "fmt", f, "err", err)
+			continue
+		}
+		dec.Close()
+		h.clientFormatIndices = append(h.clientFormatIndices, i)
+	}
+	for i, f := range h.serverFormats {
+		if f.IsPCM() && !h.passthrough[f.Tag] && (f.BitsPerSample == 8 || f.BitsPerSample == 16) && (f.Channels == 1 || f.Channels == 2) {
 			h.clientFormatIndices = append(h.clientFormatIndices, i)
 		}
 	}
 
 	if len(h.clientFormatIndices) == 0 {
-		slog.Warn("rdpsnd: no supported PCM format found")
+		h.log.Warn("rdpsnd: no supported audio format found")
 	}
 
 	h.sendClientFormats(wVersion)
@@ -325,7 +384,7 @@ func (h *Handler) sendClientFormats(serverVersion uint16) {
 	pdu.Write(body)
 
 	h.send(pdu.Bytes())
-	slog.Debug("rdpsnd: sent Client Formats", "version", version, "numFormats", len(h.clientFormatIndices))
+	h.log.Debug("rdpsnd: sent Client Formats", "version", version, "numFormats", len(h.clientFormatIndices))
 
 	// FreeRDP sends a Quality Mode PDU immediately after Client Formats.
 	// Without it, Windows waits (up to ~10 seconds) before sending Training.
@@ -342,7 +401,7 @@ func (h *Handler) sendQualityMode() {
 	binary.LittleEndian.PutUint16(pdu[4:], HIGH_QUALITY)
 	// pdu[6:8] = Reserved, already zero
 	h.send(pdu[:])
-	slog.Debug("rdpsnd: sent QualityMode")
+	h.log.Debug("rdpsnd: sent QualityMode")
 }
 
 // --- Training (MS-RDPEA 2.2.2.3) ---
@@ -353,20 +412,20 @@ func (h *Handler) processTraining(body []byte) {
 	}
 	wTimeStamp := binary.LittleEndian.Uint16(body[0:])
 	wPackSize := binary.LittleEndian.Uint16(body[2:])
-	slog.Debug("rdpsnd: Training", "timestamp", wTimeStamp, "packSize", wPackSize)
+	h.log.Debug("rdpsnd: Training", "timestamp", wTimeStamp, "packSize", wPackSize)
 
 	pdu := [8]byte{SNDC_TRAINING, 0, 4, 0} // msgType, bPad, bodySize=4 (LE)
 	binary.LittleEndian.PutUint16(pdu[4:], wTimeStamp)
 	binary.LittleEndian.PutUint16(pdu[6:], wPackSize)
 	h.send(pdu[:])
-	slog.Debug("rdpsnd: sent Training Confirm")
+	h.log.Debug("rdpsnd: sent Training Confirm")
 }
 
 // --- Wave Info / Wave Data (MS-RDPEA 2.2.2.5 / 2.2.2.6) ---
 
 func (h *Handler) processWaveInfo(body []byte) {
 	if len(body) < 12 {
-		slog.Warn("rdpsnd: WaveInfo body too short")
+		h.log.Warn("rdpsnd: WaveInfo body too short")
 		return
 	}
 
@@ -383,11 +442,11 @@ func (h *Handler) processWaveInfo(body []byte) {
 		serverIdx := h.clientFormatIndices[wFormatNo]
 		h.activeFormatIndex = serverIdx
 	} else {
-		slog.Warn("rdpsnd: WaveInfo format index out of range", "idx", wFormatNo, "max", len(h.clientFormatIndices))
+		h.log.Warn("rdpsnd: WaveInfo format index out of range", "idx", wFormatNo, "max", len(h.clientFormatIndices))
 	}
 
 	h.expectingWave = true
-	slog.Debug("rdpsnd: WaveInfo", "ts", wTimeStamp, "fmt", wFormatNo, "block", cBlockNo)
+	h.log.Debug("rdpsnd: WaveInfo", "ts", wTimeStamp, "fmt", wFormatNo, "block", cBlockNo)
 }
 
 func (h *Handler) processWaveBody(data []byte) {
@@ -401,7 +460,7 @@ func (h *Handler) processWaveBody(data []byte) {
 	}
 	h.pendingWave = nil
 
-	slog.Debug("rdpsnd: Wave data", "len", len(audioData))
+	h.log.Debug("rdpsnd: Wave data", "len", len(audioData))
 	h.deliverAudio(audioData)
 	var confirmFmt AudioFormat
 	if h.activeFormatIndex >= 0 && h.activeFormatIndex < len(h.serverFormats) {
@@ -414,7 +473,7 @@ func (h *Handler) processWaveBody(data []byte) {
 
 func (h *Handler) processWave2(body []byte) {
 	if len(body) < 12 {
-		slog.Warn("rdpsnd: Wave2 body too short")
+		h.log.Warn("rdpsnd: Wave2 body too short")
 		return
 	}
 
@@ -427,10 +486,10 @@ func (h *Handler) processWave2(body []byte) {
 		serverIdx := h.clientFormatIndices[wFormatNo]
 		h.activeFormatIndex = serverIdx
 	} else {
-		slog.Warn("rdpsnd: Wave2 format index out of range", "idx", wFormatNo, "max", len(h.clientFormatIndices))
+		h.log.Warn("rdpsnd: Wave2 format index out of range", "idx", wFormatNo, "max", len(h.clientFormatIndices))
 	}
 
-	slog.Debug("rdpsnd: Wave2", "ts", wTimeStamp, "fmt", wFormatNo, "block", cBlockNo, "dataLen", len(audioData))
+	h.log.Debug("rdpsnd: Wave2", "ts", wTimeStamp, "fmt", wFormatNo, "block", cBlockNo, "dataLen", len(audioData))
 	h.deliverAudio(audioData)
 	var confirmFmt AudioFormat
 	if h.activeFormatIndex >= 0 && h.activeFormatIndex < len(h.serverFormats) {
@@ -462,7 +521,7 @@ func (h *Handler) sendWaveConfirm(timestamp uint16, blockNo uint8) {
 	pdu[6] = blockNo
 	// pdu[7] = bPad (zero)
 	h.send(pdu[:])
-	slog.Debug("rdpsnd: sent WaveConfirm", "ts", timestamp, "block", blockNo)
+	h.log.Debug("rdpsnd: sent WaveConfirm", "ts", timestamp, "block", blockNo)
 }
 
 // --- Audio delivery ---
@@ -471,7 +530,40 @@ func (h *Handler) deliverAudio(data []byte) {
 	if h.onAudio == nil || h.activeFormatIndex < 0 || h.activeFormatIndex >= len(h.serverFormats) {
 		return
 	}
-	h.onAudio(h.serverFormats[h.activeFormatIndex], data)
+	f := h.serverFormats[h.activeFormatIndex]
+	if f.IsPCM() || h.passthrough[f.Tag] {
+		h.onAudio(f, data)
+		return
+	}
+	if h.decoderFormat != h.activeFormatIndex {
+		h.closeDecoder()
+		newDecoder := h.decoders[f.Tag]
+		if newDecoder == nil {
+			return
+		}
+		dec, err := newDecoder(f)
+		if err != nil {
+			h.log.Warn("rdpsnd: create decoder", "fmt", f, "err", err)
+			return
+		}
+		h.decoder, h.decoderFormat = dec, h.activeFormatIndex
+	}
+	pcm, err := h.decoder.Decode(data)
+	if err != nil {
+		h.log.Warn("rdpsnd: decode wave", "fmt", f, "err", err)
+	}
+	if len(pcm) > 0 {
+		h.onAudio(f.PCMFormat(), pcm)
+	}
+}
+
+// closeDecoder closes the decoder of the previous format.
+func (h *Handler) closeDecoder() {
+	if h.decoder != nil {
+		h.decoder.Close()
+		h.decoder = nil
+	}
+	h.decoderFormat = -1
 }
 
 // --- Send helpers ---
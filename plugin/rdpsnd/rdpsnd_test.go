@@ -0,0 +1,107 @@
+package rdpsnd
+
+import (
+	"encoding/binary"
+	"slices"
+	"testing"
+)
+
+var (
+	pcmFormat   = AudioFormat{Tag: WAVE_FORMAT_PCM, Channels: 2, SamplesPerSec: 44100, AvgBytesPerSec: 176400, BlockAlign: 4, BitsPerSample: 16}
+	adpcmFormat = AudioFormat{Tag: WAVE_FORMAT_ADPCM, Channels: 1, SamplesPerSec: 22050, AvgBytesPerSec: 11155, BlockAlign: 8, BitsPerSample: 4}
+	aacFormat   = AudioFormat{Tag: WAVE_FORMAT_AAC, Channels: 2, SamplesPerSec: 48000, AvgBytesPerSec: 24000, BlockAlign: 4, BitsPerSample: 16}
+)
+
+// adpcmBlock is a mono block predicting with 256, 0 from the samples 100
+// and, older, 50; its zero nibbles hold the value.
+var adpcmBlock = []byte{0, 16, 0, 100, 0, 50, 0, 0x00}
+
+func samples(b []byte) []int16 {
+	s := make([]int16, len(b)/2)
+	for i := range s {
+		s[i] = int16(binary.LittleEndian.Uint16(b[2*i:]))
+	}
+	return s
+}
+
+func TestMSADPCMDecode(t *testing.T) {
+	d, err := NewMSADPCMDecoder(adpcmFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm, err := d.Decode(append(slices.Clone(adpcmBlock), adpcmBlock...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := samples(pcm), []int16{50, 100, 100, 100, 50, 100, 100, 100}; !slices.Equal(got, want) {
+		t.Errorf("samples %v, want %v", got, want)
+	}
+	if _, err := NewMSADPCMDecoder(pcmFormat); err == nil {
+		t.Error("PCM accepted as MS-ADPCM")
+	}
+}
+
+type sendRecorder struct {
+	pdus [][]byte
+}
+
+func (s *sendRecorder) SendToChannel(channel string, b []byte) (int, error) {
+	s.pdus = append(s.pdus, slices.Clone(b))
+	return len(b), nil
+}
+
+func pdu(msgType byte, body []byte) []byte {
+	b := []byte{msgType, 0}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(body)))
+	return append(b, body...)
+}
+
+func TestFormatNegotiation(t *testing.T) {
+	type wave struct {
+		f    AudioFormat
+		data []byte
+	}
+	var got []wave
+	h := NewHandler(func(f AudioFormat, b []byte) {
+		got = append(got, wave{f, slices.Clone(b)})
+	})
+	rec := &sendRecorder{}
+	h.Sender(rec)
+
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint16(body[14:], 3)
+	binary.LittleEndian.PutUint16(body[17:], RDPSND_VERSION_MAJOR)
+	for _, f := range []AudioFormat{pcmFormat, adpcmFormat, aacFormat} {
+		body = append(body, f.pack()...)
+	}
+	h.Process(pdu(SNDC_FORMATS, body))
+	if len(rec.pdus) == 0 {
+		t.Fatal("no Client Formats PDU")
+	}
+	var tags []uint16
+	for off := 24; off < len(rec.pdus[0]); {
+		f, next := unpackAudioFormat(rec.pdus[0], off)
+		tags = append(tags, f.Tag)
+		off = next
+	}
+	if want := []uint16{WAVE_FORMAT_AAC, WAVE_FORMAT_ADPCM, WAVE_FORMAT_PCM}; !slices.Equal(tags, want) {
+		t.Fatalf("client formats %v, want %v", tags, want)
+	}
+
+	wave2 := func(formatNo uint16, data []byte) []byte {
+		b := make([]byte, 12)
+		binary.LittleEndian.PutUint16(b[2:], formatNo)
+		return pdu(SNDC_WAVE2, append(b, data...))
+	}
+	h.Process(wave2(1, adpcmBlock))
+	h.Process(wave2(0, []byte{0x21, 0x10}))
+	if len(got) != 2 {
+		t.Fatalf("%d waves delivered", len(got))
+	}
+	if got[0].f.String() != adpcmFormat.PCMFormat().String() || !slices.Equal(samples(got[0].data), []int16{50, 100, 100, 100}) {
+		t.Errorf("ADPCM wave delivered as %v %v", got[0].f, samples(got[0].data))
+	}
+	if got[1].f.Tag != WAVE_FORMAT_AAC || !slices.Equal(got[1].data, []byte{0x21, 0x10}) {
+		t.Errorf("AAC wave delivered as %v %x", got[1].f, got[1].data)
+	}
+}
@@ -0,0 +1,322 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// ChannelPlugin is a virtual channel implemented outside grdp.  Register
+// it with RdpClient.RegisterStaticChannel or RegisterDynamicChannel
+// before connecting.
+//
+// The callbacks of one plugin are called in order on a goroutine of its
+// own, so a slow plugin delays neither the connection nor the other
+// channels.
+type ChannelPlugin interface {
+	// OnOpen is called when the channel opens; w sends PDUs to the
+	// server until OnClose.
+	OnOpen(w ChannelWriter)
+	// OnData is called with each complete PDU the server sends.  The
+	// plugin owns data.
+	OnData(data []byte)
+	// OnClose is called when the server closes the channel or the
+	// connection ends.  A dynamic channel may be opened again afterwards.
+	OnClose()
+}
+
+// ChannelWriter sends PDUs on an open channel.  Each Write sends p as one
+// PDU, split into the chunks the channel type needs; it is safe to call
+// from any goroutine.
+type ChannelWriter interface {
+	Write(p []byte) (int, error)
+}
+
+// ErrChannelClosed is returned by the ChannelWriter of a channel that has
+// been closed.
+var ErrChannelClosed = errors.New("virtual channel closed")
+
+// CHANNEL_NAME_LEN is the longest static channel name, without the
+// terminating null (MS-RDPBCGR 2.2.1.3.4.1).
+const CHANNEL_NAME_LEN = 7
+
+// dispatcher runs the callbacks of one plugin in order on its own
+// goroutine.  Its queue is unbounded so that the connection's reader
+// never blocks on a plugin.
+type dispatcher struct {
+	mu     sync.Mutex
+	queue  []func()
+	wake   chan struct{}
+	closed bool
+	log    *slog.Logger // used on the dispatcher goroutine only
+}
+
+func newDispatcher(log *slog.Logger) *dispatcher {
+	d := &dispatcher{wake: make(chan struct{}, 1), log: log}
+	go d.run()
+	return d
+}
+
+func (d *dispatcher) post(f func()) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.queue = append(d.queue, f)
+	d.mu.Unlock()
+	d.signal()
+}
+
+// stop queues f as the last callback; the goroutine exits after it.
+func (d *dispatcher) stop(f func()) {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return
+	}
+	d.queue = append(d.queue, f)
+	d.closed = true
+	d.mu.Unlock()
+	d.signal()
+}
+
+func (d *dispatcher) signal() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dispatcher) run() {
+	for range d.wake {
+		for {
+			d.mu.Lock()
+			if len(d.queue) == 0 {
+				done := d.closed
+				d.mu.Unlock()
+				if done {
+					return
+				}
+				break
+			}
+			f := d.queue[0]
+			d.queue[0] = nil
+			d.queue = d.queue[1:]
+			d.mu.Unlock()
+			d.call(f)
+		}
+	}
+}
+
+func (d *dispatcher) call(f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.log.Error("channel plugin panic", "err", r)
+		}
+	}()
+	f()
+}
+
+// session tracks whether a plugin is open and hands its callbacks to the
+// dispatcher.  The writer of each open gets invalidated by the close
+// that follows it.
+type session struct {
+	p  ChannelPlugin
+	d  *dispatcher
+	mu sync.Mutex
+	w  *sessionWriter
+}
+
+func newSession(name string, p ChannelPlugin) *session {
+	return &session{p: p, d: newDispatcher(sessionLogger(nil, name))}
+}
+
+func sessionLogger(l *slog.Logger, name string) *slog.Logger {
+	return core.Logger(l, "plugin").With(core.LogChannel, name)
+}
+
+// setLogger replaces the logger of the dispatcher from its goroutine.
+func (s *session) setLogger(l *slog.Logger) {
+	s.d.post(func() { s.d.log = l })
+}
+
+// open calls OnOpen unless the plugin is already open.
+func (s *session) open(send func([]byte) (int, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w != nil {
+		return
+	}
+	w := &sessionWriter{send: send}
+	s.w = w
+	s.d.post(func() { s.p.OnOpen(w) })
+}
+
+func (s *session) data(send func([]byte) (int, error), data []byte) {
+	s.open(send)
+	data = append([]byte(nil), data...)
+	s.d.post(func() { s.p.OnData(data) })
+}
+
+// close calls OnClose if the plugin is open; with final the dispatcher
+// goroutine exits afterwards.
+func (s *session) close(final bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w := s.w
+	s.w = nil
+	f := func() {}
+	if w != nil {
+		w.close()
+		f = s.p.OnClose
+	}
+	if final {
+		s.d.stop(f)
+	} else if w != nil {
+		s.d.post(f)
+	}
+}
+
+type sessionWriter struct {
+	mu     sync.Mutex
+	send   func([]byte) (int, error)
+	closed bool
+}
+
+func (w *sessionWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrChannelClosed
+	}
+	return w.send(p)
+}
+
+func (w *sessionWriter) close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+}
+
+// StaticChannel serves a static virtual channel with a ChannelPlugin.
+// It is a ChannelTransport for Channels.Register.  The plugin opens when
+// Open is called or when the first PDU arrives, whichever comes first.
+type StaticChannel struct {
+	name    string
+	options uint32
+	s       *session
+	sender  core.ChannelSender
+}
+
+// NewStaticChannel returns the channel name (at most CHANNEL_NAME_LEN
+// characters) with the CHANNEL_OPTION_* flags options, served by p.
+func NewStaticChannel(name string, options uint32, p ChannelPlugin) (*StaticChannel, error) {
+	if name == "" || len(name) > CHANNEL_NAME_LEN {
+		return nil, fmt.Errorf("static channel name %q: must be 1 to %d characters", name, CHANNEL_NAME_LEN)
+	}
+	return &StaticChannel{name: name, options: options, s: newSession(name, p)}, nil
+}
+
+func (c *StaticChannel) GetType() (string, uint32) {
+	return c.name, c.options
+}
+
+func (c *StaticChannel) Sender(f core.ChannelSender) {
+	c.sender = f
+}
+
+func (c *StaticChannel) Process(data []byte) {
+	c.s.data(c.send, data)
+}
+
+// SetLogger makes the channel log the panics of its plugin to l.
+func (c *StaticChannel) SetLogger(l *slog.Logger) {
+	c.s.setLogger(sessionLogger(l, c.name))
+}
+
+// Open opens the plugin once the channel has been joined.
+func (c *StaticChannel) Open() {
+	c.s.open(c.send)
+}
+
+// Close closes the plugin and stops its goroutine.
+func (c *StaticChannel) Close() {
+	c.s.close(true)
+}
+
+func (c *StaticChannel) send(p []byte) (int, error) {
+	if c.sender == nil {
+		return 0, fmt.Errorf("static channel %s: not registered", c.name)
+	}
+	return c.sender.SendToChannel(c.name, p)
+}
+
+// DynamicChannel serves a dynamic virtual channel with a ChannelPlugin.
+// Register it with the drdynvc client under its name: the plugin opens
+// each time the server creates the channel and closes when the server
+// closes it.
+type DynamicChannel struct {
+	name   string
+	s      *session
+	mu     sync.Mutex
+	sendFn func([]byte)
+}
+
+// NewDynamicChannel returns the dynamic channel name served by p.
+func NewDynamicChannel(name string, p ChannelPlugin) *DynamicChannel {
+	return &DynamicChannel{name: name, s: newSession(name, p)}
+}
+
+// Name returns the channel name.
+func (c *DynamicChannel) Name() string {
+	return c.name
+}
+
+// SetLogger makes the channel log the panics of its plugin to l.
+func (c *DynamicChannel) SetLogger(l *slog.Logger) {
+	c.s.setLogger(sessionLogger(l, c.name))
+}
+
+// SetSendFunc is called by the drdynvc client when the server creates
+// the channel.
+func (c *DynamicChannel) SetSendFunc(f func([]byte)) {
+	c.mu.Lock()
+	c.sendFn = f
+	c.mu.Unlock()
+}
+
+// OnChannelCreated is called by the drdynvc client once it has accepted
+// the channel.
+func (c *DynamicChannel) OnChannelCreated() {
+	c.s.open(c.send)
+}
+
+// OnChannelClosed is called by the drdynvc client when the server closes
+// the channel.
+func (c *DynamicChannel) OnChannelClosed() {
+	c.s.close(false)
+}
+
+func (c *DynamicChannel) Process(data []byte) {
+	c.s.data(c.send, data)
+}
+
+// Close closes the plugin and stops its goroutine.
+func (c *DynamicChannel) Close() {
+	c.s.close(true)
+}
+
+func (c *DynamicChannel) send(p []byte) (int, error) {
+	c.mu.Lock()
+	f := c.sendFn
+	c.mu.Unlock()
+	if f == nil {
+		return 0, ErrChannelClosed
+	}
+	f(p)
+	return len(p), nil
+}
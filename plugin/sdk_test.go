@@ -0,0 +1,90 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/testutil"
+)
+
+// echoPlugin records its callbacks and writes every PDU back.
+type echoPlugin struct {
+	events chan string
+	w      ChannelWriter
+}
+
+func newEchoPlugin() *echoPlugin { return &echoPlugin{events: make(chan string, 16)} }
+
+func (p *echoPlugin) OnOpen(w ChannelWriter) { p.w = w; p.events <- "open" }
+func (p *echoPlugin) OnData(data []byte) {
+	p.w.Write(data)
+	p.events <- "data " + string(data)
+}
+func (p *echoPlugin) OnClose() { p.events <- "close" }
+
+func (p *echoPlugin) expect(t *testing.T, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-p.events:
+			if got != w {
+				t.Fatalf("got %q, want %q", got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", w)
+		}
+	}
+}
+
+func TestStaticChannelPlugin(t *testing.T) {
+	if _, err := NewStaticChannel("telemetry", 0, newEchoPlugin()); err == nil {
+		t.Error("accepted a name longer than 7 characters")
+	}
+	c := NewChannels(testutil.NewTransport())
+	rec := &chunkRecorder{}
+	c.SetChannelSender(rec)
+	p := newEchoPlugin()
+	sc, err := NewStaticChannel("telem", CHANNEL_OPTION_INITIALIZED, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Register(sc)
+
+	c.process("telem", chunk(2, CHANNEL_FLAG_FIRST|CHANNEL_FLAG_LAST, []byte("hi")))
+	sc.Open()
+	p.expect(t, "open", "data hi")
+	if len(rec.chunks) != 1 || !bytes.Equal(rec.chunks[0], chunk(2, CHANNEL_FLAG_FIRST|CHANNEL_FLAG_LAST, []byte("hi"))) {
+		t.Errorf("sent %x", rec.chunks)
+	}
+	sc.Close()
+	p.expect(t, "close")
+	if _, err := p.w.Write([]byte("x")); !errors.Is(err, ErrChannelClosed) {
+		t.Errorf("Write after close = %v", err)
+	}
+}
+
+func TestDynamicChannelPlugin(t *testing.T) {
+	p := newEchoPlugin()
+	dc := NewDynamicChannel("Example::Telemetry", p)
+	var sent [][]byte
+	dc.SetSendFunc(func(b []byte) { sent = append(sent, bytes.Clone(b)) })
+	dc.OnChannelCreated()
+	dc.Process([]byte("a"))
+	p.expect(t, "open", "data a")
+	if len(sent) != 1 || string(sent[0]) != "a" {
+		t.Errorf("sent %q", sent)
+	}
+
+	w := p.w
+	dc.OnChannelClosed()
+	p.expect(t, "close")
+	if _, err := w.Write([]byte("x")); !errors.Is(err, ErrChannelClosed) {
+		t.Errorf("Write after close = %v", err)
+	}
+	dc.OnChannelCreated()
+	p.expect(t, "open")
+	dc.Close()
+	p.expect(t, "close")
+}
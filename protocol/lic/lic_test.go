@@ -0,0 +1,18 @@
+package lic
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nakagami/grdp/core"
+)
+
+func FuzzReadLicensePacket(f *testing.F) {
+	// STATUS_VALID_CLIENT
+	f.Add([]byte{0xff, 0x03, 0x10, 0x00, 0x07, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00})
+	f.Add([]byte{LICENSE_REQUEST, 0x03, 0x08, 0x00, 1, 2, 3, 4})
+	f.Add([]byte{LICENSE_REQUEST, 0x03, 0x02, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadLicensePacket(core.NewErrReader(bytes.NewReader(data)))
+	})
+}
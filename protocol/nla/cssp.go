@@ -1,8 +1,49 @@
 package nla
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
 	"encoding/asn1"
-	"log/slog"
+	"errors"
+	"fmt"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// ErrMITMDetected is matched (via errors.Is) by every PubKeyAuthError.
+var ErrMITMDetected = errors.New("nla: server public key verification failed, possible man-in-the-middle")
+
+// PubKeyAuthError reports that the server's pubKeyAuth response did not
+// prove knowledge of the TLS public key, i.e. the TLS endpoint is not
+// the host that completed the NTLM exchange.
+type PubKeyAuthError struct {
+	Version int    // negotiated CredSSP version
+	Reason  string // what did not match
+}
+
+func (e *PubKeyAuthError) Error() string {
+	return fmt.Sprintf("%v (CredSSP v%d: %s)", ErrMITMDetected, e.Version, e.Reason)
+}
+
+func (e *PubKeyAuthError) Is(target error) bool {
+	return target == ErrMITMDetected
+}
+
+// CredSSP protocol versions (MS-CSSP 2.2.1).  Version 5 introduced the
+// clientNonce and the SHA-256 public key binding that mitigates
+// CVE-2018-0886; version 6 only adds the errorCode semantics.
+const (
+	CREDSSP_VERSION_MIN = 2
+	CREDSSP_VERSION_5   = 5
+	CREDSSP_VERSION     = 6
+)
+
+const (
+	clientServerHashMagic = "CredSSP Client-To-Server Binding Hash\x00"
+	serverClientHashMagic = "CredSSP Server-To-Client Binding Hash\x00"
 )
 
 type NegoToken struct {
@@ -10,11 +51,87 @@ type NegoToken struct {
 }
 
 type TSRequest struct {
-	Version    int         `asn1:"explicit,tag:0"`
-	NegoTokens []NegoToken `asn1:"optional,explicit,tag:1"`
-	AuthInfo   []byte      `asn1:"optional,explicit,tag:2"`
-	PubKeyAuth []byte      `asn1:"optional,explicit,tag:3"`
-	//ErrorCode  int         `asn1:"optional,explicit,tag:4"`
+	Version     int         `asn1:"explicit,tag:0"`
+	NegoTokens  []NegoToken `asn1:"optional,explicit,tag:1"`
+	AuthInfo    []byte      `asn1:"optional,explicit,tag:2"`
+	PubKeyAuth  []byte      `asn1:"optional,explicit,tag:3"`
+	ErrorCode   int64       `asn1:"optional,explicit,tag:4"`
+	ClientNonce []byte      `asn1:"optional,explicit,tag:5"`
+}
+
+// NTSTATUS values reported in TSRequest.errorCode (MS-ERREF 2.3.1).
+const (
+	STATUS_NO_SUCH_USER           = 0xC0000064
+	STATUS_WRONG_PASSWORD         = 0xC000006A
+	STATUS_LOGON_FAILURE          = 0xC000006D
+	STATUS_ACCOUNT_RESTRICTION    = 0xC000006E
+	STATUS_INVALID_LOGON_HOURS    = 0xC000006F
+	STATUS_INVALID_WORKSTATION    = 0xC0000070
+	STATUS_PASSWORD_EXPIRED       = 0xC0000071
+	STATUS_ACCOUNT_DISABLED       = 0xC0000072
+	STATUS_LOGON_TYPE_NOT_GRANTED = 0xC000015B
+	STATUS_ACCOUNT_EXPIRED        = 0xC0000193
+	STATUS_PASSWORD_MUST_CHANGE   = 0xC0000224
+	STATUS_ACCOUNT_LOCKED_OUT     = 0xC0000234
+)
+
+// Errors matched (via errors.Is) by CredSSPError values.
+var (
+	ErrBadCredentials     = errors.New("nla: logon failure: unknown user name or bad password")
+	ErrAccountLockedOut   = errors.New("nla: account locked out")
+	ErrAccountDisabled    = errors.New("nla: account disabled")
+	ErrAccountExpired     = errors.New("nla: account expired")
+	ErrPasswordExpired    = errors.New("nla: password expired")
+	ErrPasswordMustChange = errors.New("nla: password must be changed before logon")
+	ErrLogonRestricted    = errors.New("nla: account restrictions prevent logon")
+)
+
+// CredSSPError is returned when the server aborts CredSSP with an
+// errorCode (CredSSP v3 and later).
+type CredSSPError struct {
+	Code uint32 // NTSTATUS
+}
+
+func (e *CredSSPError) Error() string {
+	if base := e.base(); base != nil {
+		return fmt.Sprintf("%v (NTSTATUS 0x%08X)", base, e.Code)
+	}
+	return fmt.Sprintf("nla: CredSSP failed with NTSTATUS 0x%08X", e.Code)
+}
+
+func (e *CredSSPError) Is(target error) bool {
+	base := e.base()
+	return base != nil && target == base
+}
+
+func (e *CredSSPError) base() error {
+	switch e.Code {
+	case STATUS_NO_SUCH_USER, STATUS_WRONG_PASSWORD, STATUS_LOGON_FAILURE:
+		return ErrBadCredentials
+	case STATUS_ACCOUNT_LOCKED_OUT:
+		return ErrAccountLockedOut
+	case STATUS_ACCOUNT_DISABLED:
+		return ErrAccountDisabled
+	case STATUS_ACCOUNT_EXPIRED:
+		return ErrAccountExpired
+	case STATUS_PASSWORD_EXPIRED:
+		return ErrPasswordExpired
+	case STATUS_PASSWORD_MUST_CHANGE:
+		return ErrPasswordMustChange
+	case STATUS_ACCOUNT_RESTRICTION, STATUS_INVALID_LOGON_HOURS,
+		STATUS_INVALID_WORKSTATION, STATUS_LOGON_TYPE_NOT_GRANTED:
+		return ErrLogonRestricted
+	}
+	return nil
+}
+
+// Err returns a *CredSSPError when the request carries a non-zero
+// errorCode and nil otherwise.
+func (r *TSRequest) Err() error {
+	if r.ErrorCode == 0 {
+		return nil
+	}
+	return &CredSSPError{Code: uint32(r.ErrorCode)}
 }
 
 type TSCredentials struct {
@@ -28,24 +145,106 @@ type TSPasswordCreds struct {
 	Password   []byte `asn1:"explicit,tag:2"`
 }
 
+// credType values of TSCredentials
+const (
+	CRED_TYPE_PASSWORD     = 1
+	CRED_TYPE_SMARTCARD    = 2
+	CRED_TYPE_REMOTE_GUARD = 6
+)
+
+// TSRemoteGuardCreds carries the logon credential of a security package
+// for Remote Credential Guard; the secret itself never reaches the
+// server.  See MS-CSSP 2.2.1.2.3.
+type TSRemoteGuardCreds struct {
+	LogonCred         TSRemoteGuardPackageCred   `asn1:"explicit,tag:0"`
+	SupplementalCreds []TSRemoteGuardPackageCred `asn1:"optional,explicit,tag:1"`
+}
+
+// TSRemoteGuardPackageCred is a package-specific credential buffer, e.g.
+// a KERB_TICKET_LOGON for the "Kerberos" package.  PackageName is UTF-16LE.
+type TSRemoteGuardPackageCred struct {
+	PackageName []byte `asn1:"explicit,tag:0"`
+	CredBuffer  []byte `asn1:"explicit,tag:1"`
+}
+
+// NewRemoteGuardPackageCred builds a TSRemoteGuardPackageCred for the
+// named security package.
+func NewRemoteGuardPackageCred(packageName string, credBuffer []byte) TSRemoteGuardPackageCred {
+	return TSRemoteGuardPackageCred{
+		PackageName: core.UnicodeEncode(packageName),
+		CredBuffer:  credBuffer,
+	}
+}
+
+// keySpec values of TSCspDataDetail
+const (
+	AT_KEYEXCHANGE = 1
+	AT_SIGNATURE   = 2
+)
+
+// TSCspDataDetail identifies the card, reader and key container;
+// the string fields are UTF-16LE.  See MS-CSSP 2.2.1.2.2.1.
 type TSCspDataDetail struct {
 	KeySpec       int    `asn1:"explicit,tag:0"`
-	CardName      string `asn1:"explicit,tag:1"`
-	ReaderName    string `asn1:"explicit,tag:2"`
-	ContainerName string `asn1:"explicit,tag:3"`
-	CspName       string `asn1:"explicit,tag:4"`
+	CardName      []byte `asn1:"optional,explicit,tag:1"`
+	ReaderName    []byte `asn1:"optional,explicit,tag:2"`
+	ContainerName []byte `asn1:"optional,explicit,tag:3"`
+	CspName       []byte `asn1:"optional,explicit,tag:4"`
 }
 
+// TSSmartCardCreds is the smart card form of TSCredentials (credType 2);
+// the string fields are UTF-16LE.  See MS-CSSP 2.2.1.2.2.
 type TSSmartCardCreds struct {
-	Pin        string            `asn1:"explicit,tag:0"`
-	CspData    []TSCspDataDetail `asn1:"explicit,tag:1"`
-	UserHint   string            `asn1:"explicit,tag:2"`
-	DomainHint string            `asn1:"explicit,tag:3"`
+	Pin        []byte          `asn1:"explicit,tag:0"`
+	CspData    TSCspDataDetail `asn1:"explicit,tag:1"`
+	UserHint   []byte          `asn1:"optional,explicit,tag:2"`
+	DomainHint []byte          `asn1:"optional,explicit,tag:3"`
+}
+
+// SmartCard describes a smart card logon in plain strings.
+type SmartCard struct {
+	PIN           string
+	KeySpec       int // AT_KEYEXCHANGE or AT_SIGNATURE
+	CardName      string
+	ReaderName    string
+	ContainerName string
+	CSPName       string // e.g. "Microsoft Base Smart Card Crypto Provider"
+	UserHint      string
+	DomainHint    string
 }
 
-func EncodeDERTRequest(msgs []Message, authInfo []byte, pubKeyAuth []byte) []byte {
+// SmartCardProvider supplies the smart card delegated to the server at
+// the end of CredSSP, e.g. by querying a PKCS#11 module for the reader
+// and container of the logon certificate and prompting for the PIN.
+// It is called once per NLA handshake, after the server is authenticated.
+type SmartCardProvider interface {
+	SmartCard() (*SmartCard, error)
+}
+
+// SmartCardProviderFunc adapts a function to SmartCardProvider.
+type SmartCardProviderFunc func() (*SmartCard, error)
+
+func (f SmartCardProviderFunc) SmartCard() (*SmartCard, error) {
+	return f()
+}
+
+// unicodeOptional encodes s as UTF-16LE, leaving empty strings absent.
+func unicodeOptional(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return core.UnicodeEncode(s)
+}
+
+func EncodeDERTRequest(msgs []Message, authInfo []byte, pubKeyAuth []byte) ([]byte, error) {
+	return EncodeDERTRequestVersion(CREDSSP_VERSION_MIN, msgs, authInfo, pubKeyAuth, nil)
+}
+
+// EncodeDERTRequestVersion encodes a TSRequest advertising version.
+// clientNonce is only sent when non-empty (CredSSP v5 and later).
+func EncodeDERTRequestVersion(version int, msgs []Message, authInfo []byte, pubKeyAuth []byte, clientNonce []byte) ([]byte, error) {
 	req := TSRequest{
-		Version: 2,
+		Version: version,
 	}
 
 	if len(msgs) > 0 {
@@ -65,11 +264,11 @@ func EncodeDERTRequest(msgs []Message, authInfo []byte, pubKeyAuth []byte) []byt
 		req.PubKeyAuth = pubKeyAuth
 	}
 
-	result, err := asn1.Marshal(req)
-	if err != nil {
-		slog.Error("EncodeDERTRequest", "err", err)
+	if len(clientNonce) > 0 {
+		req.ClientNonce = clientNonce
 	}
-	return result
+
+	return asn1.Marshal(req)
 }
 
 func DecodeDERTRequest(s []byte) (*TSRequest, error) {
@@ -77,18 +276,130 @@ func DecodeDERTRequest(s []byte) (*TSRequest, error) {
 	_, err := asn1.Unmarshal(s, treq)
 	return treq, err
 }
-func EncodeDERTCredentials(domain, username, password []byte) []byte {
-	tpas := TSPasswordCreds{domain, username, password}
-	result, err := asn1.Marshal(tpas)
+
+// NegotiateVersion returns the CredSSP version both sides speak given
+// the version advertised by the server.
+func NegotiateVersion(serverVersion int) int {
+	if serverVersion < CREDSSP_VERSION_MIN {
+		return CREDSSP_VERSION_MIN
+	}
+	if serverVersion > CREDSSP_VERSION {
+		return CREDSSP_VERSION
+	}
+	return serverVersion
+}
+
+// NewClientNonce returns a random 32-byte nonce for CredSSP v5+.
+func NewClientNonce() []byte {
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	return nonce
+}
+
+// ClientPubKeyAuth returns the plaintext pubKeyAuth value the client
+// binds to the TLS public key.  For version 5 and later this is
+// SHA256(magic || nonce || pubkey); older versions send the key itself.
+func ClientPubKeyAuth(version int, nonce, pubkey []byte) []byte {
+	if version >= CREDSSP_VERSION_5 {
+		return pubKeyHash(clientServerHashMagic, nonce, pubkey)
+	}
+	return pubkey
+}
+
+// ServerPubKeyAuth returns the plaintext pubKeyAuth value the server is
+// expected to answer with: the server-to-client hash for version 5 and
+// later, or the public key with its first byte incremented.
+func ServerPubKeyAuth(version int, nonce, pubkey []byte) []byte {
+	if version >= CREDSSP_VERSION_5 {
+		return pubKeyHash(serverClientHashMagic, nonce, pubkey)
+	}
+	if len(pubkey) == 0 {
+		return nil
+	}
+	p := bytes.Clone(pubkey)
+	p[0]++
+	return p
+}
+
+// VerifyServerPubKeyAuth checks the decrypted pubKeyAuth sent by the
+// server against the value expected for the negotiated version.
+// decrypted is nil when the GSS signature did not verify.
+func VerifyServerPubKeyAuth(version int, nonce, pubkey, decrypted []byte) error {
+	if decrypted == nil {
+		return &PubKeyAuthError{Version: version, Reason: "invalid signature"}
+	}
+	if !bytes.Equal(decrypted, ServerPubKeyAuth(version, nonce, pubkey)) {
+		return &PubKeyAuthError{Version: version, Reason: "pubKeyAuth mismatch"}
+	}
+	return nil
+}
+
+// TLSServerEndPoint returns the "tls-server-end-point" channel binding
+// application data (RFC 5929 4.1) for the server certificate: the
+// certificate hashed with its signature hash algorithm, where MD5 and
+// SHA-1 are replaced by SHA-256.
+func TLSServerEndPoint(cert *x509.Certificate) []byte {
+	var sum []byte
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h := sha512.Sum384(cert.Raw)
+		sum = h[:]
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h := sha512.Sum512(cert.Raw)
+		sum = h[:]
+	default:
+		h := sha256.Sum256(cert.Raw)
+		sum = h[:]
+	}
+	return append([]byte("tls-server-end-point:"), sum...)
+}
+
+func pubKeyHash(magic string, nonce, pubkey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(magic))
+	h.Write(nonce)
+	h.Write(pubkey)
+	return h.Sum(nil)
+}
+
+func EncodeDERTCredentials(domain, username, password []byte) ([]byte, error) {
+	result, err := asn1.Marshal(TSPasswordCreds{domain, username, password})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(TSCredentials{CRED_TYPE_PASSWORD, result})
+}
+
+// EncodeDERTSmartCardCredentials encodes sc as TSCredentials with
+// credType 2 (TSSmartCardCreds).
+func EncodeDERTSmartCardCredentials(sc *SmartCard) ([]byte, error) {
+	tsc := TSSmartCardCreds{
+		Pin: core.UnicodeEncode(sc.PIN),
+		CspData: TSCspDataDetail{
+			KeySpec:       sc.KeySpec,
+			CardName:      unicodeOptional(sc.CardName),
+			ReaderName:    unicodeOptional(sc.ReaderName),
+			ContainerName: unicodeOptional(sc.ContainerName),
+			CspName:       unicodeOptional(sc.CSPName),
+		},
+		UserHint:   unicodeOptional(sc.UserHint),
+		DomainHint: unicodeOptional(sc.DomainHint),
+	}
+	result, err := asn1.Marshal(tsc)
 	if err != nil {
-		slog.Error("EncodeDERTCredentials", "err", err)
+		return nil, err
 	}
-	tcre := TSCredentials{1, result}
-	result, err = asn1.Marshal(tcre)
+	return asn1.Marshal(TSCredentials{CRED_TYPE_SMARTCARD, result})
+}
+
+// EncodeDERTRemoteGuardCredentials encodes creds as TSCredentials with
+// credType 6 (TSRemoteGuardCreds).
+func EncodeDERTRemoteGuardCredentials(creds *TSRemoteGuardCreds) ([]byte, error) {
+	result, err := asn1.Marshal(*creds)
 	if err != nil {
-		slog.Error("EncodeDERTCredentials", "err", err)
+		return nil, err
 	}
-	return result
+	return asn1.Marshal(TSCredentials{CRED_TYPE_REMOTE_GUARD, result})
 }
 
 func DecodeDERTCredentials(s []byte) (*TSCredentials, error) {
@@ -1,7 +1,13 @@
 package nla_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/asn1"
 	"encoding/hex"
+	"errors"
 	"testing"
 
 	"github.com/nakagami/grdp/protocol/nla"
@@ -9,8 +15,203 @@ import (
 
 func TestEncodeDERTRequest(t *testing.T) {
 	ntlm := nla.NewNTLMv2("", "", "")
-	result := nla.EncodeDERTRequest([]nla.Message{ntlm.GetNegotiateMessage()}, []byte(""), []byte(""))
+	result, err := nla.EncodeDERTRequest([]nla.Message{ntlm.GetNegotiateMessage()}, []byte(""), []byte(""))
+	if err != nil {
+		t.Fatal(err)
+	}
 	if hex.EncodeToString(result) != "302fa003020102a12830263024a02204204e544c4d53535000010000003582086000000000000000000000000000000000" {
 		t.Error("not equal")
 	}
 }
+
+func FuzzDecodeDERTRequest(f *testing.F) {
+	ntlm := nla.NewNTLMv2("", "", "")
+	seed := func(msgs []nla.Message, authInfo, pubKeyAuth []byte) {
+		req, err := nla.EncodeDERTRequest(msgs, authInfo, pubKeyAuth)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(req)
+	}
+	seed([]nla.Message{ntlm.GetNegotiateMessage()}, []byte(""), []byte(""))
+	seed(nil, []byte("authInfo"), []byte("pubKeyAuth"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if req, err := nla.DecodeDERTRequest(data); err == nil {
+			for _, m := range req.NegoTokens {
+				nla.ParseChallengeMessage(m.Data)
+			}
+		}
+		nla.DecodeDERTCredentials(data)
+	})
+}
+
+func TestEncodeDERTRequestVersionNonce(t *testing.T) {
+	nonce := nla.NewClientNonce()
+	result, err := nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, nil, nil, []byte{1, 2, 3}, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := nla.DecodeDERTRequest(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Version != nla.CREDSSP_VERSION {
+		t.Error("version", req.Version)
+	}
+	if !bytes.Equal(req.ClientNonce, nonce) {
+		t.Error("clientNonce not round-tripped")
+	}
+}
+
+func TestPubKeyAuth(t *testing.T) {
+	pubkey := []byte{0x30, 0x82, 0x01, 0x0a}
+	nonce := bytes.Repeat([]byte{0xaa}, 32)
+
+	h := sha256.Sum256(append(append([]byte("CredSSP Client-To-Server Binding Hash\x00"), nonce...), pubkey...))
+	if !bytes.Equal(nla.ClientPubKeyAuth(5, nonce, pubkey), h[:]) {
+		t.Error("client hash mismatch")
+	}
+	h = sha256.Sum256(append(append([]byte("CredSSP Server-To-Client Binding Hash\x00"), nonce...), pubkey...))
+	if !bytes.Equal(nla.ServerPubKeyAuth(6, nonce, pubkey), h[:]) {
+		t.Error("server hash mismatch")
+	}
+
+	if !bytes.Equal(nla.ClientPubKeyAuth(3, nil, pubkey), pubkey) {
+		t.Error("legacy client pubKeyAuth must be the key")
+	}
+	if got := nla.ServerPubKeyAuth(3, nil, pubkey); got[0] != 0x31 || pubkey[0] != 0x30 {
+		t.Error("legacy server pubKeyAuth must increment first byte", got)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for server, want := range map[int]int{0: 2, 2: 2, 3: 3, 5: 5, 6: 6, 7: 6} {
+		if got := nla.NegotiateVersion(server); got != want {
+			t.Errorf("NegotiateVersion(%d) = %d, want %d", server, got, want)
+		}
+	}
+}
+
+func TestVerifyServerPubKeyAuth(t *testing.T) {
+	pubkey := []byte{0x30, 0x82, 0x01, 0x0a}
+	nonce := bytes.Repeat([]byte{0x55}, 32)
+
+	if err := nla.VerifyServerPubKeyAuth(6, nonce, pubkey, nla.ServerPubKeyAuth(6, nonce, pubkey)); err != nil {
+		t.Error("v6:", err)
+	}
+	if err := nla.VerifyServerPubKeyAuth(2, nil, pubkey, []byte{0x31, 0x82, 0x01, 0x0a}); err != nil {
+		t.Error("v2:", err)
+	}
+
+	// A relay would answer with its own key or a hash over it.
+	other := []byte{0x30, 0x82, 0x01, 0x0b}
+	for _, err := range []error{
+		nla.VerifyServerPubKeyAuth(6, nonce, pubkey, nla.ServerPubKeyAuth(6, nonce, other)),
+		nla.VerifyServerPubKeyAuth(3, nil, pubkey, pubkey),
+		nla.VerifyServerPubKeyAuth(6, nonce, pubkey, nil),
+	} {
+		var pkErr *nla.PubKeyAuthError
+		if !errors.Is(err, nla.ErrMITMDetected) || !errors.As(err, &pkErr) {
+			t.Errorf("expected PubKeyAuthError, got %v", err)
+		}
+	}
+}
+
+func TestTSRequestErrorCode(t *testing.T) {
+	// version 6, errorCode 0xC0000234 encoded as a negative 32-bit INTEGER
+	// the way Windows sends it.
+	data, _ := hex.DecodeString("300da003020106a4060204c0000234")
+	req, err := nla.DecodeDERTRequest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = req.Err()
+	if !errors.Is(err, nla.ErrAccountLockedOut) || errors.Is(err, nla.ErrBadCredentials) {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	req = &nla.TSRequest{Version: 6, ErrorCode: nla.STATUS_LOGON_FAILURE}
+	data, err = asn1.Marshal(*req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req, err = nla.DecodeDERTRequest(data); err != nil {
+		t.Fatal(err)
+	}
+	var credErr *nla.CredSSPError
+	if err := req.Err(); !errors.Is(err, nla.ErrBadCredentials) || !errors.As(err, &credErr) || credErr.Code != nla.STATUS_LOGON_FAILURE {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	if err := (&nla.TSRequest{Version: 6}).Err(); err != nil {
+		t.Error("no errorCode must not be an error:", err)
+	}
+}
+
+func TestTLSServerEndPoint(t *testing.T) {
+	cert := &x509.Certificate{Raw: []byte("certificate"), SignatureAlgorithm: x509.SHA1WithRSA}
+	h256 := sha256.Sum256(cert.Raw)
+	if got := nla.TLSServerEndPoint(cert); !bytes.Equal(got, append([]byte("tls-server-end-point:"), h256[:]...)) {
+		t.Errorf("SHA-1 certificate must bind with SHA-256, got %x", got)
+	}
+	cert.SignatureAlgorithm = x509.SHA384WithRSA
+	h384 := sha512.Sum384(cert.Raw)
+	if got := nla.TLSServerEndPoint(cert); !bytes.Equal(got, append([]byte("tls-server-end-point:"), h384[:]...)) {
+		t.Errorf("SHA-384 certificate binding %x", got)
+	}
+}
+
+func TestEncodeDERTRemoteGuardCredentials(t *testing.T) {
+	creds := &nla.TSRemoteGuardCreds{
+		LogonCred: nla.NewRemoteGuardPackageCred("Kerberos", []byte{1, 2, 3}),
+	}
+	b, err := nla.EncodeDERTRemoteGuardCredentials(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcre, err := nla.DecodeDERTCredentials(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcre.CredType != nla.CRED_TYPE_REMOTE_GUARD {
+		t.Errorf("credType = %d, want %d", tcre.CredType, nla.CRED_TYPE_REMOTE_GUARD)
+	}
+	// SEQUENCE { [0] SEQUENCE { [0] OCTET STRING "Kerberos", [1] OCTET STRING 010203 } }
+	want := "301f" + "a01d" + "301b" +
+		"a012" + "0410" + hex.EncodeToString([]byte("K\x00e\x00r\x00b\x00e\x00r\x00o\x00s\x00")) +
+		"a105" + "0403010203"
+	if got := hex.EncodeToString(tcre.Credentials); got != want {
+		t.Errorf("TSRemoteGuardCreds = %s, want %s", got, want)
+	}
+}
+
+func TestEncodeDERTSmartCardCredentials(t *testing.T) {
+	b, err := nla.EncodeDERTSmartCardCredentials(&nla.SmartCard{
+		PIN:        "1234",
+		KeySpec:    nla.AT_KEYEXCHANGE,
+		ReaderName: "R",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcre, err := nla.DecodeDERTCredentials(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcre.CredType != nla.CRED_TYPE_SMARTCARD {
+		t.Errorf("credType = %d, want %d", tcre.CredType, nla.CRED_TYPE_SMARTCARD)
+	}
+	var sc nla.TSSmartCardCreds
+	if _, err := asn1.Unmarshal(tcre.Credentials, &sc); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sc.Pin, []byte("1\x002\x003\x004\x00")) {
+		t.Errorf("pin = % x", sc.Pin)
+	}
+	if sc.CspData.KeySpec != nla.AT_KEYEXCHANGE || !bytes.Equal(sc.CspData.ReaderName, []byte("R\x00")) {
+		t.Errorf("cspData = %+v", sc.CspData)
+	}
+	if sc.CspData.CardName != nil || sc.UserHint != nil {
+		t.Errorf("empty optional fields must be omitted: %+v", sc)
+	}
+}
@@ -6,8 +6,9 @@ import (
 	"crypto/rc4"
 	"encoding/binary"
 	"encoding/hex"
-	"fmt"
 	"log/slog"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/lunixbochs/struc"
@@ -39,6 +40,13 @@ const (
 	MsvChannelBindings   = 0x000A
 )
 
+// MsvAvFlags values (MS-NLMP 2.2.2.1).
+const (
+	MSV_AV_FLAGS_ACCOUNT_CONSTRAINED = 0x00000001
+	MSV_AV_FLAGS_MIC_PRESENT         = 0x00000002
+	MSV_AV_FLAGS_UNTRUSTED_SPN       = 0x00000004
+)
+
 type AVPair struct {
 	Id    uint16 `struc:"little"`
 	Len   uint16 `struc:"little,sizeof=Value"`
@@ -192,6 +200,85 @@ func (m *ChallengeMessage) getTargetInfoTimestamp(data []byte) []byte {
 	return nil
 }
 
+// ParseChallengeMessage decodes an NTLM CHALLENGE_MESSAGE.
+func ParseChallengeMessage(s []byte) (*ChallengeMessage, error) {
+	m := &ChallengeMessage{totalLen: len(s)}
+	r := bytes.NewReader(s)
+	if err := struc.Unpack(r, m); err != nil {
+		return nil, err
+	}
+	if m.NegotiateFlags&NTLMSSP_NEGOTIATE_VERSION != 0 {
+		version := NVersion{}
+		if err := struc.Unpack(r, &version); err != nil {
+			return nil, err
+		}
+		m.Version = version
+	}
+	m.Payload, _ = core.ReadBytes(r.Len(), r)
+	return m, nil
+}
+
+// ChallengeInfo is what a server discloses about itself in its NTLM
+// CHALLENGE_MESSAGE, before any credentials are sent.
+type ChallengeInfo struct {
+	TargetName      string
+	NbComputerName  string
+	NbDomainName    string
+	DnsComputerName string
+	DnsDomainName   string
+	DnsTreeName     string
+	Timestamp       time.Time // server clock, zero when not sent
+	Version         *NVersion // nil unless NTLMSSP_NEGOTIATE_VERSION is set
+	NegotiateFlags  uint32
+}
+
+// Info extracts the server identity from the target name and target
+// info fields.  Fields that are missing or out of bounds are left empty.
+func (m *ChallengeMessage) Info() *ChallengeInfo {
+	info := &ChallengeInfo{NegotiateFlags: m.NegotiateFlags}
+	if m.NegotiateFlags&NTLMSSP_NEGOTIATE_VERSION != 0 {
+		v := m.Version
+		info.Version = &v
+	}
+	info.TargetName = core.UnicodeDecode(m.payloadField(m.TargetNameBufferOffset, m.TargetNameLen))
+	r := bytes.NewReader(m.payloadField(m.TargetInfoBufferOffset, m.TargetInfoLen))
+	for r.Len() >= 4 {
+		avPair := &AVPair{}
+		if err := struc.Unpack(r, avPair); err != nil || avPair.Id == MsvAvEOL {
+			break
+		}
+		switch avPair.Id {
+		case MsvAvNbComputerName:
+			info.NbComputerName = core.UnicodeDecode(avPair.Value)
+		case MsvAvNbDomainName:
+			info.NbDomainName = core.UnicodeDecode(avPair.Value)
+		case MsvAvDnsComputerName:
+			info.DnsComputerName = core.UnicodeDecode(avPair.Value)
+		case MsvAvDnsDomainName:
+			info.DnsDomainName = core.UnicodeDecode(avPair.Value)
+		case MsvAvDnsTreeName:
+			info.DnsTreeName = core.UnicodeDecode(avPair.Value)
+		case MsvAvTimestamp:
+			if len(avPair.Value) == 8 {
+				ft := int64(binary.LittleEndian.Uint64(avPair.Value))
+				info.Timestamp = time.Unix(0, (ft-116444736000000000)*100).UTC()
+			}
+		}
+	}
+	return info
+}
+
+// payloadField returns the offset/length field of the message, or nil when
+// it does not lie within the payload.
+func (m *ChallengeMessage) payloadField(offset uint32, n uint16) []byte {
+	base := m.BaseLen()
+	if n == 0 || offset < base || int(offset-base)+int(n) > len(m.Payload) {
+		return nil
+	}
+	start := offset - base
+	return m.Payload[start : start+uint32(n)]
+}
+
 type AuthenticateMessage struct {
 	Signature                          [8]byte
 	MessageType                        uint32   `struc:"little"`
@@ -285,8 +372,107 @@ type NTLMv2 struct {
 	respKeyLM           []byte
 	negotiateMessage    *NegotiateMessage
 	challengeMessage    *ChallengeMessage
+	challengeRaw        []byte
 	authenticateMessage *AuthenticateMessage
 	enableUnicode       bool
+
+	// channelBindings is the MD5 hash of the gss_channel_bindings_struct
+	// sent in MsvChannelBindings; all zero when no bindings are set.
+	channelBindings [16]byte
+	// targetName is the SPN sent in MsvAvTargetName; empty to omit it.
+	targetName string
+
+	log *slog.Logger
+}
+
+// SetChannelBindings sets the application data of the GSS channel
+// bindings (e.g. "tls-server-end-point:" followed by the certificate
+// hash) whose MD5 is sent in the MsvChannelBindings AV pair.  nil sends
+// the all-zero value meaning "no bindings".
+func (n *NTLMv2) SetChannelBindings(applicationData []byte) {
+	if applicationData == nil {
+		n.channelBindings = [16]byte{}
+		return
+	}
+	// gss_channel_bindings_struct: initiator and acceptor address type
+	// and length are zero, followed by the application data.
+	b := make([]byte, 20, 20+len(applicationData))
+	binary.LittleEndian.PutUint32(b[16:], uint32(len(applicationData)))
+	b = append(b, applicationData...)
+	n.channelBindings = md5.Sum(b)
+}
+
+// SetTargetName sets the service principal name (e.g. "TERMSRV/host")
+// sent in the MsvAvTargetName AV pair.
+func (n *NTLMv2) SetTargetName(spn string) {
+	n.targetName = spn
+}
+
+// ServicePrincipalName returns the "TERMSRV/<host>" SPN of an RDP server
+// addressed as host, which may carry a port and IPv6 brackets.  An IP
+// literal yields an SPN that only NTLM accepts; Kerberos needs the DNS
+// name or an explicit SPN.
+func ServicePrincipalName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return "TERMSRV/" + host
+}
+
+// rawMessage is a Message already in wire form.
+type rawMessage []byte
+
+func (m rawMessage) Serialize() []byte {
+	return m
+}
+
+// clientTargetInfo returns the AV pairs for the NTLMv2 client challenge:
+// the server's pairs with MsvAvFlags, MsvAvTargetName and
+// MsvChannelBindings added or replaced (MS-NLMP 3.1.5.1.2).
+func (n *NTLMv2) clientTargetInfo(serverInfo []byte, micPresent bool) []byte {
+	var flags uint32
+	buff := &bytes.Buffer{}
+	r := bytes.NewReader(serverInfo)
+	for r.Len() >= 4 {
+		id, _ := core.ReadUint16LE(r)
+		l, _ := core.ReadUint16LE(r)
+		value, err := core.ReadBytes(int(l), r)
+		if err != nil || id == MsvAvEOL {
+			break
+		}
+		switch id {
+		case MsvAvFlags:
+			if len(value) == 4 {
+				flags = binary.LittleEndian.Uint32(value)
+			}
+			continue
+		case MsvAvTargetName, MsvChannelBindings:
+			continue
+		}
+		writeAVPair(id, value, buff)
+	}
+
+	if micPresent {
+		flags |= MSV_AV_FLAGS_MIC_PRESENT
+	}
+	if flags != 0 {
+		v := make([]byte, 4)
+		binary.LittleEndian.PutUint32(v, flags)
+		writeAVPair(MsvAvFlags, v, buff)
+	}
+	if n.targetName != "" {
+		writeAVPair(MsvAvTargetName, core.UnicodeEncode(n.targetName), buff)
+	}
+	writeAVPair(MsvChannelBindings, n.channelBindings[:], buff)
+	writeAVPair(MsvAvEOL, nil, buff)
+	return buff.Bytes()
+}
+
+func writeAVPair(id uint16, value []byte, w *bytes.Buffer) {
+	core.WriteUInt16LE(id, w)
+	core.WriteUInt16LE(uint16(len(value)), w)
+	w.Write(value)
 }
 
 func NewNTLMv2(domain, user, password string) *NTLMv2 {
@@ -296,9 +482,26 @@ func NewNTLMv2(domain, user, password string) *NTLMv2 {
 		password:  password,
 		respKeyNT: NTOWFv2(password, user, domain),
 		respKeyLM: LMOWFv2(password, user, domain),
+		log:       core.Logger(nil, "nla"),
 	}
 }
 
+// SetLogger makes the NTLM exchange log to l, with the attribute
+// layer=nla.
+func (n *NTLMv2) SetLogger(l *slog.Logger) {
+	n.log = core.Logger(l, "nla")
+}
+
+// SetCredentials replaces the account used for the authenticate message,
+// for credentials that are only known once the server has been reached.
+func (n *NTLMv2) SetCredentials(domain, user, password string) {
+	n.domain = domain
+	n.user = user
+	n.password = password
+	n.respKeyNT = NTOWFv2(password, user, domain)
+	n.respKeyLM = LMOWFv2(password, user, domain)
+}
+
 // generate first handshake messgae
 func (n *NTLMv2) GetNegotiateMessage() *NegotiateMessage {
 	negoMsg := NewNegotiateMessage()
@@ -369,28 +572,18 @@ var (
 	serverSealing = concat([]byte("session key to server-to-client sealing key magic constant"), []byte{0x00})
 )
 
-func (n *NTLMv2) GetAuthenticateMessage(s []byte) (*AuthenticateMessage, *NTLMv2Security) {
-	slog.Debug("GetAuthenticateMessage", "s", s)
+// GetAuthenticateMessage answers the CHALLENGE message s.  It fails when
+// s does not parse as a CHALLENGE message.
+func (n *NTLMv2) GetAuthenticateMessage(s []byte) (*AuthenticateMessage, *NTLMv2Security, error) {
+	n.log.Debug("GetAuthenticateMessage", "s", core.Hex(s))
 
-	challengeMsg := &ChallengeMessage{totalLen: len(s)}
-	r := bytes.NewReader(s)
-	err := struc.Unpack(r, challengeMsg)
+	challengeMsg, err := ParseChallengeMessage(s)
 	if err != nil {
-		slog.Error("GetAuthenticateMessage", "err", err)
-		return nil, nil
+		return nil, nil, err
 	}
-	if challengeMsg.NegotiateFlags&NTLMSSP_NEGOTIATE_VERSION != 0 {
-		version := NVersion{}
-		err := struc.Unpack(r, &version)
-		if err != nil {
-			slog.Error("GetAuthenticateMessage", "err", err)
-			return nil, nil
-		}
-		challengeMsg.Version = version
-	}
-	challengeMsg.Payload, _ = core.ReadBytes(r.Len(), r)
 	n.challengeMessage = challengeMsg
-	slog.Debug("GetAuthenticateMessage", "challengeMsg", challengeMsg)
+	n.challengeRaw = bytes.Clone(s)
+	n.log.Debug("GetAuthenticateMessage", "challengeMsg", challengeMsg)
 
 	serverName := challengeMsg.getTargetName()
 	serverInfo := challengeMsg.getTargetInfo()
@@ -404,12 +597,21 @@ func (n *NTLMv2) GetAuthenticateMessage(s []byte) (*AuthenticateMessage, *NTLMv2
 	} else {
 		computeMIC = true
 	}
-	slog.Debug("GetAuthenticateMessage", "serverName", core.UnicodeDecode(serverName))
+	if len(serverInfo) > 0 {
+		serverInfo = n.clientTargetInfo(serverInfo, computeMIC)
+	}
+	n.log.Debug("GetAuthenticateMessage", "serverName", core.UnicodeDecode(serverName))
 	serverChallenge := challengeMsg.ServerChallenge[:]
 	clientChallenge := core.Random(8)
 	ntChallengeResponse, lmChallengeResponse, SessionBaseKey := n.ComputeResponseV2(
 		n.respKeyNT, n.respKeyLM, serverChallenge, clientChallenge, timestamp, serverInfo)
 
+	if computeMIC {
+		// With MsvAvTimestamp present the LM response SHOULD be Z(24)
+		// (MS-NLMP 3.1.5.1.2).
+		lmChallengeResponse = make([]byte, 24)
+	}
+
 	exchangeKey := SessionBaseKey
 	exportedSessionKey := core.Random(16)
 	EncryptedRandomSessionKey := make([]byte, len(exportedSessionKey))
@@ -419,14 +621,14 @@ func (n *NTLMv2) GetAuthenticateMessage(s []byte) (*AuthenticateMessage, *NTLMv2
 	if challengeMsg.NegotiateFlags&NTLMSSP_NEGOTIATE_UNICODE != 0 {
 		n.enableUnicode = true
 	}
-	slog.Debug(fmt.Sprintf("user: %s, password:********", n.user))
+	n.log.Debug("GetAuthenticateMessage", "user", core.Secret(n.user))
 	domain, user, _ := n.GetEncodedCredentials()
 
 	n.authenticateMessage = NewAuthenticateMessage(challengeMsg.NegotiateFlags,
 		domain, user, []byte(""), lmChallengeResponse, ntChallengeResponse, EncryptedRandomSessionKey)
 
 	if computeMIC {
-		copy(n.authenticateMessage.MIC[:], MIC(exportedSessionKey, n.negotiateMessage, n.challengeMessage, n.authenticateMessage)[:16])
+		copy(n.authenticateMessage.MIC[:], MIC(exportedSessionKey, n.negotiateMessage, rawMessage(n.challengeRaw), n.authenticateMessage)[:16])
 	}
 
 	md := md5.New()
@@ -450,17 +652,18 @@ func (n *NTLMv2) GetAuthenticateMessage(s []byte) (*AuthenticateMessage, *NTLMv2
 	md.Write(a)
 	ServerSealingKey := md.Sum(nil)
 
-	slog.Debug(fmt.Sprintf("ClientSigningKey:%s", hex.EncodeToString(ClientSigningKey)))
-	slog.Debug(fmt.Sprintf("ServerSigningKey:%s", hex.EncodeToString(ServerSigningKey)))
-	slog.Debug(fmt.Sprintf("ClientSealingKey:%s", hex.EncodeToString(ClientSealingKey)))
-	slog.Debug(fmt.Sprintf("ServerSealingKey:%s", hex.EncodeToString(ServerSealingKey)))
+	n.log.Debug("GetAuthenticateMessage: session keys",
+		"clientSigning", core.Secret(hex.EncodeToString(ClientSigningKey)),
+		"serverSigning", core.Secret(hex.EncodeToString(ServerSigningKey)),
+		"clientSealing", core.Secret(hex.EncodeToString(ClientSealingKey)),
+		"serverSealing", core.Secret(hex.EncodeToString(ServerSealingKey)))
 
 	encryptRC4, _ := rc4.NewCipher(ClientSealingKey)
 	decryptRC4, _ := rc4.NewCipher(ServerSealingKey)
 
 	ntlmSec := &NTLMv2Security{encryptRC4, decryptRC4, ClientSigningKey, ServerSigningKey, 0}
 
-	return n.authenticateMessage, ntlmSec
+	return n.authenticateMessage, ntlmSec, nil
 }
 
 func (n *NTLMv2) GetEncodedCredentials() ([]byte, []byte, []byte) {
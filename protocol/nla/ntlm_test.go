@@ -2,6 +2,7 @@ package nla_test
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"testing"
 
@@ -51,3 +52,138 @@ func TestNTLMv2_ComputeResponse(t *testing.T) {
 		t.Error("SessionBaseKey incorrect")
 	}
 }
+
+// buildChallenge returns a CHALLENGE_MESSAGE without version whose
+// TargetInfo holds a domain name and, if ts is non-nil, a timestamp.
+func buildChallenge(ts []byte) []byte {
+	info := &bytes.Buffer{}
+	dom := []byte{'C', 0, 'O', 0, 'R', 0, 'P', 0}
+	binary.Write(info, binary.LittleEndian, [2]uint16{nla.MsvAvNbDomainName, uint16(len(dom))})
+	info.Write(dom)
+	if ts != nil {
+		binary.Write(info, binary.LittleEndian, [2]uint16{nla.MsvAvTimestamp, uint16(len(ts))})
+		info.Write(ts)
+	}
+	info.Write([]byte{0, 0, 0, 0})
+
+	msg := &bytes.Buffer{}
+	msg.WriteString("NTLMSSP\x00")
+	binary.Write(msg, binary.LittleEndian, uint32(2))
+	binary.Write(msg, binary.LittleEndian, [2]uint16{0, 0})
+	binary.Write(msg, binary.LittleEndian, uint32(48))
+	binary.Write(msg, binary.LittleEndian, uint32(nla.NTLMSSP_NEGOTIATE_UNICODE|nla.NTLMSSP_NEGOTIATE_KEY_EXCH))
+	msg.Write([]byte{1, 2, 3, 4, 5, 6, 7, 8}) // server challenge
+	msg.Write(make([]byte, 8))
+	binary.Write(msg, binary.LittleEndian, [2]uint16{uint16(info.Len()), uint16(info.Len())})
+	binary.Write(msg, binary.LittleEndian, uint32(48))
+	msg.Write(info.Bytes())
+	return msg.Bytes()
+}
+
+// clientAVPairs extracts the AV pairs of the NTLMv2 client challenge.
+func clientAVPairs(t *testing.T, auth *nla.AuthenticateMessage) map[uint16][]byte {
+	off := auth.NtChallengeResponseBufferOffset - auth.BaseLen()
+	resp := auth.Payload[off : off+uint32(auth.NtChallengeResponseLen)]
+	r := bytes.NewReader(resp[16+28:])
+	pairs := map[uint16][]byte{}
+	for r.Len() >= 4 {
+		var hdr [2]uint16
+		binary.Read(r, binary.LittleEndian, &hdr)
+		if hdr[0] == nla.MsvAvEOL {
+			return pairs
+		}
+		v := make([]byte, hdr[1])
+		r.Read(v)
+		pairs[hdr[0]] = v
+	}
+	t.Fatal("no MsvAvEOL in client challenge")
+	return nil
+}
+
+func TestAuthenticateMessageMIC(t *testing.T) {
+	ntlm := nla.NewNTLMv2("CORP", "user", "password")
+	ntlm.GetNegotiateMessage()
+	ntlm.SetTargetName("TERMSRV/host")
+	ntlm.SetChannelBindings([]byte("tls-server-end-point:0123456789abcdef0123456789abcdef"))
+	auth, sec, err := ntlm.GetAuthenticateMessage(buildChallenge([]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+	if err != nil || auth == nil || sec == nil {
+		t.Fatalf("GetAuthenticateMessage failed: %v", err)
+	}
+	if auth.MIC == [16]byte{} {
+		t.Error("MIC not set")
+	}
+	pairs := clientAVPairs(t, auth)
+	if f := pairs[nla.MsvAvFlags]; len(f) != 4 || binary.LittleEndian.Uint32(f)&nla.MSV_AV_FLAGS_MIC_PRESENT == 0 {
+		t.Errorf("MsvAvFlags %x", f)
+	}
+	if cb := pairs[nla.MsvChannelBindings]; len(cb) != 16 || bytes.Equal(cb, make([]byte, 16)) {
+		t.Errorf("MsvChannelBindings %x", cb)
+	}
+	if pairs[nla.MsvAvTargetName] == nil || pairs[nla.MsvAvNbDomainName] == nil {
+		t.Error("missing AV pairs", pairs)
+	}
+}
+
+func TestAuthenticateMessageNoTimestamp(t *testing.T) {
+	ntlm := nla.NewNTLMv2("CORP", "user", "password")
+	ntlm.GetNegotiateMessage()
+	auth, _, err := ntlm.GetAuthenticateMessage(buildChallenge(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.MIC != [16]byte{} {
+		t.Error("MIC must not be set without MsvAvTimestamp")
+	}
+	pairs := clientAVPairs(t, auth)
+	if _, ok := pairs[nla.MsvAvFlags]; ok {
+		t.Error("unexpected MsvAvFlags")
+	}
+	if cb := pairs[nla.MsvChannelBindings]; !bytes.Equal(cb, make([]byte, 16)) {
+		t.Errorf("MsvChannelBindings %x", cb)
+	}
+}
+
+func TestChallengeInfo(t *testing.T) {
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, 116444736000000000+10_000_000) // 1970-01-01 00:00:01
+	m, err := nla.ParseChallengeMessage(buildChallenge(ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := m.Info()
+	if info.NbDomainName != "CORP" || info.Timestamp.Unix() != 1 || info.Version != nil {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	// A target info offset outside the message must not panic.
+	bad := buildChallenge(nil)
+	binary.LittleEndian.PutUint32(bad[44:], 0xffff)
+	if m, err := nla.ParseChallengeMessage(bad); err != nil || m.Info().NbDomainName != "" {
+		t.Errorf("bad offset: %v", err)
+	}
+}
+
+func FuzzParseChallengeMessage(f *testing.F) {
+	ts := make([]byte, 8)
+	binary.LittleEndian.PutUint64(ts, 116444736000000000)
+	f.Add(buildChallenge(ts))
+	f.Add(buildChallenge(nil))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if m, err := nla.ParseChallengeMessage(data); err == nil {
+			m.Info()
+		}
+	})
+}
+
+func TestServicePrincipalName(t *testing.T) {
+	for host, want := range map[string]string{
+		"rds.corp.example:3389": "TERMSRV/rds.corp.example",
+		"rds.corp.example":      "TERMSRV/rds.corp.example",
+		"10.0.0.5:3389":         "TERMSRV/10.0.0.5",
+		"[fe80::1]:3389":        "TERMSRV/fe80::1",
+	} {
+		if got := nla.ServicePrincipalName(host); got != want {
+			t.Errorf("ServicePrincipalName(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
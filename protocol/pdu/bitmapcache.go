@@ -0,0 +1,291 @@
+package pdu
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/nakagami/grdp/core"
+)
+
+/**
+ * Bitmap cache rev2 capability and Persistent Key List flags
+ * (MS-RDPBCGR 2.2.7.1.4.2, 2.2.1.17)
+ */
+const (
+	PERSISTENT_KEYS_EXPECTED_FLAG = 0x0001
+	ALLOW_CACHE_WAITING_LIST_FLAG = 0x0002
+
+	BITMAPCACHE_CELL_PERSISTENT    uint32 = 0x80000000
+	BITMAPCACHE_WAITING_LIST_INDEX        = 0x7FFF
+	BITMAPCACHE_MAX_CELLS                 = 5
+
+	PERSIST_FIRST_PDU = 0x01
+	PERSIST_LAST_PDU  = 0x02
+
+	// maxPersistKeysPerPDU is the largest number of keys Windows accepts
+	// in one Persistent Key List PDU.
+	maxPersistKeysPerPDU = 169
+)
+
+// CachedBitmap is a bitmap sent in a Cache Bitmap order, kept in the wire
+// format: decode it like a BitmapData with the same fields.
+type CachedBitmap struct {
+	// Key is the 64-bit persistent key, 0 when the server sent none.
+	Key           uint64
+	Width, Height uint16
+	Bpp           uint16
+	Compressed    bool
+	Data          []byte
+}
+
+// BitmapCache holds the bitmap cache cells of a session and, across
+// sessions, the bitmaps the server gave persistent keys.  Those can be
+// saved to disk and are announced in the Persistent Key List PDU of the
+// next connection, so the server draws from them instead of resending.
+type BitmapCache struct {
+	mu        sync.Mutex
+	cells     [BITMAPCACHE_MAX_CELLS]map[uint16]*CachedBitmap
+	persisted [BITMAPCACHE_MAX_CELLS]map[uint64]*CachedBitmap
+	// numCells is the number of cells of each cache negotiated in the
+	// capability exchange; until then it is not known and not enforced.
+	numCells   [BITMAPCACHE_MAX_CELLS]uint32
+	negotiated bool
+	log        *slog.Logger
+}
+
+func NewBitmapCache() *BitmapCache {
+	b := &BitmapCache{log: core.DefaultLogger}
+	for i := range b.cells {
+		b.cells[i] = make(map[uint16]*CachedBitmap)
+		b.persisted[i] = make(map[uint64]*CachedBitmap)
+	}
+	return b
+}
+
+// Put stores bm in cell index of cache cacheId, and remembers it for the
+// next session when it has a persistent key.
+func (b *BitmapCache) Put(cacheId int, index uint16, bm *CachedBitmap) {
+	if cacheId < 0 || cacheId >= BITMAPCACHE_MAX_CELLS {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.negotiated && uint32(index) >= b.numCells[cacheId] {
+		b.log.Debug("bitmap cache: cell out of range", "cacheId", cacheId, "index", index)
+		return
+	}
+	if old := b.cells[cacheId][index]; old != nil && old.Key != 0 {
+		delete(b.persisted[cacheId], old.Key)
+	}
+	b.cells[cacheId][index] = bm
+	if bm.Key != 0 {
+		b.persisted[cacheId][bm.Key] = bm
+	}
+}
+
+// Get returns the bitmap in cell index of cache cacheId, or nil.
+func (b *BitmapCache) Get(cacheId int, index uint16) *CachedBitmap {
+	if cacheId < 0 || cacheId >= BITMAPCACHE_MAX_CELLS {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cells[cacheId][index]
+}
+
+// setCells sets the number of cells of each cache, dropping the bitmaps
+// of cells that no longer exist.
+func (b *BitmapCache) setCells(cells [BITMAPCACHE_MAX_CELLS]uint32) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.numCells = cells
+	b.negotiated = true
+	for id, m := range b.cells {
+		for index := range m {
+			if uint32(index) >= cells[id] {
+				delete(m, index)
+			}
+		}
+	}
+}
+
+// Len returns the number of persisted bitmaps in cache cacheId.
+func (b *BitmapCache) Len(cacheId int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.persisted[cacheId])
+}
+
+// preload starts a session: the cells are emptied and refilled, from
+// index 0, with up to cells[i] persisted bitmaps of cache i, whose keys
+// are returned in cell order for the Persistent Key List PDU.
+func (b *BitmapCache) preload(cells [BITMAPCACHE_MAX_CELLS]uint32) (keys [BITMAPCACHE_MAX_CELLS][]uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id := range b.cells {
+		b.cells[id] = make(map[uint16]*CachedBitmap)
+		for key, bm := range b.persisted[id] {
+			if uint32(len(keys[id])) >= min(cells[id], BITMAPCACHE_WAITING_LIST_INDEX) {
+				delete(b.persisted[id], key)
+				continue
+			}
+			b.cells[id][uint16(len(keys[id]))] = bm
+			keys[id] = append(keys[id], key)
+		}
+	}
+	return keys
+}
+
+var bitmapCacheMagic = []byte("GRDPBMC1")
+
+// Save writes the persisted bitmaps to w.
+func (b *BitmapCache) Save(w io.Writer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	bw.Write(bitmapCacheMagic)
+	for id, m := range b.persisted {
+		for _, bm := range m {
+			core.WriteUInt8(uint8(id), bw)
+			core.WriteUInt32LE(uint32(bm.Key), bw)
+			core.WriteUInt32LE(uint32(bm.Key>>32), bw)
+			core.WriteUInt16LE(bm.Width, bw)
+			core.WriteUInt16LE(bm.Height, bw)
+			core.WriteUInt16LE(bm.Bpp, bw)
+			if bm.Compressed {
+				core.WriteUInt8(1, bw)
+			} else {
+				core.WriteUInt8(0, bw)
+			}
+			core.WriteUInt32LE(uint32(len(bm.Data)), bw)
+			bw.Write(bm.Data)
+		}
+	}
+	return bw.Flush()
+}
+
+// Load adds the bitmaps written by Save to the persisted ones.
+func (b *BitmapCache) Load(r io.Reader) error {
+	br := bufio.NewReader(r)
+	magic, err := core.ReadBytes(len(bitmapCacheMagic), br)
+	if err != nil || string(magic) != string(bitmapCacheMagic) {
+		return errors.New("bitmap cache: bad file header")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		id, err := core.ReadUInt8(br)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if id >= BITMAPCACHE_MAX_CELLS {
+			return fmt.Errorf("bitmap cache: bad cache id %d", id)
+		}
+		bm := &CachedBitmap{}
+		key1, _ := core.ReadUInt32LE(br)
+		key2, _ := core.ReadUInt32LE(br)
+		bm.Key = uint64(key1) | uint64(key2)<<32
+		bm.Width, _ = core.ReadUint16LE(br)
+		bm.Height, _ = core.ReadUint16LE(br)
+		bm.Bpp, _ = core.ReadUint16LE(br)
+		compressed, _ := core.ReadUInt8(br)
+		bm.Compressed = compressed != 0
+		n, err := core.ReadUInt32LE(br)
+		if err != nil {
+			return fmt.Errorf("bitmap cache: %w", err)
+		}
+		if n > uint32(bm.Width)*uint32(bm.Height)*4+1024 {
+			return fmt.Errorf("bitmap cache: bad entry length %d", n)
+		}
+		if bm.Data, err = core.ReadBytes(int(n), br); err != nil {
+			return fmt.Errorf("bitmap cache: %w", err)
+		}
+		if bm.Key != 0 {
+			b.persisted[id][bm.Key] = bm
+		}
+	}
+}
+
+// LoadBitmapCacheFile returns the bitmap cache saved in path, or an empty
+// cache when the file does not exist.
+func LoadBitmapCacheFile(path string) (*BitmapCache, error) {
+	b := NewBitmapCache()
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	} else if err != nil {
+		return b, err
+	}
+	defer f.Close()
+	return b, b.Load(f)
+}
+
+// SaveFile writes the persisted bitmaps to path.
+func (b *BitmapCache) SaveFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".bmcache-*")
+	if err != nil {
+		return err
+	}
+	if err = b.Save(f); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// persistentKeyListPDUs splits keys into Persistent Key List PDUs.
+func persistentKeyListPDUs(keys [BITMAPCACHE_MAX_CELLS][]uint64) []*PersistKeyPDU {
+	var total [BITMAPCACHE_MAX_CELLS]uint16
+	var all []PersistKeyEntry
+	var cacheOf []int
+	for id, k := range keys {
+		total[id] = uint16(len(k))
+		for _, key := range k {
+			all = append(all, PersistKeyEntry{uint32(key), uint32(key >> 32)})
+			cacheOf = append(cacheOf, id)
+		}
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	var pdus []*PersistKeyPDU
+	for start := 0; start < len(all); start += maxPersistKeysPerPDU {
+		end := min(start+maxPersistKeysPerPDU, len(all))
+		p := &PersistKeyPDU{
+			TotalEntriesCache0: total[0],
+			TotalEntriesCache1: total[1],
+			TotalEntriesCache2: total[2],
+			TotalEntriesCache3: total[3],
+			TotalEntriesCache4: total[4],
+			Entries:            all[start:end],
+		}
+		num := [BITMAPCACHE_MAX_CELLS]*uint16{&p.NumEntriesCache0, &p.NumEntriesCache1,
+			&p.NumEntriesCache2, &p.NumEntriesCache3, &p.NumEntriesCache4}
+		for _, id := range cacheOf[start:end] {
+			*num[id]++
+		}
+		if start == 0 {
+			p.BBitMask |= PERSIST_FIRST_PDU
+		}
+		if end == len(all) {
+			p.BBitMask |= PERSIST_LAST_PDU
+		}
+		pdus = append(pdus, p)
+	}
+	return pdus
+}
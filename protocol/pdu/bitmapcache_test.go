@@ -0,0 +1,56 @@
+package pdu
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBitmapCachePersistentKeys(t *testing.T) {
+	b := NewBitmapCache()
+	for i := 0; i < 200; i++ {
+		b.Put(1, uint16(i), &CachedBitmap{Key: uint64(i+1) << 32, Width: 4, Height: 4, Bpp: 16, Data: []byte{byte(i)}})
+	}
+	b.Put(2, 0, &CachedBitmap{Key: 0, Width: 4, Height: 4, Bpp: 16, Data: []byte{1}})
+
+	buf := &bytes.Buffer{}
+	if err := b.Save(buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewBitmapCache()
+	if err := loaded.Load(buf); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Len(1) != 200 || loaded.Len(2) != 0 {
+		t.Fatalf("loaded %d/%d bitmaps, want 200/0", loaded.Len(1), loaded.Len(2))
+	}
+
+	keys := loaded.preload([BITMAPCACHE_MAX_CELLS]uint32{1: 180})
+	if len(keys[1]) != 180 || loaded.Len(1) != 180 {
+		t.Fatalf("preloaded %d keys, kept %d, want 180", len(keys[1]), loaded.Len(1))
+	}
+	if bm := loaded.Get(1, 179); bm == nil || bm.Key != keys[1][179] {
+		t.Fatalf("cell 179 = %+v, want key %x", bm, keys[1][179])
+	}
+
+	pdus := persistentKeyListPDUs(keys)
+	if len(pdus) != 2 {
+		t.Fatalf("got %d PDUs, want 2", len(pdus))
+	}
+	if p := pdus[0]; p.NumEntriesCache1 != 169 || p.TotalEntriesCache1 != 180 || p.BBitMask != PERSIST_FIRST_PDU {
+		t.Errorf("first PDU = %d/%d flags %d", p.NumEntriesCache1, p.TotalEntriesCache1, p.BBitMask)
+	}
+	if p := pdus[1]; p.NumEntriesCache1 != 11 || p.BBitMask != PERSIST_LAST_PDU {
+		t.Errorf("last PDU = %d flags %d", p.NumEntriesCache1, p.BBitMask)
+	}
+
+	var got PersistKeyPDU
+	if err := got.Unpack(bytes.NewReader(pdus[1].Serialize())); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Entries) != 11 || got.Entries[10] != pdus[1].Entries[10] {
+		t.Errorf("round trip entries = %v", got.Entries)
+	}
+	if n := len(NewDataPDU(pdus[1], 0).Serialize()); n != 12+24+11*8 {
+		t.Errorf("data PDU length = %d", n)
+	}
+}
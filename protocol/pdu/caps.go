@@ -2,7 +2,6 @@ package pdu
 
 import (
 	"bytes"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -291,6 +290,22 @@ const (
 	PTRFLAGS_BUTTON3        = 0x4000
 )
 
+// Synchronize event toggle flags (MS-RDPBCGR 2.2.8.1.1.3.1.1.5) and the
+// LED flags of the Set Keyboard Indicators PDU, which share the values.
+const (
+	TS_SYNC_SCROLL_LOCK = 0x00000001
+	TS_SYNC_NUM_LOCK    = 0x00000002
+	TS_SYNC_CAPS_LOCK   = 0x00000004
+	TS_SYNC_KANA_LOCK   = 0x00000008
+)
+
+// Extended mouse event flags (MS-RDPBCGR 2.2.8.1.1.3.1.1.4).
+const (
+	PTRXFLAGS_DOWN    = 0x8000
+	PTRXFLAGS_BUTTON1 = 0x0001
+	PTRXFLAGS_BUTTON2 = 0x0002
+)
+
 const (
 	KBDFLAGS_EXTENDED  = 0x0100
 	KBDFLAGS_EXTENDED1 = 0x0200
@@ -745,7 +760,7 @@ func (*DrawNineGridCapability) Type() CapsType {
 	return CAPSTYPE_DRAWNINEGRIDCACHE
 }
 
-func readCapability(r io.Reader) (Capability, error) {
+func readCapability(r io.Reader, log *slog.Logger) (Capability, error) {
 	capType, err := core.ReadUint16LE(r)
 	if err != nil {
 		return nil, err
@@ -825,13 +840,13 @@ func readCapability(r io.Reader) (Capability, error) {
 		c = &FrameAcknowledgeCapability{}
 	default:
 		err := errors.New(fmt.Sprintf("unsupported Capability type 0x%04x", capType))
-		slog.Error("readCapability", "err", err)
+		log.Error("readCapability", "err", err)
 		return nil, err
 	}
 	if err := struc.Unpack(capReader, c); err != nil {
-		slog.Error("readCapability", "err", err, "capType", capType, "capBytes", hex.EncodeToString(capBytes))
+		log.Error("readCapability", "err", err, "capType", capType, "capBytes", core.Hex(capBytes))
 		return nil, err
 	}
-	slog.Debug("Capability", "type", c.Type(), "value", c)
+	log.Debug("Capability", "type", c.Type(), "value", c)
 	return c, nil
 }
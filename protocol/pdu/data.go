@@ -2,16 +2,24 @@ package pdu
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"strings"
 	"sync"
 
 	"github.com/lunixbochs/struc"
 	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/protocol/t125/gcc"
 )
 
+// errUnsupportedPDU marks the PDUs well formed as far as the client
+// can tell but of a type it does not parse, which are dropped without
+// being reported as malformed.
+var errUnsupportedPDU = errors.New("unsupported")
+
 // capBuffPool pools bytes.Buffer instances used to serialize individual
 // capability structures inside DemandActivePDU and ConfirmActivePDU.
 // Each Serialize call borrows one buffer and returns it when done.
@@ -247,6 +255,32 @@ type ShareDataHeader struct {
 	CompressedLength   uint16 `struc:"little"`
 }
 
+// shareDataHeaderSize is the length of ShareDataHeader on the wire.
+const shareDataHeaderSize = 12
+
+func (h *ShareDataHeader) unpack(r io.Reader) error {
+	var b [shareDataHeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	h.SharedId = binary.LittleEndian.Uint32(b[0:])
+	h.Padding1 = b[4]
+	h.StreamId = b[5]
+	h.UncompressedLength = binary.LittleEndian.Uint16(b[6:])
+	h.PDUType2 = b[8]
+	h.CompressedType = b[9]
+	h.CompressedLength = binary.LittleEndian.Uint16(b[10:])
+	return nil
+}
+
+func (h *ShareDataHeader) append(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint32(b, h.SharedId)
+	b = append(b, h.Padding1, h.StreamId)
+	b = binary.LittleEndian.AppendUint16(b, h.UncompressedLength)
+	b = append(b, h.PDUType2, h.CompressedType)
+	return binary.LittleEndian.AppendUint16(b, h.CompressedLength)
+}
+
 func NewShareDataHeader(size int, type2 uint8, shareId uint32) *ShareDataHeader {
 	return &ShareDataHeader{
 		SharedId:           shareId,
@@ -298,7 +332,13 @@ func (d *DemandActivePDU) Serialize() []byte {
 	return buff.Bytes()
 }
 
-func readDemandActivePDU(r io.Reader) (*DemandActivePDU, error) {
+// ParseDemandActive parses the Demand Active PDU following the share
+// control header.
+func ParseDemandActive(data []byte) (*DemandActivePDU, error) {
+	return readDemandActivePDU(core.NewErrReader(bytes.NewReader(data)), core.DefaultLogger)
+}
+
+func readDemandActivePDU(r io.Reader, log *slog.Logger) (*DemandActivePDU, error) {
 	d := &DemandActivePDU{}
 	var err error
 	d.SharedId, err = core.ReadUInt32LE(r)
@@ -316,7 +356,7 @@ func readDemandActivePDU(r io.Reader) (*DemandActivePDU, error) {
 	d.Pad2Octets, err = core.ReadUint16LE(r)
 	d.CapabilitySets = make([]Capability, 0, d.NumberCapabilities)
 	for i := 0; i < int(d.NumberCapabilities); i++ {
-		c, err := readCapability(r)
+		c, err := readCapability(r, log)
 		if err != nil {
 			//return nil, err
 			continue
@@ -405,7 +445,7 @@ func NewConfirmActivePDU() *ConfirmActivePDU {
 	}
 }
 
-func readConfirmActivePDU(r io.Reader) (*ConfirmActivePDU, error) {
+func readConfirmActivePDU(r io.Reader, log *slog.Logger) (*ConfirmActivePDU, error) {
 	p := &ConfirmActivePDU{}
 	var err error
 	p.SharedId, err = core.ReadUInt32LE(r)
@@ -426,14 +466,14 @@ func readConfirmActivePDU(r io.Reader) (*ConfirmActivePDU, error) {
 
 	p.CapabilitySets = make([]Capability, 0, p.NumberCapabilities)
 	for i := 0; i < int(p.NumberCapabilities); i++ {
-		c, err := readCapability(r)
+		c, err := readCapability(r, log)
 		if err != nil {
 			return nil, err
 		}
 		p.CapabilitySets = append(p.CapabilitySets, c)
 	}
 	s, _ := core.ReadUInt32LE(r)
-	slog.Debug("readConfirmActivePDU", "sessionid", s)
+	log.Debug("readConfirmActivePDU", "sessionid", s)
 	return p, nil
 }
 
@@ -460,20 +500,39 @@ func readDeactiveAllPDU(r io.Reader) (*DeactiveAllPDU, error) {
 }
 
 // ServerRedirectionPDU represents the RDP Server Redirection PDU
-// (MS-RDPBCGR 2.2.13.2.1). Only the LoadBalanceInfo field (routing
-// token) is extracted; other optional fields are skipped.
+// (MS-RDPBCGR 2.2.13.2.1). The routing fields needed to reach the same
+// backend again (load balance info, target addresses, user and domain)
+// are extracted; the password, TSV URL and certificate are skipped.
 type ServerRedirectionPDU struct {
-	Flags           uint16
-	Length          uint16
-	SessionID       uint32
-	RedirFlags      uint32
-	LoadBalanceInfo []byte
+	Flags             uint16
+	Length            uint16
+	SessionID         uint32
+	RedirFlags        uint32
+	TargetNetAddress  string
+	LoadBalanceInfo   []byte
+	Username          string
+	Domain            string
+	TargetFQDN        string
+	TargetNetBiosName string
 }
 
 const (
-	LB_TARGET_NET_ADDRESS = 0x00000001
-	LB_LOAD_BALANCE_INFO  = 0x00000002
-	LB_USERNAME           = 0x00000004
+	LB_TARGET_NET_ADDRESS       = 0x00000001
+	LB_LOAD_BALANCE_INFO        = 0x00000002
+	LB_USERNAME                 = 0x00000004
+	LB_DOMAIN                   = 0x00000008
+	LB_PASSWORD                 = 0x00000010
+	LB_DONTSTOREUSERNAME        = 0x00000020
+	LB_SMARTCARD_LOGON          = 0x00000040
+	LB_NOREDIRECT               = 0x00000080
+	LB_TARGET_FQDN              = 0x00000100
+	LB_TARGET_NETBIOS_NAME      = 0x00000200
+	LB_TARGET_NET_ADDRESSES     = 0x00000800
+	LB_CLIENT_TSV_URL           = 0x00001000
+	LB_SERVER_TSV_CAPABLE       = 0x00002000
+	LB_PASSWORD_IS_PK_ENCRYPTED = 0x00004000
+	LB_REDIRECTION_GUID         = 0x00008000
+	LB_TARGET_CERTIFICATE       = 0x00010000
 )
 
 func (*ServerRedirectionPDU) Type() uint16 {
@@ -484,6 +543,29 @@ func (d *ServerRedirectionPDU) Serialize() []byte {
 	return nil
 }
 
+// readRedirField reads a length-prefixed variable field of the
+// redirection PDU.
+func readRedirField(name string, r io.Reader) ([]byte, error) {
+	cbLen, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return nil, fmt.Errorf("redir: read %s len: %w", name, err)
+	}
+	b, err := core.ReadBytes(int(cbLen), r)
+	if err != nil {
+		return nil, fmt.Errorf("redir: read %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// readRedirString reads a length-prefixed, null-terminated UTF-16LE field.
+func readRedirString(name string, r io.Reader) (string, error) {
+	b, err := readRedirField(name, r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(core.UnicodeDecode(b), "\x00"), nil
+}
+
 func readServerRedirectionPDU(r io.Reader) (*ServerRedirectionPDU, error) {
 	// Enhanced Security variant has a 2-byte pad before the PDU body
 	if _, err := core.ReadUint16LE(r); err != nil {
@@ -506,33 +588,41 @@ func readServerRedirectionPDU(r io.Reader) (*ServerRedirectionPDU, error) {
 	}
 
 	// Parse variable-length fields in flag order.
-	// We only need LoadBalanceInfo (routing token) for reconnection.
 	if redir.RedirFlags&LB_TARGET_NET_ADDRESS != 0 {
-		cbLen, err := core.ReadUInt32LE(r)
-		if err != nil {
-			return nil, fmt.Errorf("redir: read targetNetAddr len: %w", err)
-		}
-		if _, err := core.ReadBytes(int(cbLen), r); err != nil {
-			return nil, fmt.Errorf("redir: read targetNetAddr: %w", err)
+		if redir.TargetNetAddress, err = readRedirString("targetNetAddr", r); err != nil {
+			return nil, err
 		}
 	}
-
 	if redir.RedirFlags&LB_LOAD_BALANCE_INFO != 0 {
-		cbLen, err := core.ReadUInt32LE(r)
-		if err != nil {
-			return nil, fmt.Errorf("redir: read loadBalanceInfo len: %w", err)
+		if redir.LoadBalanceInfo, err = readRedirField("loadBalanceInfo", r); err != nil {
+			return nil, err
 		}
-		redir.LoadBalanceInfo, err = core.ReadBytes(int(cbLen), r)
-		if err != nil {
-			return nil, fmt.Errorf("redir: read loadBalanceInfo: %w", err)
+	}
+	if redir.RedirFlags&LB_USERNAME != 0 {
+		if redir.Username, err = readRedirString("username", r); err != nil {
+			return nil, err
+		}
+	}
+	if redir.RedirFlags&LB_DOMAIN != 0 {
+		if redir.Domain, err = readRedirString("domain", r); err != nil {
+			return nil, err
+		}
+	}
+	if redir.RedirFlags&LB_PASSWORD != 0 {
+		if _, err = readRedirField("password", r); err != nil {
+			return nil, err
+		}
+	}
+	if redir.RedirFlags&LB_TARGET_FQDN != 0 {
+		if redir.TargetFQDN, err = readRedirString("targetFQDN", r); err != nil {
+			return nil, err
+		}
+	}
+	if redir.RedirFlags&LB_TARGET_NETBIOS_NAME != 0 {
+		if redir.TargetNetBiosName, err = readRedirString("targetNetBiosName", r); err != nil {
+			return nil, err
 		}
 	}
-
-	slog.Debug("Server Redirection PDU",
-		"flags", redir.Flags,
-		"sessionID", redir.SessionID,
-		"redirFlags", redir.RedirFlags,
-		"loadBalanceInfo", string(redir.LoadBalanceInfo))
 	return redir, nil
 }
 
@@ -546,13 +636,29 @@ func (*DataPDU) Type() uint16 {
 }
 
 func (d *DataPDU) Serialize() []byte {
-	buff := &bytes.Buffer{}
-	struc.Pack(buff, d.Header)
+	if ds, ok := d.Data.(dataPDUSerializer); ok {
+		data := ds.Serialize()
+		return append(d.Header.append(make([]byte, 0, shareDataHeaderSize+len(data))), data...)
+	}
+	buff := bytes.NewBuffer(d.Header.append(nil))
 	struc.Pack(buff, d.Data)
 	return buff.Bytes()
 }
 
+// dataPDUSerializer is implemented by the data PDUs that pack themselves:
+// those struc cannot pack and those sent often enough for the cost of its
+// reflection to show, such as input and frame acknowledgements.
+type dataPDUSerializer interface {
+	Serialize() []byte
+}
+
 func NewDataPDU(data DataPDUData, shareId uint32) *DataPDU {
+	if ds, ok := data.(dataPDUSerializer); ok {
+		return &DataPDU{
+			Header: NewShareDataHeader(len(ds.Serialize()), data.Type2(), shareId),
+			Data:   data,
+		}
+	}
 	dataLen, err := struc.Sizeof(data)
 	if err != nil {
 		// Fallback: pack to measure length
@@ -566,38 +672,41 @@ func NewDataPDU(data DataPDUData, shareId uint32) *DataPDU {
 	}
 }
 
-func readDataPDU(r io.Reader, mppc *core.MppcDecompressor) (*DataPDU, error) {
+func readDataPDU(r io.Reader, bulk *core.BulkDecompressor, log *slog.Logger) (*DataPDU, error) {
 	header := &ShareDataHeader{}
-	err := struc.Unpack(r, header)
+	err := header.unpack(r)
 	if err != nil {
-		slog.Error("readDataPDU", "err", err)
+		log.Error("readDataPDU", "err", err)
 		return nil, err
 	}
 
-	// Decompress the payload when the server has compressed it.
-	if header.CompressedType != 0 && mppc != nil {
+	// Decompress the payload when the server has compressed it.  The
+	// compressed length counts the 18 byte share control and share data
+	// headers (MS-RDPBCGR 2.2.8.1.1.1.2).
+	if header.CompressedType != 0 && bulk != nil {
 		if header.CompressedType&RDP_MPPC_COMPRESSED != 0 {
-			compressed, err := core.ReadBytes(int(header.CompressedLength), r)
+			if header.CompressedLength < 18 {
+				return nil, fmt.Errorf("readDataPDU: compressed length %d too short", header.CompressedLength)
+			}
+			compressed, err := core.ReadBytes(int(header.CompressedLength)-18, r)
 			if err != nil {
-				slog.Error("readDataPDU: reading compressed payload", "err", err)
+				log.Error("readDataPDU: reading compressed payload", "err", err)
 				return nil, err
 			}
-			decompressed, err := mppc.Decompress(header.CompressedType, compressed)
+			decompressed, err := bulk.Decompress(header.CompressedType, compressed)
 			if err != nil {
-				slog.Error("readDataPDU: MPPC decompression failed", "err", err)
+				log.Error("readDataPDU: bulk decompression failed", "err", err)
 				return nil, err
 			}
-			r = bytes.NewReader(decompressed)
+			r = core.NewErrReader(bytes.NewReader(decompressed))
 		} else {
-			// CompressedType set but not COMPRESSED: update history only.
-			plain, _ := core.ReadBytes(int(header.CompressedLength), r)
-			_, _ = mppc.Decompress(header.CompressedType, plain)
-			r = bytes.NewReader(plain)
+			// Uncompressed, but the flush and at-front flags still apply.
+			_, _ = bulk.Decompress(header.CompressedType, nil)
 		}
 	}
 
 	var d DataPDUData
-	slog.Debug("readDataPDU", "PDUTYPE2", header.PDUType2)
+	log.Debug("readDataPDU", core.LogPDU, header.PDUType2)
 	switch header.PDUType2 {
 	case PDUTYPE2_UPDATE:
 		d = &UpdateDataPDU{}
@@ -626,17 +735,32 @@ func readDataPDU(r io.Reader, mppc *core.MppcDecompressor) (*DataPDU, error) {
 	case PDUTYPE2_SET_KEYBOARD_INDICATORS:
 		d = &SetKeyboardIndicatorsDataPDU{}
 
+	case PDUTYPE2_SHUTDOWN_DENIED:
+		d = &ShutdownDeniedPDU{}
+
+	case PDUTYPE2_MONITOR_LAYOUT_PDU:
+		d = &MonitorLayoutPDU{}
+
 	default:
-		err = fmt.Errorf("Unknown data pdu type2 0x%02x", header.PDUType2)
-		slog.Error("readDataPDU", "err", err)
+		err = fmt.Errorf("%w data pdu type2 0x%02x", errUnsupportedPDU, header.PDUType2)
+		log.Error("readDataPDU", "err", err)
 		return nil, err
 	}
 
 	err = d.Unpack(r)
+	if er, ok := r.(*core.ErrReader); ok && err == nil {
+		err = er.Err()
+	}
 	if err != nil {
-		slog.Error("readDataPDU", "err", err)
+		log.Error("readDataPDU", "err", err)
 		return nil, err
 	}
+	switch d := d.(type) {
+	case *UpdateDataPDU:
+		log.Debug("readDataPDU: update", "updateType", d.UpdateType)
+	case *PointerDataPDU:
+		log.Debug("readDataPDU: pointer", "messageType", d.MessageType, "parsed", d.Pdata != nil)
+	}
 
 	p := &DataPDU{
 		Header: header,
@@ -661,13 +785,15 @@ func (*UpdateDataPDU) Type2() uint8 {
 func (d *UpdateDataPDU) Unpack(r io.Reader) (err error) {
 	//slow path update
 	d.UpdateType, err = core.ReadUint16LE(r)
-	slog.Debug("FastPathUpdate", "type", d.UpdateType)
 	var p UpdateData
 	switch d.UpdateType {
 	case FASTPATH_UPDATETYPE_ORDERS:
+		core.ReadUint16LE(r)
+		p = &FastPathOrdersPDU{slowPath: true}
 	case FASTPATH_UPDATETYPE_BITMAP:
 		p = &BitmapUpdateDataPDU{}
 	case FASTPATH_UPDATETYPE_PALETTE:
+		p = &PaletteUpdateDataPDU{slowPath: true}
 	case FASTPATH_UPDATETYPE_SYNCHRONIZE:
 	}
 	if p != nil {
@@ -677,7 +803,7 @@ func (d *UpdateDataPDU) Unpack(r io.Reader) (err error) {
 			return err
 		}
 	} else {
-		return fmt.Errorf("Unsupport slow update type 0x%x", d.UpdateType)
+		return fmt.Errorf("%w slow update type 0x%x", errUnsupportedPDU, d.UpdateType)
 	}
 
 	d.Udata = p
@@ -706,7 +832,6 @@ func (d *PointerDataPDU) Unpack(r io.Reader) error {
 	if err != nil {
 		return err
 	}
-	slog.Debug("PointerDataPDU", "messageType", d.MessageType)
 	var p UpdateData
 	switch d.MessageType {
 	case TS_PTRUPDATE_TYPE_CACHED:
@@ -715,8 +840,6 @@ func (d *PointerDataPDU) Unpack(r io.Reader) error {
 		p = &FastPathUpdatePointerPDU{}
 	case TS_PTRUPDATE_TYPE_SYSTEM, TS_PTRUPDATE_TYPE_POSITION, TS_PTRUPDATE_TYPE_COLOR:
 		// not yet parsed; remaining data is discarded by the caller
-	default:
-		slog.Debug("PointerDataPDU: unhandled", "messageType", d.MessageType)
 	}
 	if p != nil {
 		if err = p.Unpack(r); err != nil {
@@ -765,6 +888,7 @@ func (f *BitmapUpdateDataPDU) Unpack(r io.Reader) error {
 		}
 
 		rect.BitmapDataStream, err = core.ReadBytes(int(ln), r)
+		rect.EncodedLength = int(rect.BitmapLength)
 		f.Rectangles = append(f.Rectangles, rect)
 	}
 	return err
@@ -827,6 +951,32 @@ func (d *ErrorInfoDataPDU) Unpack(r io.Reader) error {
 	return struc.Unpack(r, d)
 }
 
+// MonitorLayoutPDU is the server Monitor Layout PDU (MS-RDPBCGR
+// 2.2.12.1), the monitor layout the session actually uses.
+type MonitorLayoutPDU struct {
+	Monitors []gcc.MonitorDef
+}
+
+func (*MonitorLayoutPDU) Type2() uint8 {
+	return PDUTYPE2_MONITOR_LAYOUT_PDU
+}
+func (d *MonitorLayoutPDU) Unpack(r io.Reader) error {
+	n, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	if n > gcc.MONITOR_MAX_COUNT {
+		return fmt.Errorf("monitor layout: %d monitors", n)
+	}
+	d.Monitors = make([]gcc.MonitorDef, n)
+	for i := range d.Monitors {
+		if d.Monitors[i], err = gcc.ReadMonitorDef(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type FontMapDataPDU struct {
 	NumberEntries   uint16 `struc:"little"`
 	TotalNumEntries uint16 `struc:"little"`
@@ -861,6 +1011,28 @@ func (d *SetKeyboardIndicatorsDataPDU) Unpack(r io.Reader) error {
 	return struc.Unpack(r, d)
 }
 
+// ShutdownRequestPDU asks the server whether the client may disconnect.
+// It has no body.  MS-RDPBCGR 2.2.2.2
+type ShutdownRequestPDU struct{}
+
+func (*ShutdownRequestPDU) Type2() uint8 {
+	return PDUTYPE2_SHUTDOWN_REQUEST
+}
+func (d *ShutdownRequestPDU) Unpack(r io.Reader) error {
+	return nil
+}
+
+// ShutdownDeniedPDU is the server's answer to a Shutdown Request PDU when
+// the session stays alive.  MS-RDPBCGR 2.2.2.3
+type ShutdownDeniedPDU struct{}
+
+func (*ShutdownDeniedPDU) Type2() uint8 {
+	return PDUTYPE2_SHUTDOWN_DENIED
+}
+func (d *ShutdownDeniedPDU) Unpack(r io.Reader) error {
+	return nil
+}
+
 // SuppressOutputPDU tells the server to start/stop sending display updates.
 // MS-RDPBCGR 2.2.11.3.1
 type SuppressOutputPDU struct {
@@ -888,7 +1060,12 @@ func (*FrameAcknowledgeDataPDU) Type2() uint8 {
 	return PDUTYPE2_FRAME_ACKNOWLEDGE
 }
 func (d *FrameAcknowledgeDataPDU) Unpack(r io.Reader) error {
-	return struc.Unpack(r, d)
+	var err error
+	d.FrameID, err = core.ReadUInt32LE(r)
+	return err
+}
+func (d *FrameAcknowledgeDataPDU) Serialize() []byte {
+	return binary.LittleEndian.AppendUint32(nil, d.FrameID)
 }
 
 // RefreshRectPDU requests the server to redraw one or more screen regions.
@@ -929,42 +1106,120 @@ type LogonFields struct {
 	LogonId    uint32   `struc:"little"`
 	random     [16]byte //16 `struc:"little"`
 }
+
+/**
+ * Logon error notification types and data of TS_LOGON_ERRORS_INFO
+ * @see https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/845eb789-6edf-453a-8b0e-c976823d1f72
+ */
+const (
+	LOGON_MSG_DISCONNECT_REFUSED uint32 = 0xFFFFFFF9
+	LOGON_MSG_NO_PERMISSION             = 0xFFFFFFFA
+	LOGON_MSG_BUMP_OPTIONS              = 0xFFFFFFFB
+	LOGON_MSG_RECONNECT_OPTIONS         = 0xFFFFFFFC
+	LOGON_MSG_SESSION_TERMINATE         = 0xFFFFFFFD
+	LOGON_MSG_SESSION_CONTINUE          = 0xFFFFFFFE
+	LOGON_FAILED_BAD_PASSWORD           = 0x00000000
+	LOGON_FAILED_UPDATE_PASSWORD        = 0x00000001
+	LOGON_FAILED_OTHER                  = 0x00000002
+	LOGON_WARNING                       = 0x00000003
+)
+
+const (
+	STATUS_FINDING_DESTINATION        = 0xFFFFFFFE
+	STATUS_LOADING_DESTINATION        = 0xFFFFFFFD
+	STATUS_BRINGING_SESSION_ONLINE    = 0xFFFFFFFC
+	STATUS_REDIRECTING_TO_DESTINATION = 0xFFFFFFFB
+	STATUS_VM_LOADING                 = 0xFFFFFFFA
+	STATUS_VM_WAKING                  = 0xFFFFFFF9
+	STATUS_VM_STARTING                = 0xFFFFFFF8
+	STATUS_VM_STARTING_MONITORING     = 0xFFFFFFF7
+	STATUS_VM_RETRYING_MONITORING     = 0xFFFFFFF6
+)
+
+// ARC_SC_PRIVATE_PACKET length and version
+const (
+	ARC_SC_PRIVATE_PACKET_LENGTH  = 28
+	ARC_SC_PRIVATE_PACKET_VERSION = 1
+)
+
+// SaveSessionInfo is the Save Session Info PDU (MS-RDPBCGR 2.2.10.1).
+// Which fields are set depends on InfoType: LogonId, UserName and Domain
+// for INFOTYPE_LOGON and INFOTYPE_LOGON_LONG, and for
+// INFOTYPE_LOGON_EXTENDED_INFO the fields named by FieldsPresent.
 type SaveSessionInfo struct {
 	InfoType      uint32
 	Length        uint16
 	FieldsPresent uint32
 	LogonId       uint32
-	Random        []byte
+	UserName      string
+	Domain        string
+
+	// Random is the ArcRandomBits of the auto-reconnect cookie, LogonId its
+	// session ID (LOGON_EX_AUTORECONNECTCOOKIE).
+	Random []byte
+
+	// ErrorNotificationType is one of LOGON_MSG_* and LOGON_FAILED_*,
+	// ErrorNotificationData a session ID or STATUS_* (LOGON_EX_LOGONERRORS).
+	ErrorNotificationType uint32
+	ErrorNotificationData uint32
+}
+
+// unicodeField decodes a NUL-terminated UTF-16 field of cb bytes held in
+// b, which may be a fixed-size buffer.
+func unicodeField(b []byte, cb uint32) string {
+	if int(cb) < len(b) {
+		b = b[:cb]
+	}
+	return strings.TrimRight(core.UnicodeDecode(b), "\x00")
 }
 
 func (s *SaveSessionInfo) logonInfoV1(r io.Reader) (err error) {
-	core.ReadUInt32LE(r) // cbDomain
-	b, _ := core.ReadBytes(52, r)
-	domain := core.UnicodeDecode(b)
+	cbDomain, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	b, err := core.ReadBytes(52, r)
+	if err != nil {
+		return err
+	}
+	s.Domain = unicodeField(b, cbDomain)
 
-	core.ReadUInt32LE(r) // cbUserName
-	b, _ = core.ReadBytes(512, r)
-	userName := core.UnicodeDecode(b)
+	cbUserName, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	b, err = core.ReadBytes(512, r)
+	if err != nil {
+		return err
+	}
+	s.UserName = unicodeField(b, cbUserName)
 
-	sessionId, _ := core.ReadUInt32LE(r)
-	s.LogonId = sessionId
-	slog.Debug("logonInfo", "sessionId", s.LogonId, "userName", userName, "domain", domain)
+	s.LogonId, err = core.ReadUInt32LE(r)
 	return err
 }
 func (s *SaveSessionInfo) logonInfoV2(r io.Reader) (err error) {
-	core.ReadUint16LE(r)
-	core.ReadUInt32LE(r)
-	sessionId, _ := core.ReadUInt32LE(r)
-	s.LogonId = sessionId
+	core.ReadUint16LE(r) // version
+	core.ReadUInt32LE(r) // size
+	s.LogonId, _ = core.ReadUInt32LE(r)
 	cbDomain, _ := core.ReadUInt32LE(r)
-	cbUserName, _ := core.ReadUInt32LE(r)
-	core.ReadBytes(558, r)
+	cbUserName, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	if _, err = core.ReadBytes(558, r); err != nil {
+		return err
+	}
 
-	b, _ := core.ReadBytes(int(cbDomain), r)
-	domain := core.UnicodeDecode(b)
-	b, _ = core.ReadBytes(int(cbUserName), r)
-	userName := core.UnicodeDecode(b)
-	slog.Debug("logonInfoV2", "sessionId", s.LogonId, "userName", userName, "domain", domain)
+	b, err := core.ReadBytes(int(cbDomain), r)
+	if err != nil {
+		return err
+	}
+	s.Domain = unicodeField(b, cbDomain)
+	b, err = core.ReadBytes(int(cbUserName), r)
+	if err != nil {
+		return err
+	}
+	s.UserName = unicodeField(b, cbUserName)
 
 	return err
 }
@@ -973,31 +1228,36 @@ func (s *SaveSessionInfo) logonPlainNotify(r io.Reader) (err error) {
 	return err
 }
 func (s *SaveSessionInfo) logonInfoExtended(r io.Reader) (err error) {
-	s.Length, err = core.ReadUint16LE(r)
+	s.Length, _ = core.ReadUint16LE(r)
 	s.FieldsPresent, err = core.ReadUInt32LE(r)
-	//slog.Debug("FieldsPresent:", s.FieldsPresent)
-	// auto reconnect cookie
+	if err != nil {
+		return err
+	}
+	// the fields follow in bit order, each preceded by its length
 	if s.FieldsPresent&LOGON_EX_AUTORECONNECTCOOKIE != 0 {
-		core.ReadUInt32LE(r)
+		core.ReadUInt32LE(r) // cbFieldData
 		b, _ := core.ReadUInt32LE(r)
-		if b != 28 {
+		if b != ARC_SC_PRIVATE_PACKET_LENGTH {
 			return errors.New("invalid length in Auto-Reconnect packet")
 		}
 		b, _ = core.ReadUInt32LE(r)
-		if b != 1 {
+		if b != ARC_SC_PRIVATE_PACKET_VERSION {
 			return errors.New("unsupported version of Auto-Reconnect packet")
 		}
-		b, _ = core.ReadUInt32LE(r)
-		s.LogonId = b
-		s.Random, _ = core.ReadBytes(16, r)
-	} else { // logon error info
-		core.ReadUInt32LE(r)
-		b, _ := core.ReadUInt32LE(r)
-		b, _ = core.ReadUInt32LE(r)
-		s.LogonId = b
+		s.LogonId, _ = core.ReadUInt32LE(r)
+		if s.Random, err = core.ReadBytes(16, r); err != nil {
+			return err
+		}
+	}
+	if s.FieldsPresent&LOGON_EX_LOGONERRORS != 0 {
+		core.ReadUInt32LE(r) // cbFieldData
+		s.ErrorNotificationType, _ = core.ReadUInt32LE(r)
+		if s.ErrorNotificationData, err = core.ReadUInt32LE(r); err != nil {
+			return err
+		}
 	}
 	core.ReadBytes(570, r)
-	return err
+	return nil
 }
 func (s *SaveSessionInfo) Unpack(r io.Reader) (err error) {
 	s.InfoType, err = core.ReadUInt32LE(r)
@@ -1022,24 +1282,54 @@ func (*SaveSessionInfo) Type2() uint8 {
 }
 
 type PersistKeyPDU struct {
-	NumEntriesCache0   uint16 `struc:"little"`
-	NumEntriesCache1   uint16 `struc:"little"`
-	NumEntriesCache2   uint16 `struc:"little"`
-	NumEntriesCache3   uint16 `struc:"little"`
-	NumEntriesCache4   uint16 `struc:"little"`
-	TotalEntriesCache0 uint16 `struc:"little"`
-	TotalEntriesCache1 uint16 `struc:"little"`
-	TotalEntriesCache2 uint16 `struc:"little"`
-	TotalEntriesCache3 uint16 `struc:"little"`
-	TotalEntriesCache4 uint16 `struc:"little"`
-	BBitMask           uint8  `struc:"little"`
-	Pad1               uint8  `struc:"little"`
-	Ppad3              uint16 `struc:"little"`
+	NumEntriesCache0   uint16            `struc:"little"`
+	NumEntriesCache1   uint16            `struc:"little"`
+	NumEntriesCache2   uint16            `struc:"little"`
+	NumEntriesCache3   uint16            `struc:"little"`
+	NumEntriesCache4   uint16            `struc:"little"`
+	TotalEntriesCache0 uint16            `struc:"little"`
+	TotalEntriesCache1 uint16            `struc:"little"`
+	TotalEntriesCache2 uint16            `struc:"little"`
+	TotalEntriesCache3 uint16            `struc:"little"`
+	TotalEntriesCache4 uint16            `struc:"little"`
+	BBitMask           uint8             `struc:"little"`
+	Pad1               uint8             `struc:"little"`
+	Ppad3              uint16            `struc:"little"`
+	Entries            []PersistKeyEntry `struc:"skip"`
+}
+
+// PersistKeyEntry is a TS_BITMAPCACHE_PERSISTENT_LIST_ENTRY, the two
+// halves of a 64-bit persistent bitmap key.
+type PersistKeyEntry struct {
+	Key1 uint32 `struc:"little"`
+	Key2 uint32 `struc:"little"`
 }
 
 func (*PersistKeyPDU) Type2() uint8 {
 	return PDUTYPE2_BITMAPCACHE_PERSISTENT_LIST
 }
+func (d *PersistKeyPDU) Unpack(r io.Reader) error {
+	if err := struc.Unpack(r, d); err != nil {
+		return err
+	}
+	n := int(d.NumEntriesCache0) + int(d.NumEntriesCache1) + int(d.NumEntriesCache2) +
+		int(d.NumEntriesCache3) + int(d.NumEntriesCache4)
+	d.Entries = make([]PersistKeyEntry, n)
+	for i := range d.Entries {
+		if err := struc.Unpack(r, &d.Entries[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (d *PersistKeyPDU) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	struc.Pack(buff, d)
+	for i := range d.Entries {
+		struc.Pack(buff, &d.Entries[i])
+	}
+	return buff.Bytes()
+}
 
 type UpdateData interface {
 	FastPathUpdateType() uint8
@@ -1065,6 +1355,39 @@ type BitmapData struct {
 	BitmapLength     uint16 `struc:"little,sizeof=BitmapDataStream"`
 	BitmapComprHdr   *BitmapCompressedDataHeader
 	BitmapDataStream []byte
+
+	// CodecID is the surface bits codec (0 none, 1 NSCodec, 3 RemoteFX)
+	// for BITMAP_NO_PROCESSING rectangles; it is not part of TS_BITMAP_DATA.
+	CodecID uint8 `struc:"skip"`
+	// EncodedLength is the size of the bitmap data as received.
+	EncodedLength int `struc:"skip"`
+}
+
+// BitmapUpdateType identifies the update that carried a "bitmap" event.
+type BitmapUpdateType uint8
+
+const (
+	BITMAP_UPDATE_SLOWPATH     BitmapUpdateType = iota // slow-path Update PDU
+	BITMAP_UPDATE_FASTPATH                             // fast-path bitmap update
+	BITMAP_UPDATE_SURFACE_BITS                         // fast-path surface commands
+	BITMAP_UPDATE_ORDERS                               // rendered drawing orders
+	BITMAP_UPDATE_GFX                                  // RDPGFX dynamic channel
+)
+
+func (t BitmapUpdateType) String() string {
+	switch t {
+	case BITMAP_UPDATE_SLOWPATH:
+		return "slowpath"
+	case BITMAP_UPDATE_FASTPATH:
+		return "fastpath"
+	case BITMAP_UPDATE_SURFACE_BITS:
+		return "surfacebits"
+	case BITMAP_UPDATE_ORDERS:
+		return "orders"
+	case BITMAP_UPDATE_GFX:
+		return "gfx"
+	}
+	return fmt.Sprintf("BitmapUpdateType(%d)", uint8(t))
 }
 
 func (b *BitmapData) IsCompress() bool {
@@ -1104,6 +1427,7 @@ func (f *FastPathBitmapUpdateDataPDU) Unpack(r io.Reader) error {
 		}
 
 		rect.BitmapDataStream, err = core.ReadBytes(int(ln), r)
+		rect.EncodedLength = int(rect.BitmapLength)
 		f.Rectangles = append(f.Rectangles, rect)
 	}
 	return err
@@ -1132,6 +1456,52 @@ func (f *FastPathColorPdu) Unpack(r io.Reader) error {
 	return struc.Unpack(r, f)
 }
 
+// PaletteEntry is one colour of a palette update.
+type PaletteEntry struct {
+	Red   uint8
+	Green uint8
+	Blue  uint8
+}
+
+// PaletteUpdateDataPDU is the palette of an 8bpp session.
+// (MS-RDPBCGR 2.2.9.1.1.3.1.1.1)
+type PaletteUpdateDataPDU struct {
+	// slowPath is set for a slow-path Update PDU, whose updateType field
+	// has already been read.
+	slowPath     bool
+	NumberColors uint32
+	Entries      []PaletteEntry
+}
+
+func (*PaletteUpdateDataPDU) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_PALETTE
+}
+func (f *PaletteUpdateDataPDU) Unpack(r io.Reader) error {
+	if !f.slowPath {
+		if _, err := core.ReadUint16LE(r); err != nil {
+			return err
+		}
+	}
+	core.ReadUint16LE(r)
+	n, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	if n > 256 {
+		return fmt.Errorf("palette update: %d colors", n)
+	}
+	f.NumberColors = n
+	b, err := core.ReadBytes(int(n)*3, r)
+	if err != nil {
+		return err
+	}
+	f.Entries = make([]PaletteEntry, n)
+	for i := range f.Entries {
+		f.Entries[i] = PaletteEntry{b[i*3], b[i*3+1], b[i*3+2]}
+	}
+	return nil
+}
+
 type FastPathSurfaceCmds struct {
 	Rects []BitmapData
 }
@@ -1148,11 +1518,17 @@ func (f *FastPathSurfaceCmds) Unpack(r io.Reader) error {
 type SurfaceCommandsResult struct {
 	Rects    []BitmapData
 	FrameIDs []uint32
+	// Err is the first decode error; rectangles after it are dropped.
+	Err error
 }
 
 // ParseSurfaceCommands parses one or more surface commands from raw data
 // and returns decoded BitmapData rectangles and frame IDs that need acknowledgment.
 func ParseSurfaceCommands(data []byte) SurfaceCommandsResult {
+	return parseSurfaceCommands(data, core.DefaultLogger)
+}
+
+func parseSurfaceCommands(data []byte, log *slog.Logger) SurfaceCommandsResult {
 	r := bytes.NewReader(data)
 	var result SurfaceCommandsResult
 	for r.Len() > 0 {
@@ -1162,9 +1538,10 @@ func ParseSurfaceCommands(data []byte) SurfaceCommandsResult {
 		}
 		switch cmdType {
 		case CMDTYPE_SET_SURFACE_BITS, CMDTYPE_STREAM_SURFACE_BITS:
-			rect, err := decodeSurfaceBitsCmd(r)
+			rect, err := decodeSurfaceBitsCmd(r, log)
 			if err != nil {
-				slog.Warn("decodeSurfaceBitsCmd", "err", err)
+				log.Warn("decodeSurfaceBitsCmd", "err", err)
+				result.Err = err
 				return result
 			}
 			if rect != nil {
@@ -1177,7 +1554,7 @@ func ParseSurfaceCommands(data []byte) SurfaceCommandsResult {
 				result.FrameIDs = append(result.FrameIDs, frameId)
 			}
 		default:
-			slog.Warn("Unknown surface command type", "cmdType", cmdType)
+			log.Warn("Unknown surface command type", "cmdType", cmdType)
 			return result
 		}
 	}
@@ -1185,7 +1562,7 @@ func ParseSurfaceCommands(data []byte) SurfaceCommandsResult {
 }
 
 // decodeSurfaceBitsCmd parses a SET_SURFACE_BITS or STREAM_SURFACE_BITS command.
-func decodeSurfaceBitsCmd(r io.Reader) (*BitmapData, error) {
+func decodeSurfaceBitsCmd(r io.Reader, log *slog.Logger) (*BitmapData, error) {
 	destLeft, err := core.ReadUint16LE(r)
 	if err != nil {
 		return nil, err
@@ -1206,6 +1583,9 @@ func decodeSurfaceBitsCmd(r io.Reader) (*BitmapData, error) {
 	// Skip extended compressed bitmap header if present (24 bytes).
 	// bitmapDataLength includes this header size when the flag is set.
 	if flags&0x01 != 0 {
+		if bitmapDataLength < 24 {
+			return nil, fmt.Errorf("bitmap data length %d shorter than its extended header", bitmapDataLength)
+		}
 		core.ReadBytes(24, r)
 		bitmapDataLength -= 24
 	}
@@ -1215,34 +1595,38 @@ func decodeSurfaceBitsCmd(r io.Reader) (*BitmapData, error) {
 		return nil, fmt.Errorf("failed to read bitmap data: %v", err)
 	}
 
-	slog.Debug("decodeSurfaceBitsCmd",
+	log.Debug("decodeSurfaceBitsCmd",
 		"destLeft", destLeft, "destTop", destTop, "destRight", destRight, "destBottom", destBottom,
 		"width", width, "height", height,
 		"bpp", bpp, "codecID", codecID, "flags", flags, "dataLen", bitmapDataLength)
 
+	if err := core.CheckBitmapSize(int(width), int(height)); err != nil {
+		return nil, err
+	}
+
 	var pixels []byte
 	outBpp := uint16(bpp)
 	switch codecID {
 	case 0: // Uncompressed
 		pixels = bitmapData
 	case 1: // NSCodec
-		pixels = decodeNSCodec(bitmapData, int(width), int(height))
+		pixels = decodeNSCodec(bitmapData, int(width), int(height), log)
 		outBpp = 32 // NSCodec always decodes to BGRA (4 bytes/pixel)
 	case 3: // RemoteFX (MS-RDPRFX)
 		if DecodeRemoteFX != nil {
 			pixels = DecodeRemoteFX(bitmapData, int(width), int(height))
 			outBpp = 32
 		} else {
-			slog.Warn("RemoteFX surface codec not available", "codecID", codecID)
+			log.Warn("RemoteFX surface codec not available", "codecID", codecID)
 			return nil, nil
 		}
 	default:
-		slog.Warn("Unsupported surface codec", "codecID", codecID)
+		log.Warn("Unsupported surface codec", "codecID", codecID)
 		return nil, nil // skip unsupported codecs
 	}
 
 	if pixels == nil {
-		return nil, nil
+		return nil, fmt.Errorf("surface codec %d: decode failed", codecID)
 	}
 
 	// Flip vertically for bottom-up codecs. NSCodec decodes top-down but the
@@ -1251,6 +1635,9 @@ func decodeSurfaceBitsCmd(r io.Reader) (*BitmapData, error) {
 	if codecID != 3 {
 		stride := int(width) * int(outBpp) / 8
 		h := int(height)
+		if len(pixels) < stride*h {
+			return nil, fmt.Errorf("surface codec %d: %d bytes for a %dx%d bitmap", codecID, len(pixels), width, height)
+		}
 		for y := 0; y < h/2; y++ {
 			top := y * stride
 			bot := (h - 1 - y) * stride
@@ -1269,6 +1656,8 @@ func decodeSurfaceBitsCmd(r io.Reader) (*BitmapData, error) {
 		Height:           height,
 		BitsPerPixel:     outBpp,
 		Flags:            BITMAP_NO_PROCESSING,
+		CodecID:          codecID,
+		EncodedLength:    int(bitmapDataLength),
 		BitmapLength:     0,
 		BitmapDataStream: pixels,
 	}, nil
@@ -1276,9 +1665,9 @@ func decodeSurfaceBitsCmd(r io.Reader) (*BitmapData, error) {
 
 // decodeNSCodec decodes NSCodec (MS-RDPNSC) encoded bitmap data into BGRA pixels.
 // Implements the decoder exactly as FreeRDP does (libfreerdp/codec/nsc.c).
-func decodeNSCodec(data []byte, width, height int) []byte {
+func decodeNSCodec(data []byte, width, height int, log *slog.Logger) []byte {
 	if len(data) < 20 {
-		slog.Warn("NSCodec data too short", "len", len(data))
+		log.Warn("NSCodec data too short", "len", len(data))
 		return nil
 	}
 
@@ -1296,7 +1685,7 @@ func decodeNSCodec(data []byte, width, height int) []byte {
 	}
 	shift := colorLossLevel - 1
 
-	slog.Debug("NSCodec",
+	log.Debug("NSCodec",
 		"lumaLen", lumaLen, "orangeLen", orangeLen,
 		"greenLen", greenLen, "alphaLen", alphaLen,
 		"colorLossLevel", colorLossLevel,
@@ -1307,7 +1696,7 @@ func decodeNSCodec(data []byte, width, height int) []byte {
 	// Bounds check
 	totalPlaneLen := int(lumaLen + orangeLen + greenLen + alphaLen)
 	if totalPlaneLen > len(remaining) {
-		slog.Warn("NSCodec plane lengths exceed data",
+		log.Warn("NSCodec plane lengths exceed data",
 			"planeLens", totalPlaneLen, "available", len(remaining))
 		return nil
 	}
@@ -1626,7 +2015,24 @@ func (*FastPathUpdatePointerPDU) FastPathUpdateType() uint8 {
 }
 
 func (f *FastPathUpdatePointerPDU) Unpack(r io.Reader) error {
-	return struc.Unpack(r, f)
+	var b [16]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	f.XorBpp = binary.LittleEndian.Uint16(b[0:])
+	f.CacheIdx = binary.LittleEndian.Uint16(b[2:])
+	f.X = binary.LittleEndian.Uint16(b[4:])
+	f.Y = binary.LittleEndian.Uint16(b[6:])
+	f.Width = binary.LittleEndian.Uint16(b[8:])
+	f.Height = binary.LittleEndian.Uint16(b[10:])
+	f.MaskLen = binary.LittleEndian.Uint16(b[12:])
+	f.DataLen = binary.LittleEndian.Uint16(b[14:])
+	var err error
+	if f.Data, err = core.ReadBytes(int(f.DataLen), r); err != nil {
+		return err
+	}
+	f.Mask, err = core.ReadBytes(int(f.MaskLen), r)
+	return err
 }
 
 type FastPathPointerPositionPDU struct {
@@ -1639,7 +2045,13 @@ func (*FastPathPointerPositionPDU) FastPathUpdateType() uint8 {
 }
 
 func (f *FastPathPointerPositionPDU) Unpack(r io.Reader) error {
-	return struc.Unpack(r, f)
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	f.X = binary.LittleEndian.Uint16(b[0:])
+	f.Y = binary.LittleEndian.Uint16(b[2:])
+	return nil
 }
 
 type FastPathUpdatePointerNullPDU struct {
@@ -1661,7 +2073,9 @@ func (*FastPathUpdateCachedPDU) FastPathUpdateType() uint8 {
 }
 
 func (f *FastPathUpdateCachedPDU) Unpack(r io.Reader) error {
-	return struc.Unpack(r, f)
+	var err error
+	f.CacheIdx, err = core.ReadUint16LE(r)
+	return err
 }
 
 type FastPathUpdatePDU struct {
@@ -1683,6 +2097,12 @@ const (
 	FASTPATH_FRAGMENT_NEXT   = (0x3 << 4)
 )
 
+// ParseFastPathUpdate parses the updateData of a fast-path update of type
+// code (FASTPATH_UPDATETYPE_*), once reassembled and decompressed.
+func ParseFastPathUpdate(code uint8, data []byte) (*FastPathUpdatePDU, error) {
+	return readFastPathUpdatePDU(bytes.NewReader(data), code)
+}
+
 func readFastPathUpdatePDU(r io.Reader, code uint8) (*FastPathUpdatePDU, error) {
 	f := &FastPathUpdatePDU{}
 	var err error
@@ -1693,6 +2113,7 @@ func readFastPathUpdatePDU(r io.Reader, code uint8) (*FastPathUpdatePDU, error)
 	case FASTPATH_UPDATETYPE_BITMAP:
 		d = &FastPathBitmapUpdateDataPDU{}
 	case FASTPATH_UPDATETYPE_PALETTE:
+		d = &PaletteUpdateDataPDU{}
 	case FASTPATH_UPDATETYPE_SYNCHRONIZE:
 	case FASTPATH_UPDATETYPE_SURFCMDS:
 		//d = &FastPathSurfaceCmds{}
@@ -1709,16 +2130,20 @@ func readFastPathUpdatePDU(r io.Reader, code uint8) (*FastPathUpdatePDU, error)
 		d = &FastPathUpdatePointerPDU{}
 	case FASTPATH_UPDATETYPE_LARGE_POINTER:
 	default:
-		return f, fmt.Errorf("Unknown FastPathPDU type 0x%x", code)
+		return f, fmt.Errorf("%w FastPathPDU type 0x%x", errUnsupportedPDU, code)
 	}
 	if d != nil {
-		err = d.Unpack(r)
+		er := core.NewErrReader(r)
+		err = d.Unpack(er)
+		if err == nil {
+			err = er.Err()
+		}
 		if err != nil {
 			//slog.Error("Unpack:", err)
 			return nil, err
 		}
 	} else {
-		return nil, fmt.Errorf("Unsupport FastPathPDU type 0x%x", code)
+		return nil, fmt.Errorf("%w FastPathPDU type 0x%x", errUnsupportedPDU, code)
 	}
 
 	f.Data = d
@@ -1731,6 +2156,26 @@ type ShareControlHeader struct {
 	PDUSource   uint16 `struc:"little"`
 }
 
+// shareControlHeaderSize is the length of ShareControlHeader on the wire.
+const shareControlHeaderSize = 6
+
+func (h *ShareControlHeader) unpack(r io.Reader) error {
+	var b [shareControlHeaderSize]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return err
+	}
+	h.TotalLength = binary.LittleEndian.Uint16(b[0:])
+	h.PDUType = binary.LittleEndian.Uint16(b[2:])
+	h.PDUSource = binary.LittleEndian.Uint16(b[4:])
+	return nil
+}
+
+func (h *ShareControlHeader) append(b []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, h.TotalLength)
+	b = binary.LittleEndian.AppendUint16(b, h.PDUType)
+	return binary.LittleEndian.AppendUint16(b, h.PDUSource)
+}
+
 type PDU struct {
 	ShareCtrlHeader *ShareControlHeader
 	Message         PDUMessage
@@ -1739,7 +2184,7 @@ type PDU struct {
 func NewPDU(userId uint16, message PDUMessage) *PDU {
 	pdu := &PDU{}
 	pdu.ShareCtrlHeader = &ShareControlHeader{
-		TotalLength: uint16(len(message.Serialize()) + 6),
+		TotalLength: uint16(len(message.Serialize()) + shareControlHeaderSize),
 		PDUType:     message.Type(),
 		PDUSource:   userId,
 	}
@@ -1747,11 +2192,20 @@ func NewPDU(userId uint16, message PDUMessage) *PDU {
 	return pdu
 }
 
-func readPDU(r io.Reader, mppc *core.MppcDecompressor) (*PDU, error) {
+// ParsePDU parses a slow-path PDU from its share control header.  The
+// payload of a bulk compressed data PDU is decompressed with a fresh
+// history, so only the first PDU of a compressed stream parses.
+func ParsePDU(data []byte) (*PDU, error) {
+	return readPDU(bytes.NewReader(data), core.NewBulkDecompressor(), core.DefaultLogger)
+}
+
+func readPDU(r io.Reader, bulk *core.BulkDecompressor, log *slog.Logger) (*PDU, error) {
+	er := core.NewErrReader(r)
+	r = er
 	pdu := &PDU{}
 	var err error
 	header := &ShareControlHeader{}
-	err = struc.Unpack(r, header)
+	err = header.unpack(r)
 	if err != nil {
 		return nil, err
 	}
@@ -1761,22 +2215,35 @@ func readPDU(r io.Reader, mppc *core.MppcDecompressor) (*PDU, error) {
 	var d PDUMessage
 	switch pdu.ShareCtrlHeader.PDUType {
 	case PDUTYPE_DEMANDACTIVEPDU:
-		slog.Debug("readPDU:PDUTYPE_DEMANDACTIVEPDU")
-		d, err = readDemandActivePDU(r)
+		log.Debug("readPDU", core.LogPDU, "PDUTYPE_DEMANDACTIVEPDU")
+		d, err = readDemandActivePDU(r, log)
 	case PDUTYPE_DATAPDU:
-		slog.Debug("readPDU:PDUTYPE_DATAPDU")
-		d, err = readDataPDU(r, mppc)
+		log.Debug("readPDU", core.LogPDU, "PDUTYPE_DATAPDU")
+		d, err = readDataPDU(r, bulk, log)
 	case PDUTYPE_CONFIRMACTIVEPDU:
-		slog.Debug("readPDU:PDUTYPE_CONFIRMACTIVEPDU")
-		d, err = readConfirmActivePDU(r)
+		log.Debug("readPDU", core.LogPDU, "PDUTYPE_CONFIRMACTIVEPDU")
+		d, err = readConfirmActivePDU(r, log)
 	case PDUTYPE_DEACTIVATEALLPDU:
-		slog.Debug("readPDU:PDUTYPE_DEACTIVATEALLPDU")
+		log.Debug("readPDU", core.LogPDU, "PDUTYPE_DEACTIVATEALLPDU")
 		d, err = readDeactiveAllPDU(r)
 	case PDUTYPE_SERVER_REDIR_PKT:
-		slog.Debug("readPDU:PDUTYPE_SERVER_REDIR_PKT")
-		d, err = readServerRedirectionPDU(r)
+		log.Debug("readPDU", core.LogPDU, "PDUTYPE_SERVER_REDIR_PKT")
+		var redir *ServerRedirectionPDU
+		if redir, err = readServerRedirectionPDU(r); err == nil {
+			log.Debug("Server Redirection PDU",
+				"flags", redir.Flags,
+				"sessionID", redir.SessionID,
+				"redirFlags", redir.RedirFlags,
+				"targetNetAddress", redir.TargetNetAddress,
+				"targetFQDN", redir.TargetFQDN,
+				"loadBalanceInfo", string(redir.LoadBalanceInfo))
+		}
+		d = redir
 	default:
-		slog.Error("PDU invalid pdu type", "type", fmt.Sprintf("0x%02x", pdu.ShareCtrlHeader.PDUType))
+		log.Error("PDU invalid pdu type", core.LogPDU, fmt.Sprintf("0x%02x", pdu.ShareCtrlHeader.PDUType))
+	}
+	if err == nil {
+		err = er.Err()
 	}
 	if err != nil {
 		return nil, err
@@ -1786,10 +2253,8 @@ func readPDU(r io.Reader, mppc *core.MppcDecompressor) (*PDU, error) {
 }
 
 func (p *PDU) serialize() []byte {
-	buff := &bytes.Buffer{}
-	struc.Pack(buff, p.ShareCtrlHeader)
-	core.WriteBytes(p.Message.Serialize(), buff)
-	return buff.Bytes()
+	msg := p.Message.Serialize()
+	return append(p.ShareCtrlHeader.append(make([]byte, 0, shareControlHeaderSize+len(msg))), msg...)
 }
 
 type SlowPathInputEvent struct {
@@ -1824,6 +2289,33 @@ func (p *PointerEvent) FastPathEncode(buf []byte) []byte {
 	return buf
 }
 
+// ExtendedMouseEvent is TS_POINTERX_EVENT, which carries the fourth and
+// fifth mouse buttons (MS-RDPBCGR 2.2.8.1.1.3.1.1.4).
+type ExtendedMouseEvent struct {
+	PointerFlags uint16 `struc:"little"`
+	XPos         uint16 `struc:"little"`
+	YPos         uint16 `struc:"little"`
+}
+
+func (p *ExtendedMouseEvent) Serialize() []byte {
+	return []byte{
+		byte(p.PointerFlags), byte(p.PointerFlags >> 8),
+		byte(p.XPos), byte(p.XPos >> 8),
+		byte(p.YPos), byte(p.YPos >> 8),
+	}
+}
+
+// FastPathEncode appends this event in the Fast-Path Input wire format
+// (MS-RDPBCGR §2.2.8.1.2.2.4) to buf and returns the new slice.
+func (p *ExtendedMouseEvent) FastPathEncode(buf []byte) []byte {
+	buf = append(buf, byte(FASTPATH_INPUT_EVENT_MOUSEX<<5))
+	buf = append(buf,
+		byte(p.PointerFlags), byte(p.PointerFlags>>8),
+		byte(p.XPos), byte(p.XPos>>8),
+		byte(p.YPos), byte(p.YPos>>8))
+	return buf
+}
+
 type SynchronizeEvent struct {
 	Pad2Octets  uint16 `struc:"little"`
 	ToggleFlags uint32 `struc:"little"`
@@ -1837,6 +2329,13 @@ func (p *SynchronizeEvent) Serialize() []byte {
 	}
 }
 
+// FastPathEncode appends this event in the Fast-Path Input wire format
+// (MS-RDPBCGR §2.2.8.1.2.2.6), which carries the toggle flags in the
+// eventHeader, to buf and returns the new slice.
+func (p *SynchronizeEvent) FastPathEncode(buf []byte) []byte {
+	return append(buf, byte(FASTPATH_INPUT_EVENT_SYNC<<5)|byte(p.ToggleFlags&0x1F))
+}
+
 type ScancodeKeyEvent struct {
 	KeyboardFlags uint16 `struc:"little"`
 	KeyCode       uint16 `struc:"little"`
@@ -1913,3 +2412,19 @@ func (*ClientInputEventPDU) Type2() uint8 {
 func (*ClientInputEventPDU) Unpack(io.Reader) error {
 	return nil
 }
+func (p *ClientInputEventPDU) Serialize() []byte {
+	n := 4
+	for i := range p.SlowPathInputEvents {
+		n += 6 + len(p.SlowPathInputEvents[i].SlowPathInputData)
+	}
+	b := make([]byte, 0, n)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(p.SlowPathInputEvents)))
+	b = binary.LittleEndian.AppendUint16(b, p.Pad2Octets)
+	for i := range p.SlowPathInputEvents {
+		e := &p.SlowPathInputEvents[i]
+		b = binary.LittleEndian.AppendUint32(b, e.EventTime)
+		b = binary.LittleEndian.AppendUint16(b, e.MessageType)
+		b = append(b, e.SlowPathInputData...)
+	}
+	return b
+}
@@ -0,0 +1,261 @@
+package pdu
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/lunixbochs/struc"
+	"github.com/nakagami/grdp/core"
+)
+
+func writeRedirString(s string, w *bytes.Buffer) {
+	b := core.UnicodeEncode(s + "\x00")
+	core.WriteUInt32LE(uint32(len(b)), w)
+	w.Write(b)
+}
+
+func TestReadServerRedirectionPDU(t *testing.T) {
+	body := &bytes.Buffer{}
+	writeRedirString("10.0.0.5", body)
+	lb := []byte("Cookie: msts=3640205228.15629.0000\r\n")
+	core.WriteUInt32LE(uint32(len(lb)), body)
+	body.Write(lb)
+	writeRedirString("alice", body)
+	writeRedirString("CORP", body)
+	core.WriteUInt32LE(4, body)
+	body.Write([]byte{1, 2, 3, 4})
+	writeRedirString("rdsh01.corp.example", body)
+
+	buf := &bytes.Buffer{}
+	core.WriteUInt16LE(0, buf)
+	core.WriteUInt16LE(0x0400, buf)
+	core.WriteUInt16LE(uint16(12+body.Len()), buf)
+	core.WriteUInt32LE(7, buf)
+	core.WriteUInt32LE(LB_TARGET_NET_ADDRESS|LB_LOAD_BALANCE_INFO|LB_USERNAME|
+		LB_DOMAIN|LB_PASSWORD|LB_TARGET_FQDN, buf)
+	buf.Write(body.Bytes())
+
+	redir, err := readServerRedirectionPDU(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redir.SessionID != 7 {
+		t.Error("sessionID", redir.SessionID)
+	}
+	if !bytes.Equal(redir.LoadBalanceInfo, lb) {
+		t.Errorf("loadBalanceInfo %q", redir.LoadBalanceInfo)
+	}
+	if redir.TargetNetAddress != "10.0.0.5" || redir.Username != "alice" ||
+		redir.Domain != "CORP" || redir.TargetFQDN != "rdsh01.corp.example" {
+		t.Errorf("unexpected fields %+v", redir)
+	}
+}
+
+func TestSaveSessionInfoLogonV1(t *testing.T) {
+	buf := &bytes.Buffer{}
+	core.WriteUInt32LE(INFOTYPE_LOGON, buf)
+	domain := core.UnicodeEncode("CORP\x00")
+	core.WriteUInt32LE(uint32(len(domain)), buf)
+	buf.Write(append(domain, make([]byte, 52-len(domain))...))
+	user := core.UnicodeEncode("alice\x00")
+	core.WriteUInt32LE(uint32(len(user)), buf)
+	buf.Write(append(user, make([]byte, 512-len(user))...))
+	core.WriteUInt32LE(3, buf)
+
+	s := &SaveSessionInfo{}
+	if err := s.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if s.LogonId != 3 || s.UserName != "alice" || s.Domain != "CORP" {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestSaveSessionInfoExtended(t *testing.T) {
+	random := bytes.Repeat([]byte{0xab}, 16)
+	buf := &bytes.Buffer{}
+	core.WriteUInt32LE(INFOTYPE_LOGON_EXTENDED_INFO, buf)
+	core.WriteUInt16LE(2+4+4+28+4+8, buf)
+	core.WriteUInt32LE(LOGON_EX_AUTORECONNECTCOOKIE|LOGON_EX_LOGONERRORS, buf)
+	core.WriteUInt32LE(28, buf)
+	core.WriteUInt32LE(ARC_SC_PRIVATE_PACKET_LENGTH, buf)
+	core.WriteUInt32LE(ARC_SC_PRIVATE_PACKET_VERSION, buf)
+	core.WriteUInt32LE(5, buf)
+	buf.Write(random)
+	core.WriteUInt32LE(8, buf)
+	core.WriteUInt32LE(LOGON_MSG_SESSION_CONTINUE, buf)
+	core.WriteUInt32LE(STATUS_FINDING_DESTINATION, buf)
+	buf.Write(make([]byte, 570))
+
+	s := &SaveSessionInfo{}
+	if err := s.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if s.LogonId != 5 || !bytes.Equal(s.Random, random) {
+		t.Errorf("cookie %d % x", s.LogonId, s.Random)
+	}
+	if s.ErrorNotificationType != LOGON_MSG_SESSION_CONTINUE || s.ErrorNotificationData != STATUS_FINDING_DESTINATION {
+		t.Errorf("logon error %#x %#x", s.ErrorNotificationType, s.ErrorNotificationData)
+	}
+}
+
+func TestExtendedMouseEvent(t *testing.T) {
+	p := &ExtendedMouseEvent{PointerFlags: PTRXFLAGS_DOWN | PTRXFLAGS_BUTTON2, XPos: 0x0102, YPos: 0x0304}
+	if got, want := p.Serialize(), []byte{0x02, 0x80, 0x02, 0x01, 0x04, 0x03}; !bytes.Equal(got, want) {
+		t.Errorf("Serialize = % x, want % x", got, want)
+	}
+	want := []byte{FASTPATH_INPUT_EVENT_MOUSEX << 5, 0x02, 0x80, 0x02, 0x01, 0x04, 0x03}
+	if got := p.FastPathEncode(nil); !bytes.Equal(got, want) {
+		t.Errorf("FastPathEncode = % x, want % x", got, want)
+	}
+}
+
+// TestHandPacked checks the PDUs packed by hand against struc, which
+// packs them from their field tags.
+func TestHandPacked(t *testing.T) {
+	ctrl := &ShareControlHeader{TotalLength: 0x1234, PDUType: PDUTYPE_DATAPDU, PDUSource: 1007}
+	data := &ShareDataHeader{SharedId: 0x103ea, Padding1: 1, StreamId: STREAM_LOW, UncompressedLength: 0x0506,
+		PDUType2: PDUTYPE2_INPUT, CompressedType: 0x21, CompressedLength: 0x0708}
+	input := &ClientInputEventPDU{NumEvents: 2, Pad2Octets: 9, SlowPathInputEvents: []SlowPathInputEvent{
+		{EventTime: 0x01020304, MessageType: INPUT_EVENT_MOUSE, SlowPathInputData: []byte{1, 2, 3, 4, 5, 6}},
+		{EventTime: 5, MessageType: INPUT_EVENT_SCANCODE, SlowPathInputData: []byte{7, 8, 9, 10, 11, 12}},
+	}}
+	for _, c := range []struct {
+		v    any
+		pack []byte
+	}{
+		{ctrl, ctrl.append(nil)},
+		{data, data.append(nil)},
+		{input, input.Serialize()},
+		{&FrameAcknowledgeDataPDU{FrameID: 0x0a0b0c0d}, (&FrameAcknowledgeDataPDU{FrameID: 0x0a0b0c0d}).Serialize()},
+	} {
+		var want bytes.Buffer
+		if err := struc.Pack(&want, c.v); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c.pack, want.Bytes()) {
+			t.Errorf("%T packs % x, struc % x", c.v, c.pack, want.Bytes())
+		}
+	}
+
+	pointer := &FastPathUpdatePointerPDU{XorBpp: 32, CacheIdx: 1, X: 2, Y: 3, Width: 1, Height: 1,
+		MaskLen: 2, DataLen: 4, Data: []byte{0xff, 0xff, 0xff, 0}, Mask: []byte{0x80, 0}}
+	gotCtrl, gotData, gotPointer := &ShareControlHeader{}, &ShareDataHeader{}, &FastPathUpdatePointerPDU{}
+	gotPosition, gotCached, gotAck := &FastPathPointerPositionPDU{}, &FastPathUpdateCachedPDU{}, &FrameAcknowledgeDataPDU{}
+	for _, c := range []struct {
+		v, got any
+		unpack func(io.Reader) error
+	}{
+		{ctrl, gotCtrl, gotCtrl.unpack},
+		{data, gotData, gotData.unpack},
+		{pointer, gotPointer, gotPointer.Unpack},
+		{&FastPathPointerPositionPDU{X: 0x0102, Y: 0x0304}, gotPosition, gotPosition.Unpack},
+		{&FastPathUpdateCachedPDU{CacheIdx: 7}, gotCached, gotCached.Unpack},
+		{&FrameAcknowledgeDataPDU{FrameID: 0x0a0b0c0d}, gotAck, gotAck.Unpack},
+	} {
+		var b bytes.Buffer
+		if err := struc.Pack(&b, c.v); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.unpack(&b); err != nil || !reflect.DeepEqual(c.got, c.v) {
+			t.Errorf("unpacked %+v, %v; want %+v", c.got, err, c.v)
+		}
+	}
+}
+
+func FuzzParsePDU(f *testing.F) {
+	demand := &DemandActivePDU{
+		SharedId:               0x103ea,
+		LengthSourceDescriptor: 4,
+		SourceDescriptor:       []byte("RDP\x00"),
+		CapabilitySets: []Capability{&BitmapCapability{
+			PreferredBitsPerPixel: 16,
+			DesktopWidth:          1024,
+			DesktopHeight:         768,
+		}, &OrderCapability{}, &PointerCapability{}},
+	}
+	f.Add(NewPDU(1002, demand).serialize())
+	f.Add(NewPDU(1002, &DeactiveAllPDU{ShareId: 0x103ea, LengthSourceDescriptor: 1, SourceDescriptor: []byte{0}}).serialize())
+	for _, d := range []DataPDUData{
+		NewSynchronizeDataPDU(1007),
+		&ControlDataPDU{Action: CTRLACTION_GRANTED_CONTROL},
+		&FontMapDataPDU{MapFlags: 0x0003, EntrySize: 0x0004},
+		&ErrorInfoDataPDU{ErrorInfo: 0x1000},
+	} {
+		f.Add(NewPDU(1002, NewDataPDU(d, 0x103ea)).serialize())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ParsePDU(data)
+		if len(data) > 6 {
+			ParseDemandActive(data[6:])
+		}
+	})
+}
+
+func FuzzParseFastPathUpdate(f *testing.F) {
+	// an uncompressed 2x1 bitmap
+	f.Add(uint8(FASTPATH_UPDATETYPE_BITMAP), []byte{
+		0x01, 0x00, 0x01, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02, 0x00, 0x01, 0x00, 0x20, 0x00, 0x00, 0x00, 0x08, 0x00,
+		0x00, 0x00, 0xff, 0x00, 0x00, 0x00, 0xff, 0x00})
+	f.Add(uint8(FASTPATH_UPDATETYPE_PTR_POSITION), []byte{0x10, 0x00, 0x20, 0x00})
+	f.Add(uint8(FASTPATH_UPDATETYPE_CACHED), []byte{0x01, 0x00})
+	f.Add(uint8(FASTPATH_UPDATETYPE_PALETTE), []byte{0x02, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 1, 2, 3, 4, 5, 6})
+	f.Add(uint8(FASTPATH_UPDATETYPE_ORDERS), []byte{0x01, 0x00, 0x09, 0x0a, 0x01, 0x00, 0x02, 0x00, 0x10, 0x00, 0x10, 0x00})
+	f.Fuzz(func(t *testing.T, code uint8, data []byte) {
+		ParseFastPathUpdate(code&0x0F, data)
+	})
+}
+
+func FuzzParseSurfaceCommands(f *testing.F) {
+	// a Surface Bits command with an uncompressed 1x1 bitmap, then a
+	// Frame Marker
+	f.Add([]byte{
+		0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00,
+		0x20, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00, 1, 2, 3, 4,
+		0x04, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ParseSurfaceCommands(data)
+	})
+}
+
+func BenchmarkParsePDU(b *testing.B) {
+	data := NewPDU(1002, NewDataPDU(&ControlDataPDU{Action: CTRLACTION_GRANTED_CONTROL, GrantId: 1007, ControlId: 0x3ea}, 0x103ea)).serialize()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := readPDU(bytes.NewReader(data), nil, core.DefaultLogger); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseFastPathPointer(b *testing.B) {
+	position := []byte{0x10, 0x00, 0x20, 0x00}
+	pointer := []byte{
+		0x20, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x00, 0x01, 0x00,
+		0x02, 0x00, 0x04, 0x00, 0xff, 0xff, 0xff, 0x00, 0x80, 0x00}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := ParseFastPathUpdate(FASTPATH_UPDATETYPE_PTR_POSITION, position); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ParseFastPathUpdate(FASTPATH_UPDATETYPE_POINTER, pointer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSerializeInput(b *testing.B) {
+	mouse := (&PointerEvent{PointerFlags: PTRFLAGS_MOVE, XPos: 100, YPos: 200}).Serialize()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p := &ClientInputEventPDU{NumEvents: 2, SlowPathInputEvents: []SlowPathInputEvent{
+			{0, INPUT_EVENT_MOUSE, len(mouse), mouse},
+			{0, INPUT_EVENT_MOUSE, len(mouse), mouse},
+		}}
+		NewPDU(1007, NewDataPDU(p, 0x103ea)).serialize()
+		NewPDU(1007, NewDataPDU(&FrameAcknowledgeDataPDU{FrameID: uint32(i)}, 0x103ea)).serialize()
+	}
+}
@@ -0,0 +1,236 @@
+package pdu
+
+import "fmt"
+
+/**
+ * Error codes of the Set Error Info PDU
+ * @see https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/a21a1bd9-2303-49c1-90ec-3932435c248c
+ */
+const (
+	ERRINFO_NONE                                uint32 = 0x00000000
+	ERRINFO_RPC_INITIATED_DISCONNECT                   = 0x00000001
+	ERRINFO_RPC_INITIATED_LOGOFF                       = 0x00000002
+	ERRINFO_IDLE_TIMEOUT                               = 0x00000003
+	ERRINFO_LOGON_TIMEOUT                              = 0x00000004
+	ERRINFO_DISCONNECTED_BY_OTHERCONNECTION            = 0x00000005
+	ERRINFO_OUT_OF_MEMORY                              = 0x00000006
+	ERRINFO_SERVER_DENIED_CONNECTION                   = 0x00000007
+	ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES             = 0x00000009
+	ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED          = 0x0000000A
+	ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER            = 0x0000000B
+	ERRINFO_LOGOFF_BY_USER                             = 0x0000000C
+	ERRINFO_CLOSE_STACK_ON_DRIVER_NOT_READY            = 0x0000000F
+	ERRINFO_SERVER_DWM_CRASH                           = 0x00000010
+	ERRINFO_CLOSE_STACK_ON_DRIVER_FAILURE              = 0x00000011
+	ERRINFO_CLOSE_STACK_ON_DRIVER_IFACE_FAILURE        = 0x00000012
+	ERRINFO_SERVER_WINLOGON_CRASH                      = 0x00000017
+	ERRINFO_SERVER_CSRSS_CRASH                         = 0x00000018
+	ERRINFO_SERVER_SHUTDOWN                            = 0x00000019
+	ERRINFO_SERVER_REBOOT                              = 0x0000001A
+
+	ERRINFO_LICENSE_INTERNAL                    = 0x00000100
+	ERRINFO_LICENSE_NO_LICENSE_SERVER           = 0x00000101
+	ERRINFO_LICENSE_NO_LICENSE                  = 0x00000102
+	ERRINFO_LICENSE_BAD_CLIENT_MSG              = 0x00000103
+	ERRINFO_LICENSE_HWID_DOESNT_MATCH           = 0x00000104
+	ERRINFO_LICENSE_BAD_CLIENT_LICENSE          = 0x00000105
+	ERRINFO_LICENSE_CANT_FINISH_PROTOCOL        = 0x00000106
+	ERRINFO_LICENSE_CLIENT_ENDED_PROTOCOL       = 0x00000107
+	ERRINFO_LICENSE_BAD_CLIENT_ENCRYPTION       = 0x00000108
+	ERRINFO_LICENSE_CANT_UPGRADE_LICENSE        = 0x00000109
+	ERRINFO_LICENSE_NO_REMOTE_CONNECTIONS       = 0x0000010A
+	ERRINFO_CB_DESTINATION_NOT_FOUND            = 0x00000400
+	ERRINFO_CB_LOADING_DESTINATION              = 0x00000402
+	ERRINFO_CB_REDIRECTING_TO_DESTINATION       = 0x00000404
+	ERRINFO_CB_SESSION_ONLINE_VM_WAKE           = 0x00000405
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT           = 0x00000406
+	ERRINFO_CB_SESSION_ONLINE_VM_NO_DNS         = 0x00000407
+	ERRINFO_CB_DESTINATION_POOL_NOT_FREE        = 0x00000408
+	ERRINFO_CB_CONNECTION_CANCELLED             = 0x00000409
+	ERRINFO_CB_CONNECTION_ERROR_INVALID_SETS    = 0x00000410
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT_TIMEOUT   = 0x00000411
+	ERRINFO_CB_SESSION_ONLINE_VM_SESSMON_FAILED = 0x00000412
+
+	ERRINFO_UNKNOWNPDUTYPE2                 = 0x000010C9
+	ERRINFO_UNKNOWNPDUTYPE                  = 0x000010CA
+	ERRINFO_DATAPDUSEQUENCE                 = 0x000010CB
+	ERRINFO_CONTROLPDUSEQUENCE              = 0x000010CD
+	ERRINFO_INVALIDCONTROLPDUACTION         = 0x000010CE
+	ERRINFO_INVALIDINPUTPDUTYPE             = 0x000010CF
+	ERRINFO_INVALIDINPUTPDUMOUSE            = 0x000010D0
+	ERRINFO_INVALIDREFRESHRECTPDU           = 0x000010D1
+	ERRINFO_CREATEUSERDATAFAILED            = 0x000010D2
+	ERRINFO_CONNECTFAILED                   = 0x000010D3
+	ERRINFO_CONFIRMACTIVEWRONGSHAREID       = 0x000010D4
+	ERRINFO_CONFIRMACTIVEWRONGORIGINATOR    = 0x000010D5
+	ERRINFO_PERSISTENTKEYPDUBADLENGTH       = 0x000010DA
+	ERRINFO_INPUTPDUBADLENGTH               = 0x000010DE
+	ERRINFO_SECURITYDATATOOSHORT            = 0x000010E0
+	ERRINFO_VCHANNELDATATOOSHORT            = 0x000010E1
+	ERRINFO_SHAREDATATOOSHORT               = 0x000010E2
+	ERRINFO_BADSUPRESSOUTPUTPDU             = 0x000010E3
+	ERRINFO_CONFIRMACTIVEPDUTOOSHORT        = 0x000010E5
+	ERRINFO_CAPABILITYSETTOOSMALL           = 0x000010E7
+	ERRINFO_CAPABILITYSETTOOLARGE           = 0x000010E8
+	ERRINFO_NOCURSORCACHE                   = 0x000010E9
+	ERRINFO_BADCAPABILITIES                 = 0x000010EA
+	ERRINFO_VIRTUALCHANNELDECOMPRESSIONERR  = 0x000010EC
+	ERRINFO_INVALIDVCCOMPRESSIONTYPE        = 0x000010ED
+	ERRINFO_INVALIDCHANNELID                = 0x000010EF
+	ERRINFO_VCHANNELSTOOMANY                = 0x000010F0
+	ERRINFO_REMOTEAPPSNOTENABLED            = 0x000010F3
+	ERRINFO_CACHECAPNOTSET                  = 0x000010F4
+	ERRINFO_BADMONITORDATA                  = 0x00001191
+	ERRINFO_VCDECOMPRESSEDREASSEMBLEFAILED  = 0x00001192
+	ERRINFO_VCDATATOOLONG                   = 0x00001193
+	ERRINFO_BAD_FRAME_ACK_DATA              = 0x00001194
+	ERRINFO_GRAPHICSMODENOTSUPPORTED        = 0x00001195
+	ERRINFO_GRAPHICSSUBSYSTEMRESETFAILED    = 0x00001196
+	ERRINFO_GRAPHICSSUBSYSTEMFAILED         = 0x00001197
+	ERRINFO_VIRTUALDESKTOPTOOLARGE          = 0x0000119C
+	ERRINFO_MONITORGEOMETRYVALIDATIONFAILED = 0x0000119D
+	ERRINFO_INVALIDMONITORCOUNT             = 0x0000119E
+	ERRINFO_UPDATESESSIONKEYFAILED          = 0x00001201
+	ERRINFO_DECRYPTFAILED                   = 0x00001202
+	ERRINFO_ENCRYPTFAILED                   = 0x00001203
+	ERRINFO_ENCPKGMISMATCH                  = 0x00001204
+	ERRINFO_DECRYPTFAILED2                  = 0x00001205
+)
+
+type errorInfoText struct {
+	name        string
+	description string
+}
+
+var errorInfoTexts = map[uint32]errorInfoText{
+	ERRINFO_RPC_INITIATED_DISCONNECT:            {"ERRINFO_RPC_INITIATED_DISCONNECT", "an administrative tool on the server disconnected the session"},
+	ERRINFO_RPC_INITIATED_LOGOFF:                {"ERRINFO_RPC_INITIATED_LOGOFF", "an administrative tool on the server logged the user off"},
+	ERRINFO_IDLE_TIMEOUT:                        {"ERRINFO_IDLE_TIMEOUT", "the idle session limit elapsed"},
+	ERRINFO_LOGON_TIMEOUT:                       {"ERRINFO_LOGON_TIMEOUT", "the active session limit elapsed"},
+	ERRINFO_DISCONNECTED_BY_OTHERCONNECTION:     {"ERRINFO_DISCONNECTED_BY_OTHERCONNECTION", "another user connected to the session"},
+	ERRINFO_OUT_OF_MEMORY:                       {"ERRINFO_OUT_OF_MEMORY", "the server ran out of memory"},
+	ERRINFO_SERVER_DENIED_CONNECTION:            {"ERRINFO_SERVER_DENIED_CONNECTION", "the server denied the connection"},
+	ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES:      {"ERRINFO_SERVER_INSUFFICIENT_PRIVILEGES", "the user has no remote access to the server"},
+	ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED:   {"ERRINFO_SERVER_FRESH_CREDENTIALS_REQUIRED", "the server requires credentials to be entered for each connection"},
+	ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER:     {"ERRINFO_RPC_INITIATED_DISCONNECT_BYUSER", "the user disconnected the session with an administrative tool"},
+	ERRINFO_LOGOFF_BY_USER:                      {"ERRINFO_LOGOFF_BY_USER", "the user logged off"},
+	ERRINFO_CLOSE_STACK_ON_DRIVER_NOT_READY:     {"ERRINFO_CLOSE_STACK_ON_DRIVER_NOT_READY", "the display driver was not ready"},
+	ERRINFO_SERVER_DWM_CRASH:                    {"ERRINFO_SERVER_DWM_CRASH", "the desktop window manager on the server crashed"},
+	ERRINFO_CLOSE_STACK_ON_DRIVER_FAILURE:       {"ERRINFO_CLOSE_STACK_ON_DRIVER_FAILURE", "the display driver failed to start"},
+	ERRINFO_CLOSE_STACK_ON_DRIVER_IFACE_FAILURE: {"ERRINFO_CLOSE_STACK_ON_DRIVER_IFACE_FAILURE", "the display driver interface failed"},
+	ERRINFO_SERVER_WINLOGON_CRASH:               {"ERRINFO_SERVER_WINLOGON_CRASH", "winlogon on the server crashed"},
+	ERRINFO_SERVER_CSRSS_CRASH:                  {"ERRINFO_SERVER_CSRSS_CRASH", "csrss on the server crashed"},
+	ERRINFO_SERVER_SHUTDOWN:                     {"ERRINFO_SERVER_SHUTDOWN", "the server is shutting down"},
+	ERRINFO_SERVER_REBOOT:                       {"ERRINFO_SERVER_REBOOT", "the server is rebooting"},
+
+	ERRINFO_LICENSE_INTERNAL:              {"ERRINFO_LICENSE_INTERNAL", "internal licensing error"},
+	ERRINFO_LICENSE_NO_LICENSE_SERVER:     {"ERRINFO_LICENSE_NO_LICENSE_SERVER", "no license server was available"},
+	ERRINFO_LICENSE_NO_LICENSE:            {"ERRINFO_LICENSE_NO_LICENSE", "no client access license was available"},
+	ERRINFO_LICENSE_BAD_CLIENT_MSG:        {"ERRINFO_LICENSE_BAD_CLIENT_MSG", "the server received an invalid licensing message"},
+	ERRINFO_LICENSE_HWID_DOESNT_MATCH:     {"ERRINFO_LICENSE_HWID_DOESNT_MATCH_LICENSE", "the client license does not match this hardware"},
+	ERRINFO_LICENSE_BAD_CLIENT_LICENSE:    {"ERRINFO_LICENSE_BAD_CLIENT_LICENSE", "the client license is invalid"},
+	ERRINFO_LICENSE_CANT_FINISH_PROTOCOL:  {"ERRINFO_LICENSE_CANT_FINISH_PROTOCOL", "the licensing protocol could not complete"},
+	ERRINFO_LICENSE_CLIENT_ENDED_PROTOCOL: {"ERRINFO_LICENSE_CLIENT_ENDED_PROTOCOL", "the client ended the licensing protocol"},
+	ERRINFO_LICENSE_BAD_CLIENT_ENCRYPTION: {"ERRINFO_LICENSE_BAD_CLIENT_ENCRYPTION", "a licensing message was incorrectly encrypted"},
+	ERRINFO_LICENSE_CANT_UPGRADE_LICENSE:  {"ERRINFO_LICENSE_CANT_UPGRADE_LICENSE", "the client license could not be upgraded or renewed"},
+	ERRINFO_LICENSE_NO_REMOTE_CONNECTIONS: {"ERRINFO_LICENSE_NO_REMOTE_CONNECTIONS", "the server is not licensed to accept remote connections"},
+
+	ERRINFO_CB_DESTINATION_NOT_FOUND:            {"ERRINFO_CB_DESTINATION_NOT_FOUND", "the connection broker found no target endpoint"},
+	ERRINFO_CB_LOADING_DESTINATION:              {"ERRINFO_CB_LOADING_DESTINATION", "the target endpoint is disconnecting from the connection broker"},
+	ERRINFO_CB_REDIRECTING_TO_DESTINATION:       {"ERRINFO_CB_REDIRECTING_TO_DESTINATION", "the connection broker is redirecting to the target endpoint"},
+	ERRINFO_CB_SESSION_ONLINE_VM_WAKE:           {"ERRINFO_CB_SESSION_ONLINE_VM_WAKE", "the target virtual machine could not be woken"},
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT:           {"ERRINFO_CB_SESSION_ONLINE_VM_BOOT", "the target virtual machine could not be started"},
+	ERRINFO_CB_SESSION_ONLINE_VM_NO_DNS:         {"ERRINFO_CB_SESSION_ONLINE_VM_NO_DNS", "the IP address of the target virtual machine could not be found"},
+	ERRINFO_CB_DESTINATION_POOL_NOT_FREE:        {"ERRINFO_CB_DESTINATION_POOL_NOT_FREE", "no virtual machine in the pool is available"},
+	ERRINFO_CB_CONNECTION_CANCELLED:             {"ERRINFO_CB_CONNECTION_CANCELLED", "the connection broker request was cancelled"},
+	ERRINFO_CB_CONNECTION_ERROR_INVALID_SETS:    {"ERRINFO_CB_CONNECTION_ERROR_INVALID_SETTINGS", "the connection broker settings are invalid"},
+	ERRINFO_CB_SESSION_ONLINE_VM_BOOT_TIMEOUT:   {"ERRINFO_CB_SESSION_ONLINE_VM_BOOT_TIMEOUT", "the target virtual machine timed out starting"},
+	ERRINFO_CB_SESSION_ONLINE_VM_SESSMON_FAILED: {"ERRINFO_CB_SESSION_ONLINE_VM_SESSMON_FAILED", "session monitoring failed on the target virtual machine"},
+
+	ERRINFO_UNKNOWNPDUTYPE2:                 {"ERRINFO_UNKNOWNPDUTYPE2", "the server received an unknown data PDU type"},
+	ERRINFO_UNKNOWNPDUTYPE:                  {"ERRINFO_UNKNOWNPDUTYPE", "the server received an unknown PDU type"},
+	ERRINFO_DATAPDUSEQUENCE:                 {"ERRINFO_DATAPDUSEQUENCE", "the server received a data PDU out of sequence"},
+	ERRINFO_CONTROLPDUSEQUENCE:              {"ERRINFO_CONTROLPDUSEQUENCE", "the server received a control PDU out of sequence"},
+	ERRINFO_INVALIDCONTROLPDUACTION:         {"ERRINFO_INVALIDCONTROLPDUACTION", "the server received an invalid control PDU action"},
+	ERRINFO_INVALIDINPUTPDUTYPE:             {"ERRINFO_INVALIDINPUTPDUTYPE", "the server received an invalid input event"},
+	ERRINFO_INVALIDINPUTPDUMOUSE:            {"ERRINFO_INVALIDINPUTPDUMOUSE", "the server received an invalid mouse event"},
+	ERRINFO_INVALIDREFRESHRECTPDU:           {"ERRINFO_INVALIDREFRESHRECTPDU", "the server received an invalid Refresh Rect PDU"},
+	ERRINFO_CREATEUSERDATAFAILED:            {"ERRINFO_CREATEUSERDATAFAILED", "the server failed to build the GCC Conference Create Response"},
+	ERRINFO_CONNECTFAILED:                   {"ERRINFO_CONNECTFAILED", "the connection sequence failed on the server"},
+	ERRINFO_CONFIRMACTIVEWRONGSHAREID:       {"ERRINFO_CONFIRMACTIVEWRONGSHAREID", "the Confirm Active PDU has the wrong share ID"},
+	ERRINFO_CONFIRMACTIVEWRONGORIGINATOR:    {"ERRINFO_CONFIRMACTIVEWRONGORIGINATOR", "the Confirm Active PDU has the wrong originator ID"},
+	ERRINFO_PERSISTENTKEYPDUBADLENGTH:       {"ERRINFO_PERSISTENTKEYPDUBADLENGTH", "the Persistent Key List PDU is too short"},
+	ERRINFO_INPUTPDUBADLENGTH:               {"ERRINFO_INPUTPDUBADLENGTH", "an input PDU is too short"},
+	ERRINFO_SECURITYDATATOOSHORT:            {"ERRINFO_SECURITYDATATOOSHORT", "the security data is too short"},
+	ERRINFO_VCHANNELDATATOOSHORT:            {"ERRINFO_VCHANNELDATATOOSHORT", "virtual channel data is too short"},
+	ERRINFO_SHAREDATATOOSHORT:               {"ERRINFO_SHAREDATATOOSHORT", "share data is too short"},
+	ERRINFO_BADSUPRESSOUTPUTPDU:             {"ERRINFO_BADSUPRESSOUTPUTPDU", "the Suppress Output PDU is invalid"},
+	ERRINFO_CONFIRMACTIVEPDUTOOSHORT:        {"ERRINFO_CONFIRMACTIVEPDUTOOSHORT", "the Confirm Active PDU is too short"},
+	ERRINFO_CAPABILITYSETTOOSMALL:           {"ERRINFO_CAPABILITYSETTOOSMALL", "a capability set is too short"},
+	ERRINFO_CAPABILITYSETTOOLARGE:           {"ERRINFO_CAPABILITYSETTOOLARGE", "a capability set is too long"},
+	ERRINFO_NOCURSORCACHE:                   {"ERRINFO_NOCURSORCACHE", "the pointer cache sizes are both zero"},
+	ERRINFO_BADCAPABILITIES:                 {"ERRINFO_BADCAPABILITIES", "the client capabilities are invalid"},
+	ERRINFO_VIRTUALCHANNELDECOMPRESSIONERR:  {"ERRINFO_VIRTUALCHANNELDECOMPRESSIONERR", "virtual channel data failed to decompress"},
+	ERRINFO_INVALIDVCCOMPRESSIONTYPE:        {"ERRINFO_INVALIDVCCOMPRESSIONTYPE", "virtual channel data used an invalid compression type"},
+	ERRINFO_INVALIDCHANNELID:                {"ERRINFO_INVALIDCHANNELID", "a channel ID is invalid"},
+	ERRINFO_VCHANNELSTOOMANY:                {"ERRINFO_VCHANNELSTOOMANY", "too many static virtual channels were requested"},
+	ERRINFO_REMOTEAPPSNOTENABLED:            {"ERRINFO_REMOTEAPPSNOTENABLED", "RemoteApp is not enabled on the server"},
+	ERRINFO_CACHECAPNOTSET:                  {"ERRINFO_CACHECAPNOTSET", "a cache capability set is missing"},
+	ERRINFO_BADMONITORDATA:                  {"ERRINFO_BADMONITORDATA", "the monitor data is invalid"},
+	ERRINFO_VCDECOMPRESSEDREASSEMBLEFAILED:  {"ERRINFO_VCDECOMPRESSEDREASSEMBLEFAILED", "decompressed virtual channel data could not be reassembled"},
+	ERRINFO_VCDATATOOLONG:                   {"ERRINFO_VCDATATOOLONG", "a virtual channel message is too long"},
+	ERRINFO_BAD_FRAME_ACK_DATA:              {"ERRINFO_BAD_FRAME_ACK_DATA", "a frame acknowledgement is invalid"},
+	ERRINFO_GRAPHICSMODENOTSUPPORTED:        {"ERRINFO_GRAPHICSMODENOTSUPPORTED", "the requested graphics mode is not supported"},
+	ERRINFO_GRAPHICSSUBSYSTEMRESETFAILED:    {"ERRINFO_GRAPHICSSUBSYSTEMRESETFAILED", "the server graphics subsystem failed to reset"},
+	ERRINFO_GRAPHICSSUBSYSTEMFAILED:         {"ERRINFO_GRAPHICSSUBSYSTEMFAILED", "the server graphics subsystem failed"},
+	ERRINFO_VIRTUALDESKTOPTOOLARGE:          {"ERRINFO_VIRTUALDESKTOPTOOLARGE", "the monitor layout exceeds the maximum desktop size"},
+	ERRINFO_MONITORGEOMETRYVALIDATIONFAILED: {"ERRINFO_MONITORGEOMETRYVALIDATIONFAILED", "the monitor geometry is invalid"},
+	ERRINFO_INVALIDMONITORCOUNT:             {"ERRINFO_INVALIDMONITORCOUNT", "too many monitors were requested"},
+	ERRINFO_UPDATESESSIONKEYFAILED:          {"ERRINFO_UPDATESESSIONKEYFAILED", "the session key update failed"},
+	ERRINFO_DECRYPTFAILED:                   {"ERRINFO_DECRYPTFAILED", "the server failed to decrypt client data"},
+	ERRINFO_ENCRYPTFAILED:                   {"ERRINFO_ENCRYPTFAILED", "the server failed to encrypt data"},
+	ERRINFO_ENCPKGMISMATCH:                  {"ERRINFO_ENCPKGMISMATCH", "the encryption methods do not match"},
+	ERRINFO_DECRYPTFAILED2:                  {"ERRINFO_DECRYPTFAILED2", "the server received unencrypted data when encryption was required"},
+}
+
+// ServerError is the reason a server gave in a Set Error Info PDU
+// (MS-RDPBCGR 2.2.5.1.1), typically just before it disconnects.
+type ServerError struct {
+	Code uint32
+}
+
+// Name returns the ERRINFO_* name of the code.
+func (e *ServerError) Name() string {
+	if t, ok := errorInfoTexts[e.Code]; ok {
+		return t.name
+	}
+	return fmt.Sprintf("ERRINFO_0x%08X", e.Code)
+}
+
+// Description returns a short explanation of the code.
+func (e *ServerError) Description() string {
+	if t, ok := errorInfoTexts[e.Code]; ok {
+		return t.description
+	}
+	switch {
+	case e.Code >= 0x10C9 && e.Code <= 0x11FF:
+		return "the server detected a protocol error"
+	case e.Code >= 0x1200:
+		return "the server detected a security error"
+	}
+	return "unknown error"
+}
+
+// Informational reports whether the code describes connection broker
+// progress rather than a failure; a redirection normally follows.
+func (e *ServerError) Informational() bool {
+	switch e.Code {
+	case ERRINFO_CB_LOADING_DESTINATION, ERRINFO_CB_REDIRECTING_TO_DESTINATION:
+		return true
+	}
+	return false
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server error %s (0x%08X): %s", e.Name(), e.Code, e.Description())
+}
@@ -0,0 +1,40 @@
+package pdu
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/nakagami/grdp/testutil"
+)
+
+func TestRecvErrorInfo(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewClient(tr)
+	errs := testutil.Capture[error](&c.Emitter, "error")
+	infos := testutil.Capture[*ServerError](&c.Emitter, "errorInfo")
+	tr.On("data", c.recvPDU)
+	c.active = true
+
+	for _, code := range []uint32{ERRINFO_NONE, ERRINFO_CB_REDIRECTING_TO_DESTINATION, ERRINFO_LOGOFF_BY_USER} {
+		tr.Emit("data", NewPDU(c.userId, NewDataPDU(&ErrorInfoDataPDU{ErrorInfo: code}, c.sharedId.Load())).serialize())
+	}
+
+	if got := infos.All(); len(got) != 2 || got[0].Code != ERRINFO_CB_REDIRECTING_TO_DESTINATION {
+		t.Fatalf("errorInfo events %v", got)
+	}
+	got := errs.All()
+	if len(got) != 1 {
+		t.Fatalf("error events %v", got)
+	}
+	var se *ServerError
+	if !errors.As(got[0], &se) || se.Code != ERRINFO_LOGOFF_BY_USER {
+		t.Fatalf("got %v", got[0])
+	}
+	if !strings.Contains(se.Error(), "ERRINFO_LOGOFF_BY_USER") {
+		t.Errorf("message %q", se.Error())
+	}
+	if d := (&ServerError{Code: 0x10FF}).Description(); d != "the server detected a protocol error" {
+		t.Errorf("fallback description %q", d)
+	}
+}
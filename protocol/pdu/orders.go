@@ -134,9 +134,15 @@ func (o *OrderPdu) HasBounds() bool {
 }
 
 type Altsec struct {
+	// Order is the parsed order, such as *WindowOrder, or nil for the
+	// order types that are skipped.
+	Order any
 }
 
 type Secondary struct {
+	// Order is the parsed order, such as *CacheBitmapV2Order, or nil for
+	// the order types that are skipped.
+	Order any
 }
 
 type Primary struct {
@@ -147,41 +153,70 @@ type Primary struct {
 type FastPathOrdersPDU struct {
 	NumberOrders uint16
 	OrderPdus    []OrderPdu
+	// slowPath is set for the orders of a slow-path Update PDU, which
+	// pads the order count; data holds the orders until decode.
+	slowPath bool
+	data     []byte
 }
 
 func (*FastPathOrdersPDU) FastPathUpdateType() uint8 {
 	return FASTPATH_UPDATETYPE_ORDERS
 }
 
-func (f *FastPathOrdersPDU) Unpack(r io.Reader) error {
-	f.NumberOrders, _ = core.ReadUint16LE(r)
-	//slog.Debug("NumberOrders:", f.NumberOrders)
+func (f *FastPathOrdersPDU) Unpack(r io.Reader) (err error) {
+	f.NumberOrders, err = core.ReadUint16LE(r)
+	if err != nil {
+		return err
+	}
+	if f.slowPath {
+		core.ReadUint16LE(r)
+	}
+	f.data, err = io.ReadAll(r)
+	return err
+}
+
+// decode parses the orders against the drawing order history s.  The
+// orders carry no lengths, so an order that cannot be parsed ends the
+// batch, and its error is returned.
+func (f *FastPathOrdersPDU) decode(s *orderState) error {
+	log := s.log
+	r := core.NewErrReader(bytes.NewReader(f.data))
+	var batchErr error
+	f.OrderPdus = make([]OrderPdu, 0, f.NumberOrders)
 	for i := 0; i < int(f.NumberOrders); i++ {
 		var o OrderPdu
-		o.ControlFlags, _ = core.ReadUInt8(r)
+		var err error
+		o.ControlFlags, err = core.ReadUInt8(r)
+		if err != nil {
+			break
+		}
 		if o.ControlFlags&TS_STANDARD == 0 {
 			//slog.Debug("Altsec order")
-			o.processAltsecOrder(r)
+			err = o.processAltsecOrder(r, log)
 			o.Type = ORDER_ALTSEC
-			//return errors.New("Not support")
 		} else if o.ControlFlags&TS_SECONDARY != 0 {
 			//slog.Debug("Secondary order")
-			o.processSecondaryOrder(r)
+			err = o.processSecondaryOrder(r, log)
 			o.Type = ORDER_SECONDARY
 		} else {
 			//slog.Debug("Primary order")
-			o.processPrimaryOrder(r)
+			err = o.processPrimaryOrder(r, s)
 			o.Type = ORDER_PRIMARY
 		}
-
-		if f.OrderPdus == nil {
-			f.OrderPdus = make([]OrderPdu, 0, f.NumberOrders)
+		if err == nil {
+			err = r.Err()
+		}
+		if err != nil {
+			batchErr = fmt.Errorf("order %d of %d: %w", i, f.NumberOrders, err)
+			break
 		}
 		f.OrderPdus = append(f.OrderPdus, o)
 	}
-	return nil
+	f.data = nil
+	return batchErr
 }
-func (o *OrderPdu) processAltsecOrder(r io.Reader) error {
+
+func (o *OrderPdu) processAltsecOrder(r io.Reader, log *slog.Logger) error {
 	orderType := o.ControlFlags >> 2
 	//slog.Debug("Altsec:", orderType)
 	switch orderType {
@@ -197,6 +232,20 @@ func (o *OrderPdu) processAltsecOrder(r io.Reader) error {
 	case ORDER_TYPE_GDIPLUS_CACHE_NEXT:
 	case ORDER_TYPE_GDIPLUS_CACHE_END:
 	case ORDER_TYPE_WINDOW:
+		// The order size counts the control flags byte and itself.
+		size, err := core.ReadUint16LE(r)
+		if err != nil || size < 3 {
+			return errWindowOrder
+		}
+		b, err := core.ReadBytes(int(size)-3, r)
+		if err != nil {
+			return err
+		}
+		wo, err := readWindowOrder(b)
+		if err != nil {
+			log.Debug("window order", "err", err)
+		}
+		o.Altsec = &Altsec{Order: wo}
 	case ORDER_TYPE_COMPDESK_FIRST:
 	case ORDER_TYPE_FRAME_MARKER:
 		core.ReadUInt32LE(r)
@@ -204,16 +253,16 @@ func (o *OrderPdu) processAltsecOrder(r io.Reader) error {
 
 	return nil
 }
-func (o *OrderPdu) processSecondaryOrder(r io.Reader) error {
+func (o *OrderPdu) processSecondaryOrder(r io.Reader, log *slog.Logger) error {
 	var sec Secondary
 	length, _ := core.ReadUint16LE(r)
 	flags, _ := core.ReadUint16LE(r)
 	orderType, _ := core.ReadUInt8(r)
 
-	slog.Debug("processSecondaryOrder", "SecondaryOrderType", SecondaryOrderType(orderType))
+	log.Debug("processSecondaryOrder", "SecondaryOrderType", SecondaryOrderType(orderType))
 
 	b, _ := core.ReadBytes(int(length)+13-6, r)
-	r0 := bytes.NewReader(b)
+	r0 := core.NewErrReader(bytes.NewReader(b))
 
 	switch orderType {
 	case ORDER_TYPE_BITMAP_UNCOMPRESSED:
@@ -235,35 +284,39 @@ func (o *OrderPdu) processSecondaryOrder(r io.Reader) error {
 	case ORDER_TYPE_CACHE_BRUSH:
 		sec.updateCacheBrushOrder(r0, flags)
 	default:
-		slog.Debug("processSecondaryOrder", "Unsupport order type", orderType)
+		log.Debug("processSecondaryOrder", "Unsupport order type", orderType)
 	}
+	o.Secondary = &sec
 
+	if err := r0.Err(); err != nil {
+		return fmt.Errorf("%v: %w", SecondaryOrderType(orderType), err)
+	}
 	return nil
 }
 func (b *Bounds) updateBounds(r io.Reader) {
 	present, _ := core.ReadUInt8(r)
 
 	if present&1 != 0 {
-		readOrderCoord(r, &b.left, false)
+		readOrderCoord(r, &b.Left, false)
 	} else if present&16 != 0 {
-		readOrderCoord(r, &b.left, true)
+		readOrderCoord(r, &b.Left, true)
 	}
 
 	if present&2 != 0 {
-		readOrderCoord(r, &b.top, false)
+		readOrderCoord(r, &b.Top, false)
 	} else if present&32 != 0 {
-		readOrderCoord(r, &b.top, true)
+		readOrderCoord(r, &b.Top, true)
 	}
 
 	if present&4 != 0 {
-		readOrderCoord(r, &b.right, false)
+		readOrderCoord(r, &b.Right, false)
 	} else if present&64 != 0 {
-		readOrderCoord(r, &b.right, true)
+		readOrderCoord(r, &b.Right, true)
 	}
 	if present&8 != 0 {
-		readOrderCoord(r, &b.bottom, false)
+		readOrderCoord(r, &b.Bottom, false)
 	} else if present&128 != 0 {
-		readOrderCoord(r, &b.bottom, true)
+		readOrderCoord(r, &b.Bottom, true)
 	}
 }
 
@@ -272,18 +325,55 @@ type PrimaryOrder interface {
 	Unpack(io.Reader, uint32, bool) error
 }
 
-var (
-	orderType uint8
-	bounds    Bounds
-)
-
-func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
+// orderState is the primary drawing order history of a connection: an
+// order only carries the fields that changed since the previous order of
+// its type, and may omit its type and bounds (MS-RDPEGDI 3.3.5.1.1.2).
+type orderState struct {
+	orderType  uint8
+	bounds     Bounds
+	dstblt     Dstblt
+	patblt     Patblt
+	scrblt     Scrblt
+	lineTo     LineTo
+	opaqueRect OpaqueRect
+	saveBitmap SaveBitmap
+	memblt     Memblt
+	mem3blt    Mem3blt
+	polygonSc  PolygonSc
+	polygonCb  PolygonCb
+	polyline   Polyline
+	ellipseSc  EllipeSc
+	ellipseCb  EllipeCb
+	glyphIndex GlayphIndex
+
+	log *slog.Logger
+}
+
+func newOrderState() *orderState {
+	return &orderState{orderType: ORDER_TYPE_PATBLT, log: core.DefaultLogger}
+}
+
+// unpackPrimary updates the history last of an order type and returns a
+// copy of it, so the orders of one batch do not share fields.
+func unpackPrimary[T any, P interface {
+	*T
+	PrimaryOrder
+}](last *T, r io.Reader, present uint32, delta bool) (PrimaryOrder, error) {
+	v := *last
+	if err := P(&v).Unpack(r, present, delta); err != nil {
+		return nil, err
+	}
+	*last = v
+	return P(&v), nil
+}
+
+func (o *OrderPdu) processPrimaryOrder(r io.Reader, s *orderState) error {
 	o.Primary = &Primary{}
 	if o.ControlFlags&TS_TYPE_CHANGE != 0 {
-		orderType, _ = core.ReadUInt8(r)
+		s.orderType, _ = core.ReadUInt8(r)
 	}
 	size := 1
-	switch orderType {
+	switch s.orderType {
 	case ORDER_TYPE_MEM3BLT, ORDER_TYPE_TEXT2:
 		size = 3
 
@@ -309,10 +399,10 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 
 	if o.ControlFlags&TS_BOUNDS != 0 {
 		if o.ControlFlags&TS_ZERO_BOUNDS_DELTAS == 0 {
-			bounds.updateBounds(r)
+			s.bounds.updateBounds(r)
 		}
 		//slog.Debug("updateBounds")
-		o.Primary.Bounds = bounds
+		o.Primary.Bounds = s.bounds
 	}
 
 	delta := o.ControlFlags&TS_DELTA_COORDINATES != 0
@@ -320,34 +410,35 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 	//slog.Debug(fmt.Sprintf("present=%d,delta=%v", present, delta))
 
 	var p PrimaryOrder
-	switch orderType {
+	var err error
+	switch s.orderType {
 	case ORDER_TYPE_DSTBLT:
-		p = &Dstblt{}
+		p, err = unpackPrimary(&s.dstblt, r, present, delta)
 
 	case ORDER_TYPE_PATBLT:
-		p = &Patblt{}
+		p, err = unpackPrimary(&s.patblt, r, present, delta)
 
 	case ORDER_TYPE_SCRBLT:
-		p = &Scrblt{}
+		p, err = unpackPrimary(&s.scrblt, r, present, delta)
 
 	//case ORDER_TYPE_DRAWNINEGRID:
 
 	//case ORDER_TYPE_MULTI_DRAWNINEGRID:
 
 	case ORDER_TYPE_LINETO:
-		p = &LineTo{}
+		p, err = unpackPrimary(&s.lineTo, r, present, delta)
 
 	case ORDER_TYPE_OPAQUERECT:
-		p = &OpaqueRect{}
+		p, err = unpackPrimary(&s.opaqueRect, r, present, delta)
 
 	case ORDER_TYPE_SAVEBITMAP:
-		p = &SaveBitmap{}
+		p, err = unpackPrimary(&s.saveBitmap, r, present, delta)
 
 	case ORDER_TYPE_MEMBLT:
-		p = &Memblt{}
+		p, err = unpackPrimary(&s.memblt, r, present, delta)
 
 	case ORDER_TYPE_MEM3BLT:
-		p = &Mem3blt{}
+		p, err = unpackPrimary(&s.mem3blt, r, present, delta)
 
 	//case ORDER_TYPE_MULTIDSTBLT:
 
@@ -360,33 +451,32 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 	//case ORDER_TYPE_FAST_INDEX:
 
 	case ORDER_TYPE_POLYGON_SC:
-		p = &PolygonSc{}
+		p, err = unpackPrimary(&s.polygonSc, r, present, delta)
 
 	case ORDER_TYPE_POLYGON_CB:
-		p = &PolygonCb{}
+		p, err = unpackPrimary(&s.polygonCb, r, present, delta)
 
 	case ORDER_TYPE_POLYLINE:
-		p = &Polyline{}
+		p, err = unpackPrimary(&s.polyline, r, present, delta)
 
 	//case ORDER_TYPE_FAST_GLYPH:
 
 	case ORDER_TYPE_ELLIPSE_SC:
-		p = &EllipeSc{}
+		p, err = unpackPrimary(&s.ellipseSc, r, present, delta)
 
 	case ORDER_TYPE_ELLIPSE_CB:
-		p = &EllipeCb{}
+		p, err = unpackPrimary(&s.ellipseCb, r, present, delta)
 
 	case ORDER_TYPE_TEXT2:
-		p = &GlayphIndex{}
+		p, err = unpackPrimary(&s.glyphIndex, r, present, delta)
 	default:
-		slog.Error("processPrimaryOrder", "orderType", orderType)
+		s.log.Error("processPrimaryOrder", "orderType", s.orderType)
 		return errors.New("Not Support order type")
 	}
-	if p != nil {
-		if err := p.Unpack(r, present, delta); err != nil {
-			return err
-		}
+	if err != nil {
+		return err
 	}
+	s.log.Debug("processPrimaryOrder", "orderType", s.orderType)
 
 	o.Primary.Data = p
 	return nil
@@ -401,81 +491,116 @@ func readOrderCoord(r io.Reader, coord *int32, delta bool) {
 	}
 }
 
+// readGenericColor reads a 3-byte Generic Color: a palette index, a 15 or
+// 16-bit colour in the low bytes, or red, green and blue bytes, depending
+// on the session colour depth.
+func readGenericColor(r io.Reader) uint32 {
+	b, _ := core.ReadBytes(3, r)
+	if len(b) < 3 {
+		return 0
+	}
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+/* Ternary raster operations, the Opcode of the blt orders */
+const (
+	ROP3_BLACKNESS = 0x00
+	ROP3_DSTINVERT = 0x55
+	ROP3_PATINVERT = 0x5A
+	ROP3_SRCINVERT = 0x66
+	ROP3_SRCAND    = 0x88
+	ROP3_NOP       = 0xAA
+	ROP3_SRCCOPY   = 0xCC
+	ROP3_SRCPAINT  = 0xEE
+	ROP3_PATCOPY   = 0xF0
+	ROP3_WHITENESS = 0xFF
+)
+
 type Dstblt struct {
-	x      int32
-	y      int32
-	cx     int32
-	cy     int32
-	opcode uint8
+	X      int32
+	Y      int32
+	Cx     int32
+	Cy     int32
+	Opcode uint8
 }
 
 func (d *Dstblt) Type() int {
 	return ORDER_TYPE_DSTBLT
 }
 func (d *Dstblt) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Debug("Dstblt Order")
 	if present&0x01 != 0 {
-		readOrderCoord(r, &d.x, delta)
+		readOrderCoord(r, &d.X, delta)
 	}
 	if present&0x02 != 0 {
-		readOrderCoord(r, &d.y, delta)
+		readOrderCoord(r, &d.Y, delta)
 	}
 	if present&0x04 != 0 {
-		readOrderCoord(r, &d.cx, delta)
+		readOrderCoord(r, &d.Cx, delta)
 	}
 	if present&0x08 != 0 {
-		readOrderCoord(r, &d.cy, delta)
+		readOrderCoord(r, &d.Cy, delta)
 	}
 	if present&0x10 != 0 {
-		d.opcode, _ = core.ReadUInt8(r)
+		d.Opcode, _ = core.ReadUInt8(r)
 	}
 	return nil
 }
 
 type Patblt struct {
-	x        int32
-	y        int32
-	cx       int32
-	cy       int32
-	opcode   uint8
-	bgcolour [4]uint8
-	fgcolour [4]uint8
-	brush    Brush
+	X         int32
+	Y         int32
+	Cx        int32
+	Cy        int32
+	Opcode    uint8
+	BackColor uint32
+	ForeColor uint32
+	Brush     Brush
 }
 
 func (d *Patblt) Type() int {
 	return ORDER_TYPE_PATBLT
 }
 func (d *Patblt) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Debug("Patblt Order")
 	if present&0x01 != 0 {
-		readOrderCoord(r, &d.x, delta)
+		readOrderCoord(r, &d.X, delta)
 	}
 	if present&0x02 != 0 {
-		readOrderCoord(r, &d.y, delta)
+		readOrderCoord(r, &d.Y, delta)
 	}
 	if present&0x04 != 0 {
-		readOrderCoord(r, &d.cx, delta)
+		readOrderCoord(r, &d.Cx, delta)
 	}
 	if present&0x08 != 0 {
-		readOrderCoord(r, &d.cy, delta)
+		readOrderCoord(r, &d.Cy, delta)
 	}
 	if present&0x10 != 0 {
-		d.opcode, _ = core.ReadUInt8(r)
+		d.Opcode, _ = core.ReadUInt8(r)
 	}
 	if present&0x0020 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.bgcolour[0], d.bgcolour[1], d.bgcolour[2], d.bgcolour[3] = b, g, r, a
+		d.BackColor = readGenericColor(r)
 	}
 	if present&0x0040 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.fgcolour[0], d.fgcolour[1], d.fgcolour[2], d.fgcolour[3] = b, g, r, a
+		d.ForeColor = readGenericColor(r)
 	}
-	d.brush.updateBrush(r, present>>7)
+	d.Brush.updateBrush(r, present>>7)
 
 	return nil
 }
 
+/* Brush styles */
+const (
+	BS_SOLID   = 0x00
+	BS_NULL    = 0x01
+	BS_HATCHED = 0x02
+	BS_PATTERN = 0x03
+
+	// TS_CACHED_BRUSH is set in Brush.Style for a brush from the brush
+	// cache, which the client does not advertise.
+	TS_CACHED_BRUSH = 0x80
+)
+
+// Brush is a TS_BRUSH.  For BS_PATTERN, Data holds the 8 rows of the
+// 8x8 monochrome pattern, bottom row first.
 type Brush struct {
 	X     uint8
 	Y     uint8
@@ -523,10 +648,7 @@ func (d *Scrblt) Type() int {
 	return ORDER_TYPE_SCRBLT
 }
 
-var d Scrblt
-
-func (d1 *Scrblt) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Debug("Scrblt Order")
+func (d *Scrblt) Unpack(r io.Reader, present uint32, delta bool) error {
 	if present&0x0001 != 0 {
 		readOrderCoord(r, &d.X, delta)
 	}
@@ -548,26 +670,24 @@ func (d1 *Scrblt) Unpack(r io.Reader, present uint32, delta bool) error {
 	if present&0x0040 != 0 {
 		readOrderCoord(r, &d.Srcy, delta)
 	}
-	*d1 = d
 	return nil
 }
 
 type LineTo struct {
-	Mixmode  uint16
-	Startx   int32
-	Starty   int32
-	Endx     int32
-	Endy     int32
-	Bgcolour [4]uint8
-	Opcode   uint8
-	Pen      Pen
+	Mixmode   uint16
+	Startx    int32
+	Starty    int32
+	Endx      int32
+	Endy      int32
+	BackColor uint32
+	Opcode    uint8
+	Pen       Pen
 }
 
 func (d *LineTo) Type() int {
 	return ORDER_TYPE_LINETO
 }
 func (d *LineTo) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Debug("LineTo Order")
 	if present&0x0001 != 0 {
 		d.Mixmode, _ = core.ReadUint16LE(r)
 	}
@@ -584,8 +704,7 @@ func (d *LineTo) Unpack(r io.Reader, present uint32, delta bool) error {
 		readOrderCoord(r, &d.Endy, delta)
 	}
 	if present&0x0020 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Bgcolour[0], d.Bgcolour[1], d.Bgcolour[2], d.Bgcolour[3] = b, g, r, a
+		d.BackColor = readGenericColor(r)
 	}
 	if present&0x0040 != 0 {
 		d.Opcode, _ = core.ReadUInt8(r)
@@ -597,9 +716,9 @@ func (d *LineTo) Unpack(r io.Reader, present uint32, delta bool) error {
 }
 
 type Pen struct {
-	Style  uint8
-	Width  uint8
-	Colour [4]uint8
+	Style uint8
+	Width uint8
+	Color uint32
 }
 
 func (d *Pen) updatePen(r io.Reader, present uint32) {
@@ -612,24 +731,24 @@ func (d *Pen) updatePen(r io.Reader, present uint32) {
 	}
 
 	if present&4 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Colour[0], d.Colour[1], d.Colour[2], d.Colour[3] = b, g, r, a
+		d.Color = readGenericColor(r)
 	}
 }
 
+// OpaqueRect fills a rectangle with Color, a Generic Color whose bytes
+// are sent separately.
 type OpaqueRect struct {
-	X      int32
-	Y      int32
-	Cx     int32
-	Cy     int32
-	Colour [4]uint8
+	X     int32
+	Y     int32
+	Cx    int32
+	Cy    int32
+	Color uint32
 }
 
 func (d *OpaqueRect) Type() int {
 	return ORDER_TYPE_OPAQUERECT
 }
 func (d *OpaqueRect) Unpack(r io.Reader, present uint32, delta bool) error {
-	slog.Debug("OpaqueRect Order")
 	if present&0x0001 != 0 {
 		readOrderCoord(r, &d.X, delta)
 	}
@@ -642,17 +761,12 @@ func (d *OpaqueRect) Unpack(r io.Reader, present uint32, delta bool) error {
 	if present&0x0008 != 0 {
 		readOrderCoord(r, &d.Cy, delta)
 	}
-	if present&0x0010 != 0 {
-		i, _ := core.ReadUInt8(r)
-		d.Colour[0] = i
-	}
-	if present&0x0020 != 0 {
-		i, _ := core.ReadUInt8(r)
-		d.Colour[1] = i
-	}
-	if present&0x0040 != 0 {
-		i, _ := core.ReadUInt8(r)
-		d.Colour[2] = i
+	for i := 0; i < 3; i++ {
+		if present&(0x0010<<i) != 0 {
+			b, _ := core.ReadUInt8(r)
+			shift := 8 * i
+			d.Color = d.Color&^(0xFF<<shift) | uint32(b)<<shift
+		}
 	}
 	return nil
 }
@@ -749,8 +863,8 @@ type Mem3blt struct {
 	Opcode      uint8
 	Srcx        int32
 	Srcy        int32
-	Bgcolour    [4]uint8
-	Fgcolour    [4]uint8
+	BackColor   uint32
+	ForeColor   uint32
 	Brush       Brush
 	CacheIdx    uint16
 }
@@ -785,32 +899,29 @@ func (d *Mem3blt) Unpack(r io.Reader, present uint32, delta bool) error {
 		readOrderCoord(r, &d.Srcy, delta)
 	}
 	if present&0x000100 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Bgcolour[0], d.Bgcolour[1], d.Bgcolour[2], d.Bgcolour[3] = b, g, r, a
+		d.BackColor = readGenericColor(r)
 	}
 	if present&0x000200 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Fgcolour[0], d.Fgcolour[1], d.Fgcolour[2], d.Fgcolour[3] = b, g, r, a
+		d.ForeColor = readGenericColor(r)
 	}
 	d.Brush.updateBrush(r, present>>10)
 	if present&0x008000 != 0 {
 		d.CacheIdx, _ = core.ReadUint16LE(r)
 	}
-	if present&0x010000 != 0 {
-		core.ReadUint16LE(r)
-	}
 
 	return nil
 }
 
+// PolygonSc is a solid colour polygon; Points are the vertices after
+// (X, Y), each relative to the previous one.
 type PolygonSc struct {
-	X        int32
-	Y        int32
-	Opcode   uint8
-	Fillmode uint8
-	Fgcolour [4]uint8
-	Npoints  uint8
-	Points   []Point
+	X          int32
+	Y          int32
+	Opcode     uint8
+	Fillmode   uint8
+	BrushColor uint32
+	Npoints    uint8
+	Points     []Point
 }
 
 type Point struct {
@@ -835,37 +946,44 @@ func (d *PolygonSc) Unpack(r io.Reader, present uint32, delta bool) error {
 		d.Fillmode, _ = core.ReadUInt8(r)
 	}
 	if present&0x0010 != 0 {
-		b, g, r, a := updateReadColorRef(r)
-		d.Fgcolour[0], d.Fgcolour[1], d.Fgcolour[2], d.Fgcolour[3] = b, g, r, a
+		d.BrushColor = readGenericColor(r)
 	}
 	if present&0x0020 != 0 {
 		d.Npoints, _ = core.ReadUInt8(r)
-		d.Points = make([]Point, 0, d.Npoints+1)
 	}
 	if present&0x0040 != 0 {
-		size, _ := core.ReadUInt8(r)
-		data, _ := core.ReadBytes(int(size), r)
-		d.Points = append(d.Points, Point{d.X, d.Y})
-		var flags uint8
-		r = bytes.NewReader(data)
-		for i := 1; i <= int(d.Npoints); i++ {
-			var p Point
-			if (i-1)%4 == 0 {
-				flags, _ = core.ReadUInt8(r)
-			}
-			if (^flags)&0x80 != 0 {
-				p.X = parseDelta(r)
-			}
-			if (^flags)&0x40 != 0 {
-				p.Y = parseDelta(r)
-			}
-			flags <<= 2
-		}
+		d.Points = readDeltaPoints(r, int(d.Npoints))
 	}
 
 	return nil
 }
 
+// readDeltaPoints reads a DELTA_PTS_FIELD of n points: a length byte, the
+// zero bits of every point, then the non-zero deltas.
+func readDeltaPoints(r io.Reader, n int) []Point {
+	size, _ := core.ReadUInt8(r)
+	data, err := core.ReadBytes(int(size), r)
+	if err != nil {
+		return nil
+	}
+	dr := bytes.NewReader(data)
+	zeroBits, err := core.ReadBytes((n+3)/4, dr)
+	if err != nil {
+		return nil
+	}
+	points := make([]Point, n)
+	for i := range points {
+		flags := zeroBits[i/4] << (2 * (i % 4))
+		if flags&0x80 == 0 {
+			points[i].X = parseDelta(dr)
+		}
+		if flags&0x40 == 0 {
+			points[i].Y = parseDelta(dr)
+		}
+	}
+	return points
+}
+
 func parseDelta(r io.Reader) (v int32) {
 	b, _ := core.ReadUInt8(r)
 	if b&0x40 != 0 {
@@ -890,13 +1008,43 @@ func (d *PolygonCb) Unpack(r io.Reader, present uint32, delta bool) error {
 	return nil
 }
 
+// Polyline is a series of lines from (Xstart, Ystart); Deltas are the
+// ends of the lines, each relative to the previous one.
 type Polyline struct {
+	Xstart          int32
+	Ystart          int32
+	Opcode          uint8
+	BrushCacheEntry uint16
+	PenColor        uint32
+	NumDeltaEntries uint8
+	Deltas          []Point
 }
 
 func (d *Polyline) Type() int {
 	return ORDER_TYPE_POLYLINE
 }
 func (d *Polyline) Unpack(r io.Reader, present uint32, delta bool) error {
+	if present&0x0001 != 0 {
+		readOrderCoord(r, &d.Xstart, delta)
+	}
+	if present&0x0002 != 0 {
+		readOrderCoord(r, &d.Ystart, delta)
+	}
+	if present&0x0004 != 0 {
+		d.Opcode, _ = core.ReadUInt8(r)
+	}
+	if present&0x0008 != 0 {
+		d.BrushCacheEntry, _ = core.ReadUint16LE(r)
+	}
+	if present&0x0010 != 0 {
+		d.PenColor = readGenericColor(r)
+	}
+	if present&0x0020 != 0 {
+		d.NumDeltaEntries, _ = core.ReadUInt8(r)
+	}
+	if present&0x0040 != 0 {
+		d.Deltas = readDeltaPoints(r, int(d.NumDeltaEntries))
+	}
 	return nil
 }
 
@@ -920,13 +1068,81 @@ func (d *EllipeCb) Unpack(r io.Reader, present uint32, delta bool) error {
 	return nil
 }
 
+/* GlyphIndex flAccel flags */
+const (
+	SO_FLAG_DEFAULT_PLACEMENT = 0x01
+	SO_HORIZONTAL             = 0x02
+	SO_VERTICAL               = 0x04
+	SO_REVERSED               = 0x08
+	SO_ZERO_BEARINGS          = 0x10
+	SO_CHAR_INC_EQUAL_BM_BASE = 0x20
+	SO_MAXEXT_EQUAL_BM_SIDE   = 0x40
+)
+
+// GlayphIndex draws Data, a list of glyph cache indexes and fragment
+// operations, at (X, Y).  Despite the names, BackColor is the colour of
+// the text and ForeColor the colour of the opaque rectangle.
 type GlayphIndex struct {
+	CacheId      uint8
+	FlAccel      uint8
+	UlCharInc    uint8
+	FOpRedundant uint8
+	BackColor    uint32
+	ForeColor    uint32
+	BkLeft       int16
+	BkTop        int16
+	BkRight      int16
+	BkBottom     int16
+	OpLeft       int16
+	OpTop        int16
+	OpRight      int16
+	OpBottom     int16
+	Brush        Brush
+	X            int16
+	Y            int16
+	Data         []byte
 }
 
 func (d *GlayphIndex) Type() int {
 	return ORDER_TYPE_TEXT2
 }
 func (d *GlayphIndex) Unpack(r io.Reader, present uint32, delta bool) error {
+	bytesFields := []*uint8{&d.CacheId, &d.FlAccel, &d.UlCharInc, &d.FOpRedundant}
+	for i, f := range bytesFields {
+		if present&(1<<i) != 0 {
+			*f, _ = core.ReadUInt8(r)
+		}
+	}
+	if present&0x000010 != 0 {
+		d.BackColor = readGenericColor(r)
+	}
+	if present&0x000020 != 0 {
+		d.ForeColor = readGenericColor(r)
+	}
+	rectFields := []*int16{&d.BkLeft, &d.BkTop, &d.BkRight, &d.BkBottom,
+		&d.OpLeft, &d.OpTop, &d.OpRight, &d.OpBottom}
+	for i, f := range rectFields {
+		if present&(0x40<<i) != 0 {
+			v, _ := core.ReadUint16LE(r)
+			*f = int16(v)
+		}
+	}
+	d.Brush.updateBrush(r, present>>14)
+	if present&0x080000 != 0 {
+		v, _ := core.ReadUint16LE(r)
+		d.X = int16(v)
+	}
+	if present&0x100000 != 0 {
+		v, _ := core.ReadUint16LE(r)
+		d.Y = int16(v)
+	}
+	if present&0x200000 != 0 {
+		n, _ := core.ReadUInt8(r)
+		var err error
+		if d.Data, err = core.ReadBytes(int(n), r); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -950,7 +1166,8 @@ func (s *Secondary) updateCacheBitmapOrder(r io.Reader, compressed bool, flags u
 	cb.bitmapComprHdr = bitmapComprHdr
 	cb.bitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
 	cb.bitmapLength = bitmapLength
-
+	cb.compressed = compressed
+	s.Order = &cb
 }
 
 type CacheBitmapOrder struct {
@@ -960,6 +1177,7 @@ type CacheBitmapOrder struct {
 	bitmapHeight     uint8
 	bitmapLength     uint16
 	cacheIndex       uint16
+	compressed       bool
 	bitmapComprHdr   []byte
 	bitmapDataStream []byte
 }
@@ -986,10 +1204,10 @@ type CacheBitmapV2Order struct {
 	key1               uint32
 	key2               uint32
 	bitmapBpp          uint32
-	bitmapWidth        uint8
-	bitmapHeight       uint8
-	bitmapLength       uint16
-	cacheIndex         uint32
+	bitmapWidth        uint16
+	bitmapHeight       uint16
+	bitmapLength       uint32
+	cacheIndex         uint16
 	compressed         bool
 	cbCompFirstRowSize uint16
 	cbCompMainBodySize uint16
@@ -998,9 +1216,30 @@ type CacheBitmapV2Order struct {
 	bitmapDataStream   []byte
 }
 
+// readTwoByteUnsigned reads a TWO_BYTE_UNSIGNED_ENCODING value.
+func readTwoByteUnsigned(r io.Reader) uint16 {
+	b, _ := core.ReadUInt8(r)
+	if b&0x80 == 0 {
+		return uint16(b)
+	}
+	lo, _ := core.ReadUInt8(r)
+	return uint16(b&0x7F)<<8 | uint16(lo)
+}
+
+// readFourByteUnsigned reads a FOUR_BYTE_UNSIGNED_ENCODING value.
+func readFourByteUnsigned(r io.Reader) uint32 {
+	b, _ := core.ReadUInt8(r)
+	v := uint32(b & 0x3F)
+	for i := 0; i < int(b>>6); i++ {
+		n, _ := core.ReadUInt8(r)
+		v = v<<8 | uint32(n)
+	}
+	return v
+}
+
 func (s *Secondary) updateCacheBitmapV2Order(r io.Reader, compressed bool, flags uint16) {
 	var cb CacheBitmapV2Order
-	cb.cacheId = uint32(flags) & 0x0003
+	cb.cacheId = uint32(flags) & 0x0007
 	cb.flags = (uint32(flags) & 0xFF80) >> 7
 	bitsPerPixelId := (uint32(flags) & 0x0078) >> 3
 	cb.bitmapBpp = getCbV2Bpp(bitsPerPixelId)
@@ -1010,21 +1249,20 @@ func (s *Secondary) updateCacheBitmapV2Order(r io.Reader, compressed bool, flags
 		cb.key2, _ = core.ReadUInt32LE(r)
 	}
 
+	cb.bitmapWidth = readTwoByteUnsigned(r)
 	if cb.flags&CBR2_HEIGHT_SAME_AS_WIDTH != 0 {
-		cb.bitmapWidth, _ = core.ReadUInt8(r)
 		cb.bitmapHeight = cb.bitmapWidth
 	} else {
-		cb.bitmapWidth, _ = core.ReadUInt8(r)
-		cb.bitmapHeight, _ = core.ReadUInt8(r)
+		cb.bitmapHeight = readTwoByteUnsigned(r)
 	}
 
-	bitmapLength, _ := core.ReadUint16LE(r)
-	cacheIndex, _ := core.ReadUInt8(r)
+	bitmapLength := readFourByteUnsigned(r)
+	cacheIndex := readTwoByteUnsigned(r)
 
 	if cb.flags&CBR2_DO_NOT_CACHE != 0 {
-		cb.cacheIndex = 0x7FFF
+		cb.cacheIndex = BITMAPCACHE_WAITING_LIST_INDEX
 	} else {
-		cb.cacheIndex = uint32(cacheIndex)
+		cb.cacheIndex = cacheIndex
 	}
 
 	if compressed {
@@ -1033,14 +1271,14 @@ func (s *Secondary) updateCacheBitmapV2Order(r io.Reader, compressed bool, flags
 			cb.cbCompMainBodySize, _ = core.ReadUint16LE(r)
 			cb.cbScanWidth, _ = core.ReadUint16LE(r)
 			cb.cbUncompressedSize, _ = core.ReadUint16LE(r)
-			bitmapLength = cb.cbCompMainBodySize
+			bitmapLength = uint32(cb.cbCompMainBodySize)
 		}
 	}
 
 	cb.bitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
 	cb.bitmapLength = bitmapLength
 	cb.compressed = compressed
-
+	s.Order = &cb
 }
 
 type CacheBitmapV3Order struct {
@@ -1117,41 +1355,51 @@ func updateReadColorRef(r io.Reader) (uint8, uint8, uint8, uint8) {
 	return blue, green, red, 255
 }
 
+// CacheGlyphOrder is a Cache Glyph (revision 1) order, which the
+// GlyphIndex orders draw from.
 type CacheGlyphOrder struct {
-	cacheId uint8
-	nglyphs uint8
-	glyphs  []CacheGlyph
+	CacheId uint8
+	Glyphs  []CacheGlyph
 }
+
+// CacheGlyph is a 1bpp glyph drawn with its top-left corner at (X, Y)
+// from the glyph origin.  Data rows are byte aligned, most significant
+// bit first.
 type CacheGlyph struct {
-	character uint16
-	offset    uint16
-	baseline  uint16
-	width     uint16
-	height    uint16
-	datasize  int
-	data      []uint8
+	Index  uint16
+	X      int16
+	Y      int16
+	Width  uint16
+	Height uint16
+	Data   []uint8
 }
 
 func (s *Secondary) updateCacheGlyphOrder(r io.Reader, flags uint16) {
 	var cb CacheGlyphOrder
 
-	cb.cacheId, _ = core.ReadUInt8(r)
-	cb.nglyphs, _ = core.ReadUInt8(r)
-	cb.glyphs = make([]CacheGlyph, 0, cb.nglyphs)
+	cb.CacheId, _ = core.ReadUInt8(r)
+	nglyphs, _ := core.ReadUInt8(r)
+	cb.Glyphs = make([]CacheGlyph, 0, nglyphs)
 
-	for i := 0; i < int(cb.nglyphs); i++ {
+	for i := 0; i < int(nglyphs); i++ {
 		var c CacheGlyph
-		c.character, _ = core.ReadUint16LE(r)
-		c.offset, _ = core.ReadUint16LE(r)
-		c.baseline, _ = core.ReadUint16LE(r)
-		c.width, _ = core.ReadUint16LE(r)
-		c.height, _ = core.ReadUint16LE(r)
-
-		c.datasize = int(c.height*((c.width+7)/8)+3) & ^3
-		c.data, _ = core.ReadBytes(c.datasize, r)
+		var x, y uint16
+		c.Index, _ = core.ReadUint16LE(r)
+		x, _ = core.ReadUint16LE(r)
+		y, _ = core.ReadUint16LE(r)
+		c.X, c.Y = int16(x), int16(y)
+		c.Width, _ = core.ReadUint16LE(r)
+		c.Height, _ = core.ReadUint16LE(r)
+
+		datasize := (int(c.Height)*((int(c.Width)+7)/8) + 3) & ^3
+		var err error
+		if c.Data, err = core.ReadBytes(datasize, r); err != nil {
+			return
+		}
 
-		cb.glyphs = append(cb.glyphs, c)
+		cb.Glyphs = append(cb.Glyphs, c)
 	}
+	s.Order = &cb
 }
 
 type CacheBrushOrder struct {
@@ -1220,11 +1468,13 @@ func update_decompress_brush(in []uint8, bpp int) []uint8 {
 }
 
 /*Primary*/
+// Bounds is the clipping rectangle of a primary order, bottom-right
+// inclusive.
 type Bounds struct {
-	left   int32
-	top    int32
-	right  int32
-	bottom int32
+	Left   int32
+	Top    int32
+	Right  int32
+	Bottom int32
 }
 type OrderInfo struct {
 	controlFlags     uint32
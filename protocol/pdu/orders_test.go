@@ -0,0 +1,127 @@
+package pdu
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nakagami/grdp/core"
+)
+
+func TestDecodeOrdersHistory(t *testing.T) {
+	buf := &bytes.Buffer{}
+	core.WriteUInt16LE(2, buf)
+	// OpaqueRect (10, 20, 30, 40) in red, then the same moved 5 right
+	// with a delta coordinate.
+	buf.Write([]byte{TS_STANDARD | TS_TYPE_CHANGE, ORDER_TYPE_OPAQUERECT, 0x7F})
+	for _, v := range []uint16{10, 20, 30, 40} {
+		core.WriteUInt16LE(v, buf)
+	}
+	buf.Write([]byte{0xFF, 0x00, 0x00})
+	buf.Write([]byte{TS_STANDARD | TS_DELTA_COORDINATES, 0x01, 5})
+
+	f := &FastPathOrdersPDU{}
+	if err := f.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	f.decode(newOrderState())
+	if len(f.OrderPdus) != 2 {
+		t.Fatalf("got %d orders, want 2", len(f.OrderPdus))
+	}
+	first := f.OrderPdus[0].Primary.Data.(*OpaqueRect)
+	second := f.OrderPdus[1].Primary.Data.(*OpaqueRect)
+	if *first != (OpaqueRect{10, 20, 30, 40, 0xFF}) {
+		t.Errorf("first = %+v", *first)
+	}
+	if *second != (OpaqueRect{15, 20, 30, 40, 0xFF}) {
+		t.Errorf("second = %+v", *second)
+	}
+}
+
+func TestDecodePolylineDeltas(t *testing.T) {
+	buf := &bytes.Buffer{}
+	core.WriteUInt16LE(1, buf)
+	buf.Write([]byte{TS_STANDARD | TS_TYPE_CHANGE, ORDER_TYPE_POLYLINE, 0x7F})
+	core.WriteUInt16LE(100, buf)
+	core.WriteUInt16LE(50, buf)
+	buf.Write([]byte{13, 0, 0, 0x11, 0x22, 0x33, 2})
+	// Two points: (+10, 0) with Y zero, then (-3, +200).
+	buf.Write([]byte{5, 0x40, 10, 0x7D, 0x80, 0xC8})
+
+	f := &FastPathOrdersPDU{}
+	if err := f.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	f.decode(newOrderState())
+	if len(f.OrderPdus) != 1 {
+		t.Fatalf("got %d orders, want 1", len(f.OrderPdus))
+	}
+	p := f.OrderPdus[0].Primary.Data.(*Polyline)
+	if p.Xstart != 100 || p.Ystart != 50 || p.Opcode != 13 || p.PenColor != 0x332211 {
+		t.Errorf("polyline = %+v", *p)
+	}
+	if len(p.Deltas) != 2 || p.Deltas[0] != (Point{10, 0}) || p.Deltas[1] != (Point{-3, 200}) {
+		t.Errorf("deltas = %v", p.Deltas)
+	}
+}
+
+func TestDecodeWindowOrder(t *testing.T) {
+	body := &bytes.Buffer{}
+	core.WriteUInt32LE(WINDOW_ORDER_TYPE_WINDOW|WINDOW_ORDER_STATE_NEW|WINDOW_ORDER_FIELD_TITLE|WINDOW_ORDER_FIELD_SHOW, body)
+	core.WriteUInt32LE(0x1234, body)
+	body.WriteByte(5) // SW_SHOW
+	core.WriteUInt16LE(4, body)
+	body.Write([]byte{'h', 0, 'i', 0})
+
+	buf := &bytes.Buffer{}
+	core.WriteUInt16LE(2, buf)
+	buf.WriteByte(ORDER_TYPE_WINDOW<<2 | TS_SECONDARY)
+	core.WriteUInt16LE(uint16(3+body.Len()), buf)
+	buf.Write(body.Bytes())
+	// A frame marker after it must still be found.
+	buf.WriteByte(ORDER_TYPE_FRAME_MARKER<<2 | TS_SECONDARY)
+	core.WriteUInt32LE(1, buf)
+
+	f := &FastPathOrdersPDU{}
+	if err := f.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	f.decode(newOrderState())
+	if len(f.OrderPdus) != 2 {
+		t.Fatalf("got %d orders, want 2", len(f.OrderPdus))
+	}
+	w, ok := f.OrderPdus[0].Altsec.Order.(*WindowOrder)
+	if !ok {
+		t.Fatalf("order = %#v", f.OrderPdus[0].Altsec.Order)
+	}
+	if w.WindowId != 0x1234 || w.ShowState != 5 || w.Title != "hi" {
+		t.Errorf("window order = %+v", *w)
+	}
+}
+
+func TestDecodeWindowIconOrder(t *testing.T) {
+	b := &bytes.Buffer{}
+	core.WriteUInt32LE(WINDOW_ORDER_TYPE_WINDOW|WINDOW_ORDER_ICON|WINDOW_ORDER_FIELD_ICON_BIG, b)
+	core.WriteUInt32LE(9, b)
+	b.Write([]byte{2, 0, 1, 1}) // entry 2 of cache 1, 1 bpp
+	core.WriteUInt16LE(8, b)
+	core.WriteUInt16LE(1, b)
+	core.WriteUInt16LE(8, b) // color table
+	core.WriteUInt16LE(4, b) // mask
+	core.WriteUInt16LE(4, b) // color
+	b.Write([]byte{0x80, 0, 0, 0})
+	b.Write([]byte{0, 0, 0, 0, 0xFF, 0xFF, 0xFF, 0})
+	b.Write([]byte{0x55, 0, 0, 0})
+
+	o, err := readWindowOrder(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := o.(*WindowOrder)
+	i := w.Icon
+	if w.WindowId != 9 || i == nil || i.CacheEntry != 2 || i.CacheId != 1 || i.Width != 8 || i.Height != 1 {
+		t.Fatalf("icon order = %+v, icon %+v", *w, i)
+	}
+	if !bytes.Equal(i.BitsMask, []byte{0x80, 0, 0, 0}) || len(i.ColorTable) != 8 || !bytes.Equal(i.BitsColor, []byte{0x55, 0, 0, 0}) {
+		t.Errorf("icon = %+v", *i)
+	}
+}
@@ -2,8 +2,11 @@ package pdu
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 
 	"github.com/nakagami/grdp/core"
 	"github.com/nakagami/grdp/emission"
@@ -14,16 +17,14 @@ var readerPool = sync.Pool{
 	New: func() any { return new(bytes.Reader) },
 }
 
-// fastPathBufPool reuses byte slices for serializing fast-path input PDUs.
+// fastPathBufs reuses byte slices for serializing fast-path input PDUs.
 // Capacity 128 covers the maximum frame: 1 + 7*15 = 106 bytes.
-var fastPathBufPool = sync.Pool{
-	New: func() any { return make([]byte, 0, 128) },
-}
+var fastPathBufs = core.NewBufferPool(128, 128)
 
 type PDULayer struct {
 	emission.Emitter
 	transport          core.Transport
-	sharedId           uint32
+	sharedId           atomic.Uint32 // set on activation, read by the senders
 	userId             uint16
 	channelId          uint16
 	serverCapabilities map[CapsType]Capability
@@ -32,16 +33,21 @@ type PDULayer struct {
 	// serverFastPathInput is set after capability exchange when both sides
 	// advertise INPUT_FLAG_FASTPATH_INPUT, allowing client input to be sent
 	// using the much shorter fast-path framing (MS-RDPBCGR §2.2.8.1.2).
-	serverFastPathInput bool
+	serverFastPathInput atomic.Bool
 	demandActivePDU     *DemandActivePDU
-	mppc                *core.MppcDecompressor
+	bulk                *core.BulkDecompressor
+	received            pduCounts
+	// frameAck is set after capability exchange when both sides advertise
+	// the Frame Acknowledge capability, enabling TS_FRAME_ACKNOWLEDGE_PDU.
+	frameAck bool
+	log      *slog.Logger
 }
 
 func NewPDULayer(t core.Transport) *PDULayer {
 	p := &PDULayer{
 		Emitter:   *emission.NewEmitter(),
 		transport: t,
-		sharedId:  0x103EA,
+		log:       core.Logger(nil, "pdu"),
 		serverCapabilities: map[CapsType]Capability{
 			CAPSTYPE_GENERAL: &GeneralCapability{
 				ProtocolVersion: 0x0200,
@@ -94,7 +100,7 @@ func NewPDULayer(t core.Transport) *PDULayer {
 			CAPSTYPE_SOUND:           &SoundCapability{0x0001, 0},
 			CAPSTYPE_INPUT:           &InputCapability{},
 			CAPSTYPE_FONT:            &FontCapability{0x0001, 0},
-			CAPSTYPE_BRUSH:           &BrushCapability{BRUSH_COLOR_8x8},
+			CAPSTYPE_BRUSH:           &BrushCapability{BRUSH_DEFAULT},
 			CAPSTYPE_GLYPHCACHE:      &GlyphCapability{},
 			CAPSETTYPE_BITMAP_CODECS: newClientBitmapCodecsCapability(),
 			CAPSTYPE_BITMAPCACHE_REV2: &BitmapCache2Capability{
@@ -127,8 +133,9 @@ func NewPDULayer(t core.Transport) *PDULayer {
 			},
 			CAPSSETTYPE_FRAME_ACKNOWLEDGE: &FrameAcknowledgeCapability{2},
 		},
-		mppc: core.NewMppcDecompressor(),
+		bulk: core.NewBulkDecompressor(),
 	}
+	p.sharedId.Store(0x103EA)
 
 	t.On("close", func() {
 		p.Emit("close")
@@ -144,7 +151,7 @@ func (p *PDULayer) sendPDU(message PDUMessage) {
 }
 
 func (p *PDULayer) sendDataPDU(message DataPDUData) {
-	dataPdu := NewDataPDU(message, p.sharedId)
+	dataPdu := NewDataPDU(message, p.sharedId.Load())
 	p.sendPDU(dataPdu)
 }
 
@@ -152,26 +159,101 @@ func (p *PDULayer) SetFastPathSender(f core.FastPathSender) {
 	p.fastPathSender = f
 }
 
+// BitmapUpdate is the argument of the "bitmap" event of Client.
+type BitmapUpdate struct {
+	Rectangles []BitmapData
+	UpdateType BitmapUpdateType
+}
+
 type Client struct {
 	*PDULayer
+	// ready, errs and bitmap are the typed "ready", "error" and "bitmap"
+	// events.
+	ready          emission.Event[struct{}]
+	errs           emission.Event[error]
+	bitmap         emission.Event[BitmapUpdate]
 	clientCoreData *gcc.ClientCoreData
 	buff           *bytes.Buffer
+	// preferredBpp is advertised in the Confirm Active bitmap capability;
+	// colorDepth is the depth the server announced in its Demand Active,
+	// inputFlags its input capability flags.
+	preferredBpp atomic.Uint32
+	colorDepth   atomic.Uint32
+	inputFlags   atomic.Uint32
+	// capOverrides replaces (or, when nil, removes) client capability sets
+	// after the defaults are filled in; capFilter then sees the final sets.
+	capOverrides map[CapsType]Capability
+	capFilter    CapabilityFilter
+	// active is set once the connection finalization completes and cleared
+	// by a Deactivate All PDU; while it is clear the capability exchange
+	// handlers, not recvPDU, consume the PDUs.
+	active bool
+	// bitmapCache stores the Cache Bitmap orders; when persistBitmaps
+	// is set its persisted keys are announced in the first connection
+	// finalization.
+	bitmapCache    *BitmapCache
+	persistBitmaps bool
+	persistKeyList bool
+	// orders is the primary drawing order history; drawingOrders enables
+	// the order capabilities the client can render.
+	orders        *orderState
+	drawingOrders bool
 }
 
 func NewClient(t core.Transport) *Client {
 	c := &Client{
-		PDULayer: NewPDULayer(t),
-		buff:     &bytes.Buffer{},
+		PDULayer:      NewPDULayer(t),
+		buff:          &bytes.Buffer{},
+		bitmapCache:   NewBitmapCache(),
+		orders:        newOrderState(),
+		drawingOrders: true,
 	}
+	c.preferredBpp.Store(32)
+	c.ready.Shim(&c.Emitter, "ready", func(struct{}) []any { return nil }, nil)
+	c.errs.Shim(&c.Emitter, "error", nil, nil)
+	c.bitmap.Shim(&c.Emitter, "bitmap",
+		func(u BitmapUpdate) []any { return []any{u.Rectangles, u.UpdateType} },
+		func(a []any) (u BitmapUpdate) {
+			if len(a) == 2 {
+				u.Rectangles, _ = a[0].([]BitmapData)
+				u.UpdateType, _ = a[1].(BitmapUpdateType)
+			}
+			return u
+		})
 	c.transport.Once("connect", c.connect)
 	return c
 }
 
+// SetLogger makes the layer log to l, with the attribute layer=pdu.
+func (c *Client) SetLogger(l *slog.Logger) {
+	c.log = core.Logger(l, "pdu")
+	c.orders.log = c.log
+	c.bitmapCache.log = c.log
+}
+
+// OnReady subscribes f to the end of each activation, the "ready" event.
+func (c *Client) OnReady(f func()) *emission.Subscription {
+	return c.ready.Subscribe(func(struct{}) { f() })
+}
+
+// OnError subscribes f to the errors of the session and of the layers
+// below, the "error" event.
+func (c *Client) OnError(f func(error)) *emission.Subscription {
+	return c.errs.Subscribe(f)
+}
+
+// OnBitmap subscribes f to the bitmap updates received, the "bitmap"
+// event.
+func (c *Client) OnBitmap(f func(BitmapUpdate)) *emission.Subscription {
+	return c.bitmap.Subscribe(f)
+}
+
 func (c *Client) connect(data *gcc.ClientCoreData, userId uint16, channelId uint16) {
-	slog.Debug("pdu connect", "userId", userId, "channelId", channelId)
+	c.log.Debug("pdu connect", "userId", userId, "channelId", channelId)
 	c.clientCoreData = data
 	c.userId = userId
 	c.channelId = channelId
+	core.OnData(c.transport, c.recvPDU)
 	c.transport.Once("data", c.recvDemandActivePDU)
 }
 
@@ -179,9 +261,15 @@ func (c *Client) recvDemandActivePDU(s []byte) {
 	r := readerPool.Get().(*bytes.Reader)
 	r.Reset(s)
 	defer readerPool.Put(r)
-	pdu, err := readPDU(r, c.mppc)
+	pdu, err := c.readPDU(r)
 	if err != nil {
-		slog.Error("recvDemandActivePDU", "err", err)
+		if c.protocolError("Demand Active", s, err) {
+			c.transport.Once("data", c.recvDemandActivePDU)
+		}
+		return
+	}
+	if c.recvSessionPDU(pdu) {
+		c.transport.Once("data", c.recvDemandActivePDU)
 		return
 	}
 	if pdu.ShareCtrlHeader.PDUType != PDUTYPE_DEMANDACTIVEPDU {
@@ -190,7 +278,7 @@ func (c *Client) recvDemandActivePDU(s []byte) {
 			// DemandActivePDU (e.g. GNOME RDP after RDPGFX capability
 			// exchange). Stay on the same connection and keep waiting,
 			// exactly as FreeRDP does.
-			slog.Debug("received DeactivateAllPDU while waiting for DemandActivePDU; continuing to wait")
+			c.log.Debug("received DeactivateAllPDU while waiting for DemandActivePDU; continuing to wait")
 			c.transport.Once("data", c.recvDemandActivePDU)
 			return
 		}
@@ -200,38 +288,59 @@ func (c *Client) recvDemandActivePDU(s []byte) {
 			}
 			return
 		}
-		slog.Debug("ignore message during connection sequence", "type", pdu.ShareCtrlHeader.PDUType)
+		c.log.Debug("ignore message during connection sequence", core.LogPDU, pdu.ShareCtrlHeader.PDUType)
 		c.transport.Once("data", c.recvDemandActivePDU)
 		return
 	}
-	c.sharedId = pdu.Message.(*DemandActivePDU).SharedId
+	c.sharedId.Store(pdu.Message.(*DemandActivePDU).SharedId)
 	c.demandActivePDU = pdu.Message.(*DemandActivePDU)
 	for _, caps := range c.demandActivePDU.CapabilitySets {
-		slog.Debug("serverCaps", "type", caps.Type(), "value", caps)
+		c.log.Debug("serverCaps", "type", caps.Type(), "value", caps)
 		c.serverCapabilities[caps.Type()] = caps
 	}
 	if ic, ok := c.serverCapabilities[CAPSTYPE_INPUT].(*InputCapability); ok {
-		c.serverFastPathInput = ic.Flags&INPUT_FLAG_FASTPATH_INPUT != 0
+		c.serverFastPathInput.Store(ic.Flags&INPUT_FLAG_FASTPATH_INPUT != 0)
+		c.inputFlags.Store(uint32(ic.Flags))
+	}
+	if bc, ok := c.serverCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability); ok {
+		c.colorDepth.Store(uint32(bc.PreferredBitsPerPixel))
+		// The server may change the desktop size on reactivation; the
+		// client adopts it (MS-RDPBCGR 1.3.1.3).
+		if bc.DesktopWidth != 0 && bc.DesktopHeight != 0 &&
+			(bc.DesktopWidth != c.clientCoreData.DesktopWidth || bc.DesktopHeight != c.clientCoreData.DesktopHeight) {
+			c.clientCoreData.DesktopWidth = bc.DesktopWidth
+			c.clientCoreData.DesktopHeight = bc.DesktopHeight
+			c.Emit("desktopResize", bc.DesktopWidth, bc.DesktopHeight)
+		}
+	}
+	if gc, ok := c.serverCapabilities[CAPSTYPE_GENERAL].(*GeneralCapability); ok {
+		if sc, ok := c.transport.(interface{ SetSecureChecksum(bool) }); ok {
+			sc.SetSecureChecksum(gc.ExtraFlags&ENC_SALTED_CHECKSUM != 0)
+		}
 	}
 
-	c.sendConfirmActivePDU()
-	c.sendClientFinalizeSynchronizePDU()
+	clientCaps := c.sendConfirmActivePDU()
+	_, serverFrameAck := c.serverCapabilities[CAPSSETTYPE_FRAME_ACKNOWLEDGE]
+	_, clientFrameAck := clientCaps[CAPSSETTYPE_FRAME_ACKNOWLEDGE]
+	c.frameAck = serverFrameAck && clientFrameAck
+	c.sendClientFinalizeSynchronizePDU(clientCaps)
 	c.transport.Once("data", c.recvServerSynchronizePDU)
 }
 
-func (c *Client) sendConfirmActivePDU() {
+// sendConfirmActivePDU sends the client capability sets and returns them.
+func (c *Client) sendConfirmActivePDU() map[CapsType]Capability {
 	pdu := NewConfirmActivePDU()
 	generalCapa := c.clientCapabilities[CAPSTYPE_GENERAL].(*GeneralCapability)
 	generalCapa.OSMajorType = OSMAJORTYPE_WINDOWS
 	generalCapa.OSMinorType = OSMINORTYPE_WINDOWS_NT
 	generalCapa.GeneralCompressionTypes = 0x0002 // PACKET_COMPR_TYPE_64K: advertise MPPC-64K support
 	generalCapa.ExtraFlags = LONG_CREDENTIALS_SUPPORTED | NO_BITMAP_COMPRESSION_HDR |
-		FASTPATH_OUTPUT_SUPPORTED | AUTORECONNECT_SUPPORTED
+		FASTPATH_OUTPUT_SUPPORTED | AUTORECONNECT_SUPPORTED | ENC_SALTED_CHECKSUM
 	generalCapa.RefreshRectSupport = 1
 	generalCapa.SuppressOutputSupport = 1
 
 	bitmapCapa := c.clientCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability)
-	bitmapCapa.PreferredBitsPerPixel = 32
+	bitmapCapa.PreferredBitsPerPixel = gcc.HighColor(c.preferredBpp.Load())
 	bitmapCapa.DesktopWidth = c.clientCoreData.DesktopWidth
 	bitmapCapa.DesktopHeight = c.clientCoreData.DesktopHeight
 	bitmapCapa.DesktopResizeFlag = 0x0001
@@ -239,15 +348,16 @@ func (c *Client) sendConfirmActivePDU() {
 	orderCapa := c.clientCapabilities[CAPSTYPE_ORDER].(*OrderCapability)
 	orderCapa.OrderFlags = NEGOTIATEORDERSUPPORT | ZEROBOUNDSDELTASSUPPORT | COLORINDEXSUPPORT | ORDERFLAGS_EXTRA_FLAGS
 	orderCapa.OrderSupportExFlags |= ORDERFLAGS_EX_ALTSEC_FRAME_MARKER_SUPPORT
-	orderCapa.OrderSupport[TS_NEG_DSTBLT_INDEX] = 1
-	orderCapa.OrderSupport[TS_NEG_PATBLT_INDEX] = 1
-	orderCapa.OrderSupport[TS_NEG_SCRBLT_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_LINETO_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_MEMBLT_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_MEM3BLT_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_POLYLINE_INDEX] = 1
+	orderCapa.OrderSupport = [32]byte{}
+	if c.drawingOrders {
+		// PATBLT also covers OpaqueRect.
+		for _, i := range []Order{TS_NEG_DSTBLT_INDEX, TS_NEG_PATBLT_INDEX, TS_NEG_SCRBLT_INDEX,
+			TS_NEG_MEMBLT_INDEX, TS_NEG_MEM3BLT_INDEX, TS_NEG_LINETO_INDEX,
+			TS_NEG_POLYLINE_INDEX, TS_NEG_GLYPH_INDEX_INDEX} {
+			orderCapa.OrderSupport[i] = 1
+		}
+	}
 	/*orderCapa.OrderSupport[TS_NEG_MULTIOPAQUERECT_INDEX] = 1
-	orderCapa.OrderSupport[TS_NEG_GLYPH_INDEX_INDEX] = 1
 	//orderCapa.OrderSupport[TS_NEG_DRAWNINEGRID_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_SAVEBITMAP_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_POLYGON_SC_INDEX] = 1
@@ -258,7 +368,7 @@ func (c *Client) sendConfirmActivePDU() {
 
 	inputCapa := c.clientCapabilities[CAPSTYPE_INPUT].(*InputCapability)
 	inputCapa.Flags = INPUT_FLAG_SCANCODES | INPUT_FLAG_MOUSEX | INPUT_FLAG_UNICODE |
-		INPUT_FLAG_FASTPATH_INPUT | INPUT_FLAG_FASTPATH_INPUT2
+		INPUT_FLAG_FASTPATH_INPUT | INPUT_FLAG_FASTPATH_INPUT2 | INPUT_FLAG_MOUSE_HWHEEL
 	inputCapa.KeyboardLayout = c.clientCoreData.KbdLayout
 	inputCapa.KeyboardType = c.clientCoreData.KeyboardType
 	inputCapa.KeyboardSubType = c.clientCoreData.KeyboardSubType
@@ -266,22 +376,58 @@ func (c *Client) sendConfirmActivePDU() {
 	inputCapa.ImeFileName = c.clientCoreData.ImeFileName
 
 	glyphCapa := c.clientCapabilities[CAPSTYPE_GLYPHCACHE].(*GlyphCapability)
-	/*glyphCapa.GlyphCache[0] = cacheEntry{254, 4}
-	glyphCapa.GlyphCache[1] = cacheEntry{254, 4}
-	glyphCapa.GlyphCache[2] = cacheEntry{254, 8}
-	glyphCapa.GlyphCache[3] = cacheEntry{254, 8}
-	glyphCapa.GlyphCache[4] = cacheEntry{254, 16}
-	glyphCapa.GlyphCache[5] = cacheEntry{254, 32}
-	glyphCapa.GlyphCache[6] = cacheEntry{254, 64}
-	glyphCapa.GlyphCache[7] = cacheEntry{254, 128}
-	glyphCapa.GlyphCache[8] = cacheEntry{254, 256}
-	glyphCapa.GlyphCache[9] = cacheEntry{64, 2048}
-	glyphCapa.FragCache = 0x01000100*/
-	glyphCapa.SupportLevel = GLYPH_SUPPORT_NONE
-
-	pdu.SharedId = c.sharedId
-	for _, v := range c.clientCapabilities {
-		slog.Debug("clientCaps", "type", v.Type(), "value", v)
+	if c.drawingOrders {
+		glyphCapa.GlyphCache[0] = cacheEntry{254, 4}
+		glyphCapa.GlyphCache[1] = cacheEntry{254, 4}
+		glyphCapa.GlyphCache[2] = cacheEntry{254, 8}
+		glyphCapa.GlyphCache[3] = cacheEntry{254, 8}
+		glyphCapa.GlyphCache[4] = cacheEntry{254, 16}
+		glyphCapa.GlyphCache[5] = cacheEntry{254, 32}
+		glyphCapa.GlyphCache[6] = cacheEntry{254, 64}
+		glyphCapa.GlyphCache[7] = cacheEntry{254, 128}
+		glyphCapa.GlyphCache[8] = cacheEntry{254, 256}
+		glyphCapa.GlyphCache[9] = cacheEntry{64, 2048}
+		glyphCapa.FragCache = 0x01000100
+		glyphCapa.SupportLevel = GLYPH_SUPPORT_FULL
+	} else {
+		*glyphCapa = GlyphCapability{SupportLevel: GLYPH_SUPPORT_NONE}
+	}
+
+	if bc, ok := c.clientCapabilities[CAPSTYPE_BITMAPCACHE_REV2].(*BitmapCache2Capability); ok && c.persistBitmaps {
+		bc.BitmapCachePersist |= PERSISTENT_KEYS_EXPECTED_FLAG
+		for _, cells := range []*uint32{&bc.BmpC0Cells, &bc.BmpC1Cells, &bc.BmpC2Cells, &bc.BmpC3Cells, &bc.BmpC4Cells} {
+			*cells |= BITMAPCACHE_CELL_PERSISTENT
+		}
+	}
+
+	caps := make(map[CapsType]Capability, len(c.clientCapabilities)+len(c.capOverrides))
+	for t, v := range c.clientCapabilities {
+		caps[t] = v
+	}
+	// Revision 2 of the bitmap cache capability is only for servers that
+	// send the Bitmap Cache Host Support capability (MS-RDPBCGR 2.2.7.1.4.2);
+	// the others get revision 1.
+	if _, ok := c.serverCapabilities[CAPSTYPE_BITMAPCACHE_HOSTSUPPORT]; !ok {
+		if _, ok := caps[CAPSTYPE_BITMAPCACHE_REV2]; ok {
+			delete(caps, CAPSTYPE_BITMAPCACHE_REV2)
+			caps[CAPSTYPE_BITMAPCACHE] = newClientBitmapCacheCapability()
+		}
+	}
+	for t, v := range c.capOverrides {
+		if v == nil {
+			delete(caps, t)
+		} else {
+			caps[t] = v
+		}
+	}
+	if c.capFilter != nil {
+		c.capFilter(caps)
+	}
+	c.bitmapCache.setCells(bitmapCacheCells(caps))
+
+	pdu.SharedId = c.sharedId.Load()
+	for _, v := range caps {
+		c.log.Debug("clientCaps", "type", v.Type(), "value", v)
 		pdu.CapabilitySets = append(pdu.CapabilitySets, v)
 	}
 	pdu.NumberCapabilities = uint16(len(pdu.CapabilitySets))
@@ -290,33 +436,229 @@ func (c *Client) sendConfirmActivePDU() {
 	pdu.LengthCombinedCapabilities = c.demandActivePDU.LengthCombinedCapabilities
 
 	c.sendPDU(pdu)
+	return caps
+}
+
+// CapabilityFilter adjusts the client capability sets just before they are
+// sent in a Confirm Active PDU.  It may modify, add or delete entries; the
+// values are those of SetClientCapability or the built-in defaults, with
+// the session-dependent fields such as the desktop size already set.
+type CapabilityFilter func(caps map[CapsType]Capability)
+
+// SetClientCapability replaces the built-in client capability set of the
+// same type, e.g. an *OrderCapability listing the drawing orders the
+// server may send.  It applies to every following capability exchange.
+func (c *Client) SetClientCapability(capability Capability) {
+	if c.capOverrides == nil {
+		c.capOverrides = make(map[CapsType]Capability)
+	}
+	c.capOverrides[capability.Type()] = capability
 }
 
-func (c *Client) sendClientFinalizeSynchronizePDU() {
+// RemoveClientCapability stops advertising the capability set of type t.
+func (c *Client) RemoveClientCapability(t CapsType) {
+	if c.capOverrides == nil {
+		c.capOverrides = make(map[CapsType]Capability)
+	}
+	c.capOverrides[t] = nil
+}
+
+// ClientCapability returns the built-in client capability set of type t,
+// which may be modified in place before the capability exchange, or nil.
+// Fields set from the session, such as the desktop size, are overwritten
+// when the Confirm Active PDU is sent; use a CapabilityFilter for those.
+func (c *Client) ClientCapability(t CapsType) Capability {
+	return c.clientCapabilities[t]
+}
+
+// ServerCapability returns the capability set of type t of the last
+// Demand Active PDU, or nil if the server sent none.
+func (c *Client) ServerCapability(t CapsType) Capability {
+	return c.serverCapabilities[t]
+}
+
+// SetCapabilityFilter sets f to run before each Confirm Active PDU.
+func (c *Client) SetCapabilityFilter(f CapabilityFilter) {
+	c.capFilter = f
+}
+
+// SetMaxUnacknowledgedFrames sets how many frames the server may send
+// ahead of the Frame Acknowledge PDUs, advertised in the next Confirm
+// Active PDU.  0 disables frame acknowledgement.
+func (c *Client) SetMaxUnacknowledgedFrames(n uint32) {
+	if n == 0 {
+		delete(c.clientCapabilities, CAPSSETTYPE_FRAME_ACKNOWLEDGE)
+		return
+	}
+	c.clientCapabilities[CAPSSETTYPE_FRAME_ACKNOWLEDGE] = &FrameAcknowledgeCapability{n}
+}
+
+// SetPreferredColorDepth sets the colour depth advertised in the next
+// Confirm Active PDU, sent at connection and after each reactivation.
+func (c *Client) SetPreferredColorDepth(bpp uint16) {
+	c.preferredBpp.Store(uint32(bpp))
+}
+
+// ColorDepth returns the session colour depth announced by the server in
+// the most recent Demand Active PDU, or 0 before activation.
+func (c *Client) ColorDepth() uint16 {
+	return uint16(c.colorDepth.Load())
+}
+
+// ServerInputFlags returns the INPUT_FLAG_* of the server Input
+// Capability Set, or 0 before the Demand Active PDU.
+func (c *Client) ServerInputFlags() uint16 {
+	return uint16(c.inputFlags.Load())
+}
+
+// CompressionType returns the core.PACKET_COMPR_TYPE_* bulk compressor
+// the server compresses PDUs with, or -1 while it has sent none.
+func (c *Client) CompressionType() int {
+	return c.bulk.Type()
+}
+
+// SetBitmapCache replaces the in-memory bitmap cache with b, a persistent
+// one: its persisted bitmaps are offered to the server in the Persistent
+// Key List PDU.  Set it before connecting.
+func (c *Client) SetBitmapCache(b *BitmapCache) {
+	c.bitmapCache = b
+	c.persistBitmaps = true
+}
+
+// BitmapCache returns the cache the MemBlt and Mem3Blt orders draw from.
+func (c *Client) BitmapCache() *BitmapCache {
+	return c.bitmapCache
+}
+
+// SetDrawingOrders sets whether the next Confirm Active PDU advertises the
+// primary drawing orders and the glyph cache.  Without them the server
+// sends the screen as bitmap updates only.
+func (c *Client) SetDrawingOrders(on bool) {
+	c.drawingOrders = on
+}
+
+func (c *Client) sendClientFinalizeSynchronizePDU(caps map[CapsType]Capability) {
 	c.sendDataPDU(NewSynchronizeDataPDU(c.channelId))
 	c.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_COOPERATE})
 	c.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_REQUEST_CONTROL})
-	//c.sendDataPDU(&PersistKeyPDU{BBitMask: 0x03})
+	c.sendPersistentKeyList(caps)
 	c.sendDataPDU(&FontListDataPDU{ListFlags: 0x0003, EntrySize: 0x0032})
 }
 
+// newClientBitmapCacheCapability returns the revision 1 bitmap cache
+// capability: three caches of 16×16, 32×32 and 64×64 pixel cells at
+// 32bpp (MS-RDPBCGR 2.2.7.1.4.1).
+func newClientBitmapCacheCapability() *BitmapCacheCapability {
+	return &BitmapCacheCapability{
+		Cache0Entries:         600,
+		Cache0MaximumCellSize: 16 * 16 * 4,
+		Cache1Entries:         300,
+		Cache1MaximumCellSize: 32 * 32 * 4,
+		Cache2Entries:         262,
+		Cache2MaximumCellSize: 64 * 64 * 4,
+	}
+}
+
+// bitmapCacheCells returns the number of cells of each bitmap cache in
+// the client capabilities, revision 2 taking precedence.
+func bitmapCacheCells(caps map[CapsType]Capability) (cells [BITMAPCACHE_MAX_CELLS]uint32) {
+	if bc, ok := caps[CAPSTYPE_BITMAPCACHE_REV2].(*BitmapCache2Capability); ok {
+		for i, n := range []uint32{bc.BmpC0Cells, bc.BmpC1Cells, bc.BmpC2Cells, bc.BmpC3Cells, bc.BmpC4Cells} {
+			if i < int(bc.CachesNum) {
+				cells[i] = n &^ BITMAPCACHE_CELL_PERSISTENT
+			}
+		}
+	} else if bc, ok := caps[CAPSTYPE_BITMAPCACHE].(*BitmapCacheCapability); ok {
+		cells[0] = uint32(bc.Cache0Entries)
+		cells[1] = uint32(bc.Cache1Entries)
+		cells[2] = uint32(bc.Cache2Entries)
+	}
+	return cells
+}
+
+// sendPersistentKeyList sends the keys of the persisted bitmaps, preloaded
+// into the cache cells, when both sides support persistent caching.  It is
+// part of the first connection finalization only (MS-RDPBCGR 1.3.1.1).
+func (c *Client) sendPersistentKeyList(caps map[CapsType]Capability) {
+	if !c.persistBitmaps || c.persistKeyList {
+		return
+	}
+	c.persistKeyList = true
+	bc, ok := caps[CAPSTYPE_BITMAPCACHE_REV2].(*BitmapCache2Capability)
+	if !ok || bc.BitmapCachePersist&PERSISTENT_KEYS_EXPECTED_FLAG == 0 {
+		return
+	}
+	if _, ok := c.serverCapabilities[CAPSTYPE_BITMAPCACHE_HOSTSUPPORT]; !ok {
+		return
+	}
+	var cells [BITMAPCACHE_MAX_CELLS]uint32
+	for i, n := range []uint32{bc.BmpC0Cells, bc.BmpC1Cells, bc.BmpC2Cells, bc.BmpC3Cells, bc.BmpC4Cells} {
+		if i < int(bc.CachesNum) && n&BITMAPCACHE_CELL_PERSISTENT != 0 {
+			cells[i] = n &^ BITMAPCACHE_CELL_PERSISTENT
+		}
+	}
+	for _, p := range persistentKeyListPDUs(c.bitmapCache.preload(cells)) {
+		c.sendDataPDU(p)
+	}
+}
+
+// cacheOrders stores the bitmaps of the Cache Bitmap orders in the cache.
+func (c *Client) cacheOrders(orders []OrderPdu) {
+	for _, o := range orders {
+		if o.Secondary == nil {
+			continue
+		}
+		switch cb := o.Secondary.Order.(type) {
+		case *CacheBitmapOrder:
+			c.bitmapCache.Put(int(cb.cacheId), cb.cacheIndex, &CachedBitmap{
+				Width:      uint16(cb.bitmapWidth),
+				Height:     uint16(cb.bitmapHeight),
+				Bpp:        uint16(cb.bitmapBpp),
+				Compressed: cb.compressed,
+				Data:       cb.bitmapDataStream,
+			})
+		case *CacheBitmapV2Order:
+			if cb.cacheIndex == BITMAPCACHE_WAITING_LIST_INDEX {
+				continue
+			}
+			bm := &CachedBitmap{
+				Width:      cb.bitmapWidth,
+				Height:     cb.bitmapHeight,
+				Bpp:        uint16(cb.bitmapBpp),
+				Compressed: cb.compressed,
+				Data:       cb.bitmapDataStream,
+			}
+			if cb.flags&CBR2_PERSISTENT_KEY_PRESENT != 0 {
+				bm.Key = uint64(cb.key1) | uint64(cb.key2)<<32
+			}
+			c.bitmapCache.Put(int(cb.cacheId), cb.cacheIndex, bm)
+		}
+	}
+}
+
 func (c *Client) recvServerSynchronizePDU(s []byte) {
 	r := readerPool.Get().(*bytes.Reader)
 	r.Reset(s)
 	defer readerPool.Put(r)
-	pdu, err := readPDU(r, c.mppc)
+	pdu, err := c.readPDU(r)
 	if err != nil {
-		slog.Error("recvServerSynchronizePDU", "err", err)
+		if c.protocolError("Synchronize", s, err) {
+			c.transport.Once("data", c.recvServerSynchronizePDU)
+		}
+		return
+	}
+	if c.recvSessionPDU(pdu) {
+		c.transport.Once("data", c.recvServerSynchronizePDU)
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
 	if !ok || dataPdu.Header.PDUType2 != PDUTYPE2_SYNCHRONIZE {
 		if ok {
-			slog.Error("recvServerSynchronizePDU ignore datapdu", "type2", dataPdu.Header.PDUType2)
+			c.log.Error("recvServerSynchronizePDU ignore datapdu", core.LogPDU, dataPdu.Header.PDUType2)
 		} else {
-			slog.Error("recvServerSynchronizePDU ignore message", "type", pdu.ShareCtrlHeader.PDUType)
+			c.log.Error("recvServerSynchronizePDU ignore message", core.LogPDU, pdu.ShareCtrlHeader.PDUType)
 		}
-		slog.Debug("recvServerSynchronizePDU dataPdu", "pdu", &dataPdu)
+		c.log.Debug("recvServerSynchronizePDU dataPdu", "data", &dataPdu)
 		c.transport.Once("data", c.recvServerSynchronizePDU)
 		return
 	}
@@ -327,23 +669,29 @@ func (c *Client) recvServerControlCooperatePDU(s []byte) {
 	r := readerPool.Get().(*bytes.Reader)
 	r.Reset(s)
 	defer readerPool.Put(r)
-	pdu, err := readPDU(r, c.mppc)
+	pdu, err := c.readPDU(r)
 	if err != nil {
-		slog.Error("recvServerControlCooperatePDU", "err", err)
+		if c.protocolError("Control Cooperate", s, err) {
+			c.transport.Once("data", c.recvServerControlCooperatePDU)
+		}
+		return
+	}
+	if c.recvSessionPDU(pdu) {
+		c.transport.Once("data", c.recvServerControlCooperatePDU)
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
 	if !ok || dataPdu.Header.PDUType2 != PDUTYPE2_CONTROL {
 		if ok {
-			slog.Error("recvServerControlCooperatePDU ignore datapdu", "type2", dataPdu.Header.PDUType2)
+			c.log.Error("recvServerControlCooperatePDU ignore datapdu", core.LogPDU, dataPdu.Header.PDUType2)
 		} else {
-			slog.Error("recvServerControlCooperatePDU ignore message", "type", pdu.ShareCtrlHeader.PDUType)
+			c.log.Error("recvServerControlCooperatePDU ignore message", core.LogPDU, pdu.ShareCtrlHeader.PDUType)
 		}
 		c.transport.Once("data", c.recvServerControlCooperatePDU)
 		return
 	}
 	if dataPdu.Data.(*ControlDataPDU).Action != CTRLACTION_COOPERATE {
-		slog.Error("recvServerControlCooperatePDU ignore", "action", dataPdu.Data.(*ControlDataPDU).Action)
+		c.log.Error("recvServerControlCooperatePDU ignore", "action", dataPdu.Data.(*ControlDataPDU).Action)
 		c.transport.Once("data", c.recvServerControlCooperatePDU)
 		return
 	}
@@ -354,23 +702,29 @@ func (c *Client) recvServerControlGrantedPDU(s []byte) {
 	r := readerPool.Get().(*bytes.Reader)
 	r.Reset(s)
 	defer readerPool.Put(r)
-	pdu, err := readPDU(r, c.mppc)
+	pdu, err := c.readPDU(r)
 	if err != nil {
-		slog.Error("recvServerControlGrantedPDU", "err", err)
+		if c.protocolError("Control Granted", s, err) {
+			c.transport.Once("data", c.recvServerControlGrantedPDU)
+		}
+		return
+	}
+	if c.recvSessionPDU(pdu) {
+		c.transport.Once("data", c.recvServerControlGrantedPDU)
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
 	if !ok || dataPdu.Header.PDUType2 != PDUTYPE2_CONTROL {
 		if ok {
-			slog.Error("recvServerControlGrantedPDU ignore datapdu", "type2", dataPdu.Header.PDUType2)
+			c.log.Error("recvServerControlGrantedPDU ignore datapdu", core.LogPDU, dataPdu.Header.PDUType2)
 		} else {
-			slog.Error("recvServerControlGrantedPDU ignore message", "type", pdu.ShareCtrlHeader.PDUType)
+			c.log.Error("recvServerControlGrantedPDU ignore message", core.LogPDU, pdu.ShareCtrlHeader.PDUType)
 		}
 		c.transport.Once("data", c.recvServerControlGrantedPDU)
 		return
 	}
 	if dataPdu.Data.(*ControlDataPDU).Action != CTRLACTION_GRANTED_CONTROL {
-		slog.Error("recvServerControlGrantedPDU ignore", "action", dataPdu.Data.(*ControlDataPDU).Action)
+		c.log.Error("recvServerControlGrantedPDU ignore", "action", dataPdu.Data.(*ControlDataPDU).Action)
 		c.transport.Once("data", c.recvServerControlGrantedPDU)
 		return
 	}
@@ -381,47 +735,165 @@ func (c *Client) recvServerFontMapPDU(s []byte) {
 	r := readerPool.Get().(*bytes.Reader)
 	r.Reset(s)
 	defer readerPool.Put(r)
-	pdu, err := readPDU(r, c.mppc)
+	pdu, err := c.readPDU(r)
 	if err != nil {
-		slog.Error("recvServerFontMapPDU", "err", err)
+		if c.protocolError("Font Map", s, err) {
+			c.transport.Once("data", c.recvServerFontMapPDU)
+		}
+		return
+	}
+	if c.recvSessionPDU(pdu) {
+		c.transport.Once("data", c.recvServerFontMapPDU)
 		return
 	}
 	dataPdu, ok := pdu.Message.(*DataPDU)
 	if !ok || dataPdu.Header.PDUType2 != PDUTYPE2_FONTMAP {
 		if ok {
-			slog.Error("recvServerFontMapPDU ignore datapdu", "type2", dataPdu.Header.PDUType2)
+			c.log.Error("recvServerFontMapPDU ignore datapdu", core.LogPDU, dataPdu.Header.PDUType2)
 		} else {
-			slog.Error("recvServerFontMapPDU ignore message", "type", pdu.ShareCtrlHeader.PDUType)
+			c.log.Error("recvServerFontMapPDU ignore message", core.LogPDU, pdu.ShareCtrlHeader.PDUType)
 		}
+		c.transport.Once("data", c.recvServerFontMapPDU)
 		return
 	}
-	c.transport.On("data", c.recvPDU)
+	c.active = true
 
 	// Tell the server we're ready to receive display updates (MS-RDPBCGR 2.2.11.3.1)
-	slog.Debug("Sending SuppressOutput (ALLOW_DISPLAY_UPDATES)")
+	c.log.Debug("Sending SuppressOutput (ALLOW_DISPLAY_UPDATES)")
 	c.sendDataPDU(&SuppressOutputPDU{
 		AllowDisplayUpdates: 1,
 		Right:               c.clientCoreData.DesktopWidth - 1,
 		Bottom:              c.clientCoreData.DesktopHeight - 1,
 	})
 
-	c.Emit("ready")
+	c.ready.Emit(struct{}{})
+}
+
+// recvSessionPDU handles the data PDUs a server may send at any point of
+// the session, including the connection sequence, and reports whether p
+// was one of them.
+func (c *Client) recvSessionPDU(p *PDU) bool {
+	return c.recvErrorInfo(p) || c.recvSaveSessionInfo(p) || c.recvMonitorLayout(p) ||
+		c.recvKeyboardIndicators(p)
+}
+
+// recvKeyboardIndicators reports whether p is a Set Keyboard Indicators
+// PDU, emitted as "keyboardIndicators" with the TS_SYNC_* LED flags.
+func (c *Client) recvKeyboardIndicators(p *PDU) bool {
+	d, ok := p.Message.(*DataPDU)
+	if !ok || d.Header.PDUType2 != PDUTYPE2_SET_KEYBOARD_INDICATORS {
+		return false
+	}
+	leds := d.Data.(*SetKeyboardIndicatorsDataPDU).LedFlags
+	c.log.Debug("keyboard indicators", "leds", leds)
+	c.Emit("keyboardIndicators", leds)
+	return true
+}
+
+// recvMonitorLayout reports whether p is a Monitor Layout PDU, emitted as
+// "monitorLayout" with the monitors.
+func (c *Client) recvMonitorLayout(p *PDU) bool {
+	d, ok := p.Message.(*DataPDU)
+	if !ok || d.Header.PDUType2 != PDUTYPE2_MONITOR_LAYOUT_PDU {
+		return false
+	}
+	monitors := d.Data.(*MonitorLayoutPDU).Monitors
+	c.log.Debug("monitor layout", "monitors", monitors)
+	c.Emit("monitorLayout", monitors)
+	return true
+}
+
+// recvErrorInfo reports whether p is a Set Error Info PDU.  The code is
+// emitted as "errorInfo" and, unless it is zero or only reports connection
+// broker progress, as "error"; the server disconnects right after.
+func (c *Client) recvErrorInfo(p *PDU) bool {
+	d, ok := p.Message.(*DataPDU)
+	if !ok || d.Header.PDUType2 != PDUTYPE2_SET_ERROR_INFO_PDU {
+		return false
+	}
+	code := d.Data.(*ErrorInfoDataPDU).ErrorInfo
+	if code == ERRINFO_NONE {
+		return true
+	}
+	e := &ServerError{Code: code}
+	c.log.Info("server error info", "code", code, "name", e.Name())
+	c.Emit("errorInfo", e)
+	if !e.Informational() {
+		c.Emit("error", e)
+	}
+	return true
+}
+
+// recvSaveSessionInfo reports whether p is a Save Session Info PDU.  A
+// logon is emitted as "logon" with the session ID, user name and domain,
+// a logon error as "logonError" with its type and data, and an
+// auto-reconnect cookie as "autoReconnectCookie" with the session ID and
+// random bits.
+func (c *Client) recvSaveSessionInfo(p *PDU) bool {
+	d, ok := p.Message.(*DataPDU)
+	if !ok || d.Header.PDUType2 != PDUTYPE2_SAVE_SESSION_INFO {
+		return false
+	}
+	info := d.Data.(*SaveSessionInfo)
+	switch info.InfoType {
+	case INFOTYPE_LOGON, INFOTYPE_LOGON_LONG, INFOTYPE_LOGON_PLAINNOTIFY:
+		c.log.Debug("logon", "sessionId", info.LogonId, "userName", core.Secret(info.UserName), "domain", core.Secret(info.Domain))
+		c.Emit("logon", info.LogonId, info.UserName, info.Domain)
+	case INFOTYPE_LOGON_EXTENDED_INFO:
+		if info.FieldsPresent&LOGON_EX_AUTORECONNECTCOOKIE != 0 {
+			c.Emit("autoReconnectCookie", info.LogonId, info.Random)
+		}
+		if info.FieldsPresent&LOGON_EX_LOGONERRORS != 0 {
+			c.log.Debug("logon error", "type", info.ErrorNotificationType, "data", info.ErrorNotificationData)
+			c.Emit("logonError", info.ErrorNotificationType, info.ErrorNotificationData)
+		}
+	}
+	return true
+}
+
+// protocolError reports the PDU s that could not be parsed.  During the
+// connection sequence, which cannot go on without it, it is emitted as
+// "error" and ends the connection; in an active session only the update
+// is lost, and it goes to "decodeError" so the screen gets repainted.  A
+// PDU of a type the client does not parse is only logged; protocolError
+// returns true for it, and the connection goes on.
+func (c *Client) protocolError(name string, s []byte, err error) bool {
+	if errors.Is(err, errUnsupportedPDU) {
+		c.log.Debug("PDU not supported", core.LogPDU, name, "err", err)
+		return true
+	}
+	perr := core.NewProtocolError("pdu", name, s, err)
+	if !c.active {
+		c.log.Error("malformed PDU", core.LogPDU, name, "err", err)
+		c.Emit("error", perr)
+		c.transport.Close()
+		return false
+	}
+	c.log.Warn("malformed PDU", core.LogPDU, name, "err", err)
+	c.Emit("decodeError", perr)
+	return false
 }
 
 func (c *Client) recvPDU(s []byte) {
 	r := readerPool.Get().(*bytes.Reader)
 	r.Reset(s)
 	defer readerPool.Put(r)
-	if r.Len() > 0 {
-		p, err := readPDU(r, c.mppc)
+	if c.active && r.Len() > 0 {
+		p, err := c.readPDU(r)
 		if err != nil {
-			slog.Error("recvPDU", "err", err)
+			c.protocolError("Share Control", s, err)
+			return
+		}
+		if c.recvSessionPDU(p) {
 			return
 		}
 		if p.ShareCtrlHeader.PDUType == PDUTYPE_DEACTIVATEALLPDU {
 			// Server is reactivating the session (e.g. desktop resize).
 			// Signal callers to pause input until "ready" fires again.
-			slog.Debug("received DeactivateAllPDU during active session, waiting for reactivation")
+			c.log.Debug("received DeactivateAllPDU during active session, waiting for reactivation")
+			c.active = false
+			c.orders = newOrderState()
+			c.orders.log = c.log
 			c.Emit("deactivateAll")
 			c.transport.Once("data", c.recvDemandActivePDU)
 		} else if p.ShareCtrlHeader.PDUType == PDUTYPE_SERVER_REDIR_PKT {
@@ -434,9 +906,15 @@ func (c *Client) recvPDU(s []byte) {
 				up := d.Data.(*UpdateDataPDU)
 				p := up.Udata
 				if up.UpdateType == FASTPATH_UPDATETYPE_BITMAP {
-					c.Emit("bitmap", p.(*BitmapUpdateDataPDU).Rectangles)
+					c.bitmap.Emit(BitmapUpdate{p.(*BitmapUpdateDataPDU).Rectangles, BITMAP_UPDATE_SLOWPATH})
 				} else if up.UpdateType == FASTPATH_UPDATETYPE_ORDERS {
+					if err := p.(*FastPathOrdersPDU).decode(c.orders); err != nil {
+						c.protocolError("Orders", s, err)
+					}
+					c.cacheOrders(p.(*FastPathOrdersPDU).OrderPdus)
 					c.Emit("orders", p.(*FastPathOrdersPDU).OrderPdus)
+				} else if up.UpdateType == FASTPATH_UPDATETYPE_PALETTE {
+					c.Emit("palette", p.(*PaletteUpdateDataPDU).Entries)
 				}
 			} else if d.Header.PDUType2 == PDUTYPE2_POINTER {
 				pp := d.Data.(*PointerDataPDU)
@@ -451,6 +929,8 @@ func (c *Client) recvPDU(s []byte) {
 				if pp.MessageType == TS_PTRUPDATE_TYPE_SYSTEM {
 					c.Emit("pointer_hide")
 				}
+			} else if d.Header.PDUType2 == PDUTYPE2_SHUTDOWN_DENIED {
+				c.Emit("shutdownDenied")
 			}
 		}
 	}
@@ -482,18 +962,32 @@ func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 			return
 		}
 
-		// Read exactly `size` bytes for this update's payload.
-		payload, err := core.ReadBytes(int(size), r)
-		if err != nil {
+		// The update is parsed in place: the parsers copy what they keep.
+		if int(size) > r.Len() {
 			return
 		}
+		off := len(s) - r.Len()
+		payload := s[off : off+int(size)]
+		r.Seek(int64(size), io.SeekCurrent)
 
-		slog.Debug("RecvFastPath", "Code", FastPathUpdateType(updateCode),
+		c.log.Debug("RecvFastPath", core.LogPDU, FastPathUpdateType(updateCode),
 			"compressionFlags", compressionFlags,
 			"fragmentation", fragmentation,
 			"size", size)
 
-		// Handle fragmentation: reassemble fragments first, then decompress.
+		// Decompress if the server marked this update as compressed.  Each
+		// fragment is compressed on its own, so this precedes reassembly.
+		if compressionFlags != 0 && c.bulk != nil {
+			decompressed, err := c.bulk.Decompress(compressionFlags, payload)
+			if err != nil {
+				c.log.Warn("RecvFastPath: bulk decompression failed", "err", err)
+				c.Emit("decodeError", err)
+				continue
+			}
+			payload = decompressed
+		}
+
+		// Handle fragmentation: reassemble the decompressed fragments.
 		if fragmentation != FASTPATH_FRAGMENT_SINGLE {
 			if fragmentation == FASTPATH_FRAGMENT_FIRST {
 				c.buff.Reset()
@@ -504,42 +998,48 @@ func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 			}
 			payload = c.buff.Bytes()
 		}
-
-		// Decompress if the server marked this update as compressed.
-		if compressionFlags != 0 && c.mppc != nil {
-			decompressed, err := c.mppc.Decompress(compressionFlags, payload)
-			if err != nil {
-				slog.Warn("RecvFastPath: MPPC decompression failed", "err", err)
-				continue
-			}
-			payload = decompressed
-		}
+		c.received.add(FastPathUpdateType(updateCode).String())
 
 		// Surface Commands: parse directly (needs to know data size)
 		if updateCode == FASTPATH_UPDATETYPE_SURFCMDS {
-			result := ParseSurfaceCommands(payload)
+			result := parseSurfaceCommands(payload, c.log)
+			if result.Err != nil {
+				c.Emit("decodeError", result.Err)
+			}
 			if len(result.Rects) > 0 {
-				c.Emit("bitmap", result.Rects)
+				c.bitmap.Emit(BitmapUpdate{result.Rects, BITMAP_UPDATE_SURFACE_BITS})
 			}
+			// The "bitmap" listeners have painted the frame by now, so
+			// acknowledging it paces the server to the client.
 			for _, fid := range result.FrameIDs {
-				c.sendDataPDU(&FrameAcknowledgeDataPDU{FrameID: fid})
+				if c.frameAck {
+					c.sendDataPDU(&FrameAcknowledgeDataPDU{FrameID: fid})
+				}
 			}
 			continue
 		}
 
-		pr := bytes.NewReader(payload)
+		pr := readerPool.Get().(*bytes.Reader)
+		pr.Reset(payload)
 		p, err := readFastPathUpdatePDU(pr, updateCode)
+		readerPool.Put(pr)
 		if err != nil {
-			slog.Warn("readFastPathUpdatePDU:", "Code", FastPathUpdateType(updateCode), "err", err)
+			c.protocolError(FastPathUpdateType(updateCode).String(), payload, err)
 			continue
 		}
 
 		if updateCode == FASTPATH_UPDATETYPE_BITMAP {
-			c.Emit("bitmap", p.Data.(*FastPathBitmapUpdateDataPDU).Rectangles)
+			c.bitmap.Emit(BitmapUpdate{p.Data.(*FastPathBitmapUpdateDataPDU).Rectangles, BITMAP_UPDATE_FASTPATH})
 		} else if updateCode == FASTPATH_UPDATETYPE_COLOR {
 			c.Emit("color", p.Data.(*FastPathColorPdu))
 		} else if updateCode == FASTPATH_UPDATETYPE_ORDERS {
+			if err := p.Data.(*FastPathOrdersPDU).decode(c.orders); err != nil {
+				c.protocolError("Orders", payload, err)
+			}
+			c.cacheOrders(p.Data.(*FastPathOrdersPDU).OrderPdus)
 			c.Emit("orders", p.Data.(*FastPathOrdersPDU).OrderPdus)
+		} else if updateCode == FASTPATH_UPDATETYPE_PALETTE {
+			c.Emit("palette", p.Data.(*PaletteUpdateDataPDU).Entries)
 		} else if updateCode == FASTPATH_UPDATETYPE_PTR_NULL {
 			c.Emit("pointer_hide")
 		} else if updateCode == FASTPATH_UPDATETYPE_PTR_POSITION {
@@ -564,7 +1064,7 @@ type fastPathEncoder interface {
 }
 
 func (c *Client) SendInputEvents(msgType uint16, events []InputEventsInterface) {
-	if c.serverFastPathInput && c.fastPathSender != nil && c.canSendFastPathInput(events) {
+	if c.serverFastPathInput.Load() && c.fastPathSender != nil && c.canSendFastPathInput(events) {
 		if c.sendFastPathInputEvents(events) {
 			return
 		}
@@ -584,8 +1084,7 @@ func (c *Client) SendInputEvents(msgType uint16, events []InputEventsInterface)
 }
 
 // canSendFastPathInput reports whether every event in the batch implements
-// the fast-path encoder.  Falls back to slow-path if any event type doesn't
-// (currently just SynchronizeEvent, which the client never sends).
+// the fast-path encoder.  Falls back to slow-path if any event type doesn't.
 func (c *Client) canSendFastPathInput(events []InputEventsInterface) bool {
 	if len(events) == 0 || len(events) > 15 {
 		return false
@@ -599,29 +1098,40 @@ func (c *Client) canSendFastPathInput(events []InputEventsInterface) bool {
 }
 
 func (c *Client) sendFastPathInputEvents(events []InputEventsInterface) bool {
-	buf := fastPathBufPool.Get().([]byte)
-	buf = buf[:0]
-	buf = append(buf, byte(len(events)))
+	buf := fastPathBufs.Get(0)
+	buf.B = append(buf.B, byte(len(events)))
 	for _, e := range events {
-		buf = e.(fastPathEncoder).FastPathEncode(buf)
+		buf.B = e.(fastPathEncoder).FastPathEncode(buf.B)
 	}
-	_, err := c.fastPathSender.SendFastPath(0, buf)
-	fastPathBufPool.Put(buf[:cap(buf)])
+	_, err := c.fastPathSender.SendFastPath(0, buf.B)
+	buf.Release()
 	if err != nil {
 		// Disable for the rest of the session so we don't keep paying the
 		// failed-attempt cost on every input event.
-		c.serverFastPathInput = false
-		slog.Warn("fast-path input disabled, falling back to slow-path", "err", err)
+		c.serverFastPathInput.Store(false)
+		c.log.Warn("fast-path input disabled, falling back to slow-path", "err", err)
 		return false
 	}
 	return true
 }
 
+// SendSynchronizeEvent sends the Synchronize Input Event, setting the
+// remote lock keys to the TS_SYNC_* toggle flags.
+func (c *Client) SendSynchronizeEvent(flags uint32) {
+	c.SendInputEvents(INPUT_EVENT_SYNC, []InputEventsInterface{&SynchronizeEvent{ToggleFlags: flags}})
+}
+
+// SendShutdownRequest asks the server to end the connection.  The server
+// answers with "shutdownDenied" to keep the session, or disconnects.
+func (c *Client) SendShutdownRequest() {
+	c.sendDataPDU(&ShutdownRequestPDU{})
+}
+
 // SendRefreshRect requests the server to redraw the given screen rectangle.
 // This causes the server to send a full refresh (including a new H.264 IDR)
 // for the specified region, which is useful after a decoder reset.
 func (c *Client) SendRefreshRect(width, height uint16) {
-	slog.Debug("PDU: SendRefreshRect", "w", width, "h", height)
+	c.log.Debug("PDU: SendRefreshRect", "w", width, "h", height)
 	c.sendDataPDU(&RefreshRectPDU{
 		NumberOfAreas: 1,
 		Right:         width - 1,
@@ -637,7 +1147,7 @@ func (c *Client) SendRefreshRect(width, height uint16) {
 // SendRefreshRect is sometimes silently ignored by Windows servers while a
 // video stream is active; this is the reliable fallback used by mstsc/FreeRDP.
 func (c *Client) SendForceRefresh(width, height uint16) {
-	slog.Debug("PDU: SendForceRefresh (suppress→allow)", "w", width, "h", height)
+	c.log.Debug("PDU: SendForceRefresh (suppress→allow)", "w", width, "h", height)
 	c.sendDataPDU(&SuppressOutputPDU{
 		AllowDisplayUpdates: 0x00, // SUPPRESS_DISPLAY_UPDATES
 	})
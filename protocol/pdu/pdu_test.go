@@ -0,0 +1,248 @@
+package pdu
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/protocol/t125/gcc"
+	"github.com/nakagami/grdp/testutil"
+)
+
+// activate plays the server side of a capability exchange and connection
+// finalization announcing a width x height desktop.
+func activate(tr *testutil.Transport, c *Client, width, height uint16) {
+	demand := &DemandActivePDU{
+		SharedId:               0x103ea,
+		LengthSourceDescriptor: 4,
+		SourceDescriptor:       []byte("RDP\x00"),
+		CapabilitySets: []Capability{&BitmapCapability{
+			PreferredBitsPerPixel: 16,
+			DesktopWidth:          width,
+			DesktopHeight:         height,
+		}},
+	}
+	tr.Emit("data", NewPDU(1002, demand).serialize())
+	for _, d := range []DataPDUData{
+		NewSynchronizeDataPDU(1007),
+		&ControlDataPDU{Action: CTRLACTION_COOPERATE},
+		&ControlDataPDU{Action: CTRLACTION_GRANTED_CONTROL},
+		&FontMapDataPDU{MapFlags: 0x0003, EntrySize: 0x0004},
+	} {
+		tr.Emit("data", NewPDU(1002, NewDataPDU(d, 0x103ea)).serialize())
+	}
+}
+
+func TestReactivation(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewClient(tr)
+	ready := 0
+	c.On("ready", func() { ready++ })
+	resizes := testutil.Capture[uint16](&c.Emitter, "desktopResize")
+	infos := testutil.Capture[*ServerError](&c.Emitter, "errorInfo")
+
+	core := gcc.NewClientCoreData(0x409, 4, 0)
+	core.DesktopWidth, core.DesktopHeight = 1024, 768
+	tr.Emit("connect", core, uint16(1007), uint16(1003))
+	activate(tr, c, 1024, 768)
+	if ready != 1 || !c.active {
+		t.Fatalf("ready %d, active %v after activation", ready, c.active)
+	}
+
+	tr.Emit("data", NewPDU(1002, &DeactiveAllPDU{ShareId: 0x103ea, LengthSourceDescriptor: 1, SourceDescriptor: []byte{0}}).serialize())
+	if c.active {
+		t.Fatal("still active after Deactivate All")
+	}
+	activate(tr, c, 1280, 720)
+	if ready != 2 || !c.active {
+		t.Fatalf("ready %d, active %v after reactivation", ready, c.active)
+	}
+	if got := resizes.All(); len(got) != 1 || got[0] != 1280 {
+		t.Errorf("desktopResize %v", got)
+	}
+	if core.DesktopWidth != 1280 || core.DesktopHeight != 720 {
+		t.Errorf("desktop %dx%d", core.DesktopWidth, core.DesktopHeight)
+	}
+
+	// a PDU after the reactivation must be handled exactly once
+	tr.Emit("data", NewPDU(1002, NewDataPDU(&ErrorInfoDataPDU{ErrorInfo: ERRINFO_IDLE_TIMEOUT}, 0x103ea)).serialize())
+	if n := len(infos.All()); n != 1 {
+		t.Errorf("errorInfo emitted %d times", n)
+	}
+}
+
+func TestTruncatedDemandActive(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewClient(tr)
+	errs := testutil.Capture[error](&c.Emitter, "error")
+	tr.Emit("connect", gcc.NewClientCoreData(0x409, 4, 0), uint16(1007), uint16(1003))
+
+	demand := NewPDU(1002, &DemandActivePDU{
+		SharedId:               0x103ea,
+		LengthSourceDescriptor: 4,
+		SourceDescriptor:       []byte("RDP\x00"),
+		CapabilitySets:         []Capability{&BitmapCapability{PreferredBitsPerPixel: 16}},
+	}).serialize()
+	tr.Emit("data", demand[:len(demand)-8])
+
+	err, _ := errs.Last()
+	var perr *core.ProtocolError
+	if !errors.As(err, &perr) || perr.Layer != "pdu" || perr.PDU != "Demand Active" {
+		t.Fatalf("error %v", err)
+	}
+	if !tr.Closed() {
+		t.Error("connection not closed")
+	}
+}
+
+func TestFrameAcknowledge(t *testing.T) {
+	// a SURFCMDS fast-path update holding the end marker of frame 7
+	update := testutil.Hex("04 08 00  04 00 01 00 07 00 00 00")
+	for _, limit := range []uint32{2, 0} {
+		tr := testutil.NewTransport()
+		c := NewClient(tr)
+		c.SetMaxUnacknowledgedFrames(limit)
+		core := gcc.NewClientCoreData(0x409, 4, 0)
+		tr.Emit("connect", core, uint16(1007), uint16(1003))
+		// as if the Demand Active carried the capability
+		c.serverCapabilities[CAPSSETTYPE_FRAME_ACKNOWLEDGE] = &FrameAcknowledgeCapability{}
+		activate(tr, c, 1024, 768)
+
+		before := len(tr.Frames())
+		c.RecvFastPath(0, update)
+		frames := tr.Frames()[before:]
+		if limit == 0 {
+			if len(frames) != 0 {
+				t.Errorf("acknowledged with frame acknowledgement off")
+			}
+			continue
+		}
+		if len(frames) != 1 {
+			t.Fatalf("%d writes", len(frames))
+		}
+		ack := frames[0].Data
+		if ack[14] != PDUTYPE2_FRAME_ACKNOWLEDGE || ack[len(ack)-4] != 7 {
+			t.Errorf("ack % x", ack)
+		}
+	}
+}
+
+func TestCapabilityOverride(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewClient(tr)
+	order := &OrderCapability{OrderFlags: NEGOTIATEORDERSUPPORT}
+	c.SetClientCapability(order)
+	c.RemoveClientCapability(CAPSTYPE_SOUND)
+	var sent map[CapsType]Capability
+	c.SetCapabilityFilter(func(caps map[CapsType]Capability) {
+		delete(caps, CAPSSETTYPE_FRAME_ACKNOWLEDGE)
+		sent = caps
+	})
+	c.serverCapabilities[CAPSSETTYPE_FRAME_ACKNOWLEDGE] = &FrameAcknowledgeCapability{}
+
+	core := gcc.NewClientCoreData(0x409, 4, 0)
+	core.DesktopWidth, core.DesktopHeight = 800, 600
+	tr.Emit("connect", core, uint16(1007), uint16(1003))
+	activate(tr, c, 800, 600)
+
+	if sent[CAPSTYPE_ORDER] != order {
+		t.Error("order capability not replaced")
+	}
+	if _, ok := sent[CAPSTYPE_SOUND]; ok {
+		t.Error("sound capability not removed")
+	}
+	if bc := sent[CAPSTYPE_BITMAP].(*BitmapCapability); bc.DesktopWidth != 800 {
+		t.Errorf("bitmap capability desktop width %d", bc.DesktopWidth)
+	}
+	if c.frameAck {
+		t.Error("frame acknowledgement enabled although the filter removed it")
+	}
+}
+
+func TestBitmapCacheRev1(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewClient(tr)
+	var sent map[CapsType]Capability
+	c.SetCapabilityFilter(func(caps map[CapsType]Capability) { sent = caps })
+
+	core := gcc.NewClientCoreData(0x409, 4, 0)
+	core.DesktopWidth, core.DesktopHeight = 800, 600
+	tr.Emit("connect", core, uint16(1007), uint16(1003))
+	// The server sends no Bitmap Cache Host Support capability.
+	activate(tr, c, 800, 600)
+
+	if _, ok := sent[CAPSTYPE_BITMAPCACHE_REV2]; ok {
+		t.Error("revision 2 bitmap cache capability sent")
+	}
+	bc, ok := sent[CAPSTYPE_BITMAPCACHE].(*BitmapCacheCapability)
+	if !ok {
+		t.Fatal("no revision 1 bitmap cache capability sent")
+	}
+
+	// A Cache Bitmap order for a 2x2 32bpp bitmap in each of the last
+	// cell of cache 1 and the cell past it.
+	var orders []byte
+	orders = append(orders, 2, 0)
+	for _, index := range []uint16{bc.Cache1Entries - 1, bc.Cache1Entries} {
+		orders = append(orders, TS_STANDARD|TS_SECONDARY, 18, 0, 0, 0, ORDER_TYPE_BITMAP_UNCOMPRESSED,
+			1, 0, 2, 2, 32, 16, 0, byte(index), byte(index>>8))
+		orders = append(orders, make([]byte, 16)...)
+	}
+	f := &FastPathOrdersPDU{}
+	if err := f.Unpack(bytes.NewReader(orders)); err != nil {
+		t.Fatal(err)
+	}
+	f.decode(newOrderState())
+	c.cacheOrders(f.OrderPdus)
+
+	bm := c.BitmapCache().Get(1, bc.Cache1Entries-1)
+	if bm == nil || bm.Width != 2 || bm.Height != 2 || bm.Bpp != 32 || len(bm.Data) != 16 {
+		t.Errorf("cached bitmap = %+v", bm)
+	}
+	if c.BitmapCache().Get(1, bc.Cache1Entries) != nil {
+		t.Error("bitmap cached past the negotiated cells")
+	}
+}
+
+func TestKeyboardIndicators(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewClient(tr)
+	leds := testutil.Capture[uint16](&c.Emitter, "keyboardIndicators")
+	tr.Emit("connect", gcc.NewClientCoreData(0x409, 4, 0), uint16(1007), uint16(1003))
+	activate(tr, c, 1024, 768)
+
+	tr.Emit("data", NewPDU(1002, NewDataPDU(&SetKeyboardIndicatorsDataPDU{LedFlags: TS_SYNC_CAPS_LOCK | TS_SYNC_NUM_LOCK}, 0x103ea)).serialize())
+	if got := leds.All(); len(got) != 1 || got[0] != TS_SYNC_CAPS_LOCK|TS_SYNC_NUM_LOCK {
+		t.Errorf("keyboardIndicators %v", got)
+	}
+
+	before := len(tr.Frames())
+	c.SendSynchronizeEvent(TS_SYNC_KANA_LOCK)
+	frames := tr.Frames()[before:]
+	if len(frames) != 1 {
+		t.Fatalf("%d writes", len(frames))
+	}
+	if ev := frames[0].Data; ev[len(ev)-4] != TS_SYNC_KANA_LOCK || ev[len(ev)-8] != INPUT_EVENT_SYNC {
+		t.Errorf("synchronize event % x", ev)
+	}
+}
+
+func TestStats(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewClient(tr)
+	tr.Emit("connect", gcc.NewClientCoreData(0x409, 4, 0), uint16(1007), uint16(1003))
+	activate(tr, c, 1024, 768)
+	c.RecvFastPath(0, testutil.Hex("04 08 00  04 00 01 00 07 00 00 00"))
+
+	s := c.Stats()
+	for name, n := range map[string]uint64{
+		"PDUTYPE_DEMANDACTIVEPDU":      1,
+		"PDUTYPE2_CONTROL":             2,
+		"FASTPATH_UPDATETYPE_SURFCMDS": 1,
+	} {
+		if s.PDUs[name] != n {
+			t.Errorf("%s counted %d times, want %d", name, s.PDUs[name], n)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package pdu
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"sync"
+)
+
+// Stats counts what the layer received.
+type Stats struct {
+	// PDUs is the number of PDUs received per type: the PDUTYPE2_* of
+	// the slow-path data PDUs, the PDUTYPE_* of the other slow-path PDUs
+	// and the FASTPATH_UPDATETYPE_* of the fast-path updates.
+	PDUs map[string]uint64
+	// Compressed and Decompressed are the sizes of the bulk compressed
+	// payloads before and after decompression.
+	Compressed, Decompressed uint64
+}
+
+// pduCounts counts the PDUs received per type.
+type pduCounts struct {
+	mu sync.Mutex
+	n  map[string]uint64
+}
+
+func (p *pduCounts) add(name string) {
+	p.mu.Lock()
+	if p.n == nil {
+		p.n = make(map[string]uint64)
+	}
+	p.n[name]++
+	p.mu.Unlock()
+}
+
+// Stats returns the counts of what the layer received so far.  It is safe
+// to call from any goroutine.
+func (c *PDULayer) Stats() Stats {
+	c.received.mu.Lock()
+	s := Stats{PDUs: maps.Clone(c.received.n)}
+	c.received.mu.Unlock()
+	if s.PDUs == nil {
+		s.PDUs = map[string]uint64{}
+	}
+	if c.bulk != nil {
+		s.Compressed, s.Decompressed = c.bulk.Totals()
+	}
+	return s
+}
+
+// readPDU reads a slow-path PDU and counts it.
+func (c *PDULayer) readPDU(r io.Reader) (*PDU, error) {
+	p, err := readPDU(r, c.bulk, c.log)
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := p.Message.(*DataPDU); ok {
+		c.received.add(PduType2(d.Header.PDUType2).String())
+	} else {
+		c.received.add(shareControlTypeName(p.ShareCtrlHeader.PDUType))
+	}
+	return p, nil
+}
+
+func shareControlTypeName(t uint16) string {
+	switch t {
+	case PDUTYPE_DEMANDACTIVEPDU:
+		return "PDUTYPE_DEMANDACTIVEPDU"
+	case PDUTYPE_CONFIRMACTIVEPDU:
+		return "PDUTYPE_CONFIRMACTIVEPDU"
+	case PDUTYPE_DEACTIVATEALLPDU:
+		return "PDUTYPE_DEACTIVATEALLPDU"
+	case PDUTYPE_SERVER_REDIR_PKT:
+		return "PDUTYPE_SERVER_REDIR_PKT"
+	}
+	return fmt.Sprintf("PDUTYPE_0x%02x", t)
+}
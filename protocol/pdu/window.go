@@ -0,0 +1,383 @@
+package pdu
+
+import (
+	"encoding/binary"
+	"errors"
+	"unicode/utf16"
+)
+
+// FieldsPresentFlags of the Windowing Alternate Secondary Drawing Orders
+// (MS-RDPERP 2.2.1.3).  The order type bits tell window, notification
+// icon and desktop orders apart; the field bits depend on the type.
+const (
+	WINDOW_ORDER_TYPE_WINDOW   = 0x01000000
+	WINDOW_ORDER_TYPE_NOTIFY   = 0x02000000
+	WINDOW_ORDER_TYPE_DESKTOP  = 0x04000000
+	WINDOW_ORDER_STATE_NEW     = 0x10000000
+	WINDOW_ORDER_STATE_DELETED = 0x20000000
+	WINDOW_ORDER_ICON          = 0x40000000
+	WINDOW_ORDER_CACHED_ICON   = 0x80000000
+
+	WINDOW_ORDER_FIELD_APPBAR_EDGE           = 0x00000001
+	WINDOW_ORDER_FIELD_OWNER                 = 0x00000002
+	WINDOW_ORDER_FIELD_TITLE                 = 0x00000004
+	WINDOW_ORDER_FIELD_STYLE                 = 0x00000008
+	WINDOW_ORDER_FIELD_SHOW                  = 0x00000010
+	WINDOW_ORDER_FIELD_APPBAR_STATE          = 0x00000040
+	WINDOW_ORDER_FIELD_RESIZE_MARGIN_X       = 0x00000080
+	WINDOW_ORDER_FIELD_WND_RECTS             = 0x00000100
+	WINDOW_ORDER_FIELD_VISIBILITY            = 0x00000200
+	WINDOW_ORDER_FIELD_WND_SIZE              = 0x00000400
+	WINDOW_ORDER_FIELD_WND_OFFSET            = 0x00000800
+	WINDOW_ORDER_FIELD_VIS_OFFSET            = 0x00001000
+	WINDOW_ORDER_FIELD_ICON_BIG              = 0x00002000
+	WINDOW_ORDER_FIELD_CLIENT_AREA_OFFSET    = 0x00004000
+	WINDOW_ORDER_FIELD_WND_CLIENT_DELTA      = 0x00008000
+	WINDOW_ORDER_FIELD_CLIENT_AREA_SIZE      = 0x00010000
+	WINDOW_ORDER_FIELD_RP_CONTENT            = 0x00020000
+	WINDOW_ORDER_FIELD_ROOT_PARENT           = 0x00040000
+	WINDOW_ORDER_FIELD_ENFORCE_SERVER_ZORDER = 0x00080000
+	WINDOW_ORDER_FIELD_ICON_OVERLAY_NULL     = 0x00200000
+	WINDOW_ORDER_FIELD_OVERLAY_DESCRIPTION   = 0x00400000
+	WINDOW_ORDER_FIELD_TASKBAR_BUTTON        = 0x00800000
+	WINDOW_ORDER_FIELD_RESIZE_MARGIN_Y       = 0x08000000
+
+	WINDOW_ORDER_FIELD_NOTIFY_TIP      = 0x00000001
+	WINDOW_ORDER_FIELD_NOTIFY_INFO_TIP = 0x00000002
+	WINDOW_ORDER_FIELD_NOTIFY_STATE    = 0x00000004
+	WINDOW_ORDER_FIELD_NOTIFY_VERSION  = 0x00000008
+
+	WINDOW_ORDER_FIELD_DESKTOP_NONE          = 0x00000001
+	WINDOW_ORDER_FIELD_DESKTOP_HOOKED        = 0x00000002
+	WINDOW_ORDER_FIELD_DESKTOP_ARC_COMPLETED = 0x00000004
+	WINDOW_ORDER_FIELD_DESKTOP_ARC_BEGAN     = 0x00000008
+	WINDOW_ORDER_FIELD_DESKTOP_ZORDER        = 0x00000010
+	WINDOW_ORDER_FIELD_DESKTOP_ACTIVE_WND    = 0x00000020
+)
+
+// WindowRect is a TS_RECTANGLE_16 of a window order, bottom-right
+// exclusive.
+type WindowRect struct {
+	Left, Top, Right, Bottom uint16
+}
+
+// IconInfo is a TS_ICON_INFO: a bottom-up device-independent bitmap of
+// Bpp bits per pixel, with a color table for 8 bpp or less, and the 1
+// bpp AND mask of its transparent pixels.  The icon is stored at
+// CacheEntry of CacheId unless CacheId is ICON_CACHE_NONE.
+type IconInfo struct {
+	CacheEntry uint16
+	CacheId    uint8
+	Bpp        uint8
+	Width      uint16
+	Height     uint16
+	ColorTable []byte
+	BitsMask   []byte
+	BitsColor  []byte
+}
+
+// CachedIcon is a TS_CACHED_ICON_INFO, which names an icon an earlier
+// order cached.
+type CachedIcon struct {
+	CacheEntry uint16
+	CacheId    uint8
+}
+
+// ICON_CACHE_NONE is the CacheId of an icon that is not to be cached.
+const ICON_CACHE_NONE = 0xFF
+
+// WindowOrder is a Window Information order: the state of a new or
+// changed server window, of which only the fields in FieldsPresent are
+// set, or its deletion.  An icon order, WINDOW_ORDER_ICON or
+// WINDOW_ORDER_CACHED_ICON, carries only the small icon of the window,
+// or its big icon with WINDOW_ORDER_FIELD_ICON_BIG.
+type WindowOrder struct {
+	FieldsPresent uint32
+	WindowId      uint32
+
+	Icon       *IconInfo
+	CachedIcon *CachedIcon
+
+	OwnerWindowId       uint32
+	Style               uint32
+	ExtendedStyle       uint32
+	ShowState           uint8
+	Title               string
+	ClientOffsetX       int32
+	ClientOffsetY       int32
+	ClientAreaWidth     uint32
+	ClientAreaHeight    uint32
+	ResizeMarginLeft    uint32
+	ResizeMarginRight   uint32
+	ResizeMarginTop     uint32
+	ResizeMarginBottom  uint32
+	RPContent           uint8
+	RootParentHandle    uint32
+	WindowOffsetX       int32
+	WindowOffsetY       int32
+	WindowClientDeltaX  int32
+	WindowClientDeltaY  int32
+	WindowWidth         uint32
+	WindowHeight        uint32
+	WindowRects         []WindowRect
+	VisibleOffsetX      int32
+	VisibleOffsetY      int32
+	VisibilityRects     []WindowRect
+	OverlayDescription  string
+	TaskbarButton       uint8
+	EnforceServerZOrder uint8
+	AppBarState         uint8
+	AppBarEdge          uint8
+}
+
+// NotifyIconInfoTip is the balloon tooltip of a notification icon.
+type NotifyIconInfoTip struct {
+	Timeout   uint32
+	InfoFlags uint32
+	Text      string
+	Title     string
+}
+
+// NotifyIconOrder is a Notification Icon Information order: the state of
+// a new or changed notification area icon, of which only the fields in
+// FieldsPresent are set, or its deletion.
+type NotifyIconOrder struct {
+	FieldsPresent uint32
+	WindowId      uint32
+	NotifyIconId  uint32
+
+	Version    uint32
+	ToolTip    string
+	InfoTip    NotifyIconInfoTip
+	State      uint32
+	Icon       *IconInfo
+	CachedIcon *CachedIcon
+}
+
+// DesktopOrder is a Desktop Information order: the active window and
+// the z-order of the windows of the server desktop.
+type DesktopOrder struct {
+	FieldsPresent  uint32
+	ActiveWindowId uint32
+	// ZOrder lists the window IDs front to back.
+	ZOrder []uint32
+}
+
+var errWindowOrder = errors.New("pdu: malformed window order")
+
+// windowReader decodes the fields of a window order; the first error
+// sticks.
+type windowReader struct {
+	b   []byte
+	err error
+}
+
+func (r *windowReader) next(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = errWindowOrder
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *windowReader) uint8() uint8   { return r.next(1)[0] }
+func (r *windowReader) uint16() uint16 { return binary.LittleEndian.Uint16(r.next(2)) }
+func (r *windowReader) uint32() uint32 { return binary.LittleEndian.Uint32(r.next(4)) }
+func (r *windowReader) int32() int32   { return int32(r.uint32()) }
+
+// string reads a UNICODE_STRING: a byte count and UTF-16 text.
+func (r *windowReader) string() string {
+	b := r.next(int(r.uint16()))
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+func (r *windowReader) iconInfo() *IconInfo {
+	i := &IconInfo{CacheEntry: r.uint16(), CacheId: r.uint8(), Bpp: r.uint8(), Width: r.uint16(), Height: r.uint16()}
+	var colorTable int
+	if i.Bpp <= 8 {
+		colorTable = int(r.uint16())
+	}
+	mask, color := int(r.uint16()), int(r.uint16())
+	i.BitsMask = r.next(mask)
+	i.ColorTable = r.next(colorTable)
+	i.BitsColor = r.next(color)
+	return i
+}
+
+func (r *windowReader) cachedIcon() *CachedIcon {
+	return &CachedIcon{CacheEntry: r.uint16(), CacheId: r.uint8()}
+}
+
+func (r *windowReader) rects() []WindowRect {
+	n := int(r.uint16())
+	if r.err != nil || 8*n > len(r.b) {
+		r.err = errWindowOrder
+		return nil
+	}
+	rects := make([]WindowRect, n)
+	for i := range rects {
+		rects[i] = WindowRect{r.uint16(), r.uint16(), r.uint16(), r.uint16()}
+	}
+	return rects
+}
+
+// readWindowOrder decodes the body of a Windowing Alternate Secondary
+// Drawing Order, following the OrderSize of its header.
+func readWindowOrder(b []byte) (any, error) {
+	r := &windowReader{b: b}
+	fields := r.uint32()
+	var o any
+	switch {
+	case fields&WINDOW_ORDER_TYPE_WINDOW != 0:
+		o = r.windowOrder(fields)
+	case fields&WINDOW_ORDER_TYPE_NOTIFY != 0:
+		o = r.notifyIconOrder(fields)
+	case fields&WINDOW_ORDER_TYPE_DESKTOP != 0:
+		o = r.desktopOrder(fields)
+	default:
+		return nil, errWindowOrder
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return o, nil
+}
+
+func (r *windowReader) windowOrder(fields uint32) *WindowOrder {
+	o := &WindowOrder{FieldsPresent: fields, WindowId: r.uint32()}
+	switch {
+	case fields&WINDOW_ORDER_ICON != 0:
+		o.Icon = r.iconInfo()
+		return o
+	case fields&WINDOW_ORDER_CACHED_ICON != 0:
+		o.CachedIcon = r.cachedIcon()
+		return o
+	case fields&WINDOW_ORDER_STATE_DELETED != 0:
+		return o
+	}
+	if fields&WINDOW_ORDER_FIELD_OWNER != 0 {
+		o.OwnerWindowId = r.uint32()
+	}
+	if fields&WINDOW_ORDER_FIELD_STYLE != 0 {
+		o.Style = r.uint32()
+		o.ExtendedStyle = r.uint32()
+	}
+	if fields&WINDOW_ORDER_FIELD_SHOW != 0 {
+		o.ShowState = r.uint8()
+	}
+	if fields&WINDOW_ORDER_FIELD_TITLE != 0 {
+		o.Title = r.string()
+	}
+	if fields&WINDOW_ORDER_FIELD_CLIENT_AREA_OFFSET != 0 {
+		o.ClientOffsetX = r.int32()
+		o.ClientOffsetY = r.int32()
+	}
+	if fields&WINDOW_ORDER_FIELD_CLIENT_AREA_SIZE != 0 {
+		o.ClientAreaWidth = r.uint32()
+		o.ClientAreaHeight = r.uint32()
+	}
+	if fields&WINDOW_ORDER_FIELD_RESIZE_MARGIN_X != 0 {
+		o.ResizeMarginLeft = r.uint32()
+		o.ResizeMarginRight = r.uint32()
+	}
+	if fields&WINDOW_ORDER_FIELD_RESIZE_MARGIN_Y != 0 {
+		o.ResizeMarginTop = r.uint32()
+		o.ResizeMarginBottom = r.uint32()
+	}
+	if fields&WINDOW_ORDER_FIELD_RP_CONTENT != 0 {
+		o.RPContent = r.uint8()
+	}
+	if fields&WINDOW_ORDER_FIELD_ROOT_PARENT != 0 {
+		o.RootParentHandle = r.uint32()
+	}
+	if fields&WINDOW_ORDER_FIELD_WND_OFFSET != 0 {
+		o.WindowOffsetX = r.int32()
+		o.WindowOffsetY = r.int32()
+	}
+	if fields&WINDOW_ORDER_FIELD_WND_CLIENT_DELTA != 0 {
+		o.WindowClientDeltaX = r.int32()
+		o.WindowClientDeltaY = r.int32()
+	}
+	if fields&WINDOW_ORDER_FIELD_WND_SIZE != 0 {
+		o.WindowWidth = r.uint32()
+		o.WindowHeight = r.uint32()
+	}
+	if fields&WINDOW_ORDER_FIELD_WND_RECTS != 0 {
+		o.WindowRects = r.rects()
+	}
+	if fields&WINDOW_ORDER_FIELD_VIS_OFFSET != 0 {
+		o.VisibleOffsetX = r.int32()
+		o.VisibleOffsetY = r.int32()
+	}
+	if fields&WINDOW_ORDER_FIELD_VISIBILITY != 0 {
+		o.VisibilityRects = r.rects()
+	}
+	if fields&WINDOW_ORDER_FIELD_OVERLAY_DESCRIPTION != 0 {
+		o.OverlayDescription = r.string()
+	}
+	if fields&WINDOW_ORDER_FIELD_TASKBAR_BUTTON != 0 {
+		o.TaskbarButton = r.uint8()
+	}
+	if fields&WINDOW_ORDER_FIELD_ENFORCE_SERVER_ZORDER != 0 {
+		o.EnforceServerZOrder = r.uint8()
+	}
+	if fields&WINDOW_ORDER_FIELD_APPBAR_STATE != 0 {
+		o.AppBarState = r.uint8()
+	}
+	if fields&WINDOW_ORDER_FIELD_APPBAR_EDGE != 0 {
+		o.AppBarEdge = r.uint8()
+	}
+	return o
+}
+
+func (r *windowReader) notifyIconOrder(fields uint32) *NotifyIconOrder {
+	o := &NotifyIconOrder{FieldsPresent: fields, WindowId: r.uint32(), NotifyIconId: r.uint32()}
+	if fields&WINDOW_ORDER_STATE_DELETED != 0 {
+		return o
+	}
+	if fields&WINDOW_ORDER_FIELD_NOTIFY_VERSION != 0 {
+		o.Version = r.uint32()
+	}
+	if fields&WINDOW_ORDER_FIELD_NOTIFY_TIP != 0 {
+		o.ToolTip = r.string()
+	}
+	if fields&WINDOW_ORDER_FIELD_NOTIFY_INFO_TIP != 0 {
+		o.InfoTip.Timeout = r.uint32()
+		o.InfoTip.InfoFlags = r.uint32()
+		o.InfoTip.Text = r.string()
+		o.InfoTip.Title = r.string()
+	}
+	if fields&WINDOW_ORDER_FIELD_NOTIFY_STATE != 0 {
+		o.State = r.uint32()
+	}
+	if fields&WINDOW_ORDER_ICON != 0 {
+		o.Icon = r.iconInfo()
+	}
+	if fields&WINDOW_ORDER_CACHED_ICON != 0 {
+		o.CachedIcon = r.cachedIcon()
+	}
+	return o
+}
+
+func (r *windowReader) desktopOrder(fields uint32) *DesktopOrder {
+	o := &DesktopOrder{FieldsPresent: fields}
+	if fields&WINDOW_ORDER_FIELD_DESKTOP_NONE != 0 {
+		return o
+	}
+	if fields&WINDOW_ORDER_FIELD_DESKTOP_ACTIVE_WND != 0 {
+		o.ActiveWindowId = r.uint32()
+	}
+	if fields&WINDOW_ORDER_FIELD_DESKTOP_ZORDER != 0 {
+		o.ZOrder = make([]uint32, r.uint8())
+		for i := range o.ZOrder {
+			o.ZOrder[i] = r.uint32()
+		}
+	}
+	return o
+}
@@ -0,0 +1,142 @@
+package sec
+
+import (
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+/**
+ * FIPS security header (TS_SECURITY_HEADER2) and fast-path fipsInformation
+ * @see https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/f9004ec8-1226-4fc2-8f2f-650f092e6ed7
+ */
+const (
+	TSFIPS_HEADER_LENGTH uint16 = 0x0010
+	TSFIPS_VERSION1             = 0x01
+)
+
+// fipsIV is the Triple DES initialisation vector of MS-RDPBCGR 5.3.6.2.
+var fipsIV = []byte{0x12, 0x34, 0x56, 0x78, 0x90, 0xab, 0xcd, 0xef}
+
+// fipsCipher is the FIPS 140-1 (ENCRYPTION_METHOD_FIPS) session state:
+// Triple DES in CBC mode, chained across PDUs in each direction, and an
+// HMAC-SHA1 signature over the plaintext and the PDU count.
+type fipsCipher struct {
+	encrypter cipher.BlockMode
+	decrypter cipher.BlockMode
+	signKey   []byte
+
+	nbEncryptedPacket uint32
+	nbDecryptedPacket uint32
+}
+
+/*
+@summary: derive the client FIPS keys
+@see: https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/3a8a1ec8-1e5c-442e-8c8a-5f9f0d38e6ea
+*/
+func newFIPSCipher(clientRandom, serverRandom []byte) (*fipsCipher, error) {
+	encryptKeyT := fipsHash(clientRandom[16:32], serverRandom[16:32])
+	decryptKeyT := fipsHash(clientRandom[:16], serverRandom[:16])
+
+	encryptBlock, err := des.NewTripleDESCipher(fipsExpandKey(encryptKeyT))
+	if err != nil {
+		return nil, err
+	}
+	decryptBlock, err := des.NewTripleDESCipher(fipsExpandKey(decryptKeyT))
+	if err != nil {
+		return nil, err
+	}
+	return &fipsCipher{
+		encrypter: cipher.NewCBCEncrypter(encryptBlock, fipsIV),
+		decrypter: cipher.NewCBCDecrypter(decryptBlock, fipsIV),
+		signKey:   fipsHash(decryptKeyT, encryptKeyT),
+	}, nil
+}
+
+func fipsHash(a, b []byte) []byte {
+	h := sha1.New()
+	h.Write(a)
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// fipsExpandKey extends a 160-bit SHA-1 digest to 168 bits with its first
+// byte and spreads it over 24 bytes, seven key bits and an odd parity bit
+// each, as the Windows implementation does.
+func fipsExpandKey(digest []byte) []byte {
+	var buf [21]byte
+	for i := range 20 {
+		buf[i] = bits.Reverse8(digest[i])
+	}
+	buf[20] = bits.Reverse8(digest[0])
+
+	key := make([]byte, 24)
+	for i := range key {
+		p, r := i*7/8, i*7%8
+		c := buf[p] << r
+		if r > 1 {
+			c |= buf[p+1] >> (8 - r)
+		}
+		key[i] = oddParity(bits.Reverse8(c & 0xfe))
+	}
+	return key
+}
+
+// oddParity sets the least significant bit of b so it has odd parity.
+func oddParity(b byte) byte {
+	b &^= 1
+	if bits.OnesCount8(b)%2 == 0 {
+		b |= 1
+	}
+	return b
+}
+
+// sign returns the 8-byte HMAC-SHA1 data signature of MS-RDPBCGR 5.3.6.2.1.
+func (f *fipsCipher) sign(data []byte, count uint32) []byte {
+	var countBuf [4]byte
+	binary.LittleEndian.PutUint32(countBuf[:], count)
+	h := hmac.New(sha1.New, f.signKey)
+	h.Write(data)
+	h.Write(countBuf[:])
+	return h.Sum(nil)[:8]
+}
+
+// encrypt returns the FIPS header fields following the basic security
+// header (length, version, padlen and signature), then the ciphertext.
+func (f *fipsCipher) encrypt(data []byte) []byte {
+	pad := (des.BlockSize - len(data)%des.BlockSize) % des.BlockSize
+	result := make([]byte, 12+len(data)+pad)
+	binary.LittleEndian.PutUint16(result[0:], TSFIPS_HEADER_LENGTH)
+	result[2] = TSFIPS_VERSION1
+	result[3] = byte(pad)
+	copy(result[4:12], f.sign(data, f.nbEncryptedPacket))
+	copy(result[12:], data)
+	f.encrypter.CryptBlocks(result[12:], result[12:])
+	f.nbEncryptedPacket++
+	return result
+}
+
+// decrypt is the reverse of encrypt; it checks the signature.
+func (f *fipsCipher) decrypt(data []byte) ([]byte, error) {
+	if len(data) < 12 {
+		return nil, errors.New("fips: short security header")
+	}
+	pad := int(data[3])
+	payload := data[12:]
+	if len(payload)%des.BlockSize != 0 || pad >= des.BlockSize || pad > len(payload) {
+		return nil, fmt.Errorf("fips: bad payload length %d with padding %d", len(payload), pad)
+	}
+	plaintext := make([]byte, len(payload))
+	f.decrypter.CryptBlocks(plaintext, payload)
+	plaintext = plaintext[:len(plaintext)-pad]
+	if !hmac.Equal(f.sign(plaintext, f.nbDecryptedPacket), data[4:12]) {
+		return nil, fmt.Errorf("fips: %w", ErrMACMismatch)
+	}
+	f.nbDecryptedPacket++
+	return plaintext, nil
+}
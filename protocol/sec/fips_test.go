@@ -0,0 +1,64 @@
+package sec
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"math/bits"
+	"testing"
+)
+
+func TestFIPSExpandKey(t *testing.T) {
+	key := fipsExpandKey(bytes.Repeat([]byte{0xa5}, 20))
+	if len(key) != 24 {
+		t.Fatalf("got %d bytes", len(key))
+	}
+	for i, b := range key {
+		if bits.OnesCount8(b)%2 != 1 {
+			t.Errorf("byte %d = %#02x has even parity", i, b)
+		}
+	}
+}
+
+func TestFIPSRoundTrip(t *testing.T) {
+	clientRandom := bytes.Repeat([]byte{1, 2, 3, 4}, 8)
+	serverRandom := bytes.Repeat([]byte{5, 6, 7, 8}, 8)
+	client, err := newFIPSCipher(clientRandom, serverRandom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server decrypts with the client encryption key and vice versa
+	decryptBlock, _ := des.NewTripleDESCipher(fipsExpandKey(fipsHash(clientRandom[16:], serverRandom[16:])))
+	encryptBlock, _ := des.NewTripleDESCipher(fipsExpandKey(fipsHash(clientRandom[:16], serverRandom[:16])))
+	server := &fipsCipher{
+		encrypter: cipher.NewCBCEncrypter(encryptBlock, fipsIV),
+		decrypter: cipher.NewCBCDecrypter(decryptBlock, fipsIV),
+		signKey:   client.signKey,
+	}
+
+	for _, msg := range []string{"hello", "exactly8", "a longer message of several blocks"} {
+		pdu := client.encrypt([]byte(msg))
+		if len(pdu[12:])%8 != 0 || int(pdu[3]) != len(pdu)-12-len(msg) {
+			t.Fatalf("%q: bad padding in % x", msg, pdu[:12])
+		}
+		got, err := server.decrypt(pdu)
+		if err != nil {
+			t.Fatalf("%q: %v", msg, err)
+		}
+		if string(got) != msg {
+			t.Errorf("got %q, want %q", got, msg)
+		}
+
+		got, err = client.decrypt(server.encrypt([]byte(msg)))
+		if err != nil || string(got) != msg {
+			t.Errorf("server to client: got %q, %v", got, err)
+		}
+	}
+
+	pdu := client.encrypt([]byte("tampered"))
+	pdu[4] ^= 1
+	if _, err := server.decrypt(pdu); err == nil {
+		t.Error("bad signature accepted")
+	}
+}
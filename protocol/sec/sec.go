@@ -2,6 +2,7 @@ package sec
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rc4"
@@ -13,6 +14,9 @@ import (
 	"github.com/lunixbochs/struc"
 	"io"
 	"log/slog"
+	"strings"
+	"sync"
+	"time"
 	"unicode/utf16"
 
 	"github.com/nakagami/grdp/core"
@@ -38,6 +42,10 @@ func init() {
 	}
 }
 
+// ErrMACMismatch is emitted when the signature of a decrypted PDU does not
+// match its contents.
+var ErrMACMismatch = errors.New("sec: MAC signature mismatch")
+
 /**
  * SecurityFlag
  * @see http://msdn.microsoft.com/en-us/library/cc240579.aspx
@@ -122,6 +130,10 @@ func NewClientAutoReconnect(id uint32, random []byte) *ClientAutoReconnect {
 	}
 }
 
+// maxClientAddress is the number of UTF-16 characters clientAddress holds
+// before its null terminator.
+const maxClientAddress = 39
+
 type RDPExtendedInfo struct {
 	ClientAddressFamily uint16 `struc:"little"`
 	CbClientAddress     uint16 `struc:"little,sizeof=ClientAddress"`
@@ -265,32 +277,30 @@ type SEC struct {
 	decryptRc4 *rc4.Cipher
 	encryptRc4 *rc4.Cipher
 
+	// writeMu serializes the encrypted writes: the RC4 stream and the
+	// packet count must follow the order the PDUs go out in.
+	writeMu sync.Mutex
+
 	macKey []byte
 
+	// fips replaces the RC4 state when the server selected
+	// ENCRYPTION_METHOD_FIPS.
+	fips *fipsCipher
+
 	// fastPathSender is the underlying transport (typically TPKT) that knows
 	// how to wrap a payload in a fast-path frame.  Set via SetFastPathSender
 	// to enable Fast-Path Client Input PDUs (MS-RDPBCGR §2.2.8.1.2).
 	fastPathSender core.FastPathSender
+
+	log *slog.Logger
 }
 
 func NewSEC(t core.Transport) *SEC {
 	sec := &SEC{
-		*emission.NewEmitter(),
-		t,
-		NewRDPInfo(),
-		"",
-		nil,
-		nil,
-		false,
-		false,
-		0,
-		0,
-		nil,
-		nil,
-		nil,
-		nil,
-		nil,
-		nil,
+		Emitter:   *emission.NewEmitter(),
+		transport: t,
+		info:      NewRDPInfo(),
+		log:       core.Logger(nil, "sec"),
 	}
 
 	t.On("close", func() {
@@ -301,6 +311,11 @@ func NewSEC(t core.Transport) *SEC {
 	return sec
 }
 
+// SetLogger makes the layer log to l, with the attribute layer=sec.
+func (s *SEC) SetLogger(l *slog.Logger) {
+	s.log = core.Logger(l, "sec")
+}
+
 func (s *SEC) Read(data []byte) (n int, err error) {
 	return s.transport.Read(data)
 }
@@ -309,6 +324,8 @@ func (s *SEC) Write(b []byte) (n int, err error) {
 	if !s.enableEncryption {
 		return s.transport.Write(b)
 	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
 	data := s.encrytData(b)
 	return s.transport.Write(data)
 }
@@ -337,6 +354,15 @@ func (s *SEC) SendFastPath(secFlag byte, b []byte) (int, error) {
 	return s.fastPathSender.SendFastPath(secFlag, b)
 }
 
+// SetSecureChecksum makes encrypted PDUs sent from now on carry a salted
+// MAC (SECURE_CHECKSUM).  Both peers must advertise ENC_SALTED_CHECKSUM in
+// the General Capability Set.
+func (s *SEC) SetSecureChecksum(enabled bool) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.enableSecureCheckSum = enabled
+}
+
 // LegacyEncryptionEnabled reports whether the per-PDU RDP encryption layer
 // (not TLS/CredSSP) is in use.  Callers use this to disable optimisations
 // like fast-path input that this layer does not yet implement signing for.
@@ -345,7 +371,9 @@ func (s *SEC) LegacyEncryptionEnabled() bool {
 }
 
 func (s *SEC) sendFlagged(flag uint16, data []byte) (n int, err error) {
-	slog.Debug("sendFlagged", "flag", flag, "data", core.Hex(data))
+	s.log.Debug("sendFlagged", "flag", flag, "data", core.Hex(data))
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
 	b := s.encryt(flag, data)
 	return s.transport.Write(b)
 }
@@ -357,6 +385,20 @@ func (s *SEC) sendFlagged(flag uint16, data []byte) (n int, err error) {
 @return: {str} signature
 */
 func macData(macSaltKey, data []byte) []byte {
+	return mac(macSaltKey, data, nil)
+}
+
+/*
+@summary: salted MAC, mixing in the count of PDUs encrypted before this one
+@see: https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/37f849e6-3b43-4ce4-9445-1b1b7e1e8a2b
+*/
+func saltedMacData(macSaltKey, data []byte, count int) []byte {
+	var countBuf [4]byte
+	binary.LittleEndian.PutUint32(countBuf[:], uint32(count))
+	return mac(macSaltKey, data, countBuf[:])
+}
+
+func mac(macSaltKey, data, count []byte) []byte {
 	sha1Digest := sha1.New()
 	md5Digest := md5.New()
 
@@ -367,6 +409,7 @@ func macData(macSaltKey, data []byte) []byte {
 	sha1Digest.Write(macPad36[:])
 	sha1Digest.Write(lenBuf[:])
 	sha1Digest.Write(data)
+	sha1Digest.Write(count)
 
 	sha1Sig := sha1Digest.Sum(nil)
 
@@ -376,28 +419,49 @@ func macData(macSaltKey, data []byte) []byte {
 
 	return md5Digest.Sum(nil)
 }
-func (s *SEC) readEncryptedPayload(data []byte, checkSum bool) []byte {
+func (s *SEC) readEncryptedPayload(data []byte, checkSum bool) ([]byte, error) {
+	if s.fips != nil {
+		return s.fips.decrypt(data)
+	}
+	if len(data) < 8 {
+		return nil, errors.New("sec: short encrypted payload")
+	}
 	sign := data[:8]
-	slog.Debug("readEncryptedPayload", "sign", sign)
+	s.log.Debug("readEncryptedPayload", "sign", sign)
 	encryptedPayload := data[8:]
 	if s.decryptRc4 == nil {
 		s.decryptRc4, _ = rc4.NewCipher(s.currentDecrytKey)
 	}
+	count := s.nbDecryptedPacket
 	s.nbDecryptedPacket++
 	plaintext := make([]byte, len(encryptedPayload))
 	s.decryptRc4.XORKeyStream(plaintext, encryptedPayload)
 
-	return plaintext
+	var expected []byte
+	if checkSum {
+		expected = saltedMacData(s.macKey, plaintext, count)
+	} else {
+		expected = macData(s.macKey, plaintext)
+	}
+	if !hmac.Equal(expected[:8], sign) {
+		return nil, ErrMACMismatch
+	}
+	return plaintext, nil
 }
 func (s *SEC) writeEncryptedPayload(data []byte, checkSum bool) []byte {
-	if checkSum {
-		return []byte{}
+	if s.fips != nil {
+		return s.fips.encrypt(data)
 	}
-
+	count := s.nbEncryptedPacket
 	s.nbEncryptedPacket++
-	slog.Debug("writeEncryptedPayload", "nbEncryptedPacket", s.nbEncryptedPacket)
+	s.log.Debug("writeEncryptedPayload", "nbEncryptedPacket", s.nbEncryptedPacket)
 
-	sign := macData(s.macKey, data)[:8]
+	var sign []byte
+	if checkSum {
+		sign = saltedMacData(s.macKey, data, count)[:8]
+	} else {
+		sign = macData(s.macKey, data)[:8]
+	}
 	if s.encryptRc4 == nil {
 		s.encryptRc4, _ = rc4.NewCipher(s.currentEncryptKey)
 	}
@@ -405,7 +469,7 @@ func (s *SEC) writeEncryptedPayload(data []byte, checkSum bool) []byte {
 	result := make([]byte, 8+len(data))
 	copy(result[:8], sign)
 	s.encryptRc4.XORKeyStream(result[8:], data)
-	slog.Debug("writeEncryptedPayload", "sign", core.Hex(sign), "plaintext", core.Hex(result[8:]))
+	s.log.Debug("writeEncryptedPayload", "sign", core.Hex(sign), "plaintext", core.Hex(result[8:]))
 	return result
 }
 
@@ -432,25 +496,39 @@ func (s *SEC) encrytData(b []byte) []byte {
 	return s.encryt(flag, b)
 }
 
-func (s *SEC) decrytData(b []byte) []byte {
+func (s *SEC) decrytData(b []byte) ([]byte, error) {
 	if !s.enableEncryption {
-		return b
+		return b, nil
 	}
 
 	if len(b) < 4 {
-		return b
+		return b, nil
 	}
 	securityFlag := binary.LittleEndian.Uint16(b[0:])
 	// securityFlagHi = b[2:4] (ignored)
 	data := b[4:]
 	if securityFlag&ENCRYPT != 0 {
-		data = s.readEncryptedPayload(data, securityFlag&SECURE_CHECKSUM != 0)
+		return s.readEncryptedPayload(data, securityFlag&SECURE_CHECKSUM != 0)
 	}
-	return data
+	return data, nil
+}
+
+// Connection describes the connection the "connect" event of Client
+// reports once licensing is over.
+type Connection struct {
+	CoreData  *gcc.ClientCoreData
+	UserId    uint16
+	ChannelId uint16
 }
 
 type Client struct {
 	*SEC
+	// data, channel and connected are the typed "data", "channel" and
+	// "connect" events.
+	data      emission.Event[[]byte]
+	channel   emission.Event[t125.ChannelData]
+	connected emission.Event[Connection]
+	licensing emission.Event[struct{}]
 	userId    uint16
 	channelId uint16
 	//initialise decrypt and encrypt keys
@@ -459,16 +537,121 @@ type Client struct {
 
 	fastPathListener core.FastPathListener
 	channelSender    core.ChannelSender
+	keyExchange      KeyExchangeProvider
+	// credentials, when set, supplies the account for the Client Info PDU.
+	credentials func() (domain, user, password string, err error)
+	certPolicy  ServerCertPolicy
+}
+
+// ServerCertPolicy selects what a Standard RDP Security server
+// certificate that fails verification does to the connection.
+type ServerCertPolicy int
+
+const (
+	// ServerCertWarn logs a warning and connects anyway.
+	ServerCertWarn ServerCertPolicy = iota
+	// ServerCertStrict aborts the connection.
+	ServerCertStrict
+	// ServerCertIgnore connects silently.
+	ServerCertIgnore
+)
+
+// KeyExchangeProvider generates and encrypts the Standard RDP Security
+// client random (MS-RDPBCGR 5.3.4).  Replace the default with
+// SetKeyExchangeProvider to take the random from a hardware generator or
+// to have an HSM or other security appliance perform the RSA encryption.
+//
+// It does not keep the key material out of process memory: the SEC layer
+// derives the session keys from the client random ClientRandom returns,
+// and encrypts and signs the PDUs with them itself.
+type KeyExchangeProvider interface {
+	// ClientRandom returns the 32-byte client random.
+	ClientRandom() ([]byte, error)
+	// EncryptClientRandom encrypts clientRandom with the server's public
+	// key using RSA PKCS#1 v1.5.  clientRandom and the result are
+	// big-endian; the SEC layer handles the little-endian wire order.
+	EncryptClientRandom(pub *rsa.PublicKey, clientRandom []byte) ([]byte, error)
+}
+
+// defaultKeyExchange keeps the client random in process memory.
+type defaultKeyExchange struct{}
+
+func (defaultKeyExchange) ClientRandom() ([]byte, error) {
+	return core.Random(32), nil
+}
+
+func (defaultKeyExchange) EncryptClientRandom(pub *rsa.PublicKey, clientRandom []byte) ([]byte, error) {
+	return rsa.EncryptPKCS1v15(rand.Reader, pub, clientRandom)
 }
 
 func NewClient(t core.Transport) *Client {
 	c := &Client{
-		SEC: NewSEC(t),
+		SEC:         NewSEC(t),
+		keyExchange: defaultKeyExchange{},
 	}
+	c.data.Shim(&c.Emitter, "data", nil, nil)
+	c.channel.Shim(&c.Emitter, "channel",
+		func(d t125.ChannelData) []any { return []any{d.Channel, d.Data} },
+		func(a []any) (d t125.ChannelData) {
+			if len(a) == 2 {
+				d.Channel, _ = a[0].(string)
+				d.Data, _ = a[1].([]byte)
+			}
+			return d
+		})
+	c.connected.Shim(&c.Emitter, "connect",
+		func(cn Connection) []any { return []any{cn.CoreData, cn.UserId, cn.ChannelId} },
+		func(a []any) (cn Connection) {
+			if len(a) == 3 {
+				cn.CoreData, _ = a[0].(*gcc.ClientCoreData)
+				cn.UserId, _ = a[1].(uint16)
+				cn.ChannelId, _ = a[2].(uint16)
+			}
+			return cn
+		})
 	t.On("connect", c.connect)
 	return c
 }
 
+// OnData subscribes f to the decrypted PDUs of the I/O channel, the
+// "data" event.
+func (c *Client) OnData(f func([]byte)) *emission.Subscription {
+	return c.data.Subscribe(f)
+}
+
+// OnChannel subscribes f to the decrypted chunks of the static virtual
+// channels, the "channel" event.
+func (c *Client) OnChannel(f func(t125.ChannelData)) *emission.Subscription {
+	return c.channel.Subscribe(f)
+}
+
+// OnConnect subscribes f to the end of licensing, the "connect" event.
+func (c *Client) OnConnect(f func(Connection)) *emission.Subscription {
+	return c.connected.Subscribe(f)
+}
+
+// OnLicensing subscribes f to the start of licensing, once the Client
+// Info PDU has been sent.
+func (c *Client) OnLicensing(f func()) *emission.Subscription {
+	return c.licensing.Subscribe(func(struct{}) { f() })
+}
+
+// SetKeyExchangeProvider replaces the client random generation and
+// encryption used by Standard RDP Security.  nil restores the default.
+func (c *Client) SetKeyExchangeProvider(p KeyExchangeProvider) {
+	if p == nil {
+		p = defaultKeyExchange{}
+	}
+	c.keyExchange = p
+}
+
+// SetServerCertPolicy sets how the proprietary certificate or X.509 chain
+// sent by the server in its security data is checked.  The default is
+// ServerCertWarn.
+func (c *Client) SetServerCertPolicy(p ServerCertPolicy) {
+	c.certPolicy = p
+}
+
 func (c *Client) SetClientAutoReconnect(id uint32, random []byte) {
 	auto := NewClientAutoReconnect(id, random)
 	c.info.SetClientAutoReconnect(auto)
@@ -484,6 +667,26 @@ func (c *Client) SetAlternateShell(shell string) {
 	c.info.Flag |= INFO_RAIL
 }
 
+// SetCompression requests bulk compression of the server-to-client PDUs
+// up to level, a core.PACKET_COMPR_TYPE_* value, in the Client Info PDU
+// (MS-RDPBCGR 2.2.1.11.1.1).  The server may choose a lower level.
+func (c *Client) SetCompression(level int) {
+	c.info.Flag &^= INFO_CompressionTypeMask
+	c.info.Flag |= INFO_COMPRESSION | uint32(level)<<9&INFO_CompressionTypeMask
+}
+
+// SetRail asks the server in the Client Info PDU for a RemoteApp
+// session, whose applications are started over the RAIL channel.
+func (c *Client) SetRail() {
+	c.info.Flag |= INFO_RAIL
+}
+
+// SetAudioCapture tells the server in the Client Info PDU that the client
+// can redirect audio input.
+func (c *Client) SetAudioCapture() {
+	c.info.Flag |= INFO_AUDIOCAPTURE
+}
+
 func (c *Client) SetUser(user string) {
 	buff := &bytes.Buffer{}
 	for _, ch := range utf16.Encode([]rune(user)) {
@@ -502,6 +705,44 @@ func (c *Client) SetPwd(pwd string) {
 	c.info.Password = buff.Bytes()
 }
 
+// SetClientAddress sets the client IP address reported in the extended
+// Client Info PDU, e.g. the origin workstation behind a jump host.  An
+// address containing ':' is reported as AF_INET6.  The null-terminated
+// UTF-16 clientAddress holds at most 80 bytes, so longer addresses are
+// truncated to 39 characters.
+func (c *Client) SetClientAddress(addr string) {
+	ext := c.info.ExtendedInfo
+	ext.ClientAddressFamily = AF_INET
+	if strings.Contains(addr, ":") {
+		ext.ClientAddressFamily = AF_INET6
+	}
+	u := utf16.Encode([]rune(addr))
+	if len(u) > maxClientAddress {
+		u = u[:maxClientAddress]
+	}
+	buff := &bytes.Buffer{}
+	for _, ch := range u {
+		core.WriteUInt16LE(ch, buff)
+	}
+	core.WriteUInt16LE(0, buff)
+	ext.ClientAddress = buff.Bytes()
+}
+
+// SetPerformanceFlags sets the PERF_* flags of the extended Client Info
+// PDU, the visual effects the server turns off (or, for font smoothing and
+// desktop composition, on) to save bandwidth.
+func (c *Client) SetPerformanceFlags(flags uint32) {
+	c.info.ExtendedInfo.PerformanceFlags = flags
+}
+
+// SetTimeZone reports loc, with the daylight saving rules of the current
+// year, as the client time zone in the extended Client Info PDU.  The
+// server applies it when time zone redirection is allowed.
+func (c *Client) SetTimeZone(loc *time.Location) {
+	tz := NewTimeZoneInformation(loc, time.Now().In(loc).Year())
+	c.info.ExtendedInfo.ClientTimeZone = tz.Serialize()
+}
+
 func (c *Client) SetDomain(domain string) {
 	buff := &bytes.Buffer{}
 	for _, ch := range utf16.Encode([]rune(domain)) {
@@ -512,7 +753,7 @@ func (c *Client) SetDomain(domain string) {
 }
 
 func (c *Client) connect(clientData []any, serverData []any, userId uint16, channels []t125.MCSChannelInfo) {
-	slog.Debug("connected!", "clientData", clientData, "serverData", serverData, "userId", userId, "channels", channels)
+	c.log.Debug("connected!", "clientData", clientData, "serverData", serverData, "userId", userId, "channels", channels)
 	c.clientData = clientData
 	c.serverData = serverData
 	c.userId = userId
@@ -530,6 +771,7 @@ func (c *Client) connect(clientData []any, serverData []any, userId uint16, chan
 
 	c.sendInfoPkt()
 	c.transport.Once("sec", c.recvLicenceInfo)
+	c.licensing.Emit(struct{}{})
 }
 
 func (c *Client) ClientCoreData() *gcc.ClientCoreData {
@@ -649,7 +891,6 @@ func generateKeys(clientRandom, serverRandom []byte, method uint32) ([]byte, []b
 	b.Write(clientRandom[:24])
 	b.Write(serverRandom[:24])
 	preMasterHash := b.Bytes()
-	slog.Debug("getnerateKeys", "method", method)
 
 	masterHash := masterSecret(preMasterHash, clientRandom, serverRandom)
 	sessionKey := sessionKeyBlob(masterHash, clientRandom, serverRandom)
@@ -683,51 +924,97 @@ func (e *ClientSecurityExchangePDU) serialize() []byte {
 	return buff.Bytes()
 }
 func (c *Client) sendClientRandom() {
-	clientRandom := core.Random(32)
-	slog.Debug("sendClientRandom", "clientRandom", core.Hex(clientRandom))
+	clientRandom, err := c.keyExchange.ClientRandom()
+	if err != nil {
+		c.Emit("error", fmt.Errorf("sec: client random: %w", err))
+		return
+	}
+	if len(clientRandom) != 32 {
+		c.Emit("error", fmt.Errorf("sec: client random must be 32 bytes, got %d", len(clientRandom)))
+		return
+	}
+	c.log.Debug("sendClientRandom", "clientRandom", core.Hex(clientRandom))
 
 	serverRandom := c.ServerSecurityData().ServerRandom
-	slog.Debug("sendlientRandom", "ServerRandom", core.Hex(serverRandom))
+	c.log.Debug("sendlientRandom", "ServerRandom", core.Hex(serverRandom))
 
+	c.log.Debug("sendClientRandom: generateKeys", "method", c.ServerSecurityData().EncryptionMethod)
 	c.macKey, c.initialDecrytKey, c.initialEncryptKey = generateKeys(clientRandom,
 		serverRandom, c.ServerSecurityData().EncryptionMethod)
+	if c.ServerSecurityData().EncryptionMethod == gcc.FIPS_ENCRYPTION_FLAG {
+		if c.fips, err = newFIPSCipher(clientRandom, serverRandom); err != nil {
+			c.Emit("error", fmt.Errorf("sec: fips keys: %w", err))
+			return
+		}
+	}
 
 	//initialize keys
 	c.currentDecrytKey = c.initialDecrytKey
 	c.currentEncryptKey = c.initialEncryptKey
 
 	//verify certificate
-	if !c.ServerSecurityData().ServerCertificate.CertData.Verify() {
-		slog.Warn("Cannot verify server identity")
+	c.log.Debug("sendClientRandom: server certificate", "type", fmt.Sprintf("%T", c.ServerSecurityData().ServerCertificate.CertData))
+	if err := c.ServerSecurityData().ServerCertificate.CertData.Verify(); err != nil {
+		switch c.certPolicy {
+		case ServerCertStrict:
+			c.Emit("error", fmt.Errorf("sec: server certificate: %w", err))
+			return
+		case ServerCertWarn:
+			c.log.Warn("Cannot verify server identity", "err", err)
+		}
 	}
 
-	serverPubKey, _ := c.ServerSecurityData().ServerCertificate.CertData.GetPublicKey()
-	ret, err := rsa.EncryptPKCS1v15(rand.Reader, serverPubKey, core.Reverse(clientRandom))
+	serverPubKey, err := c.ServerSecurityData().ServerCertificate.CertData.GetPublicKey()
 	if err != nil {
-		slog.Error("sendlientRandom", "err", err)
+		c.Emit("error", fmt.Errorf("sec: server certificate: %w", err))
+		return
+	}
+	// Reverse a copy: the random may still be the provider's.
+	ret, err := c.keyExchange.EncryptClientRandom(serverPubKey, core.Reverse(bytes.Clone(clientRandom)))
+	if err != nil {
+		c.log.Error("sendlientRandom", "err", err)
+		c.Emit("error", fmt.Errorf("sec: encrypt client random: %w", err))
+		return
 	}
 	message := ClientSecurityExchangePDU{}
 	message.EncryptedClientRandom = core.Reverse(ret)
 	message.Length = uint32(len(message.EncryptedClientRandom) + 8)
 	message.Padding = make([]byte, 8)
 
-	slog.Debug("sendlientRandom", "message", message)
+	c.log.Debug("sendlientRandom", "message", message)
 
 	c.sendFlagged(EXCHANGE_PKT, message.serialize())
 }
+
+// SetCredentialsFunc makes the Client Info PDU ask f for the account when
+// it is sent instead of using SetUser, SetPwd and SetDomain.
+func (c *Client) SetCredentialsFunc(f func() (domain, user, password string, err error)) {
+	c.credentials = f
+}
+
 func (c *Client) sendInfoPkt() {
+	if c.credentials != nil {
+		domain, user, password, err := c.credentials()
+		if err != nil {
+			c.Emit("error", fmt.Errorf("sec: credentials: %w", err))
+			return
+		}
+		c.SetDomain(domain)
+		c.SetUser(user)
+		c.SetPwd(password)
+	}
 	var secFlag uint16 = INFO_PKT
 	if c.enableEncryption {
 		secFlag |= ENCRYPT
 	}
 
-	slog.Debug("sendInfoPkt", "secFlag", secFlag, "hasExtended", c.ClientCoreData().RdpVersion >= gcc.RDP_VERSION_5_PLUS)
+	c.log.Debug("sendInfoPkt", "secFlag", secFlag, "hasExtended", c.ClientCoreData().RdpVersion >= gcc.RDP_VERSION_5_PLUS)
 	c.sendFlagged(secFlag, c.info.Serialize(c.ClientCoreData().RdpVersion >= gcc.RDP_VERSION_5_PLUS))
 }
 
 func (c *Client) recvLicenceInfo(channel string, s []byte) {
-	slog.Debug("recvLicenceInfo", "s", core.Hex(s))
-	r := bytes.NewReader(s)
+	c.log.Debug("recvLicenceInfo", "s", core.Hex(s))
+	r := core.NewErrReader(bytes.NewReader(s))
 	h := readSecurityHeader(r)
 	if (h.securityFlag & LICENSE_PKT) == 0 {
 		c.Emit("error", errors.New("NODE_RDP_PROTOCOL_PDU_SEC_BAD_LICENSE_HEADER"))
@@ -735,35 +1022,47 @@ func (c *Client) recvLicenceInfo(channel string, s []byte) {
 	}
 
 	p := lic.ReadLicensePacket(r)
+	if err := r.Err(); err != nil {
+		c.log.Error("malformed PDU", core.LogPDU, "License", "err", err)
+		c.Emit("error", core.NewProtocolError("sec", "License", s, err))
+		c.transport.Close()
+		return
+	}
 	switch p.BMsgtype {
 	case lic.NEW_LICENSE:
-		slog.Debug("sec NEW_LICENSE")
+		c.log.Debug("sec NEW_LICENSE")
 		c.Emit("success")
 		goto connect
 	case lic.ERROR_ALERT:
 		message := p.LicensingMessage.(*lic.ErrorMessage)
-		slog.Debug("recvLicenceInfo ERROR_ALERT", "ErrorCode", message.DwErrorCode)
+		c.log.Debug("recvLicenceInfo ERROR_ALERT", "ErrorCode", message.DwErrorCode)
 		if message.DwErrorCode == lic.STATUS_VALID_CLIENT && message.DwStateTransaction == lic.ST_NO_TRANSITION {
 			goto connect
 		}
 		goto retry
 	case lic.LICENSE_REQUEST:
-		slog.Debug("recvLicenceInfo LICENSE_REQUEST")
+		c.log.Debug("recvLicenceInfo LICENSE_REQUEST")
 		c.sendClientNewLicenseRequest(p.LicensingMessage.([]byte))
 		goto retry
 	case lic.PLATFORM_CHALLENGE:
-		slog.Debug("recvLicenceInfo PLATFORM_CHALLENGE")
+		c.log.Debug("recvLicenceInfo PLATFORM_CHALLENGE")
 		c.sendClientChallengeResponse(p.LicensingMessage.([]byte))
 		goto retry
 	default:
-		slog.Error("Not a valid license packet")
+		c.log.Error("Not a valid license packet")
 		c.Emit("error", errors.New("Not a valid license packet"))
 		return
 	}
 
 connect:
-	c.transport.On("sec", c.recvData)
-	c.Emit("connect", c.clientData[0].(*gcc.ClientCoreData), c.userId, c.channelId)
+	if m, ok := c.transport.(interface {
+		OnChannelData(func(t125.ChannelData)) *emission.Subscription
+	}); ok {
+		m.OnChannelData(func(d t125.ChannelData) { c.recvData(d.Channel, d.Data) })
+	} else {
+		c.transport.On("sec", c.recvData)
+	}
+	c.connected.Emit(Connection{c.clientData[0].(*gcc.ClientCoreData), c.userId, c.channelId})
 	return
 
 retry:
@@ -782,7 +1081,7 @@ func (c *Client) sendClientNewLicenseRequest(data []byte) {
 		rd := bytes.NewReader(req.ServerCertificate.BlobData)
 		err := sc.Unpack(rd)
 		if err != nil {
-			slog.Error("sendClientNewLicenseRequest", "err", err)
+			c.log.Error("sendClientNewLicenseRequest", "err", err)
 			return
 		}
 	}
@@ -803,10 +1102,14 @@ func (c *Client) sendClientNewLicenseRequest(data []byte) {
 
 	buff := &bytes.Buffer{}
 
-	serverPubKey, _ := sc.CertData.GetPublicKey()
+	serverPubKey, err := sc.CertData.GetPublicKey()
+	if err != nil {
+		c.log.Error("sendClientNewLicenseRequest", "err", err)
+		return
+	}
 	ret, err := rsa.EncryptPKCS1v15(rand.Reader, serverPubKey, core.Reverse(preMasterSecret))
 	if err != nil {
-		slog.Error("sendClientNewLicenseRequest", "err", err)
+		c.log.Error("sendClientNewLicenseRequest", "err", err)
 	}
 
 	buff.Write(core.Reverse(ret))
@@ -832,7 +1135,7 @@ func (c *Client) sendClientNewLicenseRequest(data []byte) {
 	buff.Reset()
 	err = struc.Pack(buff, message)
 	if err != nil {
-		slog.Error("sendClientNewLicenseRequest", "err", err)
+		c.log.Error("sendClientNewLicenseRequest", "err", err)
 	}
 
 	c.sendFlagged(LICENSE_PKT, buff.Bytes())
@@ -845,8 +1148,12 @@ func (c *Client) sendClientChallengeResponse(data []byte) {
 	serverEncryptedChallenge := pc.EncryptedPlatformChallenge.BlobData
 	//decrypt server challenge
 	//it should be TEST word in unicode format
-	rc, _ := rc4.NewCipher(c.initialDecrytKey)
-	serverChallenge := make([]byte, 20)
+	rc, err := rc4.NewCipher(c.initialDecrytKey)
+	if err != nil {
+		c.Emit("error", fmt.Errorf("sec: platform challenge before the license request: %w", err))
+		return
+	}
+	serverChallenge := make([]byte, len(serverEncryptedChallenge))
 	rc.XORKeyStream(serverChallenge, serverEncryptedChallenge)
 	//if serverChallenge != "T\x00E\x00S\x00T\x00\x00\x00":
 	//raise InvalidExpectedDataException("bad license server challenge")
@@ -878,12 +1185,16 @@ func (c *Client) sendClientChallengeResponse(data []byte) {
 }
 
 func (c *Client) recvData(channel string, s []byte) {
-	data := c.decrytData(s)
+	data, err := c.decrytData(s)
+	if err != nil {
+		c.Emit("error", err)
+		return
+	}
 	if channel != t125.GLOBAL_CHANNEL_NAME {
-		c.Emit("channel", channel, data)
+		c.channel.Emit(t125.ChannelData{Channel: channel, Data: data})
 		return
 	}
-	c.Emit("data", data)
+	c.data.Emit(data)
 }
 func (c *Client) SetFastPathListener(f core.FastPathListener) {
 	c.fastPathListener = f
@@ -892,7 +1203,12 @@ func (c *Client) SetFastPathListener(f core.FastPathListener) {
 func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 	data := s
 	if c.enableEncryption && secFlag&FASTPATH_OUTPUT_ENCRYPTED != 0 {
-		data = c.readEncryptedPayload(s, secFlag&FASTPATH_OUTPUT_SECURE_CHECKSUM != 0)
+		var err error
+		data, err = c.readEncryptedPayload(s, secFlag&FASTPATH_OUTPUT_SECURE_CHECKSUM != 0)
+		if err != nil {
+			c.Emit("error", err)
+			return
+		}
 	}
 	c.fastPathListener.RecvFastPath(secFlag, data)
 }
@@ -905,6 +1221,8 @@ func (c *Client) SendToChannel(channel string, b []byte) (int, error) {
 	if !c.enableEncryption {
 		return c.channelSender.SendToChannel(channel, b)
 	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
 	var flag uint16 = ENCRYPT
 	if c.enableSecureCheckSum {
 		flag |= SECURE_CHECKSUM
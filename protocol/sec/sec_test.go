@@ -0,0 +1,226 @@
+package sec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/protocol/t125/gcc"
+	"github.com/nakagami/grdp/testutil"
+)
+
+// secPair returns a client and a server SEC sharing 128-bit RC4 keys.
+func secPair() (*SEC, *SEC) {
+	macKey := []byte("0123456789abcdef")
+	c2s, s2c := []byte("client to server"), []byte("server to client")
+	client, server := NewSEC(testutil.NewTransport()), NewSEC(testutil.NewTransport())
+	client.macKey, server.macKey = macKey, macKey
+	client.currentEncryptKey, client.currentDecrytKey = c2s, s2c
+	server.currentEncryptKey, server.currentDecrytKey = s2c, c2s
+	return client, server
+}
+
+func TestEncryptedPayloadMAC(t *testing.T) {
+	for _, salted := range []bool{false, true} {
+		client, server := secPair()
+		for _, msg := range []string{"first", "second", "third"} {
+			got, err := server.readEncryptedPayload(client.writeEncryptedPayload([]byte(msg), salted), salted)
+			if err != nil || string(got) != msg {
+				t.Fatalf("salted=%v: got %q, %v", salted, got, err)
+			}
+		}
+
+		pdu := client.writeEncryptedPayload([]byte("tampered"), salted)
+		pdu[len(pdu)-1] ^= 1
+		if _, err := server.readEncryptedPayload(pdu, salted); !errors.Is(err, ErrMACMismatch) {
+			t.Errorf("salted=%v: tampered payload: err = %v", salted, err)
+		}
+	}
+}
+
+func TestSaltedMACCount(t *testing.T) {
+	key, data := []byte("0123456789abcdef"), []byte("data")
+	if string(saltedMacData(key, data, 0)) == string(saltedMacData(key, data, 1)) {
+		t.Error("salted MAC ignores the packet count")
+	}
+}
+
+func TestConcurrentEncryptedWrites(t *testing.T) {
+	client, server := secPair()
+	tr := client.transport.(*testutil.Transport)
+	client.enableEncryption = true
+	client.SetSecureChecksum(true)
+
+	const writers, each = 8, 50
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range each {
+				client.Write([]byte(fmt.Sprintf("writer %d pdu %d", i, j)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The salted MAC covers the packet count, so a PDU encrypted out of
+	// the order it was written in fails to decrypt.
+	frames := tr.Frames()
+	if len(frames) != writers*each {
+		t.Fatalf("%d frames", len(frames))
+	}
+	for i, f := range frames {
+		if _, err := server.decrytData(f.Data); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+}
+
+// stubKeyExchange returns a fixed random and a recognisable ciphertext,
+// recording what the SEC layer passed it.
+type stubKeyExchange struct {
+	random    []byte
+	err       error
+	pub       *rsa.PublicKey
+	encrypted []byte
+}
+
+func (s *stubKeyExchange) ClientRandom() ([]byte, error) {
+	return s.random, s.err
+}
+
+func (s *stubKeyExchange) EncryptClientRandom(pub *rsa.PublicKey, clientRandom []byte) ([]byte, error) {
+	s.pub, s.encrypted = pub, clientRandom
+	return []byte("encrypted by the provider"), nil
+}
+
+// keyExchangeClient returns a client with the server data of a Standard
+// RDP Security connection whose certificate carries key.
+func keyExchangeClient(t *testing.T, key *rsa.PrivateKey) (*Client, *testutil.Transport) {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := testutil.NewTransport()
+	c := NewClient(tr)
+	c.SetServerCertPolicy(ServerCertIgnore)
+	c.serverData = []any{&gcc.ServerCoreData{}, &gcc.ServerSecurityData{
+		EncryptionMethod: gcc.ENCRYPTION_FLAG_128BIT,
+		ServerRandom:     bytes.Repeat([]byte{0x5a}, 32),
+		ServerCertificate: gcc.ServerCertificate{
+			CertData: &gcc.X509CertificateChain{CertBlobArray: []gcc.CertBlob{{AbCert: der}}},
+		},
+	}}
+	return c, tr
+}
+
+func TestKeyExchangeProvider(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, tr := keyExchangeClient(t, key)
+	random := make([]byte, 32)
+	for i := range random {
+		random[i] = byte(i)
+	}
+	p := &stubKeyExchange{random: bytes.Clone(random)}
+	c.SetKeyExchangeProvider(p)
+	c.sendClientRandom()
+
+	if p.pub == nil || !p.pub.Equal(&key.PublicKey) {
+		t.Fatal("provider not given the server public key")
+	}
+	if !bytes.Equal(p.random, random) {
+		t.Error("provider's random modified")
+	}
+	if !bytes.Equal(p.encrypted, core.Reverse(bytes.Clone(random))) {
+		t.Errorf("provider encrypted % x", p.encrypted)
+	}
+	frames := tr.Frames()
+	if len(frames) != 1 {
+		t.Fatalf("%d frames sent", len(frames))
+	}
+	f := frames[0].Data
+	if flag := binary.LittleEndian.Uint16(f); flag != EXCHANGE_PKT {
+		t.Errorf("flags 0x%04x", flag)
+	}
+	want := core.Reverse([]byte("encrypted by the provider"))
+	if n := binary.LittleEndian.Uint32(f[4:]); int(n) != len(want)+8 || !bytes.Equal(f[8:8+len(want)], want) {
+		t.Errorf("security exchange PDU % x", f)
+	}
+	mac, dec, enc := generateKeys(random, bytes.Repeat([]byte{0x5a}, 32), gcc.ENCRYPTION_FLAG_128BIT)
+	if !bytes.Equal(c.macKey, mac) || !bytes.Equal(c.currentDecrytKey, dec) || !bytes.Equal(c.currentEncryptKey, enc) {
+		t.Error("session keys not derived from the provider's random")
+	}
+
+	// A failing provider, or one returning a random of the wrong size,
+	// aborts the connection before anything is sent.
+	for _, p := range []*stubKeyExchange{{err: errors.New("hsm offline")}, {random: random[:16]}} {
+		c, tr := keyExchangeClient(t, key)
+		c.SetKeyExchangeProvider(p)
+		var gotErr error
+		c.On("error", func(err error) { gotErr = err })
+		c.sendClientRandom()
+		if gotErr == nil || len(tr.Frames()) != 0 {
+			t.Errorf("provider %+v: err %v, %d frames", p, gotErr, len(tr.Frames()))
+		}
+		if p.err != nil && !errors.Is(gotErr, p.err) {
+			t.Errorf("error %v does not wrap the provider's", gotErr)
+		}
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	tests := []struct {
+		addr   string
+		family uint16
+		chars  string
+	}{
+		{"192.0.2.1", AF_INET, "192.0.2.1"},
+		{"2001:db8::1", AF_INET6, "2001:db8::1"},
+		{"2001:0db8:0000:0000:0000:ff00:0042:8329%eth0", AF_INET6, "2001:0db8:0000:0000:0000:ff00:0042:8329"},
+	}
+	for _, tt := range tests {
+		c := NewClient(testutil.NewTransport())
+		c.SetClientAddress(tt.addr)
+		b := c.info.ExtendedInfo.Serialize()
+
+		want := &bytes.Buffer{}
+		binary.Write(want, binary.LittleEndian, tt.family)
+		binary.Write(want, binary.LittleEndian, uint16(2*len(tt.chars)+2))
+		for _, ch := range tt.chars {
+			binary.Write(want, binary.LittleEndian, uint16(ch))
+		}
+		binary.Write(want, binary.LittleEndian, uint16(0))
+		if !bytes.HasPrefix(b, want.Bytes()) {
+			t.Errorf("%s: extended info starts % x, want % x", tt.addr, b[:min(len(b), want.Len())], want.Bytes())
+		}
+		if n := binary.LittleEndian.Uint16(b[2:]); n > 80 {
+			t.Errorf("%s: cbClientAddress %d", tt.addr, n)
+		}
+		// clientDir, the time zone, the session ID and the performance
+		// flags follow the address.
+		if rest := len(b) - want.Len(); rest != 2+2+172+4+4 {
+			t.Errorf("%s: %d bytes after the address", tt.addr, rest)
+		}
+	}
+}
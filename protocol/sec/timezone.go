@@ -0,0 +1,123 @@
+package sec
+
+import (
+	"bytes"
+	"time"
+	"unicode/utf16"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// SystemTime is a TS_SYSTEMTIME.  In a time zone transition Year is 0 and
+// the date recurs every year: Day is the occurrence of DayOfWeek in the
+// month, 1 to 4, or 5 for the last one.
+type SystemTime struct {
+	Year, Month, DayOfWeek, Day        uint16
+	Hour, Minute, Second, Milliseconds uint16
+}
+
+func (t *SystemTime) serialize(buff *bytes.Buffer) {
+	for _, v := range [...]uint16{t.Year, t.Month, t.DayOfWeek, t.Day, t.Hour, t.Minute, t.Second, t.Milliseconds} {
+		core.WriteUInt16LE(v, buff)
+	}
+}
+
+// TimeZoneInformation is the TS_TIME_ZONE_INFORMATION of the extended
+// Client Info PDU (MS-RDPBCGR 2.2.1.11.1.1.1).  Biases are in minutes
+// and follow the Windows convention: UTC = local time + bias.
+// StandardDate and DaylightDate are the local times, in the zone being
+// left, at which standard and daylight time begin; both are zero for a
+// zone without daylight saving time.
+type TimeZoneInformation struct {
+	Bias         int32
+	StandardName string
+	StandardDate SystemTime
+	StandardBias int32
+	DaylightName string
+	DaylightDate SystemTime
+	DaylightBias int32
+}
+
+// NewTimeZoneInformation describes loc with the rules it follows in
+// year.  The names are the zone abbreviations, such as "CET" and "CEST".
+func NewTimeZoneInformation(loc *time.Location, year int) *TimeZoneInformation {
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, loc)
+	stdName, stdOffset := start.Zone()
+	tz := &TimeZoneInformation{}
+	var dstName string
+	var dstOffset int
+	var toDst, toStd time.Time
+	for t := start; t.Year() == year; {
+		_, end := t.ZoneBounds()
+		if end.IsZero() || end.Year() != year {
+			break
+		}
+		if end.IsDST() && toDst.IsZero() {
+			toDst = end
+			dstName, dstOffset = end.Zone()
+		} else if !end.IsDST() && toStd.IsZero() {
+			toStd = end
+			stdName, stdOffset = end.Zone()
+		}
+		t = end
+	}
+	if start.IsDST() {
+		// Southern hemisphere: the year starts in daylight time.
+		dstName, dstOffset = start.Zone()
+	}
+	tz.Bias = -int32(stdOffset / 60)
+	tz.StandardName = stdName
+	if !toDst.IsZero() && !toStd.IsZero() {
+		tz.DaylightName = dstName
+		tz.DaylightBias = -int32((dstOffset - stdOffset) / 60)
+		tz.DaylightDate = transitionDate(toDst, stdOffset)
+		tz.StandardDate = transitionDate(toStd, dstOffset)
+	} else {
+		tz.DaylightName = stdName
+	}
+	return tz
+}
+
+// transitionDate returns the recurring TS_SYSTEMTIME of the transition at
+// t, as local time at offset, the UTC offset in effect before it.
+func transitionDate(t time.Time, offset int) SystemTime {
+	t = t.In(time.FixedZone("", offset))
+	day := uint16((t.Day()-1)/7 + 1)
+	if t.AddDate(0, 0, 7).Month() != t.Month() {
+		day = 5
+	}
+	return SystemTime{
+		Month:     uint16(t.Month()),
+		DayOfWeek: uint16(t.Weekday()),
+		Day:       day,
+		Hour:      uint16(t.Hour()),
+		Minute:    uint16(t.Minute()),
+		Second:    uint16(t.Second()),
+	}
+}
+
+// Serialize returns the 172 byte structure.
+func (tz *TimeZoneInformation) Serialize() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(uint32(tz.Bias), buff)
+	writeTimeZoneName(tz.StandardName, buff)
+	tz.StandardDate.serialize(buff)
+	core.WriteUInt32LE(uint32(tz.StandardBias), buff)
+	writeTimeZoneName(tz.DaylightName, buff)
+	tz.DaylightDate.serialize(buff)
+	core.WriteUInt32LE(uint32(tz.DaylightBias), buff)
+	return buff.Bytes()
+}
+
+// writeTimeZoneName writes name as a null-terminated UTF-16 string padded
+// to 32 characters.
+func writeTimeZoneName(name string, buff *bytes.Buffer) {
+	u := utf16.Encode([]rune(name))
+	if len(u) > 31 {
+		u = u[:31]
+	}
+	u = append(u, make([]uint16, 32-len(u))...)
+	for _, ch := range u {
+		core.WriteUInt16LE(ch, buff)
+	}
+}
@@ -0,0 +1,57 @@
+package sec
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestTimeZoneInformation(t *testing.T) {
+	tests := []struct {
+		zone string
+		want TimeZoneInformation
+	}{
+		{"America/New_York", TimeZoneInformation{
+			Bias:         300,
+			StandardName: "EST",
+			StandardDate: SystemTime{Month: 11, DayOfWeek: 0, Day: 1, Hour: 2},
+			DaylightName: "EDT",
+			DaylightDate: SystemTime{Month: 3, DayOfWeek: 0, Day: 2, Hour: 2},
+			DaylightBias: -60,
+		}},
+		{"Europe/Berlin", TimeZoneInformation{
+			Bias:         -60,
+			StandardName: "CET",
+			StandardDate: SystemTime{Month: 10, DayOfWeek: 0, Day: 5, Hour: 3},
+			DaylightName: "CEST",
+			DaylightDate: SystemTime{Month: 3, DayOfWeek: 0, Day: 5, Hour: 2},
+			DaylightBias: -60,
+		}},
+		{"Australia/Sydney", TimeZoneInformation{
+			Bias:         -600,
+			StandardName: "AEST",
+			StandardDate: SystemTime{Month: 4, DayOfWeek: 0, Day: 1, Hour: 3},
+			DaylightName: "AEDT",
+			DaylightDate: SystemTime{Month: 10, DayOfWeek: 0, Day: 1, Hour: 2},
+			DaylightBias: -60,
+		}},
+		{"Asia/Tokyo", TimeZoneInformation{
+			Bias:         -540,
+			StandardName: "JST",
+			DaylightName: "JST",
+		}},
+	}
+	for _, tt := range tests {
+		loc, err := time.LoadLocation(tt.zone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := NewTimeZoneInformation(loc, 2024)
+		if *got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.zone, *got, tt.want)
+		}
+		if n := len(got.Serialize()); n != 172 {
+			t.Errorf("%s: serialized %d bytes, want 172", tt.zone, n)
+		}
+	}
+}
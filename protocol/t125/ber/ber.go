@@ -64,34 +64,36 @@ func WriteUniversalTag(tag uint8, pc bool, w io.Writer) {
 	core.WriteUInt8((CLASS_UNIV|berPC(pc))|(TAG_MASK&tag), w)
 }
 
+// ReadLength reads a definite-form length: short form up to 0x7F, or
+// long form with up to four length octets.
 func ReadLength(r io.Reader) (int, error) {
+	size, err := core.ReadUInt8(r)
+	if err != nil {
+		return 0, err
+	}
+	if size&0x80 == 0 {
+		return int(size), nil
+	}
+	n := int(size &^ 0x80)
+	if n == 0 || n > 4 {
+		return 0, fmt.Errorf("BER length with %d octets", n)
+	}
 	ret := 0
-	size, _ := core.ReadUInt8(r)
-	if size&0x80 > 0 {
-		size = size &^ 0x80
-		if size == 1 {
-			r, err := core.ReadUInt8(r)
-			if err != nil {
-				return 0, err
-			}
-			ret = int(r)
-		} else if size == 2 {
-			r, err := core.ReadUint16BE(r)
-			if err != nil {
-				return 0, err
-			}
-			ret = int(r)
-		} else {
-			return 0, errors.New("BER length may be 1 or 2")
+	for range n {
+		b, err := core.ReadUInt8(r)
+		if err != nil {
+			return 0, err
 		}
-	} else {
-		ret = int(size)
+		ret = ret<<8 | int(b)
 	}
 	return ret, nil
 }
 
 func WriteLength(size int, w io.Writer) {
-	if size > 0x7f {
+	if size > 0xffff {
+		core.WriteUInt8(0x84, w)
+		core.WriteUInt32BE(uint32(size), w)
+	} else if size > 0x7f {
 		core.WriteUInt8(0x82, w)
 		core.WriteUInt16BE(uint16(size), w)
 	} else {
@@ -99,28 +101,27 @@ func WriteLength(size int, w io.Writer) {
 	}
 }
 
+// ReadInteger reads a non-negative INTEGER of up to four octets.
 func ReadInteger(r io.Reader) (int, error) {
 	if !ReadUniversalTag(TAG_INTEGER, false, r) {
 		return 0, errors.New("Bad integer tag")
 	}
-	size, _ := ReadLength(r)
-	switch size {
-	case 1:
-		num, _ := core.ReadUInt8(r)
-		return int(num), nil
-	case 2:
-		num, _ := core.ReadUint16BE(r)
-		return int(num), nil
-	case 3:
-		integer1, _ := core.ReadUInt8(r)
-		integer2, _ := core.ReadUint16BE(r)
-		return int(integer2) + int(uint32(integer1)<<16), nil
-	case 4:
-		num, _ := core.ReadUInt32BE(r)
-		return int(num), nil
-	default:
-		return 0, errors.New("wrong size")
+	size, err := ReadLength(r)
+	if err != nil {
+		return 0, err
+	}
+	if size < 1 || size > 4 {
+		return 0, fmt.Errorf("BER integer of %d octets", size)
+	}
+	b, err := core.ReadBytes(size, r)
+	if err != nil {
+		return 0, err
+	}
+	ret := 0
+	for _, v := range b {
+		ret = ret<<8 | int(v)
 	}
+	return ret, nil
 }
 
 func WriteInteger(n int, w io.Writer) {
@@ -143,6 +144,34 @@ func WriteOctetstring(str string, w io.Writer) {
 	core.WriteBytes([]byte(str), w)
 }
 
+// ReadOctetString reads an OCTET STRING.
+func ReadOctetString(r io.Reader) ([]byte, error) {
+	if !ReadUniversalTag(TAG_OCTET_STRING, false, r) {
+		return nil, errors.New("Bad octet string tag")
+	}
+	return readContents(r)
+}
+
+// ReadSequence reads a SEQUENCE and returns its contents, so that
+// components added by later versions of a type can be skipped.
+func ReadSequence(r io.Reader) ([]byte, error) {
+	if !ReadUniversalTag(TAG_SEQUENCE, true, r) {
+		return nil, errors.New("Bad sequence tag")
+	}
+	return readContents(r)
+}
+
+func readContents(r io.Reader) ([]byte, error) {
+	size, err := ReadLength(r)
+	if err != nil {
+		return nil, err
+	}
+	if lr, ok := r.(interface{ Len() int }); ok && size > lr.Len() {
+		return nil, fmt.Errorf("BER length %d exceeds the %d octets left", size, lr.Len())
+	}
+	return core.ReadBytes(size, r)
+}
+
 func WriteBoolean(b bool, w io.Writer) {
 	bb := uint8(0)
 	if b {
@@ -0,0 +1,61 @@
+package ber
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLength(t *testing.T) {
+	for _, n := range []int{0, 0x7f, 0x80, 0xffff, 0x10000} {
+		b := &bytes.Buffer{}
+		WriteLength(n, b)
+		got, err := ReadLength(b)
+		if err != nil || got != n || b.Len() != 0 {
+			t.Errorf("length %#x: got %#x, %v", n, got, err)
+		}
+	}
+	// Long forms other encoders use.
+	for _, tt := range []struct {
+		in   []byte
+		want int
+	}{
+		{[]byte{0x81, 0x90}, 0x90},
+		{[]byte{0x83, 0x01, 0x00, 0x00}, 0x10000},
+	} {
+		if got, err := ReadLength(bytes.NewReader(tt.in)); err != nil || got != tt.want {
+			t.Errorf("% x: got %#x, %v", tt.in, got, err)
+		}
+	}
+	for _, in := range [][]byte{{0x80}, {0x85, 1, 2, 3, 4, 5}, {0x82, 0x01}} {
+		if _, err := ReadLength(bytes.NewReader(in)); err == nil {
+			t.Errorf("% x: accepted", in)
+		}
+	}
+}
+
+func TestInteger(t *testing.T) {
+	for _, n := range []int{0, 0xff, 0x100, 0xfc17, 0x10000, 0x7fffffff} {
+		b := &bytes.Buffer{}
+		WriteInteger(n, b)
+		if got, err := ReadInteger(b); err != nil || got != n {
+			t.Errorf("integer %#x: got %#x, %v", n, got, err)
+		}
+	}
+	// Three octet integers are valid BER.
+	if got, err := ReadInteger(bytes.NewReader([]byte{0x02, 0x03, 0x01, 0x00, 0x00})); err != nil || got != 0x10000 {
+		t.Errorf("3 octets: got %#x, %v", got, err)
+	}
+	if _, err := ReadInteger(bytes.NewReader([]byte{0x02, 0x05, 1, 2, 3, 4, 5})); err == nil {
+		t.Error("5 octet integer accepted")
+	}
+}
+
+func TestSequence(t *testing.T) {
+	if _, err := ReadSequence(bytes.NewReader([]byte{0x30, 0x05, 0x02, 0x01, 0x00})); err == nil {
+		t.Error("sequence longer than the data accepted")
+	}
+	got, err := ReadOctetString(bytes.NewReader([]byte{0x04, 0x82, 0x00, 0x02, 0xaa, 0xbb}))
+	if err != nil || !bytes.Equal(got, []byte{0xaa, 0xbb}) {
+		t.Errorf("octet string = % x, %v", got, err)
+	}
+}
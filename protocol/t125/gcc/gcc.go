@@ -2,15 +2,20 @@ package gcc
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/md5"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"math/big"
 	"os"
+	"unicode/utf16"
 
 	"github.com/lunixbochs/struc"
 	"github.com/nakagami/grdp/core"
@@ -39,6 +44,7 @@ const (
 	CS_CLUSTER        = 0xC004
 	CS_MONITOR        = 0xC005
 	CS_MCS_MSGCHANNEL = 0xC006 // TS_UD_CS_MCS_MSGCHANNEL
+	CS_MONITOR_EX     = 0xC008
 )
 
 /**
@@ -255,19 +261,71 @@ type ClientCoreData struct {
 	ConnectionType         uint8          `struc:"uint8"`
 	Pad1octet              uint8          `struc:"uint8"`
 	ServerSelectedProtocol uint32         `struc:"little"`
+
+	// The optional display fields, sent when DesktopScaleFactor is set:
+	// the physical size of the desktop in millimetres, its ORIENTATION_*
+	// and the desktop (100 to 500) and device (100, 140 or 180) scale
+	// factors in percent.
+	DesktopPhysicalWidth  uint32 `struc:"skip"`
+	DesktopPhysicalHeight uint32 `struc:"skip"`
+	DesktopOrientation    uint16 `struc:"skip"`
+	DesktopScaleFactor    uint32 `struc:"skip"`
+	DeviceScaleFactor     uint32 `struc:"skip"`
 }
 
+// Orientations of ClientCoreData and MonitorAttributes
+const (
+	ORIENTATION_LANDSCAPE         = 0
+	ORIENTATION_PORTRAIT          = 90
+	ORIENTATION_LANDSCAPE_FLIPPED = 180
+	ORIENTATION_PORTRAIT_FLIPPED  = 270
+)
+
 func NewClientCoreData(kbdLayout uint32, keyboardType uint32, keyboardSubType uint32) *ClientCoreData {
 	name, _ := os.Hostname()
-	var ClientName [32]byte
-	copy(ClientName[:], core.UnicodeEncode(name)[:])
-	return &ClientCoreData{
+	data := &ClientCoreData{
 		RDP_VERSION_10_2, 1280, 800, RNS_UD_COLOR_8BPP,
-		RNS_UD_SAS_DEL, KeyboardLayout(kbdLayout), 22621, ClientName, keyboardType,
+		RNS_UD_SAS_DEL, KeyboardLayout(kbdLayout), 22621, [32]byte{}, keyboardType,
 		keyboardSubType, 12, [64]byte{}, RNS_UD_COLOR_8BPP, 1, 0, HIGH_COLOR_24BPP,
 		RNS_UD_15BPP_SUPPORT | RNS_UD_16BPP_SUPPORT | RNS_UD_24BPP_SUPPORT | RNS_UD_32BPP_SUPPORT,
-		RNS_UD_CS_SUPPORT_ERRINFO_PDU | RNS_UD_CS_WANT_32BPP_SESSION | RNS_UD_CS_VALID_CONNECTION_TYPE | RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT,
-		[64]byte{}, uint8(CONNECTION_TYPE_LAN), 0, 0}
+		RNS_UD_CS_SUPPORT_ERRINFO_PDU | RNS_UD_CS_WANT_32BPP_SESSION | RNS_UD_CS_VALID_CONNECTION_TYPE | RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT |
+			RNS_UD_CS_SUPPORT_HEARTBEAT_PDU,
+		[64]byte{}, uint8(CONNECTION_TYPE_LAN), 0, 0,
+		0, 0, ORIENTATION_LANDSCAPE, 0, 0}
+	data.SetClientName(name)
+	return data
+}
+
+// SetColorDepth requests a session colour depth of bpp (8, 15, 16, 24 or
+// 32) in highColorDepth and the RNS_UD_CS_WANT_32BPP_SESSION flag.
+func (data *ClientCoreData) SetColorDepth(bpp int) {
+	data.EarlyCapabilityFlags &^= RNS_UD_CS_WANT_32BPP_SESSION
+	switch bpp {
+	case 8:
+		data.HighColorDepth = HIGH_COLOR_8BPP
+	case 15:
+		data.HighColorDepth = HIGH_COLOR_15BPP
+	case 16:
+		data.HighColorDepth = HIGH_COLOR_16BPP
+	case 32:
+		data.HighColorDepth = HIGH_COLOR_24BPP
+		data.EarlyCapabilityFlags |= RNS_UD_CS_WANT_32BPP_SESSION
+	default:
+		data.HighColorDepth = HIGH_COLOR_24BPP
+	}
+}
+
+// SetClientName stores name as the null-terminated UTF-16 clientName,
+// truncated to the 15 characters the field can hold.
+func (data *ClientCoreData) SetClientName(name string) {
+	u := utf16.Encode([]rune(name))
+	if len(u) > 15 {
+		u = u[:15]
+	}
+	data.ClientName = [32]byte{}
+	for i, ch := range u {
+		binary.LittleEndian.PutUint16(data.ClientName[2*i:], ch)
+	}
 }
 
 func (data *ClientCoreData) Pack() []byte {
@@ -275,7 +333,16 @@ func (data *ClientCoreData) Pack() []byte {
 	core.WriteUInt16LE(CS_CORE, buff) // 01C0
 	core.WriteUInt16LE(0xd8, buff)    // d800
 	struc.Pack(buff, data)
-	return buff.Bytes()
+	if data.DesktopScaleFactor != 0 {
+		core.WriteUInt32LE(data.DesktopPhysicalWidth, buff)
+		core.WriteUInt32LE(data.DesktopPhysicalHeight, buff)
+		core.WriteUInt16LE(data.DesktopOrientation, buff)
+		core.WriteUInt32LE(data.DesktopScaleFactor, buff)
+		core.WriteUInt32LE(data.DeviceScaleFactor, buff)
+	}
+	b := buff.Bytes()
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
 }
 
 type ClientNetworkData struct {
@@ -332,7 +399,7 @@ type ClientSecurityData struct {
 
 func NewClientSecurityData() *ClientSecurityData {
 	return &ClientSecurityData{
-		ENCRYPTION_FLAG_40BIT | ENCRYPTION_FLAG_56BIT | ENCRYPTION_FLAG_128BIT,
+		ENCRYPTION_FLAG_40BIT | ENCRYPTION_FLAG_56BIT | ENCRYPTION_FLAG_128BIT | FIPS_ENCRYPTION_FLAG,
 		00}
 }
 
@@ -345,6 +412,90 @@ func (d *ClientSecurityData) Pack() []byte {
 	return buff.Bytes()
 }
 
+/**
+ * @see https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/c3964b39-3d54-4ae1-a84a-ceaed311e0f6
+ */
+const (
+	TS_MONITOR_PRIMARY uint32 = 0x00000001
+	MONITOR_MAX_COUNT         = 16
+)
+
+// MonitorDef is a TS_MONITOR_DEF: the inclusive bounds of one monitor in
+// virtual desktop coordinates, where the primary monitor is at 0,0.
+type MonitorDef struct {
+	Left   int32
+	Top    int32
+	Right  int32
+	Bottom int32
+	Flags  uint32
+}
+
+// ReadMonitorDef reads a TS_MONITOR_DEF, as also found in the server
+// Monitor Layout PDU.
+func ReadMonitorDef(r io.Reader) (m MonitorDef, err error) {
+	var v [5]uint32
+	for i := range v {
+		if v[i], err = core.ReadUInt32LE(r); err != nil {
+			return m, err
+		}
+	}
+	return MonitorDef{int32(v[0]), int32(v[1]), int32(v[2]), int32(v[3]), v[4]}, nil
+}
+
+type ClientMonitorData struct {
+	Flags    uint32
+	Monitors []MonitorDef
+}
+
+func (d *ClientMonitorData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(CS_MONITOR, buff) // type
+	core.WriteUInt16LE(uint16(12+20*len(d.Monitors)), buff)
+	core.WriteUInt32LE(d.Flags, buff)
+	core.WriteUInt32LE(uint32(len(d.Monitors)), buff)
+	for _, m := range d.Monitors {
+		core.WriteUInt32LE(uint32(m.Left), buff)
+		core.WriteUInt32LE(uint32(m.Top), buff)
+		core.WriteUInt32LE(uint32(m.Right), buff)
+		core.WriteUInt32LE(uint32(m.Bottom), buff)
+		core.WriteUInt32LE(m.Flags, buff)
+	}
+	return buff.Bytes()
+}
+
+// MonitorAttributes is a TS_MONITOR_ATTRIBUTES: the physical size in
+// millimetres, ORIENTATION_* and scale factors in percent of a monitor.
+type MonitorAttributes struct {
+	PhysicalWidth      uint32
+	PhysicalHeight     uint32
+	Orientation        uint32
+	DesktopScaleFactor uint32
+	DeviceScaleFactor  uint32
+}
+
+// ClientMonitorExtendedData carries the attributes of the monitors of the
+// Client Monitor Data, in the same order.
+type ClientMonitorExtendedData struct {
+	Monitors []MonitorAttributes
+}
+
+func (d *ClientMonitorExtendedData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(CS_MONITOR_EX, buff) // type
+	core.WriteUInt16LE(uint16(16+20*len(d.Monitors)), buff)
+	core.WriteUInt32LE(0, buff)  // flags
+	core.WriteUInt32LE(20, buff) // monitorAttributeSize
+	core.WriteUInt32LE(uint32(len(d.Monitors)), buff)
+	for _, m := range d.Monitors {
+		core.WriteUInt32LE(m.PhysicalWidth, buff)
+		core.WriteUInt32LE(m.PhysicalHeight, buff)
+		core.WriteUInt32LE(m.Orientation, buff)
+		core.WriteUInt32LE(m.DesktopScaleFactor, buff)
+		core.WriteUInt32LE(m.DeviceScaleFactor, buff)
+	}
+	return buff.Bytes()
+}
+
 type RSAPublicKey struct {
 	Magic   uint32 `struc:"little"` //0x31415352
 	Keylen  uint32 `struc:"little,sizeof=Modulus"`
@@ -366,21 +517,71 @@ type ProprietaryServerCertificate struct {
 	SignatureBlob     []byte       `struc:"little"`
 	//PaddingLen        uint16       `struc:"little,sizeof=Padding,skip"`
 	Padding []byte `struc:"[8]byte"`
+
+	// dwVersion and signedData are the bytes covered by SignatureBlob,
+	// from dwVersion of the enclosing SERVER_CERTIFICATE to the end of
+	// PublicKeyBlob.
+	dwVersion  uint32
+	signedData []byte
+}
+
+/**
+ * Terminal Services signing key, whose private half is public as well
+ * @see https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/05b7ea7d-5ffe-4a5e-b962-1ca45d36ae6c
+ */
+var tsskPublicKey = &rsa.PublicKey{
+	N: new(big.Int).SetBytes(core.Reverse([]byte{
+		0x3d, 0x3a, 0x5e, 0xbd, 0x72, 0x43, 0x3e, 0xc9, 0x4d, 0xbb, 0xc1, 0x1e, 0x4a, 0xba, 0x5f, 0xcb,
+		0x3e, 0x88, 0x20, 0x87, 0xef, 0xf5, 0xc1, 0xe2, 0xd7, 0xb7, 0x6b, 0x9a, 0xf2, 0x52, 0x45, 0x95,
+		0xce, 0x63, 0x65, 0x6b, 0x58, 0x3a, 0xfe, 0xef, 0x7c, 0xe7, 0xbf, 0xfe, 0x3d, 0xf6, 0x5c, 0x7d,
+		0x6c, 0x5e, 0x06, 0x09, 0x1a, 0xf5, 0x61, 0xbb, 0x20, 0x93, 0x09, 0x5f, 0x05, 0x6d, 0xea, 0x87,
+	})),
+	E: 0xc0887b5b,
 }
 
+const tsskKeyLength = 64
+
 func (p *ProprietaryServerCertificate) GetPublicKey() (*rsa.PublicKey, error) {
 	b := new(big.Int).SetBytes(core.Reverse(p.PublicKeyBlob.Modulus))
 	e := new(big.Int).SetInt64(int64(p.PublicKeyBlob.PubExp))
 	return &rsa.PublicKey{N: b, E: int(e.Int64())}, nil
 }
-func (p *ProprietaryServerCertificate) Verify() bool {
-	return true
+
+// Verify checks that SignatureBlob is the Terminal Services signing key
+// signature of the certificate (MS-RDPBCGR 5.3.3.1.3).
+func (p *ProprietaryServerCertificate) Verify() error {
+	if len(p.SignatureBlob) != tsskKeyLength {
+		return fmt.Errorf("proprietary certificate: signature of %d bytes", len(p.SignatureBlob))
+	}
+	h := md5.New()
+	binary.Write(h, binary.LittleEndian, p.dwVersion)
+	h.Write(p.signedData)
+	hash := h.Sum(nil)
+
+	// textbook RSA in little-endian byte order
+	c := new(big.Int).SetBytes(core.Reverse(p.SignatureBlob))
+	m := new(big.Int).Exp(c, big.NewInt(int64(tsskPublicKey.E)), tsskPublicKey.N)
+	sig := core.Reverse(m.FillBytes(make([]byte, tsskKeyLength)))
+
+	// MD5 hash, 0x00, 0xff padding, 0x01
+	ok := bytes.Equal(sig[:16], hash) && sig[16] == 0x00 && sig[62] == 0x01
+	for _, b := range sig[17:62] {
+		ok = ok && b == 0xff
+	}
+	if !ok {
+		return errors.New("proprietary certificate: bad signature")
+	}
+	return nil
 }
 func (p *ProprietaryServerCertificate) Encrypt() []byte {
 	//todo
 	return nil
 }
 func (p *ProprietaryServerCertificate) Unpack(r io.Reader) error {
+	signed := &bytes.Buffer{}
+	body := core.NewErrReader(r)
+	tee := core.NewErrReader(io.TeeReader(body, signed))
+	r = tee
 	p.DwSigAlgId, _ = core.ReadUInt32LE(r)
 	p.DwKeyAlgId, _ = core.ReadUInt32LE(r)
 	p.PublicKeyBlobType, _ = core.ReadUint16LE(r)
@@ -391,15 +592,25 @@ func (p *ProprietaryServerCertificate) Unpack(r io.Reader) error {
 	b.Bitlen, _ = core.ReadUInt32LE(r)
 	b.Datalen, _ = core.ReadUInt32LE(r)
 	b.PubExp, _ = core.ReadUInt32LE(r)
-	b.Modulus, _ = core.ReadBytes(int(b.Keylen)-8, r)
+	// read from body, which knows its length, for ReadBytes to reject a
+	// keylen past the end
+	if tee.Err() == nil {
+		b.Modulus, _ = core.ReadBytes(int(b.Keylen)-8, body)
+		signed.Write(b.Modulus)
+	}
 	b.Padding, _ = core.ReadBytes(8, r)
 	p.PublicKeyBlob = b
+	p.signedData = signed.Bytes()
+	r = body
 	p.SignatureBlobType, _ = core.ReadUint16LE(r)
 	p.SignatureBlobLen, _ = core.ReadUint16LE(r)
 	p.SignatureBlob, _ = core.ReadBytes(int(p.SignatureBlobLen)-8, r)
 	p.Padding, _ = core.ReadBytes(8, r)
 
-	return nil
+	if err := tee.Err(); err != nil {
+		return err
+	}
+	return body.Err()
 }
 
 type CertBlob struct {
@@ -413,12 +624,21 @@ type X509CertificateChain struct {
 }
 
 func (x *X509CertificateChain) GetPublicKey() (*rsa.PublicKey, error) {
+	if len(x.CertBlobArray) == 0 {
+		return nil, errors.New("empty certificate chain")
+	}
 	data := x.CertBlobArray[len(x.CertBlobArray)-1].AbCert
 	cert, err := x509.ParseCertificate(data)
 	if err != nil {
-		slog.Error("X509 ParseCertificate", "err", err)
-		return nil, err
+		return nil, fmt.Errorf("x509 certificate: %w", err)
 	}
+	return certPublicKey(cert)
+}
+
+// certPublicKey returns the RSA key of cert, also when it uses an RSA
+// algorithm identifier crypto/x509 does not know.
+func certPublicKey(cert *x509.Certificate) (*rsa.PublicKey, error) {
+	var err error
 	var rsaPublicKey *rsa.PublicKey
 	if cert.PublicKey == nil {
 		var pubKeyInfo struct {
@@ -434,20 +654,101 @@ func (x *X509CertificateChain) GetPublicKey() (*rsa.PublicKey, error) {
 			return nil, err
 		}
 	} else {
-		rsaPublicKey = cert.PublicKey.(*rsa.PublicKey)
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("unsupported public key %T", cert.PublicKey)
+		}
+		rsaPublicKey = pub
 	}
 
 	return rsaPublicKey, nil
 }
-func (x *X509CertificateChain) Verify() bool {
-	return true
+
+// Signature algorithms found in license server certificate chains; the
+// OIW sha1WithRSA identifier is one crypto/x509 does not parse.
+var (
+	oidMD5WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 4}
+	oidSHA1WithRSA    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSHA256WithRSA  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidOIWSHA1WithRSA = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 29}
+)
+
+// Verify checks that the chain, root first, is linked by signatures: the
+// root is self-signed and each certificate is signed by the previous one.
+// SHA-1 and MD5 signatures are checked directly since crypto/x509 refuses
+// them.  No trust anchor is involved; the root is issued by the license
+// server.
+func (x *X509CertificateChain) Verify() error {
+	if len(x.CertBlobArray) == 0 {
+		return errors.New("empty certificate chain")
+	}
+	certs := make([]*x509.Certificate, len(x.CertBlobArray))
+	for i, blob := range x.CertBlobArray {
+		cert, err := x509.ParseCertificate(blob.AbCert)
+		if err != nil {
+			return fmt.Errorf("certificate %d: %w", i, err)
+		}
+		certs[i] = cert
+	}
+	for i, cert := range certs {
+		issuer := cert
+		if i > 0 {
+			issuer = certs[i-1]
+		}
+		pub, err := certPublicKey(issuer)
+		if err != nil {
+			return fmt.Errorf("certificate %d issuer: %w", i, err)
+		}
+		if err := checkCertSignature(cert, pub); err != nil {
+			return fmt.Errorf("certificate %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func checkCertSignature(cert *x509.Certificate, pub *rsa.PublicKey) error {
+	var raw struct {
+		TBS       asn1.RawValue
+		Algorithm pkix.AlgorithmIdentifier
+		Signature asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(cert.Raw, &raw); err != nil {
+		return err
+	}
+	var hash crypto.Hash
+	switch alg := raw.Algorithm.Algorithm; {
+	case alg.Equal(oidMD5WithRSA):
+		hash = crypto.MD5
+	case alg.Equal(oidSHA1WithRSA), alg.Equal(oidOIWSHA1WithRSA):
+		hash = crypto.SHA1
+	case alg.Equal(oidSHA256WithRSA):
+		hash = crypto.SHA256
+	default:
+		return fmt.Errorf("unsupported signature algorithm %v", alg)
+	}
+	h := hash.New()
+	h.Write(cert.RawTBSCertificate)
+	if err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), raw.Signature.RightAlign()); err != nil {
+		return fmt.Errorf("bad signature: %w", err)
+	}
+	return nil
 }
 func (x *X509CertificateChain) Encrypt() []byte {
 	//todo
 	return nil
 }
 func (x *X509CertificateChain) Unpack(r io.Reader) error {
-	return struc.Unpack(r, x)
+	er := core.NewErrReader(r)
+	n, _ := core.ReadUInt32LE(er)
+	for i := uint32(0); i < n && er.Err() == nil; i++ {
+		var c CertBlob
+		c.CbCert, _ = core.ReadUInt32LE(er)
+		c.AbCert, _ = core.ReadBytes(int(c.CbCert), er)
+		x.CertBlobArray = append(x.CertBlobArray, c)
+	}
+	x.NumCertBlobs = n
+	x.Padding, _ = core.ReadBytes(12, er)
+	return er.Err()
 }
 
 type ServerCoreData struct {
@@ -469,8 +770,12 @@ func (d *ServerCoreData) ScType() Message {
 	return SC_CORE
 }
 func (d *ServerCoreData) Unpack(r io.Reader) error {
-	version, _ := core.ReadUInt32LE(r)
+	version, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
 	d.RdpVersion = VERSION(version)
+	// clientRequestedProtocols and earlyCapabilityFlags are optional.
 	d.ClientRequestedProtocol, _ = core.ReadUInt32LE(r)
 	d.EarlyCapabilityFlags, _ = core.ReadUInt32LE(r)
 
@@ -496,7 +801,8 @@ func (d *ServerNetworkData) Unpack(r io.Reader) error {
 
 type CertData interface {
 	GetPublicKey() (*rsa.PublicKey, error)
-	Verify() bool
+	// Verify checks the certificate signature.
+	Verify() error
 	Unpack(io.Reader) error
 }
 type ServerCertificate struct {
@@ -505,25 +811,24 @@ type ServerCertificate struct {
 }
 
 func (sc *ServerCertificate) Unpack(r io.Reader) error {
-	sc.DwVersion, _ = core.ReadUInt32LE(r)
+	var err error
+	if sc.DwVersion, err = core.ReadUInt32LE(r); err != nil {
+		return err
+	}
 	var cd CertData
 	switch CertificateType(sc.DwVersion & 0x7fffffff) {
 	case CERT_CHAIN_VERSION_1:
-		slog.Debug("ProprietaryServerCertificate")
 		cd = &ProprietaryServerCertificate{}
 	case CERT_CHAIN_VERSION_2:
-		slog.Debug("X509CertificateChain")
 		cd = &X509CertificateChain{}
 	default:
-		slog.Error("Unpack", "Unsupported version", sc.DwVersion&0x7fffffff)
-		return errors.New("Unsupported version")
+		return fmt.Errorf("unsupported server certificate version %d", sc.DwVersion&0x7fffffff)
 	}
-	if cd != nil {
-		err := cd.Unpack(r)
-		if err != nil {
-			slog.Error("Unpack", "err", err)
-			return err
-		}
+	if err := cd.Unpack(r); err != nil {
+		return fmt.Errorf("%T: %w", cd, err)
+	}
+	if p, ok := cd.(*ProprietaryServerCertificate); ok {
+		p.dwVersion = sc.DwVersion
 	}
 	sc.CertData = cd
 
@@ -547,6 +852,8 @@ func (d *ServerSecurityData) ScType() Message {
 	return SC_SECURITY
 }
 func (s *ServerSecurityData) Unpack(r io.Reader) error {
+	er := core.NewErrReader(r)
+	r = er
 	s.EncryptionMethod, _ = core.ReadUInt32LE(r)
 	s.EncryptionLevel, _ = core.ReadUInt32LE(r)
 	if !(s.EncryptionMethod == 0 && s.EncryptionLevel == 0) {
@@ -555,6 +862,9 @@ func (s *ServerSecurityData) Unpack(r io.Reader) error {
 		s.ServerRandom, _ = core.ReadBytes(int(s.ServerRandomLen), r)
 		var sc ServerCertificate
 		data, _ := core.ReadBytes(int(s.ServerCertLen), r)
+		if err := er.Err(); err != nil {
+			return err
+		}
 		rd := bytes.NewReader(data)
 		err := sc.Unpack(rd)
 		if err != nil {
@@ -563,11 +873,12 @@ func (s *ServerSecurityData) Unpack(r io.Reader) error {
 		s.ServerCertificate = sc
 	}
 
-	return nil
+	return er.Err()
 }
 
 // ServerMsgChannelData holds the message channel ID allocated by the server
-// (TS_UD_SC_MCS_MSGCHANNEL). Used for connect-time network auto-detection.
+// (TS_UD_SC_MCS_MSGCHANNEL). It carries network auto-detection,
+// heartbeat and multitransport PDUs.
 type ServerMsgChannelData struct {
 	MCSChannelId uint16
 }
@@ -584,7 +895,7 @@ func (d *ServerMsgChannelData) Unpack(r io.Reader) error {
 
 // PackClientMsgChannelData serialises the TS_UD_CS_MCS_MSGCHANNEL block.
 // Advertising this block requests that the server allocate a dedicated message
-// channel for connect-time network auto-detection (RTT/BW measurements).
+// channel for network auto-detection (RTT/BW measurements) and heartbeats.
 func PackClientMsgChannelData() []byte {
 	buff := &bytes.Buffer{}
 	core.WriteUInt16LE(CS_MCS_MSGCHANNEL, buff) // type 0xC006
@@ -614,34 +925,62 @@ type ScData interface {
 	Unpack(io.Reader) error
 }
 
-func ReadConferenceCreateResponse(data []byte) []any {
-	ret := make([]any, 0, 3)
-
-	r := bytes.NewReader(data)
+// ReadConferenceCreateResponse parses the GCC Conference Create Response
+// carried in the MCS Connect Response and returns the server data blocks
+// it knows.  Unknown blocks are skipped, logged to log, and known blocks
+// may be longer than the fields the client reads.
+func ReadConferenceCreateResponse(data []byte, log *slog.Logger) ([]any, error) {
+	r := core.NewErrReader(bytes.NewReader(data))
 	per.ReadChoice(r)
 	if !per.ReadObjectIdentifier(r, t124_02_98_oid) {
-		slog.Error("NODE_RDP_PROTOCOL_T125_GCC_BAD_OBJECT_IDENTIFIER_T124")
-		return ret
+		return nil, errors.New("NODE_RDP_PROTOCOL_T125_GCC_BAD_OBJECT_IDENTIFIER_T124")
 	}
 	per.ReadLength(r)
 	per.ReadChoice(r)
 	per.ReadInteger16(r)
-	per.ReadInteger(r)
+	if _, err := per.ReadInteger(r); err != nil {
+		return nil, fmt.Errorf("conference tag: %w", err)
+	}
 	per.ReadEnumerates(r)
 	per.ReadNumberOfSet(r)
 	per.ReadChoice(r)
 
 	if !per.ReadOctetStream(r, h221_sc_key, 4) {
-		slog.Error("NODE_RDP_PROTOCOL_T125_GCC_BAD_H221_SC_KEY")
-		return ret
+		return nil, errors.New("NODE_RDP_PROTOCOL_T125_GCC_BAD_H221_SC_KEY")
+	}
+
+	ln, err := per.ReadLength(r)
+	if err != nil {
+		return nil, fmt.Errorf("user data length: %w", err)
+	}
+	userData, err := core.ReadBytes(int(ln), r)
+	if err != nil {
+		return nil, fmt.Errorf("user data: %w", err)
 	}
+	return parseServerData(userData, log)
+}
+
+// ParseServerData parses the user data blocks of the server settings in
+// a Conference Create Response: *ServerCoreData, *ServerSecurityData,
+// *ServerNetworkData and *ServerMsgChannelData.  Blocks of other types
+// are skipped.
+func ParseServerData(userData []byte) ([]any, error) {
+	return parseServerData(userData, core.DefaultLogger)
+}
 
-	ln, _ := per.ReadLength(r)
-	for ln > 0 {
-		t, _ := core.ReadUint16LE(r)
-		l, _ := core.ReadUint16LE(r)
-		dataBytes, _ := core.ReadBytes(int(l)-4, r)
-		ln = ln - l
+func parseServerData(userData []byte, log *slog.Logger) ([]any, error) {
+	ret := make([]any, 0, 3)
+	for len(userData) > 0 {
+		if len(userData) < 4 {
+			return nil, fmt.Errorf("truncated user data block header")
+		}
+		t := binary.LittleEndian.Uint16(userData)
+		l := int(binary.LittleEndian.Uint16(userData[2:]))
+		if l < 4 || l > len(userData) {
+			return nil, fmt.Errorf("user data block 0x%04x: bad length %d", t, l)
+		}
+		dataBytes := userData[4:l]
+		userData = userData[l:]
 		var d ScData
 		switch Message(t) {
 		case SC_CORE:
@@ -653,19 +992,15 @@ func ReadConferenceCreateResponse(data []byte) []any {
 		case SC_MCS_MSGCHANNEL:
 			d = &ServerMsgChannelData{}
 		default:
-			slog.Debug("ReadConferenceCreateResponse: ignoring unknown block", "type", t)
+			log.Debug("ParseServerData: ignoring unknown block", "type", t)
 			continue
 		}
 
-		if d != nil {
-			r := bytes.NewReader(dataBytes)
-			err := d.Unpack(r)
-			if err != nil {
-				slog.Warn("ReadConferenceCreateResponse", "err", err)
-			}
-			ret = append(ret, d)
+		if err := d.Unpack(bytes.NewReader(dataBytes)); err != nil {
+			return nil, fmt.Errorf("user data block 0x%04x: %w", t, err)
 		}
+		ret = append(ret, d)
 	}
 
-	return ret
+	return ret, nil
 }
@@ -0,0 +1,216 @@
+package gcc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+)
+
+// tsskPrivateExponent is published alongside the signing key so servers
+// can sign their proprietary certificates.
+var tsskPrivateExponent = new(big.Int).SetBytes(core.Reverse([]byte{
+	0x87, 0xa7, 0x19, 0x32, 0xda, 0x11, 0x87, 0x55, 0x58, 0x00, 0x16, 0x16, 0x25, 0x65, 0x68, 0xf8,
+	0x24, 0x3e, 0xe6, 0xfa, 0xe9, 0x67, 0x49, 0x94, 0xcf, 0x92, 0xcc, 0x33, 0x99, 0xe8, 0x08, 0x60,
+	0x17, 0x9a, 0x12, 0x9f, 0x24, 0xdd, 0xb1, 0x24, 0x99, 0xc7, 0x3a, 0xb8, 0x0a, 0x7b, 0x0d, 0xdd,
+	0x35, 0x07, 0x79, 0x17, 0x0b, 0x51, 0x9b, 0xb3, 0xc7, 0x10, 0x01, 0x13, 0xe7, 0x3f, 0xf3, 0x5f,
+}))
+
+// proprietaryCertificate returns a SERVER_CERTIFICATE signed with the
+// Terminal Services signing key.
+func proprietaryCertificate() []byte {
+	b := &bytes.Buffer{}
+	w := func(v any) { binary.Write(b, binary.LittleEndian, v) }
+	w(uint32(CERT_CHAIN_VERSION_1))
+	w([2]uint32{1, 1})           // dwSigAlgId, dwKeyAlgId
+	w([2]uint16{6, 20 + 64 + 8}) // BB_RSA_KEY_BLOB
+	w([5]uint32{0x31415352, 72, 512, 63, 65537})
+	b.Write(bytes.Repeat([]byte{0xab}, 64))
+	b.Write(make([]byte, 8))
+
+	hash := md5.Sum(b.Bytes())
+	sig := make([]byte, 64)
+	copy(sig, hash[:])
+	for i := 17; i < 62; i++ {
+		sig[i] = 0xff
+	}
+	sig[62] = 0x01
+	m := new(big.Int).SetBytes(core.Reverse(sig))
+	signature := core.Reverse(new(big.Int).Exp(m, tsskPrivateExponent, tsskPublicKey.N).FillBytes(make([]byte, 64)))
+
+	w([2]uint16{8, 64 + 8}) // BB_RSA_SIGNATURE_BLOB
+	b.Write(signature)
+	b.Write(make([]byte, 8))
+	return b.Bytes()
+}
+
+func TestProprietaryCertificateVerify(t *testing.T) {
+	raw := proprietaryCertificate()
+	var sc ServerCertificate
+	if err := sc.Unpack(bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.CertData.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw[40] ^= 1 // modulus
+	if err := sc.Unpack(bytes.NewReader(raw)); err != nil {
+		t.Fatal(err)
+	}
+	if sc.CertData.Verify() == nil {
+		t.Error("tampered certificate verified")
+	}
+}
+
+func TestX509ChainVerify(t *testing.T) {
+	rootKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	leafKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	root, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &rootKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootCert, _ := x509.ParseCertificate(root)
+	leaf, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{SerialNumber: big.NewInt(2)}, rootCert, &leafKey.PublicKey, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain := &X509CertificateChain{CertBlobArray: []CertBlob{{AbCert: root}, {AbCert: leaf}}}
+	if err := chain.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	chain.CertBlobArray[0], chain.CertBlobArray[1] = chain.CertBlobArray[1], chain.CertBlobArray[0]
+	if chain.Verify() == nil {
+		t.Error("reversed chain verified")
+	}
+}
+
+func TestClientMonitorData(t *testing.T) {
+	d := &ClientMonitorData{Monitors: []MonitorDef{
+		{Left: 0, Top: 0, Right: 1919, Bottom: 1079, Flags: TS_MONITOR_PRIMARY},
+		{Left: -1280, Top: 0, Right: -1, Bottom: 1023},
+	}}
+	b := d.Pack()
+	if len(b) != 52 || binary.LittleEndian.Uint16(b) != CS_MONITOR || binary.LittleEndian.Uint16(b[2:]) != 52 {
+		t.Fatalf("header % x", b[:min(len(b), 12)])
+	}
+	if n := binary.LittleEndian.Uint32(b[8:]); n != 2 {
+		t.Errorf("monitorCount %d", n)
+	}
+	r := bytes.NewReader(b[12:])
+	for i, want := range d.Monitors {
+		got, err := ReadMonitorDef(r)
+		if err != nil || got != want {
+			t.Errorf("monitor %d: got %+v, %v", i, got, err)
+		}
+	}
+}
+
+func TestClientCoreDataScale(t *testing.T) {
+	d := NewClientCoreData(0x409, 4, 0)
+	if b := d.Pack(); len(b) != 0xd8 || binary.LittleEndian.Uint16(b[2:]) != 0xd8 {
+		t.Fatalf("core data of %d bytes without scale factors", len(b))
+	}
+	d.DesktopScaleFactor, d.DeviceScaleFactor = 150, 140
+	b := d.Pack()
+	if len(b) != 0xd8+18 || binary.LittleEndian.Uint16(b[2:]) != uint16(len(b)) {
+		t.Fatalf("core data of %d bytes, header says %d", len(b), binary.LittleEndian.Uint16(b[2:]))
+	}
+	if s := binary.LittleEndian.Uint32(b[0xd8+10:]); s != 150 {
+		t.Errorf("desktopScaleFactor %d", s)
+	}
+	if s := binary.LittleEndian.Uint32(b[0xd8+14:]); s != 140 {
+		t.Errorf("deviceScaleFactor %d", s)
+	}
+
+	ex := (&ClientMonitorExtendedData{Monitors: []MonitorAttributes{{DesktopScaleFactor: 200, DeviceScaleFactor: 180}}}).Pack()
+	if len(ex) != 36 || binary.LittleEndian.Uint16(ex) != CS_MONITOR_EX || binary.LittleEndian.Uint16(ex[2:]) != 36 ||
+		binary.LittleEndian.Uint32(ex[8:]) != 20 || binary.LittleEndian.Uint32(ex[28:]) != 200 {
+		t.Errorf("monitor extended data % x", ex)
+	}
+}
+
+// conferenceCreateResponse wraps server user data blocks in a GCC
+// Conference Create Response.
+func conferenceCreateResponse(userData []byte) []byte {
+	b := []byte{0x00, 0x05, 0x00, 0x14, 0x7c, 0x00, 0x01} // choice, t124 OID
+	inner := []byte{0x14, 0x76, 0x0a, 0x01, 0x01, 0x00, 0x01, 0xc0, 0x00, 'M', 'c', 'D', 'n'}
+	inner = append(inner, 0x80|byte(len(userData)>>8), byte(len(userData)))
+	inner = append(inner, userData...)
+	b = append(b, 0x80|byte(len(inner)>>8), byte(len(inner)))
+	return append(b, inner...)
+}
+
+func TestReadConferenceCreateResponse(t *testing.T) {
+	block := func(typ Message, body ...byte) []byte {
+		return append(binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, uint16(typ)), uint16(4+len(body))), body...)
+	}
+	userData := bytes.Join([][]byte{
+		// A core block longer than the fields the client reads.
+		block(SC_CORE, 0x07, 0x00, 0x08, 0x00, 0x01, 0, 0, 0, 0x01, 0, 0, 0, 0xaa, 0xbb, 0xcc, 0xdd),
+		block(0x0C08, 0, 0, 0, 0), // multitransport, not parsed
+		block(SC_NET, 0xeb, 0x03, 0x03, 0x00, 0xec, 0x03, 0xed, 0x03, 0xee, 0x03, 0, 0),
+		block(SC_MCS_MSGCHANNEL, 0xef, 0x03),
+	}, nil)
+	got, err := ReadConferenceCreateResponse(conferenceCreateResponse(userData), core.DefaultLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(got))
+	}
+	if core, ok := got[0].(*ServerCoreData); !ok || core.RdpVersion != RDP_VERSION_10_2 || core.ClientRequestedProtocol != 1 {
+		t.Errorf("core = %+v", got[0])
+	}
+	if net, ok := got[1].(*ServerNetworkData); !ok || net.MCSChannelId != 1003 || len(net.ChannelIdArray) != 3 || net.ChannelIdArray[2] != 1006 {
+		t.Errorf("net = %+v", got[1])
+	}
+	if msg, ok := got[2].(*ServerMsgChannelData); !ok || msg.MCSChannelId != 1007 {
+		t.Errorf("msgchannel = %+v", got[2])
+	}
+
+	// A block running past the end of the user data.
+	bad := append(block(SC_CORE, 0x0c, 0x00, 0x08, 0x00), 0x02, 0x0c, 0xff, 0x00)
+	if _, err := ReadConferenceCreateResponse(conferenceCreateResponse(bad), core.DefaultLogger); err == nil {
+		t.Error("truncated block accepted")
+	}
+}
+
+func FuzzReadConferenceCreateResponse(f *testing.F) {
+	block := func(typ Message, body ...byte) []byte {
+		return append(binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, uint16(typ)), uint16(4+len(body))), body...)
+	}
+	f.Add(conferenceCreateResponse(bytes.Join([][]byte{
+		block(SC_CORE, 0x04, 0x00, 0x08, 0x00, 0x01, 0, 0, 0),
+		block(SC_SECURITY, 0, 0, 0, 0, 0, 0, 0, 0),
+		block(SC_NET, 0xeb, 0x03, 0x01, 0x00, 0xec, 0x03, 0, 0),
+		block(SC_MCS_MSGCHANNEL, 0xef, 0x03),
+	}, nil)))
+	// a proprietary certificate with Standard RDP Security
+	sec := binary.LittleEndian.AppendUint32(nil, uint32(ENCRYPTION_FLAG_128BIT))
+	sec = binary.LittleEndian.AppendUint32(sec, uint32(ENCRYPTION_LEVEL_CLIENT_COMPATIBLE))
+	sec = binary.LittleEndian.AppendUint32(sec, 32)
+	cert := proprietaryCertificate()
+	sec = binary.LittleEndian.AppendUint32(sec, uint32(len(cert)))
+	sec = append(append(sec, make([]byte, 32)...), cert...)
+	f.Add(conferenceCreateResponse(block(SC_SECURITY, sec...)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadConferenceCreateResponse(data, core.DefaultLogger)
+		ParseServerData(data)
+	})
+}
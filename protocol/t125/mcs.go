@@ -7,6 +7,7 @@ import (
 	"io"
 	"log/slog"
 	"reflect"
+	"sync"
 	"time"
 
 	//	"github.com/nakagami/grdp/plugin/cliprdr"
@@ -45,6 +46,18 @@ const (
 	SEND_DATA_INDICATION                       = 26
 )
 
+/**
+ * Reason of a Disconnect Provider Ultimatum
+ * @see T.125 section 7, Reason
+ */
+const (
+	RN_DOMAIN_DISCONNECTED uint8 = 0
+	RN_PROVIDER_INITIATED        = 1
+	RN_TOKEN_PURGED              = 2
+	RN_USER_REQUESTED            = 3
+	RN_CHANNEL_PURGED            = 4
+)
+
 const (
 	MCS_GLOBAL_CHANNEL_ID uint16 = 1003
 	MCS_USERCHANNEL_BASE         = 1001
@@ -110,20 +123,18 @@ func (d *DomainParameters) BER() []byte {
 }
 
 func ReadDomainParameters(r io.Reader) (*DomainParameters, error) {
-	if !ber.ReadUniversalTag(ber.TAG_SEQUENCE, true, r) {
-		return nil, errors.New("bad BER tags")
+	data, err := ber.ReadSequence(r)
+	if err != nil {
+		return nil, fmt.Errorf("domain parameters: %w", err)
 	}
+	sr := bytes.NewReader(data)
 	d := &DomainParameters{}
-	ber.ReadLength(r)
-
-	d.MaxChannelIds, _ = ber.ReadInteger(r)
-	d.MaxUserIds, _ = ber.ReadInteger(r)
-	d.MaxTokenIds, _ = ber.ReadInteger(r)
-	ber.ReadInteger(r)
-	ber.ReadInteger(r)
-	ber.ReadInteger(r)
-	d.MaxMCSPDUsize, _ = ber.ReadInteger(r)
-	ber.ReadInteger(r)
+	for _, p := range []*int{&d.MaxChannelIds, &d.MaxUserIds, &d.MaxTokenIds,
+		&d.NumPriorities, &d.MinThoughput, &d.MaxHeight, &d.MaxMCSPDUsize, &d.ProtocolVersion} {
+		if *p, err = ber.ReadInteger(sr); err != nil {
+			return nil, fmt.Errorf("domain parameters: %w", err)
+		}
+	}
 	return d, nil
 }
 
@@ -184,6 +195,8 @@ func NewConnectResponse(userData []byte) *ConnectResponse {
 }
 
 func ReadConnectResponse(r io.Reader) (*ConnectResponse, error) {
+	er := core.NewErrReader(r)
+	r = er
 	c := &ConnectResponse{}
 	var err error
 	_, err = ber.ReadApplicationTag(MCS_TYPE_CONNECT_RESPONSE, r)
@@ -194,23 +207,32 @@ func ReadConnectResponse(r io.Reader) (*ConnectResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.result != 0 {
+		return nil, fmt.Errorf("MCS connect response result %d", c.result)
+	}
 
 	c.calledConnectId, err = ber.ReadInteger(r)
+	if err != nil {
+		return nil, fmt.Errorf("calledConnectId: %w", err)
+	}
 	c.domainParameters, err = ReadDomainParameters(r)
 	if err != nil {
 		return nil, err
 	}
-	if !ber.ReadUniversalTag(ber.TAG_OCTET_STRING, false, r) {
-		return nil, errors.New("invalid expected BER tag")
+	c.userData, err = ber.ReadOctetString(r)
+	if err != nil {
+		return nil, fmt.Errorf("userData: %w", err)
 	}
-	dataLen, _ := ber.ReadLength(r)
-	c.userData, err = core.ReadBytes(dataLen, r)
-	return c, err
+	if err := er.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 type MCSChannelInfo struct {
-	ID   uint16
-	Name string
+	ID      uint16
+	Name    string
+	Options uint32
 }
 
 type MCS struct {
@@ -219,6 +241,7 @@ type MCS struct {
 	recvOpCode MCSDomainPDU
 	sendOpCode MCSDomainPDU
 	channels   []MCSChannelInfo
+	log        *slog.Logger
 }
 
 func NewMCS(t core.Transport, recvOpCode MCSDomainPDU, sendOpCode MCSDomainPDU) *MCS {
@@ -227,7 +250,8 @@ func NewMCS(t core.Transport, recvOpCode MCSDomainPDU, sendOpCode MCSDomainPDU)
 		t,
 		recvOpCode,
 		sendOpCode,
-		[]MCSChannelInfo{{MCS_GLOBAL_CHANNEL_ID, GLOBAL_CHANNEL_NAME}},
+		[]MCSChannelInfo{{ID: MCS_GLOBAL_CHANNEL_ID, Name: GLOBAL_CHANNEL_NAME}},
+		core.Logger(nil, "mcs"),
 	}
 
 	m.transport.On("close", func() {
@@ -238,6 +262,11 @@ func NewMCS(t core.Transport, recvOpCode MCSDomainPDU, sendOpCode MCSDomainPDU)
 	return m
 }
 
+// SetLogger makes the layer log to l, with the attribute layer=mcs.
+func (m *MCS) SetLogger(l *slog.Logger) {
+	m.log = core.Logger(l, "mcs")
+}
+
 func (x *MCS) Read(b []byte) (n int, err error) {
 	return x.transport.Read(b)
 }
@@ -250,11 +279,24 @@ func (m *MCS) Close() error {
 	return m.transport.Close()
 }
 
+// ChannelData is a PDU received on an MCS channel, the "sec" event of
+// MCSClient.
+type ChannelData struct {
+	Channel string
+	// Data is a slice of the frame read by the transport.  It is only
+	// valid during the call; a layer keeping it must copy it.
+	Data []byte
+}
+
 type MCSClient struct {
 	*MCS
+	// received is the typed "sec" event.
+	received           emission.Event[ChannelData]
 	clientCoreData     *gcc.ClientCoreData
 	clientNetworkData  *gcc.ClientNetworkData
 	clientSecurityData *gcc.ClientSecurityData
+	clientMonitorData  *gcc.ClientMonitorData
+	clientMonitorEx    *gcc.ClientMonitorExtendedData
 
 	serverCoreData     *gcc.ServerCoreData
 	serverNetworkData  *gcc.ServerNetworkData
@@ -266,6 +308,11 @@ type MCSClient struct {
 	messageChannelId     uint16 // from SC_MCS_MSGCHANNEL; 0 = not negotiated
 	messageChannelJoined bool
 	bwStartTime          time.Time // timestamp of last RDP_BW_START for timeDelta calculation
+	bwMeasuring          bool      // between RDP_BW_START and RDP_BW_STOP
+	bwByteCount          uint32    // bytes received since RDP_BW_START
+
+	netCharMu sync.Mutex
+	netChar   NetworkCharacteristics
 }
 
 func NewMCSClient(t core.Transport, kbdLayout uint32, keyboardType uint32, keyboardSubType uint32) *MCSClient {
@@ -276,6 +323,15 @@ func NewMCSClient(t core.Transport, kbdLayout uint32, keyboardType uint32, keybo
 		clientSecurityData: gcc.NewClientSecurityData(),
 		userId:             1 + MCS_USERCHANNEL_BASE,
 	}
+	c.received.Shim(&c.Emitter, "sec",
+		func(d ChannelData) []any { return []any{d.Channel, d.Data} },
+		func(a []any) (d ChannelData) {
+			if len(a) == 2 {
+				d.Channel, _ = a[0].(string)
+				d.Data, _ = a[1].([]byte)
+			}
+			return d
+		})
 	c.transport.On("connect", c.connect)
 	return c
 }
@@ -285,6 +341,86 @@ func (c *MCSClient) SetClientDesktop(width, height uint16) {
 	c.clientCoreData.DesktopHeight = height
 }
 
+// ClientDesktop returns the desktop size sent in the Client Core Data.
+func (c *MCSClient) ClientDesktop() (width, height uint16) {
+	return c.clientCoreData.DesktopWidth, c.clientCoreData.DesktopHeight
+}
+
+// SetClientMonitors requests a multi-monitor desktop: the Client Monitor
+// Data block is sent and the desktop size becomes the bounding box of the
+// monitors.
+func (c *MCSClient) SetClientMonitors(monitors []gcc.MonitorDef) {
+	if len(monitors) == 0 {
+		c.clientMonitorData = nil
+		return
+	}
+	c.clientMonitorData = &gcc.ClientMonitorData{Monitors: monitors}
+	c.clientCoreData.EarlyCapabilityFlags |= gcc.RNS_UD_CS_SUPPORT_MONITOR_LAYOUT_PDU
+	left, top, right, bottom := monitors[0].Left, monitors[0].Top, monitors[0].Right, monitors[0].Bottom
+	for _, m := range monitors[1:] {
+		left, top = min(left, m.Left), min(top, m.Top)
+		right, bottom = max(right, m.Right), max(bottom, m.Bottom)
+	}
+	c.clientCoreData.DesktopWidth = uint16(right - left + 1)
+	c.clientCoreData.DesktopHeight = uint16(bottom - top + 1)
+}
+
+// SetClientScale advertises the desktop and device scale factors, in
+// percent, in the Client Core Data.
+func (c *MCSClient) SetClientScale(desktopScale, deviceScale uint32) {
+	c.clientCoreData.DesktopScaleFactor = desktopScale
+	c.clientCoreData.DeviceScaleFactor = deviceScale
+}
+
+// SetClientMonitorAttributes sends the Client Monitor Extended Data with
+// the attributes of the monitors of SetClientMonitors, in the same order.
+func (c *MCSClient) SetClientMonitorAttributes(attrs []gcc.MonitorAttributes) {
+	if len(attrs) == 0 {
+		c.clientMonitorEx = nil
+		return
+	}
+	c.clientMonitorEx = &gcc.ClientMonitorExtendedData{Monitors: attrs}
+}
+
+// SetClientName sets the client computer name reported in the GCC core
+// data (and license requests) instead of the local hostname.  Names longer
+// than 15 characters are truncated.
+func (c *MCSClient) SetClientName(name string) {
+	c.clientCoreData.SetClientName(name)
+}
+
+// SetClientBuild sets the client build number reported in the GCC core
+// data.
+func (c *MCSClient) SetClientBuild(build uint32) {
+	c.clientCoreData.ClientBuild = build
+}
+
+// SetKeyboardFunctionKeys sets the number of function keys of the
+// keyboard reported in the GCC core data; the default is 12.
+func (c *MCSClient) SetKeyboardFunctionKeys(n uint32) {
+	c.clientCoreData.KeyboardFnKeys = n
+}
+
+// SetConnectionType sets the connection type hint of the GCC core data,
+// which servers use to pick the visual effects and codecs of the session.
+// CONNECTION_TYPE_AUTODETECT asks the server to measure the network, and
+// so implies autodetect.  autodetect sets whether the client advertises
+// RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT; on by default.
+func (c *MCSClient) SetConnectionType(t gcc.ConnectionType, autodetect bool) {
+	c.clientCoreData.ConnectionType = uint8(t)
+	c.clientCoreData.EarlyCapabilityFlags |= gcc.RNS_UD_CS_VALID_CONNECTION_TYPE
+	c.clientCoreData.EarlyCapabilityFlags &^= gcc.RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT
+	if autodetect || t == gcc.CONNECTION_TYPE_AUTODETECT {
+		c.clientCoreData.EarlyCapabilityFlags |= gcc.RNS_UD_CS_SUPPORT_NETCHAR_AUTODETECT
+	}
+}
+
+// SetClientColorDepth sets the colour depth requested in the GCC core
+// data.
+func (c *MCSClient) SetClientColorDepth(bpp int) {
+	c.clientCoreData.SetColorDepth(bpp)
+}
+
 func (c *MCSClient) SetClientDynvcProtocol() {
 	c.clientCoreData.EarlyCapabilityFlags |= gcc.RNS_UD_CS_SUPPORT_DYNVC_GFX_PROTOCOL
 	c.clientNetworkData.AddVirtualChannel(drdynvc.ChannelName, drdynvc.ChannelOption)
@@ -308,49 +444,93 @@ func (c *MCSClient) SetClientClipboard() {
 		uint32(gcc.CHANNEL_OPTION_INITIALIZED|gcc.CHANNEL_OPTION_ENCRYPT_RDP|gcc.CHANNEL_OPTION_COMPRESS_RDP))
 }
 
+// SetClientVirtualChannel requests the static virtual channel name with
+// the CHANNEL_OPTION_* flags options.
+func (c *MCSClient) SetClientVirtualChannel(name string, options uint32) {
+	c.clientNetworkData.AddVirtualChannel(name, options)
+}
+
+// VirtualChannelInfo describes a static virtual channel requested in the
+// client network data and the outcome of its channel join.
+type VirtualChannelInfo struct {
+	Name    string
+	ID      uint16 // MCS channel ID assigned by the server; 0 if none
+	Options uint32 // CHANNEL_OPTION_* flags requested by the client
+	Joined  bool   // the server confirmed the channel join
+}
+
+// VirtualChannels returns the requested static virtual channels in
+// request order together with the IDs the server assigned.
+func (c *MCSClient) VirtualChannels() []VirtualChannelInfo {
+	joined := make(map[uint16]bool, len(c.channels))
+	for _, ch := range c.channels {
+		joined[ch.ID] = true
+	}
+	infos := make([]VirtualChannelInfo, 0, len(c.clientNetworkData.ChannelDefArray))
+	for i, def := range c.clientNetworkData.ChannelDefArray {
+		info := VirtualChannelInfo{Name: def.Name, Options: def.Options}
+		if c.serverNetworkData != nil && i < len(c.serverNetworkData.ChannelIdArray) {
+			info.ID = c.serverNetworkData.ChannelIdArray[i]
+			info.Joined = joined[info.ID]
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
 func (c *MCSClient) connect(selectedProtocol uint32) {
-	slog.Debug("connect", "selectedProtocol", selectedProtocol)
+	c.log.Debug("connect", "selectedProtocol", selectedProtocol)
 	c.clientCoreData.ServerSelectedProtocol = selectedProtocol
 
-	slog.Debug("connnect", "clientCoreData", c.clientCoreData)
-	slog.Debug("connect", "clientNetworkData", c.clientNetworkData)
-	slog.Debug("connect", "clientSecurityData", c.clientSecurityData)
+	c.log.Debug("connnect", "clientCoreData", c.clientCoreData)
+	c.log.Debug("connect", "clientNetworkData", c.clientNetworkData)
+	c.log.Debug("connect", "clientSecurityData", c.clientSecurityData)
 	// sendConnectclientCoreDataInitial
 	userDataBuff := bytes.Buffer{}
 	userDataBuff.Write(c.clientCoreData.Pack())
 	userDataBuff.Write(c.clientNetworkData.Pack())
 	userDataBuff.Write(c.clientSecurityData.Pack())
+	if c.clientMonitorData != nil {
+		userDataBuff.Write(c.clientMonitorData.Pack())
+		if c.clientMonitorEx != nil {
+			userDataBuff.Write(c.clientMonitorEx.Pack())
+		}
+	}
 	userDataBuff.Write(gcc.PackClientMsgChannelData())
 
-	slog.Debug("userData", "data", core.Hex(userDataBuff.Bytes()), "len", len(userDataBuff.Bytes()))
+	c.log.Debug("userData", "data", core.Hex(userDataBuff.Bytes()), "len", len(userDataBuff.Bytes()))
 	ccReq := gcc.MakeConferenceCreateRequest(userDataBuff.Bytes())
-	slog.Debug("ccReq", "data", core.Hex(ccReq), "len", len(ccReq))
+	c.log.Debug("ccReq", "data", core.Hex(ccReq), "len", len(ccReq))
 	connectInitial := NewConnectInitial(ccReq)
 	connectInitialBerEncoded := connectInitial.BER()
 
 	dataBuff := &bytes.Buffer{}
 	ber.WriteApplicationTag(uint8(MCS_TYPE_CONNECT_INITIAL), len(connectInitialBerEncoded), dataBuff)
 	dataBuff.Write(connectInitialBerEncoded)
-	slog.Debug("send connet initial", "data", core.Hex(dataBuff.Bytes()), "len", len(dataBuff.Bytes()))
+	c.log.Debug("send connet initial", "data", core.Hex(dataBuff.Bytes()), "len", len(dataBuff.Bytes()))
 
 	_, err := c.transport.Write(dataBuff.Bytes())
 	if err != nil {
 		c.Emit("error", errors.New(fmt.Sprintf("mcs sendConnectInitial write error %v", err)))
 		return
 	}
-	slog.Debug("mcs wait for data event")
+	c.log.Debug("mcs wait for data event")
 	c.transport.Once("data", c.recvConnectResponse)
 }
 
 func (c *MCSClient) recvConnectResponse(s []byte) {
-	slog.Debug("mcs recvConnectResponse", "s", core.Hex(s))
+	c.log.Debug("mcs recvConnectResponse", "s", core.Hex(s))
 	cResp, err := ReadConnectResponse(bytes.NewReader(s))
 	if err != nil {
-		c.Emit("error", errors.New(fmt.Sprintf("ReadConnectResponse %v", err)))
+		c.protocolError("Connect Response", s, err)
 		return
 	}
 	// record server gcc block
-	serverSettings := gcc.ReadConferenceCreateResponse(cResp.userData)
+	serverSettings, err := gcc.ReadConferenceCreateResponse(cResp.userData, c.log)
+	if err != nil {
+		c.protocolError("Connect Response", s, fmt.Errorf("conference create response: %w", err))
+		return
+	}
 	for _, v := range serverSettings {
 		switch v.(type) {
 		case *gcc.ServerSecurityData:
@@ -364,12 +544,23 @@ func (c *MCSClient) recvConnectResponse(s []byte) {
 
 		case *gcc.ServerMsgChannelData:
 			c.messageChannelId = v.(*gcc.ServerMsgChannelData).MCSChannelId
-			slog.Debug("SC_MCS_MSGCHANNEL", "messageChannelId", c.messageChannelId)
+			c.log.Debug("SC_MCS_MSGCHANNEL", "messageChannelId", c.messageChannelId)
 
 		default:
-			slog.Warn("recvConnectResponse: unhandled server gcc block", "type", reflect.TypeOf(v))
+			c.log.Warn("recvConnectResponse: unhandled server gcc block", "type", reflect.TypeOf(v))
 		}
 	}
+	if c.serverNetworkData == nil {
+		c.Emit("error", errors.New("MCS connect response without server network data"))
+		return
+	}
+	// A server may allocate more channel IDs than the client requested;
+	// only the requested channels are joined.
+	if n := len(c.clientNetworkData.ChannelDefArray); len(c.serverNetworkData.ChannelIdArray) > n {
+		c.log.Warn("recvConnectResponse: ignoring extra channel IDs", "requested", n, "got", len(c.serverNetworkData.ChannelIdArray))
+		c.serverNetworkData.ChannelIdArray = c.serverNetworkData.ChannelIdArray[:n]
+	}
+	c.serverNetworkData.ChannelCount = uint16(len(c.serverNetworkData.ChannelIdArray))
 	c.sendErectDomainRequest()
 	c.sendAttachUserRequest()
 
@@ -391,8 +582,8 @@ func (c *MCSClient) sendAttachUserRequest() {
 }
 
 func (c *MCSClient) recvAttachUserConfirm(s []byte) {
-	slog.Debug("mcs recvAttachUserConfirm", "s", core.Hex(s))
-	r := bytes.NewReader(s)
+	c.log.Debug("mcs recvAttachUserConfirm", "s", core.Hex(s))
+	r := core.NewErrReader(bytes.NewReader(s))
 
 	option, err := core.ReadUInt8(r)
 	if err != nil {
@@ -416,15 +607,19 @@ func (c *MCSClient) recvAttachUserConfirm(s []byte) {
 	}
 
 	userId, _ := per.ReadInteger16(r)
+	if err := r.Err(); err != nil {
+		c.protocolError("Attach User Confirm", s, err)
+		return
+	}
 	userId += MCS_USERCHANNEL_BASE
 	c.userId = userId
 
-	c.channels = append(c.channels, MCSChannelInfo{userId, "user"})
+	c.channels = append(c.channels, MCSChannelInfo{ID: userId, Name: "user"})
 	c.connectChannels()
 }
 
 func (c *MCSClient) connectChannels() {
-	slog.Debug("connectChannels", "channelsConnected", c.channelsConnected, "channels", c.channels)
+	c.log.Debug("connectChannels", "channelsConnected", c.channelsConnected, "channels", c.channels)
 	if c.channelsConnected >= len(c.channels) {
 		// Join the message channel (for connect-time auto-detection) before SVCs.
 		if c.messageChannelId != 0 && !c.messageChannelJoined {
@@ -442,7 +637,7 @@ func (c *MCSClient) connectChannels() {
 			c.transport.Once("data", c.recvChannelJoinConfirm)
 			return
 		}
-		c.transport.On("data", c.recvData)
+		core.OnData(c.transport, c.recvData)
 		// send client and sever gcc informations callback to sec
 		clientData := make([]any, 0)
 		clientData = append(clientData, c.clientCoreData)
@@ -463,7 +658,7 @@ func (c *MCSClient) connectChannels() {
 }
 
 func (c *MCSClient) sendChannelJoinRequest(channelId uint16) {
-	slog.Debug("sendChannelJoinRequest", "channelId", channelId)
+	c.log.Debug("sendChannelJoinRequest", "channelId", channelId)
 	buff := &bytes.Buffer{}
 	writeMCSPDUHeader(CHANNEL_JOIN_REQUEST, 0, buff)
 	per.WriteInteger16(c.userId-MCS_USERCHANNEL_BASE, buff)
@@ -471,8 +666,26 @@ func (c *MCSClient) sendChannelJoinRequest(channelId uint16) {
 	c.transport.Write(buff.Bytes())
 }
 
+// protocolError ends the connection on the PDU s that could not be
+// parsed: the layers above cannot go on without it.
+func (c *MCSClient) protocolError(name string, s []byte, err error) {
+	c.log.Error("malformed PDU", core.LogPDU, name, "err", err)
+	c.Emit("error", core.NewProtocolError("mcs", name, s, err))
+	c.transport.Close()
+}
+
+// SendDisconnectProviderUltimatum tells the server the client is leaving
+// the domain, with one of the RN_* reasons.
+func (c *MCSClient) SendDisconnectProviderUltimatum(reason uint8) error {
+	buff := &bytes.Buffer{}
+	writeMCSPDUHeader(DISCONNECT_PROVIDER_ULTIMATUM, (reason>>1)&0x03, buff)
+	core.WriteUInt8(reason<<7, buff)
+	_, err := c.transport.Write(buff.Bytes())
+	return err
+}
+
 func (c *MCSClient) recvData(s []byte) {
-	r := bytes.NewReader(s)
+	r := core.NewErrReader(bytes.NewReader(s))
 	option, err := core.ReadUInt8(r)
 	if err != nil {
 		c.Emit("error", err)
@@ -480,7 +693,12 @@ func (c *MCSClient) recvData(s []byte) {
 	}
 
 	if readMCSPDUHeader(option, DISCONNECT_PROVIDER_ULTIMATUM) {
-		c.Emit("error", errors.New("MCS DISCONNECT_PROVIDER_ULTIMATUM"))
+		// the 3-bit reason straddles the header byte
+		next, _ := core.ReadUInt8(r)
+		reason := (option&0x03)<<1 | next>>7
+		c.log.Debug("MCS DISCONNECT_PROVIDER_ULTIMATUM", "reason", reason)
+		c.Emit("disconnect", reason)
+		c.Emit("error", fmt.Errorf("MCS DISCONNECT_PROVIDER_ULTIMATUM reason %d", reason))
 		c.transport.Close()
 		return
 	} else if !readMCSPDUHeader(option, c.recvOpCode) {
@@ -488,12 +706,20 @@ func (c *MCSClient) recvData(s []byte) {
 		return
 	}
 
+	if c.bwMeasuring {
+		c.bwByteCount += uint32(len(s))
+	}
+
 	userId, _ := per.ReadInteger16(r)
 	userId += MCS_USERCHANNEL_BASE
 
 	channelId, _ := per.ReadInteger16(r)
 	per.ReadEnumerates(r)
 	size, _ := per.ReadLength(r)
+	if err := r.Err(); err != nil {
+		c.protocolError("Send Data Indication", s, err)
+		return
+	}
 	// channel ID doesn't match a requested layer
 	found := false
 	channelName := ""
@@ -507,23 +733,30 @@ func (c *MCSClient) recvData(s []byte) {
 	if !found {
 		if c.messageChannelId != 0 && channelId == c.messageChannelId {
 			data, _ := core.ReadBytes(int(size), r)
-			c.handleAutoDetect(data)
+			c.recvMessageChannel(data)
 			return
 		}
-		slog.Error("mcs receive data for an unconnected layer")
+		c.log.Error("mcs receive data for an unconnected layer")
 		return
 	}
-	left, err := core.ReadBytes(int(size), r)
-	if err != nil {
-		c.Emit("error", errors.New(fmt.Sprintf("mcs recvData get data error %v", err)))
+	// the data is passed on in place, not copied
+	off := len(s) - r.Len()
+	if int(size) > len(s)-off {
+		c.Emit("error", errors.New(fmt.Sprintf("mcs recvData get data error %v", io.ErrUnexpectedEOF)))
 		return
 	}
-	c.Emit("sec", channelName, left)
+	c.received.Emit(ChannelData{channelName, s[off : off+int(size)]})
+}
+
+// OnChannelData subscribes f to the PDUs received on the joined channels,
+// the "sec" event.
+func (c *MCSClient) OnChannelData(f func(ChannelData)) *emission.Subscription {
+	return c.received.Subscribe(f)
 }
 
 func (c *MCSClient) recvChannelJoinConfirm(s []byte) {
-	slog.Debug("recvChannelJoinConfirm", "s", core.Hex(s))
-	r := bytes.NewReader(s)
+	c.log.Debug("recvChannelJoinConfirm", "s", core.Hex(s))
+	r := core.NewErrReader(bytes.NewReader(s))
 	option, err := core.ReadUInt8(r)
 	if err != nil {
 		c.Emit("error", err)
@@ -545,6 +778,10 @@ func (c *MCSClient) recvChannelJoinConfirm(s []byte) {
 	}
 
 	channelId, _ := per.ReadInteger16(r)
+	if err := r.Err(); err != nil {
+		c.protocolError("Channel Join Confirm", s, err)
+		return
+	}
 	if (confirm != 0) && (channelId == uint16(MCS_GLOBAL_CHANNEL_ID) || channelId == c.userId) {
 		c.Emit("error", errors.New("NODE_RDP_PROTOCOL_T125_MCS_SERVER_MUST_CONFIRM_STATIC_CHANNEL"))
 		return
@@ -555,6 +792,7 @@ func (c *MCSClient) recvChannelJoinConfirm(s []byte) {
 				var t MCSChannelInfo
 				t.ID = channelId
 				t.Name = string(c.clientNetworkData.ChannelDefArray[i].Name[:])
+				t.Options = c.clientNetworkData.ChannelDefArray[i].Options
 				c.channels = append(c.channels, t)
 			}
 		}
@@ -563,7 +801,7 @@ func (c *MCSClient) recvChannelJoinConfirm(s []byte) {
 	c.connectChannels()
 }
 
-// Connect-time auto-detection constants (MS-RDPBCGR 2.2.14).
+// Auto-detection constants (MS-RDPBCGR 2.2.14).
 const (
 	secAutoDetectReq = uint16(0x1000)
 	secAutoDetectRsp = uint16(0x2000)
@@ -575,6 +813,9 @@ const (
 	rdpRttRequest            = uint16(0x0001) // continuous RTT request
 	rdpBwStart               = uint16(0x0014) // continuous BW start (no response)
 	rdpBwStop                = uint16(0x0429) // continuous BW stop
+	rdpNetcharBaseRttAvg     = uint16(0x0840) // baseRTT, averageRTT
+	rdpNetcharBwAvg          = uint16(0x0880) // bandwidth, averageRTT
+	rdpNetcharAll            = uint16(0x08C0) // baseRTT, bandwidth, averageRTT
 
 	typeIDAutodetectResponse = uint8(0x01)
 	rdpRttResponseType       = uint16(0x0000)
@@ -582,48 +823,168 @@ const (
 	rdpBwResults             = uint16(0x000B) // continuous BW results
 )
 
-// handleAutoDetect processes a connect-time auto-detect request from the server
-// on the message channel. It responds to RTT and BW measurement requests so
-// that gnome-remote-desktop proceeds to open the audio DVC channels.
-func (c *MCSClient) handleAutoDetect(data []byte) {
+// NetworkCharacteristics holds the results of network auto-detection.
+// The server measures the round-trip times and reports them in a Network
+// Characteristics Result; Bandwidth is the one it reports, or else the
+// one the client measured during the last bandwidth measurement.
+type NetworkCharacteristics struct {
+	BaseRTT    time.Duration
+	AverageRTT time.Duration
+	Bandwidth  uint32 // kilobits per second; 0 when not measured
+}
+
+// NetworkCharacteristics returns the auto-detection results so far.  It
+// is safe to call from any goroutine.
+func (c *MCSClient) NetworkCharacteristics() NetworkCharacteristics {
+	c.netCharMu.Lock()
+	defer c.netCharMu.Unlock()
+	return c.netChar
+}
+
+// Security header flags of the message channel PDUs (MS-RDPBCGR 2.2.8.1.1.2.1)
+const (
+	secTransportReq = uint16(0x0002)
+	secTransportRsp = uint16(0x0004)
+	secHeartbeat    = uint16(0x4000)
+)
+
+// Heartbeat is the content of a Server Heartbeat PDU (MS-RDPBCGR 2.2.16.1),
+// emitted as "heartbeat".  The server sends one every Period seconds
+// while there is no other traffic; the connection is considered
+// unhealthy after MissedWarn and lost after MissedReconnect missed ones.
+type Heartbeat struct {
+	Period          uint8
+	MissedWarn      uint8
+	MissedReconnect uint8
+}
+
+// recvMessageChannel routes a PDU of the MCS message channel by the flags
+// of its basic security header: auto-detect requests, heartbeats and
+// multitransport initiation requests.
+func (c *MCSClient) recvMessageChannel(data []byte) {
 	r := bytes.NewReader(data)
 	secFlag, _ := core.ReadUint16LE(r)
-	core.ReadUint16LE(r) // secFlagHi
+	if _, err := core.ReadUint16LE(r); err != nil { // secFlagHi
+		c.log.Debug("message channel: short PDU", "len", len(data))
+		return
+	}
+
+	switch {
+	case secFlag&secAutoDetectReq != 0:
+		c.handleAutoDetect(r)
+	case secFlag&secHeartbeat != 0:
+		c.handleHeartbeat(r)
+	case secFlag&secTransportReq != 0:
+		c.handleMultitransportRequest(r)
+	default:
+		c.log.Debug("message channel: unknown PDU", "flags", secFlag)
+	}
+}
 
-	if secFlag&secAutoDetectReq == 0 {
+// handleHeartbeat emits a Server Heartbeat PDU.
+func (c *MCSClient) handleHeartbeat(r *bytes.Reader) {
+	b, err := core.ReadBytes(4, r)
+	if err != nil {
+		c.log.Debug("heartbeat: short PDU")
+		return
+	}
+	hb := Heartbeat{Period: b[1], MissedWarn: b[2], MissedReconnect: b[3]}
+	c.log.Debug("heartbeat", "period", hb.Period, "warn", hb.MissedWarn, "reconnect", hb.MissedReconnect)
+	c.Emit("heartbeat", hb)
+}
+
+// hrEAbort declines a multitransport request (E_ABORT).
+const hrEAbort = uint32(0x80004004)
+
+// handleMultitransportRequest answers an Initiate Multitransport Request
+// PDU (MS-RDPBCGR 2.2.15.1).  The client has no UDP transport, so it
+// declines and the session stays on TCP.
+func (c *MCSClient) handleMultitransportRequest(r *bytes.Reader) {
+	requestId, err := core.ReadUInt32LE(r)
+	if err != nil {
+		c.log.Debug("multitransport: short request")
 		return
 	}
+	protocol, _ := core.ReadUint16LE(r)
+	c.log.Debug("multitransport: declining request", "requestId", requestId, "protocol", protocol)
 
-	_, _ = core.ReadUInt8(r) // headerLength
-	core.ReadUInt8(r)        // headerTypeId
+	payload := &bytes.Buffer{}
+	core.WriteUInt16LE(secTransportRsp, payload)
+	core.WriteUInt16LE(0, payload)
+	core.WriteUInt32LE(requestId, payload)
+	core.WriteUInt32LE(hrEAbort, payload)
+	c.transport.Write(c.Pack(payload.Bytes(), c.messageChannelId))
+}
+
+// handleAutoDetect processes an auto-detect request from the server on
+// the message channel, at connect time or during the session.  It answers
+// RTT and bandwidth measurement requests, which servers such as
+// gnome-remote-desktop wait for before opening the audio DVC channels.
+func (c *MCSClient) handleAutoDetect(r *bytes.Reader) {
+	headerLength, _ := core.ReadUInt8(r)
+	core.ReadUInt8(r) // headerTypeId
 	seqNum, _ := core.ReadUint16LE(r)
-	reqType, _ := core.ReadUint16LE(r)
+	reqType, err := core.ReadUint16LE(r)
+	if err != nil || headerLength < 6 {
+		c.log.Debug("auto-detect: short request", "headerLength", headerLength)
+		return
+	}
 
 	switch reqType {
 	case rdpRttRequestConnecttime, rdpRttRequest:
-		c.sendAutoDetectResponse(seqNum, rdpRttResponseType, 0)
+		c.sendAutoDetectResponse(seqNum, rdpRttResponseType, 0, 0)
 	case rdpBwStartConnecttime, rdpBwStart:
 		c.bwStartTime = time.Now()
-	case rdpBwStopConnecttime:
-		elapsed := uint32(time.Since(c.bwStartTime).Milliseconds())
-		if elapsed == 0 {
-			elapsed = 1
+		c.bwByteCount = 0
+		c.bwMeasuring = true
+	case rdpBwPayload:
+		// Counted by recvData; no response.
+	case rdpBwStopConnecttime, rdpBwStop:
+		if !c.bwMeasuring {
+			return
+		}
+		c.bwMeasuring = false
+		elapsed := uint32(max(time.Since(c.bwStartTime).Milliseconds(), 1))
+		responseType := rdpBwResults
+		if reqType == rdpBwStopConnecttime {
+			responseType = rdpBwResultsConnecttime
+		}
+		c.sendAutoDetectResponse(seqNum, responseType, elapsed, c.bwByteCount)
+		c.netCharMu.Lock()
+		c.netChar.Bandwidth = uint32(uint64(c.bwByteCount) * 8 / uint64(elapsed))
+		c.netCharMu.Unlock()
+	case rdpNetcharBaseRttAvg, rdpNetcharBwAvg, rdpNetcharAll:
+		var baseRTT, bandwidth uint32
+		if reqType != rdpNetcharBwAvg {
+			baseRTT, _ = core.ReadUInt32LE(r)
+		}
+		if reqType != rdpNetcharBaseRttAvg {
+			bandwidth, _ = core.ReadUInt32LE(r)
+		}
+		averageRTT, err := core.ReadUInt32LE(r)
+		if err != nil {
+			c.log.Debug("auto-detect: short network characteristics result")
+			return
+		}
+		c.netCharMu.Lock()
+		if reqType != rdpNetcharBwAvg {
+			c.netChar.BaseRTT = time.Duration(baseRTT) * time.Millisecond
 		}
-		c.sendAutoDetectResponse(seqNum, rdpBwResultsConnecttime, elapsed)
-	case rdpBwStop:
-		elapsed := uint32(time.Since(c.bwStartTime).Milliseconds())
-		if elapsed == 0 {
-			elapsed = 1
+		if reqType != rdpNetcharBaseRttAvg {
+			c.netChar.Bandwidth = bandwidth
 		}
-		c.sendAutoDetectResponse(seqNum, rdpBwResults, elapsed)
-		// rdpBwPayload requires no response
+		c.netChar.AverageRTT = time.Duration(averageRTT) * time.Millisecond
+		c.netCharMu.Unlock()
+		c.log.Debug("auto-detect: network characteristics", "baseRTT", baseRTT, "bandwidth", bandwidth, "averageRTT", averageRTT)
+	default:
+		c.log.Debug("auto-detect: unknown request", "requestType", reqType)
 	}
 }
 
-// sendAutoDetectResponse sends an auto-detect response on the message channel.
-// timeDelta is 0 for RTT responses (no BW fields); non-zero for BW responses
-// (timeDelta in milliseconds since the corresponding BW_START was received).
-func (c *MCSClient) sendAutoDetectResponse(sequenceNumber uint16, responseType uint16, timeDelta uint32) {
+// sendAutoDetectResponse sends an auto-detect response on the message
+// channel.  The bandwidth results carry timeDelta, the milliseconds since
+// the BW_START, and byteCount, the bytes received since then.
+func (c *MCSClient) sendAutoDetectResponse(sequenceNumber uint16, responseType uint16, timeDelta, byteCount uint32) {
 	includeBW := responseType == rdpBwResultsConnecttime || responseType == rdpBwResults
 	headerLength := uint8(6)
 	if includeBW {
@@ -638,8 +999,8 @@ func (c *MCSClient) sendAutoDetectResponse(sequenceNumber uint16, responseType u
 	core.WriteUInt16LE(sequenceNumber, payload)
 	core.WriteUInt16LE(responseType, payload)
 	if includeBW {
-		core.WriteUInt32LE(timeDelta, payload) // timeDelta in milliseconds
-		core.WriteUInt32LE(0, payload)         // byteCount (no BW_PAYLOAD was sent)
+		core.WriteUInt32LE(timeDelta, payload)
+		core.WriteUInt32LE(byteCount, payload)
 	}
 
 	c.transport.Write(c.Pack(payload.Bytes(), c.messageChannelId))
@@ -0,0 +1,179 @@
+package t125
+
+import (
+	"bytes"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/protocol/t125/gcc"
+	"github.com/nakagami/grdp/testutil"
+)
+
+func TestDisconnectProviderUltimatum(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewMCSClient(tr, 0, 0, 0)
+	reasons := testutil.Capture[uint8](&c.Emitter, "disconnect")
+	testutil.Capture[error](&c.Emitter, "error")
+
+	c.SendDisconnectProviderUltimatum(RN_USER_REQUESTED)
+	testutil.AssertWrites(t, tr, testutil.Hex("21 80"))
+
+	c.recvData(testutil.Hex("20 80")) // rn-provider-initiated
+	if got, ok := reasons.Last(); !ok || got != RN_PROVIDER_INITIATED {
+		t.Errorf("reason = %d, %v", got, ok)
+	}
+	if !tr.Closed() {
+		t.Error("transport not closed")
+	}
+}
+
+func TestAutoDetect(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewMCSClient(tr, 0, 0, 0)
+	c.messageChannelId = 1008
+	// recv delivers an auto-detect request on the message channel and
+	// returns the size of the MCS PDU.
+	recv := func(req string) int {
+		body := append(testutil.Hex("00 10 00 00"), testutil.Hex(req)...)
+		s := append(testutil.Hex("68 00 00 03 f0 70"), byte(len(body)))
+		c.recvData(append(s, body...))
+		return len(s) + len(body)
+	}
+
+	recv("06 00 01 00 01 10") // RTT request, connect-time
+	recv("06 00 02 00 14 10") // BW start, connect-time
+	n := recv("08 00 03 00 02 00 04 00 aa bb cc dd")
+	n += recv("08 00 04 00 2b 00 00 00")
+	if got := len(tr.Frames()); got != 2 {
+		t.Fatalf("got %d writes, want 2", got)
+	}
+	// timeDelta depends on the clock, byteCount covers the PDUs from the
+	// payload to the stop.
+	timeDelta := tr.Frames()[1].Data[17:21]
+	testutil.AssertWrites(t, tr,
+		testutil.Hex("64 00 01 03 f0 70 0a 00 20 00 00 06 01 01 00 00 00"),
+		slices.Concat(testutil.Hex("64 00 01 03 f0 70 12 00 20 00 00 0e 01 04 00 03 00"),
+			timeDelta, []byte{byte(n), 0, 0, 0}),
+	)
+
+	recv("12 00 05 00 c0 08 0a 00 00 00 00 10 00 00 14 00 00 00") // network characteristics
+	nc := c.NetworkCharacteristics()
+	if nc.BaseRTT != 10*time.Millisecond || nc.Bandwidth != 4096 || nc.AverageRTT != 20*time.Millisecond {
+		t.Errorf("NetworkCharacteristics = %+v", nc)
+	}
+}
+
+func TestMessageChannelRouting(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewMCSClient(tr, 0, 0, 0)
+	c.messageChannelId = 1008
+	heartbeats := testutil.Capture[Heartbeat](&c.Emitter, "heartbeat")
+	recv := func(pdu string) {
+		body := testutil.Hex(pdu)
+		c.recvData(append(append(testutil.Hex("68 00 00 03 f0 70"), byte(len(body))), body...))
+	}
+
+	recv("00 40 00 00 00 05 03 05") // heartbeat
+	if got, ok := heartbeats.Last(); !ok || got != (Heartbeat{Period: 5, MissedWarn: 3, MissedReconnect: 5}) {
+		t.Errorf("heartbeat = %+v, %v", got, ok)
+	}
+
+	recv("02 00 00 00 07 00 00 00 01 00 00 00" + strings.Repeat("00", 16)) // multitransport request
+	testutil.AssertWrites(t, tr, testutil.Hex("64 00 01 03 f0 70 0c 04 00 00 00 07 00 00 00 04 40 00 80"))
+}
+
+func TestReadConnectResponse(t *testing.T) {
+	params := testutil.Hex(`30 1d 02 01 22 02 01 03 02 01 00 02 01 01 02 01 00
+		02 01 01 02 03 00 ff f8 02 01 02
+		02 01 00`) // a component the client does not know
+	body := append(testutil.Hex("0a 01 00 02 01 00"), params...)
+	body = append(body, testutil.Hex("04 82 00 03 aa bb cc")...)
+	pdu := append(testutil.Hex("7f 66"), byte(len(body)))
+	c, err := ReadConnectResponse(bytes.NewReader(append(pdu, body...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.domainParameters.MaxChannelIds != 0x22 || c.domainParameters.MaxMCSPDUsize != 0xfff8 {
+		t.Errorf("domain parameters = %+v", c.domainParameters)
+	}
+	if !bytes.Equal(c.userData, testutil.Hex("aa bb cc")) {
+		t.Errorf("userData = % x", c.userData)
+	}
+
+	body[2] = 0x01 // rt-domain-merging
+	if _, err := ReadConnectResponse(bytes.NewReader(append(pdu, body...))); err == nil {
+		t.Error("unsuccessful result accepted")
+	}
+}
+
+func FuzzReadConnectResponse(f *testing.F) {
+	f.Add(testutil.Hex(`7f 66 2a 0a 01 00 02 01 00
+		30 1a 02 01 22 02 01 03 02 01 00 02 01 01 02 01 00 02 01 01 02 03 00 ff f8 02 01 02
+		04 03 aa bb cc`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ReadConnectResponse(bytes.NewReader(data))
+	})
+}
+
+// TestVirtualChannels negotiates three static channels, of which the
+// server refuses the last, and checks the channels reported.
+func TestVirtualChannels(t *testing.T) {
+	tr := testutil.NewTransport()
+	c := NewMCSClient(tr, 0, 0, 0)
+	initialized := uint32(gcc.CHANNEL_OPTION_INITIALIZED)
+	c.SetClientClipboard()
+	c.SetClientVirtualChannel("rdpsnd", initialized)
+	c.SetClientVirtualChannel("echo", initialized|uint32(gcc.CHANNEL_OPTION_SHOW_PROTOCOL))
+	want := []VirtualChannelInfo{
+		{Name: "cliprdr", Options: uint32(gcc.CHANNEL_OPTION_INITIALIZED | gcc.CHANNEL_OPTION_ENCRYPT_RDP | gcc.CHANNEL_OPTION_COMPRESS_RDP)},
+		{Name: "rdpsnd", Options: initialized},
+		{Name: "echo", Options: initialized | uint32(gcc.CHANNEL_OPTION_SHOW_PROTOCOL)},
+	}
+	if got := c.VirtualChannels(); !slices.Equal(got, want) {
+		t.Errorf("before the connection: %+v", got)
+	}
+
+	tr.Emit("connect", uint32(0))
+	// The server assigns IDs 1004 to 1006, and one more.
+	block := func(typ gcc.Message, body ...byte) []byte {
+		return append(binary.LittleEndian.AppendUint16(binary.LittleEndian.AppendUint16(nil, uint16(typ)), uint16(4+len(body))), body...)
+	}
+	userData := conferenceCreateResponse(slices.Concat(
+		block(gcc.SC_CORE, 0x04, 0x00, 0x08, 0x00),
+		block(gcc.SC_NET, 0xeb, 0x03, 0x04, 0x00, 0xec, 0x03, 0xed, 0x03, 0xee, 0x03, 0xef, 0x03),
+	))
+	body := slices.Concat(testutil.Hex(`0a 01 00 02 01 00
+		30 1a 02 01 22 02 01 03 02 01 00 02 01 01 02 01 00 02 01 01 02 03 00 ff f8 02 01 02`),
+		[]byte{0x04, 0x81, byte(len(userData))}, userData)
+	tr.Emit("data", slices.Concat([]byte{0x7f, 0x66, 0x81, byte(len(body))}, body))
+	tr.Emit("data", testutil.Hex("2e 00 00 06")) // user 1007
+	for _, join := range []string{
+		"3e 00 00 06 03 ef 03 ef", // the user channel
+		"3e 00 00 06 03 eb 03 eb", // the I/O channel
+		"3e 00 00 06 03 ec 03 ec",
+		"3e 00 00 06 03 ed 03 ed",
+		"3e 0e 00 06 03 ee", // rt-channel-not-found
+	} {
+		tr.Emit("data", testutil.Hex(join))
+	}
+	want[0].ID, want[0].Joined = 1004, true
+	want[1].ID, want[1].Joined = 1005, true
+	want[2].ID = 1006
+	if got := c.VirtualChannels(); !slices.Equal(got, want) {
+		t.Errorf("after the joins: %+v", got)
+	}
+}
+
+// conferenceCreateResponse wraps server user data blocks in a GCC
+// Conference Create Response.
+func conferenceCreateResponse(userData []byte) []byte {
+	b := []byte{0x00, 0x05, 0x00, 0x14, 0x7c, 0x00, 0x01} // choice, t124 OID
+	inner := []byte{0x14, 0x76, 0x0a, 0x01, 0x01, 0x00, 0x01, 0xc0, 0x00, 'M', 'c', 'D', 'n'}
+	inner = append(inner, 0x80|byte(len(userData)>>8), byte(len(userData)))
+	inner = append(inner, userData...)
+	b = append(b, 0x80|byte(len(inner)>>8), byte(len(inner)))
+	return append(b, inner...)
+}
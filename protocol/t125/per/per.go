@@ -1,8 +1,9 @@
 package per
 
 import (
+	"errors"
+	"fmt"
 	"io"
-	"log/slog"
 
 	"github.com/nakagami/grdp/core"
 )
@@ -56,21 +57,24 @@ func WriteLength(value int, w io.Writer) {
 	}
 }
 
+// ReadLength reads an unconstrained length determinant: one octet up to
+// 0x7F, or two octets with the top bit set up to 0x3FFF.
 func ReadLength(r io.Reader) (uint16, error) {
 	b, err := core.ReadUInt8(r)
 	if err != nil {
-		return 0, nil
-	}
-	var size uint16
-	if b&0x80 > 0 {
-		b = b &^ 0x80
-		size = uint16(b) << 8
-		left, _ := core.ReadUInt8(r)
-		size += uint16(left)
-	} else {
-		size = uint16(b)
+		return 0, err
+	}
+	if b&0x80 == 0 {
+		return uint16(b), nil
+	}
+	if b&0x40 != 0 {
+		return 0, errors.New("PER fragmented length not supported")
+	}
+	left, err := core.ReadUInt8(r)
+	if err != nil {
+		return 0, err
 	}
-	return size, nil
+	return uint16(b&0x3f)<<8 | uint16(left), nil
 }
 
 /**
@@ -79,7 +83,7 @@ func ReadLength(r io.Reader) (uint16, error) {
  */
 func WriteObjectIdentifier(oid []byte, w io.Writer) {
 	core.WriteUInt8(5, w)
-	core.WriteByte((oid[0]<<4)&(oid[1]&0x0f), w)
+	core.WriteByte(oid[0]<<4|oid[1]&0x0f, w)
 	core.WriteByte(oid[2], w)
 	core.WriteByte(oid[3], w)
 	core.WriteByte(oid[4], w)
@@ -154,22 +158,24 @@ func ReadNumberOfSet(r io.Reader) uint8 {
 	choice, _ := core.ReadUInt8(r)
 	return choice
 }
-func ReadInteger(r io.Reader) uint32 {
-	size, _ := ReadLength(r)
+
+// ReadInteger reads an unconstrained INTEGER of one, two or four octets.
+func ReadInteger(r io.Reader) (uint32, error) {
+	size, err := ReadLength(r)
+	if err != nil {
+		return 0, err
+	}
 	switch size {
 	case 1:
-		ret, _ := core.ReadUInt8(r)
-		return uint32(ret)
+		ret, err := core.ReadUInt8(r)
+		return uint32(ret), err
 	case 2:
-		ret, _ := core.ReadUint16BE(r)
-		return uint32(ret)
+		ret, err := core.ReadUint16BE(r)
+		return uint32(ret), err
 	case 4:
-		ret, _ := core.ReadUInt32BE(r)
-		return ret
-	default:
-		slog.Debug("ReadInteger")
+		return core.ReadUInt32BE(r)
 	}
-	return 0
+	return 0, fmt.Errorf("PER integer of %d octets", size)
 }
 
 func ReadObjectIdentifier(r io.Reader, oid []byte) bool {
@@ -0,0 +1,47 @@
+package per
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLength(t *testing.T) {
+	for _, n := range []int{0, 0x7f, 0x80, 0x3fff} {
+		b := &bytes.Buffer{}
+		WriteLength(n, b)
+		got, err := ReadLength(b)
+		if err != nil || int(got) != n || b.Len() != 0 {
+			t.Errorf("length %#x: got %#x, %v", n, got, err)
+		}
+	}
+	for _, in := range [][]byte{{}, {0x81}, {0xc1, 0x00}} {
+		if _, err := ReadLength(bytes.NewReader(in)); err == nil {
+			t.Errorf("% x: accepted", in)
+		}
+	}
+}
+
+func TestInteger(t *testing.T) {
+	for _, n := range []int{1, 0x100, 0x10000} {
+		b := &bytes.Buffer{}
+		WriteInteger(n, b)
+		if got, err := ReadInteger(b); err != nil || int(got) != n {
+			t.Errorf("integer %#x: got %#x, %v", n, got, err)
+		}
+	}
+	if _, err := ReadInteger(bytes.NewReader([]byte{0x03, 1, 2, 3})); err == nil {
+		t.Error("3 octet integer accepted")
+	}
+}
+
+func TestObjectIdentifier(t *testing.T) {
+	oid := []byte{0, 0, 20, 124, 0, 1}
+	b := &bytes.Buffer{}
+	WriteObjectIdentifier(oid, b)
+	if !bytes.Equal(b.Bytes(), []byte{0x05, 0x00, 0x14, 0x7c, 0x00, 0x01}) {
+		t.Errorf("encoded % x", b.Bytes())
+	}
+	if !ReadObjectIdentifier(b, oid) {
+		t.Error("round trip failed")
+	}
+}
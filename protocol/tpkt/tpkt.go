@@ -1,11 +1,16 @@
 package tpkt
 
 import (
+	"bufio"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
-	"sync"
+	"os"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"github.com/nakagami/grdp/core"
@@ -13,35 +18,17 @@ import (
 	"github.com/nakagami/grdp/protocol/nla"
 )
 
-var writePool = sync.Pool{
-	New: func() any { return make([]byte, 0, 4096) },
-}
-
-// readBufPool reuses packet body buffers in readLoop.
-// Typical RDP packets are well under 4 KiB; the pool avoids a heap
-// allocation for every incoming packet (~60/s during active sessions).
-// Buffers larger than maxPooledReadBuf are not pooled to avoid keeping
-// large slices alive in the pool between bursts.
-const maxPooledReadBuf = 32 * 1024
-
-var readBufPool = sync.Pool{
-	New: func() any { return make([]byte, 0, 4096) },
-}
+// readBufs and writeBufs reuse the packet buffers of readLoop and of the
+// writes.  Typical RDP packets are well under 4 KiB; the pools avoid a
+// heap allocation for every packet (~60/s during active sessions).
+// Buffers larger than maxPooledBuf are not pooled to avoid keeping large
+// slices alive in the pool between bursts.
+const maxPooledBuf = 32 * 1024
 
-func acquireReadBuf(n int) []byte {
-	b := readBufPool.Get().([]byte)
-	if cap(b) >= n {
-		return b[:n]
-	}
-	readBufPool.Put(b[:0])
-	return make([]byte, n)
-}
-
-func releaseReadBuf(b []byte) {
-	if cap(b) <= maxPooledReadBuf {
-		readBufPool.Put(b[:0])
-	}
-}
+var (
+	readBufs  = core.NewBufferPool(4096, maxPooledBuf)
+	writeBufs = core.NewBufferPool(4096, maxPooledBuf)
+)
 
 // take idea from https://github.com/Madnikulin50/gordp
 
@@ -61,88 +48,250 @@ const (
  */
 type TPKT struct {
 	emission.Emitter
+	// data and errs are the typed "data" and "error" events.
+	data             emission.Event[[]byte]
+	errs             emission.Event[error]
 	Conn             *core.SocketLayer
 	ntlm             *nla.NTLMv2
 	fastPathListener core.FastPathListener
+	tap              core.Tap
 	ntlmSec          *nla.NTLMv2Security
+
+	// credsspVersion is the CredSSP version negotiated with the server
+	// and clientNonce the nonce bound to the public key for v5+.
+	credsspVersion int
+	clientNonce    []byte
+
+	// remoteGuard, when set, is delegated instead of the password
+	// (Remote Credential Guard).
+	remoteGuard *nla.TSRemoteGuardCreds
+	// smartCard, when set, supplies TSSmartCardCreds instead of the
+	// password.
+	smartCard nla.SmartCardProvider
+	// credentials, when set, is called for the NTLM account just before
+	// the authenticate message is built.
+	credentials func() (domain, user, password string, err error)
+
+	// nlaTimeout bounds each CredSSP message; a read that times out is
+	// retried up to nlaRetries times before the handshake fails.
+	nlaTimeout time.Duration
+	nlaRetries int
+
+	// readTimeout, in nanoseconds, bounds the wait for each packet; zero
+	// waits forever.  It is read by readLoop.
+	readTimeout atomic.Int64
+
+	log *slog.Logger
+}
+
+// Defaults for SetNLATimeout.  Together they allow a stalled server the
+// same 30 seconds the whole handshake used to get.
+const (
+	DefaultNLATimeout = 10 * time.Second
+	DefaultNLARetries = 2
+)
+
+// NLATimeoutError reports which step of the NLA handshake the server
+// failed to answer in time.  It unwraps to os.ErrDeadlineExceeded.
+type NLATimeoutError struct {
+	Stage    string        // "TLS handshake", "CHALLENGE" or "pubKeyAuth"
+	Timeout  time.Duration // per attempt
+	Attempts int
+	Err      error
+}
+
+func (e *NLATimeoutError) Error() string {
+	return fmt.Sprintf("nla: timed out waiting for %s (%d attempt(s) of %s)", e.Stage, e.Attempts, e.Timeout)
+}
+
+func (e *NLATimeoutError) Unwrap() error {
+	return e.Err
 }
 
 func New(s *core.SocketLayer, ntlm *nla.NTLMv2) *TPKT {
 	t := &TPKT{
-		Emitter: *emission.NewEmitter(),
-		Conn:    s,
-		ntlm:    ntlm,
+		Emitter:    *emission.NewEmitter(),
+		Conn:       s,
+		ntlm:       ntlm,
+		nlaTimeout: DefaultNLATimeout,
+		nlaRetries: DefaultNLARetries,
+		log:        core.Logger(nil, "tpkt"),
 	}
+	t.data.Shim(&t.Emitter, "data", nil, nil)
+	t.errs.Shim(&t.Emitter, "error", nil, nil)
 	go t.readLoop()
 	return t
 }
 
-// readLoop is the single goroutine that reads all incoming TPKT/FastPath packets.
-// It replaces the previous callback-chain pattern (StartReadBytes → recvHeader →
-// StartReadBytes → recvExtendedHeader → …) which spawned a new goroutine for each
-// individual read.  By using a single blocking loop with io.ReadFull, we eliminate
-// goroutine creation/destruction overhead on the hot receive path.
+// SetLogger makes the layer log to l, with the attribute layer=tpkt.
+func (t *TPKT) SetLogger(l *slog.Logger) {
+	t.log = core.Logger(l, "tpkt")
+}
+
+// header is the decoded framing of one incoming packet.
+type header struct {
+	fastPath bool
+	secFlag  byte // fast-path encryption flags (bits 6-7 of the first byte)
+	bodyLen  int  // number of bytes following the header
+	rawLen   int  // number of bytes of the header
+}
+
+// peekHeader frames the next packet from the header bytes buffered in r,
+// without consuming them.
+//
+// The two framings are distinguished by the action field in the low two
+// bits of the first byte: FASTPATH_ACTION_X224 (3) selects a TPKT header,
+// which must be exactly 0x03 followed by a zero reserved byte, and
+// FASTPATH_ACTION_FASTPATH (0) selects a fast-path header regardless of
+// the flag bits (so 0x00 is a valid fast-path first byte).  Any other
+// value means the stream is out of sync and is reported as an error
+// rather than guessed at.
+func peekHeader(r *bufio.Reader) (header, error) {
+	hdr, err := peek(r, 2)
+	if err != nil {
+		return header{}, err
+	}
+
+	switch hdr[0] & 0x3 {
+	case FASTPATH_ACTION_X224:
+		if hdr[0] != FASTPATH_ACTION_X224 || hdr[1] != 0 {
+			return header{}, fmt.Errorf("TPKT: invalid header % x", hdr)
+		}
+		// TPKT packet: 4-byte header total (version, reserved, length-hi, length-lo)
+		if hdr, err = peek(r, 4); err != nil {
+			return header{}, err
+		}
+		size := binary.BigEndian.Uint16(hdr[2:])
+		if size < 4 {
+			return header{}, fmt.Errorf("TPKT: invalid packet size %d", size)
+		}
+		return header{bodyLen: int(size) - 4, rawLen: 4}, nil
+
+	case FASTPATH_ACTION_FASTPATH:
+		// FastPath packet: 2- or 3-byte header
+		h := header{fastPath: true, secFlag: (hdr[0] >> 6) & 0x3, rawLen: 2}
+		length := int(hdr[1])
+		if length&0x80 != 0 {
+			// Extended 3-byte header: high 7 bits from hdr[1], low 8 from next byte
+			if hdr, err = peek(r, 3); err != nil {
+				return header{}, err
+			}
+			h.bodyLen = (length&^0x80)<<8 + int(hdr[2]) - 3
+			h.rawLen = 3
+		} else {
+			h.bodyLen = length - 2
+		}
+		if h.bodyLen < 0 {
+			return header{}, fmt.Errorf("TPKT FastPath: invalid packet size %d", h.bodyLen)
+		}
+		return h, nil
+
+	default:
+		return header{}, fmt.Errorf("TPKT: unknown action in header byte 0x%02x", hdr[0])
+	}
+}
+
+// peek returns the next n bytes of r without consuming them.  A stream
+// ending within them is io.ErrUnexpectedEOF.
+func peek(r *bufio.Reader, n int) ([]byte, error) {
+	b, err := r.Peek(n)
+	if err == io.EOF && len(b) > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// readFrame reads the next packet of r whole, header included, into a
+// buffer from readBufs that the caller releases.
+func readFrame(r *bufio.Reader) (header, *core.Buffer, error) {
+	h, err := peekHeader(r)
+	if err != nil {
+		return header{}, nil, err
+	}
+	buf := readBufs.Get(h.rawLen + h.bodyLen)
+	if _, err := io.ReadFull(r, buf.B); err != nil {
+		buf.Release()
+		return header{}, nil, err
+	}
+	return h, buf, nil
+}
+
+// readLoop is the single goroutine that reads all incoming TPKT/FastPath
+// packets, from the buffered reader of the socket.  The listeners of a
+// packet run on it before the next packet is read, so a slow listener
+// holds the server back through TCP flow control rather than letting
+// packets pile up.  The first read error ends the loop and is the
+// "error" event.
 func (t *TPKT) readLoop() {
-	var hdr [2]byte
+	r := t.Conn.Reader()
 	for {
-		if _, err := io.ReadFull(t.Conn, hdr[:]); err != nil {
-			t.Emit("error", err)
+		if d := time.Duration(t.readTimeout.Load()); d > 0 {
+			t.Conn.SetReadDeadline(time.Now().Add(d))
+		}
+		h, buf, err := readFrame(r)
+		if err != nil {
+			t.readError(err)
 			return
 		}
+		t.dispatch(h, buf.B)
+		buf.Release()
+	}
+}
 
-		version := hdr[0]
-		if version == FASTPATH_ACTION_X224 {
-			// TPKT packet: 4-byte header total (version, reserved, length-hi, length-lo)
-			var extHdr [2]byte
-			if _, err := io.ReadFull(t.Conn, extHdr[:]); err != nil {
-				t.Emit("error", err)
-				return
-			}
-			size := binary.BigEndian.Uint16(extHdr[:])
-			if size < 4 {
-				t.Emit("error", fmt.Errorf("TPKT: invalid packet size %d", size))
-				return
-			}
-			body := acquireReadBuf(int(size) - 4)
-			if _, err := io.ReadFull(t.Conn, body); err != nil {
-				t.Emit("error", err)
-				return
-			}
-			t.Emit("data", body)
-			releaseReadBuf(body)
-		} else {
-			// FastPath packet: 2- or 3-byte header
-			secFlag := (version >> 6) & 0x3
-			length := int(hdr[1])
-			slog.Debug("TPKT FastPath", "secFlag", secFlag, "length", length)
-
-			var packetSize int
-			if length&0x80 != 0 {
-				// Extended 3-byte header: high 7 bits from hdr[1], low 8 from next byte
-				var extByte [1]byte
-				if _, err := io.ReadFull(t.Conn, extByte[:]); err != nil {
-					slog.Error("TPKT recvExtendedFastPathHeader", "err", err)
-					return
-				}
-				leftPart := length & ^0x80
-				packetSize = (leftPart<<8) + int(extByte[0]) - 3
-			} else {
-				packetSize = length - 2
-			}
-
-			if packetSize < 0 {
-				t.Emit("error", fmt.Errorf("TPKT FastPath: invalid packet size %d", packetSize))
-				return
-			}
-			body := acquireReadBuf(packetSize)
-			if _, err := io.ReadFull(t.Conn, body); err != nil {
-				slog.Debug("TPKT recvFastPath error", "err", err)
-				return
-			}
-			t.fastPathListener.RecvFastPath(secFlag, body)
-			releaseReadBuf(body)
+// dispatch hands a packet read by readLoop to its listeners.  The frame
+// keeps its header so the tap sees it whole.
+func (t *TPKT) dispatch(h header, frame []byte) {
+	if t.tap != nil {
+		t.capture(false, frame)
+	}
+	body := frame[h.rawLen:]
+	if h.fastPath {
+		t.log.Debug("TPKT FastPath", "secFlag", h.secFlag, "length", h.bodyLen)
+		if t.fastPathListener != nil {
+			t.fastPathListener.RecvFastPath(h.secFlag, body)
 		}
+	} else {
+		t.data.Emit(body)
+	}
+}
+
+// readError reports the error that ended readLoop.
+func (t *TPKT) readError(err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("tpkt: no packet for %s: %w", time.Duration(t.readTimeout.Load()), err)
 	}
+	t.errs.Emit(err)
+}
+
+// SetReadTimeout makes the connection fail when the server sends no
+// packet for d; zero, the default, waits forever.  It applies from the
+// next packet on.
+func (t *TPKT) SetReadTimeout(d time.Duration) {
+	t.readTimeout.Store(int64(d))
+}
+
+// OnData subscribes f to the slow-path PDUs received, the "data" event.
+// The slice is only valid during the call.
+func (t *TPKT) OnData(f func([]byte)) *emission.Subscription {
+	return t.data.Subscribe(f)
+}
+
+// OnError subscribes f to the read error that ends the connection, the
+// "error" event.
+func (t *TPKT) OnError(f func(error)) *emission.Subscription {
+	return t.errs.Subscribe(f)
+}
+
+// SetTLSConfig sets the TLS configuration of the underlying socket; see
+// core.SocketLayer.SetTLSConfig.
+func (t *TPKT) SetTLSConfig(config *tls.Config) {
+	t.Conn.SetTLSConfig(config)
+}
+
+// SetCertificatePolicy sets how the underlying socket verifies the
+// server certificate; see core.SocketLayer.SetCertificatePolicy.
+func (t *TPKT) SetCertificatePolicy(p *core.CertificatePolicy) {
+	t.Conn.SetCertificatePolicy(p)
 }
 
 func (t *TPKT) StartTLS() error {
@@ -150,107 +299,306 @@ func (t *TPKT) StartTLS() error {
 }
 
 func (t *TPKT) StartNLA() error {
-	// Set a deadline for the entire NLA handshake (TLS + NTLM auth)
-	// to prevent hanging indefinitely when the server is slow to respond.
-	t.Conn.SetDeadline(time.Now().Add(30 * time.Second))
 	defer t.Conn.SetDeadline(time.Time{}) // clear deadline after NLA completes
 
-	slog.Debug("StartNLA: TLS handshake begin")
+	t.log.Debug("StartNLA: TLS handshake begin")
+	t.Conn.SetDeadline(time.Now().Add(t.nlaTimeout))
 	err := t.StartTLS()
 	if err != nil {
-		slog.Error("StartNLA", "start tls failed", err)
+		t.log.Error("StartNLA: start tls failed", "err", err)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return &NLATimeoutError{Stage: "TLS handshake", Timeout: t.nlaTimeout, Attempts: 1, Err: err}
+		}
+		return err
+	}
+	t.log.Debug("StartNLA: TLS handshake complete")
+	// Extended Protection for Authentication: bind the NTLM exchange to
+	// the TLS server certificate.
+	if cert, err := t.Conn.PeerCertificate(); err == nil {
+		t.ntlm.SetChannelBindings(nla.TLSServerEndPoint(cert))
+	}
+	req, err := nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, []nla.Message{t.ntlm.GetNegotiateMessage()}, nil, nil, nil)
+	if err != nil {
+		t.log.Error("encode NegotiateMessage", "err", err)
 		return err
 	}
-	slog.Debug("StartNLA: TLS handshake complete")
-	req := nla.EncodeDERTRequest([]nla.Message{t.ntlm.GetNegotiateMessage()}, nil, nil)
-	slog.Debug("StartNLA send", "req", core.Hex(req), "len", len(req))
+	t.log.Debug("StartNLA send", "req", core.Hex(req), "len", len(req))
+	t.Conn.SetDeadline(time.Now().Add(t.nlaTimeout))
 	_, err = t.Conn.Write(req)
 	if err != nil {
-		slog.Error("send NegotiateMessage", "err", err)
+		t.log.Error("send NegotiateMessage", "err", err)
 		return err
 	}
 
-	resp := make([]byte, 1024)
-	n, err := t.Conn.Read(resp)
-	slog.Debug("StartNLA recv", "n", n, "err", err)
+	resp, err := t.readTSRequest("CHALLENGE")
+	t.log.Debug("StartNLA recv", "n", len(resp), "err", err)
 	if err != nil {
-		return fmt.Errorf("read %s", err)
-	} else {
-		slog.Debug("StartNLA Read success")
+		return err
 	}
-	return t.recvChallenge(resp[:n])
+	return t.recvChallenge(resp)
+}
+
+// ProbeNLA performs TLS and the NTLM NEGOTIATE/CHALLENGE round trip of
+// CredSSP, then stops: no AUTHENTICATE message is sent, so no logon is
+// attempted and no account can be locked out.  It returns what the
+// server disclosed in its CHALLENGE.
+func (t *TPKT) ProbeNLA() (*nla.ChallengeInfo, error) {
+	defer t.Conn.SetDeadline(time.Time{})
+
+	t.Conn.SetDeadline(time.Now().Add(t.nlaTimeout))
+	if err := t.StartTLS(); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, &NLATimeoutError{Stage: "TLS handshake", Timeout: t.nlaTimeout, Attempts: 1, Err: err}
+		}
+		return nil, err
+	}
+	req, err := nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, []nla.Message{t.ntlm.GetNegotiateMessage()}, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	t.Conn.SetDeadline(time.Now().Add(t.nlaTimeout))
+	if _, err := t.Conn.Write(req); err != nil {
+		return nil, err
+	}
+	resp, err := t.readTSRequest("CHALLENGE")
+	if err != nil {
+		return nil, err
+	}
+	tsreq, err := nla.DecodeDERTRequest(resp)
+	if err != nil {
+		return nil, err
+	}
+	if err := tsreq.Err(); err != nil {
+		return nil, err
+	}
+	if len(tsreq.NegoTokens) == 0 {
+		return nil, errors.New("nla: CHALLENGE without negoToken")
+	}
+	challenge, err := nla.ParseChallengeMessage(tsreq.NegoTokens[0].Data)
+	if err != nil {
+		return nil, fmt.Errorf("nla: parse CHALLENGE: %w", err)
+	}
+	return challenge.Info(), nil
+}
+
+// SetNLATimeout sets how long each CredSSP message may take and how many
+// times a timed-out read is retried before StartNLA gives up with an
+// NLATimeoutError.
+func (t *TPKT) SetNLATimeout(timeout time.Duration, retries int) {
+	t.nlaTimeout = timeout
+	t.nlaRetries = retries
+}
+
+// readTSRequest reads one complete DER-encoded TSRequest, using the outer
+// SEQUENCE length to find its end.  stage names the expected message in
+// errors.
+func (t *TPKT) readTSRequest(stage string) ([]byte, error) {
+	var buf []byte
+	attempts := 1
+	fill := func(n int) error {
+		buf = slices.Grow(buf, n-len(buf))
+		for len(buf) < n {
+			m, err := t.Conn.Read(buf[len(buf):n])
+			buf = buf[:len(buf)+m]
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				return fmt.Errorf("nla: read %s: %w", stage, err)
+			}
+			if attempts > t.nlaRetries {
+				return &NLATimeoutError{Stage: stage, Timeout: t.nlaTimeout, Attempts: attempts, Err: err}
+			}
+			attempts++
+			t.log.Warn("NLA read timed out, retrying", "stage", stage, "attempt", attempts)
+			t.Conn.SetDeadline(time.Now().Add(t.nlaTimeout))
+		}
+		return nil
+	}
+
+	t.Conn.SetDeadline(time.Now().Add(t.nlaTimeout))
+	if err := fill(2); err != nil {
+		return nil, err
+	}
+	if buf[0] != 0x30 {
+		return nil, fmt.Errorf("nla: %s: not a TSRequest (tag 0x%02x)", stage, buf[0])
+	}
+	hdrLen, size := 2, int(buf[1])
+	if size&0x80 != 0 {
+		n := size & 0x7f
+		if n == 0 || n > 3 {
+			return nil, fmt.Errorf("nla: %s: invalid TSRequest length", stage)
+		}
+		if err := fill(2 + n); err != nil {
+			return nil, err
+		}
+		size = 0
+		for _, b := range buf[2 : 2+n] {
+			size = size<<8 | int(b)
+		}
+		hdrLen += n
+	}
+	if err := fill(hdrLen + size); err != nil {
+		return nil, err
+	}
+	return buf, nil
 }
 
 func (t *TPKT) recvChallenge(data []byte) error {
-	slog.Debug("recvChallenge", "data", core.Hex(data))
+	t.log.Debug("recvChallenge", "data", core.Hex(data))
 	tsreq, err := nla.DecodeDERTRequest(data)
 	if err != nil {
-		slog.Debug("DecodeDERTRequest", "err", err)
+		t.log.Debug("DecodeDERTRequest", "err", err)
 		return err
 	}
-	slog.Debug("recvChallenge", "tsreq", tsreq)
-	// get pubkey
-	pubkey, err := t.Conn.TlsPubKey()
-	slog.Debug("recvChallenge", "pubkey", core.Hex(pubkey))
+	t.log.Debug("recvChallenge", "tsreq", tsreq)
+	if err := tsreq.Err(); err != nil {
+		return err
+	}
+	t.credsspVersion = nla.NegotiateVersion(tsreq.Version)
+	t.clientNonce = nil
+	if t.credsspVersion >= nla.CREDSSP_VERSION_5 {
+		t.clientNonce = nla.NewClientNonce()
+	}
+	t.log.Debug("recvChallenge", "serverVersion", tsreq.Version, "credsspVersion", t.credsspVersion)
+	if len(tsreq.NegoTokens) == 0 {
+		return errors.New("nla: CHALLENGE without negoToken")
+	}
 
-	authMsg, ntlmSec := t.ntlm.GetAuthenticateMessage(tsreq.NegoTokens[0].Data)
+	if t.credentials != nil {
+		domain, user, password, err := t.credentials()
+		if err != nil {
+			return fmt.Errorf("nla: credentials: %w", err)
+		}
+		t.ntlm.SetCredentials(domain, user, password)
+	}
+	authMsg, ntlmSec, err := t.ntlm.GetAuthenticateMessage(tsreq.NegoTokens[0].Data)
+	if err != nil {
+		return fmt.Errorf("nla: parse CHALLENGE: %w", err)
+	}
 	t.ntlmSec = ntlmSec
 
-	encryptPubkey := ntlmSec.GssEncrypt(pubkey)
-	req := nla.EncodeDERTRequest([]nla.Message{authMsg}, nil, encryptPubkey)
-	slog.Debug("recvChallenge", "send", core.Hex(req), "len", len(req))
+	// get pubkey
+	pubkey, err := t.Conn.TlsPubKey()
+	if err != nil {
+		return fmt.Errorf("nla: server public key: %w", err)
+	}
+	t.log.Debug("recvChallenge", "pubkey", core.Hex(pubkey))
+
+	encryptPubkey := ntlmSec.GssEncrypt(nla.ClientPubKeyAuth(t.credsspVersion, t.clientNonce, pubkey))
+	req, err := nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, []nla.Message{authMsg}, nil, encryptPubkey, t.clientNonce)
+	if err != nil {
+		t.log.Error("encode AuthenticateMessage", "err", err)
+		return err
+	}
+	t.log.Debug("recvChallenge", "send", core.Hex(req), "len", len(req))
+	t.Conn.SetDeadline(time.Now().Add(t.nlaTimeout))
 	_, err = t.Conn.Write(req)
 	if err != nil {
-		slog.Error("send AuthenticateMessage", "err", err)
+		t.log.Error("send AuthenticateMessage", "err", err)
 		return err
 	}
 
-	slog.Debug("recvChallenge read challenge start")
-	resp := make([]byte, 1024)
-	n, err := t.Conn.Read(resp)
+	t.log.Debug("recvChallenge read challenge start")
+	resp, err := t.readTSRequest("pubKeyAuth")
 	if err != nil {
-		slog.Error("recvChallenge", "err", err)
-		return fmt.Errorf("read %s", err)
+		t.log.Error("recvChallenge", "err", err)
+		return err
 	}
 
-	return t.recvPubKeyInc(resp[:n])
+	return t.recvPubKeyInc(resp)
 }
 
 func (t *TPKT) recvPubKeyInc(data []byte) error {
-	slog.Debug("recvPubKeyInc", "data", core.Hex(data), "len", len(data))
+	t.log.Debug("recvPubKeyInc", "data", core.Hex(data), "len", len(data))
 	tsreq, err := nla.DecodeDERTRequest(data)
 	if err != nil {
-		slog.Debug("DecodeDERTRequest", "err", err)
+		t.log.Debug("DecodeDERTRequest", "err", err)
+		return err
+	}
+	if err := tsreq.Err(); err != nil {
+		t.log.Error("recvPubKeyInc", "err", err)
+		return err
+	}
+	t.log.Debug("PubKeyAuth", "key", core.Hex(tsreq.PubKeyAuth))
+	serverAuth := t.ntlmSec.GssDecrypt([]byte(tsreq.PubKeyAuth))
+	t.log.Debug("GssDecrypt", "pubKeyAuth", core.Hex(serverAuth))
+	pubkey, err := t.Conn.TlsPubKey()
+	if err != nil {
+		return err
+	}
+	if err := nla.VerifyServerPubKeyAuth(t.credsspVersion, t.clientNonce, pubkey, serverAuth); err != nil {
+		t.log.Error("recvPubKeyInc", "err", err)
+		return err
+	}
+	credentials, err := t.delegatedCredentials()
+	if err != nil {
 		return err
 	}
-	slog.Debug("PubKeyAuth", "key", core.Hex(tsreq.PubKeyAuth))
-	//ignore
-	pubkey := t.ntlmSec.GssDecrypt([]byte(tsreq.PubKeyAuth))
-	slog.Debug("GssDecrypy", "pubkey", core.Hex(pubkey))
-	domain, username, password := t.ntlm.GetEncodedCredentials()
-	credentials := nla.EncodeDERTCredentials(domain, username, password)
 	authInfo := t.ntlmSec.GssEncrypt(credentials)
-	req := nla.EncodeDERTRequest(nil, authInfo, nil)
+	req, err := nla.EncodeDERTRequestVersion(nla.CREDSSP_VERSION, nil, authInfo, nil, nil)
+	if err != nil {
+		return err
+	}
+	t.Conn.SetDeadline(time.Now().Add(t.nlaTimeout))
 	_, err = t.Conn.Write(req)
 	if err != nil {
-		slog.Debug("send AuthenticateMessage", "err", err)
+		t.log.Debug("send AuthenticateMessage", "err", err)
 		return err
 	}
 
 	return nil
 }
 
+// delegatedCredentials encodes the TSCredentials sent in the final
+// CredSSP message.
+func (t *TPKT) delegatedCredentials() ([]byte, error) {
+	switch {
+	case t.remoteGuard != nil:
+		return nla.EncodeDERTRemoteGuardCredentials(t.remoteGuard)
+	case t.smartCard != nil:
+		sc, err := t.smartCard.SmartCard()
+		if err != nil {
+			return nil, fmt.Errorf("nla: smart card: %w", err)
+		}
+		return nla.EncodeDERTSmartCardCredentials(sc)
+	}
+	domain, username, password := t.ntlm.GetEncodedCredentials()
+	return nla.EncodeDERTCredentials(domain, username, password)
+}
+
+// SetSmartCardProvider makes NLA delegate TSSmartCardCreds from p instead
+// of the user's password.  nil restores password delegation.
+func (t *TPKT) SetSmartCardProvider(p nla.SmartCardProvider) {
+	t.smartCard = p
+}
+
+// SetCredentialsFunc makes NLA ask f for the account when the server's
+// CHALLENGE arrives instead of using the one passed to New.
+func (t *TPKT) SetCredentialsFunc(f func() (domain, user, password string, err error)) {
+	t.credentials = f
+}
+
+// SetRemoteGuardCredentials makes NLA send creds as TSRemoteGuardCreds
+// instead of the user's password.  nil restores password delegation.
+func (t *TPKT) SetRemoteGuardCredentials(creds *nla.TSRemoteGuardCreds) {
+	t.remoteGuard = creds
+}
+
 func (t *TPKT) Read(b []byte) (n int, err error) {
 	return t.Conn.Read(b)
 }
 
 func (t *TPKT) Write(data []byte) (n int, err error) {
-	buf := writePool.Get().([]byte)
+	buf := writeBufs.Get(0)
 	size := uint16(len(data) + 4)
-	buf = append(buf[:0], FASTPATH_ACTION_X224, 0, byte(size>>8), byte(size))
-	buf = append(buf, data...)
-	n, err = t.Conn.Write(buf)
-	writePool.Put(buf[:0])
+	buf.B = append(buf.B, FASTPATH_ACTION_X224, 0, byte(size>>8), byte(size))
+	buf.B = append(buf.B, data...)
+	n, err = t.Conn.Write(buf.B)
+	if t.tap != nil {
+		t.capture(true, buf.B)
+	}
+	buf.Release()
 	return
 }
 
@@ -263,12 +611,34 @@ func (t *TPKT) SetFastPathListener(f core.FastPathListener) {
 }
 
 func (t *TPKT) SendFastPath(secFlag byte, data []byte) (n int, err error) {
-	buf := writePool.Get().([]byte)
+	buf := writeBufs.Get(0)
 	hdr := uint16(len(data)+3) | 0x8000
-	buf = append(buf[:0], FASTPATH_ACTION_FASTPATH|((secFlag&0x3)<<6), byte(hdr>>8), byte(hdr))
-	buf = append(buf, data...)
-	n, err = t.Conn.Write(buf)
-	writePool.Put(buf[:0])
+	buf.B = append(buf.B, FASTPATH_ACTION_FASTPATH|((secFlag&0x3)<<6), byte(hdr>>8), byte(hdr))
+	buf.B = append(buf.B, data...)
+	n, err = t.Conn.Write(buf.B)
+	if t.tap != nil {
+		t.capture(true, buf.B)
+	}
+	buf.Release()
 	return
 }
 
+// SetTap makes the layer hand a copy of every TPKT frame and fast-path
+// PDU it sends or receives to tap.  It must be called before the
+// connection request is sent.
+func (t *TPKT) SetTap(tap core.Tap) {
+	t.tap = tap
+}
+
+// capture hands frame to the tap.
+func (t *TPKT) capture(outbound bool, frame []byte) {
+	layer := "fastpath"
+	if frame[0]&0x3 == FASTPATH_ACTION_X224 {
+		layer = "x224"
+		// the TPDU code follows the TPKT header and the length indicator
+		if len(frame) > 5 && frame[5] == 0xF0 {
+			layer = "mcs"
+		}
+	}
+	t.tap.Capture(core.TapPDU{Time: time.Now(), Outbound: outbound, Layer: layer, Data: frame})
+}
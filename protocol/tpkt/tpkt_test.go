@@ -0,0 +1,197 @@
+package tpkt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/protocol/nla"
+)
+
+func TestPeekHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []byte
+		fastPath bool
+		secFlag  byte
+		bodyLen  int
+	}{
+		{"tpkt", []byte{0x03, 0x00, 0x00, 0x0b}, false, 0, 7},
+		{"tpkt empty", []byte{0x03, 0x00, 0x00, 0x04}, false, 0, 0},
+		{"fastpath zero first byte", []byte{0x00, 0x05}, true, 0, 3},
+		{"fastpath encrypted", []byte{0x80, 0x10}, true, 2, 14},
+		{"fastpath secure checksum", []byte{0x40, 0x02}, true, 1, 0},
+		{"fastpath long length", []byte{0x00, 0x81, 0x2c}, true, 0, 0x12c - 3},
+		{"fastpath reserved bits", []byte{0x3c, 0x04}, true, 0, 2},
+		{"fastpath byte resembling version 3 length", []byte{0x00, 0x83, 0x00}, true, 0, 0x300 - 3},
+	}
+	for _, tt := range tests {
+		h, err := peekHeader(bufio.NewReader(bytes.NewReader(tt.in)))
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+			continue
+		}
+		if h.fastPath != tt.fastPath || h.secFlag != tt.secFlag || h.bodyLen != tt.bodyLen {
+			t.Errorf("%s: got %+v", tt.name, h)
+		}
+	}
+}
+
+func TestPeekHeaderRejectsDesync(t *testing.T) {
+	bad := map[string][]byte{
+		"action 1":              {0x01, 0x00},
+		"action 2":              {0x02, 0x00},
+		"action 3 with flags":   {0x43, 0x00, 0x00, 0x10},
+		"tpkt nonzero reserved": {0x03, 0x01, 0x00, 0x10},
+		"tpkt short size":       {0x03, 0x00, 0x00, 0x03},
+		"fastpath short 2-byte": {0x00, 0x01},
+		"fastpath short 3-byte": {0x00, 0x80, 0x02},
+		"truncated tpkt":        {0x03, 0x00, 0x00},
+		"truncated fastpath":    {0x00, 0x80},
+	}
+	for name, in := range bad {
+		if h, err := peekHeader(bufio.NewReader(bytes.NewReader(in))); err == nil {
+			t.Errorf("%s: expected error, got %+v", name, h)
+		}
+	}
+}
+
+func TestReadTSRequestRetry(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tp := &TPKT{Conn: core.NewSocketLayer(client, ""), nlaTimeout: 50 * time.Millisecond, nlaRetries: 2, log: core.DefaultLogger}
+
+	msg := []byte{0x30, 0x81, 0x03, 0xa0, 0x01, 0x06}
+	go func() {
+		server.Write(msg[:4])
+		time.Sleep(80 * time.Millisecond) // stall past one timeout
+		server.Write(msg[4:])
+	}()
+	got, err := tp.readTSRequest("CHALLENGE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Errorf("got % x, want % x", got, msg)
+	}
+}
+
+func TestReadTSRequestTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tp := &TPKT{Conn: core.NewSocketLayer(client, ""), nlaTimeout: 20 * time.Millisecond, nlaRetries: 1, log: core.DefaultLogger}
+
+	_, err := tp.readTSRequest("pubKeyAuth")
+	var te *NLATimeoutError
+	if !errors.As(err, &te) {
+		t.Fatalf("got %v, want NLATimeoutError", err)
+	}
+	if te.Stage != "pubKeyAuth" || te.Attempts != 2 {
+		t.Errorf("unexpected error %+v", te)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("%v does not unwrap to os.ErrDeadlineExceeded", err)
+	}
+}
+
+// rawToken is a negoToken of the given bytes.
+type rawToken []byte
+
+func (r rawToken) Serialize() []byte { return r }
+
+// TestRecvChallengeMalformed feeds CHALLENGE TSRequests that used to
+// panic the login: one without negoTokens, one with a truncated NTLM
+// CHALLENGE message and, without TLS, one without a server key.
+func TestRecvChallengeMalformed(t *testing.T) {
+	challenge := []byte("NTLMSSP\x00\x02\x00\x00\x00\x00\x00\x00\x00\x38\x00\x00\x00\x35\x82\x8a\xe2" +
+		"\x01\x02\x03\x04\x05\x06\x07\x08\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"\x00\x00\x00\x00\x38\x00\x00\x00\x0a\x00\x63\x45\x00\x00\x00\x0f")
+	for _, tt := range []struct {
+		name   string
+		tokens []nla.Message
+		want   string
+	}{
+		{"no negoToken", nil, "without negoToken"},
+		{"truncated CHALLENGE", []nla.Message{rawToken(challenge[:20])}, "parse CHALLENGE"},
+		{"no TLS", []nla.Message{rawToken(challenge)}, "server public key"},
+	} {
+		req, err := nla.EncodeDERTRequestVersion(6, tt.tokens, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, server := net.Pipe()
+		tp := &TPKT{Conn: core.NewSocketLayer(client, ""), ntlm: nla.NewNTLMv2("", "user", "password"),
+			nlaTimeout: time.Second, log: core.DefaultLogger}
+		if err := tp.recvChallenge(req); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+type recorder struct{ frames [][]byte }
+
+func (r *recorder) Capture(p core.TapPDU)               { r.frames = append(r.frames, bytes.Clone(p.Data)) }
+func (r *recorder) RecvFastPath(secFlag byte, s []byte) { r.frames = append(r.frames, bytes.Clone(s)) }
+
+func TestReadLoop(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	tp := New(core.NewSocketLayer(client, ""), nil)
+	var tap, fastPath recorder
+	tp.SetTap(&tap)
+	tp.SetFastPathListener(&fastPath)
+	var data [][]byte
+	tp.OnData(func(b []byte) { data = append(data, bytes.Clone(b)) })
+	done := make(chan error)
+	tp.OnError(func(err error) { done <- err })
+
+	frames := [][]byte{{0x03, 0x00, 0x00, 0x07, 1, 2, 3}, {0x00, 0x05, 4, 5, 6}, {0x03, 0x00, 0x00, 0x05, 7}}
+	for _, f := range frames {
+		server.Write(f)
+	}
+	server.Close()
+	<-done
+	if len(data) != 2 || !bytes.Equal(data[0], []byte{1, 2, 3}) || !bytes.Equal(data[1], []byte{7}) {
+		t.Errorf("data %x", data)
+	}
+	if len(fastPath.frames) != 1 || !bytes.Equal(fastPath.frames[0], []byte{4, 5, 6}) {
+		t.Errorf("fast-path %x", fastPath.frames)
+	}
+	if len(tap.frames) != len(frames) {
+		t.Fatalf("tapped %x", tap.frames)
+	}
+	for i, f := range frames {
+		if !bytes.Equal(tap.frames[i], f) {
+			t.Errorf("tapped % x, want % x", tap.frames[i], f)
+		}
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	tp := New(core.NewSocketLayer(client, ""), nil)
+	tp.SetReadTimeout(20 * time.Millisecond)
+	done := make(chan error)
+	tp.OnError(func(err error) { done <- err })
+	server.Write([]byte{0x03, 0x00, 0x00, 0x05, 1})
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("got %v, want a deadline error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no timeout")
+	}
+}
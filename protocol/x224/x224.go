@@ -54,6 +54,61 @@ const (
 	PROTOCOL_HYBRID_EX        = 0x00000008
 )
 
+// ProtocolName returns the MS-RDPBCGR name of a selected security protocol.
+func ProtocolName(p uint32) string {
+	switch p {
+	case PROTOCOL_RDP:
+		return "PROTOCOL_RDP"
+	case PROTOCOL_SSL:
+		return "PROTOCOL_SSL"
+	case PROTOCOL_HYBRID:
+		return "PROTOCOL_HYBRID"
+	case PROTOCOL_HYBRID_EX:
+		return "PROTOCOL_HYBRID_EX"
+	}
+	return fmt.Sprintf("PROTOCOL_0x%08x", p)
+}
+
+// protocolRank orders security protocols by the protection they offer.
+func protocolRank(p uint32) int {
+	switch {
+	case p&PROTOCOL_HYBRID_EX != 0:
+		return 3
+	case p&PROTOCOL_HYBRID != 0:
+		return 2
+	case p&PROTOCOL_SSL != 0:
+		return 1
+	}
+	return 0
+}
+
+// strongestProtocol returns the strongest protocol in the requested mask.
+func strongestProtocol(requested uint32) uint32 {
+	for _, p := range []uint32{PROTOCOL_HYBRID_EX, PROTOCOL_HYBRID, PROTOCOL_SSL} {
+		if requested&p != 0 {
+			return p
+		}
+	}
+	return PROTOCOL_RDP
+}
+
+/**
+ * Flags of the RDP_NEG_REQ and RDP_NEG_RSP structures
+ * @see https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/902b090b-9cb3-4efc-92bf-ee13373371e3
+ */
+const (
+	// RDP_NEG_REQ
+	RESTRICTED_ADMIN_MODE_REQUIRED          uint8 = 0x01
+	REDIRECTED_AUTHENTICATION_MODE_REQUIRED       = 0x02
+	CORRELATION_INFO_PRESENT                      = 0x08
+
+	// RDP_NEG_RSP
+	EXTENDED_CLIENT_DATA_SUPPORTED           uint8 = 0x01
+	DYNVC_GFX_PROTOCOL_SUPPORTED                   = 0x02
+	RESTRICTED_ADMIN_MODE_SUPPORTED                = 0x08
+	REDIRECTED_AUTHENTICATION_MODE_SUPPORTED       = 0x10
+)
+
 /**
  * Use to negotiate security layer of RDP stack
  * In node-rdpjs only ssl is available
@@ -95,6 +150,16 @@ const (
 	SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER = 0x00000006
 )
 
+// NegotiationFailureError is emitted when the server answers the
+// connection request with an RDP_NEG_FAILURE.
+type NegotiationFailureError struct {
+	Code uint32 // e.g. HYBRID_REQUIRED_BY_SERVER
+}
+
+func (e *NegotiationFailureError) Error() string {
+	return fmt.Sprintf("NODE_RDP_PROTOCOL_X224_NEG_FAILURE with code: %d, see https://msdn.microsoft.com/en-us/library/cc240507.aspx", e.Code)
+}
+
 /**
  * X224 client connection request
  * @param opt {object} component type options
@@ -181,12 +246,20 @@ func NewDataHeader() *DataHeader {
  */
 type X224 struct {
 	emission.Emitter
+	// data and connected are the typed "data" and "connect" events.
+	data              emission.Event[[]byte]
+	connected         emission.Event[uint32]
+	negotiated        emission.Event[uint32]
 	transport         core.Transport
 	requestedProtocol uint32
 	selectedProtocol  uint32
 	dataHeader        *DataHeader
 	username          string
 	routingToken      []byte
+	requestFlags      uint8
+	downgradeHandler  func(requested, selected uint32) error
+	nlaProbe          bool
+	log               *slog.Logger
 }
 
 func New(t core.Transport) *X224 {
@@ -196,7 +269,10 @@ func New(t core.Transport) *X224 {
 		requestedProtocol: PROTOCOL_RDP | PROTOCOL_SSL | PROTOCOL_HYBRID,
 		selectedProtocol:  PROTOCOL_SSL,
 		dataHeader:        NewDataHeader(),
+		log:               core.Logger(nil, "x224"),
 	}
+	x.data.Shim(&x.Emitter, "data", nil, nil)
+	x.connected.Shim(&x.Emitter, "connect", nil, nil)
 
 	t.On("close", func() {
 		x.Emit("close")
@@ -207,6 +283,30 @@ func New(t core.Transport) *X224 {
 	return x
 }
 
+// SetLogger makes the layer log to l, with the attribute layer=x224.
+func (x *X224) SetLogger(l *slog.Logger) {
+	x.log = core.Logger(l, "x224")
+}
+
+// OnData subscribes f to the payload of the Data TPDUs received, the
+// "data" event.
+func (x *X224) OnData(f func([]byte)) *emission.Subscription {
+	return x.data.Subscribe(f)
+}
+
+// OnConnect subscribes f to the end of the connection sequence, the
+// "connect" event, with the security protocol the server selected.
+func (x *X224) OnConnect(f func(selectedProtocol uint32)) *emission.Subscription {
+	return x.connected.Subscribe(f)
+}
+
+// OnNegotiated subscribes f to the acceptance of the Connection Confirm,
+// with the security protocol the server selected, before the TLS or
+// CredSSP handshake that ends with "connect".
+func (x *X224) OnNegotiated(f func(selectedProtocol uint32)) *emission.Subscription {
+	return x.negotiated.Subscribe(f)
+}
+
 func (x *X224) Read(b []byte) (n int, err error) {
 	return x.transport.Read(b)
 }
@@ -233,6 +333,28 @@ func (x *X224) SetRequestedProtocol(p uint32) {
 	x.requestedProtocol = p
 }
 
+// SetRequestFlags sets the flags field of the RDP_NEG_REQ, e.g.
+// REDIRECTED_AUTHENTICATION_MODE_REQUIRED for Remote Credential Guard.
+func (x *X224) SetRequestFlags(flags uint8) {
+	x.requestFlags = flags
+}
+
+// SetDowngradeHandler registers f to be called when the server selects a
+// weaker security protocol than the strongest one requested, including
+// the fallback to Standard RDP Security by servers that do not negotiate.
+// selected is compared before any TLS or NLA step begins; a non-nil error
+// from f aborts the connection with that error.
+func (x *X224) SetDowngradeHandler(f func(requested, selected uint32) error) {
+	x.downgradeHandler = f
+}
+
+// SetNLAProbe makes a CredSSP connection stop after the server's NTLM
+// CHALLENGE: "nlaProbe" is emitted with the *nla.ChallengeInfo and the
+// connection is closed without authenticating.
+func (x *X224) SetNLAProbe(enabled bool) {
+	x.nlaProbe = enabled
+}
+
 func (x *X224) SetUsername(username string) {
 	x.username = username
 }
@@ -264,33 +386,44 @@ func (x *X224) Connect() error {
 
 	message := NewClientConnectionRequestPDU([]byte(cookie), x.requestedProtocol)
 	message.ProtocolNeg.Type = TYPE_RDP_NEG_REQ
+	message.ProtocolNeg.Flag = x.requestFlags
 	message.ProtocolNeg.Result = uint32(x.requestedProtocol)
 
-	slog.Debug("x224 Connect", "message", core.Hex(message.Serialize()))
+	x.log.Debug("x224 Connect", "message", core.Hex(message.Serialize()))
 	_, err := x.transport.Write(message.Serialize())
 	x.transport.Once("data", x.recvConnectionConfirm)
 	return err
 }
 
+// protocolError ends the connection on the PDU s that could not be
+// parsed.
+func (x *X224) protocolError(name string, s []byte, err error) {
+	x.log.Error("malformed PDU", core.LogPDU, name, "err", err)
+	x.Emit("error", core.NewProtocolError("x224", name, s, err))
+	x.Close()
+}
+
 func (x *X224) recvConnectionConfirm(s []byte) {
-	slog.Debug("x224 recvConnectionConfirm", "s", core.Hex(s))
+	x.log.Debug("x224 recvConnectionConfirm", "s", core.Hex(s))
 	r := bytes.NewReader(s)
-	ln, _ := core.ReadUInt8(r)
+	ln, err := core.ReadUInt8(r)
+	if err != nil {
+		x.protocolError("Connection Confirm", s, err)
+		return
+	}
 	if ln > 6 {
 		message := &ServerConnectionConfirm{}
 		if err := struc.Unpack(bytes.NewReader(s), message); err != nil {
-			slog.Error("ReadServerConnectionConfirm", "err", err)
-			x.Emit("error", err)
+			x.protocolError("Connection Confirm", s, err)
 			return
 		}
-		slog.Debug("recvConnectionConfirm", "message", *message.ProtocolNeg)
+		x.log.Debug("recvConnectionConfirm", "message", *message.ProtocolNeg)
 		if message.ProtocolNeg.Type == TYPE_RDP_NEG_FAILURE {
-			negErr := fmt.Errorf("NODE_RDP_PROTOCOL_X224_NEG_FAILURE with code: %d, see https://msdn.microsoft.com/en-us/library/cc240507.aspx",
-				message.ProtocolNeg.Result)
-			slog.Error(negErr.Error())
+			negErr := &NegotiationFailureError{Code: message.ProtocolNeg.Result}
+			x.log.Error(negErr.Error())
 			//only use Standard RDP Security mechanisms
 			if message.ProtocolNeg.Result == 2 {
-				slog.Debug("Only use Standard RDP Security mechanisms, Reconnect with Standard RDP")
+				x.log.Debug("Only use Standard RDP Security mechanisms, Reconnect with Standard RDP")
 			}
 			x.Emit("error", negErr)
 			x.Close()
@@ -298,8 +431,16 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		}
 
 		if message.ProtocolNeg.Type == TYPE_RDP_NEG_RSP {
-			slog.Debug("TYPE_RDP_NEG_RSP")
+			x.log.Debug("TYPE_RDP_NEG_RSP")
 			x.selectedProtocol = message.ProtocolNeg.Result
+			if x.requestFlags&REDIRECTED_AUTHENTICATION_MODE_REQUIRED != 0 &&
+				message.ProtocolNeg.Flag&REDIRECTED_AUTHENTICATION_MODE_SUPPORTED == 0 {
+				err := errors.New("NODE_RDP_PROTOCOL_X224_REDIRECTED_AUTHENTICATION_NOT_SUPPORTED")
+				x.log.Error(err.Error())
+				x.Emit("error", err)
+				x.Close()
+				return
+			}
 		}
 	} else {
 		x.selectedProtocol = PROTOCOL_RDP
@@ -307,45 +448,83 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 
 	if x.selectedProtocol == PROTOCOL_HYBRID_EX {
 		err := errors.New("NODE_RDP_PROTOCOL_HYBRID_EX_NOT_SUPPORTED")
-		slog.Error(err.Error())
+		x.log.Error(err.Error())
 		x.Emit("error", err)
 		return
 	}
 
-	x.transport.On("data", x.recvData)
+	if protocolRank(x.selectedProtocol) < protocolRank(x.requestedProtocol) {
+		x.log.Warn("x224 security downgrade", "requested", ProtocolName(strongestProtocol(x.requestedProtocol)),
+			"selected", ProtocolName(x.selectedProtocol))
+		if x.downgradeHandler != nil {
+			if err := x.downgradeHandler(x.requestedProtocol, x.selectedProtocol); err != nil {
+				x.Emit("error", err)
+				x.Close()
+				return
+			}
+		}
+	}
+
+	x.negotiated.Emit(x.selectedProtocol)
+	core.OnData(x.transport, x.recvData)
 
 	if x.selectedProtocol == PROTOCOL_RDP {
-		slog.Debug("*** RDP security selected ***")
-		x.Emit("connect", x.selectedProtocol)
+		x.log.Debug("*** RDP security selected ***")
+		x.connected.Emit(x.selectedProtocol)
 		return
 	}
 
 	if x.selectedProtocol == PROTOCOL_SSL {
-		slog.Debug("*** SSL security selected ***")
+		x.log.Debug("*** SSL security selected ***")
 		err := x.transport.(*tpkt.TPKT).StartTLS()
 		if err != nil {
-			slog.Error("start tls failed:", "err", err)
+			x.log.Error("start tls failed:", "err", err)
+			x.Emit("error", err)
+			return
+		}
+		x.connected.Emit(x.selectedProtocol)
+		return
+	}
+
+	if x.selectedProtocol == PROTOCOL_HYBRID && x.nlaProbe {
+		info, err := x.transport.(*tpkt.TPKT).ProbeNLA()
+		if err != nil {
+			x.log.Debug("NLA probe failed", "err", err)
 			x.Emit("error", err)
 			return
 		}
-		x.Emit("connect", x.selectedProtocol)
+		x.Emit("nlaProbe", info)
+		x.Close()
 		return
 	}
 
 	if x.selectedProtocol == PROTOCOL_HYBRID {
-		slog.Debug("*** NLA Security selected ***")
+		x.log.Debug("*** NLA Security selected ***")
 		err := x.transport.(*tpkt.TPKT).StartNLA()
 		if err != nil {
-			slog.Error("start NLA failed:", "err", err)
+			x.log.Error("start NLA failed:", "err", err)
 			x.Emit("error", err)
 			return
 		}
-		x.Emit("connect", x.selectedProtocol)
+		x.connected.Emit(x.selectedProtocol)
 		return
 	}
 }
 
+// SendDisconnectRequest sends a Disconnect Request TPDU, the last PDU of
+// a graceful disconnect.
+func (x *X224) SendDisconnectRequest() error {
+	// LI, code, DST-REF, SRC-REF, reason (normal disconnect)
+	_, err := x.transport.Write([]byte{6, byte(TPDU_DISCONNECT_REQUEST), 0, 0, 0, 0, 0})
+	return err
+}
+
 func (x *X224) recvData(s []byte) {
+	if len(s) >= 2 && MessageType(s[1]) == TPDU_DISCONNECT_REQUEST {
+		x.log.Debug("x224 Disconnect Request")
+		x.Close()
+		return
+	}
 	// x224 header takes 3 bytes
-	x.Emit("data", s[3:])
+	x.data.Emit(s[3:])
 }
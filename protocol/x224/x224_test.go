@@ -0,0 +1,96 @@
+package x224
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/nakagami/grdp/emission"
+	"github.com/nakagami/grdp/testutil"
+)
+
+type fakeTransport struct {
+	emission.Emitter
+	closed bool
+}
+
+func (f *fakeTransport) Read(b []byte) (int, error)  { return 0, nil }
+func (f *fakeTransport) Write(b []byte) (int, error) { return len(b), nil }
+func (f *fakeTransport) Close() error                { f.closed = true; return nil }
+
+// connectionConfirm builds a server Connection Confirm with an RDP_NEG_RSP.
+func connectionConfirm(selected uint32) []byte {
+	return []byte{0x0e, 0xd0, 0, 0, 0, 0, 0,
+		byte(TYPE_RDP_NEG_RSP), 0, 0x08, 0x00,
+		byte(selected), byte(selected >> 8), byte(selected >> 16), byte(selected >> 24)}
+}
+
+func TestDowngradeHandler(t *testing.T) {
+	refused := errors.New("refused")
+	tests := []struct {
+		name      string
+		requested uint32
+		selected  uint32
+		called    bool
+	}{
+		{"nla to tls", PROTOCOL_SSL | PROTOCOL_HYBRID, PROTOCOL_SSL, true},
+		{"tls to rdp", PROTOCOL_SSL, PROTOCOL_RDP, true},
+		{"rdp requested", PROTOCOL_RDP, PROTOCOL_RDP, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &fakeTransport{Emitter: *emission.NewEmitter()}
+			x := New(tr)
+			x.SetRequestedProtocol(tt.requested)
+			var gotReq, gotSel uint32
+			called := false
+			x.SetDowngradeHandler(func(requested, selected uint32) error {
+				called, gotReq, gotSel = true, requested, selected
+				return refused
+			})
+			var gotErr error
+			x.On("error", func(err error) { gotErr = err })
+
+			x.recvConnectionConfirm(connectionConfirm(tt.selected))
+			if called != tt.called {
+				t.Fatalf("handler called = %v, want %v", called, tt.called)
+			}
+			if !tt.called {
+				return
+			}
+			if gotReq != tt.requested || gotSel != tt.selected {
+				t.Errorf("handler got (%d, %d), want (%d, %d)", gotReq, gotSel, tt.requested, tt.selected)
+			}
+			if !errors.Is(gotErr, refused) || !tr.closed {
+				t.Errorf("refusal not propagated: err=%v closed=%v", gotErr, tr.closed)
+			}
+		})
+	}
+}
+
+func TestConnectTranscript(t *testing.T) {
+	tr := testutil.NewTransport()
+	x := New(tr)
+	x.SetRequestedProtocol(PROTOCOL_RDP)
+	connected := testutil.Capture[uint32](&x.Emitter, "connect")
+	received := testutil.Capture[[]byte](&x.Emitter, "data")
+
+	tr.Reply("data", connectionConfirm(PROTOCOL_RDP))
+	if err := x.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	tr.Flush()
+	if got, ok := connected.Last(); !ok || got != PROTOCOL_RDP {
+		t.Fatalf("connect = %d, %v", got, ok)
+	}
+
+	tr.Emit("data", testutil.Hex("02 f0 80 aa bb"))
+	x.Write([]byte{0xcc})
+	if all := received.All(); len(all) != 1 || !bytes.Equal(all[0], []byte{0xaa, 0xbb}) {
+		t.Errorf("received % x", all)
+	}
+	testutil.AssertWrites(t, tr,
+		append(testutil.Hex("1d e0 00 00 00 00 00"), "Cookie: mstshash=test\r\n"...),
+		testutil.Hex("02 f0 80 cc"),
+	)
+}
@@ -0,0 +1,153 @@
+package grdp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by Screenshot and Run.
+const (
+	DefaultWidth  = 1280
+	DefaultHeight = 800
+
+	// screenshotSettle is how long the screen must stay unchanged before
+	// Screenshot captures it, and screenshotTimeout bounds the wait.
+	screenshotSettle  = time.Second
+	screenshotTimeout = 20 * time.Second
+)
+
+// contextDialer returns a dialer whose connections are closed when ctx
+// ends, and a function that stops watching ctx.
+func contextDialer(ctx context.Context) (func(string) (net.Conn, error), func() bool) {
+	var mu sync.Mutex
+	var conns []net.Conn
+	dial := func(hostPort string) (net.Conn, error) {
+		d := net.Dialer{Timeout: 30 * time.Second}
+		c, err := d.DialContext(ctx, "tcp", hostPort)
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		conns = append(conns, c)
+		mu.Unlock()
+		return c, nil
+	}
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	return dial, stop
+}
+
+// splitUser splits "DOMAIN\user" into its domain and user name.
+func splitUser(user string) (string, string) {
+	if domain, name, ok := strings.Cut(user, `\`); ok {
+		return domain, name
+	}
+	return "", user
+}
+
+// Screenshot logs on to host as user ("user" or "DOMAIN\user"), waits for
+// the desktop to stop changing and returns it as a DefaultWidth x
+// DefaultHeight image.  opts configure the client as for NewRdpClient.
+func Screenshot(host, user, password string, opts ...Option) (*image.RGBA, error) {
+	return ScreenshotContext(context.Background(), host, user, password, opts...)
+}
+
+// ScreenshotContext is Screenshot with a context: the screen is captured
+// once it has been painted whole and stayed unchanged for a second, or as
+// far as it was painted after 20 seconds.  The session is logged off
+// before it returns.  If ctx ends first, the connection is dropped and
+// ctx.Err() returned.
+func ScreenshotContext(ctx context.Context, host, user, password string, opts ...Option) (*image.RGBA, error) {
+	var img *image.RGBA
+	err := RunContext(ctx, host, user, password, func(g *RdpClient) error {
+		var err error
+		img, err = g.waitScreen(ctx)
+		return err
+	}, opts...)
+	return img, err
+}
+
+// ScreenshotPNG is ScreenshotContext returning the PNG encoding of the
+// screen, as asset inventories store it.
+func ScreenshotPNG(ctx context.Context, host, user, password string, opts ...Option) ([]byte, error) {
+	img, err := ScreenshotContext(ctx, host, user, password, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("screenshot: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// Run logs on to host as user ("user" or "DOMAIN\user"), calls script
+// with the ready session, for example to Play an InputMacro, and
+// disconnects when script returns.  It returns the login error or the
+// error from script.
+func Run(host, user, password string, script func(g *RdpClient) error, opts ...Option) error {
+	return RunContext(context.Background(), host, user, password, script, opts...)
+}
+
+// RunContext is Run with a context whose end drops the connection,
+// making Login or the pending requests of script fail; it then returns
+// ctx.Err().
+func RunContext(ctx context.Context, host, user, password string, script func(g *RdpClient) error, opts ...Option) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	dial, stop := contextDialer(ctx)
+	defer stop()
+	g := New(host, append([]Option{WithDialer(dial)}, append(opts, WithFramebuffer())...)...)
+	defer g.Close()
+
+	domain, name := splitUser(user)
+	err := g.LoginContext(ctx, domain, name, password)
+	if err == nil {
+		err = script(g)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// waitScreen returns the screen once it has been painted whole and
+// stayed unchanged for screenshotSettle, or what has been painted when
+// screenshotTimeout expires.
+func (g *RdpClient) waitScreen(ctx context.Context) (*image.RGBA, error) {
+	deadline := time.Now().Add(screenshotTimeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		img, last := g.fb.snapshot(g.softCursorState())
+		now := time.Now()
+		if !last.IsZero() && g.fb.complete() && now.Sub(last) >= screenshotSettle {
+			return img, nil
+		}
+		if now.After(deadline) {
+			if last.IsZero() {
+				return nil, errors.New("screenshot: no screen updates received")
+			}
+			return img, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package grdp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/testutil"
+)
+
+func TestScreenshotContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if img, err := ScreenshotContext(ctx, "127.0.0.1:1", "user", "password"); img != nil || err != context.Canceled {
+		t.Errorf("screenshot = %v, %v", img, err)
+	}
+}
+
+func TestContextDialer(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			defer c.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dial, stop := contextDialer(ctx)
+	defer stop()
+	c, err := dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || err.(net.Error).Timeout() {
+		t.Errorf("read after cancel: %v", err)
+	}
+}
+
+// TestFramebufferSession checks that a client built as Run builds it
+// paints the updates of each session into its framebuffer.
+func TestFramebufferSession(t *testing.T) {
+	g := New("host:3389", WithResolution(4, 4), WithFramebuffer())
+	// A red 2x1 rectangle, uncompressed.
+	update := testutil.Hex(`
+		01 1e 00  01 00 01 00
+		00 00 00 00 01 00 00 00 02 00 01 00 20 00 00 00 08 00
+		00 00 ff 00 00 00 ff 00`)
+	for session := range 2 {
+		connect(g)
+		activate(g, 32)
+		var painted int
+		if session == 1 {
+			g.OnBitmap(func(bs []Bitmap) { painted += len(bs) })
+		}
+		g.fb.paint([]Bitmap{solid(0, 0, 4, 4, 0, 0, 0)})
+		g.sec.RecvFastPath(0, update)
+		img := g.Snapshot()
+		if c := img.RGBAAt(1, 0); c.R != 0xff || c.G != 0 || c.B != 0 {
+			t.Errorf("session %d: pixel %v", session, c)
+		}
+		if session == 1 && painted != 1 {
+			t.Errorf("OnBitmap after Login painted %d bitmaps", painted)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+// Package record reads and writes session recordings: the PDUs a client
+// received after decryption, timestamped, so a session can be replayed
+// offline through the pdu and codec layers to regenerate its frames.
+//
+// A recording starts with a magic number and holds one record per PDU:
+//
+//	type (1 byte) | time since start in ns (8) | length (4) | payload
+//
+// The Writer also stores key frames, PNG images of the screen taken
+// while recording, and when closed appends an index of them followed by
+// the offset of the index, so players can show previews and thumbnails
+// without decoding the session.  A recording cut short by a crash has no
+// index; Keyframes then scans the records.
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"sync"
+	"time"
+)
+
+// Type is the kind of a record.
+type Type uint8
+
+const (
+	// TypeConnect starts a connection: Data holds the desktop width and
+	// height, the MCS user ID and the I/O channel ID, each 2 bytes.
+	TypeConnect Type = iota + 1
+	// TypeData is a slow-path PDU of the I/O channel.
+	TypeData
+	// TypeFastPath is a fast-path update PDU; Flag holds its security
+	// flags.
+	TypeFastPath
+	// TypeChannel is a chunk received on the static virtual channel named
+	// by Channel.
+	TypeChannel
+	// TypeKeyframe is a PNG image of the screen.
+	TypeKeyframe
+
+	typeIndex
+)
+
+var (
+	magic       = []byte("GRDPREC1")
+	footerMagic = []byte("GRDPIDX1")
+)
+
+const (
+	headerSize = 13
+	footerSize = 16
+	// maxRecordSize bounds the payload read from a corrupt recording.
+	maxRecordSize = 64 << 20
+)
+
+// ErrFormat is returned for data that is not a session recording.
+var ErrFormat = errors.New("record: not a session recording")
+
+// Record is one entry of a recording.
+type Record struct {
+	Type    Type
+	Time    time.Duration // since the recording started
+	Flag    byte          // fast-path security flags
+	Channel string        // static virtual channel name
+	Data    []byte
+}
+
+// Connect decodes the payload of a TypeConnect record.
+func (r *Record) Connect() (width, height, userId, channelId uint16) {
+	if len(r.Data) < 8 {
+		return
+	}
+	le := binary.LittleEndian
+	return le.Uint16(r.Data), le.Uint16(r.Data[2:]), le.Uint16(r.Data[4:]), le.Uint16(r.Data[6:])
+}
+
+// Keyframe locates a key frame in a recording.
+type Keyframe struct {
+	Time   time.Duration
+	Offset int64 // of its record from the start of the recording
+}
+
+// Writer writes a recording.  Its methods are safe to call from several
+// goroutines; the first write error is returned by every later call.
+type Writer struct {
+	mu        sync.Mutex
+	w         *bufio.Writer
+	start     time.Time
+	off       int64
+	keyframes []Keyframe
+	err       error
+	closed    bool
+}
+
+// NewWriter starts a recording on w.  The timestamps of the records count
+// from this call.
+func NewWriter(w io.Writer) (*Writer, error) {
+	rw := &Writer{w: bufio.NewWriter(w), start: time.Now()}
+	if _, err := rw.w.Write(magic); err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	rw.off = int64(len(magic))
+	return rw, nil
+}
+
+// Connect records the start of a connection with the desktop size of the
+// client and the IDs the MCS layer was given.
+func (w *Writer) Connect(width, height, userId, channelId uint16) error {
+	b := make([]byte, 8)
+	le := binary.LittleEndian
+	le.PutUint16(b, width)
+	le.PutUint16(b[2:], height)
+	le.PutUint16(b[4:], userId)
+	le.PutUint16(b[6:], channelId)
+	return w.write(TypeConnect, b)
+}
+
+// Data records a slow-path PDU.
+func (w *Writer) Data(data []byte) error {
+	return w.write(TypeData, data)
+}
+
+// FastPath records a fast-path update PDU.
+func (w *Writer) FastPath(secFlag byte, data []byte) error {
+	return w.write(TypeFastPath, []byte{secFlag}, data)
+}
+
+// Channel records a chunk of a static virtual channel.
+func (w *Writer) Channel(name string, data []byte) error {
+	if len(name) > 255 {
+		return fmt.Errorf("record: channel name %q too long", name)
+	}
+	return w.write(TypeChannel, []byte{byte(len(name))}, []byte(name), data)
+}
+
+// Keyframe records img as a key frame.
+func (w *Writer) Keyframe(img image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return fmt.Errorf("record: keyframe: %w", err)
+	}
+	return w.write(TypeKeyframe, buf.Bytes())
+}
+
+// Close writes the key frame index and flushes the recording.  It does
+// not close the underlying writer.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return w.err
+	}
+	index := binary.LittleEndian.AppendUint32(nil, uint32(len(w.keyframes)))
+	for _, k := range w.keyframes {
+		index = binary.LittleEndian.AppendUint64(index, uint64(k.Time))
+		index = binary.LittleEndian.AppendUint64(index, uint64(k.Offset))
+	}
+	off := w.off
+	if err := w.writeLocked(typeIndex, index); err != nil {
+		w.closed = true
+		return err
+	}
+	w.closed = true
+	footer := binary.LittleEndian.AppendUint64(nil, uint64(off))
+	footer = append(footer, footerMagic...)
+	if _, err := w.w.Write(footer); err != nil {
+		w.err = fmt.Errorf("record: %w", err)
+		return w.err
+	}
+	if err := w.w.Flush(); err != nil {
+		w.err = fmt.Errorf("record: %w", err)
+	}
+	return w.err
+}
+
+// write appends a record whose payload is the concatenation of parts.
+func (w *Writer) write(t Type, parts ...[]byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	if w.closed {
+		return errors.New("record: write after Close")
+	}
+	return w.writeLocked(t, parts...)
+}
+
+func (w *Writer) writeLocked(t Type, parts ...[]byte) error {
+	n := 0
+	for _, p := range parts {
+		n += len(p)
+	}
+	d := time.Since(w.start)
+	if t == TypeKeyframe {
+		w.keyframes = append(w.keyframes, Keyframe{d, w.off})
+	}
+	var hdr [headerSize]byte
+	hdr[0] = byte(t)
+	binary.LittleEndian.PutUint64(hdr[1:], uint64(d))
+	binary.LittleEndian.PutUint32(hdr[9:], uint32(n))
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		w.err = fmt.Errorf("record: %w", err)
+		return w.err
+	}
+	for _, p := range parts {
+		if _, err := w.w.Write(p); err != nil {
+			w.err = fmt.Errorf("record: %w", err)
+			return w.err
+		}
+	}
+	w.off += int64(headerSize + n)
+	return nil
+}
+
+// Reader reads a recording.
+type Reader struct {
+	r   io.Reader
+	br  *bufio.Reader
+	off int64
+}
+
+// NewReader checks the magic number of the recording in r.  Keyframes and
+// ReadKeyframe need r to be an io.ReadSeeker.
+func NewReader(r io.Reader) (*Reader, error) {
+	rr := &Reader{r: r, br: bufio.NewReader(r)}
+	b := make([]byte, len(magic))
+	if _, err := io.ReadFull(rr.br, b); err != nil || !bytes.Equal(b, magic) {
+		return nil, ErrFormat
+	}
+	rr.off = int64(len(magic))
+	return rr, nil
+}
+
+// Next returns the next record other than a key frame index.  It returns
+// io.EOF at the end of the recording and io.ErrUnexpectedEOF when the
+// recording was cut in the middle of a record.
+func (r *Reader) Next() (*Record, error) {
+	t, d, data, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	if t == typeIndex {
+		// The index is followed only by the footer.
+		return nil, io.EOF
+	}
+	rec := &Record{Type: t, Time: d, Data: data}
+	switch t {
+	case TypeFastPath:
+		if len(data) < 1 {
+			return nil, fmt.Errorf("record: short fast-path record at %d", r.off)
+		}
+		rec.Flag, rec.Data = data[0], data[1:]
+	case TypeChannel:
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return nil, fmt.Errorf("record: short channel record at %d", r.off)
+		}
+		n := int(data[0])
+		rec.Channel, rec.Data = string(data[1:1+n]), data[1+n:]
+	}
+	return rec, nil
+}
+
+// read reads the next raw record.
+func (r *Reader) read() (Type, time.Duration, []byte, error) {
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(r.br, hdr[:]); err != nil {
+		if err == io.EOF {
+			return 0, 0, nil, io.EOF
+		}
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	n := binary.LittleEndian.Uint32(hdr[9:])
+	if n > maxRecordSize {
+		return 0, 0, nil, fmt.Errorf("record: record of %d bytes at %d", n, r.off)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r.br, data); err != nil {
+		return 0, 0, nil, io.ErrUnexpectedEOF
+	}
+	r.off += int64(headerSize) + int64(n)
+	return Type(hdr[0]), time.Duration(binary.LittleEndian.Uint64(hdr[1:])), data, nil
+}
+
+// Keyframes returns the key frames of the recording, from its index or,
+// without one, by scanning it.  It does not move the position of Next.
+func (r *Reader) Keyframes() ([]Keyframe, error) {
+	rs, ok := r.r.(io.ReadSeeker)
+	if !ok {
+		return nil, errors.New("record: Keyframes needs an io.ReadSeeker")
+	}
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	defer rs.Seek(pos, io.SeekStart)
+
+	if ks, err := readIndex(rs); err == nil {
+		return ks, nil
+	}
+	if _, err := rs.Seek(int64(len(magic)), io.SeekStart); err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	scan := &Reader{r: rs, br: bufio.NewReader(rs), off: int64(len(magic))}
+	var ks []Keyframe
+	for {
+		off := scan.off
+		t, d, _, err := scan.read()
+		if err != nil {
+			// A truncated recording keeps the key frames before the cut.
+			return ks, nil
+		}
+		if t == TypeKeyframe {
+			ks = append(ks, Keyframe{d, off})
+		}
+	}
+}
+
+// readIndex reads the key frame index the footer of rs points at.
+func readIndex(rs io.ReadSeeker) ([]Keyframe, error) {
+	end, err := rs.Seek(-footerSize, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	var footer [footerSize]byte
+	if _, err := io.ReadFull(rs, footer[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(footer[8:], footerMagic) {
+		return nil, ErrFormat
+	}
+	off := int64(binary.LittleEndian.Uint64(footer[:]))
+	if off < int64(len(magic)) || off+headerSize > end {
+		return nil, ErrFormat
+	}
+	if _, err := rs.Seek(off, io.SeekStart); err != nil {
+		return nil, err
+	}
+	b := make([]byte, end-off)
+	if _, err := io.ReadFull(rs, b); err != nil {
+		return nil, err
+	}
+	if Type(b[0]) != typeIndex || len(b) < headerSize+4 {
+		return nil, ErrFormat
+	}
+	b = b[headerSize:]
+	n := int(binary.LittleEndian.Uint32(b))
+	b = b[4:]
+	if n > len(b)/16 {
+		return nil, ErrFormat
+	}
+	ks := make([]Keyframe, n)
+	for i := range ks {
+		ks[i].Time = time.Duration(binary.LittleEndian.Uint64(b[16*i:]))
+		ks[i].Offset = int64(binary.LittleEndian.Uint64(b[16*i+8:]))
+	}
+	return ks, nil
+}
+
+// ReadKeyframe decodes the image of key frame k.  It does not move the
+// position of Next.
+func (r *Reader) ReadKeyframe(k Keyframe) (image.Image, error) {
+	rs, ok := r.r.(io.ReadSeeker)
+	if !ok {
+		return nil, errors.New("record: ReadKeyframe needs an io.ReadSeeker")
+	}
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	defer rs.Seek(pos, io.SeekStart)
+	if _, err := rs.Seek(k.Offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+	kr := &Reader{r: rs, br: bufio.NewReader(rs), off: k.Offset}
+	t, _, data, err := kr.read()
+	if err != nil {
+		return nil, err
+	}
+	if t != TypeKeyframe {
+		return nil, fmt.Errorf("record: no key frame at %d", k.Offset)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("record: keyframe: %w", err)
+	}
+	return img, nil
+}
@@ -0,0 +1,85 @@
+package record
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Connect(1024, 768, 1007, 1003)
+	w.Data([]byte{1, 2})
+	w.Keyframe(image.NewRGBA(image.Rect(0, 0, 4, 2)))
+	w.FastPath(0x80, []byte{3})
+	w.Channel("cliprdr", []byte{4, 5})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Data(nil); err == nil {
+		t.Error("write after Close")
+	}
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks, err := r.Keyframes()
+	if err != nil || len(ks) != 1 {
+		t.Fatalf("keyframes %v, %v", ks, err)
+	}
+	var types []Type
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, rec.Type)
+		switch rec.Type {
+		case TypeConnect:
+			if w, h, u, c := rec.Connect(); w != 1024 || h != 768 || u != 1007 || c != 1003 {
+				t.Errorf("connect %d %d %d %d", w, h, u, c)
+			}
+		case TypeFastPath:
+			if rec.Flag != 0x80 || !bytes.Equal(rec.Data, []byte{3}) {
+				t.Errorf("fast path %x % x", rec.Flag, rec.Data)
+			}
+		case TypeChannel:
+			if rec.Channel != "cliprdr" || !bytes.Equal(rec.Data, []byte{4, 5}) {
+				t.Errorf("channel %q % x", rec.Channel, rec.Data)
+			}
+		}
+	}
+	if !slices.Equal(types, []Type{TypeConnect, TypeData, TypeKeyframe, TypeFastPath, TypeChannel}) {
+		t.Errorf("types %v", types)
+	}
+	img, err := r.ReadKeyframe(ks[0])
+	if err != nil || img.Bounds() != image.Rect(0, 0, 4, 2) {
+		t.Errorf("keyframe %v, %v", img, err)
+	}
+
+	// A recording cut short has no index; its key frames are scanned.
+	cut := buf.Bytes()[:int(ks[0].Offset)+headerSize+1]
+	r, _ = NewReader(bytes.NewReader(cut))
+	if ks2, err := r.Keyframes(); err != nil || len(ks2) != 0 {
+		t.Errorf("truncated keyframes %v, %v", ks2, err)
+	}
+	full := buf.Bytes()[:buf.Len()-footerSize]
+	r, _ = NewReader(bytes.NewReader(full))
+	if ks2, err := r.Keyframes(); err != nil || len(ks2) != 1 || ks2[0] != ks[0] {
+		t.Errorf("scanned keyframes %v, %v", ks2, err)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("RIFF...."))); err != ErrFormat {
+		t.Errorf("bad magic: %v", err)
+	}
+}
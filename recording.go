@@ -0,0 +1,269 @@
+package grdp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/emission"
+	"github.com/nakagami/grdp/pcapng"
+	"github.com/nakagami/grdp/protocol/sec"
+	"github.com/nakagami/grdp/protocol/t125"
+	"github.com/nakagami/grdp/protocol/t125/gcc"
+	"github.com/nakagami/grdp/protocol/x224"
+	"github.com/nakagami/grdp/record"
+)
+
+// defaultKeyframeInterval is the key frame interval of WithRecorder when
+// none is given.
+const defaultKeyframeInterval = 10 * time.Second
+
+// sessionRecorder writes the PDUs of the connections of a client and
+// key frames of its screen to a recording.
+type sessionRecorder struct {
+	w        *record.Writer
+	interval time.Duration
+	failed   atomic.Bool
+
+	mu   sync.Mutex // guards last
+	last time.Time
+
+	log *slog.Logger
+}
+
+// WithRecorder records the session to w in the format of package record:
+// every PDU received after decryption, timestamped, with a key frame of
+// the screen every keyframeInterval (10 seconds when 0) so players can
+// preview the recording.  Replay regenerates the session from it.  The
+// option enables WithFramebuffer for the key frames; Close completes the
+// recording.  Failing writes are logged and stop the recording, not the
+// session.
+func WithRecorder(w io.Writer, keyframeInterval time.Duration) Option {
+	return func(g *RdpClient) {
+		if keyframeInterval <= 0 {
+			keyframeInterval = defaultKeyframeInterval
+		}
+		g.recordTo = w
+		g.keyframeInterval = keyframeInterval
+		if g.fb == nil {
+			g.fb = newFramebuffer(g.width, g.height)
+		}
+	}
+}
+
+// tapSession makes the session layers just built record what they
+// receive and returns the fast-path listener to install on sec.
+func (g *RdpClient) tapSession() core.FastPathListener {
+	if g.sessionRec == nil {
+		w, err := record.NewWriter(g.recordTo)
+		if err != nil {
+			g.log.Warn("session recording", "err", err)
+			g.recordTo = nil
+			return g.pdu
+		}
+		g.sessionRec = &sessionRecorder{w: w, interval: g.keyframeInterval, log: g.log}
+	}
+	rec := g.sessionRec
+	// The listeners are registered before the pdu and channel layers
+	// register theirs, so each PDU is recorded before it is processed.
+	connected := false
+	g.sec.OnConnect(func(c sec.Connection) {
+		connected = true
+		rec.check(rec.w.Connect(c.CoreData.DesktopWidth, c.CoreData.DesktopHeight, c.UserId, c.ChannelId))
+	})
+	g.sec.OnData(func(b []byte) {
+		if connected {
+			rec.check(rec.w.Data(b))
+		}
+	})
+	g.sec.OnChannel(func(d t125.ChannelData) {
+		if connected {
+			rec.check(rec.w.Channel(d.Channel, d.Data))
+		}
+	})
+	return recordingListener{rec, g.pdu}
+}
+
+// recordingListener records fast-path updates before passing them on.
+type recordingListener struct {
+	rec  *sessionRecorder
+	next core.FastPathListener
+}
+
+func (l recordingListener) RecvFastPath(secFlag byte, s []byte) {
+	l.rec.check(l.rec.w.FastPath(secFlag, s))
+	l.next.RecvFastPath(secFlag, s)
+}
+
+// keyframe records the screen, with cursor drawn on it unless nil, when
+// the previous key frame is older than the interval and the whole screen
+// has been painted.
+func (r *sessionRecorder) keyframe(fb *framebuffer, cursor *cursorState) {
+	r.mu.Lock()
+	due := time.Since(r.last) >= r.interval
+	r.mu.Unlock()
+	if !due || !fb.complete() {
+		return
+	}
+	img, _ := fb.snapshot(cursor)
+	r.mu.Lock()
+	r.last = time.Now()
+	r.mu.Unlock()
+	r.check(r.w.Keyframe(img))
+}
+
+// check logs the first write error of the recording.
+func (r *sessionRecorder) check(err error) {
+	if err != nil && !r.failed.Swap(true) {
+		r.log.Warn("session recording", "err", err)
+	}
+}
+
+// replayTransport stands in for the X.224 layer during Replay: it
+// discards what the client sends.
+type replayTransport struct {
+	emission.Emitter
+}
+
+func (t *replayTransport) Read(b []byte) (int, error)  { return 0, io.EOF }
+func (t *replayTransport) Write(b []byte) (int, error) { return len(b), nil }
+func (t *replayTransport) Close() error                { return nil }
+
+// Replay re-drives a session recorded with WithRecorder through the pdu,
+// codec and channel layers of g, offline, so OnBitmap, OnDamage, Snapshot
+// and the other callbacks regenerate the session as they did live.  g must
+// not be connected; what it sends during the replay is discarded.  speed
+// paces the records by their timestamps: 1 replays in real time, 2 twice
+// as fast and 0 as fast as possible.  Replay returns nil at the end of
+// the recording and ctx.Err() when ctx ends first.
+func (g *RdpClient) Replay(ctx context.Context, r *record.Reader, speed float64) error {
+	start := time.Now()
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("[replay err] %w", err)
+		}
+		if err := replayWait(ctx, start, rec.Time, speed); err != nil {
+			return err
+		}
+		if rec.Type != record.TypeConnect && rec.Type != record.TypeKeyframe && g.sec == nil {
+			return fmt.Errorf("[replay err] record of type %d before connect", rec.Type)
+		}
+		switch rec.Type {
+		case record.TypeConnect:
+			width, height, userId, channelId := rec.Connect()
+			g.width, g.height = int(width), int(height)
+			g.setupSession(&replayTransport{Emitter: *emission.NewEmitter()})
+			data := gcc.NewClientCoreData(g.kbdLayout, g.keyboardType, g.keyboardSubType)
+			data.DesktopWidth, data.DesktopHeight = width, height
+			g.sec.Emit("connect", data, userId, channelId)
+		case record.TypeData:
+			g.sec.Emit("data", rec.Data)
+		case record.TypeFastPath:
+			g.pdu.RecvFastPath(rec.Flag, rec.Data)
+		case record.TypeChannel:
+			g.sec.Emit("channel", rec.Channel, rec.Data)
+		}
+	}
+}
+
+// replayWait waits until the record at offset of a replay started at
+// start is due at speed.
+func replayWait(ctx context.Context, start time.Time, offset time.Duration, speed float64) error {
+	if speed > 0 {
+		wait := time.Until(start.Add(time.Duration(float64(offset) / speed)))
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				t.Stop()
+				return ctx.Err()
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// ReplayCapture re-drives the server side of a connection captured with
+// pcapng.Writer through the whole session stack of g above X.224: the MCS
+// connection, licensing, the capability exchange and then the updates,
+// offline, as Replay does for a recording.  The client must be configured
+// as the captured one was, its static channels in particular, since the
+// server answers the Connect Initial it sent; what g sends is discarded.
+// Connections using Standard RDP Security cannot be replayed.  speed
+// paces the PDUs as for Replay.  ReplayCapture returns nil at the end of
+// the capture, the error of the layer that failed, or ctx.Err() when ctx
+// ends first.
+func (g *RdpClient) ReplayCapture(ctx context.Context, r *pcapng.Reader, speed float64) error {
+	var (
+		t      *replayTransport
+		first  time.Time
+		failed error
+		start  = time.Now()
+	)
+	for failed == nil {
+		p, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("[replay err] %w", err)
+		}
+		if first.IsZero() {
+			first = p.Time
+		}
+		if err := replayWait(ctx, start, p.Time.Sub(first), speed); err != nil {
+			return err
+		}
+		if p.Outbound {
+			continue
+		}
+		switch {
+		case p.Layer == "x224":
+			// X.224 Connection Confirm: TPKT header, length indicator,
+			// TPDU code, 5 more bytes and the RDP_NEG_RSP
+			if len(p.Data) < 6 || p.Data[5]&0xF0 != 0xD0 {
+				continue
+			}
+			if t != nil {
+				return errors.New("[replay err] second connection confirm")
+			}
+			if len(p.Data) < 19 || p.Data[11] != x224.TYPE_RDP_NEG_RSP ||
+				binary.LittleEndian.Uint32(p.Data[15:]) == x224.PROTOCOL_RDP {
+				return errors.New("[replay err] connection using Standard RDP Security")
+			}
+			t = &replayTransport{Emitter: *emission.NewEmitter()}
+			g.setupSession(t)
+			g.sec.SetFastPathListener(g.pdu)
+			g.pdu.On("error", func(err error) {
+				if failed == nil {
+					failed = err
+				}
+			})
+			t.Emit("connect", binary.LittleEndian.Uint32(p.Data[15:]))
+		case t == nil:
+			return fmt.Errorf("[replay err] %s PDU before the connection confirm", p.Layer)
+		case p.Layer == "mcs":
+			// X.224 Data TPDU header: length indicator, code and EOT
+			t.Emit("data", p.Data[7:])
+		default:
+			n := 2
+			if p.Data[1]&0x80 != 0 {
+				n = 3
+			}
+			g.sec.RecvFastPath(p.Data[0]>>6, p.Data[n:])
+		}
+	}
+	return fmt.Errorf("[replay err] %w", failed)
+}
@@ -0,0 +1,135 @@
+package grdp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/emission"
+	"github.com/nakagami/grdp/pcapng"
+	"github.com/nakagami/grdp/protocol/t125/gcc"
+	"github.com/nakagami/grdp/record"
+	"github.com/nakagami/grdp/testutil"
+)
+
+func TestRecordReplay(t *testing.T) {
+	// a fast-path update painting a red 2x1 uncompressed bitmap
+	update := testutil.Hex(`
+		01 1e 00  01 00 01 00
+		00 00 00 00 01 00 00 00 02 00 01 00 20 00 00 00 08 00
+		00 00 ff 00 00 00 ff 00`)
+
+	var buf bytes.Buffer
+	g := NewRdpClient("host:3389", 2, 1, nil, WithRecorder(&buf, time.Nanosecond))
+	g.setupSession(&replayTransport{Emitter: *emission.NewEmitter()})
+	core := gcc.NewClientCoreData(0x409, 4, 0)
+	core.DesktopWidth, core.DesktopHeight = 2, 1
+	g.sec.Emit("connect", core, uint16(1007), uint16(1003))
+	g.sec.RecvFastPath(0, update)
+	if err := g.sessionRec.w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := record.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ks, err := r.Keyframes(); err != nil || len(ks) != 1 {
+		t.Errorf("keyframes %v, %v", ks, err)
+	}
+
+	var painted int
+	h := NewRdpClient("host:3389", 640, 480, nil, WithFramebuffer()).
+		OnBitmap(func(bs []Bitmap) { painted += len(bs) })
+	if err := h.Replay(context.Background(), r, 0); err != nil {
+		t.Fatal(err)
+	}
+	img := h.Snapshot()
+	if painted != 1 || img.Rect.Dx() != 2 || img.RGBAAt(1, 0).R != 0xFF {
+		t.Errorf("replayed %d bitmaps, %v %v", painted, img.Rect, img.RGBAAt(1, 0))
+	}
+}
+
+// captureServer writes a capture of a connection to a 2x1 desktop: the
+// server answers the connection sequence of a client without static
+// channels over TLS, then paints the fast-path update of TestRecordReplay.
+func captureServer(t *testing.T) []byte {
+	mcs := func(s string) []byte { // in an X.224 Data TPDU
+		b := testutil.Hex(s)
+		return append([]byte{3, 0, byte((len(b) + 7) >> 8), byte(len(b) + 7), 0x02, 0xF0, 0x80}, b...)
+	}
+	// a Send Data Indication on the I/O channel
+	data := func(s string) []byte {
+		b := testutil.Hex(s)
+		return mcs("68 00 06 03 eb 70 " + fmt.Sprintf("%02x", len(b)) + s)
+	}
+	frames := [][]byte{
+		// X.224 Connection Confirm selecting TLS
+		testutil.Hex("03 00 00 13 0e d0 00 00 12 34 00 02 00 08 00 01 00 00 00"),
+		// MCS Connect Response
+		mcs(`7f 66 5a  0a 01 00  02 01 00
+			30 1a  02 01 22 02 01 03 02 01 00 02 01 01 02 01 00 02 01 01 02 03 00 ff f8 02 01 02
+			04 36  00 05 00 14 7c 00 01 2e 14 76 0a 01 01 00 01 c0 00 4d 63 44 6e 20
+				01 0c 0c 00 04 00 08 00 01 00 00 00 // SC_CORE
+				02 0c 0c 00 00 00 00 00 00 00 00 00 // SC_SECURITY: none
+				03 0c 08 00 eb 03 00 00             // SC_NET: I/O channel 1003`),
+		mcs("2e 00 00 06"),             // Attach User Confirm: user 1007
+		mcs("3e 00 00 06 03 ef 03 ef"), // Channel Join Confirms
+		mcs("3e 00 00 06 03 eb 03 eb"),
+		// License Error PDU: STATUS_VALID_CLIENT
+		data("80 00 00 00  ff 03 10 00 07 00 00 00 02 00 00 00 04 00 00 00"),
+		// Demand Active, Synchronize, Control and Font Map PDUs
+		data(`36 00 11 00 ea 03 ea 03 01 00 04 00 00 00 52 44 50 00 01 00 00 00
+			02 00 1c 00 10 00 00 00 00 00 00 00 02 00 01 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00`),
+		data("16 00 17 00 ea 03 ea 03 01 00 00 01 08 00 1f 00 00 00 01 00 ef 03"),
+		data("1a 00 17 00 ea 03 ea 03 01 00 00 01 0c 00 14 00 00 00 04 00 00 00 00 00 00 00"),
+		data("1a 00 17 00 ea 03 ea 03 01 00 00 01 0c 00 14 00 00 00 02 00 00 00 00 00 00 00"),
+		data("1a 00 17 00 ea 03 ea 03 01 00 00 01 0c 00 28 00 00 00 00 00 00 00 03 00 04 00"),
+		// fast-path bitmap update
+		testutil.Hex(`00 23  01 1e 00  01 00 01 00
+			00 00 00 00 01 00 00 00 02 00 01 00 20 00 00 00 08 00
+			00 00 ff 00 00 00 ff 00`),
+	}
+	var buf bytes.Buffer
+	w, err := pcapng.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Unix(1700000000, 0)
+	for i, f := range frames {
+		w.Capture(core.TapPDU{Time: at.Add(time.Duration(i) * time.Millisecond), Data: f})
+	}
+	return buf.Bytes()
+}
+
+func TestReplayCapture(t *testing.T) {
+	r, err := pcapng.NewReader(bytes.NewReader(captureServer(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log bytes.Buffer
+	g := NewRdpClient("host:3389", 640, 480, nil, WithFramebuffer()).
+		OnReady(func() { fmt.Fprintln(&log, "ready") }).
+		OnResize(func(w, h int) { fmt.Fprintf(&log, "resize %dx%d\n", w, h) }).
+		OnBitmap(func(bs []Bitmap) {
+			for _, b := range bs {
+				fmt.Fprintf(&log, "bitmap (%d,%d)-(%d,%d) %dx%d depth %d % x\n", b.DestLeft, b.DestTop,
+					b.DestRight, b.DestBottom, b.Width, b.Height, b.BitsPerPixel, b.Data)
+			}
+		})
+	if err := g.ReplayCapture(context.Background(), r, 0); err != nil {
+		t.Fatal(err)
+	}
+	img := g.Snapshot()
+	fmt.Fprintf(&log, "snapshot %v % x\n", img.Rect, img.Pix)
+	pdus := g.Stats().PDUs
+	for _, k := range slices.Sorted(maps.Keys(pdus)) {
+		fmt.Fprintf(&log, "pdus %s %d\n", k, pdus[k])
+	}
+	testutil.Golden(t, "replay_capture.golden", log.Bytes())
+}
@@ -0,0 +1,82 @@
+package grdp
+
+import (
+	"github.com/nakagami/grdp/plugin/rail"
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+// remoteApp is the application a RemoteApp session starts.
+type remoteApp struct {
+	program, workingDir, arguments string
+}
+
+// SetRemoteApp makes the session a RemoteApp session that runs program,
+// such as "notepad" or a "||alias" published on the server, instead of a
+// full desktop.  The server then draws only the windows of the
+// application, which OnWindow reports so that they can be shown as
+// local windows.
+// Must be called before Login.
+func (g *RdpClient) SetRemoteApp(program, workingDir, arguments string) *RdpClient {
+	g.remoteApp = &remoteApp{program: program, workingDir: workingDir, arguments: arguments}
+	return g
+}
+
+// OnWindow registers a callback for the events of a RemoteApp session:
+// the windows, notification icons and desktop state of the server, the
+// result of starting the application, and the local moves and resizes
+// the server asks for.  See rail.Event.
+func (g *RdpClient) OnWindow(f func(rail.Event)) *RdpClient {
+	g.onWindowFn = f
+	return g
+}
+
+// RemoteApp returns the RAIL channel of the current RemoteApp session,
+// which sends the activations, moves and system commands of the local
+// windows to the server, or nil for a desktop session.
+func (g *RdpClient) RemoteApp() *rail.RailClient {
+	return g.railClient
+}
+
+// setupRail requests the RAIL channel and the capabilities of a
+// RemoteApp session and feeds the window orders to it.
+func (g *RdpClient) setupRail() {
+	c := rail.NewClient()
+	c.SetLogger(g.logger)
+	c.DesktopWidth, c.DesktopHeight = uint16(g.width), uint16(g.height)
+	c.RemoteApplicationProgram = g.remoteApp.program
+	c.ShellWorkingDirectory = g.remoteApp.workingDir
+	c.RemoteApplicationCmdLine = g.remoteApp.arguments
+	c.KeyboardLayout = g.kbdLayout
+	c.OnEvent(func(e rail.Event) {
+		if g.onWindowFn != nil {
+			g.onWindowFn(e)
+		}
+	})
+	g.railClient = c
+	g.channels.Register(c)
+	g.mcs.SetClientRemoteProgram()
+	g.sec.SetRail()
+
+	g.pdu.SetClientCapability(&pdu.RemoteProgramsCapability{
+		RailSupportLevel: rail.TS_RAIL_LEVEL_SUPPORTED | rail.TS_RAIL_LEVEL_HANDSHAKE_EX_SUPPORTED |
+			rail.TS_RAIL_LEVEL_DOCKED_LANGBAR_SUPPORTED | rail.TS_RAIL_LEVEL_LANGUAGE_IME_SYNC_SUPPORTED |
+			rail.TS_RAIL_LEVEL_SERVER_TO_CLIENT_IME_SYNC_SUPPORTED,
+	})
+	g.pdu.SetClientCapability(&pdu.WindowListCapability{
+		WndSupportLevel:     rail.TS_WINDOW_LEVEL_SUPPORTED,
+		NumIconCaches:       rail.NumIconCaches,
+		NumIconCacheEntries: rail.NumIconCacheEntries,
+	})
+	g.pdu.On("ready", func() {
+		if rc, ok := g.pdu.ServerCapability(pdu.CAPSTYPE_RAIL).(*pdu.RemoteProgramsCapability); ok {
+			c.SetServerSupportLevel(rc.RailSupportLevel)
+		}
+	})
+	g.pdu.On("orders", func(orders []pdu.OrderPdu) {
+		for _, o := range orders {
+			if o.Altsec != nil {
+				c.ProcessOrder(o.Altsec.Order)
+			}
+		}
+	})
+}
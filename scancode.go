@@ -0,0 +1,84 @@
+package grdp
+
+import "github.com/nakagami/grdp/protocol/pdu"
+
+// Scancode is a set 1 keyboard scancode.  Keys whose make code is
+// prefixed with 0xE0 are written 0xE0xx, for example 0xE048 for the up
+// arrow, and are sent with KBDFLAGS_EXTENDED; the 0xE1 prefixed Pause key
+// is ScancodePause.
+type Scancode uint16
+
+// Scancodes of the keys that need the extended flags, and of the keys
+// that share their make code without it.
+const (
+	ScancodeLeftCtrl    Scancode = 0x1D
+	ScancodeLeftShift   Scancode = 0x2A
+	ScancodeRightShift  Scancode = 0x36
+	ScancodeLeftAlt     Scancode = 0x38
+	ScancodeNumLock     Scancode = 0x45
+	ScancodeNumpadEnter Scancode = 0xE01C
+	ScancodeRightCtrl   Scancode = 0xE01D
+	ScancodeNumpadDiv   Scancode = 0xE035
+	ScancodePrintScreen Scancode = 0xE037
+	ScancodeRightAlt    Scancode = 0xE038
+	ScancodeHome        Scancode = 0xE047
+	ScancodeUp          Scancode = 0xE048
+	ScancodePageUp      Scancode = 0xE049
+	ScancodeLeft        Scancode = 0xE04B
+	ScancodeRight       Scancode = 0xE04D
+	ScancodeEnd         Scancode = 0xE04F
+	ScancodeDown        Scancode = 0xE050
+	ScancodePageDown    Scancode = 0xE051
+	ScancodeInsert      Scancode = 0xE052
+	ScancodeDelete      Scancode = 0xE053
+	ScancodeLeftWin     Scancode = 0xE05B
+	ScancodeRightWin    Scancode = 0xE05C
+	ScancodeApps        Scancode = 0xE05D
+	// ScancodePause is E1 1D 45: Ctrl with KBDFLAGS_EXTENDED1, then Num
+	// Lock.  The key has no break code, so KeyDown sends the press and
+	// release and KeyUp sends nothing.
+	ScancodePause Scancode = 0xE11D
+)
+
+// Code returns the make code without the prefix.
+func (sc Scancode) Code() uint8 {
+	return uint8(sc)
+}
+
+// Extended reports whether the key is 0xE0 prefixed.
+func (sc Scancode) Extended() bool {
+	return sc&0xFF00 == 0xE000
+}
+
+// Extended1 reports whether the key is 0xE1 prefixed.
+func (sc Scancode) Extended1() bool {
+	return sc&0xFF00 == 0xE100
+}
+
+// keyEvents returns the keyboard events of pressing (or releasing) sc,
+// with the prefix moved into KBDFLAGS_EXTENDED or KBDFLAGS_EXTENDED1
+// (MS-RDPBCGR 2.2.8.1.1.3.1.1.1).
+func (sc Scancode) keyEvents(release bool) []pdu.InputEventsInterface {
+	if sc == ScancodePause {
+		if release {
+			return nil
+		}
+		return []pdu.InputEventsInterface{
+			&pdu.ScancodeKeyEvent{KeyboardFlags: pdu.KBDFLAGS_EXTENDED1, KeyCode: uint16(ScancodeLeftCtrl)},
+			&pdu.ScancodeKeyEvent{KeyCode: uint16(ScancodeNumLock)},
+			&pdu.ScancodeKeyEvent{KeyboardFlags: pdu.KBDFLAGS_EXTENDED1 | pdu.KBDFLAGS_RELEASE, KeyCode: uint16(ScancodeLeftCtrl)},
+			&pdu.ScancodeKeyEvent{KeyboardFlags: pdu.KBDFLAGS_RELEASE, KeyCode: uint16(ScancodeNumLock)},
+		}
+	}
+	p := &pdu.ScancodeKeyEvent{KeyCode: uint16(sc.Code())}
+	switch {
+	case sc.Extended():
+		p.KeyboardFlags |= pdu.KBDFLAGS_EXTENDED
+	case sc.Extended1():
+		p.KeyboardFlags |= pdu.KBDFLAGS_EXTENDED1
+	}
+	if release {
+		p.KeyboardFlags |= pdu.KBDFLAGS_RELEASE
+	}
+	return []pdu.InputEventsInterface{p}
+}
@@ -0,0 +1,32 @@
+package grdp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+func TestScancodeKeyEvents(t *testing.T) {
+	for _, tt := range []struct {
+		sc      Scancode
+		release bool
+		want    []pdu.InputEventsInterface
+	}{
+		{0x1E, false, []pdu.InputEventsInterface{&pdu.ScancodeKeyEvent{KeyCode: 0x1E}}},
+		{ScancodeUp, true, []pdu.InputEventsInterface{
+			&pdu.ScancodeKeyEvent{KeyboardFlags: pdu.KBDFLAGS_EXTENDED | pdu.KBDFLAGS_RELEASE, KeyCode: 0x48},
+		}},
+		{ScancodePause, false, []pdu.InputEventsInterface{
+			&pdu.ScancodeKeyEvent{KeyboardFlags: pdu.KBDFLAGS_EXTENDED1, KeyCode: 0x1D},
+			&pdu.ScancodeKeyEvent{KeyCode: 0x45},
+			&pdu.ScancodeKeyEvent{KeyboardFlags: pdu.KBDFLAGS_EXTENDED1 | pdu.KBDFLAGS_RELEASE, KeyCode: 0x1D},
+			&pdu.ScancodeKeyEvent{KeyboardFlags: pdu.KBDFLAGS_RELEASE, KeyCode: 0x45},
+		}},
+		{ScancodePause, true, nil},
+	} {
+		if got := tt.sc.keyEvents(tt.release); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%#x release=%v: got %+v", uint16(tt.sc), tt.release, got)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package grdp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/nakagami/grdp/protocol/sec"
+)
+
+// State is the phase of the connection sequence a client is in.
+type State int
+
+const (
+	// StateConnecting dials the server.
+	StateConnecting State = iota
+	// StateNegotiating exchanges the X.224 Connection Request and Confirm
+	// that select the security protocol.
+	StateNegotiating
+	// StateSecurityExchange runs the TLS or CredSSP handshake, the MCS
+	// connection and the Standard RDP Security key exchange, and sends
+	// the Client Info PDU.
+	StateSecurityExchange
+	// StateLicensing waits for the server to license the client.
+	StateLicensing
+	// StateCapabilityExchange exchanges the Demand Active and Confirm
+	// Active PDUs and finalizes the connection, again on reactivation.
+	StateCapabilityExchange
+	// StateActive is the session accepting input and sending updates.
+	StateActive
+	// StateClosing ends the session after Close.
+	StateClosing
+	// StateClosed has no connection, before Login or after it ended.
+	StateClosed
+)
+
+var stateNames = [...]string{"Connecting", "Negotiating", "SecurityExchange", "Licensing",
+	"CapabilityExchange", "Active", "Closing", "Closed"}
+
+func (s State) String() string {
+	if s >= 0 && int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// ErrClosed is the error of WaitReady for a connection ended by Close.
+var ErrClosed = errors.New("grdp: client closed")
+
+// ErrConnectionTimeout is the error of a connection sequence that did not
+// complete within the connect timeout of WithTimeouts.
+var ErrConnectionTimeout = errors.New("grdp: connection timeout")
+
+// LoginError reports the failure of Login: the state the connection
+// sequence was in and the error of the layer that failed, such as an
+// *x224.NegotiationFailureError, nla.ErrBadCredentials, a
+// *core.ProtocolError, ErrConnectionTimeout or ErrClosed, which errors.Is
+// and errors.As find through it.
+type LoginError struct {
+	State State
+	Err   error
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("[login err] %v: %v", e.State, e.Err)
+}
+
+func (e *LoginError) Unwrap() error {
+	return e.Err
+}
+
+// errConnectionLost is the error of WaitReady for a connection the
+// server or the network ended.
+var errConnectionLost = errors.New("grdp: connection lost")
+
+// stateMachine tracks the State of a client.  Each connection attempt
+// begins a generation; the events of the layers of an older attempt, such
+// as the close of a transport replaced by a reconnect, are ignored.
+type stateMachine struct {
+	mu       sync.Mutex
+	state    State
+	err      error // why the last connection closed
+	gen      uint64
+	changed  chan struct{} // closed and replaced by every transition
+	onChange func(old, new State)
+}
+
+func newStateMachine() *stateMachine {
+	return &stateMachine{state: StateClosed, changed: make(chan struct{})}
+}
+
+// begin starts a connection attempt in StateConnecting and returns its
+// generation.
+func (m *stateMachine) begin() uint64 {
+	m.mu.Lock()
+	m.gen++
+	gen := m.gen
+	m.mu.Unlock()
+	m.set(gen, StateConnecting, nil)
+	return gen
+}
+
+// fail closes attempt gen with err and returns the LoginError reporting
+// the state it failed in.
+func (m *stateMachine) fail(gen uint64, err error) error {
+	m.mu.Lock()
+	s := m.state
+	m.mu.Unlock()
+	m.set(gen, StateClosed, err)
+	return &LoginError{State: s, Err: err}
+}
+
+// current returns the generation of the last connection attempt.
+func (m *stateMachine) current() uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.gen
+}
+
+// set moves attempt gen to s; err is the cause of a StateClosed.  A
+// closed attempt stays closed, and a connection closing after Close
+// reports ErrClosed.  Closing a client that never connected records the
+// cause for WaitReady without a transition.
+func (m *stateMachine) set(gen uint64, s State, err error) {
+	m.mu.Lock()
+	old := m.state
+	switch {
+	case gen != m.gen:
+		m.mu.Unlock()
+		return
+	case old == StateClosed && s == StateClosed:
+		if m.err == nil {
+			m.err = ErrClosed
+			m.wake()
+		}
+		m.mu.Unlock()
+		return
+	case old == s || (old == StateClosed && s != StateConnecting):
+		m.mu.Unlock()
+		return
+	}
+	if s == StateClosed {
+		if old == StateClosing || err == nil {
+			err = ErrClosed
+		}
+		m.err = err
+	}
+	m.state = s
+	m.wake()
+	f := m.onChange
+	m.mu.Unlock()
+	if f != nil {
+		f(old, s)
+	}
+}
+
+// wake wakes the waiters of WaitReady; m.mu must be held.
+func (m *stateMachine) wake() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *stateMachine) get() (State, <-chan struct{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, m.changed, m.err
+}
+
+// trackState moves connection attempt gen through the states as its
+// layers report their progress.
+func (g *RdpClient) trackState(gen uint64) {
+	g.x224.OnNegotiated(func(uint32) { g.state.set(gen, StateSecurityExchange, nil) })
+	g.sec.OnLicensing(func() { g.state.set(gen, StateLicensing, nil) })
+	g.sec.OnConnect(func(sec.Connection) { g.state.set(gen, StateCapabilityExchange, nil) })
+	g.pdu.On("deactivateAll", func() { g.state.set(gen, StateCapabilityExchange, nil) })
+	g.pdu.On("close", func() { g.state.set(gen, StateClosed, errConnectionLost) })
+}
+
+// State returns the phase of the connection sequence the client is in.
+func (g *RdpClient) State() State {
+	s, _, _ := g.state.get()
+	return s
+}
+
+// OnStateChange registers a callback for the transitions of State.  It
+// is called on the goroutine making the transition: the one that called
+// Login or Close, or the connection's reader goroutine.
+func (g *RdpClient) OnStateChange(f func(old, new State)) *RdpClient {
+	g.state.mu.Lock()
+	g.state.onChange = f
+	g.state.mu.Unlock()
+	return g
+}
+
+// WaitReady blocks until the session is active and returns nil, or
+// returns why the last connection closed: ErrClosed after Close, the
+// error of the layer that failed, or an error reporting the connection
+// lost.  Before the first Login it waits, so it can be called from
+// another goroutine than Login's.  It returns ctx.Err() if ctx ends
+// first.
+func (g *RdpClient) WaitReady(ctx context.Context) error {
+	for {
+		s, changed, err := g.state.get()
+		switch {
+		case s == StateActive:
+			return nil
+		case s == StateClosed && err != nil:
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package grdp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStateTransitions(t *testing.T) {
+	g := NewRdpClient("host:3389", 640, 480, nil)
+	var seen []State
+	g.OnStateChange(func(old, new State) { seen = append(seen, new) })
+
+	ready := make(chan error, 1)
+	go func() { ready <- g.WaitReady(context.Background()) }()
+
+	gen := g.state.begin()
+	for _, s := range []State{StateNegotiating, StateSecurityExchange, StateLicensing,
+		StateCapabilityExchange, StateActive} {
+		g.state.set(gen, s, nil)
+	}
+	if err := <-ready; err != nil {
+		t.Fatal("WaitReady:", err)
+	}
+
+	// a reconnect ignores what the layers of the previous attempt report
+	next := g.state.begin()
+	g.state.set(gen, StateClosed, errors.New("stale"))
+	if s := g.State(); s != StateConnecting {
+		t.Fatalf("state %v after a stale close", s)
+	}
+	lost := errors.New("lost")
+	g.state.set(next, StateClosed, lost)
+	g.state.set(next, StateActive, nil)
+	if err := g.WaitReady(context.Background()); err != lost {
+		t.Errorf("WaitReady after the connection closed: %v", err)
+	}
+
+	want := []State{StateConnecting, StateNegotiating, StateSecurityExchange, StateLicensing,
+		StateCapabilityExchange, StateActive, StateConnecting, StateClosed}
+	if !slices.Equal(seen, want) {
+		t.Errorf("transitions %v", seen)
+	}
+}
+
+func TestWaitReadyClose(t *testing.T) {
+	g := NewRdpClient("host:3389", 640, 480, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := g.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitReady before Login: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- g.WaitReady(context.Background()) }()
+	g.Close()
+	if err := <-done; err != ErrClosed {
+		t.Errorf("WaitReady after Close: %v", err)
+	}
+	if s := g.State(); s != StateClosed {
+		t.Errorf("state %v after Close", s)
+	}
+}
+
+func TestLoginError(t *testing.T) {
+	refused := errors.New("refused")
+	g := New("host:3389", WithDialer(func(string) (net.Conn, error) { return nil, refused }))
+	err := g.Login("", "user", "password")
+	var le *LoginError
+	if !errors.As(err, &le) || le.State != StateConnecting || !errors.Is(err, refused) {
+		t.Fatalf("Login: %v", err)
+	}
+	if err := g.WaitReady(context.Background()); err != refused {
+		t.Errorf("WaitReady after a failed Login: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := g.LoginContext(ctx, "", "user", "password"); !errors.Is(err, context.Canceled) {
+		t.Errorf("LoginContext with an ended context: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package grdp
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nakagami/grdp/protocol/pdu"
+)
+
+// Stats is a snapshot of the session statistics.  The counters start
+// from zero with each connection, including those of a reconnection or a
+// redirection.
+type Stats struct {
+	// BytesReceived and BytesSent are the bytes of the connection on the
+	// wire, TLS records included.
+	BytesReceived uint64
+	BytesSent     uint64
+
+	// PDUs is the number of PDUs received per type: the PDUTYPE2_* of
+	// the slow-path data PDUs, the PDUTYPE_* of the other slow-path PDUs
+	// and the FASTPATH_UPDATETYPE_* of the fast-path updates.
+	PDUs map[string]uint64
+
+	// Frames is the number of screen updates received: bitmap updates,
+	// batches of drawing orders and graphics pipeline frames.  FPS is
+	// their rate, measured between calls to Stats at least a second
+	// apart; it is 0 during the first second.
+	Frames uint64
+	FPS    float64
+
+	// DecodeTime is the time spent decompressing bitmaps and decoding the
+	// surface commands of the graphics pipeline.
+	DecodeTime time.Duration
+
+	// CompressedBytes and DecompressedBytes are the sizes of the bulk
+	// compressed PDUs before and after decompression.
+	CompressedBytes   uint64
+	DecompressedBytes uint64
+	// Compressor is the name of the bulk compressor the server compresses
+	// the session with, such as "MPPC-64K" or "XCRUSH", or "" while it has
+	// sent no compressed PDU.
+	Compressor string
+
+	// BaseRTT and AverageRTT are the lowest and average round-trip times
+	// the server measured with network auto-detection, and Bandwidth the
+	// measured bandwidth in kilobits per second.  They are 0 until the
+	// server has run the corresponding measurement.
+	BaseRTT    time.Duration
+	AverageRTT time.Duration
+	Bandwidth  uint32
+
+	// PingRTT is the round-trip time of the last successful Ping, and
+	// EchoRequests the number of latency probes of the server answered
+	// on the ECHO channel.
+	PingRTT      time.Duration
+	EchoRequests uint32
+}
+
+// CompressionRatio returns how many times larger the bulk compressed
+// PDUs are once decompressed, 0 before the first one.
+func (s Stats) CompressionRatio() float64 {
+	if s.CompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.DecompressedBytes) / float64(s.CompressedBytes)
+}
+
+// sessionStats holds the statistics the client itself measures.
+type sessionStats struct {
+	frames     atomic.Uint64 // bitmap updates and drawing orders
+	decodeTime atomic.Int64  // of the bitmaps, in nanoseconds
+
+	mu          sync.Mutex // guards the FPS measurement
+	since       time.Time
+	sinceFrames uint64
+	fps         float64
+}
+
+// reset starts the statistics of a new connection.
+func (s *sessionStats) reset() {
+	s.frames.Store(0)
+	s.decodeTime.Store(0)
+	s.mu.Lock()
+	s.since, s.sinceFrames, s.fps = time.Now(), 0, 0
+	s.mu.Unlock()
+}
+
+// rate returns the frame rate, measured again when the last measurement
+// is a second old.
+func (s *sessionStats) rate(frames uint64, now time.Time) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d := now.Sub(s.since); d >= time.Second {
+		s.fps = float64(frames-s.sinceFrames) / d.Seconds()
+		s.since, s.sinceFrames = now, frames
+	}
+	return s.fps
+}
+
+// countFrames resets the statistics for the session layers just built
+// and counts the screen updates they receive.
+func (g *RdpClient) countFrames() {
+	g.stats.reset()
+	g.pdu.OnBitmap(func(pdu.BitmapUpdate) { g.stats.frames.Add(1) })
+	g.pdu.On("orders", func([]pdu.OrderPdu) { g.stats.frames.Add(1) })
+}
+
+// Stats returns the current session statistics.  It is safe to call from
+// any goroutine.
+func (g *RdpClient) Stats() Stats {
+	s := Stats{
+		Frames:     g.stats.frames.Load(),
+		DecodeTime: time.Duration(g.stats.decodeTime.Load()),
+	}
+	if g.tpkt != nil {
+		s.BytesReceived, s.BytesSent = g.tpkt.Conn.Counts()
+	}
+	if g.pdu != nil {
+		ps := g.pdu.Stats()
+		s.PDUs, s.CompressedBytes, s.DecompressedBytes = ps.PDUs, ps.Compressed, ps.Decompressed
+		s.Compressor = g.CompressionType()
+	}
+	if h := g.gfxHandler; h != nil {
+		s.Frames += h.Frames()
+		s.DecodeTime += h.DecodeTime()
+	}
+	s.FPS = g.stats.rate(s.Frames, time.Now())
+	if g.mcs != nil {
+		nc := g.mcs.NetworkCharacteristics()
+		s.BaseRTT, s.AverageRTT, s.Bandwidth = nc.BaseRTT, nc.AverageRTT, nc.Bandwidth
+	}
+	if h := g.echoHandler; h != nil {
+		s.PingRTT, s.EchoRequests = h.LastRTT(), h.Requests()
+	}
+	return s
+}
+
+// Metric is one measurement of Stats in the Prometheus data model, for
+// collectors exporting the statistics of sessions.
+type Metric struct {
+	// Name is the metric name, such as rdp_received_bytes_total.
+	Name string
+	Help string
+	// Counter tells a counter, which only grows during a connection, from
+	// a gauge.
+	Counter bool
+	// Labels holds the label of the metrics split by one, such as the
+	// type of rdp_received_pdus_total.
+	Labels map[string]string
+	Value  float64
+}
+
+// Metrics returns the statistics as metrics with conventional Prometheus
+// names and units: bytes, seconds and bits per second.  A collector
+// reports them on each scrape, for instance with
+//
+//	for _, m := range client.Stats().Metrics() {
+//		ch <- prometheus.MustNewConstMetric(desc[m.Name], valueType(m), m.Value, labelValues(m)...)
+//	}
+func (s Stats) Metrics() []Metric {
+	counter := func(name, help string, v float64) Metric {
+		return Metric{Name: name, Help: help, Counter: true, Value: v}
+	}
+	gauge := func(name, help string, v float64) Metric {
+		return Metric{Name: name, Help: help, Value: v}
+	}
+	ms := []Metric{
+		counter("rdp_received_bytes_total", "Bytes received on the connection.", float64(s.BytesReceived)),
+		counter("rdp_sent_bytes_total", "Bytes sent on the connection.", float64(s.BytesSent)),
+		counter("rdp_frames_total", "Screen updates received.", float64(s.Frames)),
+		gauge("rdp_frames_per_second", "Rate of the screen updates received.", s.FPS),
+		counter("rdp_decode_seconds_total", "Time spent decoding bitmaps and surface commands.", s.DecodeTime.Seconds()),
+		counter("rdp_bulk_compressed_bytes_total", "Bulk compressed PDU bytes received.", float64(s.CompressedBytes)),
+		counter("rdp_bulk_decompressed_bytes_total", "Bulk compressed PDU bytes once decompressed.", float64(s.DecompressedBytes)),
+		gauge("rdp_base_rtt_seconds", "Lowest round-trip time measured by the server.", s.BaseRTT.Seconds()),
+		gauge("rdp_average_rtt_seconds", "Average round-trip time measured by the server.", s.AverageRTT.Seconds()),
+		gauge("rdp_bandwidth_bits_per_second", "Bandwidth measured by the server.", float64(s.Bandwidth)*1000),
+		gauge("rdp_ping_rtt_seconds", "Round-trip time of the last Ping.", s.PingRTT.Seconds()),
+		counter("rdp_echo_requests_total", "Latency probes of the server answered.", float64(s.EchoRequests)),
+	}
+	types := make([]string, 0, len(s.PDUs))
+	for t := range s.PDUs {
+		types = append(types, t)
+	}
+	slices.Sort(types)
+	for _, t := range types {
+		m := counter("rdp_received_pdus_total", "PDUs received, by type.", float64(s.PDUs[t]))
+		m.Labels = map[string]string{"type": t}
+		ms = append(ms, m)
+	}
+	if s.Compressor != "" {
+		m := gauge("rdp_bulk_compressor_info", "Bulk compressor of the session.", 1)
+		m.Labels = map[string]string{"compressor": s.Compressor}
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// Ping measures the application-level round-trip time to the server over
+// the ECHO dynamic channel (MS-RDPEECO), which includes the time the
+// server takes to process the request.  The channel is meant for probes
+// of the server, so Ping only gets an answer from servers whose endpoint
+// echoes the client as well; from the others it returns ctx.Err() when
+// ctx ends.  The result is also reported as Stats().PingRTT.
+func (g *RdpClient) Ping(ctx context.Context) (time.Duration, error) {
+	h := g.echoHandler
+	if h == nil {
+		return 0, errors.New("ping: not connected")
+	}
+	return h.Ping(ctx)
+}
@@ -0,0 +1,39 @@
+package grdp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsMetrics(t *testing.T) {
+	s := Stats{
+		BytesReceived:     4096,
+		PDUs:              map[string]uint64{"PDUTYPE2_UPDATE": 3, "FASTPATH_UPDATETYPE_BITMAP": 5},
+		DecodeTime:        1500 * time.Millisecond,
+		CompressedBytes:   100,
+		DecompressedBytes: 250,
+		Compressor:        "XCRUSH",
+	}
+	if r := s.CompressionRatio(); r != 2.5 {
+		t.Errorf("compression ratio %v", r)
+	}
+	got := map[string]float64{}
+	for _, m := range s.Metrics() {
+		name := m.Name
+		for _, v := range m.Labels {
+			name += "{" + v + "}"
+		}
+		got[name] = m.Value
+	}
+	for name, v := range map[string]float64{
+		"rdp_received_bytes_total":                            4096,
+		"rdp_decode_seconds_total":                            1.5,
+		"rdp_received_pdus_total{PDUTYPE2_UPDATE}":            3,
+		"rdp_received_pdus_total{FASTPATH_UPDATETYPE_BITMAP}": 5,
+		"rdp_bulk_compressor_info{XCRUSH}":                    1,
+	} {
+		if got[name] != v {
+			t.Errorf("%s = %v, want %v", name, got[name], v)
+		}
+	}
+}
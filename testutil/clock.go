@@ -0,0 +1,101 @@
+package testutil
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Clock is a virtual clock: its time only moves when Advance moves it,
+// firing the timers that come due on the way, so a test of timeouts or
+// pacing runs instantly and always the same.
+type Clock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*Timer
+}
+
+// Timer is a timer of a Clock.
+type Timer struct {
+	c  *Clock
+	at time.Time
+	f  func()
+}
+
+// NewClock returns a clock reading start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Since returns the time elapsed on the clock since t.
+func (c *Clock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// AfterFunc calls f, on the goroutine calling Advance, once the clock has
+// moved d on.
+func (c *Clock) AfterFunc(d time.Duration, f func()) *Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &Timer{c: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// After returns a channel receiving the time of the clock once it has
+// moved d on.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	c.AfterFunc(d, func() { ch <- c.Now() })
+	return ch
+}
+
+// Stop cancels the timer, reporting whether it had not fired yet.
+func (t *Timer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	i := slices.Index(t.c.timers, t)
+	if i < 0 {
+		return false
+	}
+	t.c.timers = slices.Delete(t.c.timers, i, i+1)
+	return true
+}
+
+// Advance moves the clock d on.  The timers due fire in the order of
+// their time, each with the clock reading that time; the timers they set
+// fire as well if they are due before the end of d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		i := -1
+		for j, t := range c.timers {
+			if !t.at.After(end) && (i < 0 || t.at.Before(c.timers[i].at)) {
+				i = j
+			}
+		}
+		if i < 0 {
+			break
+		}
+		t := c.timers[i]
+		c.timers = slices.Delete(c.timers, i, i+1)
+		if t.at.After(c.now) {
+			c.now = t.at
+		}
+		c.mu.Unlock()
+		t.f()
+		c.mu.Lock()
+	}
+	if end.After(c.now) {
+		c.now = end
+	}
+	c.mu.Unlock()
+}
@@ -0,0 +1,45 @@
+package testutil
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testutil.Golden")
+
+// Golden fails t unless got equals the golden file testdata/name of the
+// package under test.  Run the test with -update to write got to the file
+// instead, then review the change to the file:
+//
+//	go test -run TestReplayCapture -update
+func Golden(t testing.TB, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run with -update to create it", err)
+	}
+	if !bytes.Equal(got, want) {
+		i := diffOffset(got, want)
+		t.Errorf("%s differs at offset %d; run with -update to accept\n got %q\nwant %q",
+			path, i, excerpt(got, i), excerpt(want, i))
+	}
+}
+
+// excerpt returns the bytes of b around offset i.
+func excerpt(b []byte, i int) []byte {
+	lo, hi := max(i-32, 0), min(i+32, len(b))
+	return b[lo:hi]
+}
@@ -0,0 +1,91 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nakagami/grdp/emission"
+)
+
+// Hex decodes a hex fixture such as "03 00 00 0b" or a multi-line dump.
+// Whitespace is ignored and "//" starts a comment running to the end of
+// the line.  It panics on malformed input.
+func Hex(s string) []byte {
+	var clean strings.Builder
+	for line := range strings.Lines(s) {
+		line, _, _ = strings.Cut(line, "//")
+		for _, f := range strings.Fields(line) {
+			clean.WriteString(f)
+		}
+	}
+	b, err := hex.DecodeString(clean.String())
+	if err != nil {
+		panic("testutil.Hex: " + err.Error())
+	}
+	return b
+}
+
+// AssertWrites fails t unless tr saw exactly want, in order.  Only the
+// data is compared; use Frames to check channels and fast-path flags.
+func AssertWrites(t testing.TB, tr *Transport, want ...[]byte) {
+	t.Helper()
+	got := tr.Frames()
+	for i := 0; i < len(got) || i < len(want); i++ {
+		switch {
+		case i >= len(want):
+			t.Errorf("unexpected write %d: % x", i, got[i].Data)
+		case i >= len(got):
+			t.Errorf("missing write %d: % x", i, want[i])
+		case !bytes.Equal(got[i].Data, want[i]):
+			t.Errorf("write %d differs at offset %d\n got % x\nwant % x",
+				i, diffOffset(got[i].Data, want[i]), got[i].Data, want[i])
+		}
+	}
+}
+
+func diffOffset(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// Events collects the first argument of each emission of one event.
+type Events[T any] struct {
+	mu  sync.Mutex
+	got []T
+}
+
+// Capture records event on e, for example Capture[error](&x.Emitter,
+// "error").  The argument must have type T.
+func Capture[T any](e *emission.Emitter, event string) *Events[T] {
+	c := &Events[T]{}
+	emission.On1(e, event, func(v T) {
+		c.mu.Lock()
+		c.got = append(c.got, v)
+		c.mu.Unlock()
+	})
+	return c
+}
+
+// All returns the values recorded so far.
+func (c *Events[T]) All() []T {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]T(nil), c.got...)
+}
+
+// Last returns the most recent value and whether there was one.
+func (c *Events[T]) Last() (T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.got) == 0 {
+		var zero T
+		return zero, false
+	}
+	return c.got[len(c.got)-1], true
+}
@@ -0,0 +1,255 @@
+// Package testutil provides fakes for unit testing a single protocol layer.
+//
+// A layer is built on a Transport instead of the layer below it.  The test
+// drives the layer, queues what the peer answers with Reply, delivers the
+// answers with Flush and checks the bytes the layer wrote with AssertWrites:
+//
+//	tr := testutil.NewTransport()
+//	x := x224.New(tr)
+//	tr.Reply("data", connectionConfirm)
+//	x.Connect()
+//	tr.Flush()
+//	testutil.AssertWrites(t, tr, connectionRequest)
+//
+// Pipe connects two layers back to back instead, each Flush passing on
+// what the other wrote.  With a Clock, the writes are stamped with its
+// time and EmitAfter delivers data once the clock has moved on.
+//
+// Golden compares the output of a test, such as the events of a capture
+// replayed with grdp's ReplayCapture, with a file under testdata.
+//
+// The fakes only use the exported API of the layers and of core, so they
+// serve as well for testing the handlers of an application built on
+// grdp: a channel plugin, for one, or the code handling the PDUs of a
+// layer.
+package testutil
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nakagami/grdp/core"
+	"github.com/nakagami/grdp/emission"
+)
+
+// Frame is one write seen by a Transport.
+type Frame struct {
+	// Channel is set for SendToChannel, FastPath for SendFastPath.
+	Channel  string
+	FastPath bool
+	SecFlag  byte
+	Data     []byte
+	// Time is the time of the Clock of the transport at the write, zero
+	// without one.
+	Time time.Time
+}
+
+type reply struct {
+	event string
+	args  []any
+}
+
+// Transport is a scripted fake of the layer below the one under test.  It
+// implements core.Transport, core.FastPathSender and core.ChannelSender,
+// records every write and answers the n-th write with the n-th Reply.
+type Transport struct {
+	emission.Emitter
+
+	mu      sync.Mutex
+	frames  []Frame
+	replies []reply
+	sent    int
+	closed  bool
+	clock   *Clock
+
+	// peer is the other end of a Pipe; inbox holds the writes of the
+	// peer not passed on yet and fastPath receives its fast-path PDUs.
+	peer     *Transport
+	inbox    []Frame
+	fastPath core.FastPathListener
+
+	// WriteErr, when set, is returned by every write.
+	WriteErr error
+}
+
+var (
+	_ core.Transport      = (*Transport)(nil)
+	_ core.FastPathSender = (*Transport)(nil)
+	_ core.ChannelSender  = (*Transport)(nil)
+)
+
+func NewTransport() *Transport {
+	return &Transport{Emitter: *emission.NewEmitter()}
+}
+
+// Pipe returns two transports connected back to back, for a layer and
+// the peer it talks to: the Flush of each emits what the other wrote,
+// the data of Write as "data", that of SendToChannel as "channel" with
+// the channel name and that of SendFastPath to the listener set with
+// SetFastPathListener.  Replies queued with Reply are still emitted.
+func Pipe() (*Transport, *Transport) {
+	a, b := NewTransport(), NewTransport()
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+// SetFastPathListener sets the receiver of the fast-path PDUs the peer
+// of a Pipe sends, as tpkt.TPKT does.
+func (t *Transport) SetFastPathListener(f core.FastPathListener) {
+	t.mu.Lock()
+	t.fastPath = f
+	t.mu.Unlock()
+}
+
+// SetClock stamps the writes with the time of c and lets EmitAfter
+// schedule data on it.
+func (t *Transport) SetClock(c *Clock) {
+	t.mu.Lock()
+	t.clock = c
+	t.mu.Unlock()
+}
+
+// EmitAfter emits event with args once the clock of the transport has
+// moved d on, on the goroutine calling Clock.Advance.  The transport
+// must have a clock.
+func (t *Transport) EmitAfter(d time.Duration, event string, args ...any) {
+	t.mu.Lock()
+	c := t.clock
+	t.mu.Unlock()
+	if c == nil {
+		panic("testutil: EmitAfter on a Transport without a Clock")
+	}
+	c.AfterFunc(d, func() { t.Emit(event, args...) })
+}
+
+// Read reports io.EOF; layers receive data through emitted events.
+func (t *Transport) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (t *Transport) Write(b []byte) (int, error) {
+	return t.record(Frame{Data: b})
+}
+
+func (t *Transport) SendFastPath(secFlag byte, b []byte) (int, error) {
+	return t.record(Frame{FastPath: true, SecFlag: secFlag, Data: b})
+}
+
+func (t *Transport) SendToChannel(channel string, b []byte) (int, error) {
+	return t.record(Frame{Channel: channel, Data: b})
+}
+
+func (t *Transport) record(f Frame) (int, error) {
+	if t.WriteErr != nil {
+		return 0, t.WriteErr
+	}
+	f.Data = append([]byte(nil), f.Data...)
+	t.mu.Lock()
+	if t.clock != nil {
+		f.Time = t.clock.Now()
+	}
+	t.frames = append(t.frames, f)
+	peer := t.peer
+	t.mu.Unlock()
+	if peer != nil {
+		peer.mu.Lock()
+		peer.inbox = append(peer.inbox, f)
+		peer.mu.Unlock()
+	}
+	return len(f.Data), nil
+}
+
+// Close marks the transport closed.  It does not emit "close"; call
+// Emit("close") to simulate the peer hanging up.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	return nil
+}
+
+// Closed reports whether Close was called.
+func (t *Transport) Closed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.closed
+}
+
+// Reply queues event, emitted with args by Flush once one more write has
+// been seen.  Replies are matched to writes in order.
+func (t *Transport) Reply(event string, args ...any) *Transport {
+	t.mu.Lock()
+	t.replies = append(t.replies, reply{event, args})
+	t.mu.Unlock()
+	return t
+}
+
+// Flush emits the replies whose write has been seen, including those due
+// to writes made by the layer while handling an earlier reply, then what
+// the peer of a Pipe wrote.  Replies are not emitted from inside Write, so
+// a layer may register its listener after writing, as the real transports
+// allow.  Flush reports whether it emitted anything.
+func (t *Transport) Flush() bool {
+	emitted := false
+	for {
+		t.mu.Lock()
+		if t.sent < len(t.replies) && t.sent < len(t.frames) {
+			r := t.replies[t.sent]
+			t.sent++
+			t.mu.Unlock()
+			t.Emit(r.event, r.args...)
+			emitted = true
+			continue
+		}
+		if len(t.inbox) == 0 {
+			t.mu.Unlock()
+			return emitted
+		}
+		f := t.inbox[0]
+		t.inbox = t.inbox[1:]
+		fastPath := t.fastPath
+		t.mu.Unlock()
+		switch {
+		case f.FastPath:
+			if fastPath != nil {
+				fastPath.RecvFastPath(f.SecFlag, f.Data)
+			}
+		case f.Channel != "":
+			t.Emit("channel", f.Channel, f.Data)
+		default:
+			t.Emit("data", f.Data)
+		}
+		emitted = true
+	}
+}
+
+// Pump flushes the transports, the two ends of a Pipe, until neither has
+// anything left to emit.
+func Pump(ts ...*Transport) {
+	for {
+		emitted := false
+		for _, t := range ts {
+			if t.Flush() {
+				emitted = true
+			}
+		}
+		if !emitted {
+			return
+		}
+	}
+}
+
+// Pending returns the number of replies not emitted yet.
+func (t *Transport) Pending() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.replies) - t.sent
+}
+
+// Frames returns the writes seen so far.
+func (t *Transport) Frames() []Frame {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Frame(nil), t.frames...)
+}
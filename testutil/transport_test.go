@@ -0,0 +1,89 @@
+package testutil
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	c := NewClock(start)
+	var fired []time.Duration
+	record := func() { fired = append(fired, c.Since(start)) }
+	c.AfterFunc(3*time.Second, record)
+	c.AfterFunc(time.Second, func() {
+		record()
+		c.AfterFunc(time.Second, record) // due at 2s, within the same Advance
+	})
+	c.AfterFunc(5*time.Second, record).Stop()
+	after := c.After(4 * time.Second)
+
+	c.Advance(3 * time.Second)
+	if want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}; !slices.Equal(fired, want) {
+		t.Errorf("fired at %v, want %v", fired, want)
+	}
+	select {
+	case <-after:
+		t.Fatal("After fired early")
+	default:
+	}
+	c.Advance(3 * time.Second)
+	if at := <-after; at != start.Add(4*time.Second) {
+		t.Errorf("After fired at %v", at)
+	}
+	if len(fired) != 3 || c.Since(start) != 6*time.Second {
+		t.Errorf("stopped timer fired or clock at %v", c.Since(start))
+	}
+}
+
+type fastPathRecorder [][]byte
+
+func (r *fastPathRecorder) RecvFastPath(secFlag byte, s []byte) { *r = append(*r, s) }
+
+func TestPipe(t *testing.T) {
+	client, server := Pipe()
+	clock := NewClock(time.Unix(1700000000, 0))
+	client.SetClock(clock)
+	var fastPath fastPathRecorder
+	client.SetFastPathListener(&fastPath)
+
+	// the server answers each request, on fast-path after the second
+	var requests [][]byte
+	server.On("data", func(b []byte) {
+		requests = append(requests, b)
+		if len(requests) < 2 {
+			server.Write(append([]byte("re:"), b...))
+		} else {
+			server.SendFastPath(0, b)
+		}
+	})
+	var answers [][]byte
+	client.On("data", func(b []byte) {
+		answers = append(answers, b)
+		clock.Advance(time.Second)
+		client.Write([]byte("two"))
+	})
+	client.Write([]byte("one"))
+	Pump(client, server)
+
+	if len(requests) != 2 || len(answers) != 1 || string(answers[0]) != "re:one" {
+		t.Fatalf("requests %q answers %q", requests, answers)
+	}
+	if len(fastPath) != 1 || string(fastPath[0]) != "two" {
+		t.Errorf("fast-path %q", fastPath)
+	}
+	if f := client.Frames(); f[1].Time.Sub(f[0].Time) != time.Second {
+		t.Errorf("writes at %v and %v", f[0].Time, f[1].Time)
+	}
+
+	var late []byte
+	server.On("channel", func(name string, b []byte) { late = b })
+	client.EmitAfter(time.Minute, "data", []byte("late"))
+	clock.Advance(time.Minute)
+	client.SendToChannel("rdpdr", []byte("chunk"))
+	Pump(client, server)
+	if len(answers) != 2 || string(late) != "chunk" {
+		t.Errorf("answers %q channel %q", answers, late)
+	}
+}
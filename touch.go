@@ -0,0 +1,67 @@
+package grdp
+
+import "github.com/nakagami/grdp/plugin/rdpei"
+
+// TouchBegin puts touch contact id (0 to 255) down at (x, y) through the
+// MS-RDPEI Input Virtual Channel.  Up to rdpei.MaxTouchContacts contacts
+// can be down at once.  The touch methods are no-ops when the server has
+// not opened the channel; Touch reports whether it is available.
+func (g *RdpClient) TouchBegin(id int, x, y int) {
+	g.sendTouch("TouchBegin", id, x, y, rdpei.CONTACT_FLAG_DOWN)
+}
+
+// TouchUpdate moves touch contact id, which must be down, to (x, y).
+func (g *RdpClient) TouchUpdate(id int, x, y int) {
+	g.sendTouch("TouchUpdate", id, x, y, rdpei.CONTACT_FLAG_UPDATE)
+}
+
+// TouchEnd lifts touch contact id at (x, y).
+func (g *RdpClient) TouchEnd(id int, x, y int) {
+	g.sendTouch("TouchEnd", id, x, y, rdpei.CONTACT_FLAG_UP)
+}
+
+// TouchCancel lifts touch contact id without completing its gesture, for
+// example when the frontend hands the touch sequence to the system.
+func (g *RdpClient) TouchCancel(id int, x, y int) {
+	g.sendTouch("TouchCancel", id, x, y, rdpei.CONTACT_FLAG_UP|rdpei.CONTACT_FLAG_CANCELED)
+}
+
+// Touch reports whether the server accepts touch and pen input.
+func (g *RdpClient) Touch() bool {
+	return g.eventReady.Load() && g.touchHandler != nil && g.touchHandler.Ready()
+}
+
+func (g *RdpClient) sendTouch(name string, id int, x, y int, flags uint32) {
+	if !g.Touch() {
+		return
+	}
+	if id < 0 || id > 0xFF {
+		g.log.Warn(name+": contact id out of range", "id", id)
+		return
+	}
+	g.flushMouseMove()
+	g.flushWheel()
+	if !g.touchHandler.Touch(uint8(id), int32(x), int32(y), flags) {
+		g.log.Debug(name+": contact not sent", "id", id)
+		return
+	}
+	g.notifyGfxLocalInput()
+}
+
+// PenEvent sends one pen (stylus) sample, such as a hover
+// (CONTACT_FLAG_UPDATE|CONTACT_FLAG_INRANGE), a touch down
+// (CONTACT_FLAG_DOWN|CONTACT_FLAG_INRANGE|CONTACT_FLAG_INCONTACT) or a
+// lift (CONTACT_FLAG_UP|CONTACT_FLAG_INRANGE).  Servers below MS-RDPEI
+// version 2.0 do not support pen input and the sample is dropped.
+func (g *RdpClient) PenEvent(p rdpei.PenContact) {
+	if !g.Touch() {
+		return
+	}
+	g.flushMouseMove()
+	g.flushWheel()
+	if !g.touchHandler.Pen(p) {
+		g.log.Debug("PenEvent: pen input not supported by the server")
+		return
+	}
+	g.notifyGfxLocalInput()
+}
@@ -0,0 +1,234 @@
+package grdp
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// VideoFormat selects the stream written by a VideoExporter.
+type VideoFormat int
+
+const (
+	// VideoY4M writes a YUV4MPEG2 stream, 4:2:0 BT.601, which ffmpeg reads
+	// without further options:
+	//
+	//	ffmpeg -i - -c:v libx264 session.mp4
+	VideoY4M VideoFormat = iota
+	// VideoRGBA writes the bare RGBA pixels of each frame, which need
+	// the size and rate on the ffmpeg command line:
+	//
+	//	ffmpeg -f rawvideo -pix_fmt rgba -s 1920x1080 -r 30 -i - session.mp4
+	VideoRGBA
+)
+
+// VideoExporter composites bitmap updates into a screen image and writes
+// it to an io.Writer as a constant frame rate video stream, typically the
+// standard input of ffmpeg.  Frame n is presented at n/fps seconds after
+// the exporter started: a frame is written every 1/fps seconds, repeating
+// the previous one when the screen did not change, so the video keeps the
+// timing of the session.  Pass Paint to RdpClient.OnBitmap:
+//
+//	cmd := exec.Command("ffmpeg", "-i", "-", "session.mp4")
+//	stdin, _ := cmd.StdinPipe()
+//	cmd.Start()
+//	v := grdp.NewVideoExporter(stdin, w, h, grdp.VideoY4M, 15)
+//	client.OnBitmap(v.Paint)
+//	...
+//	v.Close()
+//	stdin.Close()
+//	cmd.Wait()
+type VideoExporter struct {
+	fb *framebuffer
+
+	w       io.Writer
+	format  VideoFormat
+	fps     float64
+	start   time.Time
+	written int64
+	frame   []byte // the last frame written
+
+	mu      sync.Mutex
+	overlay func(dst draw.Image)
+	err     error
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewVideoExporter starts an exporter writing a width x height video at
+// fps frames per second to w from its own goroutine.  fps <= 0 selects 10
+// frames per second.
+func NewVideoExporter(w io.Writer, width, height int, format VideoFormat, fps float64) *VideoExporter {
+	if fps <= 0 {
+		fps = 10
+	}
+	v := &VideoExporter{
+		fb:     newFramebuffer(width, height),
+		w:      w,
+		format: format,
+		fps:    fps,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go v.loop()
+	return v
+}
+
+// SetOverlay registers f to draw on each frame before it is written,
+// typically RdpClient.DrawCursor with the soft cursor enabled.
+func (v *VideoExporter) SetOverlay(f func(dst draw.Image)) *VideoExporter {
+	v.mu.Lock()
+	v.overlay = f
+	v.mu.Unlock()
+	return v
+}
+
+// Paint composites bitmaps into the screen image.  It copies the pixels,
+// so it can be used directly as an OnBitmap callback.
+func (v *VideoExporter) Paint(bitmaps []Bitmap) {
+	v.fb.paint(bitmaps)
+}
+
+// Err returns the write error that stopped the stream, if any.
+func (v *VideoExporter) Err() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.err
+}
+
+// Close stops the exporter goroutine and returns Err.  It does not close
+// the writer.
+func (v *VideoExporter) Close() error {
+	v.closeOnce.Do(func() {
+		close(v.stop)
+		<-v.done
+	})
+	return v.Err()
+}
+
+func (v *VideoExporter) loop() {
+	defer close(v.done)
+	v.start = time.Now()
+	if v.format == VideoY4M {
+		num, den := frameRate(v.fps)
+		r := v.fb.img.Rect
+		if _, err := fmt.Fprintf(v.w, "YUV4MPEG2 W%d H%d F%d:%d Ip A1:1 C420jpeg\n", r.Dx(), r.Dy(), num, den); err != nil {
+			v.fail(err)
+			return
+		}
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / v.fps))
+	defer ticker.Stop()
+	for {
+		if err := v.writeDue(); err != nil {
+			v.fail(err)
+			return
+		}
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeDue writes the frames whose presentation time has come: the
+// screen if it changed, then repeats of it for the ticks a slow writer
+// made the exporter miss.
+func (v *VideoExporter) writeDue() error {
+	due := int64(time.Since(v.start).Seconds()*v.fps) + 1
+	if v.written >= due {
+		return nil
+	}
+	if img := v.fb.take(false); img != nil || v.frame == nil {
+		if img == nil {
+			img, _ = v.fb.snapshot(nil)
+		}
+		v.mu.Lock()
+		overlay := v.overlay
+		v.mu.Unlock()
+		if overlay != nil {
+			overlay(img)
+		}
+		v.frame = v.encode(img, v.frame[:0])
+	}
+	for ; v.written < due; v.written++ {
+		if _, err := v.w.Write(v.frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *VideoExporter) fail(err error) {
+	v.mu.Lock()
+	v.err = fmt.Errorf("video export: %w", err)
+	v.mu.Unlock()
+}
+
+// encode appends img to b as one frame of the stream.
+func (v *VideoExporter) encode(img *image.RGBA, b []byte) []byte {
+	if v.format == VideoRGBA {
+		start := len(b)
+		b = append(b, img.Pix...)
+		for i := start + 3; i < len(b); i += 4 {
+			b[i] = 0xFF
+		}
+		return b
+	}
+	return appendI420(append(b, "FRAME\n"...), img)
+}
+
+// appendI420 appends the Y, U and V planes of img, with BT.601 limited
+// range and chroma averaged over 2x2 blocks.
+func appendI420(b []byte, img *image.RGBA) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	for y := range h {
+		row := img.Pix[y*img.Stride:]
+		for x := range w {
+			r, g, bl := int(row[4*x]), int(row[4*x+1]), int(row[4*x+2])
+			b = append(b, uint8(16+(66*r+129*g+25*bl+128)>>8))
+		}
+	}
+	cw, ch := (w+1)/2, (h+1)/2
+	u := make([]byte, 0, cw*ch)
+	vp := make([]byte, 0, cw*ch)
+	for cy := range ch {
+		for cx := range cw {
+			var r, g, bl, n int
+			for y := 2 * cy; y < min(2*cy+2, h); y++ {
+				for x := 2 * cx; x < min(2*cx+2, w); x++ {
+					p := img.Pix[y*img.Stride+4*x:]
+					r, g, bl, n = r+int(p[0]), g+int(p[1]), bl+int(p[2]), n+1
+				}
+			}
+			r, g, bl = r/n, g/n, bl/n
+			u = append(u, uint8(128+(-38*r-74*g+112*bl+128)>>8))
+			vp = append(vp, uint8(128+(112*r-94*g-18*bl+128)>>8))
+		}
+	}
+	return append(append(b, u...), vp...)
+}
+
+// frameRate returns fps as the ratio of a YUV4MPEG2 header, exact for
+// rates such as 30000/1001.
+func frameRate(fps float64) (num, den int) {
+	if fps == math.Trunc(fps) {
+		return int(fps), 1
+	}
+	num, den = int(math.Round(fps*1001)), 1001
+	if math.Abs(float64(num)/float64(den)-fps) > 1e-6 {
+		num, den = int(math.Round(fps*1000)), 1000
+	}
+	a, b := num, den
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return num / a, den / a
+}
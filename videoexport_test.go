@@ -0,0 +1,43 @@
+package grdp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestVideoExporterY4M(t *testing.T) {
+	var buf bytes.Buffer
+	v := NewVideoExporter(&buf, 4, 2, VideoY4M, 100)
+	v.Paint([]Bitmap{solid(0, 0, 4, 2, 0xFF, 0, 0)})
+	time.Sleep(50 * time.Millisecond)
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := "YUV4MPEG2 W4 H2 F100:1 Ip A1:1 C420jpeg\n"
+	if !bytes.HasPrefix(buf.Bytes(), []byte(header)) {
+		t.Fatalf("header %q", buf.Bytes()[:min(buf.Len(), len(header))])
+	}
+	frames := buf.Bytes()[len(header):]
+	const size = len("FRAME\n") + 4*2 + 2*2*1
+	if len(frames) < 2*size || len(frames)%size != 0 {
+		t.Fatalf("%d bytes of frames", len(frames))
+	}
+	// The last frame is red: Y 82, U 90, V 240.
+	last := frames[len(frames)-size:]
+	if string(last[:6]) != "FRAME\n" || last[6] != 82 || last[14] != 90 || last[16] != 240 {
+		t.Errorf("last frame % x", last)
+	}
+}
+
+func TestFrameRate(t *testing.T) {
+	for _, c := range []struct {
+		fps      float64
+		num, den int
+	}{{30, 30, 1}, {30000.0 / 1001, 30000, 1001}, {12.5, 25, 2}} {
+		if num, den := frameRate(c.fps); num != c.num || den != c.den {
+			t.Errorf("frameRate(%v) = %d:%d", c.fps, num, den)
+		}
+	}
+}